@@ -0,0 +1,203 @@
+package afpacket
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var errClosed = errors.New("afpacket: use of closed socket")
+
+// Config configures a [Conn].
+type Config struct {
+	// Promiscuous puts the interface in promiscuous mode for as long as the
+	// socket is open so that frames addressed to the stack's hardware address
+	// are received.
+	Promiscuous bool
+	// RecvBuffer is the size in bytes of the socket's kernel receive buffer.
+	// Frames received while it is full are dropped and counted in [Stats].
+	// If zero the system default is used.
+	RecvBuffer int
+}
+
+// Stats are the kernel's counters of a [Conn] since it was opened.
+type Stats struct {
+	// Packets counts frames received by the socket, dropped ones included.
+	Packets uint32
+	// Drops counts frames dropped for lack of space in the receive buffer.
+	Drops uint32
+}
+
+// Conn is an AF_PACKET socket bound to a network interface that sends and
+// receives whole Ethernet frames. Its methods are not safe for concurrent use.
+type Conn struct {
+	fd    int
+	iface net.Interface
+	stats Stats
+}
+
+// Open opens a raw AF_PACKET socket bound to the network interface named ifname.
+// The socket is non-blocking: see [Conn.Recv] and [Conn.Wait].
+func Open(ifname string, cfg Config) (*Conn, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	proto := htons(syscall.ETH_P_ALL)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	conn := &Conn{fd: fd, iface: *iface}
+	err = conn.setup(proto, cfg)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *Conn) setup(proto uint16, cfg Config) error {
+	err := syscall.Bind(c.fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: c.iface.Index})
+	if err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	if cfg.RecvBuffer > 0 {
+		err = syscall.SetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, cfg.RecvBuffer)
+		if err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if cfg.Promiscuous {
+		// Membership is dropped by the kernel when the socket is closed.
+		mreq := packetMreq{ifindex: int32(c.iface.Index), typ: syscall.PACKET_MR_PROMISC}
+		raw := (*[unsafe.Sizeof(mreq)]byte)(unsafe.Pointer(&mreq))
+		err = syscall.SetsockoptString(c.fd, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, string(raw[:]))
+		if err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
+
+// HardwareAddr6 returns the hardware address of the interface. It is usually
+// not the address the stack should use, see the package documentation.
+func (c *Conn) HardwareAddr6() (hw [6]byte) {
+	copy(hw[:], c.iface.HardwareAddr)
+	return hw
+}
+
+// MTU returns the MTU of the interface with the Ethernet header included, as
+// expected by [github.com/soypat/seqs/stacks.PortStackConfig].
+func (c *Conn) MTU() int {
+	const sizeEthernetHeader = 14
+	return c.iface.MTU + sizeEthernetHeader
+}
+
+// Recv reads the next frame received on the interface into dst and returns
+// its length, or zero if no frame is available. Frames sent through the
+// interface, by the host or by Send, are skipped. Frames longer than dst are
+// truncated.
+func (c *Conn) Recv(dst []byte) (int, error) {
+	if c.fd < 0 {
+		return 0, errClosed
+	}
+	for {
+		n, from, err := syscall.Recvfrom(c.fd, dst, syscall.MSG_TRUNC)
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EINTR:
+			return 0, nil
+		case err != nil:
+			return 0, os.NewSyscallError("recvfrom", err)
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		if n > len(dst) {
+			n = len(dst) // MSG_TRUNC returns the length of the frame off the wire.
+		}
+		return n, nil
+	}
+}
+
+// Send writes the Ethernet frame to the interface. A full transmit queue is
+// reported as an error, which [github.com/soypat/seqs/stacks.PortStack.TxDone]
+// may be notified of.
+func (c *Conn) Send(frame []byte) error {
+	if c.fd < 0 {
+		return errClosed
+	}
+	for {
+		_, err := syscall.Write(c.fd, frame)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return os.NewSyscallError("write", err)
+		}
+		return nil
+	}
+}
+
+// Wait blocks until a frame is available to [Conn.Recv] or timeout elapses
+// and reports whether a frame is available.
+func (c *Conn) Wait(timeout time.Duration) (bool, error) {
+	if c.fd < 0 {
+		return false, errClosed
+	}
+	var set syscall.FdSet
+	bits := 8 * int(unsafe.Sizeof(set.Bits[0]))
+	set.Bits[c.fd/bits] |= 1 << uint(c.fd%bits)
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+	n, err := syscall.Select(c.fd+1, &set, nil, nil, &tv)
+	if err == syscall.EINTR {
+		return false, nil
+	} else if err != nil {
+		return false, os.NewSyscallError("select", err)
+	}
+	return n > 0, nil
+}
+
+// Stats returns the kernel's counters of the socket.
+func (c *Conn) Stats() (Stats, error) {
+	if c.fd < 0 {
+		return c.stats, errClosed
+	}
+	// The syscall package lacks a generic getsockopt. struct tpacket_stats
+	// has the size of struct ip_mreq so it is read as one.
+	mreq, err := syscall.GetsockoptIPMreq(c.fd, syscall.SOL_PACKET, syscall.PACKET_STATISTICS)
+	if err != nil {
+		return c.stats, os.NewSyscallError("getsockopt", err)
+	}
+	st := (*Stats)(unsafe.Pointer(mreq))
+	// The kernel resets the counters on every read so they are accumulated here.
+	c.stats.Packets += st.Packets
+	c.stats.Drops += st.Drops
+	return c.stats, nil
+}
+
+// Close closes the socket, leaving promiscuous mode if it was entered.
+func (c *Conn) Close() error {
+	if c.fd < 0 {
+		return errClosed
+	}
+	err := syscall.Close(c.fd)
+	c.fd = -1
+	return err
+}
+
+// packetMreq is struct packet_mreq of linux/if_packet.h.
+type packetMreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	address [8]byte
+}
+
+// htons converts a short from host to network byte order.
+func htons(v uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&v))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
@@ -0,0 +1,45 @@
+package afpacket
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoopback(t *testing.T) {
+	conn, err := Open("lo", Config{})
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("AF_PACKET sockets require CAP_NET_RAW")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Sent to the loopback's all zero hardware address with a local experimental EtherType.
+	frame := make([]byte, 60)
+	frame[12], frame[13] = 0x88, 0xb5
+	copy(frame[14:], "afpacket loopback")
+	err = conn.Send(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [128]byte
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		conn.Wait(10 * time.Millisecond)
+		n, err := conn.Recv(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		} else if n > 0 && bytes.Equal(buf[:n], frame) {
+			st, err := conn.Stats()
+			if err != nil {
+				t.Fatal(err)
+			} else if st.Packets == 0 {
+				t.Error("no received packets counted")
+			}
+			return
+		}
+	}
+	t.Fatal("sent frame not received")
+}
@@ -0,0 +1,26 @@
+// Package afpacket implements a NIC driver over Linux AF_PACKET sockets so
+// stacks may be run and benchmarked on a host network interface, i.e: a veth
+// pair or a dedicated interface, at rates well beyond what a TUN device or
+// an embedded target sustains.
+//
+// The stack should be given a hardware and IP address of its own. Frames
+// addressed to it are only delivered by the kernel when the interface is in
+// promiscuous mode, see [Config.Promiscuous]. The host's kernel keeps
+// processing the frames it receives, so a dedicated interface without an IP
+// address configured avoids it answering on behalf of the stack.
+//
+// Opening AF_PACKET sockets requires the CAP_NET_RAW capability.
+//
+// A typical main loop polls the stack with the [Conn.Recv] and [Conn.Send]
+// methods:
+//
+//	for {
+//		_, err := stack.Poll(buf, conn.Recv, conn.Send, stacks.PollBudget{})
+//		if err != nil {
+//			return err
+//		}
+//		conn.Wait(time.Millisecond)
+//	}
+//
+// The package is only supported on Linux.
+package afpacket
@@ -0,0 +1,224 @@
+// Command seqs-sim runs seqs stacks over a simulated ethernet link on the host.
+// It loads a JSON scenario describing link impairments (loss, latency) and a
+// list of scripted actions, runs each action on a fresh pair of stacks and
+// reports per-run statistics.
+//
+// Example scenario:
+//
+//	{
+//		"seed": 1,
+//		"lossPercent": 0,
+//		"latencyTicks": 2,
+//		"maxTicks": 5000,
+//		"actions": [
+//			{"kind": "dhcp"},
+//			{"kind": "tcp", "bytes": 65536}
+//		]
+//	}
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/netip"
+	"os"
+
+	"github.com/soypat/seqs/eth/dhcp"
+	"github.com/soypat/seqs/stacks"
+	"github.com/soypat/seqs/stacks/stackstest"
+)
+
+const mtu = 1500
+
+type scenario struct {
+	Seed int64 `json:"seed"`
+	// LossPercent is the probability in percent of a frame being lost in transit.
+	LossPercent float64 `json:"lossPercent"`
+	// LatencyTicks is the amount of simulation ticks a frame takes to arrive.
+	LatencyTicks int `json:"latencyTicks"`
+	// MaxTicks is the amount of ticks after which an action is considered failed.
+	MaxTicks int      `json:"maxTicks"`
+	Actions  []action `json:"actions"`
+}
+
+type action struct {
+	// Kind is one of "dhcp" or "tcp".
+	Kind string `json:"kind"`
+	// Bytes is the amount of data sent from client to server in a "tcp" action.
+	Bytes int `json:"bytes"`
+}
+
+var defaultScenario = scenario{
+	Seed:         1,
+	LatencyTicks: 1,
+	MaxTicks:     10000,
+	Actions:      []action{{Kind: "dhcp"}, {Kind: "tcp", Bytes: 32 * 1024}},
+}
+
+func main() {
+	var (
+		flagScenario = flag.String("scenario", "", "path to JSON scenario file. If empty runs a default scenario")
+		flagLoss     = flag.Float64("loss", -1, "override scenario loss percentage")
+		flagLatency  = flag.Int("latency", -1, "override scenario latency in ticks")
+		flagVerbose  = flag.Bool("v", false, "enable debug logging of stacks")
+	)
+	flag.Parse()
+	sc := defaultScenario
+	if *flagScenario != "" {
+		b, err := os.ReadFile(*flagScenario)
+		if err != nil {
+			fatalf("reading scenario: %s", err)
+		}
+		sc = scenario{}
+		err = json.Unmarshal(b, &sc)
+		if err != nil {
+			fatalf("parsing scenario: %s", err)
+		}
+	}
+	if *flagLoss >= 0 {
+		sc.LossPercent = *flagLoss
+	}
+	if *flagLatency >= 0 {
+		sc.LatencyTicks = *flagLatency
+	}
+	if sc.MaxTicks <= 0 {
+		sc.MaxTicks = defaultScenario.MaxTicks
+	}
+	var logger *slog.Logger
+	if *flagVerbose {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+
+	rng := rand.New(rand.NewSource(sc.Seed))
+	failed := false
+	for i, act := range sc.Actions {
+		link := newLink(rng, sc, logger)
+		var err error
+		switch act.Kind {
+		case "dhcp":
+			err = runDHCP(link, sc.MaxTicks, rng)
+		case "tcp":
+			err = runTCP(link, sc.MaxTicks, act.Bytes)
+		default:
+			err = errors.New("unknown action kind " + act.Kind)
+		}
+		status := "ok"
+		if err != nil {
+			status = "FAIL: " + err.Error()
+			failed = true
+		}
+		st := link.Stats()
+		fmt.Printf("action[%d] %-5s ticks=%-6d frames=%-6d lost=%-5d bytes=%-8d %s\n",
+			i, act.Kind, st.Ticks, st.Frames, st.Lost, st.Bytes, status)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// newLink returns a simulated point-to-point ethernet link between two stacks
+// impaired as described by sc.
+func newLink(rng *rand.Rand, sc scenario, logger *slog.Logger) *stackstest.Link {
+	var cfgs [2]stacks.PortStackConfig
+	for i := range cfgs {
+		cfgs[i] = stacks.PortStackConfig{
+			MAC:             [6]byte{0x02, 0, 0, 0, 0, byte(i + 1)},
+			MaxOpenPortsUDP: 1,
+			MaxOpenPortsTCP: 1,
+			MTU:             mtu,
+			Logger:          logger,
+		}
+	}
+	lcfg := stackstest.LinkConfig{
+		Loss:    sc.LossPercent / 100,
+		Latency: sc.LatencyTicks,
+		Rand:    rng,
+	}
+	return stackstest.NewLink(lcfg, cfgs[0], cfgs[1])
+}
+
+func runDHCP(link *stackstest.Link, maxTicks int, rng *rand.Rand) error {
+	cstack, sstack := link.Stacks()
+	client := stacks.NewDHCPClient(cstack, dhcp.DefaultClientPort)
+	server := stacks.NewDHCPServer(sstack, netip.AddrFrom4([4]byte{192, 168, 1, 1}), dhcp.DefaultServerPort)
+	err := server.Start()
+	if err != nil {
+		return err
+	}
+	err = client.BeginRequest(stacks.DHCPRequestConfig{
+		RequestedAddr: netip.AddrFrom4([4]byte{192, 168, 1, 69}),
+		Xid:           uint32(rng.Int31()) | 1,
+		Hostname:      "seqs-sim",
+	})
+	if err != nil {
+		return err
+	}
+	return link.Run(maxTicks, func() bool { return client.State() == dhcp.StateBound })
+}
+
+func runTCP(link *stackstest.Link, maxTicks, size int) error {
+	const (
+		bufSize    = 2048
+		serverPort = 80
+	)
+	cstack, sstack := link.Stacks()
+	cstack.SetAddr(netip.AddrFrom4([4]byte{192, 168, 1, 2}))
+	sstack.SetAddr(netip.AddrFrom4([4]byte{192, 168, 1, 1}))
+	cfg := stacks.TCPConnConfig{TxBufSize: bufSize, RxBufSize: bufSize}
+	client, err := stacks.NewTCPConn(cstack, cfg)
+	if err != nil {
+		return err
+	}
+	server, err := stacks.NewTCPConn(sstack, cfg)
+	if err != nil {
+		return err
+	}
+	err = server.OpenListenTCP(serverPort, 0x1000)
+	if err != nil {
+		return err
+	}
+	remote := netip.AddrPortFrom(sstack.Addr(), serverPort)
+	err = client.OpenDialTCP(1025, sstack.HardwareAddr6(), remote, 0x2000)
+	if err != nil {
+		return err
+	}
+	var data [bufSize]byte
+	sent, received := 0, 0
+	var writeErr error
+	err = link.Run(maxTicks, func() bool {
+		if client.State().IsSynchronized() && sent < size {
+			// Write only what fits so that the single-threaded simulation never blocks.
+			chunk := client.AvailableOutput()
+			if size-sent < chunk {
+				chunk = size - sent
+			}
+			if chunk > 0 {
+				ngot, err := client.Write(data[:chunk])
+				sent += ngot
+				if err != nil && err != io.EOF {
+					writeErr = err
+					return true
+				}
+			}
+		}
+		if server.BufferedInput() > 0 {
+			ngot, _ := server.Read(data[:])
+			received += ngot
+		}
+		return received >= size
+	})
+	if err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "seqs-sim: "+format+"\n", args...)
+	os.Exit(1)
+}
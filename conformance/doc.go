@@ -0,0 +1,11 @@
+// Package conformance contains a catalog of RFC 9293 (which obsoletes RFC 793)
+// and RFC 1122 mandated TCP behaviors tested against [seqs.ControlBlock].
+//
+// The package has no exported API; run its tests to check what is supported:
+//
+//	go test -v github.com/soypat/seqs/conformance
+//
+// Each case references the RFC section it covers. Cases describing behavior
+// the implementation knowingly diverges from are annotated with the reason and
+// reported as skipped, so the test output doubles as a support matrix.
+package conformance
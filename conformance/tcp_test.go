@@ -0,0 +1,398 @@
+package conformance_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/soypat/seqs"
+)
+
+const (
+	issA, issB = 100, 300
+	wndA, wndB = 1000, 1000
+	synack     = seqs.FlagSYN | seqs.FlagACK
+	finack     = seqs.FlagFIN | seqs.FlagACK
+	pshack     = seqs.FlagPSH | seqs.FlagACK
+)
+
+type conformanceCase struct {
+	// ref is the RFC and section mandating the behavior.
+	ref  string
+	desc string
+	// divergence, if non-empty, documents why the implementation does not
+	// comply. A failing case with a divergence is skipped instead of failed.
+	divergence string
+	test       func() error
+}
+
+var catalog = []conformanceCase{
+	{
+		ref:  "RFC 9293 3.5",
+		desc: "three-way handshake synchronizes both ends",
+		test: func() error {
+			_, err := established()
+			return err
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.4",
+		desc: "segment at RCV.NXT within window is accepted and acknowledged",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			err = tcb.Recv(seqs.Segment{SEQ: issB + 1, ACK: issA + 1, Flags: pshack, WND: wndB, DATALEN: 10})
+			if err != nil {
+				return err
+			}
+			return wantPending(tcb, seqs.Segment{SEQ: issA + 1, ACK: issB + 11, Flags: seqs.FlagACK, WND: wndA})
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.4",
+		desc: "segment with SEQ beyond receive window is not acceptable",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			err = tcb.Recv(seqs.Segment{SEQ: issB + 1 + wndA + 10, ACK: issA + 1, Flags: pshack, WND: wndB, DATALEN: 10})
+			if err == nil {
+				return errors.New("out of window segment accepted")
+			}
+			return wantState(tcb, seqs.StateEstablished)
+		},
+	},
+	{
+		ref:        "RFC 9293 3.10.7.4",
+		desc:       "unacceptable segment elicits an ACK (unless RST)",
+		divergence: "rejected segments are dropped silently; the caller is expected to handle out-of-window segments",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			tcb.Recv(seqs.Segment{SEQ: issB + 1 + wndA + 10, ACK: issA + 1, Flags: pshack, WND: wndB, DATALEN: 10})
+			return wantPending(tcb, seqs.Segment{SEQ: issA + 1, ACK: issB + 1, Flags: seqs.FlagACK, WND: wndA})
+		},
+	},
+	{
+		ref:        "RFC 9293 3.10.7.4",
+		desc:       "out-of-order segment within window is acceptable",
+		divergence: "ControlBlock only admits sequential segments (SEQ == RCV.NXT), see SHLD-31",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			return tcb.Recv(seqs.Segment{SEQ: issB + 11, ACK: issA + 1, Flags: pshack, WND: wndB, DATALEN: 10})
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.4",
+		desc: "zero receive window: empty segment at RCV.NXT is acceptable",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			tcb.SetRecvWindow(0)
+			err = tcb.Recv(seqs.Segment{SEQ: issB + 1, ACK: issA + 1, Flags: seqs.FlagACK, WND: wndB})
+			var reject *seqs.RejectError
+			if errors.As(err, &reject) {
+				return err
+			}
+			return nil
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.4",
+		desc: "zero receive window: segment carrying data is not acceptable",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			tcb.SetRecvWindow(0)
+			err = tcb.Recv(seqs.Segment{SEQ: issB + 1, ACK: issA + 1, Flags: pshack, WND: wndB, DATALEN: 1})
+			if err == nil {
+				return errors.New("data accepted on zero window")
+			}
+			return nil
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.4",
+		desc: "zero send window: no data is sent until window opens",
+		test: func() error {
+			tcb, err := establishedWnd(0)
+			if err != nil {
+				return err
+			}
+			seg, ok := tcb.PendingSegment(10)
+			if ok && seg.DATALEN > 0 {
+				return fmt.Errorf("data segment produced with zero send window: %+v", seg)
+			}
+			return nil
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.4",
+		desc: "ACK of unsent data (SEG.ACK > SND.NXT) is dropped and answered with an ACK",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			err = tcb.Recv(seqs.Segment{SEQ: issB + 1, ACK: issA + 50, Flags: seqs.FlagACK, WND: wndB})
+			if err == nil {
+				return errors.New("ACK of unsent data accepted")
+			}
+			return wantPending(tcb, seqs.Segment{SEQ: issA + 1, ACK: issB + 1, Flags: seqs.FlagACK, WND: wndA})
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.4",
+		desc: "duplicate ACK (SEG.ACK < SND.UNA) is ignored",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			tcb.Recv(seqs.Segment{SEQ: issB + 1, ACK: issA, Flags: seqs.FlagACK, WND: wndB})
+			if seg, ok := tcb.PendingSegment(0); ok {
+				return fmt.Errorf("unexpected response to duplicate ACK: %+v", seg)
+			}
+			return wantState(tcb, seqs.StateEstablished)
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.4",
+		desc: "retransmitted SYN|ACK in synchronized state is acknowledged without advancing RCV.NXT",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			err = tcb.Recv(seqs.Segment{SEQ: issB, ACK: issA + 1, Flags: synack, WND: wndB})
+			if err == nil {
+				return errors.New("SYN accepted in synchronized state")
+			}
+			return wantPending(tcb, seqs.Segment{SEQ: issA + 1, ACK: issB + 1, Flags: seqs.FlagACK, WND: wndA})
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.4 / RFC 5961 3.2",
+		desc: "RST with SEQ == RCV.NXT resets a synchronized connection",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			tcb.Recv(seqs.Segment{SEQ: issB + 1, Flags: seqs.FlagRST})
+			return wantState(tcb, seqs.StateClosed)
+		},
+	},
+	{
+		ref:        "RFC 9293 3.10.7.4 / RFC 5961 3.2",
+		desc:       "RST in window but SEQ != RCV.NXT elicits a challenge ACK",
+		divergence: "sequential-only admission rejects the RST before the challenge ACK check is reached",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			tcb.Recv(seqs.Segment{SEQ: issB + 10, Flags: seqs.FlagRST})
+			if err := wantState(tcb, seqs.StateEstablished); err != nil {
+				return err
+			}
+			return wantPending(tcb, seqs.Segment{SEQ: issA + 1, ACK: issB + 1, Flags: seqs.FlagACK, WND: wndA})
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.3",
+		desc: "SYN-SENT: ACK outside of ISS..SND.NXT elicits RST with SEQ=SEG.ACK",
+		test: func() error {
+			var tcb seqs.ControlBlock
+			err := openSynSent(&tcb)
+			if err != nil {
+				return err
+			}
+			tcb.Recv(seqs.Segment{SEQ: issB, ACK: issA + 500, Flags: synack, WND: wndB})
+			seg, ok := tcb.PendingSegment(0)
+			if !ok || !seg.Flags.HasAny(seqs.FlagRST) || seg.SEQ != issA+500 {
+				return fmt.Errorf("want RST with SEQ=%d, got %+v (ok=%v)", issA+500, seg, ok)
+			}
+			return nil
+		},
+	},
+	{
+		ref:        "RFC 9293 3.10.7.3",
+		desc:       "SYN-SENT: RST with acceptable ACK enters CLOSED",
+		divergence: "ControlBlock returns to LISTEN on RST in pre-established states so the TCB can be reused",
+		test: func() error {
+			var tcb seqs.ControlBlock
+			err := openSynSent(&tcb)
+			if err != nil {
+				return err
+			}
+			tcb.Recv(seqs.Segment{ACK: issA + 1, Flags: seqs.FlagRST | seqs.FlagACK})
+			return wantState(&tcb, seqs.StateClosed)
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.7.4",
+		desc: "FIN in ESTABLISHED is acknowledged and enters CLOSE-WAIT",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			err = tcb.Recv(seqs.Segment{SEQ: issB + 1, ACK: issA + 1, Flags: finack, WND: wndB})
+			if err != nil {
+				return err
+			}
+			if err := wantState(tcb, seqs.StateCloseWait); err != nil {
+				return err
+			}
+			seg, ok := tcb.PendingSegment(0)
+			if !ok || !seg.Flags.HasAny(seqs.FlagACK) || seg.ACK != issB+2 {
+				return fmt.Errorf("want ACK of FIN with ACK=%d, got %+v", issB+2, seg)
+			}
+			return nil
+		},
+	},
+	{
+		ref:  "RFC 9293 3.10.4",
+		desc: "CLOSE in ESTABLISHED queues a FIN and enters FIN-WAIT-1 once sent",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			err = tcb.Close()
+			if err != nil {
+				return err
+			}
+			seg, ok := tcb.PendingSegment(0)
+			if !ok || !seg.Flags.HasAny(seqs.FlagFIN) {
+				return fmt.Errorf("want FIN pending, got %+v", seg)
+			}
+			err = tcb.Send(seg)
+			if err != nil {
+				return err
+			}
+			return wantState(tcb, seqs.StateFinWait1)
+		},
+	},
+	{
+		ref:  "RFC 1122 4.2.2.13",
+		desc: "CLOSE on a LISTEN or SYN-SENT connection deletes the TCB",
+		test: func() error {
+			var tcb seqs.ControlBlock
+			err := openSynSent(&tcb)
+			if err != nil {
+				return err
+			}
+			err = tcb.Close()
+			if err != nil {
+				return err
+			}
+			return wantState(&tcb, seqs.StateClosed)
+		},
+	},
+	{
+		ref:        "RFC 1122 4.2.2.17",
+		desc:       "zero window probe on zero receive window is answered with an ACK",
+		divergence: "rejected segments on zero window are dropped without an ACK; the socket layer sends window updates",
+		test: func() error {
+			tcb, err := established()
+			if err != nil {
+				return err
+			}
+			tcb.SetRecvWindow(0)
+			tcb.Recv(seqs.Segment{SEQ: issB + 1, ACK: issA + 1, Flags: pshack, WND: wndB, DATALEN: 1})
+			return wantPending(tcb, seqs.Segment{SEQ: issA + 1, ACK: issB + 1, Flags: seqs.FlagACK, WND: 0})
+		},
+	},
+	{
+		ref:  "RFC 1122 4.2.3.6",
+		desc: "keepalive segment (SEQ=SND.NXT-1) is recognized by the receiver",
+		test: func() error {
+			a, err := established()
+			if err != nil {
+				return err
+			}
+			if !a.IncomingIsKeepalive(seqs.Segment{SEQ: issB, ACK: issA + 1, Flags: seqs.FlagACK}) {
+				return errors.New("keepalive not recognized")
+			}
+			return nil
+		},
+	},
+}
+
+func TestConformance(t *testing.T) {
+	for _, c := range catalog {
+		c := c
+		t.Run(c.ref+"/"+c.desc, func(t *testing.T) {
+			err := c.test()
+			switch {
+			case err != nil && c.divergence != "":
+				t.Skipf("divergence: %s (%v)", c.divergence, err)
+			case err != nil:
+				t.Errorf("%s: %s: %v", c.ref, c.desc, err)
+			case c.divergence != "":
+				t.Errorf("%s: %s: case passes but is annotated as divergent, update the catalog", c.ref, c.desc)
+			}
+		})
+	}
+}
+
+func openSynSent(tcb *seqs.ControlBlock) error {
+	err := tcb.Open(issA, wndA, seqs.StateSynSent)
+	if err != nil {
+		return err
+	}
+	return tcb.Send(seqs.Segment{SEQ: issA, Flags: seqs.FlagSYN, WND: wndA})
+}
+
+// established returns a ControlBlock that is connected as an active opener
+// with SND.NXT=issA+1 and RCV.NXT=issB+1.
+func established() (*seqs.ControlBlock, error) { return establishedWnd(wndB) }
+
+// establishedWnd is like established but the remote advertises a send window of peerWnd.
+func establishedWnd(peerWnd seqs.Size) (*seqs.ControlBlock, error) {
+	var tcb seqs.ControlBlock
+	err := openSynSent(&tcb)
+	if err != nil {
+		return nil, err
+	}
+	err = tcb.Recv(seqs.Segment{SEQ: issB, ACK: issA + 1, Flags: synack, WND: peerWnd})
+	if err != nil {
+		return nil, err
+	}
+	err = tcb.Send(seqs.Segment{SEQ: issA + 1, ACK: issB + 1, Flags: seqs.FlagACK, WND: wndA})
+	if err != nil {
+		return nil, err
+	}
+	return &tcb, wantState(&tcb, seqs.StateEstablished)
+}
+
+func wantState(tcb *seqs.ControlBlock, want seqs.State) error {
+	if tcb.State() != want {
+		return fmt.Errorf("state=%s want %s", tcb.State(), want)
+	}
+	return nil
+}
+
+func wantPending(tcb *seqs.ControlBlock, want seqs.Segment) error {
+	got, ok := tcb.PendingSegment(int(want.DATALEN))
+	if !ok {
+		return fmt.Errorf("no pending segment, want %+v", want)
+	} else if got != want {
+		return fmt.Errorf("pending segment %+v, want %+v", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package seqs
+
+// congestion is the congestion control state of a connection as described in
+// RFC 5681: slow start, congestion avoidance and the reaction to retransmission
+// timeouts. Fast retransmit and fast recovery are not implemented.
+// The congestion window is measured in octets of sequence space.
+type congestion struct {
+	// cwnd is the congestion window. Zero until the initial window is set once
+	// the sender maximum segment size is known.
+	cwnd Size
+	// ssthresh is the slow start threshold. Zero means arbitrarily high.
+	ssthresh Size
+	// acked accumulates octets acknowledged during congestion avoidance.
+	acked Size
+}
+
+// initialWindow returns the initial congestion window for a sender maximum
+// segment size smss as per RFC 5681 section 3.1.
+func initialWindow(smss Size) Size {
+	switch {
+	case smss > 2190:
+		return 2 * smss
+	case smss > 1095:
+		return 3 * smss
+	}
+	return 4 * smss
+}
+
+// window returns the congestion window, setting the initial window if not yet set.
+func (cc *congestion) window(smss Size) Size {
+	if cc.cwnd == 0 {
+		cc.cwnd = initialWindow(smss)
+	}
+	return cc.cwnd
+}
+
+// onack grows the congestion window on the acknowledgement of acked octets of new data.
+func (cc *congestion) onack(acked, smss Size) {
+	cwnd := cc.window(smss)
+	if cc.ssthresh == 0 || cwnd < cc.ssthresh {
+		// Slow start, RFC 5681 equation (2).
+		if acked > smss {
+			acked = smss
+		}
+		cc.cwnd += acked
+		return
+	}
+	// Congestion avoidance: grow by one segment per window acknowledged (RFC 5681 section 3.1).
+	cc.acked += acked
+	if cc.acked >= cwnd {
+		cc.acked -= cwnd
+		cc.cwnd += smss
+	}
+}
+
+// ontimeout collapses the congestion window to a single segment after a
+// retransmission timeout with flight octets outstanding, RFC 5681 equation (4).
+// The slow start threshold is not lowered again by consecutive timeouts of the same data.
+func (cc *congestion) ontimeout(flight, smss Size) {
+	if cc.cwnd != smss {
+		cc.ssthresh = flight / 2
+		if cc.ssthresh < 2*smss {
+			cc.ssthresh = 2 * smss
+		}
+	}
+	cc.cwnd = smss
+	cc.acked = 0
+}
+
+// CongestionWindow returns the congestion window: the amount of unacknowledged
+// data the connection may have in flight regardless of the remote's window.
+// It starts at the initial window of RFC 5681, grows as sent data is
+// acknowledged and collapses to one segment when [ControlBlock.RetransmitSegment]
+// is called after a retransmission timeout. It is meant for debugging.
+func (tcb *ControlBlock) CongestionWindow() Size {
+	return tcb.cc.window(tcb.SendMSS())
+}
+
+// SlowStartThreshold returns the congestion window size below which the window
+// grows exponentially (slow start) instead of linearly (congestion avoidance).
+// It is zero until the first retransmission timeout, meaning no threshold.
+func (tcb *ControlBlock) SlowStartThreshold() Size { return tcb.cc.ssthresh }
@@ -65,7 +65,12 @@ type ControlBlock struct {
 	pending      [2]Flags
 	state        State
 	challengeAck bool
-	log          *slog.Logger
+	// localOpts and remoteOpts are the TCP options sent and received in SYN segments. See options.go.
+	localOpts  Options
+	remoteOpts Options
+	// cc is the congestion control state. See congestion.go.
+	cc  congestion
+	log *slog.Logger
 }
 
 // sendSpace contains Send Sequence Space data. Its sequence numbers correspond to local data.
@@ -111,12 +116,18 @@ func (tcb *ControlBlock) PendingSegment(payloadLen int) (_ Segment, ok bool) {
 		return Segment{}, false // No pending segment.
 	}
 
-	// Limit payload to what send window allows.
+	// Limit payload to what send and congestion windows allow.
 	inFlight := tcb.snd.inFlight()
-	_ = inFlight
 	maxPayload := tcb.snd.maxSend()
+	if cwnd := tcb.cc.window(tcb.SendMSS()); established && cwnd < inFlight+maxPayload {
+		maxPayload = 0
+		if cwnd > inFlight {
+			maxPayload = cwnd - inFlight
+		}
+	}
 	if payloadLen > int(maxPayload) {
-		if maxPayload == 0 && !tcb.pending[0].HasAny(FlagFIN|FlagRST|FlagSYN) {
+		// A full window holds back data but not control segments or acknowledgements.
+		if maxPayload == 0 && !tcb.pending[0].HasAny(FlagFIN|FlagRST|FlagSYN|FlagACK) {
 			return Segment{}, false
 		} else if maxPayload > tcb.snd.WND {
 			panic("seqs: bad calculation")
@@ -268,6 +279,7 @@ func (tcb *ControlBlock) resetSnd(localISS Value, remoteWND Size) {
 		WND: remoteWND,
 		// UP, WL1, WL2 defaults to zero values.
 	}
+	tcb.cc = congestion{}
 }
 
 func (tcb *ControlBlock) resetRcv(localWND Size, remoteISS Value) {
@@ -283,19 +295,26 @@ func (tcb *ControlBlock) validateIncomingSegment(seg Segment) (err error) {
 	hasAck := flags.HasAll(FlagACK)
 	// Short circuit SEQ checks if SYN present since the incoming segment initializes connection.
 	checkSEQ := !flags.HasAny(FlagSYN)
+	synchronizedSYN := flags.HasAny(FlagSYN) && tcb.state.IsSynchronized()
 	established := tcb.state == StateEstablished
 	preestablished := tcb.state.IsPreestablished()
 	acksOld := hasAck && !LessThan(tcb.snd.UNA, seg.ACK)
 	acksUnsentData := hasAck && !LessThanEq(seg.ACK, tcb.snd.NXT)
 	ctlOrDataSegment := established && (seg.DATALEN > 0 || flags.HasAny(FlagFIN|FlagRST))
 	zeroWindowOK := tcb.rcv.WND == 0 && seg.DATALEN == 0 && seg.SEQ == tcb.rcv.NXT
+	sndShift, _ := tcb.windowShifts()
 	// See section 3.4 of RFC 9293 for more on these checks.
 	switch {
-	case seg.WND > math.MaxUint16:
+	case seg.WND > math.MaxUint16<<sndShift:
 		err = errWindowOverflow
 	case tcb.state == StateClosed:
 		err = io.ErrClosedPipe
 
+	case synchronizedSYN:
+		// Retransmitted SYN or SYN|ACK whose ACK was lost. It must not advance
+		// RCV.NXT and is answered with an ACK. See RFC 9293 section 3.10.7.4.
+		err = errSynchronizedSYN
+
 	case checkSEQ && tcb.rcv.WND == 0 && seg.DATALEN > 0 && seg.SEQ == tcb.rcv.NXT:
 		err = errZeroWindow
 
@@ -311,6 +330,11 @@ func (tcb *ControlBlock) validateIncomingSegment(seg Segment) (err error) {
 		err = errRequireSequential
 	}
 	if err != nil {
+		if (synchronizedSYN || checkSEQ && tcb.state.IsSynchronized() && LessThan(seg.SEQ, tcb.rcv.NXT)) && !flags.HasAny(FlagRST) {
+			// Old duplicate, i.e: a retransmission of a segment whose ACK was lost.
+			// Acknowledge so the remote stops retransmitting. See RFC 9293 section 3.10.7.4.
+			tcb.pending[0] |= FlagACK
+		}
 		return err
 	}
 	if flags.HasAny(FlagRST) {
@@ -325,6 +349,10 @@ func (tcb *ControlBlock) validateIncomingSegment(seg Segment) (err error) {
 	case established && acksOld && !ctlOrDataSegment:
 		err = errDropSegment
 		tcb.pending[0] &= FlagFIN // Completely ignore duplicate ACKs but do not erase fin bit.
+		if seg.ACK == tcb.snd.UNA && seg.SEQ == tcb.rcv.NXT && seg.WND != tcb.snd.WND {
+			// Window update, i.e: the remote reopening a zero window. RFC 9293 section 3.10.7.4.
+			tcb.snd.WND = seg.WND
+		}
 		if isDebug {
 			tcb.debug("rcv:ACK-dup", slog.String("state", tcb.state.String()),
 				slog.Uint64("seg.ack", uint64(seg.ACK)), slog.Uint64("snd.una", uint64(tcb.snd.UNA)))
@@ -358,10 +386,11 @@ func (tcb *ControlBlock) validateOutgoingSegment(seg Segment) (err error) {
 	zeroWindowOK := tcb.snd.WND == 0 && seg.DATALEN == 0 && seg.SEQ == tcb.snd.NXT
 	outOfWindow := checkSeq && !InWindow(seg.SEQ, tcb.snd.NXT, tcb.snd.WND) &&
 		!zeroWindowOK
+	_, rcvShift := tcb.windowShifts()
 	switch {
 	case tcb.state == StateClosed:
 		err = io.ErrClosedPipe
-	case seg.WND > math.MaxUint16:
+	case seg.WND > math.MaxUint16<<rcvShift:
 		err = errWindowTooLarge
 	case hasAck && seg.ACK != tcb.rcv.NXT:
 		err = errAckNotNext
@@ -391,6 +420,7 @@ func (tcb *ControlBlock) close() {
 	tcb.pending = [2]Flags{}
 	tcb.resetRcv(0, 0)
 	tcb.resetSnd(0, 0)
+	tcb.remoteOpts = Options{}
 	tcb.debug("tcb:close")
 }
 
@@ -417,6 +447,7 @@ func (tcb *ControlBlock) handleRST(seq Value) error {
 		tcb.state = StateListen
 		tcb.resetSnd(tcb.snd.ISS+rstJump, tcb.snd.WND)
 		tcb.resetRcv(tcb.rcv.WND, 3_14159_2653^tcb.rcv.IRS)
+		tcb.remoteOpts = Options{}
 	} else {
 		tcb.close() // Enter closed state and return.
 		return net.ErrClosed
@@ -0,0 +1,109 @@
+package seqs
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+)
+
+// SizeControlState is the length of the state of a ControlBlock as encoded
+// by [ControlBlock.AppendState].
+const SizeControlState = 1 + 4*4 + 3*4 + 4 + 2 + 2 + 2*sizeOptionsState + 3*4
+
+const (
+	controlStateVersion  = 1
+	sizeOptionsState     = 2 + 1 + 1
+	optsStateScale       = 1 << 0
+	optsStateSACK        = 1 << 1
+	optsStateTimestamps  = 1 << 2
+	ctlStateChallengeAck = 1 << 0
+)
+
+var errBadControlState = errors.New("seqs:malformed control block state")
+
+// AppendState appends the state of the connection to dst so that it may be
+// restored with [ControlBlock.SetState], i.e: by a standby device taking over
+// the connection. The logger is not part of the state.
+func (tcb *ControlBlock) AppendState(dst []byte) []byte {
+	dst = append(dst, controlStateVersion)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(tcb.snd.ISS))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(tcb.snd.UNA))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(tcb.snd.NXT))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(tcb.snd.WND))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(tcb.rcv.IRS))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(tcb.rcv.NXT))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(tcb.rcv.WND))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(tcb.rstPtr))
+	dst = append(dst, uint8(tcb.pending[0]), uint8(tcb.pending[1]))
+	var flags uint8
+	if tcb.challengeAck {
+		flags |= ctlStateChallengeAck
+	}
+	dst = append(dst, uint8(tcb.state), flags)
+	dst = appendOptionsState(dst, tcb.localOpts)
+	dst = appendOptionsState(dst, tcb.remoteOpts)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(tcb.cc.cwnd))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(tcb.cc.ssthresh))
+	return binary.BigEndian.AppendUint32(dst, uint32(tcb.cc.acked))
+}
+
+// SetState restores the state of a connection encoded with [ControlBlock.AppendState].
+// The ControlBlock's logger is kept.
+func (tcb *ControlBlock) SetState(b []byte) error {
+	if len(b) < SizeControlState || b[0] != controlStateVersion || State(b[35]) > StateLastAck {
+		return errBadControlState
+	}
+	u32 := func(off int) uint32 { return binary.BigEndian.Uint32(b[off:]) }
+	*tcb = ControlBlock{
+		snd: sendSpace{
+			ISS: Value(u32(1)),
+			UNA: Value(u32(5)),
+			NXT: Value(u32(9)),
+			WND: Size(u32(13)),
+		},
+		rcv: recvSpace{
+			IRS: Value(u32(17)),
+			NXT: Value(u32(21)),
+			WND: Size(u32(25)),
+		},
+		rstPtr:       Value(u32(29)),
+		pending:      [2]Flags{Flags(b[33]), Flags(b[34])},
+		state:        State(b[35]),
+		challengeAck: b[36]&ctlStateChallengeAck != 0,
+		localOpts:    decodeOptionsState(b[37:]),
+		remoteOpts:   decodeOptionsState(b[37+sizeOptionsState:]),
+		cc: congestion{
+			cwnd:     Size(u32(37 + 2*sizeOptionsState)),
+			ssthresh: Size(u32(41 + 2*sizeOptionsState)),
+			acked:    Size(u32(45 + 2*sizeOptionsState)),
+		},
+		log: tcb.log,
+	}
+	tcb.trace("tcb:setstate", slog.String("state", tcb.state.String()))
+	return nil
+}
+
+func appendOptionsState(dst []byte, opts Options) []byte {
+	var flags uint8
+	if opts.WindowScale {
+		flags |= optsStateScale
+	}
+	if opts.SACKPermitted {
+		flags |= optsStateSACK
+	}
+	if opts.Timestamps {
+		flags |= optsStateTimestamps
+	}
+	dst = binary.BigEndian.AppendUint16(dst, opts.MSS)
+	return append(dst, opts.WindowShift, flags)
+}
+
+func decodeOptionsState(b []byte) Options {
+	return Options{
+		MSS:           binary.BigEndian.Uint16(b),
+		WindowShift:   b[2],
+		WindowScale:   b[3]&optsStateScale != 0,
+		SACKPermitted: b[3]&optsStateSACK != 0,
+		Timestamps:    b[3]&optsStateTimestamps != 0,
+	}
+}
@@ -29,6 +29,7 @@ var (
 	errLastNotInWindow   = newRejectErr("last not in snd/rcv.wnd")
 	errRequireSequential = newRejectErr("seq != rcv.nxt (require sequential segments)")
 	errAckNotNext        = newRejectErr("ack != snd.nxt")
+	errSynchronizedSYN   = newRejectErr("SYN in synchronized state")
 )
 
 func newRejectErr(err string) *RejectError { return &RejectError{err: "reject in/out seg: " + err} }
@@ -62,6 +63,7 @@ func (tcb *ControlBlock) Open(iss Value, wnd Size, state State) (err error) {
 	tcb.state = state
 	tcb.resetRcv(wnd, 0)
 	tcb.resetSnd(iss, 1)
+	tcb.remoteOpts = Options{}
 	tcb.pending = [2]Flags{}
 	if state == StateSynSent {
 		tcb.pending[0] = FlagSYN
@@ -170,6 +172,7 @@ func (tcb *ControlBlock) Recv(seg Segment) (err error) {
 		return err
 	}
 	prevNxt := tcb.snd.NXT
+	prevState := tcb.state
 	var pending Flags
 	switch tcb.state {
 	case StateListen:
@@ -194,6 +197,10 @@ func (tcb *ControlBlock) Recv(seg Segment) (err error) {
 		if seg.Flags.HasAny(FlagACK) {
 			tcb.state = StateTimeWait
 		}
+	case StateTimeWait:
+		if seg.Flags.HasAny(FlagFIN) {
+			pending = FlagACK // Remote retransmitted its FIN, RFC 9293 section 3.10.7.4.
+		}
 	default:
 		panic("unexpected recv state:" + tcb.state.String())
 	}
@@ -211,6 +218,9 @@ func (tcb *ControlBlock) Recv(seg Segment) (err error) {
 	// We accept the segment and update TCB state.
 	tcb.snd.WND = seg.WND
 	if seg.Flags.HasAny(FlagACK) {
+		if prevState.IsSynchronized() && LessThan(tcb.snd.UNA, seg.ACK) {
+			tcb.cc.onack(Sizeof(tcb.snd.UNA, seg.ACK), tcb.SendMSS())
+		}
 		tcb.snd.UNA = seg.ACK
 	}
 	seglen := seg.LEN()
@@ -231,6 +241,17 @@ func (tcb *ControlBlock) RecvNext() Value { return tcb.rcv.NXT }
 // RecvWindow returns the receive window size. If connection is closed will return 0.
 func (tcb *ControlBlock) RecvWindow() Size { return tcb.rcv.WND }
 
+// SendNext returns the next sequence number to be sent to the remote.
+func (tcb *ControlBlock) SendNext() Value { return tcb.snd.NXT }
+
+// SendWindow returns the send window: the amount of data the remote advertised
+// it can receive beyond SND.UNA. A zero window must be probed until it reopens.
+func (tcb *ControlBlock) SendWindow() Size { return tcb.snd.WND }
+
+// SendUnacked returns the oldest sequence number sent to the remote that has not
+// been acknowledged (SND.UNA). It is equal to SendNext when all sent data has been acknowledged.
+func (tcb *ControlBlock) SendUnacked() Value { return tcb.snd.UNA }
+
 // ISS returns the initial sequence number of the connection that was defined on a call to Open by user.
 func (tcb *ControlBlock) ISS() Value { return tcb.snd.ISS }
 
@@ -255,12 +276,13 @@ func (tcb *ControlBlock) SetLogger(log *slog.Logger) {
 	tcb.log = log
 }
 
-// IncomingIsKeepalive checks if an incoming segment is a keepalive segment.
-// Segments which are keepalives should not be passed into Recv or Send methods.
+// IncomingIsKeepalive checks if an incoming segment is a keepalive segment,
+// with or without the garbage octet permitted by RFC 1122 section 4.2.3.6.
+// Passing a keepalive to Recv returns an error and schedules the ACK answering the probe.
 func (tcb *ControlBlock) IncomingIsKeepalive(incomingSegment Segment) bool {
 	return incomingSegment.SEQ == tcb.rcv.NXT-1 &&
 		incomingSegment.Flags == FlagACK &&
-		incomingSegment.ACK == tcb.snd.NXT && incomingSegment.DATALEN == 0
+		incomingSegment.ACK == tcb.snd.NXT && incomingSegment.DATALEN <= 1
 }
 
 // MakeKeepalive creates a TCP keepalive segment. This segment
@@ -274,3 +296,50 @@ func (tcb *ControlBlock) MakeKeepalive() Segment {
 		DATALEN: 0,
 	}
 }
+
+// RetransmitSegment creates a segment retransmitting the oldest unacknowledged
+// octets of the send sequence space with up to payloadLen octets of data,
+// i.e: when a retransmission timeout expires as described in RFC 6298.
+// Retransmitting data collapses the congestion window to a single segment.
+// A SYN or FIN sent and not yet acknowledged is set in the segment as corresponds.
+// ok is false if there is no unacknowledged sequence space. The segment
+// should not be passed into Send since it does not advance SND.NXT.
+func (tcb *ControlBlock) RetransmitSegment(payloadLen int) (_ Segment, ok bool) {
+	unacked := tcb.snd.inFlight()
+	if unacked == 0 || !tcb.isOpen() {
+		return Segment{}, false
+	}
+	seg := Segment{
+		SEQ:   tcb.snd.UNA,
+		ACK:   tcb.rcv.NXT,
+		WND:   tcb.rcv.WND,
+		Flags: FlagACK,
+	}
+	switch tcb.state {
+	case StateSynSent:
+		seg.ACK = 0
+		seg.Flags = FlagSYN
+		return seg, true
+	case StateSynRcvd:
+		seg.Flags = synack
+		return seg, true
+	}
+	finSent := !tcb.pending[0].HasAny(FlagFIN) &&
+		(tcb.state == StateFinWait1 || tcb.state == StateClosing || tcb.state == StateLastAck)
+	tcb.cc.ontimeout(unacked, tcb.SendMSS())
+	datalen := unacked
+	if finSent {
+		datalen-- // FIN occupies the last octet of sequence space.
+	}
+	if payloadLen < 0 {
+		payloadLen = 0
+	}
+	if Size(payloadLen) < datalen {
+		datalen = Size(payloadLen)
+	} else if finSent {
+		seg.Flags |= FlagFIN
+	}
+	seg.DATALEN = datalen
+	tcb.traceSeg("tcb:retransmit", seg)
+	return seg, true
+}
@@ -0,0 +1,96 @@
+package eth
+
+// Pseudo-header checksum helpers. TCP, UDP, UDP-Lite and ICMPv6 checksums
+// cover a pseudo-header built from the network layer header preceding the
+// transport header.
+
+// AddPseudoIPv4 adds the IPv4 pseudo-header of RFC 9293 and RFC 768 to the running checksum.
+// length is the length of the transport header plus payload.
+//
+//	+--------+--------+--------+--------+
+//	|           Source Address          |
+//	+--------+--------+--------+--------+
+//	|         Destination Address       |
+//	+--------+--------+--------+--------+
+//	|  zero  |  PTCL  |      Length     |
+//	+--------+--------+--------+--------+
+func (c *CRC791) AddPseudoIPv4(src, dst [4]byte, protocol uint8, length uint16) {
+	c.Write(src[:])
+	c.Write(dst[:])
+	c.AddUint16(uint16(protocol)) // Pads with 0.
+	c.AddUint16(length)
+}
+
+// AddPseudoIPv6 adds the IPv6 pseudo-header of RFC 8200 section 8.1 to the running checksum.
+// length is the upper-layer packet length and nextHeader the upper-layer protocol number.
+//
+//	+--------+--------+--------+--------+
+//	|                                   |
+//	+          Source Address           +
+//	|             (16 bytes)            |
+//	+--------+--------+--------+--------+
+//	|                                   |
+//	+        Destination Address        +
+//	|             (16 bytes)            |
+//	+--------+--------+--------+--------+
+//	|       Upper-Layer Packet Length   |
+//	+--------+--------+--------+--------+
+//	|      zero                |  Next  |
+//	+--------+--------+--------+--------+
+func (c *CRC791) AddPseudoIPv6(src, dst [16]byte, nextHeader uint8, length uint32) {
+	c.Write(src[:])
+	c.Write(dst[:])
+	c.AddUint32(length)
+	c.AddUint32(uint32(nextHeader))
+}
+
+// CalculateChecksumIPv6 calculates the checksum for a UDP packet over IPv6.
+func (uhdr *UDPHeader) CalculateChecksumIPv6(src, dst [16]byte, payload []byte) uint16 {
+	var crc CRC791
+	crc.AddPseudoIPv6(src, dst, 17, uint32(uhdr.Length))
+	uhdr.addChecksum(&crc)
+	crc.Write(payload)
+	return crc.Sum16()
+}
+
+// CalculateChecksumIPv6 calculates the checksum of the TCP header, options and payload over IPv6.
+func (thdr *TCPHeader) CalculateChecksumIPv6(src, dst [16]byte, tcpOptions, payload []byte) uint16 {
+	var crc CRC791
+	crc.AddPseudoIPv6(src, dst, 6, uint32(SizeTCPHeader+len(tcpOptions)+len(payload)))
+	thdr.addChecksum(&crc)
+	crc.Write(tcpOptions)
+	crc.Write(payload)
+	return crc.Sum16()
+}
+
+// ChecksumICMPv6 calculates the checksum of the ICMPv6 message msg, which
+// includes the ICMPv6 header. The checksum field of msg is ignored.
+func ChecksumICMPv6(src, dst [16]byte, msg []byte) uint16 {
+	var crc CRC791
+	crc.AddPseudoIPv6(src, dst, 58, uint32(len(msg)))
+	if len(msg) < 4 {
+		crc.Write(msg)
+		return crc.Sum16()
+	}
+	crc.Write(msg[:2])
+	crc.Write(msg[4:]) // Skip checksum field.
+	return crc.Sum16()
+}
+
+// addChecksum adds the UDP header with zeroed checksum to crc.
+func (uhdr *UDPHeader) addChecksum(crc *CRC791) {
+	crc.AddUint16(uhdr.SourcePort)
+	crc.AddUint16(uhdr.DestinationPort)
+	crc.AddUint16(uhdr.Length)
+}
+
+// addChecksum adds the TCP header without options and with zeroed checksum to crc.
+func (thdr *TCPHeader) addChecksum(crc *CRC791) {
+	crc.AddUint16(thdr.SourcePort)
+	crc.AddUint16(thdr.DestinationPort)
+	crc.AddUint32(uint32(thdr.Seq))
+	crc.AddUint32(uint32(thdr.Ack))
+	crc.AddUint16(thdr.OffsetAndFlags[0])
+	crc.AddUint16(thdr.WindowSizeRaw)
+	crc.AddUint16(thdr.UrgentPtr)
+}
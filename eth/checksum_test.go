@@ -0,0 +1,155 @@
+package eth
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/soypat/seqs"
+)
+
+// FuzzPseudoChecksum cross-checks the pseudo-header checksum helpers against
+// a reference that marshals the pseudo-header and header into a buffer.
+func FuzzPseudoChecksum(f *testing.F) {
+	f.Add([]byte("\x01\x02\x03\x04\x05\x06\x07\x08"), []byte("hello world"), uint16(80), uint16(1025), uint32(0x1234))
+	f.Add([]byte{}, []byte{0xff}, uint16(0), uint16(0xffff), uint32(0))
+	f.Fuzz(func(t *testing.T, addrs, payload []byte, sport, dport uint16, seq uint32) {
+		var src4, dst4 [4]byte
+		var src6, dst6 [16]byte
+		copy(src6[:], addrs)
+		if len(addrs) > 16 {
+			copy(dst6[:], addrs[16:])
+		}
+		copy(src4[:], src6[:4])
+		copy(dst4[:], src6[4:8])
+		if len(payload) > 1400 {
+			payload = payload[:1400]
+		}
+		optlen := len(payload) / 4 * 4 // Options length is a multiple of 4.
+		if optlen > 40 {
+			optlen = 40
+		}
+		opts := payload[:optlen]
+		data := payload[len(opts):]
+
+		// UDP.
+		uhdr := UDPHeader{SourcePort: sport, DestinationPort: dport, Length: uint16(SizeUDPHeader + len(payload))}
+		var ubuf [SizeUDPHeader]byte
+		uhdr.Put(ubuf[:])
+		ip4 := IPv4Header{VersionAndIHL: 5, Protocol: 17, Source: src4, Destination: dst4, TotalLength: SizeIPv4Header + uhdr.Length}
+		ref := refSum(pseudo4(src4, dst4, 17, int(uhdr.Length)), ubuf[:], payload)
+		if got := uhdr.CalculateChecksumIPv4(&ip4, payload); got != ref {
+			t.Fatalf("UDP/IPv4 checksum %#04x, want %#04x", got, ref)
+		}
+		ref = refSum(pseudo6(src6, dst6, 17, int(uhdr.Length)), ubuf[:], payload)
+		if got := uhdr.CalculateChecksumIPv6(src6, dst6, payload); got != ref {
+			t.Fatalf("UDP/IPv6 checksum %#04x, want %#04x", got, ref)
+		}
+
+		// TCP.
+		thdr := TCPHeader{SourcePort: sport, DestinationPort: dport, Seq: seqs.Value(seq), Ack: seqs.Value(^seq), WindowSizeRaw: sport ^ dport, UrgentPtr: dport}
+		thdr.SetOffset(uint8(5 + len(opts)/4))
+		thdr.Checksum = 0xdead // Must be ignored.
+		var tbuf [SizeTCPHeader]byte
+		thdr.Put(tbuf[:])
+		binary.BigEndian.PutUint16(tbuf[16:], 0)
+		tcpLen := SizeTCPHeader + len(opts) + len(data)
+		ip4 = IPv4Header{VersionAndIHL: 5, Protocol: 6, Source: src4, Destination: dst4, TotalLength: uint16(SizeIPv4Header + tcpLen)}
+		ref = refSum(pseudo4(src4, dst4, 6, tcpLen), tbuf[:], opts, data)
+		if got := thdr.CalculateChecksumIPv4(&ip4, opts, data); got != ref {
+			t.Fatalf("TCP/IPv4 checksum %#04x, want %#04x", got, ref)
+		}
+		ref = refSum(pseudo6(src6, dst6, 6, tcpLen), tbuf[:], opts, data)
+		if got := thdr.CalculateChecksumIPv6(src6, dst6, opts, data); got != ref {
+			t.Fatalf("TCP/IPv6 checksum %#04x, want %#04x", got, ref)
+		}
+
+		// ICMPv6.
+		if len(payload) >= 4 {
+			msg := append([]byte{}, payload...)
+			msg[2], msg[3] = 0, 0
+			ref = refSum(pseudo6(src6, dst6, 58, len(msg)), msg)
+			if got := ChecksumICMPv6(src6, dst6, payload); got != ref {
+				t.Fatalf("ICMPv6 checksum %#04x, want %#04x", got, ref)
+			}
+		}
+	})
+}
+
+func pseudo4(src, dst [4]byte, proto uint8, length int) []byte {
+	var b [12]byte
+	copy(b[0:4], src[:])
+	copy(b[4:8], dst[:])
+	b[9] = proto
+	binary.BigEndian.PutUint16(b[10:], uint16(length))
+	return b[:]
+}
+
+func pseudo6(src, dst [16]byte, next uint8, length int) []byte {
+	var b [40]byte
+	copy(b[0:16], src[:])
+	copy(b[16:32], dst[:])
+	binary.BigEndian.PutUint32(b[32:], uint32(length))
+	b[39] = next
+	return b[:]
+}
+
+// refSum returns the reference checksum of the concatenation of chunks.
+func refSum(chunks ...[]byte) uint16 {
+	var all []byte
+	for _, c := range chunks {
+		all = append(all, c...)
+	}
+	return sum(all)
+}
+
+// TestSum16Kernels checks the word at a time checksum against the reference
+// for all lengths and alignments up to a full frame.
+func TestSum16Kernels(t *testing.T) {
+	var buf [1600]byte
+	for i := range buf {
+		buf[i] = byte(i*7 + i>>8)
+	}
+	buf[100], buf[101] = 0xff, 0xff
+	fold := func(sum uint32) uint32 {
+		for sum>>16 != 0 {
+			sum = sum&0xffff + sum>>16
+		}
+		return sum
+	}
+	for off := 0; off < 4; off++ {
+		for n := 0; off+n <= len(buf); n += 2 {
+			b := buf[off : off+n]
+			want := fold(sumHalfwords(0, b))
+			if got := fold(sumWords(0, b)); got != want {
+				t.Fatalf("off=%d len=%d: got sum %#04x, want %#04x", off, n, got, want)
+			}
+		}
+	}
+	var zeros [64]byte
+	if got := fold(sumWords(0, zeros[:])); got != 0 {
+		t.Errorf("got sum %#04x of zeros, want 0", got)
+	}
+}
+
+func BenchmarkSum16(b *testing.B) {
+	var buf [1500]byte
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	for _, bench := range []struct {
+		name string
+		fn   func(uint32, []byte) uint32
+	}{
+		{name: "halfwords", fn: sumHalfwords},
+		{name: "words", fn: sumWords},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(buf)))
+			var sum uint32
+			for i := 0; i < b.N; i++ {
+				sum = bench.fn(sum, buf[:])
+			}
+			_ = sum
+		})
+	}
+}
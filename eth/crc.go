@@ -1,8 +1,8 @@
 package eth
 
-import (
-	"encoding/binary"
-)
+import "hash"
+
+var _ hash.Hash = (*CRC791)(nil)
 
 // CRC791 function as defined by RFC 791. The Checksum field for TCP+IP
 // is the 16-bit ones' complement of the ones' complement sum of
@@ -14,13 +14,20 @@ type CRC791 struct {
 	sum      uint32
 	excedent uint8
 	needPad  bool
+	// last is the last byte written and written is set if any data was
+	// written. Both are needed by Combine.
+	last    uint8
+	written bool
 }
 
 // Write adds the bytes in p to the running checksum.
 func (c *CRC791) Write(buff []byte) (n int, err error) {
-	if len(buff) == 0 {
+	n = len(buff)
+	if n == 0 {
 		return 0, nil
 	}
+	c.last = buff[n-1]
+	c.written = true
 	if c.needPad {
 		c.sum += uint32(c.excedent)<<8 + uint32(buff[0])
 		buff = buff[1:]
@@ -30,16 +37,13 @@ func (c *CRC791) Write(buff []byte) (n int, err error) {
 			return 1, nil
 		}
 	}
-	count := len(buff)
-	for count > 1 {
-		c.sum += uint32(binary.BigEndian.Uint16(buff[len(buff)-count:]))
-		count -= 2
-	}
-	if count != 0 {
-		c.excedent = buff[len(buff)-1]
+	even := len(buff) &^ 1
+	c.sum = sum16(c.sum, buff[:even])
+	if even != len(buff) {
+		c.excedent = buff[even]
 		c.needPad = true
 	}
-	return len(buff), nil
+	return n, nil
 }
 
 // Add16 adds value to the running checksum interpreted as BigEndian (network order).
@@ -50,6 +54,8 @@ func (c *CRC791) AddUint32(value uint32) {
 
 // Add16 adds value to the running checksum interpreted as BigEndian (network order).
 func (c *CRC791) AddUint16(value uint16) {
+	c.last = byte(value)
+	c.written = true
 	if c.needPad {
 		c.sum += uint32(c.excedent)<<8 | uint32(value>>8)
 		c.excedent = byte(value)
@@ -60,6 +66,8 @@ func (c *CRC791) AddUint16(value uint16) {
 
 // Add16 adds value to the running checksum interpreted as BigEndian (network order).
 func (c *CRC791) AddUint8(value uint8) {
+	c.last = value
+	c.written = true
 	if c.needPad {
 		c.sum += uint32(c.excedent)<<8 | uint32(value)
 	} else {
@@ -80,5 +88,56 @@ func (c *CRC791) Sum16() uint16 {
 	return uint16(^sum)
 }
 
+// Combine adds the data written to other to c as if it had been written to
+// c after the data already written, so that checksums of separately
+// processed chunks of a payload can be joined regardless of their alignment.
+func (c *CRC791) Combine(other *CRC791) {
+	if !other.written {
+		return
+	}
+	c.written = true
+	c.last = other.last
+	if !c.needPad {
+		c.sum += other.sum
+		c.excedent = other.excedent
+		c.needPad = other.needPad
+		return
+	}
+	// c has an odd amount of bytes so other's data is shifted by one byte. The
+	// ones' complement sum of byte swapped data is the byte swapped sum.
+	osum := other.sum
+	if other.needPad {
+		osum += uint32(other.excedent) << 8
+	}
+	for osum>>16 != 0 {
+		osum = (osum & 0xffff) + (osum >> 16)
+	}
+	c.sum += uint32(c.excedent)<<8 + (osum>>8 | osum<<8&0xff00)
+	if other.needPad {
+		// Even amount of bytes in total.
+		c.excedent = 0
+		c.needPad = false
+		return
+	}
+	// The last byte of other was summed as a padded high byte but must be
+	// left pending. Subtract it by adding its ones' complement.
+	if other.last != 0 {
+		c.sum += 0xffff - uint32(other.last)<<8
+	}
+	c.excedent = other.last
+}
+
+// Sum appends the big endian checksum to b, implementing [hash.Hash].
+func (c *CRC791) Sum(b []byte) []byte {
+	sum := c.Sum16()
+	return append(b, byte(sum>>8), byte(sum))
+}
+
+// Size returns the checksum length in bytes, implementing [hash.Hash].
+func (c *CRC791) Size() int { return 2 }
+
+// BlockSize returns the checksum word size in bytes, implementing [hash.Hash].
+func (c *CRC791) BlockSize() int { return 2 }
+
 // Reset zeros out the CRC791, resetting it to the initial state.
 func (c *CRC791) Reset() { *c = CRC791{} }
@@ -0,0 +1,8 @@
+//go:build cortexm
+
+package eth
+
+// wordChecksum selects the word at a time checksum. The cortexm build tag is
+// set by TinyGo for ARM Cortex-M targets, whose checksum loop otherwise
+// dominates CPU time at line rate.
+const wordChecksum = true
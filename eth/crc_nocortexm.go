@@ -0,0 +1,6 @@
+//go:build !cortexm
+
+package eth
+
+// wordChecksum selects the word at a time checksum. See crc_cortexm.go.
+const wordChecksum = false
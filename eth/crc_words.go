@@ -0,0 +1,49 @@
+package eth
+
+import "encoding/binary"
+
+// sum16 adds the big endian 16 bit words of b to sum. len(b) must be even.
+// The word at a time implementation is selected by build tags for targets
+// on which it is faster, see crc_cortexm.go.
+func sum16(sum uint32, b []byte) uint32 {
+	if wordChecksum {
+		return sumWords(sum, b)
+	}
+	return sumHalfwords(sum, b)
+}
+
+// sumHalfwords is the reference implementation of sum16 which loads a
+// single 16 bit word per iteration.
+func sumHalfwords(sum uint32, b []byte) uint32 {
+	for len(b) > 1 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	return sum
+}
+
+// sumWords implements sum16 loading 32 bit words in native little endian
+// order into a 64 bit accumulator, unrolled to 16 bytes per iteration. Cortex-M
+// cores load each word with a single instruction and accumulate with an
+// add with carry pair. Since the ones' complement sum of byte swapped words
+// is the byte swapped sum, the swap is done once on the folded result
+// instead of once per word. See RFC 1071 section 2.
+func sumWords(sum uint32, b []byte) uint32 {
+	var acc uint64
+	for len(b) >= 16 {
+		acc += uint64(binary.LittleEndian.Uint32(b)) + uint64(binary.LittleEndian.Uint32(b[4:])) +
+			uint64(binary.LittleEndian.Uint32(b[8:])) + uint64(binary.LittleEndian.Uint32(b[12:]))
+		b = b[16:]
+	}
+	for len(b) >= 4 {
+		acc += uint64(binary.LittleEndian.Uint32(b))
+		b = b[4:]
+	}
+	if len(b) >= 2 {
+		acc += uint64(binary.LittleEndian.Uint16(b))
+	}
+	for acc>>16 != 0 {
+		acc = acc&0xffff + acc>>16
+	}
+	return sum + uint32(acc>>8|acc<<8&0xff00)
+}
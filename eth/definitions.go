@@ -49,3 +49,59 @@ const (
 	// that no 802.1Q VLAN tags are present.
 	minEthPayload = 46
 )
+
+// ICMPType is the type field of an ICMP message. See RFC 792 and RFC 950.
+type ICMPType uint8
+
+// ICMP message types.
+//
+//go:generate stringer -type=ICMPType -trimprefix=ICMPType
+const (
+	ICMPTypeEchoReply        ICMPType = 0
+	ICMPTypeDestUnreachable  ICMPType = 3
+	ICMPTypeSourceQuench     ICMPType = 4
+	ICMPTypeRedirect         ICMPType = 5
+	ICMPTypeEcho             ICMPType = 8
+	ICMPTypeTimeExceeded     ICMPType = 11
+	ICMPTypeParameterProblem ICMPType = 12
+	ICMPTypeTimestamp        ICMPType = 13
+	ICMPTypeTimestampReply   ICMPType = 14
+	ICMPTypeAddrMaskRequest  ICMPType = 17
+	ICMPTypeAddrMaskReply    ICMPType = 18
+)
+
+// ICMPv6Type is the type field of an ICMPv6 message. See RFC 4443 and RFC 4861.
+type ICMPv6Type uint8
+
+// ICMPv6 message types.
+//
+//go:generate stringer -type=ICMPv6Type -trimprefix=ICMPv6Type
+const (
+	ICMPv6TypeDestUnreachable  ICMPv6Type = 1
+	ICMPv6TypePacketTooBig     ICMPv6Type = 2
+	ICMPv6TypeTimeExceeded     ICMPv6Type = 3
+	ICMPv6TypeParameterProblem ICMPv6Type = 4
+	ICMPv6TypeEchoRequest      ICMPv6Type = 128
+	ICMPv6TypeEchoReply        ICMPv6Type = 129
+	ICMPv6TypeRouterSolicit    ICMPv6Type = 133
+	ICMPv6TypeRouterAdvert     ICMPv6Type = 134
+	ICMPv6TypeNeighborSolicit  ICMPv6Type = 135
+	ICMPv6TypeNeighborAdvert   ICMPv6Type = 136
+	ICMPv6TypeRedirect         ICMPv6Type = 137
+)
+
+// IPProto is the protocol number of the payload of an IP datagram, the
+// Protocol field of [IPv4Header] and NextHeader of [IPv6Header].
+type IPProto uint8
+
+// IP protocol numbers assigned by IANA.
+//
+//go:generate stringer -type=IPProto -trimprefix=IPProto
+const (
+	IPProtoICMP    IPProto = 1
+	IPProtoIGMP    IPProto = 2
+	IPProtoTCP     IPProto = 6
+	IPProtoUDP     IPProto = 17
+	IPProtoICMPv6  IPProto = 58
+	IPProtoUDPLite IPProto = 136
+)
@@ -12,11 +12,13 @@ func _() {
 	_ = x[StateSelecting-2]
 	_ = x[StateRequesting-3]
 	_ = x[StateBound-4]
+	_ = x[StateRenewing-5]
+	_ = x[StateRebinding-6]
 }
 
-const _ClientState_name = "InitSelectingRequestingBound"
+const _ClientState_name = "InitSelectingRequestingBoundRenewingRebinding"
 
-var _ClientState_index = [...]uint8{0, 4, 13, 23, 28}
+var _ClientState_index = [...]uint8{0, 4, 13, 23, 28, 36, 45}
 
 func (i ClientState) String() string {
 	i -= 1
@@ -49,6 +49,12 @@ const (
 	// StateRebooting
 	// On ACK to Request enter BOUND.
 	StateBound
+	// When the renewal time T1 expires enter RENEWING and extend the lease
+	// with the server that granted it.
+	StateRenewing
+	// When the rebinding time T2 expires enter REBINDING and extend the lease
+	// with any server.
+	StateRebinding
 	numStates uint8 = iota
 )
 
@@ -142,6 +148,20 @@ const (
 	OptRebindingTimeValue          OptNum = 59 // DHCP rebinding (T2) time
 	OptClientIdentifier            OptNum = 60 // Client identifier
 	OptClientIdentifier1           OptNum = 61 // Client identifier
+	OptClientFQDN                  OptNum = 81 // Client fully qualified domain name (RFC 4702)
+	OptRelayAgentInformation       OptNum = 82 // Relay agent information (RFC 3046)
+)
+
+// Client FQDN option flags. See RFC 4702 section 2.1.
+const (
+	// FQDNFlagS indicates the server should perform the A record update.
+	FQDNFlagS = 1 << 0
+	// FQDNFlagO is set by the server when it overrides the client's S flag.
+	FQDNFlagO = 1 << 1
+	// FQDNFlagE indicates the domain name is in canonical wire format.
+	FQDNFlagE = 1 << 2
+	// FQDNFlagN indicates the server should not perform any DNS updates.
+	FQDNFlagN = 1 << 3
 )
 
 type Op byte
@@ -151,6 +171,11 @@ const (
 	OpReply   Op = 2
 )
 
+// FlagBroadcast is the bit of [HeaderV4.Flags] set by clients that cannot
+// receive unicast datagrams before their address is configured. Servers and
+// relay agents then broadcast their replies. See RFC 2131 section 2.
+const FlagBroadcast uint16 = 1 << 15
+
 // HeaderV4 specifies the first 44 bytes of a DHCP packet payload. It does
 // not include BOOTP, magic cookie and options.
 // Reference: https://lists.gnu.org/archive/html/lwip-users/2012-12/msg00016.html
@@ -108,17 +108,27 @@ func _() {
 	_ = x[OpCodeQuery-0]
 	_ = x[OpCodeInverseQuery-1]
 	_ = x[OpCodeStatus-2]
+	_ = x[OpCodeUpdate-5]
 }
 
-const _OpCode_name = "QueryInverseQueryStatus"
+const (
+	_OpCode_name_0 = "QueryInverseQueryStatus"
+	_OpCode_name_1 = "Update"
+)
 
-var _OpCode_index = [...]uint8{0, 5, 17, 23}
+var (
+	_OpCode_index_0 = [...]uint8{0, 5, 17, 23}
+)
 
 func (i OpCode) String() string {
-	if i >= OpCode(len(_OpCode_index)-1) {
+	switch {
+	case i <= 2:
+		return _OpCode_name_0[_OpCode_index_0[i]:_OpCode_index_0[i+1]]
+	case i == 5:
+		return _OpCode_name_1
+	default:
 		return "<unknown dns.OpCode>"
 	}
-	return _OpCode_name[_OpCode_index[i]:_OpCode_index[i+1]]
 }
 
 func _() {
@@ -57,6 +57,7 @@ const (
 	OpCodeQuery        OpCode = 0 // Standard query.
 	OpCodeInverseQuery OpCode = 1 // Inverse query.
 	OpCodeStatus       OpCode = 2 // Server status request.
+	OpCodeUpdate       OpCode = 5 // Dynamic update (RFC 2136).
 )
 
 // An RCode is a DNS response status code.
@@ -325,6 +326,12 @@ func (r *Resource) RawData() []byte {
 	return r.data[:length]
 }
 
+// SetRawData sets the resource's data. The data is copied into the
+// resource's buffer. Header.Length is set when the resource is encoded.
+func (r *Resource) SetRawData(data []byte) {
+	r.data = append(r.data[:0], data...)
+}
+
 func (q *Question) Reset() {
 	q.Name.Reset()
 	*q = Question{Name: q.Name} // Reuse Name's buffer.
@@ -0,0 +1,69 @@
+package eth
+
+import "encoding/binary"
+
+// HeaderField locates a multi-byte field of a header in its wire format. Fields
+// are read and written in network byte order (big-endian) regardless of the
+// host's byte order, so that code patching a field of a received or outgoing
+// frame in place, i.e: a checksum or port, need not decode and re-encode the
+// whole header nor handle byte order itself.
+//
+// The offset of the field from the start of its header is held in the high
+// byte and the size of the field in bytes, 2 or 4, in the low byte.
+type HeaderField uint16
+
+// Multi-byte fields of the headers in this package. Offsets are relative to
+// the start of the header the field belongs to and match the struct field comments.
+const (
+	FieldEtherType HeaderField = 12<<8 | 2
+
+	FieldARPHardwareType HeaderField = 0<<8 | 2
+	FieldARPProtoType    HeaderField = 2<<8 | 2
+	FieldARPOperation    HeaderField = 6<<8 | 2
+
+	FieldIPv4TotalLength HeaderField = 2<<8 | 2
+	FieldIPv4ID          HeaderField = 4<<8 | 2
+	FieldIPv4Flags       HeaderField = 6<<8 | 2
+	FieldIPv4Checksum    HeaderField = 10<<8 | 2
+
+	FieldUDPSourcePort      HeaderField = 0<<8 | 2
+	FieldUDPDestinationPort HeaderField = 2<<8 | 2
+	FieldUDPLength          HeaderField = 4<<8 | 2
+	FieldUDPChecksum        HeaderField = 6<<8 | 2
+
+	FieldTCPSourcePort      HeaderField = 0<<8 | 2
+	FieldTCPDestinationPort HeaderField = 2<<8 | 2
+	FieldTCPSeq             HeaderField = 4<<8 | 4
+	FieldTCPAck             HeaderField = 8<<8 | 4
+	FieldTCPOffsetAndFlags  HeaderField = 12<<8 | 2
+	FieldTCPWindowSize      HeaderField = 14<<8 | 2
+	FieldTCPChecksum        HeaderField = 16<<8 | 2
+	FieldTCPUrgentPtr       HeaderField = 18<<8 | 2
+)
+
+// Offset returns the offset in bytes of the field from the start of its header.
+func (f HeaderField) Offset() int { return int(f >> 8) }
+
+// Size returns the size of the field in bytes.
+func (f HeaderField) Size() int { return int(f & 0xff) }
+
+// Get returns the value of the field in the header at the start of hdr.
+// Panics if hdr is too short to hold the field.
+func (f HeaderField) Get(hdr []byte) uint32 {
+	b := hdr[f.Offset() : f.Offset()+f.Size()]
+	if f.Size() == 4 {
+		return binary.BigEndian.Uint32(b)
+	}
+	return uint32(binary.BigEndian.Uint16(b))
+}
+
+// Put sets the field in the header at the start of hdr to v, truncated to the
+// field's size. Panics if hdr is too short to hold the field.
+func (f HeaderField) Put(hdr []byte, v uint32) {
+	b := hdr[f.Offset() : f.Offset()+f.Size()]
+	if f.Size() == 4 {
+		binary.BigEndian.PutUint32(b, v)
+	} else {
+		binary.BigEndian.PutUint16(b, uint16(v))
+	}
+}
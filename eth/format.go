@@ -0,0 +1,134 @@
+package eth
+
+import (
+	"net/netip"
+	"strconv"
+)
+
+// This file implements append style formatting of addresses and headers which
+// does not allocate when dst has enough capacity, so diagnostics may be
+// produced on targets where garbage collection pauses are not acceptable.
+// The String methods of headers are implemented in terms of AppendTo.
+
+// AppendMAC appends the hardware address mac to dst in the colon separated
+// hexadecimal form of [net.HardwareAddr.String], i.e: "de:ad:be:ef:00:01".
+func AppendMAC(dst []byte, mac [6]byte) []byte {
+	for i, b := range mac {
+		if i > 0 {
+			dst = append(dst, ':')
+		}
+		hex := hexascii(b)
+		dst = append(dst, hex[0], hex[1])
+	}
+	return dst
+}
+
+// AppendAddr appends the IPv4 address addr to dst in dotted decimal form.
+func AppendAddr(dst []byte, addr [4]byte) []byte {
+	for i, b := range addr {
+		if i > 0 {
+			dst = append(dst, '.')
+		}
+		dst = strconv.AppendUint(dst, uint64(b), 10)
+	}
+	return dst
+}
+
+// AppendAddrPort appends the IPv4 address addr and port to dst, i.e: "192.168.1.1:80".
+func AppendAddrPort(dst []byte, addr [4]byte, port uint16) []byte {
+	dst = AppendAddr(dst, addr)
+	dst = append(dst, ':')
+	return strconv.AppendUint(dst, uint64(port), 10)
+}
+
+// AppendTo appends the human readable representation of the Ethernet header
+// returned by [EthernetHeader.String] to dst.
+func (ehdr *EthernetHeader) AppendTo(dst []byte) []byte {
+	dst = append(dst, "dst: "...)
+	dst = AppendMAC(dst, ehdr.Destination)
+	dst = append(dst, ", src: "...)
+	dst = AppendMAC(dst, ehdr.Source)
+	dst = append(dst, ", etype: "...)
+	ethertp := ehdr.AssertType()
+	if ethertp == EtherTypeIPv4 {
+		// Default case for most common IPv4 traffic.
+		dst = append(dst, "IPv4"...)
+	} else if str, ok := _EtherType_map[ethertp]; ok {
+		dst = append(dst, str...)
+	} else {
+		dst = strconv.AppendUint(dst, uint64(ethertp), 10)
+	}
+	if ehdr.IsVLAN() {
+		dst = append(dst, "(VLAN)"...)
+	}
+	return dst
+}
+
+// AppendTo appends the human readable representation of the IPv4 header
+// returned by [IPv4Header.String] to dst.
+func (iphdr *IPv4Header) AppendTo(dst []byte) []byte {
+	dst = AppendAddr(dst, iphdr.Source)
+	dst = append(dst, " -> "...)
+	dst = AppendAddr(dst, iphdr.Destination)
+	dst = append(dst, " proto="...)
+	dst = strconv.AppendUint(dst, uint64(iphdr.Protocol), 10)
+	dst = append(dst, " len="...)
+	return strconv.AppendUint(dst, uint64(iphdr.TotalLength), 10)
+}
+
+// AppendTo appends the human readable representation of the IPv6 header
+// returned by [IPv6Header.String] to dst.
+func (ip6 *IPv6Header) AppendTo(dst []byte) []byte {
+	dst = netip.AddrFrom16(ip6.Source).AppendTo(dst)
+	dst = append(dst, " -> "...)
+	dst = netip.AddrFrom16(ip6.Destination).AppendTo(dst)
+	dst = append(dst, " next="...)
+	dst = strconv.AppendUint(dst, uint64(ip6.NextHeader), 10)
+	dst = append(dst, " len="...)
+	return strconv.AppendUint(dst, uint64(ip6.PayloadLength), 10)
+}
+
+// AppendTo appends the human readable representation of the UDP header
+// returned by [UDPHeader.String] to dst.
+func (uhdr *UDPHeader) AppendTo(dst []byte) []byte {
+	dst = strconv.AppendUint(dst, uint64(uhdr.SourcePort), 10)
+	dst = append(dst, "->"...)
+	dst = strconv.AppendUint(dst, uint64(uhdr.DestinationPort), 10)
+	dst = append(dst, " len="...)
+	return strconv.AppendUint(dst, uint64(uhdr.Length), 10)
+}
+
+// AppendTo appends the human readable representation of the ARP header
+// returned by [ARPv4Header.String] to dst.
+func (ahdr *ARPv4Header) AppendTo(dst []byte) []byte {
+	dst = append(dst, "ARP "...)
+	if bytesAreAll(ahdr.HardwareTarget[:], 0) {
+		dst = AppendMAC(dst, ahdr.HardwareTarget)
+		dst = append(dst, "->who has "...)
+		dst = AppendAddr(dst, ahdr.ProtoTarget)
+		dst = append(dst, "? Tell "...)
+		return AppendAddr(dst, ahdr.ProtoSender)
+	}
+	dst = AppendMAC(dst, ahdr.HardwareSender)
+	dst = append(dst, "->I have "...)
+	dst = AppendAddr(dst, ahdr.ProtoSender)
+	dst = append(dst, "! Tell "...)
+	dst = AppendAddr(dst, ahdr.ProtoTarget)
+	dst = append(dst, ", aka "...)
+	return AppendMAC(dst, ahdr.HardwareTarget)
+}
+
+// AppendTo appends the human readable representation of the TCP header
+// returned by [TCPHeader.String] to dst.
+func (thdr *TCPHeader) AppendTo(dst []byte) []byte {
+	dst = append(dst, "TCP port "...)
+	dst = strconv.AppendUint(dst, uint64(thdr.SourcePort), 10)
+	dst = append(dst, "->"...)
+	dst = strconv.AppendUint(dst, uint64(thdr.DestinationPort), 10)
+	dst = append(dst, '[')
+	dst = thdr.Flags().AppendFormat(dst)
+	dst = append(dst, "]seq "...)
+	dst = strconv.AppendUint(dst, uint64(thdr.Seq), 10)
+	dst = append(dst, " ack "...)
+	return strconv.AppendUint(dst, uint64(thdr.Ack), 10)
+}
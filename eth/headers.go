@@ -34,9 +34,7 @@ package eth
 
 import (
 	"encoding/binary"
-	"fmt"
 	"net"
-	"strconv"
 
 	"github.com/soypat/seqs"
 )
@@ -138,6 +136,25 @@ type IPv4Header struct {
 	Destination [4]byte // 16:20
 }
 
+// IPv6Header is the fixed Internet Protocol version 6 header of RFC 8200. 40 bytes
+// in size. Extension headers follow it as indicated by NextHeader.
+type IPv6Header struct {
+	// VersionTrafficAndFlow contains the union of the 4 bit Version, which must
+	// be 6 and is force-set in a call to Put, the 8 bit Traffic Class (DSCP and
+	// ECN, as the IPv4 ToS field) and the 20 bit Flow Label.
+	VersionTrafficAndFlow uint32 // 0:4
+	// PayloadLength is the length of the payload following the header in bytes,
+	// extension headers included.
+	PayloadLength uint16 // 4:6
+	// NextHeader identifies the header following this one. It shares values
+	// with the IPv4 Protocol field: TCP is 6, UDP is 17 and ICMPv6 is 58.
+	NextHeader uint8 // 6:7
+	// HopLimit is decremented by each router forwarding the packet, as the IPv4 TTL.
+	HopLimit    uint8    // 7:8
+	Source      [16]byte // 8:24
+	Destination [16]byte // 24:40
+}
+
 // TCPHeader are the first 20 bytes of a TCP header. Does not include options.
 type TCPHeader struct {
 	SourcePort      uint16 // 0:2
@@ -179,17 +196,22 @@ const (
 const (
 	SizeEthernetHeader = 14
 	SizeIPv4Header     = 20
+	SizeIPv6Header     = 40
 	SizeUDPHeader      = 8
 	SizeARPv4Header    = 28
 	SizeTCPHeader      = 20
 	SizeDHCPHeader     = 44
 	ipflagDontFrag     = 0x4000
-	ipFlagMoreFrag     = 0x8000
+	ipFlagMoreFrag     = 0x2000
 	ipVersion4         = 0x45
 	ipProtocolTCP      = 6
 	ipProtocolUDP      = 17
 )
 
+// SizeEthernetMin is the minimum size of an ethernet frame excluding the
+// 4 octet frame check sequence. Shorter frames must be zero padded to this size.
+const SizeEthernetMin = 60
+
 func IsBroadcastHW(hwaddr net.HardwareAddr) bool {
 	// This comparison should be optimized by compiler to not allocate.
 	// See bytes.Equal.
@@ -206,6 +228,7 @@ type EtherType uint16
 
 // DecodeEthernetHeader decodes an ethernet frame from the first 14 bytes of buf.
 // It does not handle 802.1Q VLAN situation where at least 4 more bytes must be decoded from wire.
+// See [DecodeEthernetHeaderVLAN].
 func DecodeEthernetHeader(b []byte) (ethdr EthernetHeader) {
 	_ = b[13]
 	copy(ethdr.Destination[0:], b[0:])
@@ -222,6 +245,69 @@ func DecodeEthernetHeader(b []byte) (ethdr EthernetHeader) {
 // a VLAN double-tap packet.
 func (ehdr *EthernetHeader) IsVLAN() bool { return ehdr.SizeOrEtherType == uint16(EtherTypeVLAN) }
 
+// SizeVLANTag is the size of the 802.1Q tag inserted between the source
+// address and the EtherType of VLAN tagged frames.
+const SizeVLANTag = 4
+
+// VLANTag is the Tag Control Information of an 802.1Q tag: a 3 bit priority
+// code point (PCP), the drop eligible indicator (DEI) and a 12 bit VLAN identifier (VID).
+type VLANTag uint16
+
+// MakeVLANTag returns the tag of VLAN vid with priority code point pcp.
+func MakeVLANTag(pcp uint8, vid uint16) VLANTag {
+	return VLANTag(uint16(pcp&0b111)<<13 | vid&0xfff)
+}
+
+func (tag VLANTag) VID() uint16 { return uint16(tag) & 0xfff }
+func (tag VLANTag) PCP() uint8  { return uint8(tag >> 13) }
+func (tag VLANTag) DEI() bool   { return tag&(1<<12) != 0 }
+
+// DecodeEthernetHeaderVLAN decodes an ethernet frame from buf, which may carry
+// an 802.1Q tag. If it does the tag is returned, the SizeOrEtherType field of
+// ehdr holds the EtherType following the tag and offset is 18, the size of the
+// tagged header. Otherwise tag is zero and offset is 14. Double tagged frames
+// are decoded up to the inner tag, which must then be checked with [EthernetHeader.IsVLAN].
+func DecodeEthernetHeaderVLAN(buf []byte) (ehdr EthernetHeader, tag VLANTag, offset int) {
+	ehdr = DecodeEthernetHeader(buf)
+	if !ehdr.IsVLAN() {
+		return ehdr, 0, SizeEthernetHeader
+	}
+	_ = buf[SizeEthernetHeader+SizeVLANTag-1]
+	tag = VLANTag(binary.BigEndian.Uint16(buf[14:16]))
+	ehdr.SizeOrEtherType = binary.BigEndian.Uint16(buf[16:18])
+	return ehdr, tag, SizeEthernetHeader + SizeVLANTag
+}
+
+// PutVLAN marshals the ethernet frame with an 802.1Q tag onto buf. buf needs to
+// be 18 bytes in length or PutVLAN panics.
+func (ehdr *EthernetHeader) PutVLAN(buf []byte, tag VLANTag) {
+	_ = buf[17]
+	copy(buf[0:], ehdr.Destination[0:])
+	copy(buf[6:], ehdr.Source[0:])
+	binary.BigEndian.PutUint16(buf[12:14], uint16(EtherTypeVLAN))
+	binary.BigEndian.PutUint16(buf[14:16], uint16(tag))
+	binary.BigEndian.PutUint16(buf[16:18], ehdr.SizeOrEtherType)
+}
+
+// IsLength returns true if the SizeOrEtherType field holds the payload length
+// of an IEEE 802.3 frame instead of an EtherType. The payload of such frames
+// starts with an 802.2 LLC header.
+func (ehdr *EthernetHeader) IsLength() bool { return ehdr.SizeOrEtherType <= 1500 }
+
+// SizeSNAPHeader is the size of an 802.2 LLC header followed by a SNAP header.
+const SizeSNAPHeader = 8
+
+// DecodeSNAPEtherType decodes the EtherType of a RFC 1042 encapsulated packet
+// from the 802.2 LLC/SNAP header at the start of b (the payload of an 802.3 frame).
+// ok is false if b does not start with a LLC/SNAP header with a zero OUI.
+func DecodeSNAPEtherType(b []byte) (etype EtherType, ok bool) {
+	if len(b) < SizeSNAPHeader || b[0] != 0xaa || b[1] != 0xaa || b[2] != 0x03 ||
+		b[3] != 0 || b[4] != 0 || b[5] != 0 {
+		return 0, false
+	}
+	return EtherType(binary.BigEndian.Uint16(b[6:8])), true
+}
+
 // AssertType returns the Size or EtherType field of the Ethernet frame as EtherType.
 func (ehdr EthernetHeader) AssertType() EtherType { return EtherType(ehdr.SizeOrEtherType) }
 
@@ -235,23 +321,7 @@ func (ehdr *EthernetHeader) Put(buf []byte) {
 
 // String returns a human readable representation of the Ethernet frame.
 func (ehdr *EthernetHeader) String() string {
-	var vlanstr string
-	if ehdr.IsVLAN() {
-		vlanstr = "(VLAN)"
-	}
-	// Default case for most common IPv4 traffic.
-	ethertpStr := "IPv4"
-	ethertp := ehdr.AssertType()
-	if ethertp != EtherTypeIPv4 {
-		var ok bool
-		ethertpStr, ok = _EtherType_map[EtherType(ethertp)]
-		if !ok {
-			ethertpStr = strconv.Itoa(int(ethertp))
-		}
-	}
-	return strcat("dst: ", net.HardwareAddr(ehdr.Destination[:]).String(), ", ",
-		"src: ", net.HardwareAddr(ehdr.Source[:]).String(), ", ",
-		"etype: ", ethertpStr, vlanstr)
+	return string(ehdr.AppendTo(make([]byte, 0, 64)))
 }
 
 // IHL returns the internet header length in 32bit words and is guaranteed to be within 0..15.
@@ -262,10 +332,7 @@ func (iphdr *IPv4Header) DSCP() uint8    { return iphdr.ToS >> 2 }
 func (iphdr *IPv4Header) ECN() uint8     { return iphdr.ToS & 0b11 }
 
 func (iphdr *IPv4Header) String() string {
-	return strcat(net.IP(iphdr.Source[:]).String(), " -> ",
-		net.IP(iphdr.Destination[:]).String(), " proto=", strconv.Itoa(int(iphdr.Protocol)),
-		" len=", strconv.Itoa(int(iphdr.TotalLength)),
-	)
+	return string(iphdr.AppendTo(make([]byte, 0, 48)))
 }
 
 // DecodeIPv4Header decodes a 20 byte IPv4 header from buf and returns the IPv4Header
@@ -300,6 +367,58 @@ func (iphdr *IPv4Header) Put(buf []byte) {
 	copy(buf[16:20], iphdr.Destination[:])
 }
 
+// PutWithOptions marshals the IPv4 frame followed by options onto buf and returns
+// the header length in bytes. options are padded with zeros (End of Option List)
+// to a multiple of 4 bytes and the IHL written is calculated from their length,
+// ignoring that of iphdr. The checksum is written as is, so it must be calculated
+// over the marshalled header. PutWithOptions panics if options exceed 40 bytes
+// or buf is shorter than the header length.
+func (iphdr *IPv4Header) PutWithOptions(buf []byte, options []byte) int {
+	if len(options) > 40 {
+		panic("IPv4 options exceed 40 bytes")
+	}
+	hlen := SizeIPv4Header + (len(options)+3)/4*4
+	_ = buf[hlen-1]
+	iphdr.Put(buf)
+	buf[0] = 4<<4 | uint8(hlen/4)
+	n := copy(buf[SizeIPv4Header:], options)
+	for i := SizeIPv4Header + n; i < hlen; i++ {
+		buf[i] = 0
+	}
+	return hlen
+}
+
+func (ip6 *IPv6Header) Version() uint8      { return uint8(ip6.VersionTrafficAndFlow >> 28) }
+func (ip6 *IPv6Header) TrafficClass() uint8 { return uint8(ip6.VersionTrafficAndFlow >> 20) }
+func (ip6 *IPv6Header) FlowLabel() uint32   { return ip6.VersionTrafficAndFlow & 0xfffff }
+
+func (ip6 *IPv6Header) String() string {
+	return string(ip6.AppendTo(make([]byte, 0, 112)))
+}
+
+// DecodeIPv6Header decodes a 40 byte IPv6 header from buf.
+func DecodeIPv6Header(buf []byte) (ip6 IPv6Header) {
+	_ = buf[39]
+	ip6.VersionTrafficAndFlow = binary.BigEndian.Uint32(buf[0:])
+	ip6.PayloadLength = binary.BigEndian.Uint16(buf[4:])
+	ip6.NextHeader = buf[6]
+	ip6.HopLimit = buf[7]
+	copy(ip6.Source[:], buf[8:24])
+	copy(ip6.Destination[:], buf[24:40])
+	return ip6
+}
+
+// Put marshals the IPv6 header onto buf. buf needs to be 40 bytes in length or Put panics.
+func (ip6 *IPv6Header) Put(buf []byte) {
+	_ = buf[39]
+	binary.BigEndian.PutUint32(buf[0:], 6<<28|ip6.VersionTrafficAndFlow&0x0fffffff) // ignore set version.
+	binary.BigEndian.PutUint16(buf[4:], ip6.PayloadLength)
+	buf[6] = ip6.NextHeader
+	buf[7] = ip6.HopLimit
+	copy(buf[8:24], ip6.Source[:])
+	copy(buf[24:40], ip6.Destination[:])
+}
+
 // PutPseudo marshals the pseudo-header representation of IPv4 frame onto buf.
 // buf needs to be 12 bytes in length or PutPseudo panics.
 //
@@ -381,19 +500,32 @@ func (uhdr *UDPHeader) Put(buf []byte) {
 // CalculateChecksumIPv4 calculates the checksum for a UDP packet over IPv4.
 func (uhdr *UDPHeader) CalculateChecksumIPv4(pseudoHeader *IPv4Header, payload []byte) uint16 {
 	var crc CRC791
-	crc.Write(pseudoHeader.Source[:])
-	crc.Write(pseudoHeader.Destination[:])
-	crc.AddUint16(uint16(pseudoHeader.Protocol)) // Pads with 0.
-	crc.AddUint16(uhdr.Length)                   // UDP length appears twice: https://stackoverflow.com/questions/45908909/my-udp-checksum-calculation-gives-wrong-results-every-time
-	crc.AddUint16(uhdr.SourcePort)
-	crc.AddUint16(uhdr.DestinationPort)
-	crc.AddUint16(uhdr.Length)
+	// UDP length appears twice: https://stackoverflow.com/questions/45908909/my-udp-checksum-calculation-gives-wrong-results-every-time
+	crc.AddPseudoIPv4(pseudoHeader.Source, pseudoHeader.Destination, pseudoHeader.Protocol, uhdr.Length)
+	uhdr.addChecksum(&crc)
 	crc.Write(payload)
 	return crc.Sum16()
 }
 
+// CalculateChecksumLiteIPv4 calculates the checksum for a UDP-Lite packet over
+// IPv4 as specified by RFC 3828. The Length field of uhdr is interpreted as the
+// checksum coverage: the amount of bytes covered by the checksum counting the header.
+// A coverage of zero means the whole packet is covered. payload is all data following the header.
+func (uhdr *UDPHeader) CalculateChecksumLiteIPv4(pseudoHeader *IPv4Header, payload []byte) uint16 {
+	var crc CRC791
+	covered := payload
+	if uhdr.Length >= SizeUDPHeader && int(uhdr.Length)-SizeUDPHeader < len(payload) {
+		covered = payload[:uhdr.Length-SizeUDPHeader]
+	}
+	// Pseudo-header length is the IP payload length.
+	crc.AddPseudoIPv4(pseudoHeader.Source, pseudoHeader.Destination, pseudoHeader.Protocol, uint16(SizeUDPHeader+len(payload)))
+	uhdr.addChecksum(&crc)
+	crc.Write(covered)
+	return crc.Sum16()
+}
+
 func (uhdr *UDPHeader) String() string {
-	return fmt.Sprintf("%d->%d len=%d", uhdr.SourcePort, uhdr.DestinationPort, uhdr.Length)
+	return string(uhdr.AppendTo(make([]byte, 0, 24)))
 }
 
 // Put marshals the ARP header onto buf. buf needs to be 28 bytes in length or Put panics.
@@ -411,12 +543,7 @@ func (ahdr *ARPv4Header) Put(buf []byte) {
 }
 
 func (ahdr *ARPv4Header) String() string {
-	if bytesAreAll(ahdr.HardwareTarget[:], 0) {
-		return strcat("ARP ", net.HardwareAddr(ahdr.HardwareTarget[:]).String(), "->",
-			"who has ", net.IP(ahdr.ProtoTarget[:]).String(), "?", " Tell ", net.IP(ahdr.ProtoSender[:]).String())
-	}
-	return strcat("ARP ", net.HardwareAddr(ahdr.HardwareSender[:]).String(), "->",
-		"I have ", net.IP(ahdr.ProtoSender[:]).String(), "! Tell ", net.IP(ahdr.ProtoTarget[:]).String(), ", aka ", net.HardwareAddr(ahdr.HardwareTarget[:]).String())
+	return string(ahdr.AppendTo(make([]byte, 0, 96)))
 }
 
 // AssertEtherType returns the ProtoType field of the ARP header as EtherType.
@@ -511,16 +638,9 @@ func (thdr *TCPHeader) CalculateChecksumIPv4(pseudoHeader *IPv4Header, tcpOption
 	const directMethod = true
 	if directMethod {
 		var crc CRC791
-		crc.Write(pseudoHeader.Source[:])
-		crc.Write(pseudoHeader.Destination[:])
-		crc.AddUint16(pseudoHeader.TotalLength - uint16(pseudoHeader.IHL()*4)) // TCP length.
-		crc.AddUint16(uint16(pseudoHeader.Protocol))                           // Pads with 0.
-		crc.AddUint16(thdr.SourcePort)
-		crc.AddUint16(thdr.DestinationPort)
-		crc.AddUint32(uint32(thdr.Seq))
-		crc.AddUint32(uint32(thdr.Ack))
-		crc.AddUint16(thdr.OffsetAndFlags[0])
-		crc.AddUint16(thdr.WindowSizeRaw)
+		tcpLen := pseudoHeader.TotalLength - uint16(pseudoHeader.IHL()*4)
+		crc.AddPseudoIPv4(pseudoHeader.Source, pseudoHeader.Destination, pseudoHeader.Protocol, tcpLen)
+		thdr.addChecksum(&crc)
 		crc.Write(tcpOptions)
 		crc.Write(payload)
 		return crc.Sum16()
@@ -538,13 +658,47 @@ func (thdr *TCPHeader) CalculateChecksumIPv4(pseudoHeader *IPv4Header, tcpOption
 	return crc.Sum16()
 }
 
-func (thdr *TCPHeader) String() string {
-	return strcat("TCP port ", u32toa(uint32(thdr.SourcePort)), "->", u32toa(uint32(thdr.DestinationPort)),
-		thdr.Flags().String(), "seq ", u32toa(uint32(thdr.Seq)), " ack ", u32toa(uint32(thdr.Ack)))
+// TCP option kinds.
+const (
+	TCPOptEnd = 0
+	TCPOptNop = 1
+	// TCPOptMSS is the maximum segment size option of RFC 9293.
+	TCPOptMSS = 2
+	// TCPOptWindowScale is the window scale option of RFC 7323.
+	TCPOptWindowScale = 3
+	// TCPOptSACKPermitted is the SACK-permitted option of RFC 2018.
+	TCPOptSACKPermitted = 4
+	// TCPOptMD5 is the TCP MD5 signature option of RFC 2385.
+	TCPOptMD5 = 19
+	// SizeTCPOptMD5 is the size of the TCP MD5 signature option including kind and length octets.
+	SizeTCPOptMD5 = 18
+)
+
+// FindTCPOption returns the data of the first option of the given kind in
+// opts, excluding the kind and length octets. ok is false if the option is
+// not present or the options are malformed.
+func FindTCPOption(opts []byte, kind uint8) (data []byte, ok bool) {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case TCPOptEnd:
+			return nil, false
+		case TCPOptNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return nil, false // Malformed option.
+		}
+		if opts[0] == kind {
+			return opts[2:opts[1]], true
+		}
+		opts = opts[opts[1]:]
+	}
+	return nil, false
 }
 
-func u32toa(u uint32) string {
-	return strconv.FormatUint(uint64(u), 10)
+func (thdr *TCPHeader) String() string {
+	return string(thdr.AppendTo(make([]byte, 0, 64)))
 }
 
 // bytesAreAll returns true if b is composed of only unit bytes
@@ -557,13 +711,6 @@ func bytesAreAll(b []byte, unit byte) bool {
 	return true
 }
 
-func strcat(strs ...string) (s string) {
-	for i := range strs {
-		s += strs[i]
-	}
-	return s
-}
-
 func hexascii(b byte) [2]byte {
 	const hexstr = "0123456789abcdef"
 	return [2]byte{hexstr[b>>4], hexstr[b&0b1111]}
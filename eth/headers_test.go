@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -168,6 +169,38 @@ func FuzzCRC(f *testing.F) {
 	})
 }
 
+func TestCRC791_combine(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		data := make([]byte, rng.Intn(64))
+		for j := range data {
+			if rng.Intn(4) != 0 { // Leave some zero bytes in the data.
+				data[j] = byte(rng.Intn(256))
+			}
+		}
+		// Checksum random chunks separately and combine them.
+		var crc CRC791
+		dataDiv := data
+		for len(dataDiv) > 0 {
+			n := rng.Intn(len(dataDiv)) + 1
+			var chunk CRC791
+			chunk.Write(dataDiv[:n])
+			crc.Combine(&chunk)
+			dataDiv = dataDiv[n:]
+		}
+		// Writes following Combine must keep alignment.
+		tail := []byte{byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256))}[:rng.Intn(4)]
+		crc.Write(tail)
+		want := sum(append(data, tail...))
+		if got := crc.Sum16(); got != want {
+			t.Fatalf("combined CRC791 mismatch for %q+%q, got %#04x; want %#04x", data, tail, got, want)
+		}
+		if got := crc.Sum(nil); binary.BigEndian.Uint16(got) != want || crc.Size() != len(got) {
+			t.Fatalf("Sum=%x, want %#04x", got, want)
+		}
+	}
+}
+
 // func TestCRC791_multi(t *testing.T) {
 // 	rng := rand.New(rand.NewSource(1))
 // 	for i := 0; i < 1000; i++ {
@@ -227,3 +260,269 @@ func TestIPChecksum(t *testing.T) {
 		t.Errorf("checksum mismatch, got %#04x; expected %#04x", got, expected)
 	}
 }
+
+func TestIPv4PutWithOptions(t *testing.T) {
+	ihdr := IPv4Header{VersionAndIHL: 5, TotalLength: 32, TTL: 1, Protocol: 2}
+	buf := bytes.Repeat([]byte{0xff}, 64)
+	// Router Alert option (RFC 2113) followed by a single No Operation option.
+	n := ihdr.PutWithOptions(buf, []byte{148, 4, 0, 0, 1})
+	if n != 28 {
+		t.Fatalf("header length %d, want 28", n)
+	}
+	got, offset := DecodeIPv4Header(buf)
+	if offset != 28 || got.Version() != 4 {
+		t.Errorf("decoded offset %d version %d", offset, got.Version())
+	}
+	if !bytes.Equal(buf[20:28], []byte{148, 4, 0, 0, 1, 0, 0, 0}) {
+		t.Errorf("options not padded: %x", buf[20:28])
+	}
+	if buf[28] != 0xff {
+		t.Error("wrote past header")
+	}
+	if n := ihdr.PutWithOptions(buf, nil); n != SizeIPv4Header || buf[0] != 0x45 {
+		t.Errorf("no options: header length %d first byte %#x", n, buf[0])
+	}
+}
+
+func TestEthernetHeaderVLAN(t *testing.T) {
+	ehdr := EthernetHeader{
+		Destination:     [6]byte{1, 2, 3, 4, 5, 6},
+		Source:          [6]byte{7, 8, 9, 10, 11, 12},
+		SizeOrEtherType: uint16(EtherTypeIPv4),
+	}
+	tag := MakeVLANTag(5, 100)
+	if tag.VID() != 100 || tag.PCP() != 5 || tag.DEI() {
+		t.Fatalf("tag %#04x: vid=%d pcp=%d dei=%v", uint16(tag), tag.VID(), tag.PCP(), tag.DEI())
+	}
+	var buf [SizeEthernetHeader + SizeVLANTag]byte
+	ehdr.PutVLAN(buf[:], tag)
+	if !bytes.Equal(buf[12:], []byte{0x81, 0x00, 0xa0, 100, 0x08, 0x00}) {
+		t.Fatalf("bad tagged header %x", buf[:])
+	}
+	got, gotTag, offset := DecodeEthernetHeaderVLAN(buf[:])
+	if got != ehdr || gotTag != tag || offset != len(buf) {
+		t.Errorf("decoded %v tag=%#04x offset=%d", &got, uint16(gotTag), offset)
+	}
+	ehdr.Put(buf[:])
+	got, gotTag, offset = DecodeEthernetHeaderVLAN(buf[:])
+	if got != ehdr || gotTag != 0 || offset != SizeEthernetHeader {
+		t.Errorf("decoded untagged %v tag=%#04x offset=%d", &got, uint16(gotTag), offset)
+	}
+}
+
+func TestIPv6Header(t *testing.T) {
+	// Neighbor solicitation from a link-local address to a solicited-node multicast group.
+	hdr, _ := hex.DecodeString("6000000000203aff" +
+		"fe800000000000000201f2fffe000001" +
+		"ff0200000000000000000001ff000002")
+	ip6 := DecodeIPv6Header(hdr)
+	if ip6.Version() != 6 || ip6.PayloadLength != 32 || ip6.NextHeader != 58 || ip6.HopLimit != 255 {
+		t.Fatalf("bad decode %+v", ip6)
+	}
+	const want = "fe80::201:f2ff:fe00:1 -> ff02::1:ff00:2 next=58 len=32"
+	if got := ip6.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	ip6.VersionTrafficAndFlow = 0xab<<20 | 0x12345
+	var buf [SizeIPv6Header]byte
+	ip6.Put(buf[:])
+	got := DecodeIPv6Header(buf[:])
+	if got.Version() != 6 || got.TrafficClass() != 0xab || got.FlowLabel() != 0x12345 {
+		t.Errorf("version=%d class=%#x flow=%#x", got.Version(), got.TrafficClass(), got.FlowLabel())
+	}
+	if !bytes.Equal(buf[4:], hdr[4:]) {
+		t.Errorf("marshalled %x, want %x", buf[4:], hdr[4:])
+	}
+}
+
+func TestAppendTo(t *testing.T) {
+	ehdr := EthernetHeader{Destination: [6]byte{0xde, 0xad, 0xbe, 0xef, 0, 1}, Source: [6]byte{2, 0, 0, 0, 0, 0x0a}, SizeOrEtherType: uint16(EtherTypeARP)}
+	ehdrUnknown := ehdr
+	ehdrUnknown.SizeOrEtherType = 0x1234
+	ihdr := IPv4Header{Source: [4]byte{192, 168, 1, 1}, Destination: [4]byte{10, 0, 0, 255}, Protocol: 17, TotalLength: 60}
+	uhdr := UDPHeader{SourcePort: 53, DestinationPort: 1024, Length: 28}
+	request := ARPv4Header{HardwareSender: [6]byte{1, 2, 3, 4, 5, 6}, ProtoSender: [4]byte{192, 168, 1, 2}, ProtoTarget: [4]byte{192, 168, 1, 1}}
+	reply := request
+	reply.HardwareTarget = [6]byte{0xa, 0xb, 0xc, 0xd, 0xe, 0xf}
+	thdr := TCPHeader{SourcePort: 80, DestinationPort: 12345, Seq: 100, Ack: 200, OffsetAndFlags: [1]uint16{0x5012}}
+	var tests = []struct {
+		appendTo func([]byte) []byte
+		want     string
+	}{
+		{ehdr.AppendTo, "dst: de:ad:be:ef:00:01, src: 02:00:00:00:00:0a, etype: ARP"},
+		{ehdrUnknown.AppendTo, "dst: de:ad:be:ef:00:01, src: 02:00:00:00:00:0a, etype: 4660"},
+		{ihdr.AppendTo, "192.168.1.1 -> 10.0.0.255 proto=17 len=60"},
+		{uhdr.AppendTo, "53->1024 len=28"},
+		{request.AppendTo, "ARP 00:00:00:00:00:00->who has 192.168.1.1? Tell 192.168.1.2"},
+		{reply.AppendTo, "ARP 01:02:03:04:05:06->I have 192.168.1.2! Tell 192.168.1.1, aka 0a:0b:0c:0d:0e:0f"},
+		{thdr.AppendTo, "TCP port 80->12345[SYN,ACK]seq 100 ack 200"},
+		{func(b []byte) []byte { return AppendAddrPort(b, ihdr.Destination, 8080) }, "10.0.0.255:8080"},
+	}
+	buf := make([]byte, 0, 128)
+	for i, test := range tests {
+		got := test.appendTo(buf[:0])
+		if string(got) != test.want {
+			t.Errorf("%d: got %q, want %q", i, got, test.want)
+		}
+		allocs := testing.AllocsPerRun(10, func() { test.appendTo(buf[:0]) })
+		if allocs != 0 {
+			t.Errorf("%d: %v allocations appending to buffer with capacity", i, allocs)
+		}
+	}
+	if ehdr.String() != tests[0].want || thdr.String() != tests[6].want {
+		t.Error("String does not match AppendTo")
+	}
+}
+
+func TestHeaderByteOrder(t *testing.T) {
+	// Reference captures of every header type. Multi-byte fields are chosen
+	// so that reading them in host byte order yields different values.
+	mustHex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	ethCapture := mustHex("ffffffffffff784476c48db00800")
+	arpCapture := mustHex("0001080006040001784476c48db0c0a8006f000000000000c0a80001")
+	ipCapture := mustHex("450000a24ab0400080116cdcc0a8006fc0a800ff")
+	udpCapture := mustHex("445c0035008e278f")
+	tcpCapture := mustHex("b58404d241dafee500000000a002faf076de0001")
+
+	e := DecodeEthernetHeader(ethCapture)
+	a := DecodeARPv4Header(arpCapture)
+	ip, _ := DecodeIPv4Header(ipCapture)
+	u := DecodeUDPHeader(udpCapture)
+	tcp, _ := DecodeTCPHeader(tcpCapture)
+	switch {
+	case e != EthernetHeader{Destination: BroadcastHW6(), Source: [6]byte{0x78, 0x44, 0x76, 0xc4, 0x8d, 0xb0}, SizeOrEtherType: 0x0800}:
+		t.Errorf("ethernet: %v", e.String())
+	case a != ARPv4Header{HardwareType: 1, ProtoType: 0x0800, HardwareLength: 6, ProtoLength: 4, Operation: 1,
+		HardwareSender: e.Source, ProtoSender: [4]byte{192, 168, 0, 111}, ProtoTarget: [4]byte{192, 168, 0, 1}}:
+		t.Errorf("ARP: %v", a.String())
+	case ip != IPv4Header{VersionAndIHL: 0x45, TotalLength: 162, ID: 0x4ab0, Flags: 0x4000, TTL: 128, Protocol: 17,
+		Checksum: 0x6cdc, Source: [4]byte{192, 168, 0, 111}, Destination: [4]byte{192, 168, 0, 255}}:
+		t.Errorf("IP: %v", ip.String())
+	case u != UDPHeader{SourcePort: 17500, DestinationPort: 53, Length: 142, Checksum: 0x278f}:
+		t.Errorf("UDP: %v", u.String())
+	case tcp != TCPHeader{SourcePort: 46468, DestinationPort: 1234, Seq: 1104871141, OffsetAndFlags: [1]uint16{0xa002},
+		WindowSizeRaw: 64240, Checksum: 30430, UrgentPtr: 1}:
+		t.Errorf("TCP: %v", tcp.String())
+	}
+
+	// Headers marshal back into the captures.
+	var buf [SizeTCPHeader + SizeARPv4Header]byte
+	for i, test := range []struct {
+		capture []byte
+		put     func([]byte)
+	}{
+		{ethCapture, e.Put},
+		{arpCapture, a.Put},
+		{ipCapture, ip.Put},
+		{udpCapture, u.Put},
+		{tcpCapture, tcp.Put},
+	} {
+		got := buf[:len(test.capture)]
+		test.put(got)
+		if !bytes.Equal(got, test.capture) {
+			t.Errorf("%d: marshalled %x, want %x", i, got, test.capture)
+		}
+	}
+
+	// Field accessors agree with the decoded headers and set the captured bytes.
+	for _, test := range []struct {
+		field   HeaderField
+		capture []byte
+		want    uint32
+	}{
+		{FieldEtherType, ethCapture, uint32(e.SizeOrEtherType)},
+		{FieldARPHardwareType, arpCapture, uint32(a.HardwareType)},
+		{FieldARPProtoType, arpCapture, uint32(a.ProtoType)},
+		{FieldARPOperation, arpCapture, uint32(a.Operation)},
+		{FieldIPv4TotalLength, ipCapture, uint32(ip.TotalLength)},
+		{FieldIPv4ID, ipCapture, uint32(ip.ID)},
+		{FieldIPv4Flags, ipCapture, uint32(ip.Flags)},
+		{FieldIPv4Checksum, ipCapture, uint32(ip.Checksum)},
+		{FieldUDPSourcePort, udpCapture, uint32(u.SourcePort)},
+		{FieldUDPDestinationPort, udpCapture, uint32(u.DestinationPort)},
+		{FieldUDPLength, udpCapture, uint32(u.Length)},
+		{FieldUDPChecksum, udpCapture, uint32(u.Checksum)},
+		{FieldTCPSourcePort, tcpCapture, uint32(tcp.SourcePort)},
+		{FieldTCPDestinationPort, tcpCapture, uint32(tcp.DestinationPort)},
+		{FieldTCPSeq, tcpCapture, uint32(tcp.Seq)},
+		{FieldTCPAck, tcpCapture, uint32(tcp.Ack)},
+		{FieldTCPOffsetAndFlags, tcpCapture, uint32(tcp.OffsetAndFlags[0])},
+		{FieldTCPWindowSize, tcpCapture, uint32(tcp.WindowSizeRaw)},
+		{FieldTCPChecksum, tcpCapture, uint32(tcp.Checksum)},
+		{FieldTCPUrgentPtr, tcpCapture, uint32(tcp.UrgentPtr)},
+	} {
+		off, size := test.field.Offset(), test.field.Size()
+		if got := test.field.Get(test.capture); got != test.want {
+			t.Errorf("field at %d: got %#x, want %#x", off, got, test.want)
+		}
+		got := buf[:len(test.capture)]
+		copy(got, test.capture)
+		for i := off; i < off+size; i++ {
+			got[i] = 0
+		}
+		test.field.Put(got, test.want)
+		if !bytes.Equal(got, test.capture) {
+			t.Errorf("field at %d: put %x, want %x", off, got[off:off+size], test.capture[off:off+size])
+		}
+	}
+}
+
+func TestICMPTypeString(t *testing.T) {
+	// All defined types must have a name. Unknown types print their number.
+	defined := []ICMPType{
+		ICMPTypeEchoReply, ICMPTypeDestUnreachable, ICMPTypeSourceQuench, ICMPTypeRedirect,
+		ICMPTypeEcho, ICMPTypeTimeExceeded, ICMPTypeParameterProblem, ICMPTypeTimestamp,
+		ICMPTypeTimestampReply, ICMPTypeAddrMaskRequest, ICMPTypeAddrMaskReply,
+	}
+	for _, typ := range defined {
+		if s := typ.String(); strings.HasPrefix(s, "ICMPType(") {
+			t.Errorf("ICMP type %d has no name", uint8(typ))
+		}
+	}
+	if got := ICMPType(1).String(); got != "ICMPType(1)" {
+		t.Errorf("got %q for unknown type", got)
+	}
+	if got := ICMPTypeTimestampReply.String(); got != "TimestampReply" {
+		t.Errorf("got %q, want TimestampReply", got)
+	}
+}
+
+func TestICMPv6TypeString(t *testing.T) {
+	defined := []ICMPv6Type{
+		ICMPv6TypeDestUnreachable, ICMPv6TypePacketTooBig, ICMPv6TypeTimeExceeded, ICMPv6TypeParameterProblem,
+		ICMPv6TypeEchoRequest, ICMPv6TypeEchoReply, ICMPv6TypeRouterSolicit, ICMPv6TypeRouterAdvert,
+		ICMPv6TypeNeighborSolicit, ICMPv6TypeNeighborAdvert, ICMPv6TypeRedirect,
+	}
+	for _, typ := range defined {
+		if s := typ.String(); strings.HasPrefix(s, "ICMPv6Type(") {
+			t.Errorf("ICMPv6 type %d has no name", uint8(typ))
+		}
+	}
+	if got := ICMPv6Type(5).String(); got != "ICMPv6Type(5)" {
+		t.Errorf("got %q for unknown type", got)
+	}
+	if got := ICMPv6TypeNeighborAdvert.String(); got != "NeighborAdvert" {
+		t.Errorf("got %q, want NeighborAdvert", got)
+	}
+}
+
+func TestIPProtoString(t *testing.T) {
+	defined := []IPProto{IPProtoICMP, IPProtoIGMP, IPProtoTCP, IPProtoUDP, IPProtoICMPv6, IPProtoUDPLite}
+	for _, proto := range defined {
+		if s := proto.String(); strings.HasPrefix(s, "IPProto(") {
+			t.Errorf("IP protocol %d has no name", uint8(proto))
+		}
+	}
+	if got := IPProto(3).String(); got != "IPProto(3)" {
+		t.Errorf("got %q for unknown protocol", got)
+	}
+	if got := IPProtoUDPLite.String(); got != "UDPLite" {
+		t.Errorf("got %q, want UDPLite", got)
+	}
+}
@@ -0,0 +1,89 @@
+// package lldp implements decoding of the Link Layer Discovery Protocol
+// data units as described in IEEE 802.1AB.
+package lldp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	errShortTLV     = errors.New("LLDP TLV exceeds frame")
+	errNoTerminator = errors.New("LLDP data unit missing End TLV")
+)
+
+// MulticastNearestBridge is the destination hardware address of LLDP data
+// units, which are not forwarded by bridges.
+var MulticastNearestBridge = [6]byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// SizeTLVHeader is the size of the header preceding each TLV value.
+const SizeTLVHeader = 2
+
+// TLVType is the 7 bit type of an LLDP TLV.
+type TLVType uint8
+
+const (
+	TLVEnd TLVType = iota
+	TLVChassisID
+	TLVPortID
+	TLVTimeToLive
+	TLVPortDescription
+	TLVSystemName
+	TLVSystemDescription
+	TLVSystemCapabilities
+	TLVManagementAddress
+	TLVOrganizationSpecific TLVType = 127
+)
+
+// Chassis ID subtypes, first byte of the Chassis ID TLV value.
+const (
+	ChassisComponent      = 1
+	ChassisInterfaceAlias = 2
+	ChassisPortComponent  = 3
+	ChassisMACAddress     = 4
+	ChassisNetworkAddress = 5
+	ChassisInterfaceName  = 6
+	ChassisLocal          = 7
+)
+
+// Port ID subtypes, first byte of the Port ID TLV value.
+const (
+	PortInterfaceAlias = 1
+	PortComponent      = 2
+	PortMACAddress     = 3
+	PortNetworkAddress = 4
+	PortInterfaceName  = 5
+	PortAgentCircuitID = 6
+	PortLocal          = 7
+)
+
+// ForEachTLV calls fn for each TLV of the LLDP data unit in payload, the
+// ethernet frame payload. Iteration stops at the End TLV, which is not
+// passed to fn, or when fn returns an error.
+func ForEachTLV(payload []byte, fn func(typ TLVType, value []byte) error) error {
+	if fn == nil {
+		return errors.New("nil function to parse LLDP")
+	}
+	for ptr := 0; ptr+SizeTLVHeader <= len(payload); {
+		hdr := binary.BigEndian.Uint16(payload[ptr:])
+		typ := TLVType(hdr >> 9)
+		vlen := int(hdr & 0x1ff)
+		ptr += SizeTLVHeader
+		if ptr+vlen > len(payload) {
+			return errShortTLV
+		} else if typ == TLVEnd {
+			return nil
+		}
+		if err := fn(typ, payload[ptr:ptr+vlen]); err != nil {
+			return err
+		}
+		ptr += vlen
+	}
+	return errNoTerminator
+}
+
+// AppendTLV appends a TLV of type typ with value to b. value must be shorter than 512 bytes.
+func AppendTLV(b []byte, typ TLVType, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(typ)<<9|uint16(len(value))&0x1ff)
+	return append(b, value...)
+}
@@ -111,6 +111,8 @@ const (
 	LeapNoWarning LeapIndicator = iota
 	LeapLastMinute61
 	LeapLastMinute59
+	// LeapNotSync is the alarm condition of clocks not synchronized.
+	LeapNotSync
 )
 
 const (
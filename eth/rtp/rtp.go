@@ -0,0 +1,192 @@
+// package rtp implements RTP packetization and minimal RTCP sender reports
+// as described in RFC 3550.
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// SizeHeader is the size of the fixed RTP header without CSRC identifiers or extensions.
+	SizeHeader = 12
+	// SizeSenderReport is the size of an RTCP sender report without reception report blocks.
+	SizeSenderReport = 28
+	// Version2 is the RTP version defined by RFC 3550.
+	Version2 = 2
+	// TypeSenderReport is the RTCP packet type of sender reports.
+	TypeSenderReport = 200
+	maxCSRC          = 15
+)
+
+var (
+	errShort      = errors.New("rtp: short buffer")
+	errVersion    = errors.New("rtp: unsupported version")
+	errNotSR      = errors.New("rtp: not a sender report")
+	errBadPayload = errors.New("rtp: payload type exceeds 7 bits")
+)
+
+// Header is the fixed RTP header. CSRC identifiers and header extensions
+// are skipped when decoding and not written when encoding.
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|V=2|P|X|  CC   |M|     PT      |       sequence number         |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                           timestamp                           |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|           synchronization source (SSRC) identifier            |
+//	+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+
+type Header struct {
+	// Padding is set if the payload is followed by padding octets.
+	Padding bool
+	// Marker is interpreted by the payload profile, usually marking frame boundaries.
+	Marker bool
+	// PayloadType identifies the format of the payload. It is 7 bits wide.
+	PayloadType    uint8
+	SequenceNumber uint16
+	// Timestamp is the sampling instant of the first octet of the payload.
+	Timestamp uint32
+	// SSRC identifies the synchronization source.
+	SSRC uint32
+}
+
+// Put marshals the header onto b. b must be at least SizeHeader in length or Put panics.
+func (h *Header) Put(b []byte) {
+	_ = b[SizeHeader-1] // bounds check hint to compiler; see golang.org/issue/14808
+	b[0] = Version2 << 6
+	if h.Padding {
+		b[0] |= 1 << 5
+	}
+	b[1] = h.PayloadType & 0x7f
+	if h.Marker {
+		b[1] |= 1 << 7
+	}
+	binary.BigEndian.PutUint16(b[2:4], h.SequenceNumber)
+	binary.BigEndian.PutUint32(b[4:8], h.Timestamp)
+	binary.BigEndian.PutUint32(b[8:12], h.SSRC)
+}
+
+// DecodeHeader decodes the RTP header in b and returns the offset at which
+// the payload starts, skipping CSRC identifiers and header extension.
+func DecodeHeader(b []byte) (h Header, payloadOffset int, err error) {
+	if len(b) < SizeHeader {
+		return h, 0, errShort
+	} else if b[0]>>6 != Version2 {
+		return h, 0, errVersion
+	}
+	h.Padding = b[0]&(1<<5) != 0
+	h.Marker = b[1]&(1<<7) != 0
+	h.PayloadType = b[1] & 0x7f
+	h.SequenceNumber = binary.BigEndian.Uint16(b[2:4])
+	h.Timestamp = binary.BigEndian.Uint32(b[4:8])
+	h.SSRC = binary.BigEndian.Uint32(b[8:12])
+	payloadOffset = SizeHeader + 4*int(b[0]&maxCSRC)
+	if b[0]&(1<<4) != 0 {
+		// Header extension: 16 bit profile defined field + 16 bit length in 32 bit words.
+		if len(b) < payloadOffset+4 {
+			return h, 0, errShort
+		}
+		payloadOffset += 4 + 4*int(binary.BigEndian.Uint16(b[payloadOffset+2:]))
+	}
+	if len(b) < payloadOffset {
+		return h, 0, errShort
+	}
+	return h, payloadOffset, nil
+}
+
+// Packetizer generates consecutive RTP headers for a single synchronization
+// source and keeps the statistics needed for RTCP sender reports.
+type Packetizer struct {
+	ssrc    uint32
+	pt      uint8
+	seq     uint16
+	ts      uint32
+	packets uint32
+	octets  uint32
+}
+
+// NewPacketizer returns a Packetizer for the given synchronization source
+// identifier and payload type. RFC 3550 recommends random initial
+// sequence number and timestamp values.
+func NewPacketizer(ssrc uint32, payloadType uint8, initialSeq uint16, initialTimestamp uint32) (Packetizer, error) {
+	if payloadType > 0x7f {
+		return Packetizer{}, errBadPayload
+	}
+	return Packetizer{ssrc: ssrc, pt: payloadType, seq: initialSeq, ts: initialTimestamp}, nil
+}
+
+// Next returns the header for the next packet carrying payloadLen octets and
+// advances the sequence number by one and the timestamp by samples, the
+// duration of the payload in clock rate units.
+func (p *Packetizer) Next(payloadLen int, samples uint32, marker bool) Header {
+	h := Header{
+		Marker:         marker,
+		PayloadType:    p.pt,
+		SequenceNumber: p.seq,
+		Timestamp:      p.ts,
+		SSRC:           p.ssrc,
+	}
+	p.seq++
+	p.ts += samples
+	p.packets++
+	p.octets += uint32(payloadLen)
+	return h
+}
+
+// SenderReport returns a sender report for the packets generated so far.
+// ntpTime is the wallclock time in NTP timestamp format at which rtpTimestamp was sampled.
+func (p *Packetizer) SenderReport(ntpTime uint64, rtpTimestamp uint32) SenderReport {
+	return SenderReport{
+		SSRC:         p.ssrc,
+		NTPTime:      ntpTime,
+		RTPTimestamp: rtpTimestamp,
+		PacketCount:  p.packets,
+		OctetCount:   p.octets,
+	}
+}
+
+// SenderReport is an RTCP sender report (SR) without reception report blocks.
+type SenderReport struct {
+	SSRC uint32
+	// NTPTime is the wallclock time when the report was sent in 64 bit NTP timestamp format.
+	NTPTime uint64
+	// RTPTimestamp corresponds to NTPTime in the units of the RTP timestamps.
+	RTPTimestamp uint32
+	// PacketCount is the total amount of RTP packets sent.
+	PacketCount uint32
+	// OctetCount is the total amount of payload octets sent.
+	OctetCount uint32
+}
+
+// Put marshals the sender report onto b. b must be at least SizeSenderReport in length or Put panics.
+func (sr *SenderReport) Put(b []byte) {
+	_ = b[SizeSenderReport-1] // bounds check hint to compiler; see golang.org/issue/14808
+	b[0] = Version2 << 6      // No padding, zero reception reports.
+	b[1] = TypeSenderReport
+	binary.BigEndian.PutUint16(b[2:4], SizeSenderReport/4-1) // Length in 32 bit words minus one.
+	binary.BigEndian.PutUint32(b[4:8], sr.SSRC)
+	binary.BigEndian.PutUint64(b[8:16], sr.NTPTime)
+	binary.BigEndian.PutUint32(b[16:20], sr.RTPTimestamp)
+	binary.BigEndian.PutUint32(b[20:24], sr.PacketCount)
+	binary.BigEndian.PutUint32(b[24:28], sr.OctetCount)
+}
+
+// DecodeSenderReport decodes the sender information of the RTCP sender report in b.
+// Reception report blocks are ignored.
+func DecodeSenderReport(b []byte) (sr SenderReport, err error) {
+	if len(b) < SizeSenderReport {
+		return sr, errShort
+	} else if b[0]>>6 != Version2 {
+		return sr, errVersion
+	} else if b[1] != TypeSenderReport {
+		return sr, errNotSR
+	}
+	sr.SSRC = binary.BigEndian.Uint32(b[4:8])
+	sr.NTPTime = binary.BigEndian.Uint64(b[8:16])
+	sr.RTPTimestamp = binary.BigEndian.Uint32(b[16:20])
+	sr.PacketCount = binary.BigEndian.Uint32(b[20:24])
+	sr.OctetCount = binary.BigEndian.Uint32(b[24:28])
+	return sr, nil
+}
@@ -0,0 +1,60 @@
+package rtp
+
+import "testing"
+
+func TestPacketizer(t *testing.T) {
+	const ssrc = 0xdeadbeef
+	p, err := NewPacketizer(ssrc, 0, 0xffff, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [SizeHeader]byte
+	for i := 0; i < 3; i++ {
+		h := p.Next(160, 160, i == 0)
+		h.Put(buf[:])
+		got, off, err := DecodeHeader(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		} else if off != SizeHeader {
+			t.Fatalf("payload offset %d, want %d", off, SizeHeader)
+		}
+		if got != h {
+			t.Fatalf("got %+v, want %+v", got, h)
+		}
+		wantSeq := uint16(0xffff + i) // Wraps around.
+		if h.SequenceNumber != wantSeq || h.Timestamp != 1000+160*uint32(i) || h.Marker != (i == 0) {
+			t.Errorf("packet %d: bad header %+v", i, h)
+		}
+	}
+
+	sr := p.SenderReport(0x0102030405060708, 1480)
+	var srbuf [SizeSenderReport]byte
+	sr.Put(srbuf[:])
+	gotsr, err := DecodeSenderReport(srbuf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotsr != sr || sr.PacketCount != 3 || sr.OctetCount != 480 || sr.SSRC != ssrc {
+		t.Errorf("got sender report %+v, want %+v with 3 packets and 480 octets", gotsr, sr)
+	}
+	if _, err = NewPacketizer(ssrc, 128, 0, 0); err == nil {
+		t.Error("expected error for 8 bit payload type")
+	}
+}
+
+func TestDecodeHeaderCSRCAndExtension(t *testing.T) {
+	b := make([]byte, SizeHeader+2*4+4+4+3)
+	h := Header{PayloadType: 96, SequenceNumber: 1, SSRC: 2}
+	h.Put(b)
+	b[0] |= 1<<4 | 2      // Extension and 2 CSRC.
+	b[SizeHeader+8+3] = 1 // Extension length of one word.
+	_, off, err := DecodeHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := len(b) - 3; off != want {
+		t.Errorf("payload offset %d, want %d", off, want)
+	}
+	if _, _, err = DecodeHeader(b[:SizeHeader+4]); err == nil {
+		t.Error("expected error on truncated CSRC list")
+	}
+}
@@ -56,6 +56,13 @@ func (h *RequestHeader) SetContentType(s string) {
 	h.hdr.SetContentType(s)
 }
 
+// ContentLength returns the Content-Length header value. It is -1 for chunked
+// request bodies and -2 if the header is absent.
+func (h *RequestHeader) ContentLength() int { return h.hdr.ContentLength() }
+
+// ConnectionClose returns true if the 'Connection: close' header is set.
+func (h *RequestHeader) ConnectionClose() bool { return h.hdr.ConnectionClose() }
+
 func (h *RequestHeader) DisableSpecialHeader() { h.hdr.DisableSpecialHeader() }
 
 // String returns request header representation.
@@ -5,6 +5,7 @@ package internal
 import (
 	"log/slog"
 	"runtime"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -15,6 +16,8 @@ const (
 )
 
 var (
+	// mu serializes logging of stacks running in different goroutines, which share the state below.
+	mu         sync.Mutex
 	memstats   runtime.MemStats
 	lastAllocs uint64
 
@@ -22,6 +25,8 @@ var (
 )
 
 func LogAttrs(_ *slog.Logger, level slog.Level, msg string, attrs ...slog.Attr) {
+	mu.Lock()
+	defer mu.Unlock()
 	now := time.Now()
 	n := len(now.AppendFormat(timebuf[:0], timefmt))
 	runtime.ReadMemStats(&memstats)
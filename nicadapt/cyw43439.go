@@ -0,0 +1,98 @@
+package nicadapt
+
+import (
+	"errors"
+	"io"
+
+	"github.com/soypat/seqs/stacks"
+)
+
+var errUnexpectedFrame = errors.New("nicadapt: CYW43439 frame received outside of ReadFrame")
+
+// CYW43439Device is implemented by the github.com/soypat/cyw43439 device.
+type CYW43439Device interface {
+	// SendEth transmits the Ethernet frame.
+	SendEth(frame []byte) error
+	// RecvEthHandle registers the handler called with every frame received
+	// during PollOne. The frame must not be retained.
+	RecvEthHandle(handler func(frame []byte) error)
+	// PollOne services a single event of the chip and reports whether more
+	// events are pending.
+	PollOne() (bool, error)
+	// HardwareAddr6 returns the hardware address of the chip.
+	HardwareAddr6() ([6]byte, error)
+}
+
+// CYW43439Config configures a [CYW43439] adapter.
+type CYW43439Config struct {
+	// LinkUp reports whether the chip is joined to a network. If nil the
+	// link is always reported up.
+	LinkUp func() bool
+}
+
+// CYW43439 is a [stacks.NIC] over the Infineon CYW43439 Wi-Fi chip of the
+// Raspberry Pi Pico W.
+type CYW43439 struct {
+	dev CYW43439Device
+	cfg CYW43439Config
+	mac [6]byte
+	// Set by ReadFrame for the duration of polling, written by recv.
+	dst []byte
+	n   int
+}
+
+var _ stacks.NIC = (*CYW43439)(nil)
+
+// NewCYW43439 returns a NIC that sends and receives frames through dev, which
+// must be initialized. The adapter registers its own handler on dev with
+// RecvEthHandle so dev must not be polled by the caller.
+func NewCYW43439(dev CYW43439Device, cfg CYW43439Config) (*CYW43439, error) {
+	if dev == nil {
+		panic("nil CYW43439 device")
+	}
+	mac, err := dev.HardwareAddr6()
+	if err != nil {
+		return nil, err
+	}
+	c := &CYW43439{dev: dev, cfg: cfg, mac: mac}
+	dev.RecvEthHandle(c.recv)
+	return c, nil
+}
+
+// ReadFrame implements [stacks.NIC] by polling the chip until a frame is
+// received or no events are left. Frames longer than dst are dropped and
+// reported with [io.ErrShortBuffer].
+func (c *CYW43439) ReadFrame(dst []byte) (n int, err error) {
+	c.dst, c.n = dst, 0
+	more := true
+	for c.n == 0 && more && err == nil {
+		more, err = c.dev.PollOne()
+	}
+	if c.n > 0 {
+		n = c.n
+	} else if c.n < 0 && err == nil {
+		err = io.ErrShortBuffer
+	}
+	c.dst, c.n = nil, 0
+	return n, err
+}
+
+func (c *CYW43439) recv(frame []byte) error {
+	if c.dst == nil {
+		return errUnexpectedFrame
+	} else if len(frame) > len(c.dst) {
+		c.n = -1
+		return nil
+	}
+	c.n = copy(c.dst, frame)
+	return nil
+}
+
+// WriteFrame implements [stacks.NIC].
+func (c *CYW43439) WriteFrame(frame []byte) error { return c.dev.SendEth(frame) }
+
+// HardwareAddr6 implements [stacks.NIC].
+func (c *CYW43439) HardwareAddr6() [6]byte { return c.mac }
+
+// LinkStatus implements [stacks.NIC].
+func (c *CYW43439) LinkStatus() stacks.LinkStatus { return linkStatus(c.cfg.LinkUp) }
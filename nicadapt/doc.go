@@ -0,0 +1,18 @@
+// Package nicadapt adapts common TinyGo network chip drivers to the
+// [stacks.NIC] interface so a [stacks.PortStack] can be run on them with
+// [stacks.PortStack.RunNIC] without writing glue code:
+//
+//   - [ENC28J60] wraps the tinygo.org/x/drivers/enc28j60 device.
+//   - [CYW43439] wraps the github.com/soypat/cyw43439 device of the Raspberry Pi Pico W.
+//   - [W5500] drives a WIZnet W5500 in MACRAW mode directly over its SPI bus,
+//     since the TinyGo driver only exposes the chip's own TCP/IP sockets.
+//
+// Adapters accept the drivers through small interfaces holding the methods
+// they use so this module does not depend on the driver modules, i.e:
+//
+//	dev := enc28j60.New(csPin, machine.SPI0)
+//	err := dev.Init(mac[:])
+//	...
+//	nic := nicadapt.NewENC28J60(dev, nicadapt.ENC28J60Config{MAC: mac})
+//	err = stack.RunNIC(nic, stacks.NICLoopConfig{}, nil)
+package nicadapt
@@ -0,0 +1,60 @@
+package nicadapt
+
+import "github.com/soypat/seqs/stacks"
+
+// ENC28J60Device is implemented by the tinygo.org/x/drivers/enc28j60 device.
+type ENC28J60Device interface {
+	// PacketRecv reads the next received frame into buf and returns its
+	// length, or zero if no frame is pending.
+	PacketRecv(buf []byte) (uint16, error)
+	// PacketSend transmits the Ethernet frame.
+	PacketSend(frame []byte) error
+}
+
+// ENC28J60Config configures an [ENC28J60] adapter.
+type ENC28J60Config struct {
+	// MAC is the hardware address the device was initialized with.
+	MAC [6]byte
+	// LinkUp reports the state of the link, usually by reading the PHSTAT2
+	// register of the PHY. If nil the link is always reported up.
+	LinkUp func() bool
+}
+
+// ENC28J60 is a [stacks.NIC] over a Microchip ENC28J60 Ethernet controller.
+type ENC28J60 struct {
+	dev ENC28J60Device
+	cfg ENC28J60Config
+}
+
+var _ stacks.NIC = (*ENC28J60)(nil)
+
+// NewENC28J60 returns a NIC that sends and receives frames through dev, which
+// must have been initialized with cfg.MAC.
+func NewENC28J60(dev ENC28J60Device, cfg ENC28J60Config) *ENC28J60 {
+	if dev == nil {
+		panic("nil ENC28J60 device")
+	}
+	return &ENC28J60{dev: dev, cfg: cfg}
+}
+
+// ReadFrame implements [stacks.NIC].
+func (e *ENC28J60) ReadFrame(dst []byte) (int, error) {
+	n, err := e.dev.PacketRecv(dst)
+	return int(n), err
+}
+
+// WriteFrame implements [stacks.NIC].
+func (e *ENC28J60) WriteFrame(frame []byte) error { return e.dev.PacketSend(frame) }
+
+// HardwareAddr6 implements [stacks.NIC].
+func (e *ENC28J60) HardwareAddr6() [6]byte { return e.cfg.MAC }
+
+// LinkStatus implements [stacks.NIC].
+func (e *ENC28J60) LinkStatus() stacks.LinkStatus { return linkStatus(e.cfg.LinkUp) }
+
+func linkStatus(up func() bool) stacks.LinkStatus {
+	if up == nil || up() {
+		return stacks.LinkUp
+	}
+	return stacks.LinkDown
+}
@@ -0,0 +1,302 @@
+package nicadapt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/soypat/seqs/stacks"
+)
+
+func TestENC28J60(t *testing.T) {
+	dev := &fakeENC28J60{rx: [][]byte{[]byte("frame 1")}}
+	link := true
+	mac := [6]byte{0x02, 0, 0, 0, 0, 1}
+	nic := NewENC28J60(dev, ENC28J60Config{MAC: mac, LinkUp: func() bool { return link }})
+	if nic.HardwareAddr6() != mac {
+		t.Error("bad hardware address")
+	}
+	buf := make([]byte, 64)
+	n, err := nic.ReadFrame(buf)
+	if err != nil || string(buf[:n]) != "frame 1" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	n, err = nic.ReadFrame(buf)
+	if err != nil || n != 0 {
+		t.Fatalf("want no frame, got %d bytes, %v", n, err)
+	}
+	err = nic.WriteFrame([]byte("frame 2"))
+	if err != nil || len(dev.tx) != 1 || string(dev.tx[0]) != "frame 2" {
+		t.Fatalf("frame not sent: %v", err)
+	}
+	if nic.LinkStatus() != stacks.LinkUp {
+		t.Error("want link up")
+	}
+	link = false
+	if nic.LinkStatus() != stacks.LinkDown {
+		t.Error("want link down")
+	}
+}
+
+func TestCYW43439(t *testing.T) {
+	dev := &fakeCYW43439{mac: [6]byte{0x02, 0, 0, 0, 0, 2}}
+	nic, err := NewCYW43439(dev, CYW43439Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nic.HardwareAddr6() != dev.mac || nic.LinkStatus() != stacks.LinkUp {
+		t.Error("bad hardware address or link")
+	}
+	// Events that carry no frames are polled through.
+	dev.events = [][]byte{nil, []byte("frame 1"), nil, []byte("a long frame"), []byte("frame 3")}
+	buf := make([]byte, 8)
+	n, err := nic.ReadFrame(buf)
+	if err != nil || string(buf[:n]) != "frame 1" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	n, err = nic.ReadFrame(buf)
+	if !errors.Is(err, io.ErrShortBuffer) || n != 0 {
+		t.Fatalf("want short buffer error, got %d bytes, %v", n, err)
+	}
+	n, err = nic.ReadFrame(buf)
+	if err != nil || string(buf[:n]) != "frame 3" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	n, err = nic.ReadFrame(buf)
+	if err != nil || n != 0 {
+		t.Fatalf("want no frame, got %d bytes, %v", n, err)
+	}
+	err = nic.WriteFrame([]byte("frame 4"))
+	if err != nil || len(dev.tx) != 1 || string(dev.tx[0]) != "frame 4" {
+		t.Fatalf("frame not sent: %v", err)
+	}
+}
+
+func TestW5500(t *testing.T) {
+	chip := newFakeW5500()
+	mac := [6]byte{0x02, 0, 0, 0, 0, 3}
+	nic, err := NewW5500(chip, chip.setCS, W5500Config{MAC: mac, FilterMAC: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chip.mem[w5500BlockCommon][w5500RegSHAR:][:6], mac[:]) {
+		t.Error("hardware address not programmed")
+	}
+	if mode := chip.mem[w5500BlockSocket0][w5500RegSnMR]; mode != w5500SnMRMACRAW|w5500SnMRMFEN {
+		t.Errorf("socket mode %#x", mode)
+	}
+	for sn := 0; sn < w5500Sockets; sn++ {
+		want := byte(0)
+		if sn == 0 {
+			want = w5500BufKB
+		}
+		sizes := chip.mem[sn<<2|w5500BlockSocket0][w5500RegSnRXBUF:][:2]
+		if sizes[0] != want || sizes[1] != want {
+			t.Errorf("socket %d buffer sizes %v", sn, sizes)
+		}
+	}
+
+	if nic.LinkStatus() != stacks.LinkDown {
+		t.Error("want link down")
+	}
+	chip.mem[w5500BlockCommon][w5500RegPHYCFGR] = w5500PHYLink
+	if nic.LinkStatus() != stacks.LinkUp {
+		t.Error("want link up")
+	}
+
+	// Frames wrap around the end of the receive buffer.
+	chip.setReg16(w5500RegSnRXRD, 0xfffa)
+	chip.setReg16(fakeRegSnRXWR, 0xfffa)
+	chip.recv([]byte("frame 1"))
+	chip.recv([]byte("a long frame"))
+	chip.recv([]byte("frame 3"))
+	buf := make([]byte, 8)
+	n, err := nic.ReadFrame(buf)
+	if err != nil || string(buf[:n]) != "frame 1" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	n, err = nic.ReadFrame(buf)
+	if !errors.Is(err, io.ErrShortBuffer) || n != 0 {
+		t.Fatalf("want short buffer error, got %d bytes, %v", n, err)
+	}
+	n, err = nic.ReadFrame(buf)
+	if err != nil || string(buf[:n]) != "frame 3" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	n, err = nic.ReadFrame(buf)
+	if err != nil || n != 0 {
+		t.Fatalf("want no frame, got %d bytes, %v", n, err)
+	}
+
+	err = nic.WriteFrame([]byte("frame 4"))
+	if err != nil || len(chip.sent) != 1 || string(chip.sent[0]) != "frame 4" {
+		t.Fatalf("frame not sent: %v", err)
+	}
+	err = nic.WriteFrame(make([]byte, w5500BufKB*1024+1))
+	if err == nil {
+		t.Error("want error for frame longer than the transmit buffer")
+	}
+}
+
+type fakeENC28J60 struct {
+	rx, tx [][]byte
+}
+
+func (d *fakeENC28J60) PacketRecv(buf []byte) (uint16, error) {
+	if len(d.rx) == 0 {
+		return 0, nil
+	}
+	n := copy(buf, d.rx[0])
+	d.rx = d.rx[1:]
+	return uint16(n), nil
+}
+
+func (d *fakeENC28J60) PacketSend(frame []byte) error {
+	d.tx = append(d.tx, append([]byte{}, frame...))
+	return nil
+}
+
+type fakeCYW43439 struct {
+	mac     [6]byte
+	handler func([]byte) error
+	// events are serviced by PollOne, nil ones carry no frame.
+	events [][]byte
+	tx     [][]byte
+}
+
+func (d *fakeCYW43439) SendEth(frame []byte) error {
+	d.tx = append(d.tx, append([]byte{}, frame...))
+	return nil
+}
+
+func (d *fakeCYW43439) RecvEthHandle(handler func([]byte) error) { d.handler = handler }
+
+func (d *fakeCYW43439) PollOne() (bool, error) {
+	if len(d.events) == 0 {
+		return false, nil
+	}
+	ev := d.events[0]
+	d.events = d.events[1:]
+	if ev != nil {
+		err := d.handler(ev)
+		if err != nil {
+			return false, err
+		}
+	}
+	return len(d.events) > 0, nil
+}
+
+func (d *fakeCYW43439) HardwareAddr6() ([6]byte, error) { return d.mac, nil }
+
+// Socket registers only written by the W5500 itself.
+const (
+	fakeRegSnTXRD = 0x0022
+	fakeRegSnRXWR = 0x002a
+)
+
+// fakeW5500 emulates the register and buffer blocks of a W5500 and the socket
+// commands used by MACRAW mode.
+type fakeW5500 struct {
+	mem      [32][]byte
+	hdr      []byte
+	offset   int
+	selected bool
+	sent     [][]byte
+}
+
+func newFakeW5500() *fakeW5500 {
+	c := &fakeW5500{}
+	for i := range c.mem {
+		c.mem[i] = make([]byte, 1<<16)
+	}
+	c.mem[w5500BlockCommon][w5500RegVERSIONR] = w5500Version
+	return c
+}
+
+func (c *fakeW5500) setCS(level bool) {
+	if !level {
+		c.selected = true
+		c.hdr, c.offset = nil, 0
+		return
+	}
+	if !c.selected || len(c.hdr) < 3 {
+		c.selected = false
+		return
+	}
+	c.selected = false
+	block := c.hdr[2] >> 3
+	write := c.hdr[2]&(1<<2) != 0
+	addr := uint16(c.hdr[0])<<8 | uint16(c.hdr[1])
+	if !write {
+		return
+	}
+	switch {
+	case block == w5500BlockCommon && addr == w5500RegMR:
+		c.mem[block][w5500RegMR] &^= w5500MRReset
+	case block == w5500BlockSocket0 && addr == w5500RegSnCR:
+		c.command(c.mem[block][w5500RegSnCR])
+		c.mem[block][w5500RegSnCR] = 0
+	}
+}
+
+func (c *fakeW5500) Tx(w, r []byte) error {
+	if !c.selected {
+		return errors.New("chip not selected")
+	}
+	if c.hdr == nil {
+		c.hdr = append([]byte{}, w...)
+		return nil
+	}
+	block := c.mem[c.hdr[2]>>3]
+	addr := uint16(c.hdr[0])<<8 | uint16(c.hdr[1])
+	for i := range w {
+		block[addr+uint16(c.offset+i)] = w[i]
+	}
+	for i := range r {
+		r[i] = block[addr+uint16(c.offset+i)]
+	}
+	c.offset += len(w) + len(r)
+	return nil
+}
+
+func (c *fakeW5500) command(cmd byte) {
+	switch cmd {
+	case w5500CROpen:
+		if c.mem[w5500BlockSocket0][w5500RegSnMR]&0x0f == w5500SnMRMACRAW {
+			c.mem[w5500BlockSocket0][w5500RegSnSR] = w5500SRMACRAW
+			c.setReg16(w5500RegSnTXFSR, w5500BufKB*1024)
+		}
+	case w5500CRSend:
+		rd, wr := c.reg16(fakeRegSnTXRD), c.reg16(w5500RegSnTXWR)
+		var frame []byte
+		for ; rd != wr; rd++ {
+			frame = append(frame, c.mem[w5500BlockTx0][rd])
+		}
+		c.sent = append(c.sent, frame)
+		c.setReg16(fakeRegSnTXRD, rd)
+	case w5500CRRecv:
+		c.setReg16(w5500RegSnRXRSR, c.reg16(fakeRegSnRXWR)-c.reg16(w5500RegSnRXRD))
+	}
+}
+
+// recv places a received frame in the receive buffer.
+func (c *fakeW5500) recv(frame []byte) {
+	wr := c.reg16(fakeRegSnRXWR)
+	length := uint16(len(frame) + 2)
+	for i, b := range append([]byte{byte(length >> 8), byte(length)}, frame...) {
+		c.mem[w5500BlockRx0][wr+uint16(i)] = b
+	}
+	c.setReg16(fakeRegSnRXWR, wr+length)
+	c.setReg16(w5500RegSnRXRSR, c.reg16(w5500RegSnRXRSR)+length)
+}
+
+func (c *fakeW5500) reg16(addr uint16) uint16 {
+	reg := c.mem[w5500BlockSocket0][addr:]
+	return uint16(reg[0])<<8 | uint16(reg[1])
+}
+
+func (c *fakeW5500) setReg16(addr, v uint16) {
+	c.mem[w5500BlockSocket0][addr] = byte(v >> 8)
+	c.mem[w5500BlockSocket0][addr+1] = byte(v)
+}
@@ -0,0 +1,304 @@
+package nicadapt
+
+import (
+	"errors"
+	"io"
+
+	"github.com/soypat/seqs/stacks"
+)
+
+var (
+	errW5500NotFound  = errors.New("nicadapt: W5500 not found")
+	errW5500Timeout   = errors.New("nicadapt: W5500 timed out")
+	errW5500NotOpen   = errors.New("nicadapt: W5500 failed to open MACRAW socket")
+	errW5500BadLength = errors.New("nicadapt: W5500 received frame with bad length")
+	errW5500TooLong   = errors.New("nicadapt: frame exceeds W5500 transmit buffer")
+)
+
+// W5500 common and socket register addresses and values. See the W5500 datasheet.
+const (
+	w5500RegMR       = 0x0000
+	w5500RegSHAR     = 0x0009
+	w5500RegPHYCFGR  = 0x002e
+	w5500RegVERSIONR = 0x0039
+
+	w5500RegSnMR      = 0x0000
+	w5500RegSnCR      = 0x0001
+	w5500RegSnSR      = 0x0003
+	w5500RegSnRXBUF   = 0x001e
+	w5500RegSnTXFSR   = 0x0020
+	w5500RegSnTXWR    = 0x0024
+	w5500RegSnRXRSR   = 0x0026
+	w5500RegSnRXRD    = 0x0028
+	w5500MRReset      = 0x80
+	w5500SnMRMACRAW   = 0x04
+	w5500SnMRMFEN     = 0x80
+	w5500CROpen       = 0x01
+	w5500CRSend       = 0x20
+	w5500CRRecv       = 0x40
+	w5500SRMACRAW     = 0x42
+	w5500PHYLink      = 0x01
+	w5500Version      = 0x04
+	w5500Sockets      = 8
+	w5500BufKB        = 16 // All of the chip's buffer memory is given to socket 0.
+	w5500MaxPolls     = 10000
+	w5500BlockCommon  = 0
+	w5500BlockSocket0 = 1
+	w5500BlockTx0     = 2
+	w5500BlockRx0     = 3
+)
+
+// SPI is implemented by TinyGo SPI buses, see tinygo.org/x/drivers.SPI.
+type SPI interface {
+	// Tx writes w and reads into r. Either may be nil.
+	Tx(w, r []byte) error
+}
+
+// W5500Config configures a [W5500].
+type W5500Config struct {
+	// MAC is the hardware address programmed into the chip.
+	MAC [6]byte
+	// FilterMAC makes the chip drop frames not addressed to MAC nor broadcast,
+	// lowering SPI traffic on busy networks. Multicast frames are dropped too
+	// so IPv6 and mDNS do not work with it set.
+	FilterMAC bool
+}
+
+// W5500 is a [stacks.NIC] over a WIZnet W5500 Ethernet controller with its
+// hardwired TCP/IP stack bypassed: socket 0 is opened in MACRAW mode and given
+// all of the chip's buffer memory. The TinyGo driver does not support MACRAW
+// mode so the adapter accesses the chip's registers over SPI itself.
+type W5500 struct {
+	spi SPI
+	cs  func(level bool)
+	cfg W5500Config
+	hdr [3]byte
+	aux [2]byte
+}
+
+var _ stacks.NIC = (*W5500)(nil)
+
+// NewW5500 resets the W5500 on the bus and opens it in MACRAW mode. cs sets the
+// level of the chip select pin, i.e: machine.Pin.Set. The bus must be configured
+// in SPI mode 0 or 3.
+func NewW5500(spi SPI, cs func(level bool), cfg W5500Config) (*W5500, error) {
+	if spi == nil || cs == nil {
+		panic("nil SPI bus or chip select")
+	}
+	w := &W5500{spi: spi, cs: cs, cfg: cfg}
+	cs(true)
+	err := w.writeByte(w5500BlockCommon, w5500RegMR, w5500MRReset)
+	if err != nil {
+		return nil, err
+	}
+	err = w.waitClear(w5500BlockCommon, w5500RegMR)
+	if err != nil {
+		return nil, err
+	}
+	version, err := w.readByte(w5500BlockCommon, w5500RegVERSIONR)
+	if err != nil {
+		return nil, err
+	} else if version != w5500Version {
+		return nil, errW5500NotFound
+	}
+	err = w.write(w5500BlockCommon, w5500RegSHAR, cfg.MAC[:])
+	if err != nil {
+		return nil, err
+	}
+	// Buffer sizes of sockets 1 to 7 are zeroed before socket 0 takes them.
+	// The transmit buffer size register follows the receive one.
+	for sn := w5500Sockets - 1; sn >= 0; sn-- {
+		size := byte(0)
+		if sn == 0 {
+			size = w5500BufKB
+		}
+		block := uint8(sn<<2 | w5500BlockSocket0)
+		err = w.write(block, w5500RegSnRXBUF, []byte{size, size})
+		if err != nil {
+			return nil, err
+		}
+	}
+	mode := byte(w5500SnMRMACRAW)
+	if cfg.FilterMAC {
+		mode |= w5500SnMRMFEN
+	}
+	err = w.writeByte(w5500BlockSocket0, w5500RegSnMR, mode)
+	if err != nil {
+		return nil, err
+	}
+	err = w.command(w5500CROpen)
+	if err != nil {
+		return nil, err
+	}
+	status, err := w.readByte(w5500BlockSocket0, w5500RegSnSR)
+	if err != nil {
+		return nil, err
+	} else if status != w5500SRMACRAW {
+		return nil, errW5500NotOpen
+	}
+	return w, nil
+}
+
+// ReadFrame implements [stacks.NIC]. Frames longer than dst are dropped and
+// reported with [io.ErrShortBuffer].
+func (w *W5500) ReadFrame(dst []byte) (int, error) {
+	received, err := w.read16Stable(w5500RegSnRXRSR)
+	if err != nil || received == 0 {
+		return 0, err
+	}
+	rd, err := w.read16(w5500BlockSocket0, w5500RegSnRXRD)
+	if err != nil {
+		return 0, err
+	}
+	// In MACRAW mode every frame is preceded by its length, header included.
+	length, err := w.read16(w5500BlockRx0, rd)
+	if err != nil {
+		return 0, err
+	} else if length <= 2 || length > received {
+		return 0, errW5500BadLength
+	}
+	n := int(length - 2)
+	if n <= len(dst) {
+		err = w.read(w5500BlockRx0, rd+2, dst[:n])
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = w.write16(w5500BlockSocket0, w5500RegSnRXRD, rd+length)
+	if err != nil {
+		return 0, err
+	}
+	err = w.command(w5500CRRecv)
+	if err != nil {
+		return 0, err
+	} else if n > len(dst) {
+		return 0, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// WriteFrame implements [stacks.NIC]. It waits for transmit buffer space
+// freed by frames being sent.
+func (w *W5500) WriteFrame(frame []byte) error {
+	if len(frame) > w5500BufKB*1024 {
+		return errW5500TooLong
+	}
+	for polls := 0; ; polls++ {
+		free, err := w.read16Stable(w5500RegSnTXFSR)
+		if err != nil {
+			return err
+		} else if int(free) >= len(frame) {
+			break
+		} else if polls == w5500MaxPolls {
+			return errW5500Timeout
+		}
+	}
+	wr, err := w.read16(w5500BlockSocket0, w5500RegSnTXWR)
+	if err != nil {
+		return err
+	}
+	err = w.write(w5500BlockTx0, wr, frame)
+	if err != nil {
+		return err
+	}
+	err = w.write16(w5500BlockSocket0, w5500RegSnTXWR, wr+uint16(len(frame)))
+	if err != nil {
+		return err
+	}
+	return w.command(w5500CRSend)
+}
+
+// HardwareAddr6 implements [stacks.NIC].
+func (w *W5500) HardwareAddr6() [6]byte { return w.cfg.MAC }
+
+// LinkStatus implements [stacks.NIC] by reading the link bit of the PHY
+// configuration register. Bus errors are reported as a link down.
+func (w *W5500) LinkStatus() stacks.LinkStatus {
+	phy, err := w.readByte(w5500BlockCommon, w5500RegPHYCFGR)
+	if err != nil || phy&w5500PHYLink == 0 {
+		return stacks.LinkDown
+	}
+	return stacks.LinkUp
+}
+
+// command issues cmd on socket 0 and waits for the chip to accept it.
+func (w *W5500) command(cmd byte) error {
+	err := w.writeByte(w5500BlockSocket0, w5500RegSnCR, cmd)
+	if err != nil {
+		return err
+	}
+	return w.waitClear(w5500BlockSocket0, w5500RegSnCR)
+}
+
+// waitClear polls the register until the chip clears it.
+func (w *W5500) waitClear(block uint8, addr uint16) error {
+	for polls := 0; polls < w5500MaxPolls; polls++ {
+		v, err := w.readByte(block, addr)
+		if err != nil || v == 0 {
+			return err
+		}
+	}
+	return errW5500Timeout
+}
+
+// read16Stable reads a socket 0 size register, which the datasheet advises
+// reading until two consecutive reads agree since it is updated by the chip.
+func (w *W5500) read16Stable(addr uint16) (uint16, error) {
+	prev, err := w.read16(w5500BlockSocket0, addr)
+	for polls := 0; err == nil && polls < w5500MaxPolls; polls++ {
+		var v uint16
+		v, err = w.read16(w5500BlockSocket0, addr)
+		if v == prev {
+			return v, err
+		}
+		prev = v
+	}
+	if err == nil {
+		err = errW5500Timeout
+	}
+	return 0, err
+}
+
+func (w *W5500) read16(block uint8, addr uint16) (uint16, error) {
+	err := w.read(block, addr, w.aux[:2])
+	return uint16(w.aux[0])<<8 | uint16(w.aux[1]), err
+}
+
+func (w *W5500) write16(block uint8, addr, v uint16) error {
+	w.aux = [2]byte{byte(v >> 8), byte(v)}
+	return w.write(block, addr, w.aux[:2])
+}
+
+func (w *W5500) readByte(block uint8, addr uint16) (byte, error) {
+	err := w.read(block, addr, w.aux[:1])
+	return w.aux[0], err
+}
+
+func (w *W5500) writeByte(block uint8, addr uint16, v byte) error {
+	w.aux[0] = v
+	return w.write(block, addr, w.aux[:1])
+}
+
+func (w *W5500) read(block uint8, addr uint16, dst []byte) error {
+	return w.transfer(block, addr, false, nil, dst)
+}
+
+func (w *W5500) write(block uint8, addr uint16, src []byte) error {
+	return w.transfer(block, addr, true, src, nil)
+}
+
+// transfer runs a variable length data mode SPI frame: a 16 bit address, a
+// control byte selecting the block and direction, and the data.
+func (w *W5500) transfer(block uint8, addr uint16, write bool, src, dst []byte) error {
+	w.hdr = [3]byte{byte(addr >> 8), byte(addr), block << 3}
+	if write {
+		w.hdr[2] |= 1 << 2
+	}
+	w.cs(false)
+	err := w.spi.Tx(w.hdr[:], nil)
+	if err == nil {
+		err = w.spi.Tx(src, dst)
+	}
+	w.cs(true)
+	return err
+}
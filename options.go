@@ -0,0 +1,323 @@
+package seqs
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// TCP option kinds negotiated by the ControlBlock.
+const (
+	optEnd           = 0
+	optNop           = 1
+	optMSS           = 2
+	optWindowScale   = 3
+	optSACKPermitted = 4
+	optSACK          = 5
+	optTimestamps    = 8
+)
+
+const (
+	// maxWindowShift is the largest window scale shift count permitted by RFC 7323 section 2.3.
+	maxWindowShift = 14
+	// defaultMSS is the send MSS assumed when the remote sends no MSS option. See RFC 9293 section 3.7.1.
+	defaultMSS = 536
+	// minMSS is the smallest send MSS used. Remotes advertising a smaller MSS
+	// would otherwise leave no room for data next to the options of segments.
+	minMSS = 64
+	// MaxSACKBlocks is the amount of SACK blocks that fit the TCP options space, see RFC 2018 section 3.
+	MaxSACKBlocks = 4
+	// MaxSACKBlocksTimestamps is the amount of SACK blocks that fit the TCP
+	// options space along with the timestamps option.
+	MaxSACKBlocksTimestamps = 3
+	// SizeTimestampsOption is the size of the timestamps option preceded by
+	// two NOP options for alignment as appended by [AppendTimestamps].
+	SizeTimestampsOption = 12
+)
+
+var errBadOption = errors.New("seqs:malformed TCP option")
+
+// Options are the TCP options exchanged in SYN segments to negotiate the
+// parameters of a connection.
+type Options struct {
+	// MSS is the maximum segment size: the largest amount of data the sender
+	// of the option is willing to receive in a segment, as described in RFC 9293 section 3.7.1.
+	// Zero if the option is absent.
+	MSS uint16
+	// WindowScale is set if the window scale option of RFC 7323 is present.
+	// WindowShift is its shift count, values above 14 are used as 14.
+	WindowScale bool
+	WindowShift uint8
+	// SACKPermitted is set if the SACK-permitted option of RFC 2018 is present.
+	SACKPermitted bool
+	// Timestamps is set if the timestamps option of RFC 7323 is present. Its
+	// values differ in every segment, see [ParseTimestamps].
+	Timestamps bool
+}
+
+// ParseOptions parses the options field of a TCP header. Options other than
+// those represented by [Options] are skipped.
+func ParseOptions(opts []byte) (o Options, err error) {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case optEnd:
+			return o, nil
+		case optNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return o, errBadOption
+		}
+		data := opts[2:opts[1]]
+		switch opts[0] {
+		case optMSS:
+			if len(data) != 2 {
+				return o, errBadOption
+			}
+			o.MSS = binary.BigEndian.Uint16(data)
+		case optWindowScale:
+			if len(data) != 1 {
+				return o, errBadOption
+			}
+			o.WindowScale = true
+			o.WindowShift = clampShift(data[0])
+		case optSACKPermitted:
+			if len(data) != 0 {
+				return o, errBadOption
+			}
+			o.SACKPermitted = true
+		case optTimestamps:
+			if len(data) != 8 {
+				return o, errBadOption
+			}
+			o.Timestamps = true
+		}
+		opts = opts[opts[1]:]
+	}
+	return o, nil
+}
+
+// Append appends the options present in o to dst in TCP header encoding,
+// padded with NOP options to a 32 bit boundary. At most 12 bytes are appended.
+// The timestamps option is not appended since it carries the values of each
+// segment, see [AppendTimestamps].
+func (o Options) Append(dst []byte) []byte {
+	if o.MSS != 0 {
+		dst = append(dst, optMSS, 4, byte(o.MSS>>8), byte(o.MSS))
+	}
+	if o.WindowScale {
+		dst = append(dst, optNop, optWindowScale, 3, clampShift(o.WindowShift))
+	}
+	if o.SACKPermitted {
+		dst = append(dst, optNop, optNop, optSACKPermitted, 2)
+	}
+	return dst
+}
+
+// SACKBlock is a contiguous block of sequence space received ahead of the
+// next expected sequence number as reported by the SACK option of RFC 2018.
+// Left is the first sequence number of the block and Right the sequence
+// number following its last octet.
+type SACKBlock struct {
+	Left, Right Value
+}
+
+// AppendSACK appends a SACK option reporting up to [MaxSACKBlocks] blocks
+// to dst, preceded by two NOP options for alignment. Excess blocks are not
+// appended. Nothing is appended if blocks is empty.
+func AppendSACK(dst []byte, blocks []SACKBlock) []byte {
+	if len(blocks) == 0 {
+		return dst
+	} else if len(blocks) > MaxSACKBlocks {
+		blocks = blocks[:MaxSACKBlocks]
+	}
+	dst = append(dst, optNop, optNop, optSACK, byte(2+8*len(blocks)))
+	for _, b := range blocks {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(b.Left))
+		dst = binary.BigEndian.AppendUint32(dst, uint32(b.Right))
+	}
+	return dst
+}
+
+// ParseSACK parses the blocks of the SACK option in the options field of a
+// TCP header into blocks and returns the amount parsed. It returns zero if
+// the option is absent. Blocks that do not fit blocks are skipped.
+func ParseSACK(opts []byte, blocks []SACKBlock) (n int, err error) {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case optEnd:
+			return 0, nil
+		case optNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return 0, errBadOption
+		}
+		if opts[0] == optSACK {
+			data := opts[2:opts[1]]
+			if len(data) == 0 || len(data)%8 != 0 {
+				return 0, errBadOption
+			}
+			for ; len(data) > 0 && n < len(blocks); data = data[8:] {
+				blocks[n] = SACKBlock{
+					Left:  Value(binary.BigEndian.Uint32(data)),
+					Right: Value(binary.BigEndian.Uint32(data[4:])),
+				}
+				n++
+			}
+			return n, nil
+		}
+		opts = opts[opts[1]:]
+	}
+	return 0, nil
+}
+
+// TimestampOption holds the values of the timestamps option of RFC 7323.
+// TSval is the sender's timestamp clock when the segment was sent and TSecr
+// echoes the most recent TSval received from the remote.
+type TimestampOption struct {
+	TSval, TSecr uint32
+}
+
+// AppendTimestamps appends the timestamps option holding ts to dst, preceded
+// by two NOP options for alignment as recommended by RFC 7323 appendix A.
+func AppendTimestamps(dst []byte, ts TimestampOption) []byte {
+	dst = append(dst, optNop, optNop, optTimestamps, 10)
+	dst = binary.BigEndian.AppendUint32(dst, ts.TSval)
+	return binary.BigEndian.AppendUint32(dst, ts.TSecr)
+}
+
+// ParseTimestamps parses the timestamps option in the options field of a
+// TCP header. ok is false if the option is absent.
+func ParseTimestamps(opts []byte) (ts TimestampOption, ok bool, err error) {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case optEnd:
+			return ts, false, nil
+		case optNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return ts, false, errBadOption
+		}
+		if opts[0] == optTimestamps {
+			if opts[1] != 10 {
+				return ts, false, errBadOption
+			}
+			ts.TSval = binary.BigEndian.Uint32(opts[2:])
+			ts.TSecr = binary.BigEndian.Uint32(opts[6:])
+			return ts, true, nil
+		}
+		opts = opts[opts[1]:]
+	}
+	return ts, false, nil
+}
+
+// SetLocalOptions sets the options sent in the SYN segments of connections.
+// The window scale, SACK-permitted and timestamps options are only sent in a
+// SYN-ACK if they were received in the remote's SYN. The shift count of the
+// window scale applies to windows set with [ControlBlock.SetRecvWindow] once negotiated.
+// Options set persist across connections.
+func (tcb *ControlBlock) SetLocalOptions(o Options) {
+	o.WindowShift = clampShift(o.WindowShift)
+	tcb.localOpts = o
+}
+
+// RecvOptions processes the TCP options of an incoming segment and must be
+// called before passing the segment to Recv. Only the options of SYN segments
+// received while the connection is being synchronized are considered.
+func (tcb *ControlBlock) RecvOptions(seg Segment, opts []byte) error {
+	if !seg.Flags.HasAny(FlagSYN) || (tcb.state != StateListen && tcb.state != StateSynSent) {
+		return nil
+	}
+	o, err := ParseOptions(opts)
+	if err != nil {
+		return err
+	}
+	tcb.remoteOpts = o
+	return nil
+}
+
+// RemoteOptions returns the options received in the remote's SYN segment.
+func (tcb *ControlBlock) RemoteOptions() Options { return tcb.remoteOpts }
+
+// SendOptions returns the options to be sent in seg. Only SYN segments carry options.
+func (tcb *ControlBlock) SendOptions(seg Segment) (o Options) {
+	if !seg.Flags.HasAny(FlagSYN) {
+		return o
+	}
+	o = tcb.localOpts
+	if seg.Flags.HasAny(FlagACK) {
+		// Reply to the remote's SYN: only options offered by the remote are sent.
+		o.WindowScale = o.WindowScale && tcb.remoteOpts.WindowScale
+		o.SACKPermitted = o.SACKPermitted && tcb.remoteOpts.SACKPermitted
+		o.Timestamps = o.Timestamps && tcb.remoteOpts.Timestamps
+	}
+	return o
+}
+
+// SendMSS returns the maximum amount of data to send in a segment as
+// advertised by the remote's MSS option, or 536 if it sent none. Advertised
+// values are clamped to a minimum of 64.
+func (tcb *ControlBlock) SendMSS() Size {
+	if tcb.remoteOpts.MSS == 0 {
+		return defaultMSS
+	} else if tcb.remoteOpts.MSS < minMSS {
+		return minMSS
+	}
+	return Size(tcb.remoteOpts.MSS)
+}
+
+// SACKPermitted returns true if both ends sent the SACK-permitted option.
+func (tcb *ControlBlock) SACKPermitted() bool {
+	return tcb.localOpts.SACKPermitted && tcb.remoteOpts.SACKPermitted
+}
+
+// TimestampsEnabled returns true if both ends sent the timestamps option, in
+// which case it is sent in every segment of the connection. See RFC 7323 section 3.2.
+func (tcb *ControlBlock) TimestampsEnabled() bool {
+	return tcb.localOpts.Timestamps && tcb.remoteOpts.Timestamps
+}
+
+// windowShifts returns the shift counts applied to the windows advertised by
+// the remote and the local end. They are zero unless both ends sent the window scale option.
+func (tcb *ControlBlock) windowShifts() (snd, rcv uint8) {
+	if !tcb.localOpts.WindowScale || !tcb.remoteOpts.WindowScale {
+		return 0, 0
+	}
+	return tcb.remoteOpts.WindowShift, tcb.localOpts.WindowShift
+}
+
+// EncodeWindow returns the value of the window field of the TCP header of an
+// outgoing segment with the given flags advertising wnd. The window of SYN
+// segments is never scaled as per RFC 7323 section 2.2.
+func (tcb *ControlBlock) EncodeWindow(wnd Size, flags Flags) uint16 {
+	if !flags.HasAny(FlagSYN) {
+		_, shift := tcb.windowShifts()
+		wnd >>= shift
+	}
+	if wnd > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(wnd)
+}
+
+// DecodeWindow returns the window advertised by the remote in an incoming
+// segment with the given flags and TCP header window field raw.
+func (tcb *ControlBlock) DecodeWindow(raw uint16, flags Flags) Size {
+	if flags.HasAny(FlagSYN) {
+		return Size(raw)
+	}
+	shift, _ := tcb.windowShifts()
+	return Size(raw) << shift
+}
+
+func clampShift(shift uint8) uint8 {
+	if shift > maxWindowShift {
+		return maxWindowShift
+	}
+	return shift
+}
@@ -459,6 +459,137 @@ func TestExchange_helloworld(t *testing.T) {
 	tcbB.HelperExchange(t, exchangeB)
 }
 
+func TestOptions(t *testing.T) {
+	local := seqs.Options{MSS: 1460, WindowScale: true, WindowShift: 2, SACKPermitted: true}
+	encoded := local.Append(nil)
+	if len(encoded)%4 != 0 {
+		t.Fatalf("options not padded to 32 bits: %x", encoded)
+	}
+	got, err := seqs.ParseOptions(encoded)
+	if err != nil || got != local {
+		t.Fatalf("parsed %+v err=%v, want %+v", got, err, local)
+	}
+	if _, err = seqs.ParseOptions([]byte{2, 4, 5}); err == nil {
+		t.Error("expected error parsing truncated MSS option")
+	}
+	sack := []seqs.SACKBlock{{Left: 100, Right: 200}, {Left: 0xffff_fff0, Right: 10}}
+	encoded = seqs.AppendSACK(nil, sack)
+	var blocks [seqs.MaxSACKBlocks]seqs.SACKBlock
+	n, err := seqs.ParseSACK(encoded, blocks[:])
+	if err != nil || len(encoded)%4 != 0 || n != len(sack) || blocks[0] != sack[0] || blocks[1] != sack[1] {
+		t.Fatalf("SACK blocks %v err=%v from %x, want %v", blocks[:n], err, encoded, sack)
+	}
+
+	// Server without SACK support accepts a window scaled connection.
+	var client, server seqs.ControlBlock
+	client.SetLocalOptions(local)
+	server.SetLocalOptions(seqs.Options{MSS: 536, WindowScale: true, WindowShift: 1})
+	const wnd = 0x8000
+	if err = server.Open(300, wnd, seqs.StateListen); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Open(100, wnd, seqs.StateSynSent); err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(from, to *seqs.ControlBlock) seqs.Segment {
+		t.Helper()
+		seg, ok := from.PendingSegment(0)
+		if !ok {
+			t.Fatal("no pending segment")
+		}
+		opts := from.SendOptions(seg).Append(nil)
+		raw := from.EncodeWindow(seg.WND, seg.Flags)
+		if err := from.Send(seg); err != nil {
+			t.Fatal(err)
+		}
+		if err := to.RecvOptions(seg, opts); err != nil {
+			t.Fatal(err)
+		}
+		seg.WND = to.DecodeWindow(raw, seg.Flags)
+		if err := to.Recv(seg); err != nil {
+			t.Fatal(err)
+		}
+		return seg
+	}
+	syn := seqs.Segment{SEQ: 100, Flags: seqs.FlagSYN, WND: wnd}
+	if err = client.Send(syn); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.RecvOptions(syn, client.SendOptions(syn).Append(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Recv(syn); err != nil {
+		t.Fatal(err)
+	}
+	synack, _ := server.PendingSegment(0)
+	if opts := server.SendOptions(synack); opts.SACKPermitted || !opts.WindowScale {
+		t.Errorf("SYN-ACK options %+v: want window scale without SACK-permitted", opts)
+	}
+	exchange(&server, &client)
+	exchange(&client, &server)
+	if client.State() != seqs.StateEstablished || server.State() != seqs.StateEstablished {
+		t.Fatal("not established", client.State(), server.State())
+	}
+	if client.SendMSS() != 536 || server.SendMSS() != 1460 {
+		t.Errorf("send MSS client=%d server=%d, want 536 and 1460", client.SendMSS(), server.SendMSS())
+	}
+	if client.SACKPermitted() {
+		t.Error("SACK permitted without server support")
+	}
+	if raw := server.EncodeWindow(wnd, seqs.FlagACK); raw != wnd>>1 {
+		t.Errorf("server window field=%d, want %d scaled by 1", raw, wnd>>1)
+	}
+	if got := client.DecodeWindow(wnd>>1, seqs.FlagACK); got != wnd {
+		t.Errorf("client decoded window=%d, want %d", got, wnd)
+	}
+}
+
+func TestTimestampsOption(t *testing.T) {
+	ts := seqs.TimestampOption{TSval: 0xdead_beef, TSecr: 1}
+	encoded := seqs.AppendTimestamps(seqs.AppendSACK(nil, []seqs.SACKBlock{{Left: 1, Right: 2}}), ts)
+	if len(encoded)%4 != 0 || len(encoded) != 12+seqs.SizeTimestampsOption {
+		t.Fatalf("bad encoding %x", encoded)
+	}
+	got, ok, err := seqs.ParseTimestamps(encoded)
+	if err != nil || !ok || got != ts {
+		t.Fatalf("parsed %+v ok=%v err=%v, want %+v", got, ok, err, ts)
+	}
+	if _, ok, err = seqs.ParseTimestamps(encoded[:12]); ok || err != nil {
+		t.Errorf("ok=%v err=%v parsing options without timestamps", ok, err)
+	}
+	if _, _, err = seqs.ParseTimestamps([]byte{8, 6, 0, 0, 0, 0}); err == nil {
+		t.Error("expected error parsing short timestamps option")
+	}
+
+	// Timestamps are only used if both ends send the option in their SYN.
+	for _, remote := range []bool{false, true} {
+		var client, server seqs.ControlBlock
+		client.SetLocalOptions(seqs.Options{Timestamps: true})
+		server.SetLocalOptions(seqs.Options{Timestamps: remote})
+		server.Open(300, 1024, seqs.StateListen)
+		client.Open(100, 1024, seqs.StateSynSent)
+		syn := seqs.Segment{SEQ: 100, Flags: seqs.FlagSYN, WND: 1024}
+		client.Send(syn)
+		opts := seqs.AppendTimestamps(client.SendOptions(syn).Append(nil), ts)
+		if err = server.RecvOptions(syn, opts); err != nil {
+			t.Fatal(err)
+		}
+		server.Recv(syn)
+		synack, _ := server.PendingSegment(0)
+		if got := server.SendOptions(synack).Timestamps; got != remote {
+			t.Errorf("SYN-ACK timestamps=%v, want %v", got, remote)
+		}
+		if server.TimestampsEnabled() != remote {
+			t.Errorf("server timestamps enabled=%v, want %v", server.TimestampsEnabled(), remote)
+		}
+		state := server.AppendState(nil)
+		var restored seqs.ControlBlock
+		if err = restored.SetState(state); err != nil || restored.TimestampsEnabled() != remote {
+			t.Errorf("restored timestamps enabled=%v err=%v, want %v", restored.TimestampsEnabled(), err, remote)
+		}
+	}
+}
+
 func TestResetEstablished(t *testing.T) {
 	var tcb seqs.ControlBlock
 	const windowA, windowB = 502, 4096
@@ -516,6 +647,190 @@ func TestFinackClose(t *testing.T) {
 	}
 }
 
+func TestControlState(t *testing.T) {
+	var tcb seqs.ControlBlock
+	const windowA, windowB = 502, 4096
+	const issA, issB = 100, 200
+	tcb.HelperInitState(seqs.StateEstablished, issA, issA, windowA)
+	tcb.HelperInitRcv(issB, issB, windowB)
+	err := tcb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := tcb.AppendState(nil)
+	if len(state) != seqs.SizeControlState {
+		t.Fatalf("state length %d, want %d", len(state), seqs.SizeControlState)
+	}
+	var restored seqs.ControlBlock
+	err = restored.SetState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != tcb {
+		t.Fatalf("restored %+v, want %+v", restored, tcb)
+	}
+	// Restored connection proceeds to close as the original would.
+	seg, ok := restored.PendingSegment(0)
+	if !ok || !seg.Flags.HasAll(seqs.FlagFIN|seqs.FlagACK) {
+		t.Fatalf("expected pending FIN|ACK; got %s", seg.Flags.String())
+	}
+	err = restored.SetState(state[:len(state)-1])
+	if err == nil {
+		t.Error("expected error restoring truncated state")
+	}
+}
+
+func TestRetransmitSegment(t *testing.T) {
+	var tcb seqs.ControlBlock
+	const windowA, windowB = 502, 4096
+	const issA, issB = 100, 200
+	tcb.HelperInitState(seqs.StateEstablished, issA, issA, windowA)
+	tcb.HelperInitRcv(issB, issB, windowB)
+	if _, ok := tcb.RetransmitSegment(10); ok {
+		t.Fatal("expected no retransmission without data in flight")
+	}
+	err := tcb.Send(seqs.Segment{SEQ: issA, ACK: issB, Flags: seqs.FlagACK, WND: windowA, DATALEN: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(payloadLen int, want seqs.Segment) {
+		t.Helper()
+		seg, ok := tcb.RetransmitSegment(payloadLen)
+		if !ok {
+			t.Fatal("expected retransmission")
+		} else if seg != want {
+			t.Errorf("got retransmission %+v, want %+v", seg, want)
+		}
+	}
+	check(3, seqs.Segment{SEQ: issA, ACK: issB, Flags: seqs.FlagACK, WND: windowA, DATALEN: 3})
+	check(10, seqs.Segment{SEQ: issA, ACK: issB, Flags: seqs.FlagACK, WND: windowA, DATALEN: 5})
+	if tcb.SendNext() != issA+5 {
+		t.Fatal("retransmission modified SND.NXT")
+	}
+
+	// FIN is retransmitted along with the data preceding it.
+	err = tcb.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tcb.Send(seqs.Segment{SEQ: issA + 5, ACK: issB, Flags: FINACK, WND: windowA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(3, seqs.Segment{SEQ: issA, ACK: issB, Flags: seqs.FlagACK, WND: windowA, DATALEN: 3})
+	check(10, seqs.Segment{SEQ: issA, ACK: issB, Flags: FINACK, WND: windowA, DATALEN: 5})
+
+	err = tcb.Recv(seqs.Segment{SEQ: issB, ACK: issA + 6, Flags: seqs.FlagACK, WND: windowB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcb.SendUnacked() != tcb.SendNext() {
+		t.Fatalf("SND.UNA=%d not acknowledged up to SND.NXT=%d", tcb.SendUnacked(), tcb.SendNext())
+	}
+	if _, ok := tcb.RetransmitSegment(10); ok {
+		t.Error("expected no retransmission after acknowledgement")
+	}
+}
+
+func TestCongestionWindow(t *testing.T) {
+	var tcb seqs.ControlBlock
+	const windowA, windowB = 502, 65535
+	const issA, issB = 100, 200
+	const smss = 536 // No MSS option received.
+	tcb.HelperInitState(seqs.StateEstablished, issA, issA, windowA)
+	tcb.HelperInitRcv(issB, issB, windowB)
+	checkWindow := func(cwnd, ssthresh seqs.Size) {
+		t.Helper()
+		if tcb.CongestionWindow() != cwnd || tcb.SlowStartThreshold() != ssthresh {
+			t.Fatalf("cwnd=%d ssthresh=%d, want cwnd=%d ssthresh=%d", tcb.CongestionWindow(), tcb.SlowStartThreshold(), cwnd, ssthresh)
+		}
+	}
+	send := func(payloadLen int, wantLen seqs.Size) {
+		t.Helper()
+		seg, ok := tcb.PendingSegment(payloadLen)
+		if !ok || seg.DATALEN != wantLen {
+			t.Fatalf("pending segment ok=%v len=%d, want len %d", ok, seg.DATALEN, wantLen)
+		}
+		err := tcb.Send(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ack := func(acked seqs.Size) {
+		t.Helper()
+		err := tcb.Recv(seqs.Segment{SEQ: issB, ACK: seqs.Add(tcb.SendUnacked(), acked), Flags: seqs.FlagACK, WND: windowB})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Initial window of RFC 5681 gates data in flight below the remote's window.
+	checkWindow(4*smss, 0)
+	send(4000, 4*smss)
+	if _, ok := tcb.PendingSegment(100); ok {
+		t.Fatal("data sent beyond congestion window")
+	}
+	// Slow start grows the window by a segment per acknowledgement.
+	ack(2 * smss)
+	checkWindow(5*smss, 0)
+	send(4000, 3*smss)
+
+	// A retransmission timeout collapses the window to a segment.
+	if _, ok := tcb.RetransmitSegment(smss); !ok {
+		t.Fatal("expected retransmission")
+	}
+	checkWindow(smss, 5*smss/2)
+	if _, ok := tcb.RetransmitSegment(smss); !ok {
+		t.Fatal("expected retransmission")
+	}
+	checkWindow(smss, 5*smss/2) // Threshold kept on consecutive timeouts.
+	ack(5 * smss)
+	checkWindow(2*smss, 5*smss/2)
+	send(4000, 2*smss)
+	ack(2 * smss)
+	checkWindow(3*smss, 5*smss/2)
+	// Congestion avoidance grows the window by a segment per window acknowledged.
+	send(4000, 3*smss)
+	ack(2 * smss)
+	checkWindow(3*smss, 5*smss/2)
+	ack(smss)
+	checkWindow(4*smss, 5*smss/2)
+}
+
+func TestZeroWindowUpdate(t *testing.T) {
+	var tcb seqs.ControlBlock
+	const issA, issB = 100, 200
+	tcb.HelperInitState(seqs.StateEstablished, issA, issA, 502)
+	tcb.HelperInitRcv(issB, issB, 1000)
+	seg, ok := tcb.PendingSegment(100)
+	if !ok {
+		t.Fatal("expected data segment")
+	}
+	err := tcb.Send(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Remote acknowledges the data and closes its window.
+	err = tcb.Recv(seqs.Segment{SEQ: issB, ACK: issA + 100, Flags: seqs.FlagACK, WND: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcb.SendWindow() != 0 {
+		t.Fatalf("send window %d, want 0", tcb.SendWindow())
+	}
+	if _, ok := tcb.PendingSegment(100); ok {
+		t.Fatal("data sent into zero window")
+	}
+	// A duplicate ACK reopening the window is not admitted but updates the send window.
+	tcb.Recv(seqs.Segment{SEQ: issB, ACK: issA + 100, Flags: seqs.FlagACK, WND: 300})
+	if tcb.SendWindow() != 300 {
+		t.Fatalf("send window %d after window update, want 300", tcb.SendWindow())
+	}
+	if seg, ok := tcb.PendingSegment(100); !ok || seg.DATALEN != 100 {
+		t.Fatalf("data not sent after window update ok=%v len=%d", ok, seg.DATALEN)
+	}
+}
+
 func TestExchange_helloworld_client(t *testing.T) {
 	return
 	// Client Transmission Control Block.
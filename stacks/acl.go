@@ -0,0 +1,89 @@
+package stacks
+
+import (
+	"errors"
+	"log/slog"
+	"net/netip"
+)
+
+var errBadACLPrefix = errors.New("allowed peer prefix must be a valid IPv4 prefix")
+
+// peerACL is the list of prefixes a port accepts packets from. An empty
+// list accepts packets from all peers.
+type peerACL []ipv4Prefix
+
+func (acl peerACL) allows(addr [4]byte) bool {
+	if len(acl) == 0 {
+		return true
+	}
+	for _, prefix := range acl {
+		if prefix.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAllowedPeersTCP restricts the open TCP port portNum to accept segments
+// only from peers within prefixes. Other segments are dropped before reaching
+// the port's handler and counted in [Health]. Calling SetAllowedPeersTCP with
+// no prefixes accepts all peers. The restriction is removed when the port is closed.
+func (ps *PortStack) SetAllowedPeersTCP(portNum uint16, prefixes []netip.Prefix) error {
+	port := findPort(ps.portsTCP, portNum)
+	if portNum == 0 {
+		return errZeroPort
+	} else if port == nil {
+		return errPortNonexistent
+	}
+	acl, err := makePeerACL(prefixes)
+	if err != nil {
+		return err
+	}
+	port.allow = acl
+	return nil
+}
+
+// SetAllowedPeersUDP restricts the open UDP port portNum to accept datagrams
+// only from peers within prefixes. See [PortStack.SetAllowedPeersTCP].
+func (ps *PortStack) SetAllowedPeersUDP(portNum uint16, prefixes []netip.Prefix) error {
+	port := findPort(ps.portsUDP, portNum)
+	if portNum == 0 {
+		return errZeroPort
+	} else if port == nil {
+		return errPortNonexistent
+	}
+	acl, err := makePeerACL(prefixes)
+	if err != nil {
+		return err
+	}
+	port.allow = acl
+	return nil
+}
+
+// SetAllowedPeers restricts the listener to accept connections only from
+// peers within prefixes. It must be called after StartListening.
+// See [PortStack.SetAllowedPeersTCP].
+func (l *TCPListener) SetAllowedPeers(prefixes []netip.Prefix) error {
+	return l.stack.SetAllowedPeersTCP(l.port, prefixes)
+}
+
+func makePeerACL(prefixes []netip.Prefix) (peerACL, error) {
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	acl := make(peerACL, len(prefixes))
+	for i, prefix := range prefixes {
+		if !prefix.IsValid() || !prefix.Addr().Is4() {
+			return nil, errBadACLPrefix
+		}
+		acl[i] = makeIPv4Prefix(prefix)
+	}
+	return acl, nil
+}
+
+func (ps *PortStack) rejectACL(src [4]byte, dport uint16) {
+	ps.rejectedACL++
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("ACL:reject", ps.addrAttr("src", src), slog.Int("port", int(dport)))
+	}
+}
@@ -0,0 +1,158 @@
+package stacks
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/eth"
+)
+
+var errBadActivityTrace = errors.New("activity trace needs positive record count")
+
+// ActivityEvent is the kind of event of an [ActivityRecord].
+type ActivityEvent uint8
+
+const (
+	// ActivityRecv is a segment received and processed by a connection.
+	ActivityRecv ActivityEvent = iota + 1
+	// ActivitySend is a segment sent by a connection.
+	ActivitySend
+)
+
+// String returns "rx" or "tx".
+func (ev ActivityEvent) String() string {
+	switch ev {
+	case ActivityRecv:
+		return "rx"
+	case ActivitySend:
+		return "tx"
+	}
+	return "ActivityEvent(" + strconv.Itoa(int(ev)) + ")"
+}
+
+// ActivityRecord summarizes a segment received or sent by a TCP connection and
+// the state transition it caused, if any. Payloads are not kept.
+type ActivityRecord struct {
+	Time       time.Time
+	Event      ActivityEvent
+	LocalPort  uint16
+	RemotePort uint16
+	// Prev is the state of the connection before the segment was processed or sent.
+	Prev seqs.State
+	// State is the state of the connection after the segment was processed or sent.
+	State seqs.State
+	Seq   seqs.Value
+	Ack   seqs.Value
+	// Wnd is the window field of the segment as found on the wire, unscaled.
+	Wnd   uint16
+	Len   uint16
+	Flags seqs.Flags
+}
+
+// activityTrace is a ring buffer of the most recent TCP connection activity.
+type activityTrace struct {
+	records []ActivityRecord
+	next    int
+	count   int
+}
+
+// SetActivityTrace enables tracing of the segments received and sent by TCP
+// connections of the stack and the state transitions they cause. The last n
+// records are kept in memory allocated on this call so that they may be
+// retrieved with [PortStack.AppendActivity] after a failure. Calling
+// SetActivityTrace with n equal to zero disables tracing and frees the buffer.
+func (ps *PortStack) SetActivityTrace(n int) error {
+	if n == 0 {
+		ps.activity = nil
+		return nil
+	} else if n < 0 {
+		return errBadActivityTrace
+	}
+	ps.activity = &activityTrace{records: make([]ActivityRecord, n)}
+	return nil
+}
+
+// AppendActivity appends the traced activity records to dst, oldest first.
+// It appends nothing if tracing is disabled. See [PortStack.SetActivityTrace].
+func (ps *PortStack) AppendActivity(dst []ActivityRecord) []ActivityRecord {
+	a := ps.activity
+	if a == nil {
+		return dst
+	}
+	start := a.next - a.count
+	if start < 0 {
+		start += len(a.records)
+	}
+	for i := 0; i < a.count; i++ {
+		dst = append(dst, a.records[(start+i)%len(a.records)])
+	}
+	return dst
+}
+
+// AppendActivityTable appends the activity records in human readable format,
+// one record per line, to b.
+func AppendActivityTable(b []byte, records []ActivityRecord) []byte {
+	for i := range records {
+		rec := &records[i]
+		b = rec.Time.AppendFormat(b, "15:04:05.000000")
+		b = append(b, ' ')
+		b = append(b, rec.Event.String()...)
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, uint64(rec.LocalPort), 10)
+		b = append(b, '-')
+		b = strconv.AppendUint(b, uint64(rec.RemotePort), 10)
+		b = append(b, " seq="...)
+		b = strconv.AppendUint(b, uint64(rec.Seq), 10)
+		b = append(b, " ack="...)
+		b = strconv.AppendUint(b, uint64(rec.Ack), 10)
+		b = append(b, " wnd="...)
+		b = strconv.AppendUint(b, uint64(rec.Wnd), 10)
+		b = append(b, " len="...)
+		b = strconv.AppendUint(b, uint64(rec.Len), 10)
+		b = append(b, ' ')
+		b = append(b, rec.Flags.String()...)
+		b = append(b, ' ')
+		b = append(b, rec.Prev.String()...)
+		if rec.State != rec.Prev {
+			b = append(b, "->"...)
+			b = append(b, rec.State.String()...)
+		}
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// record stores a summary of the segment in tcp, overwriting the oldest record if full.
+func (a *activityTrace) record(t time.Time, ev ActivityEvent, tcp *eth.TCPHeader, datalen int, prev, state seqs.State) {
+	rec := &a.records[a.next]
+	*rec = ActivityRecord{
+		Time:  t,
+		Event: ev,
+		Prev:  prev,
+		State: state,
+		Seq:   tcp.Seq,
+		Ack:   tcp.Ack,
+		Wnd:   tcp.WindowSizeRaw,
+		Len:   uint16(datalen),
+		Flags: tcp.Flags(),
+	}
+	if ev == ActivityRecv {
+		rec.LocalPort, rec.RemotePort = tcp.DestinationPort, tcp.SourcePort
+	} else {
+		rec.LocalPort, rec.RemotePort = tcp.SourcePort, tcp.DestinationPort
+	}
+	a.next = (a.next + 1) % len(a.records)
+	if a.count < len(a.records) {
+		a.count++
+	}
+}
+
+// traceActivity records the segment in tcp received or sent by the connection
+// if activity tracing is enabled. prev is the state before the segment.
+func (sock *TCPConn) traceActivity(ev ActivityEvent, tcp *eth.TCPHeader, datalen int, prev seqs.State) {
+	if a := sock.stack.activity; a != nil {
+		a.record(sock.stack.now(), ev, tcp, datalen, prev, sock.scb.State())
+	}
+}
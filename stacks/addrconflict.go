@@ -0,0 +1,165 @@
+package stacks
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// Address conflict detection timing constants of RFC 5227 section 1.1.
+const (
+	acdProbeNum         = 3
+	acdProbeInterval    = time.Second
+	acdAnnounceWait     = 2 * time.Second
+	acdAnnounceNum      = 2
+	acdAnnounceInterval = 2 * time.Second
+	acdDefendInterval   = 10 * time.Second
+)
+
+// addrConflict implements IPv4 address conflict detection as described in
+// RFC 5227. When enabled, setting the stack's address probes the network for
+// hosts using it and then announces it. Afterwards ARP packets claiming the
+// address from other hosts are reported as conflicts, which either pause the
+// transmission of IP traffic or are defended with an announcement.
+type addrConflict struct {
+	enabled    bool
+	pause      bool
+	onConflict func(addr netip.Addr, hw [6]byte)
+	// probes and announces are the amount of probes and announcements sent for the current address.
+	probes    uint8
+	announces uint8
+	// next is the time the next probe or announcement is due.
+	next time.Time
+	// conflict is set when a conflict is detected and cleared on SetAddr or ClearAddrConflict.
+	conflict   bool
+	conflictHW [6]byte
+	// defended is the time the address was last defended.
+	defended time.Time
+	// count is the amount of conflicts detected. See [Health].
+	count uint32
+}
+
+// restart begins probing the address set at now.
+func (acd *addrConflict) restart(now time.Time) {
+	acd.probes = 0
+	acd.announces = 0
+	acd.next = now
+	acd.conflict = false
+	acd.conflictHW = [6]byte{}
+	acd.defended = time.Time{}
+}
+
+// probing reports whether probes or announcements remain to be sent.
+func (acd *addrConflict) probing() bool {
+	return acd.enabled && !acd.conflict && acd.announces < acdAnnounceNum
+}
+
+// tentative reports whether the address is still being probed, until its first
+// announcement. RFC 5227 section 2.1.1: A host must not use an address it
+// probes, so only probes are sent meanwhile.
+func (acd *addrConflict) tentative() bool {
+	return acd.enabled && acd.announces == 0
+}
+
+// paused reports whether transmission of IP traffic is paused due to a conflict.
+func (acd *addrConflict) paused() bool {
+	return acd.pause && acd.conflict
+}
+
+// AddrConflict returns the hardware address of the host last detected using
+// the stack's address. ok is false if no conflict was detected since the
+// address was set. See [PortStackConfig.AddrConflictDetection].
+func (ps *PortStack) AddrConflict() (hw [6]byte, ok bool) {
+	return ps.acd.conflictHW, ps.acd.conflict
+}
+
+// ClearAddrConflict clears a detected address conflict, resuming transmission
+// if it was paused, i.e: once the conflicting host has been taken care of.
+// Probing of the address is not repeated.
+func (ps *PortStack) ClearAddrConflict() {
+	ps.acd.conflict = false
+	ps.acd.conflictHW = [6]byte{}
+}
+
+// checkAddrConflict checks whether the received ARP packet ahdr reveals
+// another host using the stack's address.
+func (ps *PortStack) checkAddrConflict(ahdr *eth.ARPv4Header) {
+	acd := &ps.acd
+	if !acd.enabled || ps.ip == [4]byte{} || ahdr.HardwareSender == ps.mac {
+		return
+	}
+	// Another host probing for our address while we probe also conflicts. See RFC 5227 section 2.1.1.
+	claimed := ahdr.ProtoSender == ps.ip ||
+		(acd.probing() && ahdr.Operation == 1 && ahdr.ProtoSender == [4]byte{} && ahdr.ProtoTarget == ps.ip)
+	if !claimed {
+		return
+	}
+	now := ps.now()
+	acd.count++
+	ps.error("ARP:addr-conflict", ps.addrAttr("addr", ps.ip), ps.macAttr("hw", ahdr.HardwareSender))
+	first := !acd.conflict
+	acd.conflict = true
+	acd.conflictHW = ahdr.HardwareSender
+	if !acd.pause && acd.announces >= acdAnnounceNum && now.Sub(acd.defended) >= acdDefendInterval {
+		// Defend the address with a single announcement. See RFC 5227 section 2.4 (b).
+		acd.defended = now
+		acd.announces = acdAnnounceNum - 1
+		acd.next = now
+	}
+	if first && acd.onConflict != nil {
+		acd.onConflict(netip.AddrFrom4(ps.ip), ahdr.HardwareSender)
+	}
+}
+
+// addrTentative reports whether the stack's address is being probed and may not be used yet.
+func (ps *PortStack) addrTentative() bool {
+	return ps.ip != [4]byte{} && ps.acd.tentative()
+}
+
+// acdPending reports whether a probe or announcement must be sent.
+func (ps *PortStack) acdPending() bool {
+	acd := &ps.acd
+	return acd.enabled && ps.ip != [4]byte{} && acd.announces < acdAnnounceNum && (!acd.conflict || !acd.defended.IsZero())
+}
+
+// handleAddrConflict writes a due ARP probe or announcement of the stack's address to dst.
+func (ps *PortStack) handleAddrConflict(dst []byte) (n int) {
+	acd := &ps.acd
+	now := ps.now()
+	if !ps.acdPending() || now.Before(acd.next) {
+		return 0
+	}
+	ahdr := eth.ARPv4Header{
+		Operation:      1, // Probes and announcements are requests.
+		HardwareType:   1, // Ethernet.
+		ProtoType:      uint16(eth.EtherTypeIPv4),
+		HardwareLength: 6,
+		ProtoLength:    4,
+		HardwareSender: ps.mac,
+		ProtoTarget:    ps.ip,
+	}
+	if acd.probes < acdProbeNum {
+		acd.probes++
+		acd.next = now.Add(acdProbeInterval)
+		if acd.probes == acdProbeNum {
+			acd.next = now.Add(acdAnnounceWait)
+		}
+	} else {
+		ahdr.ProtoSender = ps.ip
+		acd.announces++
+		acd.next = now.Add(acdAnnounceInterval)
+	}
+	ehdr := eth.EthernetHeader{
+		Destination:     eth.BroadcastHW6(),
+		Source:          ps.mac,
+		SizeOrEtherType: uint16(eth.EtherTypeARP),
+	}
+	ehdr.Put(dst)
+	ahdr.Put(dst[eth.SizeEthernetHeader:])
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("ARP:acd-send", slog.Bool("announce", ahdr.ProtoSender != [4]byte{}))
+	}
+	return eth.SizeEthernetHeader + eth.SizeARPv4Header
+}
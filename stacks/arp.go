@@ -4,6 +4,7 @@ import (
 	"errors"
 	"log/slog"
 	"net/netip"
+	"time"
 
 	"github.com/soypat/seqs/eth"
 )
@@ -19,6 +20,12 @@ var (
 	errNoARPInProgress    = errors.New("no ARP in progress")
 	errARPResponsePending = errors.New("ARP response pending")
 	errARPRequestPending  = errors.New("ARP request not yet sent")
+	errARPTimeout         = errors.New("ARP request timed out")
+)
+
+const (
+	defaultARPTimeout = time.Second
+	defaultARPRetries = 3
 )
 
 /*
@@ -27,9 +34,11 @@ ARP PortStack state machine:
 # ARP User Request (outgoing request)
 
 PortStack.arpResult contains state:
-1. Upon user request `BeginResolveARPv4`: PortStack.arpResult.Operation = 1 (request), which means request has not been sent out.
-2. Upon `handleARP`: PortStack.arpResult.Operation = 0xffff (wait)
-3. Upon corresponding ARP reply in `recvARP`: PortStack.arpResult.Operation = 2 (reply).
+ 1. Upon user request `BeginResolveARPv4`: PortStack.arpResult.Operation = 1 (request), which means request has not been sent out.
+ 2. Upon `handleARP`: PortStack.arpResult.Operation = 0xffff (wait)
+ 3. Upon corresponding ARP reply in `recvARP`: PortStack.arpResult.Operation = 2 (reply).
+ 4. If no reply is received within the timeout in `handleARP`: PortStack.arpResult.Operation = 1 (request) to retry,
+    or once retries are exhausted PortStack.arpResult.Operation = 0xfffe (failed).
 
 If `BeginResolveARPv4` is called at any point in resolution, the state is reset to 1.
 
@@ -43,6 +52,14 @@ type arpClient struct {
 	stack           *PortStack
 	result          eth.ARPv4Header
 	pendingResponse eth.ARPv4Header
+	// sent is the time the last request was sent or, if failed, the time the resolution failed.
+	sent     time.Time
+	attempts uint8
+	// Configuration.
+	timeout time.Duration
+	retries uint8
+	// cache holds resolved addresses. See arpcache.go.
+	cache arpCache
 }
 
 func (c *arpClient) ResultAs6() (netip.Addr, [6]byte, error) {
@@ -53,6 +70,8 @@ func (c *arpClient) ResultAs6() (netip.Addr, [6]byte, error) {
 		return netip.Addr{}, [6]byte{}, errARPRequestPending
 	case arpOpWait:
 		return netip.Addr{}, [6]byte{}, errARPResponsePending
+	case arpOpFailed:
+		return netip.Addr{}, [6]byte{}, errARPTimeout
 	}
 	return netip.AddrFrom4(c.result.ProtoSender), c.result.HardwareSender, nil
 }
@@ -72,6 +91,7 @@ func (c *arpClient) BeginResolve(addr netip.Addr) error {
 		HardwareTarget: [6]byte{}, // Zeroes, is filled by target.
 		ProtoTarget:    addr.As4(),
 	}
+	c.attempts = 0
 	return nil
 }
 
@@ -79,12 +99,23 @@ func (c *arpClient) Abort() {
 	c.result = eth.ARPv4Header{}
 }
 
+// Reset aborts the resolution in progress, discards a pending reply to a
+// request and flushes the neighbor cache. The configured timeout and retries are kept.
+func (c *arpClient) Reset() {
+	c.Abort()
+	c.pendingResponse = eth.ARPv4Header{}
+	c.attempts = 0
+	c.sent = time.Time{}
+	c.Flush()
+}
+
 func (c *arpClient) IsDone() bool {
 	return c.result.Operation == 2
 }
 
 func (c *arpClient) isPending() bool {
-	return c.pendingReplyToARP() || c.pendingOutReqARPv4()
+	// While awaiting a reply the client is pending to retry the request on timeout.
+	return c.pendingReplyToARP() || c.pendingOutReqARPv4() || c.result.Operation == arpOpWait
 }
 
 func (c *arpClient) pendingReplyToARP() bool {
@@ -95,7 +126,38 @@ func (c *arpClient) pendingOutReqARPv4() bool {
 	return c.result.Operation == 1 // User asked for a ARP request.
 }
 
+// checkTimeout retries the outstanding request if no reply was received within
+// the timeout and fails the resolution once retries are exhausted.
+func (c *arpClient) checkTimeout(now time.Time) {
+	if c.result.Operation != arpOpWait || now.Sub(c.sent) < c.attemptTimeout() {
+		return
+	}
+	if c.attempts <= c.maxRetries() {
+		c.result.Operation = 1 // Send request again.
+		return
+	}
+	c.result.Operation = arpOpFailed
+	c.sent = now
+	c.stack.info("ARP:timeout", c.stack.addrAttr("addr", c.result.ProtoTarget), slog.Int("attempts", int(c.attempts)))
+}
+
+func (c *arpClient) attemptTimeout() time.Duration {
+	if c.timeout <= 0 {
+		return defaultARPTimeout
+	}
+	return c.timeout
+}
+
+func (c *arpClient) maxRetries() uint8 {
+	if c.retries == 0 {
+		return defaultARPRetries
+	}
+	return c.retries
+}
+
 func (c *arpClient) handle(dst []byte) (n int) {
+	now := c.stack.now()
+	c.checkTimeout(now)
 	pendingOutReq := c.pendingOutReqARPv4()
 	switch {
 	case pendingOutReq:
@@ -108,6 +170,8 @@ func (c *arpClient) handle(dst []byte) (n int) {
 		ehdr.Put(dst)
 		c.result.Put(dst[eth.SizeEthernetHeader:])
 		c.result.Operation = arpOpWait // Clear pending ARP to not loop.
+		c.sent = now
+		c.attempts++
 		n = eth.SizeEthernetHeader + eth.SizeARPv4Header
 
 	case c.pendingReplyToARP():
@@ -135,24 +199,34 @@ func (c *arpClient) recv(ahdr *eth.ARPv4Header) error {
 	if ahdr.HardwareLength != 6 || ahdr.ProtoLength != 4 || ahdr.HardwareType != 1 || ahdr.AssertEtherType() != eth.EtherTypeIPv4 {
 		return errARPUnsupported // Ignore ARP unsupported requests.
 	}
+	c.stack.checkAddrConflict(ahdr)
+	now := c.stack.now()
 	switch ahdr.Operation {
 	case 1: // We received ARP request.
-		if c.pendingReplyToARP() || ahdr.ProtoTarget != c.stack.ip {
+		// As per RFC 826 the requester's mapping is refreshed and, if the
+		// request is for us, cached since the requester will likely talk to us.
+		c.cache.update(ahdr.ProtoSender, ahdr.HardwareSender, now, c.stack.isLocalAddr(ahdr.ProtoTarget))
+		if c.pendingReplyToARP() || !c.stack.isLocalAddr(ahdr.ProtoTarget) {
 			return nil // ARP reply pending or not for us.
 		}
 		// We need to respond to this ARP request by inverting Sender/Target fields.
+		requested := ahdr.ProtoTarget
 		ahdr.HardwareTarget = ahdr.HardwareSender
 		ahdr.ProtoTarget = ahdr.ProtoSender
 
 		ahdr.HardwareSender = c.stack.HardwareAddr6()
-		ahdr.ProtoSender = c.stack.ip
+		ahdr.ProtoSender = requested
 		ahdr.Operation = 2 // Set as reply. This also flags the packet as pending.
 		c.pendingResponse = *ahdr
 
 	case 2: // We received ARP reply.
-		if c.result.Operation != arpOpWait || // Result already received
-			ahdr.ProtoTarget != c.stack.ip || // Not meant for us.
-			ahdr.ProtoSender != c.result.ProtoTarget { // does not correspond to last request.
+		isResult := c.result.Operation == arpOpWait && // Result not yet received.
+			ahdr.ProtoTarget == c.stack.ip && // Meant for us.
+			ahdr.ProtoSender == c.result.ProtoTarget // Corresponds to last request.
+		probed := c.stack.checkGatewayReply(ahdr) // See gwfailover.go.
+		// Unsolicited replies (i.e: gratuitous ARP) only refresh existing entries.
+		c.cache.update(ahdr.ProtoSender, ahdr.HardwareSender, now, isResult || probed)
+		if !isResult {
 			return nil
 		}
 		c.result = *ahdr
@@ -0,0 +1,172 @@
+package stacks
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+const (
+	defaultARPCacheSize = 8
+	defaultARPCacheTTL  = 5 * time.Minute
+	// arpRefreshDivisor sets the part of an entry's lifetime before expiry,
+	// 1/arpRefreshDivisor of it, in which using the entry refreshes it.
+	arpRefreshDivisor = 8
+)
+
+// arpCache is the neighbor cache holding IPv4 to hardware address mappings
+// learned from ARP traffic. Entries expire after the configured lifetime and
+// the least recently updated entry is evicted when the cache is full.
+type arpCache struct {
+	entries []arpEntry
+	ttl     time.Duration
+}
+
+type arpEntry struct {
+	addr [4]byte
+	hw   [6]byte
+	// updated is the time the entry was last learned or refreshed. Zero if the entry is free.
+	updated time.Time
+}
+
+func (c *arpCache) lifetime() time.Duration {
+	if c.ttl <= 0 {
+		return defaultARPCacheTTL
+	}
+	return c.ttl
+}
+
+func (c *arpCache) lookup(addr [4]byte, now time.Time) ([6]byte, bool) {
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.updated.IsZero() || e.addr != addr {
+			continue
+		}
+		if now.Sub(e.updated) >= c.lifetime() {
+			*e = arpEntry{} // Expired.
+			return [6]byte{}, false
+		}
+		return e.hw, true
+	}
+	return [6]byte{}, false
+}
+
+// refreshDue reports whether the entry for addr expires soon and should be
+// refreshed with a new resolution while it is still in use.
+func (c *arpCache) refreshDue(addr [4]byte, now time.Time) bool {
+	for i := range c.entries {
+		e := &c.entries[i]
+		if !e.updated.IsZero() && e.addr == addr {
+			return now.Sub(e.updated) >= c.lifetime()-c.lifetime()/arpRefreshDivisor
+		}
+	}
+	return false
+}
+
+// update refreshes the entry for addr with hw. If there is no entry for addr
+// and insert is set a new entry is created, evicting the oldest if full.
+func (c *arpCache) update(addr [4]byte, hw [6]byte, now time.Time, insert bool) {
+	if addr == [4]byte{} || hw == [6]byte{} {
+		return // Ignore ARP probes.
+	}
+	oldest := -1
+	for i := range c.entries {
+		e := &c.entries[i]
+		if !e.updated.IsZero() && e.addr == addr {
+			e.hw = hw
+			e.updated = now
+			return
+		}
+		if oldest < 0 || e.updated.Before(c.entries[oldest].updated) {
+			oldest = i
+		}
+	}
+	if insert && oldest >= 0 {
+		c.entries[oldest] = arpEntry{addr: addr, hw: hw, updated: now}
+	}
+}
+
+// Lookup returns the cached hardware address of addr. Entries are learned
+// from ARP replies to resolutions and requests addressed to the stack.
+func (c *arpClient) Lookup(addr netip.Addr) ([6]byte, bool) {
+	if !addr.Is4() {
+		return [6]byte{}, false
+	}
+	return c.cache.lookup(addr.As4(), c.stack.now())
+}
+
+// Flush removes all entries from the neighbor cache.
+func (c *arpClient) Flush() {
+	for i := range c.cache.entries {
+		c.cache.entries[i] = arpEntry{}
+	}
+}
+
+// Resolve returns the hardware address of addr, sending ARP requests if it is
+// not cached and blocking until it is resolved, retries are exhausted or the
+// timeout elapses. Like other blocking calls it requires HandleEth and RecvEth
+// to be called concurrently.
+func (c *arpClient) Resolve(addr netip.Addr, timeout time.Duration) (hw [6]byte, err error) {
+	if !addr.Is4() {
+		return hw, errIPVersion
+	}
+	err = pollUntil(timeout, func() (bool, error) {
+		var rerr error
+		hw, rerr = c.resolve(addr.As4())
+		if rerr == errARPResponsePending {
+			return false, nil
+		}
+		return rerr == nil, rerr
+	})
+	return hw, err
+}
+
+// resolve returns the hardware address of addr without blocking. If it is
+// not known a resolution is started, once any in progress completes, and
+// errARPResponsePending is returned so the caller may queue its frame.
+// errARPTimeout is returned for an address that recently failed to resolve.
+// Cached addresses about to expire are resolved again while still in use so
+// that the sender does not stall once the entry expires.
+func (c *arpClient) resolve(addr [4]byte) ([6]byte, error) {
+	if addr == [4]byte{255, 255, 255, 255} {
+		return eth.BroadcastHW6(), nil
+	} else if isMulticastAddr(addr) {
+		return multicastMAC(addr), nil // See multicast.go.
+	}
+	addr = c.stack.nextHop(addr) // Off-link destinations are reached through the gateway. See iface.go.
+	now := c.stack.now()
+	res := &c.result
+	if hw, ok := c.cache.lookup(addr, now); ok {
+		if c.cache.refreshDue(addr, now) && c.canRefresh(addr, now) {
+			c.stack.debug("ARP:refresh", c.stack.addrAttr("addr", addr))
+			c.BeginResolve(netip.AddrFrom4(addr))
+		}
+		return hw, nil
+	}
+	switch {
+	case res.ProtoTarget == addr && res.Operation == 2:
+		return res.HardwareSender, nil
+	case res.ProtoTarget == addr && res.Operation == arpOpFailed && now.Sub(c.sent) < c.attemptTimeout():
+		return [6]byte{}, errARPTimeout
+	case res.Operation == 1 || res.Operation == arpOpWait:
+		return [6]byte{}, errARPResponsePending // Resolution of addr or another address in progress.
+	}
+	c.stack.stats.ARPCacheMisses++
+	c.BeginResolve(netip.AddrFrom4(addr))
+	return [6]byte{}, errARPResponsePending
+}
+
+// canRefresh reports whether a resolution refreshing the cache entry for addr
+// may be started: no other resolution is in progress and addr has not
+// recently failed to resolve.
+func (c *arpClient) canRefresh(addr [4]byte, now time.Time) bool {
+	res := &c.result
+	switch {
+	case res.Operation == 1 || res.Operation == arpOpWait:
+		return false
+	case res.ProtoTarget == addr && res.Operation == arpOpFailed:
+		return now.Sub(c.sent) >= c.attemptTimeout()
+	}
+	return true
+}
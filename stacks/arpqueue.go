@@ -0,0 +1,153 @@
+package stacks
+
+import (
+	"io"
+	"log/slog"
+	"net/netip"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// arpQueueHosts is the size of the ARP queue in multiples of [PortStackConfig.ARPQueueLen].
+const arpQueueHosts = 2
+
+// arpQueue holds outgoing frames to destinations whose hardware address is
+// being resolved so that sockets need not hold back their remaining packets
+// until the resolution completes. Destinations are resolved one after the
+// other by the ARP client; their frames are sent in order once resolved or
+// dropped if the resolution fails.
+type arpQueue struct {
+	frames  []arpQueued
+	perDest int
+	// seq orders queued frames.
+	seq uint32
+}
+
+type arpQueued struct {
+	buf []byte
+	// n is the length of the frame. Zero if the slot is free.
+	n   int
+	seq uint32
+	// remote is the destination of the datagram sent from local port lport,
+	// which is notified if the frame is dropped.
+	remote netip.AddrPort
+	lport  uint16
+}
+
+func makeARPQueue(perDest int, mtu uint16) arpQueue {
+	q := arpQueue{perDest: perDest, frames: make([]arpQueued, perDest*arpQueueHosts)}
+	buf := make([]byte, len(q.frames)*int(mtu))
+	for i := range q.frames {
+		q.frames[i].buf = buf[i*int(mtu) : (i+1)*int(mtu) : (i+1)*int(mtu)]
+	}
+	return q
+}
+
+// reserve returns the index of a free slot for a frame to dst or -1 if the
+// queue is full or dst already has the maximum amount of frames queued.
+func (q *arpQueue) reserve(dst [4]byte) int {
+	free, queued := -1, 0
+	for i := range q.frames {
+		f := &q.frames[i]
+		if f.n == 0 {
+			free = i
+		} else if f.remote.Addr().As4() == dst {
+			queued++
+		}
+	}
+	if queued >= q.perDest {
+		return -1
+	}
+	return free
+}
+
+// commit queues the frame of length n written to the slot at index i.
+func (q *arpQueue) commit(i, n int, lport uint16, remote netip.AddrPort) {
+	q.seq++
+	q.frames[i] = arpQueued{buf: q.frames[i].buf, n: n, seq: q.seq, remote: remote, lport: lport}
+}
+
+func (q *arpQueue) pending() bool {
+	for i := range q.frames {
+		if q.frames[i].n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// handleARPQueue writes the oldest queued frame whose destination is resolved
+// to dst and returns its length. Resolutions of queued destinations are
+// started as the ARP client becomes free and frames to destinations that fail
+// to resolve are dropped.
+func (ps *PortStack) handleARPQueue(dst []byte) int {
+	q := &ps.arpq
+	next := -1
+	var hw [6]byte
+	for i := range q.frames {
+		f := &q.frames[i]
+		if f.n == 0 {
+			continue
+		}
+		addr, err := ps.arpClient.resolve(f.remote.Addr().As4())
+		if err == errARPResponsePending {
+			continue
+		} else if err != nil {
+			ps.dropARPQueued(f, err)
+		} else if next < 0 || f.seq < q.frames[next].seq {
+			next = i
+			hw = addr
+		}
+	}
+	if next < 0 {
+		return 0
+	}
+	f := &q.frames[next]
+	n := f.n
+	f.n = 0
+	if n > len(dst) {
+		ps.error("ARP:queue-drop", slog.String("err", io.ErrShortBuffer.Error()))
+		return 0
+	}
+	copy(dst, f.buf[:n])
+	copy(dst[0:6], hw[:]) // Ethernet destination.
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("ARP:queue-send", slog.String("remote", f.remote.String()), slog.Int("plen", n-eth.SizeEthernetHeader))
+	}
+	return n
+}
+
+// dropARPQueued drops the queued frame f whose destination failed to resolve
+// and notifies the socket that sent it that the host is unreachable.
+func (ps *PortStack) dropARPQueued(f *arpQueued, err error) {
+	f.n = 0
+	ps.stats.ARPQueueDrops++
+	ps.error("ARP:queue-drop", slog.String("remote", f.remote.String()), slog.String("err", err.Error()))
+	port := findPort(ps.portsUDP, f.lport)
+	if port == nil {
+		return
+	}
+	if h, ok := port.ihandler.(icmpErrorHandler); ok {
+		h.recvICMPError(icmpCodeHostUnreachable, f.remote)
+	}
+}
+
+// queueUnresolved moves the datagram of plen bytes to remote at the head of
+// the output buffer to the stack's ARP queue to be sent once remote is
+// resolved. It returns false if the queue is full or the datagram must be fragmented.
+func (sock *UDPConn) queueUnresolved(plen int, remote netip.AddrPort) bool {
+	const payloadOffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+	ps := sock.stack
+	if !remote.Addr().Is4() || payloadOffset+plen > int(ps.mtu) {
+		return false
+	}
+	i := ps.arpq.reserve(remote.Addr().As4())
+	if i < 0 {
+		return false
+	}
+	sock.tx.discard(sizeUDPRecord)
+	sock.ntx--
+	n := sock.putDatagram(ps.arpq.frames[i].buf, plen, [6]byte{}, remote)
+	ps.arpq.commit(i, n, sock.localPort, remote)
+	return true
+}
@@ -0,0 +1,73 @@
+package stacks
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	defaultBackoffInitial = time.Second
+	// defaultBackoffGrowth is the ratio of the default Max to Initial of a [Backoff].
+	defaultBackoffGrowth = 64
+	// retryJitter is the jitter percentage of the retries of the stack's clients.
+	retryJitter = 25
+)
+
+// Backoff computes the delays between retries of an operation. The first delay
+// is Initial and doubles after every retry up to Max. Up to Jitter percent of
+// every delay is randomized so that clients failing together, i.e: after a
+// power outage, do not retry in lockstep. It is used by the stack's clients
+// and may be used by applications for their own retries.
+//
+// Backoff holds no clock nor source of randomness: the caller supplies the
+// random bits to [Backoff.Next] and adds the delay to its own clock, so retry
+// schedules are deterministic in tests.
+type Backoff struct {
+	// Initial is the first delay. If zero 1 second is used.
+	Initial time.Duration
+	// Max caps the delay. If zero 64 times Initial is used.
+	Max time.Duration
+	// Jitter is the percentage of each delay that is randomized, from 0 to 100.
+	// A delay d is drawn from [d-d*Jitter/100, d].
+	Jitter   uint8
+	attempts uint16
+}
+
+// Next returns the delay before the next retry and advances the backoff.
+// random are random bits, i.e: from a hardware TRNG, used for the jitter.
+func (b *Backoff) Next(random uint32) time.Duration {
+	initial, max := b.Initial, b.Max
+	if initial <= 0 {
+		initial = defaultBackoffInitial
+	}
+	if max <= 0 {
+		max = defaultBackoffGrowth * initial
+	}
+	d := initial
+	for i := uint16(0); i < b.attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if b.attempts < math.MaxUint16 {
+		b.attempts++
+	}
+	jitter := uint64(b.Jitter)
+	if jitter > 100 {
+		jitter = 100
+	}
+	if jitter > 0 {
+		span := uint64(d) / 100 * jitter
+		hi, lo := bits.Mul64(span, uint64(random))
+		d -= time.Duration(hi<<32 | lo>>32) // span*random/2^32.
+	}
+	return d
+}
+
+// Attempts returns the amount of delays returned by [Backoff.Next] since the backoff was reset.
+func (b *Backoff) Attempts() int { return int(b.attempts) }
+
+// Reset restarts the backoff so the next delay is Initial, i.e: after the operation succeeded.
+func (b *Backoff) Reset() { b.attempts = 0 }
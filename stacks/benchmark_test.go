@@ -45,6 +45,55 @@ func BenchmarkPortStack(b *testing.B) {
 	}
 }
 
+// BenchmarkPortStackDemux measures the per-packet address matching of a stack
+// with address aliases, a gateway and a port restricted to allowed peers.
+func BenchmarkPortStackDemux(b *testing.B) {
+	const udpdst = 5683
+	MAC := [6]byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	ps := stacks.NewPortStack(stacks.PortStackConfig{
+		MaxOpenPortsUDP: 1,
+		MAC:             MAC,
+		MTU:             2048,
+	})
+	addr := netip.AddrFrom4([4]byte{192, 168, 1, 1})
+	ps.SetAddr(addr)
+	for i := byte(0); i < 4; i++ {
+		err := ps.AddAddrAlias(netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, 0, 1 + i}), 24))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err := ps.SetGateway(netip.AddrFrom4([4]byte{192, 168, 1, 254}), netip.MustParsePrefix("192.168.1.0/24"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := stacks.NewUDPConn(ps, stacks.UDPConnConfig{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = conn.Open(udpdst)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = ps.SetAllowedPeersUDP(udpdst, []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12"), netip.MustParsePrefix("10.1.0.0/16")})
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Datagrams to the last alias from peers outside the allowed prefixes.
+	srcudp := NewNoisyUDPSource(MAC, netip.AddrFrom4([4]byte{10, 0, 0, 4}))
+	srcudp.pkt.UDP.DestinationPort = udpdst
+	pkt := []byte("hello")
+	buf := make([]byte, ps.MTU())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		srcudp.randomizeSource()
+		srcudp.pkt.Eth.Source[0] &^= 1 // Unicast source.
+		n := srcudp.WritePacket(buf, pkt)
+		ps.RecvEth(buf[:n])
+	}
+}
+
 func NewNoisyUDPSource(macDst [6]byte, ipDst netip.Addr) *NoisyUDPSource {
 	n := &NoisyUDPSource{
 		rnd: rand.New(rand.NewSource(0)),
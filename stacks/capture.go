@@ -0,0 +1,108 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	sizePcapHeader       = 24
+	sizePcapRecordHeader = 16
+	pcapLinkTypeEthernet = 1
+)
+
+var errBadCapture = errors.New("capture needs positive frame count and snap length")
+
+// packetCapture is a ring buffer holding the first bytes of the most recently
+// received and sent frames.
+type packetCapture struct {
+	snaplen int
+	buf     []byte
+	records []captureRecord
+	next    int
+	count   int
+}
+
+type captureRecord struct {
+	t       time.Time
+	origlen uint16
+	caplen  uint16
+}
+
+// SetCapture enables capture of the most recent frames received and sent by
+// the stack. Up to snaplen bytes of the last frames frames are kept in
+// memory allocated on this call. Calling SetCapture with frames equal to zero
+// disables capture and frees the buffer.
+func (ps *PortStack) SetCapture(frames, snaplen int) error {
+	if frames == 0 {
+		ps.capture = nil
+		return nil
+	} else if frames < 0 || snaplen <= 0 {
+		return errBadCapture
+	}
+	if snaplen > int(ps.mtu) {
+		snaplen = int(ps.mtu)
+	}
+	ps.capture = &packetCapture{
+		snaplen: snaplen,
+		buf:     make([]byte, frames*snaplen),
+		records: make([]captureRecord, frames),
+	}
+	return nil
+}
+
+// WriteCapture writes the captured frames to w in the pcap file format,
+// oldest frame first. It writes an empty capture if capture is disabled.
+func (ps *PortStack) WriteCapture(w io.Writer) error {
+	c := ps.capture
+	var hdr [sizePcapHeader]byte
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4) // Magic, microsecond timestamps.
+	binary.LittleEndian.PutUint16(hdr[4:], 2)          // Version major.
+	binary.LittleEndian.PutUint16(hdr[6:], 4)          // Version minor.
+	snaplen := int(ps.mtu)
+	if c != nil {
+		snaplen = c.snaplen
+	}
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(snaplen))
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeEthernet)
+	_, err := w.Write(hdr[:])
+	if err != nil || c == nil {
+		return err
+	}
+	start := c.next - c.count
+	if start < 0 {
+		start += len(c.records)
+	}
+	for i := 0; i < c.count; i++ {
+		idx := (start + i) % len(c.records)
+		rec := &c.records[idx]
+		var rhdr [sizePcapRecordHeader]byte
+		binary.LittleEndian.PutUint32(rhdr[0:], uint32(rec.t.Unix()))
+		binary.LittleEndian.PutUint32(rhdr[4:], uint32(rec.t.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(rhdr[8:], uint32(rec.caplen))
+		binary.LittleEndian.PutUint32(rhdr[12:], uint32(rec.origlen))
+		_, err = w.Write(rhdr[:])
+		if err != nil {
+			return err
+		}
+		off := idx * c.snaplen
+		_, err = w.Write(c.buf[off : off+int(rec.caplen)])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record stores frame received or sent at time t, overwriting the oldest frame if full.
+func (c *packetCapture) record(t time.Time, frame []byte) {
+	off := c.next * c.snaplen
+	n := copy(c.buf[off:off+c.snaplen], frame)
+	c.records[c.next] = captureRecord{t: t, origlen: uint16(len(frame)), caplen: uint16(n)}
+	c.next = (c.next + 1) % len(c.records)
+	if c.count < len(c.records) {
+		c.count++
+	}
+}
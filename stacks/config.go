@@ -0,0 +1,156 @@
+package stacks
+
+import (
+	"errors"
+	"net/netip"
+)
+
+var (
+	errBadConfigAddr  = errors.New("config address must be a valid IPv4 address")
+	errBadConfigAlias = errors.New("config alias must be a unique IPv4 address different from primary address")
+	errConfigAliases  = errors.New("config exceeds address alias limit")
+	errConfigMAClist  = errors.New("config exceeds multicast address limit")
+	errBadMaskBits    = errors.New("address mask bits must be at most 32")
+)
+
+// StackConfig is a snapshot of the runtime configuration of a [PortStack]:
+// its addresses, frame filters and enabled services. It is obtained with
+// [PortStack.Config] and applied with [PortStack.Apply], which allows a
+// management interface to modify and validate a copy before reconfiguring
+// the stack. Open ports and connections are not part of the configuration.
+type StackConfig struct {
+	// Addr is the primary address of the stack. See [PortStack.SetAddr].
+	Addr netip.Addr
+	// Aliases are the additional addresses of the stack. See [PortStack.AddAddrAlias].
+	Aliases []netip.Prefix
+	// L2Filter and MulticastMACs control received frame filtering. See [PortStack.SetL2Filter].
+	L2Filter      L2Filter
+	MulticastMACs [][6]byte
+	// ICMPResponders and ICMPAddrMaskBits configure ICMP replies. See [PortStackConfig].
+	ICMPResponders   ICMPResponder
+	ICMPAddrMaskBits uint8
+	// AcceptICMPRedirects enables ICMP redirect processing. See [PortStackConfig].
+	AcceptICMPRedirects bool
+	// Fingerprint shapes outgoing packet headers. See [PortStack.SetFingerprint].
+	Fingerprint Fingerprint
+	// TCPMD5 signs and verifies TCP segments. See [PortStack.SetTCPMD5].
+	TCPMD5 TCPMD5Func
+	// PortKnock configures the port knocking listener. See [PortStack.SetPortKnock].
+	PortKnock PortKnockConfig
+	// IPOptions selects how received packets with IPv4 options are handled. See [PortStack.SetIPOptionsPolicy].
+	IPOptions IPOptionsPolicy
+	// Validation selects how non-conformant packets are treated. See [PortStack.SetValidation].
+	Validation Validation
+	// TCP configures TCP connections created after it is applied. See [PortStack.SetTCPConfig].
+	TCP TCPConfig
+	// MAC is the hardware address of the stack. Left unchanged if zero. See [PortStack.SetHardwareAddr].
+	MAC [6]byte
+	// MTU is the interface's maximum transmission unit. Left unchanged if zero. See [PortStack.SetMTU].
+	MTU uint16
+	// Gateway and Subnet configure the default route. See [PortStack.SetGateway].
+	Gateway netip.Addr
+	Subnet  netip.Prefix
+}
+
+// Config returns a snapshot of the stack's runtime configuration. The
+// returned slices are copies and may be modified freely.
+func (ps *PortStack) Config() StackConfig {
+	cfg := StackConfig{
+		Addr:                ps.Addr(),
+		Aliases:             ps.AppendAddrAliases(nil),
+		L2Filter:            ps.l2filter,
+		MulticastMACs:       append([][6]byte(nil), ps.multicast[:ps.nmulticast]...),
+		ICMPResponders:      ps.icmpResponders,
+		ICMPAddrMaskBits:    ps.icmpMaskBits,
+		AcceptICMPRedirects: ps.acceptRedirects,
+		Fingerprint:         ps.fingerprint,
+		TCPMD5:              ps.tcpmd5,
+		IPOptions:           ps.ipOptsPolicy,
+		Validation:          ps.validation,
+		TCP:                 ps.tcpcfg,
+		MAC:                 ps.mac,
+		MTU:                 ps.mtu,
+		Gateway:             ps.gateway,
+		Subnet:              ps.subnet,
+	}
+	if ps.knock != nil {
+		cfg.PortKnock = ps.knock.cfg
+		cfg.PortKnock.Sequence = append([]uint16(nil), ps.knock.cfg.Sequence...)
+	}
+	return cfg
+}
+
+// Apply validates cfg and reconfigures the stack with it. If cfg is invalid
+// an error is returned and the stack configuration is left unchanged.
+// Like other configuration methods Apply must not be called concurrently
+// with RecvEth or HandleEth.
+func (ps *PortStack) Apply(cfg StackConfig) error {
+	if !cfg.Addr.Is4() {
+		return errBadConfigAddr
+	} else if len(cfg.Aliases) > maxAddrAliases {
+		return errConfigAliases
+	} else if len(cfg.MulticastMACs) > maxMulticastMACs {
+		return errConfigMAClist
+	} else if cfg.ICMPAddrMaskBits > 32 {
+		return errBadMaskBits
+	} else if cfg.IPOptions >= numIPOptionsPolicies {
+		return errBadIPOptsMode
+	} else if cfg.Validation >= numValidations {
+		return errBadValidationMd
+	} else if err := cfg.TCP.Validate(); err != nil {
+		return err
+	} else if cfg.MTU != 0 && (cfg.MTU < minMTU || cfg.MTU > ps.maxMTU) {
+		return errMTURange
+	} else if cfg.Gateway.IsValid() && (!cfg.Gateway.Is4() || !cfg.Subnet.Addr().Is4() || !cfg.Subnet.Contains(cfg.Gateway)) {
+		return errBadGateway
+	}
+	for i, prefix := range cfg.Aliases {
+		addr := prefix.Addr()
+		if !addr.Is4() || addr.IsUnspecified() || addr == cfg.Addr {
+			return errBadConfigAlias
+		}
+		for _, other := range cfg.Aliases[:i] {
+			if other.Addr() == addr {
+				return errBadConfigAlias
+			}
+		}
+	}
+	for _, mac := range cfg.MulticastMACs {
+		if mac[0]&1 == 0 {
+			return errNotMulticast
+		}
+	}
+	knock, err := newKnocker(cfg.PortKnock)
+	if err != nil {
+		return err
+	}
+
+	// Configuration is valid, apply it.
+	ps.SetAddr(cfg.Addr)
+	ps.naliases = copy(ps.aliases[:], cfg.Aliases)
+	for i := ps.naliases; i < len(ps.aliases); i++ {
+		ps.aliases[i] = netip.Prefix{}
+	}
+	ps.l2filter = cfg.L2Filter
+	ps.nmulticast = copy(ps.multicast[:], cfg.MulticastMACs)
+	for i := ps.nmulticast; i < len(ps.multicast); i++ {
+		ps.multicast[i] = [6]byte{}
+	}
+	ps.icmpResponders = cfg.ICMPResponders
+	ps.icmpMaskBits = cfg.ICMPAddrMaskBits
+	ps.acceptRedirects = cfg.AcceptICMPRedirects
+	ps.fingerprint = cfg.Fingerprint
+	ps.tcpmd5 = cfg.TCPMD5
+	ps.knock = knock
+	ps.ipOptsPolicy = cfg.IPOptions
+	ps.validation = cfg.Validation
+	ps.tcpcfg = cfg.TCP.withDefaults()
+	if cfg.MAC != [6]byte{} {
+		ps.mac = cfg.MAC
+	}
+	if cfg.MTU != 0 {
+		ps.mtu = cfg.MTU
+	}
+	ps.SetGateway(cfg.Gateway, cfg.Subnet) // Validated above.
+	return nil
+}
@@ -0,0 +1,185 @@
+package stacks
+
+import (
+	"io"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/soypat/seqs"
+)
+
+// ConnEntry describes an open UDP port, listening TCP port or TCP connection
+// of a [PortStack]. See [PortStack.Connections].
+type ConnEntry struct {
+	// Proto is "tcp", "udp" or "udplite".
+	Proto string
+	// Local is the local address. Ports accepting packets on all the stack's
+	// addresses have an unspecified local address.
+	Local netip.AddrPort
+	// Remote is the remote address. Zero for listening TCP ports and unconnected UDP ports.
+	Remote netip.AddrPort
+	// State is the TCP state of the connection. Zero for UDP ports.
+	State seqs.State
+	// RecvQ is the amount of bytes received and not yet read by the user.
+	// SendQ is the amount of bytes written by the user and not yet acknowledged or sent.
+	RecvQ, SendQ int
+	// Age is the time elapsed since the port was opened or the remote connected.
+	Age time.Duration
+}
+
+// Connections returns an entry for every open UDP port, listening TCP port
+// and TCP connection of the stack.
+func (ps *PortStack) Connections() []ConnEntry {
+	return ps.AppendConnections(nil)
+}
+
+// AppendConnections appends the entries returned by [PortStack.Connections] to dst and returns the result.
+func (ps *PortStack) AppendConnections(dst []ConnEntry) []ConnEntry {
+	now := ps.now()
+	for i := range ps.portsUDP {
+		port := &ps.portsUDP[i]
+		if port.port == 0 {
+			continue
+		}
+		entry := ConnEntry{
+			Proto: "udp",
+			Local: netip.AddrPortFrom(netip.IPv4Unspecified(), port.port),
+			Age:   now.Sub(port.opened),
+		}
+		if port.lite {
+			entry.Proto = "udplite"
+		}
+		if conn, ok := port.ihandler.(*UDPConn); ok {
+			entry.Remote = conn.remote
+			entry.RecvQ = conn.rx.Buffered()
+			entry.SendQ = conn.tx.Buffered()
+		}
+		dst = append(dst, entry)
+	}
+	for i := range ps.portsTCP {
+		port := &ps.portsTCP[i]
+		if port.port == 0 {
+			continue
+		}
+		switch h := port.handler.(type) {
+		case *TCPConn:
+			dst = append(dst, h.connEntry(now))
+		case *TCPListener:
+			dst = append(dst, ConnEntry{
+				Proto: "tcp",
+				Local: netip.AddrPortFrom(netip.IPv4Unspecified(), port.port),
+				State: seqs.StateListen,
+				Age:   now.Sub(port.opened),
+			})
+			for j := range h.conns {
+				conn := &h.conns[j]
+				if conn.remote.IsValid() && !conn.State().IsClosed() {
+					dst = append(dst, conn.connEntry(now))
+				}
+			}
+		}
+	}
+	return dst
+}
+
+func (sock *TCPConn) connEntry(now time.Time) ConnEntry {
+	entry := ConnEntry{
+		Proto:  "tcp",
+		Local:  netip.AddrPortFrom(netip.IPv4Unspecified(), sock.localPort),
+		Remote: sock.remote,
+		State:  sock.State(),
+		RecvQ:  sock.BufferedInput(),
+		SendQ:  sock.tx.Buffered(),
+		Age:    now.Sub(sock.opened),
+	}
+	if sock.remote.IsValid() {
+		laddr := sock.stack.Addr()
+		if sock.localIP != [4]byte{} {
+			laddr = netip.AddrFrom4(sock.localIP)
+		}
+		entry.Local = netip.AddrPortFrom(laddr, sock.localPort)
+	}
+	return entry
+}
+
+// AppendNetstat appends entries to b as a table formatted like the output of
+// `netstat -an`, with an additional column holding the age of each entry.
+func AppendNetstat(b []byte, entries []ConnEntry) []byte {
+	b = append(b, "Proto Recv-Q Send-Q Local Address           Foreign Address         State       Age\n"...)
+	for i := range entries {
+		e := &entries[i]
+		b = appendPadded(b, e.Proto, 5, false)
+		b = append(b, ' ')
+		b = appendPadded(b, strconv.Itoa(e.RecvQ), 6, true)
+		b = append(b, ' ')
+		b = appendPadded(b, strconv.Itoa(e.SendQ), 6, true)
+		b = append(b, ' ')
+		b = appendPadded(b, e.Local.String(), 23, false)
+		b = append(b, ' ')
+		remote := "0.0.0.0:*"
+		if e.Remote.IsValid() {
+			remote = e.Remote.String()
+		}
+		b = appendPadded(b, remote, 23, false)
+		b = append(b, ' ')
+		state := ""
+		if e.Proto == "tcp" {
+			state = netstatState(e.State)
+		}
+		b = appendPadded(b, state, 11, false)
+		b = append(b, ' ')
+		b = append(b, e.Age.Truncate(time.Second).String()...)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// WriteNetstat writes the stack's connection table to w formatted by [AppendNetstat].
+func (ps *PortStack) WriteNetstat(w io.Writer) error {
+	_, err := w.Write(AppendNetstat(nil, ps.Connections()))
+	return err
+}
+
+// netstatState returns the name netstat uses for state.
+func netstatState(state seqs.State) string {
+	switch state {
+	case seqs.StateClosed:
+		return "CLOSE"
+	case seqs.StateListen:
+		return "LISTEN"
+	case seqs.StateSynRcvd:
+		return "SYN_RECV"
+	case seqs.StateSynSent:
+		return "SYN_SENT"
+	case seqs.StateEstablished:
+		return "ESTABLISHED"
+	case seqs.StateFinWait1:
+		return "FIN_WAIT1"
+	case seqs.StateFinWait2:
+		return "FIN_WAIT2"
+	case seqs.StateClosing:
+		return "CLOSING"
+	case seqs.StateTimeWait:
+		return "TIME_WAIT"
+	case seqs.StateCloseWait:
+		return "CLOSE_WAIT"
+	case seqs.StateLastAck:
+		return "LAST_ACK"
+	}
+	return state.String()
+}
+
+// appendPadded appends s to b padded with spaces to width. Right aligned if alignRight is set.
+func appendPadded(b []byte, s string, width int, alignRight bool) []byte {
+	if !alignRight {
+		b = append(b, s...)
+	}
+	for i := len(s); i < width; i++ {
+		b = append(b, ' ')
+	}
+	if alignRight {
+		b = append(b, s...)
+	}
+	return b
+}
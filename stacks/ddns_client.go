@@ -0,0 +1,172 @@
+package stacks
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/eth/dns"
+)
+
+// DDNSClient is a minimal RFC 2136 dynamic DNS update client. It replaces
+// the A records of a name with a single address so that a device can register
+// itself with the site's DNS server.
+type DDNSClient struct {
+	stack *PortStack
+	pkt   UDPPacket
+	msg   dns.Message
+	raddr netip.Addr
+	rhw   [6]byte
+	txid  uint16
+	lport uint16
+	state uint8
+	rcode dns.RCode
+}
+
+func NewDDNSClient(stack *PortStack, localPort uint16) *DDNSClient {
+	return &DDNSClient{
+		stack: stack,
+		lport: localPort,
+	}
+}
+
+type DDNSUpdateConfig struct {
+	// Zone is the name of the zone being updated, i.e: "example.com".
+	Zone string
+	// Name is the fully qualified domain name to register, i.e: "device.example.com".
+	Name string
+	// Addr is the IPv4 address to register. If not set the stack's address is used.
+	Addr netip.Addr
+	// TTL of the registered A record in seconds.
+	TTL       uint32
+	DNSAddr   netip.Addr
+	DNSHWAddr [6]byte
+}
+
+// StartUpdate begins a dynamic DNS update which deletes all A records of
+// cfg.Name and adds a single record pointing to cfg.Addr.
+func (ddns *DDNSClient) StartUpdate(cfg DDNSUpdateConfig) error {
+	if !cfg.Addr.IsValid() {
+		cfg.Addr = ddns.stack.Addr()
+	}
+	if !cfg.Addr.Is4() || cfg.Addr.IsUnspecified() {
+		return errors.New("DDNS address must be IPv4")
+	} else if !cfg.DNSAddr.Is4() {
+		return errors.New("DDNS server address must be IPv4")
+	}
+	zone, err := dns.NewName(cfg.Zone)
+	if err != nil {
+		return err
+	}
+	name, err := dns.NewName(cfg.Name)
+	if err != nil {
+		return err
+	}
+	err = ddns.stack.OpenUDP(ddns.lport, ddns)
+	if err != nil {
+		return err
+	}
+	err = ddns.stack.RequestSendUDP(ddns.lport)
+	if err != nil {
+		return err
+	}
+
+	msg := &ddns.msg
+	msg.Reset()
+	// Zone section shares the layout of the question section.
+	msg.AddQuestions([]dns.Question{{Name: zone, Type: dns.TypeSOA, Class: dns.ClassINET}})
+	// Update section shares the layout of the authority section. A delete
+	// of an RRset is encoded with class ANY and empty data (RFC 2136 2.5.2).
+	msg.Authorities = append(msg.Authorities,
+		dns.Resource{Header: dns.ResourceHeader{Name: name, Type: dns.TypeA, Class: dns.ClassANY}},
+		dns.Resource{Header: dns.ResourceHeader{Name: name, Type: dns.TypeA, Class: dns.ClassINET, TTL: cfg.TTL}},
+	)
+	addr := cfg.Addr.As4()
+	msg.Authorities[1].SetRawData(addr[:])
+	ddns.raddr = cfg.DNSAddr
+	ddns.rhw = cfg.DNSHWAddr
+	ddns.rcode = 0
+	ddns.state = dnsSendQuery
+	return nil
+}
+
+func (ddns *DDNSClient) send(dst []byte) (n int, err error) {
+	if ddns.state == dnsAborted {
+		return 0, io.EOF
+	} else if ddns.state != dnsSendQuery {
+		return 0, nil
+	}
+	const payloadOffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+	msg := &ddns.msg
+	msgLen := msg.Len()
+	if int(msgLen) > len(dst[payloadOffset:]) {
+		return 0, io.ErrShortBuffer
+	}
+	ddns.txid = ddns.stack.rand16()
+	msg.Header = dns.Header{
+		Flags:         dns.NewClientHeaderFlags(dns.OpCodeUpdate, false),
+		TransactionID: ddns.txid,
+	}
+	payload, err := msg.AppendTo(dst[payloadOffset:payloadOffset])
+	if err != nil {
+		return 0, err
+	}
+	const ipv4ToS = 0
+	ddns.stack.setUDP(&ddns.pkt, ddns.rhw, ddns.stack.ip, ddns.raddr.As4(), ipv4ToS, payload, ddns.lport, dns.ServerPort)
+	ddns.pkt.PutHeaders(dst)
+	ddns.state = dnsAwaitResponse
+	return payloadOffset + len(payload), nil
+}
+
+func (ddns *DDNSClient) recv(pkt *UDPPacket) error {
+	if ddns.state == dnsAborted {
+		return io.EOF
+	} else if ddns.state != dnsAwaitResponse {
+		return nil
+	}
+	payload := pkt.Payload()
+	if len(payload) < dns.SizeHeader {
+		return io.ErrShortBuffer
+	}
+	dhdr := dns.DecodeHeader(payload)
+	if dhdr.TransactionID != ddns.txid || !dhdr.Flags.IsResponse() || dhdr.Flags.OpCode() != dns.OpCodeUpdate {
+		return nil // Not a response to our update.
+	}
+	ddns.rcode = dhdr.Flags.ResponseCode()
+	ddns.stack.info("DDNS:recv", slog.String("rcode", ddns.rcode.String()))
+	ddns.state = dnsDone
+	return io.EOF // Done, close socket.
+}
+
+func (ddns *DDNSClient) isPendingHandling() bool {
+	return ddns.state == dnsSendQuery || ddns.state == dnsAborted
+}
+
+// IsDone reports whether the server has responded to the update and the response code.
+// A response code of [dns.RCodeSuccess] means the name was registered.
+func (ddns *DDNSClient) IsDone() (bool, dns.RCode) {
+	return ddns.state == dnsDone, ddns.rcode
+}
+
+func (ddns *DDNSClient) Abort() {
+	if ddns.state != dnsClosed && ddns.state != dnsDone {
+		ddns.state = dnsAborted
+		ddns.stack.RequestSendUDP(ddns.lport)
+	}
+}
+
+func (ddns *DDNSClient) abort() {
+	done := ddns.state == dnsDone
+	*ddns = DDNSClient{
+		stack: ddns.stack,
+		lport: ddns.lport,
+		msg:   ddns.msg,
+		txid:  ddns.txid,
+		rcode: ddns.rcode,
+	}
+	if done {
+		ddns.state = dnsDone
+	}
+}
@@ -0,0 +1,238 @@
+package stacks
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/httpx"
+)
+
+const (
+	defaultDebugTimeout = 5 * time.Second
+	debugBufSize        = 512
+)
+
+var errDebugNoToken = errors.New("debug server requires a token")
+
+// DebugServerConfig configures a [DebugServer].
+type DebugServerConfig struct {
+	// Port is the local TCP port the server listens on.
+	Port uint16
+	// Token authenticates requests. Clients must send it in a
+	// "Authorization: Bearer <token>" header. Required.
+	Token string
+	// DHCPServer, if set, has its lease table served under /leases.
+	DHCPServer *DHCPServer
+	// Timeout limits the time spent serving a single request. If zero a timeout of 5 seconds is used.
+	Timeout time.Duration
+}
+
+// DebugServer is a small HTTP server for inspecting a deployed stack. It
+// serves plain text reports on the following paths:
+//
+//   - /stats: the stack's [Health] counters.
+//   - /conns: the open UDP ports and TCP connections. See [AppendNetstat].
+//   - /arp: the ARP neighbor cache and the last ARP resolution.
+//   - /leases: the DHCP lease table, if configured.
+//   - /capture: frames captured with [PortStack.SetCapture] in pcap format.
+//   - /lldp: the LLDP neighbor table. See [PortStack.SetLLDP].
+//   - /activity: TCP connection activity traced with [PortStack.SetActivityTrace].
+//
+// Requests are served one at a time and connections are closed after each response.
+type DebugServer struct {
+	stack *PortStack
+	l     *TCPListener
+	cfg   DebugServerConfig
+	hdr   httpx.RequestHeader
+	rd    *bufio.Reader
+	buf   []byte
+	conns []ConnEntry
+	acts  []ActivityRecord
+}
+
+// NewDebugServer creates a debug server on stack and starts listening on cfg.Port.
+// Requests are served by calling [DebugServer.Serve].
+func NewDebugServer(stack *PortStack, cfg DebugServerConfig) (*DebugServer, error) {
+	if cfg.Token == "" {
+		return nil, errDebugNoToken
+	} else if cfg.Port == 0 {
+		return nil, errZeroPort
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultDebugTimeout
+	}
+	l, err := NewTCPListener(stack, TCPListenerConfig{
+		MaxConnections: 1,
+		ConnTxBufSize:  debugBufSize,
+		ConnRxBufSize:  debugBufSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = l.StartListening(cfg.Port)
+	if err != nil {
+		return nil, err
+	}
+	return &DebugServer{
+		stack: stack,
+		l:     l,
+		cfg:   cfg,
+		rd:    bufio.NewReaderSize(nil, debugBufSize),
+	}, nil
+}
+
+// Serve accepts and serves requests until the server is closed. Like other
+// blocking calls it requires the stack to be serviced by another goroutine.
+func (ds *DebugServer) Serve() error {
+	for {
+		conn, err := ds.l.Accept()
+		if err != nil {
+			return err
+		}
+		err = ds.serveConn(conn)
+		if err != nil {
+			ds.stack.info("DEBUG:serve", slog.String("err", err.Error()))
+		}
+		conn.Close()
+	}
+}
+
+// Close stops listening for requests.
+func (ds *DebugServer) Close() error {
+	return ds.stack.CloseTCP(ds.cfg.Port)
+}
+
+func (ds *DebugServer) serveConn(conn net.Conn) error {
+	conn.SetDeadline(ds.stack.now().Add(ds.cfg.Timeout))
+	ds.rd.Reset(conn)
+	err := ds.hdr.Read(ds.rd)
+	if err != nil {
+		return err
+	}
+	const bearer = "Bearer "
+	auth := ds.hdr.Peek("Authorization")
+	if len(auth) < len(bearer) || string(auth[:len(bearer)]) != bearer ||
+		subtle.ConstantTimeCompare(auth[len(bearer):], []byte(ds.cfg.Token)) != 1 {
+		ds.stack.info("DEBUG:unauthorized")
+		return writeDebugResponse(conn, "401 Unauthorized", "text/plain", nil)
+	}
+	ps := ds.stack
+	b := ds.buf[:0]
+	contentType := "text/plain"
+	switch string(ds.hdr.RequestURI()) {
+	case "/stats":
+		b = appendHealth(b, ps.Health())
+	case "/conns":
+		ds.conns = ps.AppendConnections(ds.conns[:0])
+		b = AppendNetstat(b, ds.conns)
+	case "/arp":
+		b = ps.arpClient.appendTable(b)
+	case "/leases":
+		if ds.cfg.DHCPServer == nil {
+			return writeDebugResponse(conn, "404 Not Found", contentType, nil)
+		}
+		w := appendWriter{buf: b}
+		ds.cfg.DHCPServer.WriteLeases(&w)
+		b = w.buf
+	case "/capture":
+		contentType = "application/vnd.tcpdump.pcap"
+		w := appendWriter{buf: b}
+		ps.WriteCapture(&w)
+		b = w.buf
+	case "/lldp":
+		b = AppendLLDPTable(b, ps.LLDPNeighbors())
+	case "/activity":
+		ds.acts = ps.AppendActivity(ds.acts[:0])
+		b = AppendActivityTable(b, ds.acts)
+	default:
+		return writeDebugResponse(conn, "404 Not Found", contentType, nil)
+	}
+	ds.buf = b
+	return writeDebugResponse(conn, "200 OK", contentType, b)
+}
+
+func writeDebugResponse(w io.Writer, status, contentType string, body []byte) error {
+	_, err := io.WriteString(w, "HTTP/1.1 "+status+"\r\nContent-Type: "+contentType+
+		"\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\nConnection: close\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func appendHealth(b []byte, h Health) []byte {
+	appendCounter := func(b []byte, name string, v uint32) []byte {
+		b = append(b, name...)
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, uint64(v), 10)
+		return append(b, '\n')
+	}
+	b = append(b, "since_rx "...)
+	b = append(b, h.SinceRx.String()...)
+	b = append(b, "\nsince_tx "...)
+	b = append(b, h.SinceTx.String()...)
+	b = append(b, '\n')
+	b = appendCounter(b, "pending_udp", h.PendingUDP)
+	b = appendCounter(b, "pending_tcp", h.PendingTCP)
+	b = appendCounter(b, "buffered_tcp", uint32(h.BufferedTCP))
+	b = appendCounter(b, "processed_packets", h.ProcessedPackets)
+	b = appendCounter(b, "dropped_packets", h.DroppedPackets)
+	b = appendCounter(b, "dropped_llc", h.DroppedLLC)
+	b = appendCounter(b, "dropped_vlan", h.DroppedVLAN)
+	b = appendCounter(b, "rejected_l2", h.RejectedL2)
+	b = appendCounter(b, "rejected_md5", h.RejectedMD5)
+	b = appendCounter(b, "rejected_acl", h.RejectedACL)
+	b = appendCounter(b, "rejected_ipopts", h.RejectedIPOptions)
+	b = appendCounter(b, "rejected_inspection", h.RejectedInspection)
+	b = appendCounter(b, "deviations", h.Deviations)
+	b = appendCounter(b, "recv_errors", h.RecvErrors)
+	b = appendCounter(b, "handle_errors", h.HandleErrors)
+	b = appendCounter(b, "consecutive_errors", h.ConsecutiveErrors)
+	b = appendCounter(b, "tx_failures", h.TxFailures)
+	return b
+}
+
+// appendTable appends the cached ARP entries with their age in seconds
+// followed by the last resolved ARP entry to b.
+func (c *arpClient) appendTable(b []byte) []byte {
+	now := c.stack.now()
+	for i := range c.cache.entries {
+		e := &c.cache.entries[i]
+		if e.updated.IsZero() || now.Sub(e.updated) >= c.cache.lifetime() {
+			continue
+		}
+		b = netip.AddrFrom4(e.addr).AppendTo(b)
+		b = append(b, ' ')
+		b = eth.AppendMAC(b, e.hw)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, int64(now.Sub(e.updated)/time.Second), 10)
+		b = append(b, "s\n"...)
+	}
+	addr, hw, err := c.ResultAs6()
+	if err != nil {
+		return append(b, err.Error()+"\n"...)
+	}
+	b = addr.AppendTo(b)
+	b = append(b, ' ')
+	b = eth.AppendMAC(b, hw)
+	return append(b, '\n')
+}
+
+// appendWriter is an [io.Writer] that appends to a byte slice.
+type appendWriter struct {
+	buf []byte
+}
+
+func (w *appendWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	return len(b), nil
+}
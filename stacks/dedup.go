@@ -0,0 +1,91 @@
+package stacks
+
+import "time"
+
+const (
+	maxDuplicateWindow     = 16
+	defaultDuplicateMaxAge = 20 * time.Millisecond
+)
+
+// DuplicateFilter configures the suppression of exact duplicates of recently
+// received frames, as delivered by some radio bridges and flaky half-duplex
+// links. Duplicates are dropped before any processing so that they are not
+// delivered twice to UDP ports nor counted in [Stats]. Dropped frames are
+// counted in [Health].
+type DuplicateFilter struct {
+	// Window is the amount of most recently received frames a frame is
+	// compared against. At most 16 frames are kept. If zero duplicate
+	// suppression is disabled.
+	Window int
+	// MaxAge is the time after a frame is received during which an identical
+	// frame is considered a duplicate. If zero 20 milliseconds is used.
+	MaxAge time.Duration
+}
+
+// dupFilter holds the hashes of the most recently received frames.
+type dupFilter struct {
+	cfg     DuplicateFilter
+	recent  [maxDuplicateWindow]dupEntry
+	next    int
+	dropped uint32
+}
+
+type dupEntry struct {
+	t    time.Time
+	hash uint32
+	size uint16
+}
+
+// SetDuplicateFilter sets the duplicate frame suppression configuration,
+// forgetting the frames received so far.
+func (ps *PortStack) SetDuplicateFilter(df DuplicateFilter) {
+	ps.dedup = dupFilter{cfg: df, dropped: ps.dedup.dropped}
+}
+
+// DuplicateFilter returns the duplicate frame suppression configuration.
+func (ps *PortStack) DuplicateFilter() DuplicateFilter { return ps.dedup.cfg }
+
+// duplicateDrop records the received frame and reports whether it must be
+// dropped for being identical to one received shortly before.
+func (ps *PortStack) duplicateDrop(frame []byte) bool {
+	df := &ps.dedup
+	window := df.cfg.Window
+	if window <= 0 {
+		return false
+	} else if window > maxDuplicateWindow {
+		window = maxDuplicateWindow
+	}
+	maxAge := df.cfg.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultDuplicateMaxAge
+	}
+	now := ps.now()
+	hash := fnv1a(frame)
+	for i := 0; i < window; i++ {
+		e := &df.recent[i]
+		if e.hash == hash && int(e.size) == len(frame) && !e.t.IsZero() && now.Sub(e.t) <= maxAge {
+			df.dropped++
+			return true
+		}
+	}
+	if df.next >= window {
+		df.next = 0 // Window was shrunk.
+	}
+	df.recent[df.next] = dupEntry{t: now, hash: hash, size: uint16(len(frame))}
+	df.next = (df.next + 1) % window
+	return false
+}
+
+// fnv1a returns the 32-bit FNV-1a hash of b.
+func fnv1a(b []byte) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= prime32
+	}
+	return h
+}
@@ -0,0 +1,203 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// icmpCodeFragNeeded is the destination unreachable code of datagrams that
+// needed fragmentation but had the Don't Fragment flag set (RFC 1191).
+const icmpCodeFragNeeded = 4
+
+const (
+	// minPathMTU is the smallest path MTU accepted from ICMP messages, the 68
+	// octets every IPv4 host must be able to forward (RFC 791).
+	minPathMTU = 68
+	// pmtuFloor is the smallest path MTU adopted. Smaller ones are raised to
+	// it and segments are then sent without the Don't Fragment flag so that a
+	// forged message cannot degrade a connection to tiny segments.
+	pmtuFloor = 576
+	// pmtuTimeout is the time after which a learned path MTU is discarded to
+	// detect increases of the path MTU (RFC 1191 section 6.3).
+	pmtuTimeout = 10 * time.Minute
+)
+
+// DestinationInfo holds the metrics learned about a remote host. See [PortStack.Destination].
+type DestinationInfo struct {
+	// PMTU is the path MTU to the destination, IP header included, learned
+	// from ICMP fragmentation needed messages (RFC 1191). Zero if not learned.
+	PMTU uint16
+	// PMTULearned is the time PMTU was learned. It is discarded 10 minutes later.
+	PMTULearned time.Time
+	// SRTT and RTTVar are the round trip time estimates of the last TCP
+	// connection established with the destination. Zero if not measured.
+	SRTT, RTTVar time.Duration
+	// Failures is the amount of consecutive TCP connections with the
+	// destination that timed out without answer, LastFailure the time of the last one.
+	Failures    uint8
+	LastFailure time.Time
+	// Gateway is the first-hop router to the destination learned from an
+	// ICMP redirect, used instead of the default gateway. Invalid if not
+	// redirected. See [PortStackConfig.AcceptICMPRedirects].
+	Gateway netip.Addr
+	// Updated is the time the metrics were last updated.
+	Updated time.Time
+}
+
+type destEntry struct {
+	addr [4]byte
+	info DestinationInfo
+}
+
+// destCache stores metrics per remote host shared among connections, as
+// described by RFC 9040 (TCP control block interdependence). New connections
+// start with the round trip time estimates and path MTU learned by previous
+// ones instead of the conservative defaults. When full the least recently
+// updated destination is replaced.
+type destCache struct {
+	entries []destEntry
+}
+
+// Destination returns the metrics cached for addr. The destination cache is
+// enabled with [PortStackConfig.DestinationCacheSize]. Applications may use
+// the failure state to fail over to another server or interface early.
+func (ps *PortStack) Destination(addr netip.Addr) (DestinationInfo, bool) {
+	if !addr.Is4() {
+		return DestinationInfo{}, false
+	}
+	info := ps.dests.lookup(addr.As4())
+	if info == nil {
+		return DestinationInfo{}, false
+	}
+	info.expirePMTU(ps.now())
+	return *info, true
+}
+
+// expirePMTU discards the path MTU if learned longer than pmtuTimeout ago.
+func (info *DestinationInfo) expirePMTU(now time.Time) {
+	if info.PMTU != 0 && now.Sub(info.PMTULearned) >= pmtuTimeout {
+		info.PMTU = 0
+		info.PMTULearned = time.Time{}
+	}
+}
+
+// ForgetDestination discards the metrics cached for addr, i.e: after the route to it changed.
+func (ps *PortStack) ForgetDestination(addr netip.Addr) {
+	if !addr.Is4() {
+		return
+	}
+	a := addr.As4()
+	for i := range ps.dests.entries {
+		if ps.dests.entries[i].addr == a {
+			ps.dests.entries[i] = destEntry{}
+		}
+	}
+}
+
+func (c *destCache) lookup(addr [4]byte) *DestinationInfo {
+	for i := range c.entries {
+		if c.entries[i].addr == addr && addr != [4]byte{} {
+			return &c.entries[i].info
+		}
+	}
+	return nil
+}
+
+// update returns the entry of addr to be modified, replacing the least
+// recently updated one if addr is not cached. Returns nil if the cache is disabled.
+func (c *destCache) update(addr [4]byte, now time.Time) *DestinationInfo {
+	if len(c.entries) == 0 {
+		return nil
+	}
+	info := c.lookup(addr)
+	if info == nil {
+		e := &c.entries[0]
+		for i := range c.entries {
+			if c.entries[i].info.Updated.Before(e.info.Updated) {
+				e = &c.entries[i]
+			}
+		}
+		*e = destEntry{addr: addr}
+		info = &e.info
+	}
+	info.Updated = now
+	return info
+}
+
+// recvFragNeeded learns the path MTU advertised by an ICMP fragmentation
+// needed message quoting a datagram with header ihdr and transport payload.
+// Only messages quoting a segment in flight of an open TCP connection are
+// trusted, as others may be forged (RFC 5927). The connection adopts the path
+// MTU immediately and it is cached for new connections to the destination.
+func (ps *PortStack) recvFragNeeded(msg []byte, ihdr *eth.IPv4Header, payload []byte) {
+	mtu := binary.BigEndian.Uint16(msg[6:8]) // Next-hop MTU.
+	if mtu < minPathMTU {
+		return // Routers predating RFC 1191 send zero, plateau search is not implemented.
+	} else if mtu < pmtuFloor {
+		mtu = pmtuFloor
+	}
+	if mtu >= ps.mtu-eth.SizeEthernetHeader {
+		return
+	}
+	if ihdr.Protocol != 6 || len(payload) < 8 || !ps.recvFragNeededTCP(ihdr, payload, mtu) {
+		return
+	}
+	now := ps.now()
+	dst := ihdr.Destination
+	info := ps.dests.update(dst, now)
+	if info == nil {
+		return
+	}
+	info.PMTU, info.PMTULearned = mtu, now
+	ps.info("ICMP:pmtu", ps.addrAttr("dst", dst), slog.Uint64("mtu", uint64(mtu)))
+}
+
+// applyDestination initializes the connection with the metrics cached for its remote.
+func (sock *TCPConn) applyDestination() {
+	info := sock.stack.dests.lookup(sock.remote.Addr().As4())
+	if info == nil {
+		return
+	}
+	info.expirePMTU(sock.stack.now())
+	if info.PMTU != 0 {
+		sock.pathMTU = info.PMTU + eth.SizeEthernetHeader
+		sock.setLocalOptions()
+	}
+	if info.SRTT > 0 {
+		r := &sock.retx
+		r.srtt, r.rttvar = info.SRTT, info.RTTVar
+		r.rto = r.srtt + 4*r.rttvar
+		if r.rto < r.minRTO {
+			r.rto = r.minRTO
+		} else if r.rto > r.maxRTO {
+			r.rto = r.maxRTO
+		}
+	}
+}
+
+// saveDestination stores the metrics of the connection being closed.
+func (sock *TCPConn) saveDestination() {
+	if !sock.remote.IsValid() || sock.lastTx.IsZero() {
+		return
+	}
+	now := sock.stack.now()
+	info := sock.stack.dests.update(sock.remote.Addr().As4(), now)
+	if info == nil {
+		return
+	}
+	if sock.lastRx.IsZero() || sock.abortErr == errRetransmitTimeout || sock.abortErr == errKeepaliveTimeout {
+		if info.Failures < 255 {
+			info.Failures++
+		}
+		info.LastFailure = now
+	} else {
+		info.Failures = 0
+	}
+	if sock.retx.srtt > 0 {
+		info.SRTT, info.RTTVar = sock.retx.srtt, sock.retx.rttvar
+	}
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/soypat/seqs/eth"
 	"github.com/soypat/seqs/eth/dhcp"
+	"github.com/soypat/seqs/eth/dns"
 	"github.com/soypat/seqs/internal"
 )
 
@@ -24,6 +25,23 @@ var (
 	errUnhandledState = errors.New("unhandled state")
 	errBadMagicCookie = errors.New("bad magic cookie")
 	errUnexpectedXid  = errors.New("unexpected xid")
+	errDHCPNotBound   = errors.New("DHCP client holds no address to decline")
+	errDHCPTimers     = errors.New("DHCP config: negative timer or initial retry interval exceeds maximum")
+)
+
+const (
+	// dhcpRetxInitial and dhcpRetxMax bound the wait for a reply before a
+	// DISCOVER or REQUEST is retransmitted as suggested by RFC 2131 section 4.1.
+	dhcpRetxInitial = 4 * time.Second
+	dhcpRetxMax     = 64 * time.Second
+	// dhcpMaxRequests is the amount of unanswered REQUESTs sent before discovery starts over.
+	dhcpMaxRequests = 4
+	// dhcpDeclineWait is the minimum wait after a DECLINE before discovery
+	// starts over as required by RFC 2131 section 3.1.
+	dhcpDeclineWait = 10 * time.Second
+	// dhcpRenewRetryMin is the minimum wait between REQUESTs extending a
+	// lease as suggested by RFC 2131 section 4.4.5.
+	dhcpRenewRetryMin = time.Minute
 )
 
 type DHCPClient struct {
@@ -31,10 +49,14 @@ type DHCPClient struct {
 	currentXid      uint32
 	port            uint16
 	requestHostname string
-	requestSentAt   time.Time
-	aux             UDPPacket // Avoid heap allocation.
+	// fqdnOpt is the encoded client FQDN option data (RFC 4702), if any.
+	fqdnOpt []byte
+	// fqdnFlags are the client FQDN flags received from the server.
+	fqdnFlags     uint8
+	requestSentAt time.Time
+	aux           UDPPacket // Avoid heap allocation.
 	// aborted         bool
-	state uint8
+	state DHCPState
 	// The result IP of the DHCP transaction (our new IP).
 	offer [4]byte
 	// DHCP server IP
@@ -51,63 +73,177 @@ type DHCPClient struct {
 	tRenew    uint32 // Opt(58): Renewal time [s]
 	tRebind   uint32 // Opt(59): Rebinding time [s]
 	tIPLease  uint32 // Opt(51): IP lease time [s]
+	// boundAt is the time the last ACK was received. See dhcp_renew.go.
+	boundAt time.Time
+	// retryAt is the time the next REQUEST extending the lease is sent.
+	retryAt time.Time
+	// svmac is the hardware address REQUESTs are unicast to when renewing.
+	svmac [6]byte
+	// retxAt is the time the outstanding DISCOVER or REQUEST is retransmitted.
+	retxAt time.Time
+	retx   Backoff
+	// Timers set by BeginRequest. See [DHCPRequestConfig].
+	maxRequests   uint8
+	declineWait   time.Duration
+	renewRetryMin time.Duration
 	// This field is for avoiding heap allocations.
 	auxbuf [4]byte
 }
 
+// DHCPState is the internal state of a DHCP client or of a client of a DHCP
+// server. It is finer grained than [dhcp.ClientState]. See [DHCPClient.DetailedState].
+type DHCPState uint8
+
 // State transition table:
 //
 //	StateNone      -> | Send out Discover | -> StateWaitOffer
 //	StateWaitOffer -> |   Receive Offer   | -> StateGotOffer
 //	StateGotOffer  -> | Send out Request  | -> StateWaitAck
 //	StateWaitAck   -> |    Receive Ack    | -> StateDone
+//	StateDone      -> | T1 expires, send Request | -> StateRenewing
+//	StateRenewing  -> | T2 expires, send Request | -> StateRebinding
+//	StateRenewing  -> |    Receive Ack    | -> StateDone
+//	StateRebinding -> |    Receive Ack    | -> StateDone
+//	StateRebinding -> |   Lease expires   | -> StateNone
+//	StateDone      -> |     Decline()     | -> StateDeclining
+//	StateDeclining -> | Send out Decline  | -> StateNone
+//
+//go:generate stringer -type=DHCPState -trimprefix=DHCPState
 const (
-	dhcpStateNone = iota
-	dhcpStateWaitOffer
-	dhcpStateGotOffer
-	dhcpStateWaitAck
-	dhcpStateDone
-	dhcpStateAborted
-	dhcpStateNaked
+	// DHCPStateNone is the initial state, no request is in progress.
+	DHCPStateNone DHCPState = iota
+	// DHCPStateWaitOffer is entered after sending a Discover.
+	DHCPStateWaitOffer
+	// DHCPStateGotOffer is entered after receiving an Offer.
+	DHCPStateGotOffer
+	// DHCPStateWaitAck is entered after sending a Request for an offer.
+	DHCPStateWaitAck
+	// DHCPStateDone means a lease was acknowledged and is bound.
+	DHCPStateDone
+	// DHCPStateAborted is entered on [DHCPClient.Abort].
+	DHCPStateAborted
+	// DHCPStateNaked means the server replied to a Request with a Nak.
+	DHCPStateNaked
+	// DHCPStateRenewing is entered when T1 expires and the lease is renewed with its server.
+	DHCPStateRenewing
+	// DHCPStateRebinding is entered when T2 expires and the lease is renewed with any server.
+	DHCPStateRebinding
+	// DHCPStateDeclining is entered on [DHCPClient.Decline] until the Decline is sent.
+	DHCPStateDeclining
 )
 
 func NewDHCPClient(stack *PortStack, lport uint16) *DHCPClient {
 	if stack == nil || lport == 0 {
 		panic("nil stack or port")
 	}
-	return &DHCPClient{
+	d := &DHCPClient{
 		stack: stack,
-		state: dhcpStateNone,
+		state: DHCPStateNone,
 		port:  lport,
 	}
+	d.setTimers(DHCPRequestConfig{}.withDefaults())
+	return d
 }
 
 type DHCPRequestConfig struct {
 	RequestedAddr netip.Addr
-	Xid           uint32
-	// Optional hostname to request.
+	// Xid is the transaction ID. If zero a random one is drawn from the stack's entropy source.
+	Xid uint32
+	// Optional hostname to request. If empty the stack's hostname is requested, see [PortStack.SetHostname].
 	Hostname string
 	ServerIP netip.Addr
+	// FQDN is the optional fully qualified domain name the client wishes to
+	// have registered in DNS, sent in the Client FQDN option (RFC 4702).
+	FQDN string
+	// FQDNClientUpdate signals the client updates its DNS A record itself,
+	// i.e. with a [DDNSClient], instead of asking the server to do it.
+	FQDNClientUpdate bool
+
+	// RetryInitial and RetryMax bound the wait for a reply before a DISCOVER
+	// or REQUEST is retransmitted. If zero 4 and 64 seconds are used as
+	// suggested by RFC 2131 section 4.1. Local links with a nearby server may
+	// use much shorter intervals to acquire an address sooner.
+	RetryInitial time.Duration
+	RetryMax     time.Duration
+	// MaxRequests is the amount of unanswered REQUESTs sent before discovery
+	// starts over. If zero 4 is used.
+	MaxRequests uint8
+	// DeclineWait is the wait after a DECLINE before discovery starts over.
+	// If zero 10 seconds are used as required by RFC 2131 section 3.1.
+	DeclineWait time.Duration
+	// RenewRetryMin is the minimum wait between REQUESTs extending a lease.
+	// If zero 1 minute is used as suggested by RFC 2131 section 4.4.5.
+	RenewRetryMin time.Duration
+}
+
+// withDefaults returns the timers of cfg with zero values replaced by their defaults.
+func (cfg DHCPRequestConfig) withDefaults() DHCPRequestConfig {
+	if cfg.RetryInitial == 0 {
+		cfg.RetryInitial = dhcpRetxInitial
+		if cfg.RetryMax > 0 && cfg.RetryMax < dhcpRetxInitial {
+			cfg.RetryInitial = cfg.RetryMax
+		}
+	}
+	if cfg.RetryMax == 0 {
+		cfg.RetryMax = dhcpRetxMax
+		if cfg.RetryInitial > dhcpRetxMax {
+			cfg.RetryMax = cfg.RetryInitial
+		}
+	}
+	if cfg.MaxRequests == 0 {
+		cfg.MaxRequests = dhcpMaxRequests
+	}
+	if cfg.DeclineWait == 0 {
+		cfg.DeclineWait = dhcpDeclineWait
+	}
+	if cfg.RenewRetryMin == 0 {
+		cfg.RenewRetryMin = dhcpRenewRetryMin
+	}
+	return cfg
 }
 
 func (d *DHCPClient) BeginRequest(cfg DHCPRequestConfig) error {
-	if cfg.Xid == 0 {
-		return errors.New("xid must be non-zero")
-	} else if cfg.RequestedAddr.IsValid() && !cfg.RequestedAddr.Is4() {
+	if cfg.RequestedAddr.IsValid() && !cfg.RequestedAddr.Is4() {
 		return errors.New("requested addr must be IPv4")
 	} else if len(cfg.Hostname) > 30 {
 		return errors.New("hostname too long")
 	} else if cfg.ServerIP.IsValid() && !cfg.ServerIP.Is4() {
 		return errors.New("server IP must be IPv4")
-	} else if d.state != dhcpStateNone {
+	} else if cfg.RetryInitial < 0 || cfg.RetryMax < 0 || cfg.DeclineWait < 0 || cfg.RenewRetryMin < 0 {
+		return errDHCPTimers
+	} else if cfg = cfg.withDefaults(); cfg.RetryInitial > cfg.RetryMax {
+		return errDHCPTimers
+	} else if d.state != DHCPStateNone {
 		return errors.New("already started, call Abort() first")
 	}
 
+	var fqdn dns.Name
+	if cfg.FQDN != "" {
+		var err error
+		fqdn, err = dns.NewName(cfg.FQDN)
+		if err != nil {
+			return err
+		}
+	}
 	err := d.stack.OpenUDP(d.port, d)
 	if err != nil {
 		return err
 	}
+	d.fqdnOpt = d.fqdnOpt[:0]
+	d.fqdnFlags = 0
+	if cfg.FQDN != "" {
+		flags := byte(dhcp.FQDNFlagE | dhcp.FQDNFlagS)
+		if cfg.FQDNClientUpdate {
+			flags = dhcp.FQDNFlagE
+		}
+		// RCODE1 and RCODE2 fields are deprecated and sent as zero.
+		d.fqdnOpt = append(d.fqdnOpt, flags, 0, 0)
+		d.fqdnOpt, _ = fqdn.AppendTo(d.fqdnOpt)
+	}
 	d.currentXid = cfg.Xid
+	if d.currentXid == 0 {
+		d.currentXid = d.newXid()
+	}
 	if cfg.RequestedAddr.IsValid() {
 		d.requestedIP = cfg.RequestedAddr.As4()
 	}
@@ -116,35 +252,53 @@ func (d *DHCPClient) BeginRequest(cfg DHCPRequestConfig) error {
 		cfg.ServerIP = broadcastIPv4
 	}
 	d.svip = cfg.ServerIP.As4()
-	d.state = dhcpStateNone
+	d.state = DHCPStateNone
+	d.setTimers(cfg)
 	d.requestHostname = cfg.Hostname
-	return d.stack.FlagPendingUDP(d.port)
+	if cfg.Hostname == "" && len(d.stack.hosts.hostname) <= 30 {
+		d.requestHostname = d.stack.hosts.hostname
+	}
+	return d.stack.RequestSendUDP(d.port)
+}
+
+// ServerUpdatesDNS reports whether the server replied with a Client FQDN
+// option indicating it performs the DNS A record update for the client.
+func (d *DHCPClient) ServerUpdatesDNS() bool {
+	return d.fqdnFlags&dhcp.FQDNFlagS != 0 && d.fqdnFlags&dhcp.FQDNFlagN == 0
 }
 
 // IsDone
 //
 // Deprecated: Use d.State()==dhcp.StateBound instead.
 func (d *DHCPClient) IsDone() bool {
-	return d.state == dhcpStateDone || d.state == dhcpStateNaked
+	return d.state == DHCPStateDone || d.state == DHCPStateNaked
 }
 
 // State returns the current state of the DHCP client.
 func (d *DHCPClient) State() dhcp.ClientState {
 	switch d.state {
-	case dhcpStateNone:
+	case DHCPStateNone:
 		return dhcp.StateInit
-	case dhcpStateWaitOffer, dhcpStateGotOffer:
+	case DHCPStateWaitOffer, DHCPStateGotOffer:
 		return dhcp.StateSelecting
-	case dhcpStateWaitAck:
+	case DHCPStateWaitAck:
 		return dhcp.StateRequesting
-	case dhcpStateDone:
+	case DHCPStateDone:
 		return dhcp.StateBound
-	case dhcpStateNaked:
+	case DHCPStateNaked, DHCPStateDeclining:
 		return dhcp.StateInit
+	case DHCPStateRenewing:
+		return dhcp.StateRenewing
+	case DHCPStateRebinding:
+		return dhcp.StateRebinding
 	}
 	return 0
 }
 
+// DetailedState returns the current state of the DHCP client as tracked
+// internally, which distinguishes states [DHCPClient.State] folds together.
+func (d *DHCPClient) DetailedState() DHCPState { return d.state }
+
 // LocalPort returns the local port number used by the DHCP client.
 // If zero the client is not initialized.
 func (d *DHCPClient) LocalPort() uint16 {
@@ -225,7 +379,7 @@ func (d *DHCPClient) ourHeader() dhcp.HeaderV4 {
 	return hdr
 }
 
-func (d *DHCPClient) isAborted() bool { return d.state == dhcpStateAborted }
+func (d *DHCPClient) isAborted() bool { return d.state == DHCPStateAborted }
 
 var dhcpDefaultParamReqList = []dhcp.OptNum{
 	dhcp.OptSubnetMask,
@@ -248,6 +402,12 @@ func (d *DHCPClient) send(dst []byte) (n int, err error) {
 		return 0, io.EOF
 	} else if !d.isPendingHandling() {
 		return 0, nil
+	} else if d.leased() && !d.leaseTimer(d.stack.now()) {
+		return 0, ErrFlagPending // Keep polled until T1.
+	} else if d.awaitingReply() && !d.retransmit(d.stack.now()) {
+		return 0, ErrFlagPending // Keep polled until the retransmission.
+	} else if d.state == DHCPStateNone && d.stack.now().Before(d.retxAt) {
+		return 0, ErrFlagPending // Keep polled until discovery restarts after a DECLINE.
 	}
 	const dhcpOffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
 	switch {
@@ -258,9 +418,9 @@ func (d *DHCPClient) send(dst []byte) (n int, err error) {
 	// Switch statement prepares DHCP response depending on whether we're waiting
 	// for offer, ack or if we still need to send a discover (StateNone).
 	var Options []dhcp.Option
-	var nextstate uint8
+	var nextstate DHCPState
 	switch d.state { // Send.
-	case dhcpStateNone:
+	case DHCPStateNone:
 		// Supposing no IP options:
 		maxDHCPSize := d.stack.MTU() - eth.SizeEthernetHeader - eth.SizeIPv4Header - eth.SizeUDPHeader
 		// DHCP options.
@@ -275,9 +435,9 @@ func (d *DHCPClient) send(dst []byte) (n int, err error) {
 		if d.requestedIP != [4]byte{} {
 			Options = append(Options, dhcp.Option{Num: dhcp.OptRequestedIPaddress, Data: d.requestedIP[:]})
 		}
-		nextstate = dhcpStateWaitOffer
+		nextstate = DHCPStateWaitOffer
 
-	case dhcpStateGotOffer:
+	case DHCPStateGotOffer:
 		d.auxbuf[0] = byte(dhcp.MsgRequest)
 		// Accept this server's offer.
 		Options = append(d.optionbuf[:0], []dhcp.Option{
@@ -285,24 +445,49 @@ func (d *DHCPClient) send(dst []byte) (n int, err error) {
 			{Num: dhcp.OptRequestedIPaddress, Data: d.offer[:]},
 			{Num: dhcp.OptServerIdentification, Data: d.svip[:]},
 		}...)
-		nextstate = dhcpStateWaitAck
+		nextstate = DHCPStateWaitAck
 		d.requestSentAt = d.stack.now()
 
+	case DHCPStateRenewing, DHCPStateRebinding:
+		// Extend the lease of the address in ciaddr, no server identifier nor requested address.
+		d.auxbuf[0] = byte(dhcp.MsgRequest)
+		Options = append(d.optionbuf[:0], dhcp.Option{Num: dhcp.OptMessageType, Data: d.auxbuf[:1]})
+		nextstate = d.state
+		d.requestSentAt = d.stack.now()
+
+	case DHCPStateDeclining:
+		d.auxbuf[0] = byte(dhcp.MsgDecline)
+		Options = append(d.optionbuf[:0], []dhcp.Option{
+			{Num: dhcp.OptMessageType, Data: d.auxbuf[:1]},
+			{Num: dhcp.OptRequestedIPaddress, Data: d.offer[:]},
+			{Num: dhcp.OptServerIdentification, Data: d.svip[:]},
+		}...)
+		nextstate = DHCPStateNone
+
 	default:
 		err = errUnhandledState
 	}
 	if err != nil {
 		return 0, nil
 	}
-	if d.requestHostname != "" {
+	declining := d.state == DHCPStateDeclining
+	if d.requestHostname != "" && !declining {
 		Options = append(Options, dhcp.Option{Num: dhcp.OptHostName, Data: unsafe.Slice(unsafe.StringData(d.requestHostname), len(d.requestHostname))})
 	}
+	if len(d.fqdnOpt) > 0 && !declining {
+		Options = append(Options, dhcp.Option{Num: dhcp.OptClientFQDN, Data: d.fqdnOpt})
+	}
 	for i := dhcpOffset + 14; i < len(dst); i++ {
 		dst[i] = 0 // Zero out BOOTP and options fields.
 	}
 
 	// Encode DHCP header + options.
 	outgoingHdr := d.ourHeader()
+	srcIP := d.stack.ip
+	if declining {
+		// The declined address is only sent in the requested address option (RFC 2131 table 5).
+		outgoingHdr.CIAddr, outgoingHdr.YIAddr, srcIP = [4]byte{}, [4]byte{}, [4]byte{}
+	}
 	outgoingHdr.Put(dst[dhcpOffset:])
 
 	ptr := dhcpOffset + dhcp.MagicCookieOffset
@@ -327,15 +512,29 @@ func (d *DHCPClient) send(dst []byte) (n int, err error) {
 	// Apparently ToS is a function of which state of DHCP one is in. Not sure why code below works.
 	// Note: Not exactly needed for all servers.
 	var ToS uint8
-	if d.state > dhcpStateWaitOffer {
+	if d.state > DHCPStateWaitOffer {
 		ToS = 192
 	}
-	broadcast := eth.BroadcastHW6()
-	setUDP(pkt, d.stack.mac, broadcast, d.stack.ip, broadcastIPv4.As4(), ToS, payload, 68, 67)
+	dstHW, dstIP := eth.BroadcastHW6(), broadcastIPv4.As4()
+	if d.state == DHCPStateRenewing {
+		dstHW, dstIP = d.svmac, d.svip // Renewal is unicast to the server that granted the lease.
+	}
+	d.stack.setUDP(pkt, dstHW, srcIP, dstIP, ToS, payload, 68, 67)
 	pkt.PutHeaders(dst)
 	d.state = nextstate
+	if d.awaitingReply() {
+		d.retxAt = d.stack.now().Add(d.retx.Next(d.stack.rand32()))
+	} else if declining {
+		// Start over without asking for the declined address.
+		d.offer, d.requestedIP, d.svip = [4]byte{}, [4]byte{}, broadcastIPv4.As4()
+		d.boundAt = time.Time{}
+		d.retryAt = time.Time{}
+		d.retx.Reset()
+		d.currentXid = d.newXid()
+		d.retxAt = d.stack.now().Add(d.declineWait)
+	}
 	if d.stack.isLogEnabled(slog.LevelInfo) {
-		d.stack.info("DHCP:tx", slog.String("msg", dhcp.MessageType(Options[0].Data[0]).String()))
+		d.stack.info("DHCP:tx", slog.String("msg", dhcp.MessageType(Options[0].Data[0]).String()), slog.String("state", d.state.String()))
 	}
 	return ptr, nil
 }
@@ -367,7 +566,7 @@ func (d *DHCPClient) recv(pkt *UDPPacket) (err error) {
 	if d.stack.isLogEnabled(slog.LevelDebug) {
 		*db = 1
 	}
-	if d.state == dhcpStateWaitOffer {
+	if d.state == DHCPStateWaitOffer {
 		d.svip = rcvHdr.SIAddr
 	}
 	err = dhcp.ForEachOption(incpayload, func(opt dhcp.Option) error {
@@ -381,9 +580,10 @@ func (d *DHCPClient) recv(pkt *UDPPacket) (err error) {
 		case dhcp.OptServerIdentification:
 			d.svip = maybeIP(opt.Data)
 		case dhcp.OptDNSServers:
-			if len(d.dns) > 0 && len(opt.Data)%4 != 0 {
-				return nil // No DNS parsing if already got in previous exchange.
+			if len(opt.Data)%4 != 0 {
+				return nil // Malformed address list.
 			}
+			d.dns = d.dns[:0] // Servers of the latest message, ACK after OFFER.
 			for i := 0; i < len(opt.Data); i += 4 {
 				d.dns = append(d.dns, netip.AddrFrom4([4]byte(opt.Data[i:i+4])))
 			}
@@ -404,6 +604,10 @@ func (d *DHCPClient) recv(pkt *UDPPacket) (err error) {
 			d.tIPLease = maybeU32(opt.Data)
 		case dhcp.OptRebindingTimeValue:
 			d.tRebind = maybeU32(opt.Data)
+		case dhcp.OptClientFQDN:
+			if len(opt.Data) >= 3 {
+				d.fqdnFlags = opt.Data[0]
+			}
 		}
 		if *db != 0 && !internal.HeapAllocDebugging {
 			d.stack.debug("DHCP:rx", slog.String("opt", opt.Num.String()), slog.String("data", stringNumList(opt.Data)))
@@ -411,24 +615,38 @@ func (d *DHCPClient) recv(pkt *UDPPacket) (err error) {
 		return nil
 	})
 
+	if err != nil && d.stack.deviation("DHCP options", true) {
+		return err
+	}
+	err = nil
 	msgType := dhcp.MessageType(*mt)
 	if d.stack.isLogEnabled(slog.LevelInfo) {
-		d.stack.info("DHCP:rx", slog.String("msg", msgType.String()))
+		d.stack.info("DHCP:rx", slog.String("msg", msgType.String()), slog.String("state", d.state.String()))
+	}
+	if d.state == DHCPStateWaitOffer && msgType != dhcp.MsgOffer && d.stack.deviation("DHCP offer message type", true) {
+		return nil // Ignore message, keep waiting for an offer.
 	}
 	switch d.state { // Receive.
-	case dhcpStateWaitOffer:
+	case DHCPStateWaitOffer:
 		// Accept this server's offer.
 		d.gateway = rcvHdr.GIAddr
 		d.offer = rcvHdr.YIAddr
-		d.state = dhcpStateGotOffer
-	case dhcpStateWaitAck:
+		d.state = DHCPStateGotOffer
+		d.retx.Reset()
+	case DHCPStateWaitAck, DHCPStateRenewing, DHCPStateRebinding:
 		if msgType == dhcp.MsgAck {
-			d.state = dhcpStateDone
+			d.state = DHCPStateDone
+			d.boundAt = d.stack.now()
+			d.retryAt = time.Time{}
+			d.svmac = pkt.Eth.Source
+			d.retx.Reset()
 		} else if msgType == dhcp.MsgNak {
-			d.state = dhcpStateNaked
+			d.state = DHCPStateNaked
+		}
+	case DHCPStateDone:
+		if !d.leased() {
+			err = io.EOF // We got a valid response, close socket.
 		}
-	case dhcpStateDone:
-		err = io.EOF // We got a valid response, close socket.
 	default:
 		err = errUnhandledState
 	}
@@ -439,11 +657,76 @@ func (d *DHCPClient) recv(pkt *UDPPacket) (err error) {
 }
 
 func (d *DHCPClient) isPendingHandling() bool {
-	return d.isAborted() || d.state == dhcpStateNone || d.state == dhcpStateGotOffer
+	return d.isAborted() || d.state == DHCPStateNone || d.state == DHCPStateGotOffer || d.state == DHCPStateDeclining || d.awaitingReply() || d.leased()
+}
+
+// awaitingReply reports whether a DISCOVER or REQUEST is outstanding.
+func (d *DHCPClient) awaitingReply() bool {
+	return d.state == DHCPStateWaitOffer || d.state == DHCPStateWaitAck
+}
+
+// retransmit reports whether the outstanding DISCOVER or REQUEST went
+// unanswered and readies it to be sent again. Discovery starts over after
+// [DHCPRequestConfig.MaxRequests] unanswered REQUESTs, i.e: if the offering server went away.
+func (d *DHCPClient) retransmit(now time.Time) bool {
+	if now.Before(d.retxAt) {
+		return false
+	}
+	d.stack.info("DHCP:retransmit", slog.Int("attempts", d.retx.Attempts()), slog.String("state", d.state.String()))
+	if d.state == DHCPStateWaitOffer {
+		d.state = DHCPStateNone
+	} else if d.retx.Attempts() < int(d.maxRequests) {
+		d.state = DHCPStateGotOffer
+	} else {
+		d.state = DHCPStateNone
+		d.retx.Reset()
+	}
+	return true
+}
+
+// setTimers sets the client's timers from cfg with defaults applied.
+func (d *DHCPClient) setTimers(cfg DHCPRequestConfig) {
+	d.retx = Backoff{Initial: cfg.RetryInitial, Max: cfg.RetryMax, Jitter: retryJitter}
+	d.maxRequests = cfg.MaxRequests
+	d.declineWait = cfg.DeclineWait
+	d.renewRetryMin = cfg.RenewRetryMin
+}
+
+// Decline notifies the server with a DHCPDECLINE that the address it leased
+// is in use by another host, i.e: from [PortStackConfig.OnAddrConflict] when
+// address conflict detection finds a host using it. The lease is abandoned
+// and discovery starts over [DHCPRequestConfig.DeclineWait] after the DECLINE
+// is sent. The stack's address is not changed.
+func (d *DHCPClient) Decline() error {
+	switch d.state {
+	case DHCPStateDone, DHCPStateRenewing, DHCPStateRebinding:
+	default:
+		return errDHCPNotBound
+	}
+	if !d.leased() {
+		// Socket was closed on the ACK of an infinite lease.
+		err := d.stack.OpenUDP(d.port, d)
+		if err != nil {
+			return err
+		}
+	}
+	d.stack.info("DHCP:decline", slog.String("addr", d.Offer().String()))
+	d.state = DHCPStateDeclining
+	return d.stack.RequestSendUDP(d.port)
 }
 
 func (d *DHCPClient) Abort() {
-	d.state = dhcpStateAborted
+	d.state = DHCPStateAborted
+}
+
+// Reset abandons the lease or configuration in progress, closes the client's
+// port and returns the client to its initial state so that a new request may
+// begin, i.e: to renew everything after moving networks. Unlike a DHCPRELEASE
+// the server is not notified and the stack's address is kept.
+func (d *DHCPClient) Reset() {
+	d.stack.info("DHCP:reset", slog.Uint64("port", uint64(d.port)))
+	d.stack.closeUDPOwned(d.port, d)
+	d.abort()
 }
 
 func (d *DHCPClient) abort() {
@@ -452,15 +735,19 @@ func (d *DHCPClient) abort() {
 		port:     d.port,
 		dns:      d.dns[:0],
 		hostname: d.hostname[:0],
+		fqdnOpt:  d.fqdnOpt[:0],
 	}
+	d.setTimers(DHCPRequestConfig{}.withDefaults())
 }
 
-func setUDP(packet *UDPPacket, srcHW, dstHW [6]byte, srcAddr, dstAddr [4]byte, ipTOS uint8, payload []byte, lport, rport uint16) {
+// setUDP sets the headers of packet to send payload from the stack's hardware
+// address. The IP identification is drawn from the stack's entropy source.
+func (ps *PortStack) setUDP(packet *UDPPacket, dstHW [6]byte, srcAddr, dstAddr [4]byte, ipTOS uint8, payload []byte, lport, rport uint16) {
 	const ipLenInWords = 5
 	// Ethernet frame.
 	packet.Eth = eth.EthernetHeader{
 		Destination:     dstHW,
-		Source:          srcHW,
+		Source:          ps.mac,
 		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
 	}
 
@@ -472,7 +759,7 @@ func setUDP(packet *UDPPacket, srcHW, dstHW [6]byte, srcAddr, dstAddr [4]byte, i
 		TotalLength:   4*ipLenInWords + eth.SizeUDPHeader + uint16(len(payload)),
 		Protocol:      17, // UDP
 		TTL:           64,
-		ID:            prand16(packet.IP.ID),
+		ID:            ps.rand16(),
 		ToS:           ipTOS,
 		Flags:         0x40 << 8, // Don't fragment.
 	}
@@ -0,0 +1,130 @@
+package stacks
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+var errClockNotSet = errors.New("wall clock not set")
+
+// WriteLeases writes the server's active leases to w in the dnsmasq lease
+// file format, one lease per line:
+//
+//	<expiry unix time> <MAC> <IP> <hostname or *> <client ID or *>
+//
+// An expiry of 0 denotes an infinite lease. The stack's clock must be set to
+// the time of day (i.e: via NTP) since expiry times are absolute.
+func (d *DHCPServer) WriteLeases(w io.Writer) error {
+	now := d.stack.now()
+	if now.Before(modernAge) {
+		return errClockNotSet
+	}
+	var buf [128]byte
+	for i := range d.hosts {
+		client := &d.hosts[i]
+		if !client.leaseActive(now) {
+			continue
+		}
+		line := buf[:0]
+		var expiry int64
+		if !client.leaseEnd.IsZero() {
+			expiry = client.leaseEnd.Unix()
+		}
+		line = strconv.AppendInt(line, expiry, 10)
+		line = append(line, ' ')
+		line = eth.AppendMAC(line, client.mac)
+		line = append(line, ' ')
+		line = client.addr.AppendTo(line)
+		line = append(line, ' ')
+		if client.hostlen > 0 {
+			line = append(line, client.hostname[:client.hostlen]...)
+		} else {
+			line = append(line, '*')
+		}
+		line = append(line, " *\n"...)
+		_, err := w.Write(line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadLeases loads leases in the dnsmasq lease file format written by
+// [DHCPServer.WriteLeases] into the server's client table. Expired leases are
+// skipped. It must be called after Start.
+func (d *DHCPServer) ReadLeases(r io.Reader) error {
+	now := d.stack.now()
+	if now.Before(modernAge) {
+		return errClockNotSet
+	}
+	scanner := bufio.NewScanner(r)
+	nline := 0
+	for scanner.Scan() {
+		nline++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) < 4 {
+			return errors.New("malformed lease on line " + strconv.Itoa(nline))
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		hw, err := net.ParseMAC(fields[1])
+		if err != nil {
+			return err
+		} else if len(hw) != 6 {
+			return errors.New("non EUI-48 MAC on lease line " + strconv.Itoa(nline))
+		}
+		addr, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			return err
+		} else if !addr.Is4() {
+			continue // dnsmasq stores DHCPv6 leases in the same file.
+		}
+		client := dhcpclient{
+			mac:      [6]byte(hw),
+			addr:     addr,
+			state:    DHCPStateDone,
+			lastSeen: now,
+		}
+		if expiry != 0 {
+			client.leaseEnd = time.Unix(expiry, 0)
+		}
+		if !client.leaseActive(now) {
+			continue
+		}
+		if fields[3] != "*" {
+			client.hostlen = uint8(copy(client.hostname[:], fields[3]))
+		}
+		idx := d.lookup(client.mac)
+		if idx < 0 {
+			idx = d.slot()
+			if idx < 0 {
+				return errors.New("DHCP client table full")
+			}
+		}
+		d.hosts[idx] = client
+	}
+	return scanner.Err()
+}
+
+func (client *dhcpclient) leaseActive(now time.Time) bool {
+	return client.state == DHCPStateDone && (client.leaseEnd.IsZero() || client.leaseEnd.After(now))
+}
+
+// holdsAddr reports whether the client's address may not be offered to other
+// clients, either because its lease is active or because it was offered to it recently.
+func (client *dhcpclient) holdsAddr(now time.Time) bool {
+	return client.leaseActive(now) || client.state == DHCPStateWaitOffer && now.Sub(client.lastSeen) < dhcpOfferHold
+}
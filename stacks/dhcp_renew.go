@@ -0,0 +1,103 @@
+package stacks
+
+import (
+	"log/slog"
+	"time"
+)
+
+// dhcpInfiniteLease is the lease time value meaning the address never expires. See RFC 2131 section 3.3.
+const dhcpInfiniteLease = 0xffffffff
+
+// leased reports whether the client holds an address with a finite lease,
+// in which case the socket is kept open to renew it before it expires.
+func (d *DHCPClient) leased() bool {
+	switch d.state {
+	case DHCPStateDone, DHCPStateRenewing, DHCPStateRebinding:
+		return d.tIPLease != 0 && d.tIPLease != dhcpInfiniteLease && !d.boundAt.IsZero()
+	}
+	return false
+}
+
+// LeaseExpiry returns the time at which the leased address expires if not
+// renewed. It returns the zero time if no address is held or the lease is infinite.
+func (d *DHCPClient) LeaseExpiry() time.Time {
+	if !d.leased() {
+		return time.Time{}
+	}
+	return d.boundAt.Add(d.IPLeaseTime())
+}
+
+// renewAt returns the time T1 at which the client starts renewing the lease.
+// Defaults to half the lease time if the server sent no renewal time.
+func (d *DHCPClient) renewAt() time.Time {
+	t1 := d.RenewalTime()
+	if d.tRenew == 0 || d.tRenew >= d.tIPLease {
+		t1 = d.IPLeaseTime() / 2
+	}
+	return d.boundAt.Add(t1)
+}
+
+// rebindAt returns the time T2 at which the client starts rebinding the
+// lease with any server. Defaults to 7/8 of the lease time.
+func (d *DHCPClient) rebindAt() time.Time {
+	t2 := d.boundAt.Add(d.RebindingTime())
+	if d.tRebind == 0 || d.tRebind >= d.tIPLease || !t2.After(d.renewAt()) {
+		t2 = d.boundAt.Add(d.IPLeaseTime() / 8 * 7)
+	}
+	return t2
+}
+
+// leaseTimer advances the state of a client holding a lease to RENEWING,
+// REBINDING or back to INIT as the lease timers expire and reports whether a
+// message must be sent at time now. Retransmissions wait half the time
+// remaining until T2 when renewing, or until expiry when rebinding, down to
+// a minimum of 60 seconds as suggested by RFC 2131 section 4.4.5.
+func (d *DHCPClient) leaseTimer(now time.Time) (send bool) {
+	expiry := d.LeaseExpiry()
+	var deadline time.Time
+	switch {
+	case !now.Before(expiry):
+		if d.stack.isLogEnabled(slog.LevelInfo) {
+			d.stack.info("DHCP:lease-expired", slog.String("addr", d.Offer().String()))
+		}
+		// Restart configuration asking for the address we held.
+		d.requestedIP = d.offer
+		d.state = DHCPStateNone
+		d.boundAt = time.Time{}
+		d.retryAt = time.Time{}
+		d.currentXid = d.newXid()
+		return true
+	case !now.Before(d.rebindAt()):
+		if d.state != DHCPStateRebinding {
+			d.state = DHCPStateRebinding
+			d.retryAt = time.Time{}
+		}
+		deadline = expiry
+	case !now.Before(d.renewAt()):
+		if d.state == DHCPStateDone {
+			d.state = DHCPStateRenewing
+			d.retryAt = time.Time{}
+		}
+		deadline = d.rebindAt()
+	default:
+		return false
+	}
+	if now.Before(d.retryAt) {
+		return false
+	}
+	wait := deadline.Sub(now) / 2
+	if wait < d.renewRetryMin {
+		wait = d.renewRetryMin
+	}
+	d.retryAt = now.Add(wait)
+	d.currentXid = d.newXid()
+	return true
+}
+
+// newXid returns a non-zero transaction ID drawn from the stack's entropy source.
+func (d *DHCPClient) newXid() (xid uint32) {
+	for xid == 0 {
+		xid = d.stack.rand32()
+	}
+	return xid
+}
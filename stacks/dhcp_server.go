@@ -4,30 +4,180 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/netip"
+	"time"
 
 	"github.com/soypat/seqs/eth"
 	"github.com/soypat/seqs/eth/dhcp"
 )
 
 type dhcpclient struct {
-	addr        netip.Addr
-	state       uint8
-	port        uint16
-	requestlist [10]byte
+	mac   [6]byte
+	addr  netip.Addr
+	state DHCPState
+	port  uint16
+	// requestlist is the client's Parameter Request List. Unused entries are zero.
+	requestlist [16]byte
+	// lastSeen is used for least recently seen eviction of the hosts table.
+	lastSeen     time.Time
+	lastDiscover time.Time
+	// leaseEnd is the expiry time of the client's lease once acknowledged.
+	leaseEnd time.Time
+	// leaseTime is the duration of the lease offered to the client.
+	leaseTime time.Duration
+	hostname  [32]byte
+	hostlen   uint8
 }
 
 type DHCPServer struct {
-	stack      *PortStack
-	nextAddr   netip.Addr
-	siaddr     netip.Addr
-	port       uint16
-	hosts      map[[6]byte]dhcpclient
+	stack  *PortStack
+	siaddr netip.Addr
+	port   uint16
+	// hosts is the client table. When MaxHosts is set its backing array is
+	// allocated once by Configure and never grows.
+	hosts      []dhcpclient
 	aborted    bool
 	lastPacket UDPPacket
 	hasPacket  bool
+	cfg        DHCPServerConfig
+	// Discover rate limiting state.
+	discoverWindow   time.Time
+	discoverCount    int
+	droppedDiscovers uint32
+	// declined holds the addresses clients found in use by other hosts.
+	declined [dhcpMaxDeclined]dhcpDeclined
+	// leasebuf holds the encoded lease time option to avoid heap allocations.
+	leasebuf [4]byte
+	// Encoded configuration options. dnsbuf and domainbuf are set by Configure.
+	maskbuf, routerbuf, sidbuf [4]byte
+	dnsbuf, domainbuf          []byte
+	// relaybuf holds the relay agent information option echoed in replies to relayed messages.
+	relaybuf []byte
 }
 
+// DHCPServerConfig configures the address pool, leases and resource limits of
+// a [DHCPServer]. The limits protect the server against starvation attacks
+// where a client floods the network with DHCPDISCOVER messages from spoofed
+// hardware addresses.
+type DHCPServerConfig struct {
+	// MaxHosts limits the amount of clients tracked by the server. The client
+	// table is allocated with this fixed capacity on Configure so memory use
+	// stays constant afterwards. When the table is full new clients are handled
+	// according to Eviction. Zero means no limit.
+	MaxHosts int
+	// Eviction selects what happens when a new client arrives and the client table is full.
+	Eviction DHCPEvictionPolicy
+	// MaxDiscoversPerSecond limits the amount of DHCPDISCOVER messages processed
+	// each second across all clients. Zero means no limit.
+	MaxDiscoversPerSecond int
+	// MinDiscoverInterval is the minimum time between two processed
+	// DHCPDISCOVER messages from the same hardware address.
+	MinDiscoverInterval time.Duration
+	// LeaseTime is the duration of leases handed out. If zero a default of one
+	// hour is used. Clients may request shorter leases.
+	LeaseTime time.Duration
+	// PoolStart and PoolEnd are the first and last addresses, inclusive, of
+	// the range leased to clients. If unset the addresses .2 to .254 of the
+	// server address' /24 network are leased.
+	PoolStart, PoolEnd netip.Addr
+	// Reservations assigns fixed addresses to clients. Reserved addresses may
+	// lie outside the pool and are never leased to other clients.
+	Reservations []DHCPReservation
+	// SubnetMaskBits is the prefix length of the subnet mask sent to clients. If zero 24 is used.
+	SubnetMaskBits uint8
+	// Router is the default gateway sent to clients. Not sent if invalid.
+	Router netip.Addr
+	// DNSServers are the DNS server addresses sent to clients.
+	DNSServers []netip.Addr
+	// DomainName is the DNS domain name sent to clients. Not sent if empty.
+	DomainName string
+	// OnDiscover is an optional callback called before an address is offered
+	// to the client with hardware address mac, which requested the address
+	// requested or an invalid address if none. If allow is false the client is
+	// ignored, i.e: to implement MAC allowlists or captive-portal gating. A
+	// valid addr is offered instead of an address of the pool, i.e: one
+	// assigned by an external device registry. It must not be held by another client.
+	OnDiscover func(mac [6]byte, requested netip.Addr) (addr netip.Addr, allow bool)
+	// OnRequest is an optional callback called before the lease of addr to the
+	// client with hardware address mac is acknowledged. If it returns false a
+	// DHCPNAK is sent so the client restarts configuration.
+	OnRequest func(mac [6]byte, addr netip.Addr) bool
+	// Subnets are the networks of clients served through DHCP relay agents.
+	// Relayed messages are served from the subnet containing the address of the
+	// relay agent (giaddr). Messages relayed by agents on the server's network,
+	// or by any agent if Subnets is empty, are served from the server's pool.
+	// Others are ignored. PoolStart, PoolEnd, SubnetMaskBits and Router apply
+	// only to clients served from the server's pool.
+	Subnets []DHCPSubnet
+	// OnRelayed is an optional callback called before a message forwarded by a
+	// relay agent on behalf of the client with hardware address mac is
+	// processed. If it returns false the message is ignored, i.e: to only
+	// serve clients on certain circuits of the agent.
+	OnRelayed func(mac [6]byte, relay DHCPRelayInfo) bool
+}
+
+// DHCPSubnet is a network served by a [DHCPServer] through a relay agent.
+type DHCPSubnet struct {
+	// Prefix is the network, which contains the address of the relay agent
+	// on it. Its length is sent to clients as their subnet mask.
+	Prefix netip.Prefix
+	// PoolStart and PoolEnd are the first and last addresses, inclusive, of
+	// the range leased to clients on the network.
+	PoolStart, PoolEnd netip.Addr
+	// Router is the default gateway sent to clients. If invalid the address of the relay agent is sent.
+	Router netip.Addr
+}
+
+// DHCPRelayInfo describes the relay agent that forwarded a message to a [DHCPServer].
+type DHCPRelayInfo struct {
+	// Agent is the address of the relay agent (giaddr).
+	Agent netip.Addr
+	// CircuitID and RemoteID are the Agent Circuit ID and Agent Remote ID
+	// sub-options of the Relay Agent Information option (RFC 3046), i.e: the
+	// switch port the client is connected to. Nil if not sent by the agent.
+	// They reference the received message and must not be retained.
+	CircuitID, RemoteID []byte
+}
+
+// DHCPReservation is a static address assignment of a [DHCPServer].
+type DHCPReservation struct {
+	MAC  [6]byte
+	Addr netip.Addr
+	// LeaseTime is the duration of the client's leases. If zero [DHCPServerConfig.LeaseTime] is used.
+	LeaseTime time.Duration
+}
+
+const (
+	defaultDHCPLeaseTime = time.Hour
+	// dhcpOfferHold is how long an address offered to a client is held for it
+	// waiting for its DHCPREQUEST before it may be offered to other clients.
+	dhcpOfferHold = time.Minute
+	// dhcpDeclineHold is how long an address declined by a client is not offered.
+	dhcpDeclineHold = 10 * time.Minute
+	// dhcpMaxDeclined is the amount of declined addresses remembered.
+	dhcpMaxDeclined = 4
+)
+
+// dhcpDeclined is an address a client reported in use by another host with
+// a DHCPDECLINE, which is not offered until the time until.
+type dhcpDeclined struct {
+	addr  netip.Addr
+	until time.Time
+}
+
+// DHCPEvictionPolicy determines how a [DHCPServer] makes room in a full client table.
+type DHCPEvictionPolicy uint8
+
+const (
+	// DHCPEvictLRU replaces the least recently seen client with the new client.
+	DHCPEvictLRU DHCPEvictionPolicy = iota
+	// DHCPEvictNone ignores new clients until the server is restarted.
+	DHCPEvictNone
+)
+
 func NewDHCPServer(ps *PortStack, siaddr netip.Addr, lport uint16) *DHCPServer {
 	if ps == nil || lport == 0 {
 		panic("nil portstack or local port")
@@ -39,8 +189,74 @@ func NewDHCPServer(ps *PortStack, siaddr netip.Addr, lport uint16) *DHCPServer {
 	}
 }
 
+// Configure sets the server's address pool, leases and resource limits and allocates the client table.
+// It must be called before Start.
+func (d *DHCPServer) Configure(cfg DHCPServerConfig) error {
+	if cfg.MaxHosts < 0 || cfg.MaxDiscoversPerSecond < 0 || cfg.MinDiscoverInterval < 0 {
+		return errors.New("negative DHCP server limit")
+	} else if cfg.Eviction > DHCPEvictNone {
+		return errors.New("invalid DHCP eviction policy")
+	} else if !validDHCPLeaseTime(cfg.LeaseTime) {
+		return errors.New("invalid DHCP lease time")
+	} else if cfg.PoolStart.IsValid() != cfg.PoolEnd.IsValid() ||
+		cfg.PoolStart.IsValid() && (!cfg.PoolStart.Is4() || !cfg.PoolEnd.Is4() || cfg.PoolEnd.Less(cfg.PoolStart)) {
+		return errors.New("invalid DHCP address pool")
+	}
+	for _, r := range cfg.Reservations {
+		if !r.Addr.Is4() || !validDHCPLeaseTime(r.LeaseTime) {
+			return errors.New("invalid DHCP reservation for " + net.HardwareAddr(r.MAC[:]).String())
+		}
+	}
+	for _, sn := range cfg.Subnets {
+		if !sn.Prefix.IsValid() || !sn.Prefix.Addr().Is4() || !sn.Prefix.Contains(sn.PoolStart) ||
+			!sn.Prefix.Contains(sn.PoolEnd) || sn.PoolEnd.Less(sn.PoolStart) || sn.Router.IsValid() && !sn.Router.Is4() {
+			return errors.New("invalid DHCP subnet " + sn.Prefix.String())
+		}
+	}
+	if cfg.SubnetMaskBits > 32 || cfg.Router.IsValid() && !cfg.Router.Is4() {
+		return errors.New("invalid DHCP subnet mask or router")
+	} else if len(cfg.DNSServers) > math.MaxUint8/4 || len(cfg.DomainName) > math.MaxUint8 {
+		return errors.New("too many DHCP DNS servers or domain name too long")
+	}
+	d.dnsbuf = d.dnsbuf[:0]
+	for _, addr := range cfg.DNSServers {
+		if !addr.Is4() {
+			return errors.New("DHCP DNS server must be IPv4")
+		}
+		addr4 := addr.As4()
+		d.dnsbuf = append(d.dnsbuf, addr4[:]...)
+	}
+	d.domainbuf = append(d.domainbuf[:0], cfg.DomainName...)
+	d.cfg = cfg
+	d.hosts = nil
+	if cfg.MaxHosts > 0 {
+		d.hosts = make([]dhcpclient, 0, cfg.MaxHosts)
+	}
+	return nil
+}
+
+func validDHCPLeaseTime(lease time.Duration) bool {
+	return lease >= 0 && lease/time.Second <= math.MaxUint32
+}
+
+// DroppedDiscovers returns the amount of DHCPDISCOVER messages dropped due to rate limiting.
+func (d *DHCPServer) DroppedDiscovers() uint32 { return d.droppedDiscovers }
+
+// Reset forgets all clients and their leases and the rate limiting state,
+// keeping the configuration and the server running. Clients renewing
+// forgotten leases are handled as new clients.
+func (d *DHCPServer) Reset() {
+	d.stack.info("DHCP:reset", slog.Int("clients", len(d.hosts)))
+	d.hosts = d.hosts[:0] // Keep backing array for deterministic memory use.
+	d.hasPacket = false
+	d.discoverWindow = time.Time{}
+	d.discoverCount = 0
+	d.droppedDiscovers = 0
+	d.declined = [dhcpMaxDeclined]dhcpDeclined{}
+}
+
 func (d *DHCPServer) Start() error {
-	d.hosts = make(map[[6]byte]dhcpclient)
+	d.hosts = d.hosts[:0]
 	d.aborted = false
 	return d.stack.OpenUDP(d.port, d)
 }
@@ -53,7 +269,7 @@ func (d *DHCPServer) recv(pkt *UDPPacket) (err error) {
 		return ErrDroppedPacket
 	}
 	d.hasPacket = true
-	d.lastPacket = *pkt
+	d.lastPacket.copyFrom(pkt)
 	return nil
 }
 
@@ -66,6 +282,9 @@ func (d *DHCPServer) send(dst []byte) (int, error) {
 	}
 	n, err := d.HandleUDP(dst, &d.lastPacket)
 	d.hasPacket = false
+	if err != nil {
+		d.stack.error("DHCP:handle", slog.String("err", err.Error()))
+	}
 	return n, err
 }
 
@@ -77,11 +296,15 @@ func (d *DHCPServer) isAborted() bool { return d.aborted }
 
 func (d *DHCPServer) abort() {
 	*d = DHCPServer{
-		stack:   d.stack,
-		siaddr:  d.siaddr,
-		port:    d.port,
-		hosts:   nil, // TODO: is this wise?
-		aborted: true,
+		stack:     d.stack,
+		siaddr:    d.siaddr,
+		port:      d.port,
+		hosts:     d.hosts[:0], // Keep backing array for deterministic memory use.
+		aborted:   true,
+		cfg:       d.cfg,
+		dnsbuf:    d.dnsbuf,
+		domainbuf: d.domainbuf,
+		relaybuf:  d.relaybuf,
 	}
 }
 
@@ -101,8 +324,22 @@ func (d *DHCPServer) HandleUDP(resp []byte, packet *UDPPacket) (_ int, err error
 
 	rcvHdr := dhcp.DecodeHeaderV4(incpayload)
 	mac := packet.Eth.Source
-	client := d.hosts[mac]
+	relayed := rcvHdr.GIAddr != [4]byte{}
+	if relayed {
+		mac = [6]byte(rcvHdr.CHAddr[:6]) // Ethernet source is the relay agent.
+	}
+	idx := d.lookup(mac)
+	var client dhcpclient
+	if idx >= 0 {
+		client = d.hosts[idx]
+	}
+	now := d.stack.now()
 	var msgType dhcp.MessageType
+	var reqLease time.Duration
+	var reqAddr netip.Addr
+	sid := rcvHdr.SIAddr
+	relay := DHCPRelayInfo{Agent: netip.AddrFrom4(rcvHdr.GIAddr)}
+	d.relaybuf = d.relaybuf[:0]
 	err = dhcp.ForEachOption(incpayload, func(opt dhcp.Option) error {
 		switch opt.Num {
 		case dhcp.OptMessageType:
@@ -110,47 +347,206 @@ func (d *DHCPServer) HandleUDP(resp []byte, packet *UDPPacket) (_ int, err error
 				msgType = dhcp.MessageType(opt.Data[0])
 			}
 		case dhcp.OptParameterRequestList:
-			client.requestlist = [10]byte{}
+			client.requestlist = [16]byte{}
 			copy(client.requestlist[:], opt.Data)
 		case dhcp.OptRequestedIPaddress:
-			if len(opt.Data) == 4 && client.state == dhcpStateNone {
-				client.addr = netip.AddrFrom4([4]byte(opt.Data))
+			if len(opt.Data) == 4 {
+				reqAddr = netip.AddrFrom4([4]byte(opt.Data))
+			}
+		case dhcp.OptServerIdentification:
+			if len(opt.Data) == 4 {
+				sid = [4]byte(opt.Data)
+			}
+		case dhcp.OptHostName:
+			client.hostlen = uint8(copy(client.hostname[:], opt.Data))
+		case dhcp.OptIPAddressLeaseTime:
+			if len(opt.Data) == 4 {
+				reqLease = time.Duration(binary.BigEndian.Uint32(opt.Data)) * time.Second
+			}
+		case dhcp.OptRelayAgentInformation:
+			if relayed {
+				d.relaybuf = append(d.relaybuf, opt.Data...)
+				parseRelayAgentInfo(&relay, opt.Data)
 			}
 		}
 		return nil
 	})
-	if err != nil || (msgType != 1 && rcvHdr.SIAddr != d.siaddr.As4()) {
+	if err != nil {
+		d.drop(mac, "bad options: "+err.Error())
 		return 0, err
+	} else if (msgType == dhcp.MsgRequest || msgType == dhcp.MsgDecline) && sid != [4]byte{} && sid != d.siaddr.As4() {
+		// Requests without server identifier are sent by clients verifying
+		// or extending a lease and are answered by the server holding it.
+		d.drop(mac, "addressed to other server")
+		return 0, nil
+	}
+	var subnet *DHCPSubnet
+	if relayed {
+		subnet = d.subnet(relay.Agent)
+		if subnet == nil && len(d.cfg.Subnets) > 0 && !d.network().Contains(relay.Agent) {
+			d.drop(mac, "no subnet for relay agent "+relay.Agent.String())
+			return 0, nil
+		} else if d.cfg.OnRelayed != nil && !d.cfg.OnRelayed(mac, relay) {
+			d.stack.info("DHCP:relayed-denied", d.stack.macAttr("mac", mac), d.stack.addrAttr("giaddr", rcvHdr.GIAddr))
+			return 0, nil
+		}
+	}
+	if !reqAddr.IsValid() && rcvHdr.CIAddr != [4]byte{} {
+		reqAddr = netip.AddrFrom4(rcvHdr.CIAddr) // Renewing and rebinding clients fill ciaddr instead.
+	}
+	if reqAddr.IsValid() && client.state == DHCPStateNone {
+		client.addr = reqAddr
 	}
 
+	if msgType == dhcp.MsgDiscover && !d.admitDiscover(&client, now) {
+		d.droppedDiscovers++
+		d.stack.debug("DHCP:discover-ratelimit", d.stack.macAttr("mac", mac))
+		return 0, nil
+	}
 	var Options []dhcp.Option
+	var nak, inform bool
 	switch msgType {
 	case dhcp.MsgDiscover:
-		if client.state != dhcpStateNone {
-			err = errors.New("DHCP Discover on initialized client")
-			break
+		// A client may restart configuration at any time. The address it
+		// held, if any, is offered again if still available.
+		client.lastDiscover = now
+		var addr netip.Addr
+		if d.cfg.OnDiscover != nil {
+			var allow bool
+			addr, allow = d.cfg.OnDiscover(mac, client.addr)
+			if !allow {
+				d.stack.info("DHCP:discover-denied", d.stack.macAttr("mac", mac))
+				return 0, nil
+			} else if addr.IsValid() && (!addr.Is4() || !d.addrAvailable(addr, mac, now)) {
+				d.stack.error("DHCP:discover-addr-unavailable", d.stack.macAttr("mac", mac), slog.String("addr", addr.String()))
+				return 0, nil
+			}
+		}
+		if !addr.IsValid() {
+			addr = d.allocate(mac, client.addr, subnet, now)
+		}
+		if !addr.IsValid() {
+			d.stack.info("DHCP:pool-exhausted", d.stack.macAttr("mac", mac))
+			return 0, nil
 		}
-		rcvHdr.YIAddr = d.next(client.addr.As4())
+		rcvHdr.YIAddr = addr.As4()
+		client.addr = addr
+		client.leaseTime = d.leaseTime(mac, reqLease)
 		Options = []dhcp.Option{
 			{Num: dhcp.OptMessageType, Data: []byte{byte(dhcp.MsgOffer)}},
+			{Num: dhcp.OptIPAddressLeaseTime, Data: d.leaseTimeOpt(client.leaseTime)},
 		}
 		rcvHdr.SIAddr = d.siaddr.As4()
 		client.port = packet.UDP.SourcePort
-		client.state = dhcpStateWaitOffer
+		client.state = DHCPStateWaitOffer
 
 	case dhcp.MsgRequest:
-		if client.state != dhcpStateWaitOffer {
-			err = errors.New("unexpected DHCP Request")
+		if idx < 0 {
+			// RFC 2131 section 4.3.2: servers without record of the client remain silent.
+			d.drop(mac, "unexpected request")
+			return 0, nil
+		}
+		var reason string
+		switch {
+		case client.state != DHCPStateWaitOffer && client.state != DHCPStateDone:
+			reason = "no lease" // Released, declined or refused.
+		case reqAddr.IsValid() && reqAddr != client.addr:
+			reason = "address not leased to client"
+		case !d.addrAvailable(client.addr, mac, now):
+			reason = "address leased to other client" // Lease expired and address reassigned.
+		case subnet != nil && !subnet.Prefix.Contains(client.addr) && d.reservation(mac) == nil:
+			reason = "address not on relay agent's subnet" // Client moved networks.
+		case d.cfg.OnRequest != nil && !d.cfg.OnRequest(mac, client.addr):
+			reason = "denied"
+		}
+		if reason != "" {
+			d.stack.info("DHCP:nak", d.stack.macAttr("mac", mac), slog.String("reason", reason))
+			// Client must not use the address, NAK is broadcast as per RFC 2131 section 4.3.2.
+			nak = true
+			rcvHdr.YIAddr = [4]byte{}
+			rcvHdr.CIAddr = [4]byte{}
+			if rcvHdr.GIAddr != [4]byte{} {
+				rcvHdr.Flags |= dhcp.FlagBroadcast // Relay agent broadcasts the NAK to the client.
+			}
+			Options = []dhcp.Option{{Num: dhcp.OptMessageType, Data: []byte{byte(dhcp.MsgNak)}}}
+			client.state = DHCPStateNone
+			client.leaseEnd = now
 			break
 		}
+		if reqLease > 0 {
+			client.leaseTime = d.leaseTime(mac, reqLease)
+		}
+		rcvHdr.YIAddr = client.addr.As4() // Clients need not fill yiaddr in their request.
 		Options = []dhcp.Option{
 			{Num: dhcp.OptMessageType, Data: []byte{byte(dhcp.MsgAck)}}, // DHCP Message Type: ACK
+			{Num: dhcp.OptIPAddressLeaseTime, Data: d.leaseTimeOpt(client.leaseTime)},
 		}
-	}
-	if err != nil {
+		client.state = DHCPStateDone
+		client.leaseEnd = now.Add(client.leaseTime)
+		d.stack.stats.DHCPLeasesIssued++
+
+	case dhcp.MsgRelease:
+		if idx >= 0 {
+			// Keep the entry so the client is offered the same address if still available.
+			d.hosts[idx].state = DHCPStateNone
+			d.hosts[idx].leaseEnd = now
+			d.stack.debug("DHCP:release", d.stack.macAttr("mac", mac))
+		}
+		return 0, nil
+
+	case dhcp.MsgDecline:
+		if idx < 0 || !reqAddr.IsValid() || reqAddr != client.addr {
+			d.drop(mac, "decline of address not leased to client")
+			return 0, nil
+		}
+		// The client found the address in use by another host, possibly one
+		// configured manually. It is not offered again for a while.
+		d.decline(reqAddr, now)
+		d.hosts[idx].state = DHCPStateNone
+		d.hosts[idx].addr = netip.Addr{}
+		d.hosts[idx].leaseEnd = now
+		d.stack.info("DHCP:decline", d.stack.macAttr("mac", mac), slog.String("addr", reqAddr.String()))
 		return 0, nil
+
+	case dhcp.MsgInform:
+		if rcvHdr.CIAddr == [4]byte{} {
+			d.drop(mac, "inform without client address")
+			return 0, nil
+		}
+		// The client configured its address by other means and only asks for
+		// the network options. No lease is recorded (RFC 2131 section 3.4).
+		inform = true
+		rcvHdr.YIAddr = [4]byte{}
+		rcvHdr.SIAddr = d.siaddr.As4()
+		client.port = packet.UDP.SourcePort
+		Options = []dhcp.Option{{Num: dhcp.OptMessageType, Data: []byte{byte(dhcp.MsgAck)}}}
+
+	default:
+		d.drop(mac, "unhandled message type "+msgType.String())
+		return 0, nil
+	}
+	if nak {
+		d.sidbuf = d.siaddr.As4()
+		Options = append(Options, dhcp.Option{Num: dhcp.OptServerIdentification, Data: d.sidbuf[:]})
+	} else {
+		Options = d.appendConfigOptions(Options, &client, subnet, relay.Agent)
+	}
+	if len(d.relaybuf) > 0 {
+		// RFC 3046 section 2.2: Relay agent information is echoed as the last option.
+		Options = append(Options, dhcp.Option{Num: dhcp.OptRelayAgentInformation, Data: d.relaybuf})
+	}
+	client.mac = mac
+	client.lastSeen = now
+	if idx < 0 && !inform {
+		idx = d.slot()
+		if idx < 0 {
+			d.stack.debug("DHCP:hosts-full", d.stack.macAttr("mac", mac))
+			return 0, nil
+		}
+	}
+	if !inform {
+		d.hosts[idx] = client
 	}
-	d.hosts[mac] = client
 	const dhcpOffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
 	for i := dhcpOffset + 14; i < len(resp); i++ {
 		resp[i] = 0 // Zero out BOOTP and options fields.
@@ -172,32 +568,301 @@ func (d *DHCPServer) HandleUDP(resp []byte, packet *UDPPacket) (_ int, err error
 	ptr++
 	// Set Ethernet+IP+UDP headers.
 	payload := resp[dhcpOffset:ptr]
-	d.setResponseUDP(client.port, packet, payload)
+	d.setResponseUDP(client.port, &rcvHdr, packet, payload)
 	packet.PutHeaders(resp)
+	if d.stack.isLogEnabled(slog.LevelInfo) {
+		d.stack.info("DHCP:send", slog.String("msg", dhcp.MessageType(Options[0].Data[0]).String()),
+			d.stack.macAttr("mac", mac), d.stack.addrAttr("yiaddr", rcvHdr.YIAddr))
+	}
 	return ptr, nil
 }
 
-func (d *DHCPServer) next(requested [4]byte) [4]byte {
-	if requested != [4]byte{} {
+// drop logs the reason a message from the client with hardware address mac is ignored.
+func (d *DHCPServer) drop(mac [6]byte, reason string) {
+	d.stack.debug("DHCP:drop", d.stack.macAttr("mac", mac), slog.String("reason", reason))
+}
+
+// appendConfigOptions appends the server identifier and the configured
+// network options to opts. Network options are only appended if requested
+// by the client in its Parameter Request List, or if it sent none. Clients
+// behind the relay agent with address agent are sent the mask and router of their subnet.
+func (d *DHCPServer) appendConfigOptions(opts []dhcp.Option, client *dhcpclient, subnet *DHCPSubnet, agent netip.Addr) []dhcp.Option {
+	d.sidbuf = d.siaddr.As4()
+	opts = append(opts, dhcp.Option{Num: dhcp.OptServerIdentification, Data: d.sidbuf[:]})
+	bits := d.cfg.SubnetMaskBits
+	router := d.cfg.Router
+	if subnet != nil {
+		bits = uint8(subnet.Prefix.Bits())
+		router = subnet.Router
+		if !router.IsValid() {
+			router = agent
+		}
+	} else if bits == 0 {
+		bits = 24
+	}
+	binary.BigEndian.PutUint32(d.maskbuf[:], ^uint32(0)<<(32-bits))
+	if client.requested(dhcp.OptSubnetMask) {
+		opts = append(opts, dhcp.Option{Num: dhcp.OptSubnetMask, Data: d.maskbuf[:]})
+	}
+	if router.IsValid() && client.requested(dhcp.OptRouter) {
+		d.routerbuf = router.As4()
+		opts = append(opts, dhcp.Option{Num: dhcp.OptRouter, Data: d.routerbuf[:]})
+	}
+	if len(d.dnsbuf) > 0 && client.requested(dhcp.OptDNSServers) {
+		opts = append(opts, dhcp.Option{Num: dhcp.OptDNSServers, Data: d.dnsbuf})
+	}
+	if len(d.domainbuf) > 0 && client.requested(dhcp.OptDomainName) {
+		opts = append(opts, dhcp.Option{Num: dhcp.OptDomainName, Data: d.domainbuf})
+	}
+	return opts
+}
+
+// requested reports whether the client asked for option num in its
+// Parameter Request List. All options are requested if it sent no list.
+func (client *dhcpclient) requested(num dhcp.OptNum) bool {
+	if client.requestlist[0] == 0 {
+		return true
+	}
+	for _, n := range client.requestlist {
+		if dhcp.OptNum(n) == num {
+			return true
+		}
+	}
+	return false
+}
+
+// leaseTime returns the lease duration for the client with hardware address
+// mac that requested a lease of requested duration, which may be zero.
+func (d *DHCPServer) leaseTime(mac [6]byte, requested time.Duration) time.Duration {
+	lease := d.cfg.LeaseTime
+	if r := d.reservation(mac); r != nil && r.LeaseTime != 0 {
+		lease = r.LeaseTime
+	}
+	if lease == 0 {
+		lease = defaultDHCPLeaseTime
+	}
+	if requested > 0 && requested < lease {
+		lease = requested
+	}
+	return lease
+}
+
+func (d *DHCPServer) leaseTimeOpt(lease time.Duration) []byte {
+	binary.BigEndian.PutUint32(d.leasebuf[:], uint32(lease/time.Second))
+	return d.leasebuf[:]
+}
+
+// admitDiscover applies the DHCPDISCOVER rate limits and reports whether the message should be processed.
+func (d *DHCPServer) admitDiscover(client *dhcpclient, now time.Time) bool {
+	if d.cfg.MinDiscoverInterval > 0 && !client.lastDiscover.IsZero() &&
+		now.Sub(client.lastDiscover) < d.cfg.MinDiscoverInterval {
+		return false
+	}
+	if d.cfg.MaxDiscoversPerSecond > 0 {
+		if now.Sub(d.discoverWindow) >= time.Second {
+			d.discoverWindow = now
+			d.discoverCount = 0
+		}
+		if d.discoverCount >= d.cfg.MaxDiscoversPerSecond {
+			return false
+		}
+		d.discoverCount++
+	}
+	return true
+}
+
+// lookup returns the index of the client with the given hardware address in the hosts table or -1 if not found.
+func (d *DHCPServer) lookup(mac [6]byte) int {
+	for i := range d.hosts {
+		if d.hosts[i].mac == mac {
+			return i
+		}
+	}
+	return -1
+}
+
+// slot returns the index in the hosts table where a new client should be
+// stored. When the table is full the entry of a client with an expired lease
+// is reclaimed, otherwise the eviction policy is applied. Returns -1 if
+// the new client can not be stored.
+func (d *DHCPServer) slot() int {
+	if d.cfg.MaxHosts <= 0 || len(d.hosts) < d.cfg.MaxHosts {
+		d.hosts = append(d.hosts, dhcpclient{})
+		return len(d.hosts) - 1
+	}
+	now := d.stack.now()
+	for i := range d.hosts {
+		if !d.hosts[i].holdsAddr(now) {
+			d.stack.debug("DHCP:reclaim", d.stack.macAttr("mac", d.hosts[i].mac))
+			return i
+		}
+	}
+	if d.cfg.Eviction == DHCPEvictNone {
+		return -1
+	}
+	oldest := 0
+	for i := range d.hosts {
+		if d.hosts[i].lastSeen.Before(d.hosts[oldest].lastSeen) {
+			oldest = i
+		}
+	}
+	d.stack.debug("DHCP:evict", d.stack.macAttr("mac", d.hosts[oldest].mac))
+	return oldest
+}
+
+// allocate returns the address to offer the client with hardware address mac
+// that requested the address requested, which may be invalid. The reserved
+// address of the client is always offered. Otherwise the requested address is
+// offered if within the pool and available, or else the first available
+// address in the pool. An invalid address is returned if the pool is exhausted.
+// Clients behind a relay agent are leased addresses of their subnet's pool.
+func (d *DHCPServer) allocate(mac [6]byte, requested netip.Addr, subnet *DHCPSubnet, now time.Time) netip.Addr {
+	if r := d.reservation(mac); r != nil {
+		return r.Addr
+	}
+	start, end := d.pool(subnet)
+	inPool := requested.Is4() && !requested.Less(start) && !end.Less(requested)
+	if inPool && d.addrAvailable(requested, mac, now) {
 		return requested
 	}
-	return [4]byte{192, 168, 1, 2}
+	for addr := start; addr.IsValid() && !end.Less(addr); addr = addr.Next() {
+		if d.addrAvailable(addr, mac, now) {
+			return addr
+		}
+	}
+	return netip.Addr{}
+}
+
+// addrAvailable reports whether addr may be offered to the client with hardware address mac.
+func (d *DHCPServer) addrAvailable(addr netip.Addr, mac [6]byte, now time.Time) bool {
+	if addr == d.siaddr {
+		return false
+	}
+	for i := range d.cfg.Reservations {
+		if d.cfg.Reservations[i].Addr == addr && d.cfg.Reservations[i].MAC != mac {
+			return false
+		}
+	}
+	for i := range d.hosts {
+		host := &d.hosts[i]
+		if host.addr == addr && host.mac != mac && host.holdsAddr(now) {
+			return false
+		}
+	}
+	for i := range d.declined {
+		if d.declined[i].addr == addr && now.Before(d.declined[i].until) {
+			return false
+		}
+	}
+	return true
+}
+
+// decline marks addr as in use by a host unknown to the server, replacing
+// the declined address that is held the shortest if none is free.
+func (d *DHCPServer) decline(addr netip.Addr, now time.Time) {
+	slot := 0
+	for i := range d.declined {
+		if d.declined[i].until.Before(d.declined[slot].until) {
+			slot = i
+		}
+	}
+	d.declined[slot] = dhcpDeclined{addr: addr, until: now.Add(dhcpDeclineHold)}
+}
+
+// pool returns the first and last addresses of the lease range of subnet or
+// of the server's network if nil.
+func (d *DHCPServer) pool(subnet *DHCPSubnet) (start, end netip.Addr) {
+	if subnet != nil {
+		return subnet.PoolStart, subnet.PoolEnd
+	} else if d.cfg.PoolStart.IsValid() {
+		return d.cfg.PoolStart, d.cfg.PoolEnd
+	}
+	net24 := d.siaddr.As4()
+	net24[3] = 2
+	start = netip.AddrFrom4(net24)
+	net24[3] = 254
+	return start, netip.AddrFrom4(net24)
 }
 
-func (d *DHCPServer) setResponseUDP(clientport uint16, packet *UDPPacket, payload []byte) {
+// network returns the network of the server's address and pool.
+func (d *DHCPServer) network() netip.Prefix {
+	bits := d.cfg.SubnetMaskBits
+	if bits == 0 {
+		bits = 24
+	}
+	return netip.PrefixFrom(d.siaddr, int(bits)).Masked()
+}
+
+// subnet returns the subnet served through the relay agent with address agent or nil if none.
+func (d *DHCPServer) subnet(agent netip.Addr) *DHCPSubnet {
+	for i := range d.cfg.Subnets {
+		if d.cfg.Subnets[i].Prefix.Contains(agent) {
+			return &d.cfg.Subnets[i]
+		}
+	}
+	return nil
+}
+
+// parseRelayAgentInfo sets the sub-options of the relay agent information
+// option data found in info. Malformed trailing data is ignored.
+func parseRelayAgentInfo(info *DHCPRelayInfo, data []byte) {
+	const (
+		subOptCircuitID = 1
+		subOptRemoteID  = 2
+	)
+	for len(data) >= 2 && 2+int(data[1]) <= len(data) {
+		sub := data[2 : 2+data[1]]
+		switch data[0] {
+		case subOptCircuitID:
+			info.CircuitID = sub
+		case subOptRemoteID:
+			info.RemoteID = sub
+		}
+		data = data[2+len(sub):]
+	}
+}
+
+func (d *DHCPServer) reservation(mac [6]byte) *DHCPReservation {
+	for i := range d.cfg.Reservations {
+		if d.cfg.Reservations[i].MAC == mac {
+			return &d.cfg.Reservations[i]
+		}
+	}
+	return nil
+}
+
+// setResponseUDP sets the headers of the reply to hdr addressed as per RFC 2131 section 4.1.
+func (d *DHCPServer) setResponseUDP(clientport uint16, hdr *dhcp.HeaderV4, packet *UDPPacket, payload []byte) {
 	const ipLenInWords = 5
 	// Ethernet frame.
-	packet.Eth.Destination = eth.BroadcastHW6()
+	switch {
+	case hdr.GIAddr != [4]byte{}:
+		// Relayed message, the relay agent forwards the reply to the client.
+		packet.Eth.Destination = packet.Eth.Source
+		packet.IP.Destination = hdr.GIAddr
+		clientport = d.port
+	case hdr.CIAddr != [4]byte{}:
+		// Client renewing or rebinding its lease holds its address, reply unicast.
+		packet.Eth.Destination = packet.Eth.Source
+		packet.IP.Destination = hdr.CIAddr
+	case hdr.YIAddr != [4]byte{} && hdr.Flags&dhcp.FlagBroadcast == 0:
+		// Client accepts unicast datagrams to the address being assigned. NAKs
+		// carry no yiaddr and are always broadcast.
+		copy(packet.Eth.Destination[:], hdr.CHAddr[:6])
+		packet.IP.Destination = hdr.YIAddr
+	default:
+		packet.Eth.Destination = eth.BroadcastHW6()
+		packet.IP.Destination = broadcastIPv4.As4()
+	}
 	packet.Eth.Source = d.stack.HardwareAddr6()
 
 	packet.Eth.SizeOrEtherType = uint16(eth.EtherTypeIPv4)
 
 	// IPv4 frame.
-	packet.IP.Destination = [4]byte{}
 	packet.IP.Source = d.siaddr.As4() // Source IP is always zeroed when client sends.
 	packet.IP.Protocol = 17           // UDP
 	packet.IP.TTL = 64
-	packet.IP.ID = prand16(packet.IP.ID)
+	packet.IP.ID = d.stack.rand16()
 	packet.IP.VersionAndIHL = ipLenInWords // Sets IHL: No IP options. Version set automatically.
 	packet.IP.TotalLength = 4*ipLenInWords + eth.SizeUDPHeader + uint16(len(payload))
 	packet.IP.Checksum = packet.IP.CalculateChecksum()
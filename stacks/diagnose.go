@@ -0,0 +1,294 @@
+package stacks
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/eth/dns"
+	"github.com/soypat/seqs/internal"
+)
+
+const defaultDiagnoseTimeout = 5 * time.Second
+
+var (
+	errDiagNoAddr     = errors.New("diagnose: stack has no IP address")
+	errDiagWedged     = errors.New("diagnose: stack is wedged")
+	errDiagNoAnswer   = errors.New("diagnose: no A record in DNS response")
+	errDiagBadRCode   = errors.New("diagnose: DNS server returned error")
+	errDiagBadHTTP    = errors.New("diagnose: malformed HTTP status line")
+	errDiagConnClosed = errors.New("diagnose: HTTP connection closed before response")
+)
+
+// DiagnoseStep identifies a step of the [PortStack.Diagnose] sequence.
+type DiagnoseStep uint8
+
+const (
+	// DiagnoseLink checks the stack is configured and processing frames.
+	DiagnoseLink DiagnoseStep = iota
+	// DiagnoseARP resolves the gateway's hardware address.
+	DiagnoseARP
+	// DiagnosePing sends an ICMP echo request to the gateway.
+	DiagnosePing
+	// DiagnoseDNS resolves a name with the configured DNS server.
+	DiagnoseDNS
+	// DiagnoseHTTP sends a HTTP HEAD request to the configured address.
+	DiagnoseHTTP
+	numDiagnoseSteps
+)
+
+func (s DiagnoseStep) String() string {
+	switch s {
+	case DiagnoseLink:
+		return "link"
+	case DiagnoseARP:
+		return "arp"
+	case DiagnosePing:
+		return "ping"
+	case DiagnoseDNS:
+		return "dns"
+	case DiagnoseHTTP:
+		return "http"
+	}
+	return "DiagnoseStep(" + strconv.Itoa(int(s)) + ")"
+}
+
+// DiagnoseConfig configures the steps run by [PortStack.Diagnose].
+// Steps whose configuration is missing are skipped.
+type DiagnoseConfig struct {
+	// Gateway is the address of the default gateway. Required for all steps but the link step.
+	Gateway netip.Addr
+	// DNSServer and LookupName configure the DNS step.
+	DNSServer  netip.Addr
+	LookupName string
+	// HTTPAddr is the address of the HTTP server the HEAD request is sent to.
+	// HTTPHost is the value of the Host header, if empty HTTPAddr's address is used.
+	HTTPAddr netip.AddrPort
+	HTTPHost string
+	// LocalPort is the local UDP port used by the DNS step. The HTTP step uses LocalPort+1.
+	// Both ports must be closed when Diagnose is called.
+	LocalPort uint16
+	// StepTimeout is the time allowed for each step. If zero a timeout of 5 seconds is used.
+	StepTimeout time.Duration
+}
+
+// DiagnoseResult is the outcome of a single diagnose step.
+type DiagnoseResult struct {
+	Step DiagnoseStep
+	// Skipped is set when the step was not configured or depends on a step that failed.
+	Skipped bool
+	// Err is the reason the step failed. Nil if the step succeeded or was skipped.
+	Err     error
+	Elapsed time.Duration
+}
+
+// DiagnoseReport is the result of running [PortStack.Diagnose].
+type DiagnoseReport struct {
+	// Results holds the result of every step, indexed by [DiagnoseStep].
+	Results      [numDiagnoseSteps]DiagnoseResult
+	GatewayHW    [6]byte
+	PingRTT      time.Duration
+	ResolvedAddr netip.Addr
+	HTTPStatus   int
+}
+
+// Failed returns the result of the first failed step, which is usually the
+// layer at fault. ok is false if no step failed.
+func (r *DiagnoseReport) Failed() (_ DiagnoseResult, ok bool) {
+	for _, res := range r.Results {
+		if res.Err != nil {
+			return res, true
+		}
+	}
+	return DiagnoseResult{}, false
+}
+
+// Diagnose runs a scripted sequence of checks that exercise each layer of
+// the stack: link, ARP resolution and ping of the gateway, a DNS lookup and a
+// HTTP HEAD request. Diagnose blocks until all steps have finished and
+// requires the stack to be serviced (RecvEth/HandleEth) by another goroutine.
+func (ps *PortStack) Diagnose(cfg DiagnoseConfig) (report DiagnoseReport) {
+	if cfg.StepTimeout <= 0 {
+		cfg.StepTimeout = defaultDiagnoseTimeout
+	}
+	for i := range report.Results {
+		report.Results[i].Step = DiagnoseStep(i)
+	}
+	run := func(step DiagnoseStep, skip bool, fn func() error) bool {
+		res := &report.Results[step]
+		if skip {
+			res.Skipped = true
+			return false
+		}
+		start := ps.now()
+		res.Err = fn()
+		res.Elapsed = ps.now().Sub(start)
+		return res.Err == nil
+	}
+
+	linkOK := run(DiagnoseLink, false, func() error {
+		if !ps.Addr().IsValid() || ps.Addr().IsUnspecified() {
+			return errDiagNoAddr
+		} else if ps.Health().Wedged(0) {
+			return errDiagWedged
+		}
+		return nil
+	})
+	gwOK := run(DiagnoseARP, !linkOK || !cfg.Gateway.IsValid(), func() error {
+		return ps.diagARP(cfg, &report.GatewayHW)
+	})
+	run(DiagnosePing, !gwOK, func() error {
+		return ps.diagPing(cfg, report.GatewayHW, &report.PingRTT)
+	})
+	dnsCfg := cfg.DNSServer.IsValid() && cfg.LookupName != ""
+	run(DiagnoseDNS, !gwOK || !dnsCfg || cfg.LocalPort == 0, func() error {
+		return ps.diagDNS(cfg, report.GatewayHW, &report.ResolvedAddr)
+	})
+	run(DiagnoseHTTP, !gwOK || !cfg.HTTPAddr.IsValid() || cfg.LocalPort == 0, func() error {
+		return ps.diagHTTP(cfg, report.GatewayHW, &report.HTTPStatus)
+	})
+	return report
+}
+
+func (ps *PortStack) diagARP(cfg DiagnoseConfig, hw *[6]byte) error {
+	arpc := ps.ARP()
+	err := arpc.BeginResolve(cfg.Gateway)
+	if err != nil {
+		return err
+	}
+	err = pollUntil(cfg.StepTimeout, func() (bool, error) {
+		return arpc.IsDone(), nil
+	})
+	if err != nil {
+		arpc.Abort()
+		return err
+	}
+	_, *hw, err = arpc.ResultAs6()
+	return err
+}
+
+func (ps *PortStack) diagPing(cfg DiagnoseConfig, hw [6]byte, rtt *time.Duration) error {
+	err := pollUntil(cfg.StepTimeout, func() (bool, error) {
+		err := ps.BeginPing(cfg.Gateway, hw)
+		return err != errICMPBusy, err
+	})
+	if err != nil {
+		return err
+	}
+	return pollUntil(cfg.StepTimeout, func() (done bool, err error) {
+		*rtt, err = ps.PingResult()
+		if err == errPingPending {
+			return false, nil
+		}
+		return true, err
+	})
+}
+
+func (ps *PortStack) diagDNS(cfg DiagnoseConfig, hw [6]byte, addr *netip.Addr) error {
+	name, err := dns.NewName(cfg.LookupName)
+	if err != nil {
+		return err
+	}
+	dnsc := NewDNSClient(ps, cfg.LocalPort)
+	err = dnsc.StartResolve(DNSResolveConfig{
+		Questions:       []dns.Question{{Name: name, Type: dns.TypeA, Class: dns.ClassINET}},
+		DNSAddr:         cfg.DNSServer,
+		DNSHWAddr:       hw,
+		EnableRecursion: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer dnsc.Abort()
+	var rcode dns.RCode
+	err = pollUntil(cfg.StepTimeout, func() (done bool, _ error) {
+		done, rcode = dnsc.IsDone()
+		return done, nil
+	})
+	if err != nil {
+		return err
+	} else if rcode != dns.RCodeSuccess {
+		return errDiagBadRCode
+	}
+	for _, ans := range dnsc.Answers() {
+		data := ans.RawData()
+		if ans.Header.Type == dns.TypeA && len(data) == 4 {
+			*addr = netip.AddrFrom4([4]byte(data))
+			return nil
+		}
+	}
+	return errDiagNoAnswer
+}
+
+func (ps *PortStack) diagHTTP(cfg DiagnoseConfig, hw [6]byte, status *int) error {
+	conn, err := NewTCPConn(ps, TCPConnConfig{TxBufSize: 256, RxBufSize: 256})
+	if err != nil {
+		return err
+	}
+	lport := cfg.LocalPort + 1
+	err = conn.OpenDialTCP(lport, hw, cfg.HTTPAddr, seqs.Value(ps.rand32()))
+	if err != nil {
+		return err
+	}
+	defer ps.CloseTCP(lport)
+	deadline := ps.now().Add(cfg.StepTimeout)
+	conn.SetDeadline(deadline)
+	err = pollUntil(cfg.StepTimeout, func() (bool, error) {
+		return conn.State() == seqs.StateEstablished, nil
+	})
+	if err != nil {
+		return err
+	}
+	host := cfg.HTTPHost
+	if host == "" {
+		host = cfg.HTTPAddr.Addr().String()
+	}
+	_, err = conn.Write([]byte("HEAD / HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		return err
+	}
+	// Only the status line is of interest: "HTTP/1.1 200 OK".
+	var buf [len("HTTP/1.1 200")]byte
+	n := 0
+	for n < len(buf) {
+		ngot, err := conn.Read(buf[n:])
+		n += ngot
+		if err != nil && n < len(buf) {
+			if ps.now().After(deadline) {
+				return os.ErrDeadlineExceeded
+			}
+			return errDiagConnClosed
+		}
+	}
+	conn.Close()
+	if string(buf[:len("HTTP/1.")]) != "HTTP/1." || buf[8] != ' ' {
+		return errDiagBadHTTP
+	}
+	code, err := strconv.Atoi(string(buf[9:]))
+	if err != nil {
+		return errDiagBadHTTP
+	}
+	*status = code
+	return nil
+}
+
+// pollUntil calls poll until it returns true or an error. It returns
+// os.ErrDeadlineExceeded if timeout elapses first.
+func pollUntil(timeout time.Duration, poll func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	backoff := internal.NewBackoff(internal.BackoffHasPriority)
+	for {
+		done, err := poll()
+		if err != nil {
+			return err
+		} else if done {
+			return nil
+		} else if time.Now().After(deadline) {
+			return os.ErrDeadlineExceeded
+		}
+		backoff.Miss()
+	}
+}
@@ -0,0 +1,56 @@
+package stacks
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs"
+)
+
+// DialTCP opens a TCP connection from an ephemeral port of stack to remote and
+// blocks until it is established, refused or timeout elapses. The hardware
+// address of remote, or of the gateway if remote is off-link, is resolved with
+// ARP. cfg configures the connection as in [NewTCPConn]. Like other blocking
+// calls it requires HandleEth and RecvEth to be called concurrently.
+func DialTCP(stack *PortStack, cfg TCPConnConfig, remote netip.AddrPort, timeout time.Duration) (*TCPConn, error) {
+	if !remote.Addr().Is4() {
+		return nil, errIPVersion
+	}
+	deadline := time.Now().Add(timeout)
+	hw, err := stack.ARP().Resolve(remote.Addr(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := NewTCPConn(stack, cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.OpenDialTCP(0, hw, remote, seqs.Value(stack.rand32()))
+	if err != nil {
+		return nil, err
+	}
+	lport := conn.LocalPort()
+	err = awaitEstablished(conn, time.Until(deadline))
+	if err != nil {
+		stack.CloseTCP(lport)
+		return nil, err
+	}
+	stack.info("TCP:dial", slog.Uint64("lport", uint64(lport)), stack.addrAttr("remote", remote.Addr().As4()))
+	return conn, nil
+}
+
+// awaitEstablished blocks until the handshake of conn completes. It returns
+// errDialRefused if the connection closes first, i.e: on a RST from the remote,
+// or errSynTimeout if it was aborted after [TCPConfig.SynRetries] retransmissions.
+func awaitEstablished(conn *TCPConn, timeout time.Duration) error {
+	return pollUntil(timeout, func() (bool, error) {
+		state := conn.State()
+		if state.IsClosed() && conn.connect.timedOut {
+			return false, errSynTimeout
+		} else if state.IsClosed() {
+			return false, errDialRefused
+		}
+		return state == seqs.StateEstablished, nil
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"log/slog"
 	"net/netip"
+	"time"
 
 	"github.com/soypat/seqs/eth"
 	"github.com/soypat/seqs/eth/dns"
@@ -16,6 +17,20 @@ const (
 	dnsAwaitResponse
 	dnsDone
 	dnsAborted
+	dnsTimedOut
+)
+
+const (
+	defaultDNSTimeout = 2 * time.Second
+	defaultDNSRetries = 2
+)
+
+var (
+	errDNSTimeout    = errors.New("dns: query timed out")
+	errDNSNotFound   = errors.New("dns: name not found")
+	errDNSBadRCode   = errors.New("dns: server returned error response")
+	errDNSNoAnswer   = errors.New("dns: no address records in response")
+	errDNSLookupBusy = errors.New("dns: previous resolution not yet released")
 )
 
 type DNSClient struct {
@@ -25,12 +40,29 @@ type DNSClient struct {
 	raddr netip.Addr
 	rhw   [6]byte
 	txid  uint16
+	// lport is the configured local port. If zero port holds the ephemeral port of the current query.
 	lport uint16
+	port  uint16
 	state uint8
 	// enables server side recursion.
 	enableRecursion bool
+	// rejected counts responses not matching the outstanding query.
+	rejected uint32
+	// sent is the time the outstanding query was last sent.
+	sent     time.Time
+	attempts uint8
+	retries  uint8
+	// wait is the time waited for a response to the outstanding query, backed off by retx.
+	wait time.Duration
+	retx Backoff
+	// addrs holds the result of the last LookupNetIP call.
+	addrs []netip.Addr
+	cache dnsCache // See dnscache.go.
 }
 
+// NewDNSClient creates a DNS client sending queries from localPort. If
+// localPort is zero each resolution is sent from a random ephemeral port,
+// which makes spoofing responses harder for off-path attackers.
 func NewDNSClient(stack *PortStack, localPort uint16) *DNSClient {
 	return &DNSClient{
 		stack: stack,
@@ -43,14 +75,29 @@ type DNSResolveConfig struct {
 	DNSAddr         netip.Addr
 	DNSHWAddr       [6]byte
 	EnableRecursion bool
+	// Timeout is the time waited for a response before the query is sent
+	// again with a new transaction ID. The wait doubles on every retry up to
+	// 4 times Timeout. If zero 2 seconds is used.
+	Timeout time.Duration
+	// Retries is the amount of times an unanswered query is sent again
+	// before the resolution fails. If zero 2 retries are made.
+	Retries uint8
 }
 
-func (dnsc *DNSClient) StartResolve(cfg DNSResolveConfig) error {
-	err := dnsc.stack.OpenUDP(dnsc.lport, dnsc)
+// StartResolve sends a query with the questions in cfg. A single query is
+// outstanding at a time, so that an attacker may not flood spoofed responses
+// matching any of several concurrent queries for the same name (birthday attack).
+func (dnsc *DNSClient) StartResolve(cfg DNSResolveConfig) (err error) {
+	dnsc.port = dnsc.lport
+	if dnsc.lport == 0 {
+		dnsc.port, err = dnsc.stack.openEphemeralUDP(dnsc)
+	} else {
+		err = dnsc.stack.OpenUDP(dnsc.lport, dnsc)
+	}
 	if err != nil {
 		return err
 	}
-	err = dnsc.stack.FlagPendingUDP(dnsc.lport)
+	err = dnsc.stack.RequestSendUDP(dnsc.port)
 	if err != nil {
 		return err
 	}
@@ -62,16 +109,29 @@ func (dnsc *DNSClient) StartResolve(cfg DNSResolveConfig) error {
 	msg.LimitResourceDecoding(uint16(nd), uint16(nd), 0, 0)
 	msg.AddQuestions(cfg.Questions)
 	dnsc.state = dnsSendQuery
-	dnsc.txid += 37
 	dnsc.enableRecursion = cfg.EnableRecursion
 	dnsc.rhw = cfg.DNSHWAddr
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	dnsc.retx = Backoff{Initial: timeout, Max: 4 * timeout, Jitter: retryJitter}
+	dnsc.retries = cfg.Retries
+	if dnsc.retries == 0 {
+		dnsc.retries = defaultDNSRetries
+	}
+	dnsc.attempts = 0
 	return nil
 }
 
 func (dnsc *DNSClient) send(dst []byte) (n int, err error) {
 	if dnsc.state == dnsAborted {
+		dnsc.abort() // Ready for next resolution once the stack closes the port.
 		return 0, io.EOF
-	} else if dnsc.state != dnsSendQuery {
+	} else if dnsc.state == dnsAwaitResponse {
+		dnsc.checkTimeout()
+	}
+	if dnsc.state != dnsSendQuery {
 		return 0, nil
 	}
 	const payloadOffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
@@ -82,7 +142,7 @@ func (dnsc *DNSClient) send(dst []byte) (n int, err error) {
 		return 0, io.ErrShortBuffer
 	}
 
-	dnsc.txid = prand16(msgLen * dnsc.txid)
+	dnsc.txid = dnsc.stack.rand16() // Unpredictable ID for every query sent.
 	msg.Header = dns.Header{
 		Flags:         dns.NewClientHeaderFlags(dns.OpCodeQuery, dnsc.enableRecursion),
 		TransactionID: dnsc.txid,
@@ -95,12 +155,29 @@ func (dnsc *DNSClient) send(dst []byte) (n int, err error) {
 		return 0, errors.New("dns: unexpected write")
 	}
 	const ipv4ToS = 0
-	setUDP(&dnsc.pkt, dnsc.stack.mac, dnsc.rhw, dnsc.stack.ip, dnsc.raddr.As4(), ipv4ToS, payload, dnsc.lport, dns.ServerPort)
+	dnsc.stack.setUDP(&dnsc.pkt, dnsc.rhw, dnsc.stack.ip, dnsc.raddr.As4(), ipv4ToS, payload, dnsc.port, dns.ServerPort)
 	dnsc.pkt.PutHeaders(dst)
 	dnsc.state = dnsAwaitResponse
+	dnsc.sent = dnsc.stack.now()
+	dnsc.wait = dnsc.retx.Next(dnsc.stack.rand32())
+	dnsc.attempts++
 	return payloadOffset + int(msgLen), nil
 }
 
+// checkTimeout sends the query again if no response was received within the
+// timeout and fails the resolution once retries are exhausted.
+func (dnsc *DNSClient) checkTimeout() {
+	if dnsc.stack.now().Sub(dnsc.sent) < dnsc.wait {
+		return
+	}
+	if dnsc.attempts <= dnsc.retries {
+		dnsc.state = dnsSendQuery
+		return
+	}
+	dnsc.state = dnsTimedOut
+	dnsc.stack.info("dns:timeout", dnsc.stack.addrAttr("server", dnsc.raddr.As4()), slog.Int("attempts", int(dnsc.attempts)))
+}
+
 func (dnsc *DNSClient) recv(pkt *UDPPacket) error {
 	if dnsc.state == dnsAborted {
 		return io.EOF
@@ -112,22 +189,28 @@ func (dnsc *DNSClient) recv(pkt *UDPPacket) error {
 		return io.ErrShortBuffer
 	}
 	dhdr := dns.DecodeHeader(payload)
-	if dhdr.TransactionID != dnsc.txid || !dhdr.Flags.IsResponse() {
-		dnsc.stack.trace("dns:badResp",
+	if dhdr.TransactionID != dnsc.txid || !dhdr.Flags.IsResponse() ||
+		pkt.IP.Source != dnsc.raddr.As4() || pkt.UDP.SourcePort != dns.ServerPort {
+		// Does not correspond to our transaction or is not expected server
+		// response. Possibly a cache poisoning attempt, keep waiting for the real response.
+		dnsc.rejected++
+		dnsc.stack.debug("dns:badResp",
 			slog.Uint64("gotTx", uint64(dhdr.TransactionID)),
 			slog.Uint64("wantTx", uint64(dnsc.txid)),
+			slog.Uint64("sport", uint64(pkt.UDP.SourcePort)),
 		)
-		return nil // Does not correspond to our transaction or is not expected server response.
+		return nil
 	}
 	// Gotten to this point we have a response, valid or not.
 	flags := dhdr.Flags
 	rcode := flags.ResponseCode()
 	dnsc.stack.info("dns:recv", slog.String("op", flags.OpCode().String()), slog.String("rcode", rcode.String()))
 	dnsc.state = dnsDone
-	if rcode != dns.RCodeSuccess {
+	if rcode != dns.RCodeSuccess && rcode != dns.RCodeNameError {
 		dnsc.msg.Header = dhdr // Used in IsDone.
 		return nil
 	}
+	// Name errors are decoded for the SOA record in their authority section which sets how long they are cached.
 
 	msg := &dnsc.msg
 	_, incompleteButOK, err := msg.Decode(payload)
@@ -140,13 +223,18 @@ func (dnsc *DNSClient) recv(pkt *UDPPacket) error {
 }
 
 func (dnsc *DNSClient) isPendingHandling() bool {
-	return dnsc.state == dnsSendQuery || dnsc.state == dnsAborted
+	// While awaiting a response the client is pending to resend the query on timeout.
+	return dnsc.state == dnsSendQuery || dnsc.state == dnsAborted || dnsc.state == dnsAwaitResponse
 }
 
 func (dnsc *DNSClient) IsDone() (bool, dns.RCode) {
 	return dnsc.state == dnsDone, dnsc.msg.Header.Flags.ResponseCode()
 }
 
+// TimedOut reports whether the last resolution failed since no response was
+// received after retrying the query.
+func (dnsc *DNSClient) TimedOut() bool { return dnsc.state == dnsTimedOut }
+
 func (dnsc *DNSClient) Answers() []dns.Resource {
 	if dnsc.state != dnsDone {
 		return nil
@@ -154,19 +242,129 @@ func (dnsc *DNSClient) Answers() []dns.Resource {
 	return dnsc.msg.Answers
 }
 
+// RejectedResponses returns the amount of received responses that did not
+// match the outstanding query's ID, server address and port, i.e: spoofed
+// responses of a cache poisoning attempt.
+func (dnsc *DNSClient) RejectedResponses() uint32 { return dnsc.rejected }
+
+// LocalPort returns the port the current query is sent from.
+func (dnsc *DNSClient) LocalPort() uint16 { return dnsc.port }
+
 func (dnsc *DNSClient) Abort() {
 	if dnsc.state != dnsClosed {
 		dnsc.state = dnsAborted
-		dnsc.stack.FlagPendingUDP(dnsc.lport)
+		dnsc.stack.RequestSendUDP(dnsc.port)
 	}
 }
 
+// Reset aborts the query in progress closing its port and flushes the cache
+// so the client is as newly created. The cache configuration is kept.
+func (dnsc *DNSClient) Reset() {
+	dnsc.stack.closeUDPOwned(dnsc.port, dnsc)
+	dnsc.abort()
+	dnsc.FlushCache()
+	dnsc.rejected = 0
+}
+
 func (dnsc *DNSClient) abort() {
 	*dnsc = DNSClient{
-		stack: dnsc.stack,
-		lport: dnsc.lport,
-		msg:   dnsc.msg,
-		txid:  dnsc.txid,
+		stack:    dnsc.stack,
+		lport:    dnsc.lport,
+		port:     dnsc.port,
+		msg:      dnsc.msg,
+		txid:     dnsc.txid,
+		rejected: dnsc.rejected,
+		addrs:    dnsc.addrs,
+		cache:    dnsc.cache,
 	}
 	dnsc.msg.Reset()
 }
+
+// LookupNetIP resolves the IPv4 addresses of host by querying the server in
+// cfg for A records, ignoring cfg.Questions. It blocks until a response is
+// received or the query times out after the configured retries. Like other
+// blocking calls it requires HandleEth and RecvEth to be called concurrently.
+// The returned slice is reused by the next call to LookupNetIP.
+// Names in the stack's host table are resolved without querying DNS, see
+// [PortStack.AddHost]. Results are answered from the cache if enabled with [DNSClient.SetCache].
+// See [DNSResolver] to use the client as a [Resolver].
+func (dnsc *DNSClient) LookupNetIP(host string, cfg DNSResolveConfig) ([]netip.Addr, error) {
+	name, err := dns.NewName(host)
+	if err != nil {
+		return nil, err
+	}
+	key := dnsCacheKey(host)
+	if static := dnsc.stack.lookupHost(key); static != nil {
+		dnsc.addrs = dnsc.addrs[:0]
+		for _, addr := range static {
+			if addr.Is4() {
+				dnsc.addrs = append(dnsc.addrs, addr)
+			}
+		}
+		if len(dnsc.addrs) == 0 {
+			return nil, errDNSNoAnswer
+		}
+		return dnsc.addrs, nil
+	}
+	if e, stale := dnsc.cache.lookup(key, dnsc.stack.now()); e != nil {
+		dnsc.stack.debug("dns:cache-hit", slog.String("name", key), slog.Bool("stale", stale))
+		return dnsc.cachedResult(e, stale)
+	}
+	dnsc.cache.stale = false
+	if dnsc.state != dnsClosed {
+		// Wait for the port of a previous resolution to be released.
+		dnsc.Abort()
+		err = pollUntil(time.Second, func() (bool, error) { return dnsc.state == dnsClosed, nil })
+		if err != nil {
+			return nil, errDNSLookupBusy
+		}
+	}
+	cfg.Questions = []dns.Question{{Name: name, Type: dns.TypeA, Class: dns.ClassINET}}
+	err = dnsc.StartResolve(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer dnsc.Abort()
+	// Poll the whole retry schedule with some slack, the client times out on its own.
+	maxWait := time.Second
+	retx := dnsc.retx
+	for i := 0; i <= int(dnsc.retries); i++ {
+		maxWait += retx.Next(0)
+	}
+	var rcode dns.RCode
+	err = pollUntil(maxWait, func() (done bool, _ error) {
+		if dnsc.TimedOut() {
+			return false, errDNSTimeout
+		}
+		done, rcode = dnsc.IsDone()
+		return done, nil
+	})
+	if err == nil && rcode == dns.RCodeNameError {
+		err = errDNSNotFound
+	} else if err == nil && rcode != dns.RCodeSuccess {
+		err = errDNSBadRCode
+	}
+	if err != nil {
+		if err != errDNSNotFound {
+			// Server unreachable or failing, RFC 8767 allows answering with expired data.
+			if addrs, ok := dnsc.staleResult(key); ok {
+				return addrs, nil
+			}
+		}
+		dnsc.cacheAnswer(key, nil, err)
+		return nil, err
+	}
+	dnsc.addrs = dnsc.addrs[:0]
+	for _, ans := range dnsc.Answers() {
+		data := ans.RawData()
+		if ans.Header.Type == dns.TypeA && len(data) == 4 {
+			dnsc.addrs = append(dnsc.addrs, netip.AddrFrom4([4]byte(data)))
+		}
+	}
+	if len(dnsc.addrs) == 0 {
+		dnsc.cacheAnswer(key, nil, errDNSNoAnswer)
+		return nil, errDNSNoAnswer
+	}
+	dnsc.cacheAnswer(key, dnsc.addrs, nil)
+	return dnsc.addrs, nil
+}
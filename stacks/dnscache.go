@@ -0,0 +1,205 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/soypat/seqs/eth/dns"
+)
+
+const (
+	defaultDNSMaxTTL     = 24 * time.Hour
+	defaultDNSMaxNegTTL  = 3 * time.Hour // RFC 2308 section 5.
+	defaultDNSMaxStale   = 24 * time.Hour
+	dnsStaleRefresh      = 30 * time.Second // RFC 8767 section 4 failure recheck timer.
+	maxDNSCachedAddrs    = 4
+	sizeSOAFixedFields   = 5 * 4 // Serial, refresh, retry, expire and minimum.
+	offsetSOAMinimumFrom = 4     // Minimum is the last field of the SOA record data.
+)
+
+// DNSCacheConfig configures the cache of names resolved by [DNSClient.LookupNetIP].
+type DNSCacheConfig struct {
+	// Entries is the amount of names held in the cache. If zero caching is disabled.
+	Entries int
+	// MaxTTL caps the time answers are cached regardless of the TTL of their
+	// records. If zero 1 day is used.
+	MaxTTL time.Duration
+	// MaxNegativeTTL caps the time names found not to exist or to have no
+	// addresses are cached. Negative answers are cached for the TTL given by
+	// the SOA record of their authority section (RFC 2308) and not at all if
+	// it is absent. If zero 3 hours is used.
+	MaxNegativeTTL time.Duration
+	// ServeStale enables serving expired answers when the server does not
+	// respond or fails to resolve the name, as described by RFC 8767, so
+	// devices keep working through upstream outages. After such a failure
+	// the stale answer is served for 30 seconds before the server is queried again.
+	ServeStale bool
+	// MaxStale is the time after their expiry answers may be served stale. If zero 1 day is used.
+	MaxStale time.Duration
+}
+
+type dnsCacheEntry struct {
+	name    string
+	addrs   [maxDNSCachedAddrs]netip.Addr
+	naddrs  uint8
+	expires time.Time
+	// err is the error of negative answers, nil for positive answers.
+	err error
+	// refresh is the time until which a stale answer is served without querying
+	// the server after a failed resolution.
+	refresh time.Time
+}
+
+// dnsCache holds positive and negative answers of LookupNetIP.
+type dnsCache struct {
+	cfg     DNSCacheConfig
+	entries []dnsCacheEntry
+	// stale is set when the last lookup was answered with an expired entry.
+	stale bool
+}
+
+// SetCache enables caching of the results of [DNSClient.LookupNetIP] with
+// cfg. Cached entries are discarded.
+func (dnsc *DNSClient) SetCache(cfg DNSCacheConfig) {
+	if cfg.MaxTTL <= 0 {
+		cfg.MaxTTL = defaultDNSMaxTTL
+	}
+	if cfg.MaxNegativeTTL <= 0 {
+		cfg.MaxNegativeTTL = defaultDNSMaxNegTTL
+	}
+	if cfg.MaxStale <= 0 {
+		cfg.MaxStale = defaultDNSMaxStale
+	}
+	dnsc.cache = dnsCache{cfg: cfg, entries: make([]dnsCacheEntry, max(cfg.Entries, 0))}
+}
+
+// FlushCache discards all cached answers.
+func (dnsc *DNSClient) FlushCache() {
+	for i := range dnsc.cache.entries {
+		dnsc.cache.entries[i] = dnsCacheEntry{}
+	}
+}
+
+// ServedStale reports whether the result of the last call to
+// [DNSClient.LookupNetIP] was an expired answer. See [DNSCacheConfig.ServeStale].
+func (dnsc *DNSClient) ServedStale() bool { return dnsc.cache.stale }
+
+// dnsCacheKey returns the case insensitive cache key of host.
+func dnsCacheKey(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (c *dnsCache) find(name string) *dnsCacheEntry {
+	for i := range c.entries {
+		if c.entries[i].name == name {
+			return &c.entries[i]
+		}
+	}
+	return nil
+}
+
+// lookup returns the unexpired entry of name, or a stale one being served
+// after a recent failed resolution.
+func (c *dnsCache) lookup(name string, now time.Time) (e *dnsCacheEntry, stale bool) {
+	e = c.find(name)
+	switch {
+	case e == nil:
+		return nil, false
+	case now.Before(e.expires):
+		return e, false
+	case now.Before(e.refresh) && c.canServeStale(e, now):
+		return e, true
+	}
+	return nil, false
+}
+
+// canServeStale reports whether the expired entry e may be served after a failed resolution.
+func (c *dnsCache) canServeStale(e *dnsCacheEntry, now time.Time) bool {
+	return c.cfg.ServeStale && e.err == nil && now.Sub(e.expires) < c.cfg.MaxStale
+}
+
+// store caches the result of a resolution of name for ttl. Replaces the
+// entry with the same name or else the one expiring first.
+func (c *dnsCache) store(name string, addrs []netip.Addr, err error, ttl time.Duration, now time.Time) {
+	if len(c.entries) == 0 || ttl <= 0 {
+		return
+	}
+	e := c.find(name)
+	if e == nil {
+		e = &c.entries[0]
+		for i := range c.entries {
+			if c.entries[i].name == "" {
+				e = &c.entries[i]
+				break
+			} else if c.entries[i].expires.Before(e.expires) {
+				e = &c.entries[i]
+			}
+		}
+	}
+	*e = dnsCacheEntry{name: name, expires: now.Add(ttl), err: err}
+	e.naddrs = uint8(copy(e.addrs[:], addrs))
+}
+
+// cachedResult returns the addresses of e in dnsc's address slice.
+func (dnsc *DNSClient) cachedResult(e *dnsCacheEntry, stale bool) ([]netip.Addr, error) {
+	dnsc.cache.stale = stale
+	if e.err != nil {
+		return nil, e.err
+	}
+	dnsc.addrs = append(dnsc.addrs[:0], e.addrs[:e.naddrs]...)
+	return dnsc.addrs, nil
+}
+
+// cacheAnswer caches the outcome of the completed resolution of name: err
+// is nil if addrs were found or the error returned to the caller.
+func (dnsc *DNSClient) cacheAnswer(name string, addrs []netip.Addr, err error) {
+	c := &dnsc.cache
+	if len(c.entries) == 0 {
+		return
+	}
+	now := dnsc.stack.now()
+	if err == nil {
+		ttl := c.cfg.MaxTTL
+		for i := range dnsc.msg.Answers {
+			if rttl := time.Duration(dnsc.msg.Answers[i].Header.TTL) * time.Second; rttl < ttl {
+				ttl = rttl
+			}
+		}
+		c.store(name, addrs, nil, ttl, now)
+		return
+	}
+	// RFC 2308 section 5: Negative answers are cached for the minimum of the
+	// SOA record's TTL and its MINIMUM field.
+	for i := range dnsc.msg.Authorities {
+		soa := &dnsc.msg.Authorities[i]
+		data := soa.RawData()
+		if soa.Header.Type != dns.TypeSOA || len(data) < sizeSOAFixedFields {
+			continue
+		}
+		ttl := c.cfg.MaxNegativeTTL
+		for _, rttl := range [2]uint32{soa.Header.TTL, binary.BigEndian.Uint32(data[len(data)-offsetSOAMinimumFrom:])} {
+			if d := time.Duration(rttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+		c.store(name, nil, err, ttl, now)
+		return
+	}
+}
+
+// staleResult returns a stale answer for name after a failed resolution, if
+// serving stale answers is enabled and there is one.
+func (dnsc *DNSClient) staleResult(name string) ([]netip.Addr, bool) {
+	now := dnsc.stack.now()
+	e := dnsc.cache.find(name)
+	if e == nil || !dnsc.cache.canServeStale(e, now) {
+		return nil, false
+	}
+	e.refresh = now.Add(dnsStaleRefresh)
+	dnsc.stack.info("dns:serve-stale", slog.String("name", name))
+	addrs, _ := dnsc.cachedResult(e, true)
+	return addrs, true
+}
@@ -0,0 +1,349 @@
+package stacks_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/stacks"
+)
+
+// This file contains a small builder DSL for writing protocol tests:
+//
+//	egr.ExpectTx(t, "server SYN|ACK", expect.SYNACK().WithAck(301))
+//	err := inject.ACK(301, 501).From(clientAddr, clientMAC).To(server, 80).Into(server.PortStack())
+
+const tcpOptMSS = 2
+
+// expect is the entrypoint for building TCP segment expectations.
+var expect expector
+
+type expector struct{}
+
+func (expector) Flags(flags seqs.Flags) *segExpect { return &segExpect{flags: flags} }
+func (e expector) SYN() *segExpect                 { return e.Flags(seqs.FlagSYN) }
+func (e expector) SYNACK() *segExpect              { return e.Flags(synack) }
+func (e expector) ACK() *segExpect                 { return e.Flags(seqs.FlagACK) }
+func (e expector) PSHACK() *segExpect              { return e.Flags(pshack) }
+func (e expector) FINACK() *segExpect              { return e.Flags(finack) }
+func (e expector) RST() *segExpect                 { return e.Flags(seqs.FlagRST) }
+func (e expector) RSTACK() *segExpect              { return e.Flags(seqs.FlagRST | seqs.FlagACK) }
+
+// segExpect describes the expected contents of a TCP segment. Only fields set
+// by the With* methods are checked, flags are always checked.
+type segExpect struct {
+	flags   seqs.Flags
+	seq     seqs.Value
+	ack     seqs.Value
+	wnd     seqs.Size
+	datalen int
+	mss     uint16
+	from    int
+	has     uint8
+}
+
+const (
+	hasSeq = 1 << iota
+	hasAck
+	hasWnd
+	hasData
+	hasMSS
+	hasFrom
+)
+
+func (e *segExpect) WithSeq(seq seqs.Value) *segExpect   { e.seq = seq; e.has |= hasSeq; return e }
+func (e *segExpect) WithAck(ack seqs.Value) *segExpect   { e.ack = ack; e.has |= hasAck; return e }
+func (e *segExpect) WithWindow(wnd seqs.Size) *segExpect { e.wnd = wnd; e.has |= hasWnd; return e }
+func (e *segExpect) WithData(n int) *segExpect           { e.datalen = n; e.has |= hasData; return e }
+func (e *segExpect) WithMSS(mss uint16) *segExpect       { e.mss = mss; e.has |= hasMSS; return e }
+
+// FromStack expects the segment to be sent by the stack of index istack in the Exchanger.
+func (e *segExpect) FromStack(istack int) *segExpect { e.from = istack; e.has |= hasFrom; return e }
+
+func (e *segExpect) String() string {
+	var b strings.Builder
+	b.WriteString(e.flags.String())
+	if e.has&hasSeq != 0 {
+		fmt.Fprintf(&b, " seq=%d", e.seq)
+	}
+	if e.has&hasAck != 0 {
+		fmt.Fprintf(&b, " ack=%d", e.ack)
+	}
+	if e.has&hasWnd != 0 {
+		fmt.Fprintf(&b, " wnd=%d", e.wnd)
+	}
+	if e.has&hasData != 0 {
+		fmt.Fprintf(&b, " datalen=%d", e.datalen)
+	}
+	if e.has&hasMSS != 0 {
+		fmt.Fprintf(&b, " mss=%d", e.mss)
+	}
+	return b.String()
+}
+
+// CheckSegment checks seg against the expectation. Useful for checking
+// segments generated directly by a ControlBlock.
+func (e *segExpect) CheckSegment(t *testing.T, msg string, seg seqs.Segment) {
+	t.Helper()
+	if mismatch := e.mismatch(seg); mismatch != "" {
+		t.Errorf("%s: %s; want %s, got %+v", msg, mismatch, e, seg)
+	}
+}
+
+// CheckPacket checks a received or sent TCP packet against the expectation, including TCP options.
+func (e *segExpect) CheckPacket(t *testing.T, msg string, pkt *stacks.TCPPacket) {
+	t.Helper()
+	seg := pkt.TCP.Segment(len(pkt.Payload()))
+	mismatch := e.mismatch(seg)
+	if mismatch == "" && e.has&hasMSS != 0 {
+		mss, ok := findMSS(pkt.TCPOptions())
+		if !ok {
+			mismatch = "MSS option missing"
+		} else if mss != e.mss {
+			mismatch = fmt.Sprintf("MSS mismatch %d", mss)
+		}
+	}
+	if mismatch != "" {
+		t.Errorf("%s: %s; want %s, got %+v", msg, mismatch, e, seg)
+	}
+}
+
+// CheckFrame checks an Ethernet frame carrying a TCP segment against the expectation.
+func (e *segExpect) CheckFrame(t *testing.T, msg string, frame []byte) {
+	t.Helper()
+	pkt, err := stacks.ParseTCPPacket(frame)
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+	e.CheckPacket(t, msg, &pkt)
+}
+
+// CheckHandleEth performs a single HandleEth call on the stack and expects a
+// TCP segment matching e to be sent. The segment is returned for further checks.
+func (e *segExpect) CheckHandleEth(t *testing.T, msg string, ps *stacks.PortStack) eth.TCPHeader {
+	t.Helper()
+	var buf [defaultMTU]byte
+	n, err := ps.HandleEth(buf[:])
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	} else if n < sizeTCPNoOptions {
+		t.Fatalf("%s: wanted one TCP packet, got %d bytes", msg, n)
+	}
+	e.CheckFrame(t, msg, buf[:n])
+	thdr, _ := eth.DecodeTCPHeader(buf[eth.SizeEthernetHeader+eth.SizeIPv4Header : n])
+	return thdr
+}
+
+func (e *segExpect) mismatch(seg seqs.Segment) string {
+	switch {
+	case seg.Flags != e.flags:
+		return "flags mismatch"
+	case e.has&hasSeq != 0 && seg.SEQ != e.seq:
+		return "SEQ mismatch"
+	case e.has&hasAck != 0 && seg.ACK != e.ack:
+		return "ACK mismatch"
+	case e.has&hasWnd != 0 && seg.WND != e.wnd:
+		return "WND mismatch"
+	case e.has&hasData != 0 && int(seg.DATALEN) != e.datalen:
+		return "DATALEN mismatch"
+	}
+	return ""
+}
+
+// ExpectTx performs a single HandleTx call on the exchanger and expects exactly
+// one TCP segment to be sent which matches e.
+func (egr *Exchanger) ExpectTx(t *testing.T, msg string, e *segExpect) {
+	t.Helper()
+	nseg := len(egr.exchanges)
+	txs, n := egr.HandleTx(t)
+	totsegs := len(egr.exchanges) - nseg
+	switch {
+	case txs == 0:
+		t.Fatalf("no data sent: %s", msg)
+	case n < sizeTCPNoOptions:
+		t.Fatalf("%s: wanted one TCP packet, got short %d", msg, n)
+	case txs > 1:
+		t.Fatalf("%s: more than one tx: %d", msg, txs)
+	case totsegs != 1:
+		t.Fatalf("%s: expected one TCP segment", msg)
+	}
+	last := egr.LastExchange()
+	if e.has&hasFrom != 0 && last.who != e.from {
+		t.Fatalf("%s: expected segment from stack %d, got from %d", msg, e.from, last.who)
+	}
+	pkt, err := stacks.ParseTCPPacket(egr.getPayload(last.who))
+	if err != nil {
+		t.Fatalf("%s: %s", msg, err)
+	}
+	e.CheckPacket(t, msg, &pkt)
+}
+
+const sizeTCPNoOptions = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeTCPHeader
+
+// inject is the entrypoint for building TCP segments to be delivered to a stack.
+var inject injector
+
+type injector struct{}
+
+func (injector) Segment(seg seqs.Segment) *segInject { return &segInject{seg: seg} }
+func (i injector) SYN(seq seqs.Value) *segInject {
+	return i.Segment(seqs.Segment{SEQ: seq, Flags: seqs.FlagSYN, WND: 1024})
+}
+func (i injector) ACK(seq, ack seqs.Value) *segInject {
+	return i.Segment(seqs.Segment{SEQ: seq, ACK: ack, Flags: seqs.FlagACK, WND: 1024})
+}
+func (i injector) RST(seq seqs.Value) *segInject {
+	return i.Segment(seqs.Segment{SEQ: seq, Flags: seqs.FlagRST})
+}
+func (i injector) Flags(seq seqs.Value, flags seqs.Flags) *segInject {
+	return i.Segment(seqs.Segment{SEQ: seq, Flags: flags, WND: 1024})
+}
+
+type segInject struct {
+	seg     seqs.Segment
+	src     netip.AddrPort
+	srcMAC  [6]byte
+	dst     netip.AddrPort
+	dstMAC  [6]byte
+	payload []byte
+	options []byte
+}
+
+// From sets the source address of the injected segment.
+func (s *segInject) From(addr netip.AddrPort, mac [6]byte) *segInject {
+	s.src, s.srcMAC = addr, mac
+	return s
+}
+
+// To sets the destination of the injected segment to the stack's address.
+func (s *segInject) To(ps *stacks.PortStack, port uint16) *segInject {
+	s.dst, s.dstMAC = netip.AddrPortFrom(ps.Addr(), port), ps.HardwareAddr6()
+	return s
+}
+
+// ToAddr sets the destination of the injected segment to addr, i.e: one of the stack's aliases.
+func (s *segInject) ToAddr(addr netip.AddrPort, mac [6]byte) *segInject {
+	s.dst, s.dstMAC = addr, mac
+	return s
+}
+
+func (s *segInject) WithWindow(wnd seqs.Size) *segInject { s.seg.WND = wnd; return s }
+func (s *segInject) WithData(data []byte) *segInject {
+	s.payload = data
+	s.seg.DATALEN = seqs.Size(len(data))
+	return s
+}
+func (s *segInject) WithMSS(mss uint16) *segInject {
+	s.options = append(s.options, tcpOptMSS, 4, byte(mss>>8), byte(mss))
+	return s
+}
+
+// Frame marshals the injected segment into an ethernet frame.
+func (s *segInject) Frame() []byte {
+	for len(s.options)%4 != 0 {
+		s.options = append(s.options, 0) // End of option list padding.
+	}
+	ehdr := eth.EthernetHeader{
+		Destination:     s.dstMAC,
+		Source:          s.srcMAC,
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	ihdr := eth.IPv4Header{
+		VersionAndIHL: 4<<4 | 5,
+		TotalLength:   uint16(eth.SizeIPv4Header + eth.SizeTCPHeader + len(s.options) + len(s.payload)),
+		TTL:           64,
+		Protocol:      6,
+		Source:        s.src.Addr().As4(),
+		Destination:   s.dst.Addr().As4(),
+	}
+	ihdr.Checksum = ihdr.CalculateChecksum()
+	thdr := eth.TCPHeader{
+		SourcePort:      s.src.Port(),
+		DestinationPort: s.dst.Port(),
+		Seq:             s.seg.SEQ,
+		Ack:             s.seg.ACK,
+		WindowSizeRaw:   uint16(s.seg.WND),
+	}
+	thdr.SetFlags(s.seg.Flags)
+	thdr.SetOffset(uint8(5 + len(s.options)/4))
+	thdr.Checksum = thdr.CalculateChecksumIPv4(&ihdr, s.options, s.payload)
+
+	frame := make([]byte, eth.SizeEthernetHeader+int(ihdr.TotalLength))
+	ehdr.Put(frame)
+	ihdr.Put(frame[eth.SizeEthernetHeader:])
+	thdr.Put(frame[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	n := copy(frame[sizeTCPNoOptions:], s.options)
+	copy(frame[sizeTCPNoOptions+n:], s.payload)
+	return frame
+}
+
+// Into delivers the injected segment to the stack.
+func (s *segInject) Into(ps *stacks.PortStack) error {
+	return ps.RecvEth(s.Frame())
+}
+
+func findMSS(options []byte) (uint16, bool) {
+	for len(options) > 0 {
+		kind := options[0]
+		switch {
+		case kind == 0: // End of option list.
+			return 0, false
+		case kind == 1: // No-operation.
+			options = options[1:]
+			continue
+		case len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options):
+			return 0, false
+		case kind == tcpOptMSS && options[1] == 4:
+			return binary.BigEndian.Uint16(options[2:4]), true
+		}
+		options = options[options[1]:]
+	}
+	return 0, false
+}
+
+func TestDSLInjectExpect(t *testing.T) {
+	const serverPort = 80
+	Stacks := createPortStacks(t, 2, defaultMTU)
+	clientStack, serverStack := Stacks[0], Stacks[1]
+	server, err := stacks.NewTCPConn(serverStack, stacks.TCPConnConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.OpenListenTCP(serverPort, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientAddr := netip.AddrPortFrom(clientStack.Addr(), 1025)
+	err = inject.SYN(100).WithMSS(1460).From(clientAddr, clientStack.HardwareAddr6()).To(serverStack, serverPort).Into(serverStack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	egr := NewExchanger(clientStack, serverStack)
+	egr.ExpectTx(t, "server answers injected SYN", expect.SYNACK().WithSeq(500).WithAck(101).FromStack(1))
+	err = inject.ACK(101, 501).From(clientAddr, clientStack.HardwareAddr6()).To(serverStack, serverPort).Into(serverStack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.State() != seqs.StateEstablished {
+		t.Fatalf("server not established: %s", server.State())
+	}
+	err = inject.ACK(101, 501).WithData([]byte("hello")).From(clientAddr, clientStack.HardwareAddr6()).To(serverStack, serverPort).Into(serverStack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, ok := server.SCB().PendingSegment(0)
+	if !ok {
+		t.Fatal("expected pending ACK in control block")
+	}
+	expect.ACK().WithSeq(501).WithAck(106).CheckSegment(t, "control block ACK of data", seg)
+	// Packets with options are parsed back correctly.
+	pkt, err := stacks.ParseTCPPacket(inject.SYN(1).WithMSS(536).From(clientAddr, [6]byte{}).To(serverStack, 1).Frame())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect.SYN().WithSeq(1).WithMSS(536).CheckPacket(t, "parsed injected SYN", &pkt)
+}
@@ -0,0 +1,37 @@
+package stacks
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"log/slog"
+)
+
+// SetEntropy sets the source of randomness used for TCP initial sequence
+// numbers, DNS and DHCP transaction IDs, ICMP echo identifiers and IPv4
+// identifications, i.e: a
+// hardware TRNG on microcontrollers. A nil reader selects crypto/rand.
+// If the source fails a pseudo random generator seeded with the clock is used.
+func (ps *PortStack) SetEntropy(r io.Reader) {
+	if r == nil {
+		r = rand.Reader
+	}
+	ps.entropy = r
+}
+
+// rand32 returns 32 random bits read from the stack's entropy source.
+func (ps *PortStack) rand32() uint32 {
+	var buf [4]byte
+	_, err := io.ReadFull(ps.entropy, buf[:])
+	if err == nil {
+		return binary.LittleEndian.Uint32(buf[:])
+	}
+	if ps.isLogEnabled(slog.LevelError) {
+		ps.error("Stack:entropy", slog.String("err", err.Error()))
+	}
+	ps.prandState = prand32(ps.prandState ^ uint32(ps.now().UnixNano()) | 1)
+	return ps.prandState
+}
+
+// rand16 returns 16 random bits read from the stack's entropy source.
+func (ps *PortStack) rand16() uint16 { return uint16(ps.rand32()) }
@@ -0,0 +1,132 @@
+package stacks_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/stacks"
+)
+
+// This example runs a TLS connection from crypto/tls over TCP connections
+// between two stacks attached to each other, serviced in the background as a
+// NIC driver loop would. TCPConn implements net.Conn so it is passed as is.
+func ExampleTCPConn_tls() {
+	const mtu = 1500
+	newStack := func(mac byte, addr [4]byte) *stacks.PortStack {
+		stack := stacks.NewPortStack(stacks.PortStackConfig{
+			MAC:             [6]byte{0x02, 0, 0, 0, 0, mac},
+			MaxOpenPortsTCP: 1,
+			MTU:             mtu,
+		})
+		stack.SetAddr(netip.AddrFrom4(addr))
+		return stack
+	}
+	cstack := newStack(1, [4]byte{192, 168, 1, 2})
+	sstack := newStack(2, [4]byte{192, 168, 1, 1})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		buf := make([]byte, mtu)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, link := range [2][2]*stacks.PortStack{{cstack, sstack}, {sstack, cstack}} {
+				if n, _ := link[0].HandleEth(buf); n > 0 {
+					link[1].RecvEth(buf[:n])
+				}
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	cert, roots, err := selfSignedCert("stack.local")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	cfg := stacks.TCPConnConfig{TxBufSize: 4096, RxBufSize: 4096}
+	server, err := stacks.NewTCPConn(sstack, cfg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = server.OpenListenTCP(443, 0x1000)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	go func() {
+		for server.State() != seqs.StateEstablished {
+			time.Sleep(time.Millisecond)
+		}
+		conn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil {
+			_, err = conn.Write([]byte("hello " + line))
+		}
+		if err != nil {
+			fmt.Println("server:", err)
+		}
+	}()
+
+	client, err := stacks.DialTCP(cstack, cfg, netip.AddrPortFrom(sstack.Addr(), 443), 5*time.Second)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	conn := tls.Client(client, &tls.Config{ServerName: "stack.local", RootCAs: roots})
+	_, err = conn.Write([]byte("TLS\n"))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Print(reply)
+	// Output:
+	// hello TLS
+}
+
+// selfSignedCert returns a certificate for host and a pool trusting it.
+func selfSignedCert(host string) (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots, nil
+}
@@ -0,0 +1,445 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/eth"
+)
+
+const (
+	connStateVersion    = 2
+	sizeConnStateTS     = 4 + 4 + 4 + 4
+	sizeConnStateHeader = 1 + 2 + 4 + 4 + 2 + 6 + 2 + sizeConnStateTS + seqs.SizeControlState + 2 + 2
+
+	defaultFailoverConns  = 4
+	failoverMsgVersion    = 1
+	sizeFailoverHeader    = 1 + 4
+	sizeFailoverRecordHdr = 1 + 2
+	failoverRecordState   = 1
+	failoverRecordForget  = 2
+	sizeFailoverForget    = 2 + 4 + 2
+)
+
+var (
+	errConnStateClosed    = errors.New("connection state: connection not synchronized")
+	errConnStateMalformed = errors.New("connection state: malformed")
+	errConnStateBusy      = errors.New("connection state: socket in use")
+	errConnStateBufSize   = errors.New("connection state: socket buffers too small")
+	errFailoverPeer       = errors.New("failover: peer address must be IPv4")
+	errFailoverFull       = errors.New("failover: send queue full")
+	errFailoverUnknown    = errors.New("failover: no state received for connection")
+)
+
+// AppendState appends the state of the connection to dst so that it may be
+// resumed on a standby device with [TCPConn.ImportState], i.e: sent by a
+// [FailoverSync]. The state includes the data received and not yet read and
+// the data written and not yet acknowledged, and the timestamps exchanged if
+// negotiated so the resumed connection is not rejected by the remote as
+// sending old duplicates. Only synchronized connections may be exported.
+func (sock *TCPConn) AppendState(dst []byte) ([]byte, error) {
+	state := sock.State()
+	if sock.localPort == 0 || !state.IsSynchronized() || sock.aborting {
+		return dst, errConnStateClosed
+	}
+	remote := sock.remote.Addr().As4()
+	dst = append(dst, connStateVersion)
+	dst = binary.BigEndian.AppendUint16(dst, sock.localPort)
+	dst = append(dst, sock.localIP[:]...)
+	dst = append(dst, remote[:]...)
+	dst = binary.BigEndian.AppendUint16(dst, sock.remote.Port())
+	dst = append(dst, sock.remoteMAC[:]...)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(sock.retx.unacked))
+	dst = sock.appendTimestampsState(dst)
+	dst = sock.scb.AppendState(dst)
+	dst = appendRing(dst, &sock.rx)
+	return appendRing(dst, &sock.tx), nil
+}
+
+// ImportState resumes on the closed socket sock a connection exported with
+// [TCPConn.AppendState], opening its local port on sock's stack. The stack
+// must have taken over the address of the exporting device. Data written and
+// not acknowledged is retransmitted after a retransmission timeout.
+//
+// The receive buffer of sock must hold the data received and not yet read
+// and the window advertised to the remote, and its transmit buffer the data
+// not yet acknowledged.
+func (sock *TCPConn) ImportState(b []byte) error {
+	if sock.localPort != 0 || !sock.State().IsClosed() {
+		return errConnStateBusy
+	} else if len(b) < sizeConnStateHeader || b[0] != connStateVersion {
+		return errConnStateMalformed
+	}
+	var cs seqs.ControlBlock
+	const tsOff = 1 + 2 + 4 + 4 + 2 + 6 + 2
+	const scbOff = tsOff + sizeConnStateTS
+	err := cs.SetState(b[scbOff:])
+	if err != nil {
+		return err
+	}
+	rxdata, rest, ok := splitRing(b[scbOff+seqs.SizeControlState:])
+	txdata, _, ok2 := splitRing(rest)
+	unacked := int(binary.BigEndian.Uint16(b[tsOff-2:]))
+	switch {
+	case !ok || !ok2 || unacked > len(txdata) || !cs.State().IsSynchronized():
+		return errConnStateMalformed
+	case len(sock.rx.buf) < len(rxdata)+int(cs.RecvWindow()) || len(sock.tx.buf) < len(txdata):
+		return errConnStateBufSize
+	}
+	localPort := binary.BigEndian.Uint16(b[1:])
+	err = sock.stack.OpenTCP(localPort, sock)
+	if err != nil {
+		return err
+	}
+	now := sock.stack.now()
+	sock.scb = cs
+	sock.scb.SetLogger(sock.stack.logger)
+	sock.localPort = localPort
+	sock.localIP = [4]byte(b[3:7])
+	sock.remote = netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[7:11])), binary.BigEndian.Uint16(b[11:]))
+	sock.remoteMAC = [6]byte(b[13:19])
+	sock.opened = now
+	sock.lastRx = now
+	sock.lastTx = now
+	sock.connect = tcpConnect{}
+	sock.pathMTU = 0
+	sock.closing = false
+	sock.abortErr = nil
+	sock.rx.Reset()
+	sock.tx.Reset()
+	sock.rx.Write(rxdata)
+	sock.tx.Write(txdata)
+	sock.retx.reset()
+	sock.retx.unacked = unacked
+	if unacked > 0 {
+		sock.retx.timer = now
+	}
+	sock.importTimestampsState(b[tsOff:scbOff], now)
+	sock.connid++
+	sock.info("TCPConn.ImportState", slog.Uint64("lport", uint64(localPort)), slog.String("state", cs.State().String()))
+	if sock.isPendingHandling() {
+		sock.stack.RequestSendTCP(localPort)
+	}
+	return nil
+}
+
+// appendTimestampsState appends the timestamps state of the connection to dst:
+// the current timestamp clock, TS.Recent with its age in milliseconds and
+// Last.ACK.sent. The clock is exported rather than its offset so that the
+// importing device, whose clock may differ, keeps timestamps monotonic.
+func (sock *TCPConn) appendTimestampsState(dst []byte) []byte {
+	now := sock.stack.now()
+	st := &sock.ts
+	age := uint32(math.MaxUint32) // TS.Recent not set.
+	if !st.recentAt.IsZero() {
+		age = math.MaxUint32 - 1
+		if ms := now.Sub(st.recentAt).Milliseconds(); ms < int64(age) {
+			age = uint32(ms)
+		}
+	}
+	dst = binary.BigEndian.AppendUint32(dst, sock.tsClock(now))
+	dst = binary.BigEndian.AppendUint32(dst, st.recent)
+	dst = binary.BigEndian.AppendUint32(dst, age)
+	return binary.BigEndian.AppendUint32(dst, uint32(st.lastACK))
+}
+
+// importTimestampsState sets the timestamps state written by appendTimestampsState at now.
+func (sock *TCPConn) importTimestampsState(b []byte, now time.Time) {
+	sock.ts = tcpTimestamps{
+		offset:  binary.BigEndian.Uint32(b) - uint32(now.UnixMilli()),
+		recent:  binary.BigEndian.Uint32(b[4:]),
+		lastACK: seqs.Value(binary.BigEndian.Uint32(b[12:])),
+	}
+	if age := binary.BigEndian.Uint32(b[8:]); age != math.MaxUint32 {
+		sock.ts.recentAt = now.Add(-time.Duration(age) * time.Millisecond)
+	}
+}
+
+// appendRing appends the data buffered in r to dst preceded by its length.
+func appendRing(dst []byte, r *ring) []byte {
+	n := r.Buffered()
+	dst = binary.BigEndian.AppendUint16(dst, uint16(n))
+	start := len(dst)
+	dst = append(dst, make([]byte, n)...)
+	r.peek(dst[start:], 0)
+	return dst
+}
+
+// splitRing splits the length prefixed data written by appendRing from b.
+func splitRing(b []byte) (data, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
+
+// FailoverSyncConfig configures a [FailoverSync].
+type FailoverSyncConfig struct {
+	// Peer is the address of the peer device connection states are
+	// exchanged with. The peer must use the same port.
+	Peer netip.AddrPort
+	// PeerHWAddr is the hardware address of the peer. If zero it is resolved with ARP.
+	PeerHWAddr [6]byte
+	// LocalPort is the port connection states are sent and received on.
+	LocalPort uint16
+	// MaxConns is the amount of connection states received from the peer
+	// held for takeover. States of further connections are dropped. If zero 4 is used.
+	MaxConns int
+}
+
+// FailoverConn identifies a connection whose state was received from the peer.
+type FailoverConn struct {
+	LocalPort uint16
+	Local     netip.Addr
+	Remote    netip.AddrPort
+}
+
+// failoverState is a connection state received from the peer.
+type failoverState struct {
+	conn FailoverConn
+	data []byte
+}
+
+// FailoverSync is the skeleton of a protocol synchronizing TCP connection
+// state between two devices, i.e: gateways in a warm standby pair. The active
+// device sends the state of its connections with [FailoverSync.Sync] as they
+// change and [FailoverSync.Forget] once they are closed. The standby device
+// holds the latest state of each connection and resumes them with
+// [FailoverSync.Takeover] once it takes over the active's address.
+//
+// States are sent over UDP without acknowledgement, so connections resumed
+// may be behind the remote and be reset by it. Each state must fit in a
+// single datagram, which bounds the data buffered by synchronized connections.
+type FailoverSync struct {
+	stack  *PortStack
+	pkt    UDPPacket
+	cfg    FailoverSyncConfig
+	hw     [6]byte
+	states []failoverState
+	// out holds the records queued to be sent to the peer.
+	out     []byte
+	seq     uint32
+	lastRx  uint32
+	rxSeen  bool
+	dropped uint32
+	started bool
+}
+
+// NewFailoverSync creates a connection state synchronizer for stack.
+func NewFailoverSync(stack *PortStack, cfg FailoverSyncConfig) (*FailoverSync, error) {
+	if !cfg.Peer.Addr().Is4() {
+		return nil, errFailoverPeer
+	} else if cfg.LocalPort == 0 || cfg.Peer.Port() == 0 {
+		return nil, errZeroPort
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = defaultFailoverConns
+	}
+	size := int(stack.mtu) - eth.SizeEthernetHeader - eth.SizeIPv4Header - eth.SizeUDPHeader - sizeFailoverHeader
+	buf := make([]byte, (cfg.MaxConns+1)*size)
+	fs := &FailoverSync{
+		stack:  stack,
+		cfg:    cfg,
+		hw:     cfg.PeerHWAddr,
+		states: make([]failoverState, cfg.MaxConns),
+		out:    buf[:0:size],
+	}
+	for i := range fs.states {
+		off := (i + 1) * size
+		fs.states[i].data = buf[off : off : off+size]
+	}
+	return fs, nil
+}
+
+// Start opens the synchronizer's port.
+func (fs *FailoverSync) Start() error {
+	err := fs.stack.OpenUDP(fs.cfg.LocalPort, fs)
+	if err != nil {
+		return err
+	}
+	fs.started = true
+	fs.stack.info("FAILOVER:start", fs.stack.addrPortAttr("peer", fs.cfg.Peer.Addr().As4(), fs.cfg.Peer.Port()))
+	return nil
+}
+
+// Stop closes the synchronizer's port. Queued records are discarded and
+// states received from the peer are kept.
+func (fs *FailoverSync) Stop() error {
+	fs.abort()
+	return fs.stack.CloseUDP(fs.cfg.LocalPort)
+}
+
+// Sync queues the current state of sock to be sent to the peer.
+func (fs *FailoverSync) Sync(sock *TCPConn) error {
+	size := sizeConnStateHeader + sock.rx.Buffered() + sock.tx.Buffered()
+	if cap(fs.out)-len(fs.out) < sizeFailoverRecordHdr+size {
+		fs.dropped++
+		return errFailoverFull
+	}
+	out, err := sock.AppendState(binary.BigEndian.AppendUint16(append(fs.out, failoverRecordState), uint16(size)))
+	if err != nil {
+		return err
+	}
+	fs.out = out
+	fs.stack.RequestSendUDP(fs.cfg.LocalPort)
+	return nil
+}
+
+// Forget queues a notice to the peer that sock's connection was closed and
+// its state must be discarded. It must be called before sock is closed.
+func (fs *FailoverSync) Forget(sock *TCPConn) error {
+	if cap(fs.out)-len(fs.out) < sizeFailoverRecordHdr+sizeFailoverForget {
+		return errFailoverFull
+	}
+	remote := sock.remote.Addr().As4()
+	fs.out = append(fs.out, failoverRecordForget)
+	fs.out = binary.BigEndian.AppendUint16(fs.out, sizeFailoverForget)
+	fs.out = binary.BigEndian.AppendUint16(fs.out, sock.localPort)
+	fs.out = append(fs.out, remote[:]...)
+	fs.out = binary.BigEndian.AppendUint16(fs.out, sock.remote.Port())
+	fs.stack.RequestSendUDP(fs.cfg.LocalPort)
+	return nil
+}
+
+// AppendConns appends the connections whose state was received from the peer to dst.
+func (fs *FailoverSync) AppendConns(dst []FailoverConn) []FailoverConn {
+	for i := range fs.states {
+		if fs.states[i].conn.LocalPort != 0 {
+			dst = append(dst, fs.states[i].conn)
+		}
+	}
+	return dst
+}
+
+// Takeover resumes conn on the closed socket sock with the latest state
+// received from the peer. See [TCPConn.ImportState].
+func (fs *FailoverSync) Takeover(sock *TCPConn, conn FailoverConn) error {
+	st := fs.lookup(conn.LocalPort, conn.Remote)
+	if st == nil {
+		return errFailoverUnknown
+	}
+	err := sock.ImportState(st.data)
+	if err != nil {
+		return err
+	}
+	st.conn = FailoverConn{}
+	return nil
+}
+
+// Dropped returns the amount of states not sent or held for lack of space.
+func (fs *FailoverSync) Dropped() uint32 { return fs.dropped }
+
+func (fs *FailoverSync) lookup(localPort uint16, remote netip.AddrPort) *failoverState {
+	for i := range fs.states {
+		c := &fs.states[i].conn
+		if c.LocalPort == localPort && c.Remote == remote {
+			return &fs.states[i]
+		}
+	}
+	return nil
+}
+
+func (fs *FailoverSync) send(dst []byte) (int, error) {
+	const payloadOffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+	if !fs.started {
+		return 0, io.EOF
+	} else if len(fs.out) == 0 {
+		return 0, nil
+	}
+	peer := fs.cfg.Peer.Addr().As4()
+	if fs.hw == [6]byte{} {
+		hw, err := fs.stack.arpClient.resolve(peer)
+		if err == errARPResponsePending {
+			return 0, ErrFlagPending
+		} else if err != nil {
+			fs.stack.error("FAILOVER:drop-unresolved", slog.Int("bytes", len(fs.out)))
+			fs.dropped++
+			fs.out = fs.out[:0]
+			return 0, nil
+		}
+		fs.hw = hw
+	}
+	if len(dst) < payloadOffset+sizeFailoverHeader+len(fs.out) {
+		return 0, io.ErrShortBuffer
+	}
+	payload := append(dst[payloadOffset:payloadOffset], failoverMsgVersion)
+	payload = binary.BigEndian.AppendUint32(payload, fs.seq)
+	payload = append(payload, fs.out...)
+	fs.seq++
+	fs.out = fs.out[:0]
+	const ipv4ToS = 0
+	fs.stack.setUDP(&fs.pkt, fs.hw, fs.stack.ip, peer, ipv4ToS, payload, fs.cfg.LocalPort, fs.cfg.Peer.Port())
+	fs.pkt.PutHeaders(dst)
+	fs.stack.debug("FAILOVER:send", slog.Int("plen", len(payload)), slog.Uint64("seq", uint64(fs.seq-1)))
+	return payloadOffset + len(payload), nil
+}
+
+func (fs *FailoverSync) recv(pkt *UDPPacket) error {
+	if !fs.started {
+		return io.EOF
+	}
+	payload := pkt.Payload()
+	if pkt.IP.Source != fs.cfg.Peer.Addr().As4() || pkt.UDP.SourcePort != fs.cfg.Peer.Port() ||
+		len(payload) < sizeFailoverHeader || payload[0] != failoverMsgVersion {
+		return nil
+	}
+	seq := binary.BigEndian.Uint32(payload[1:])
+	if fs.rxSeen && int32(seq-fs.lastRx) <= 0 {
+		fs.stack.debug("FAILOVER:old", slog.Uint64("seq", uint64(seq)))
+		return nil // Duplicate or reordered message holding older states.
+	}
+	fs.rxSeen, fs.lastRx = true, seq
+	for b := payload[sizeFailoverHeader:]; len(b) >= sizeFailoverRecordHdr; {
+		kind, n := b[0], int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < sizeFailoverRecordHdr+n {
+			break
+		}
+		fs.recvRecord(kind, b[sizeFailoverRecordHdr:sizeFailoverRecordHdr+n])
+		b = b[sizeFailoverRecordHdr+n:]
+	}
+	return nil
+}
+
+// recvRecord stores or discards the state of a connection as the peer requested.
+func (fs *FailoverSync) recvRecord(kind uint8, rec []byte) {
+	switch {
+	case kind == failoverRecordState && len(rec) >= sizeConnStateHeader && rec[0] == connStateVersion:
+		conn := FailoverConn{
+			LocalPort: binary.BigEndian.Uint16(rec[1:]),
+			Local:     netip.AddrFrom4([4]byte(rec[3:7])),
+			Remote:    netip.AddrPortFrom(netip.AddrFrom4([4]byte(rec[7:11])), binary.BigEndian.Uint16(rec[11:])),
+		}
+		st := fs.lookup(conn.LocalPort, conn.Remote)
+		if st == nil {
+			st = fs.lookup(0, netip.AddrPort{})
+		}
+		if st == nil || len(rec) > cap(st.data) {
+			fs.dropped++
+			return
+		}
+		st.conn = conn
+		st.data = append(st.data[:0], rec...)
+	case kind == failoverRecordForget && len(rec) >= sizeFailoverForget:
+		remote := netip.AddrPortFrom(netip.AddrFrom4([4]byte(rec[2:6])), binary.BigEndian.Uint16(rec[6:]))
+		if st := fs.lookup(binary.BigEndian.Uint16(rec), remote); st != nil {
+			st.conn = FailoverConn{}
+		}
+	}
+}
+
+func (fs *FailoverSync) isPendingHandling() bool { return fs.started && len(fs.out) > 0 }
+
+func (fs *FailoverSync) abort() {
+	fs.started = false
+	fs.out = fs.out[:0]
+}
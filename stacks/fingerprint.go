@@ -0,0 +1,91 @@
+package stacks
+
+import (
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/eth"
+)
+
+// ipFlagDontFragment is the IPv4 DF flag.
+const ipFlagDontFragment eth.IPFlags = 0x4000
+
+// IPIDMode selects how the identification field of outgoing IPv4 packets is generated.
+type IPIDMode uint8
+
+const (
+	// IPIDRandom draws the identification of every packet from the stack's
+	// entropy source so that off-path attackers cannot predict it.
+	IPIDRandom IPIDMode = iota
+	// IPIDIncrement uses a stack-wide counter incremented on every packet.
+	IPIDIncrement
+	// IPIDZero always sets the identification to zero. Usually paired with DontFragment.
+	IPIDZero
+)
+
+// Fingerprint groups the stack behaviors observed by remote OS fingerprinting
+// tools such as nmap. It applies to TCP segments, stack generated RSTs and ICMP replies.
+// SYN segments carry the MSS and window scale options in a fixed order.
+type Fingerprint struct {
+	// TTL of outgoing IPv4 packets. If zero a TTL of 64 is used.
+	TTL uint8
+	// IPID selects how the IPv4 identification field is generated.
+	IPID IPIDMode
+	// DontFragment sets the DF flag on outgoing packets.
+	DontFragment bool
+	// InitialWindow limits the window advertised in SYN segments. The
+	// advertised window never exceeds the connection's receive buffer free space.
+	// A value of zero means no limit.
+	InitialWindow uint16
+}
+
+// FingerprintDefault returns the profile of the native behavior of the stack.
+func FingerprintDefault() Fingerprint { return Fingerprint{TTL: 64} }
+
+// FingerprintLinux returns a profile resembling a modern Linux host.
+func FingerprintLinux() Fingerprint {
+	return Fingerprint{TTL: 64, IPID: IPIDZero, DontFragment: true, InitialWindow: 64240}
+}
+
+// FingerprintWindows returns a profile resembling a modern Windows host.
+func FingerprintWindows() Fingerprint {
+	return Fingerprint{TTL: 128, IPID: IPIDIncrement, DontFragment: true, InitialWindow: 64240}
+}
+
+// SetFingerprint sets the fingerprint profile used for outgoing packets.
+func (ps *PortStack) SetFingerprint(fp Fingerprint) { ps.fingerprint = fp }
+
+// Fingerprint returns the fingerprint profile used for outgoing packets.
+func (ps *PortStack) Fingerprint() Fingerprint { return ps.fingerprint }
+
+// applyFingerprint overwrites the fields of ip covered by the fingerprint
+// profile and recalculates the IP checksum. Transport checksums are not
+// affected since none of the fields are part of the pseudo-header.
+func (ps *PortStack) applyFingerprint(ip *eth.IPv4Header) {
+	fp := &ps.fingerprint
+	ip.TTL = fp.TTL
+	if ip.TTL == 0 {
+		ip.TTL = 64
+	}
+	switch fp.IPID {
+	case IPIDRandom:
+		ip.ID = ps.rand16()
+	case IPIDIncrement:
+		ps.ipid++
+		ip.ID = ps.ipid
+	case IPIDZero:
+		ip.ID = 0
+	}
+	if fp.DontFragment {
+		ip.Flags |= ipFlagDontFragment
+	} else {
+		ip.Flags &^= ipFlagDontFragment
+	}
+	ip.Checksum = ip.CalculateChecksum()
+}
+
+// synWindow returns the window to advertise in a segment with flags sent with wnd free receive space.
+func (fp *Fingerprint) synWindow(flags seqs.Flags, wnd seqs.Size) seqs.Size {
+	if fp.InitialWindow != 0 && flags.HasAny(seqs.FlagSYN) && wnd > seqs.Size(fp.InitialWindow) {
+		return seqs.Size(fp.InitialWindow)
+	}
+	return wnd
+}
@@ -0,0 +1,289 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+const (
+	// FlowCollectorPort is the IANA assigned port of IPFIX collectors.
+	FlowCollectorPort = 4739
+	defaultFlowQueue  = 8
+
+	ipfixVersion         = 10
+	ipfixSetTemplate     = 2
+	ipfixTemplateID      = 256
+	sizeIPFIXHeader      = 16
+	sizeIPFIXSetHeader   = 4
+	sizeIPFIXDataRecord  = 4 + 4 + 2 + 2 + 1 + 8 + 8 + 8 + 8
+	sizeIPFIXTemplateSet = sizeIPFIXSetHeader + 4 + 4*len(ipfixTemplateFields)
+)
+
+// ipfixTemplateFields are the information element IDs and lengths of the data
+// records sent, as registered in the IANA IPFIX information elements registry.
+var ipfixTemplateFields = [...][2]uint16{
+	{8, 4},   // sourceIPv4Address
+	{12, 4},  // destinationIPv4Address
+	{7, 2},   // sourceTransportPort
+	{11, 2},  // destinationTransportPort
+	{4, 1},   // protocolIdentifier
+	{1, 8},   // octetDeltaCount
+	{2, 8},   // packetDeltaCount
+	{152, 8}, // flowStartMilliseconds
+	{153, 8}, // flowEndMilliseconds
+}
+
+var errFlowCollector = errors.New("flow collector address must be IPv4")
+
+// FlowRecord holds the accounting of a flow: the packets exchanged over a
+// TCP connection or a connected UDP socket during its lifetime.
+type FlowRecord struct {
+	// Proto is the IP protocol number: 6 for TCP, 17 for UDP and 136 for UDP-Lite.
+	Proto  uint8
+	Local  netip.AddrPort
+	Remote netip.AddrPort
+	// Start is when the connection was opened or the socket connected. End is when it was closed.
+	Start, End time.Time
+	// PacketsIn and PacketsOut count received and sent packets. BytesIn and
+	// BytesOut count their IP octets, IP header included.
+	PacketsIn, PacketsOut uint64
+	BytesIn, BytesOut     uint64
+}
+
+// flowCount accumulates the counters of a [FlowRecord].
+type flowCount struct {
+	start             time.Time
+	pktsIn, pktsOut   uint64
+	bytesIn, bytesOut uint64
+}
+
+func (fc *flowCount) onrecv(iplen int) {
+	fc.pktsIn++
+	fc.bytesIn += uint64(iplen)
+}
+
+func (fc *flowCount) onsend(iplen int) {
+	fc.pktsOut++
+	fc.bytesOut += uint64(iplen)
+}
+
+// endFlow hands the accounting of a finished flow to the stack's flow exporter
+// if any and resets the counters. Flows of IPv6 remotes are not exported since
+// the exporter's template only describes IPv4 flows.
+func (ps *PortStack) endFlow(fc *flowCount, proto uint8, local [4]byte, localPort uint16, remote netip.AddrPort) {
+	if ps.flows != nil && remote.Addr().Is4() && fc.pktsIn+fc.pktsOut > 0 {
+		ps.flows.queue(FlowRecord{
+			Proto:      proto,
+			Local:      netip.AddrPortFrom(netip.AddrFrom4(local), localPort),
+			Remote:     remote,
+			Start:      fc.start,
+			End:        ps.now(),
+			PacketsIn:  fc.pktsIn,
+			PacketsOut: fc.pktsOut,
+			BytesIn:    fc.bytesIn,
+			BytesOut:   fc.bytesOut,
+		})
+	}
+	*fc = flowCount{}
+}
+
+// FlowExporterConfig configures the collector and record queue of a [FlowExporter].
+type FlowExporterConfig struct {
+	// Collector is the address of the IPFIX collector records are sent to,
+	// usually on port [FlowCollectorPort].
+	Collector netip.AddrPort
+	// CollectorHWAddr is the hardware address of the collector or the gateway
+	// to reach it. If zero it is resolved with ARP.
+	CollectorHWAddr [6]byte
+	// LocalPort is the port records are sent from.
+	LocalPort uint16
+	// ObservationDomain identifies the device to the collector.
+	ObservationDomain uint32
+	// QueueLen is the amount of records held while waiting to be sent.
+	// Records of flows ending while the queue is full are dropped. If zero 8 is used.
+	QueueLen int
+}
+
+// FlowExporter sends the accounting of TCP connections and connected UDP
+// sockets of a [PortStack] to a collector as they are closed, so traffic can
+// be accounted for without mirroring it. Records are sent as IPFIX (RFC 7011)
+// messages over UDP. Each flow is exported as one data record per direction
+// with packets, and every message includes the template describing them since
+// UDP collectors may miss or expire templates.
+type FlowExporter struct {
+	stack   *PortStack
+	pkt     UDPPacket
+	cfg     FlowExporterConfig
+	records []FlowRecord
+	// n is the amount of records queued.
+	n       int
+	seq     uint32
+	dropped uint32
+	hw      [6]byte
+}
+
+// NewFlowExporter creates a flow exporter for stack. Flows are accounted from
+// the moment [FlowExporter.Start] is called.
+func NewFlowExporter(stack *PortStack, cfg FlowExporterConfig) (*FlowExporter, error) {
+	if !cfg.Collector.Addr().Is4() {
+		return nil, errFlowCollector
+	} else if cfg.LocalPort == 0 || cfg.Collector.Port() == 0 {
+		return nil, errZeroPort
+	}
+	if cfg.QueueLen <= 0 {
+		cfg.QueueLen = defaultFlowQueue
+	}
+	return &FlowExporter{
+		stack:   stack,
+		cfg:     cfg,
+		records: make([]FlowRecord, cfg.QueueLen),
+		hw:      cfg.CollectorHWAddr,
+	}, nil
+}
+
+// Start opens the exporter's port and begins exporting flows ending afterwards.
+func (fe *FlowExporter) Start() error {
+	err := fe.stack.OpenUDP(fe.cfg.LocalPort, fe)
+	if err != nil {
+		return err
+	}
+	fe.stack.flows = fe
+	fe.stack.info("FLOW:start", fe.stack.addrPortAttr("collector", fe.cfg.Collector.Addr().As4(), fe.cfg.Collector.Port()))
+	return nil
+}
+
+// Stop stops exporting flows and closes the exporter's port. Queued records are discarded.
+func (fe *FlowExporter) Stop() error {
+	fe.abort()
+	return fe.stack.CloseUDP(fe.cfg.LocalPort)
+}
+
+// Dropped returns the amount of records dropped due to the queue being full.
+func (fe *FlowExporter) Dropped() uint32 { return fe.dropped }
+
+// Queued returns the amount of records waiting to be sent.
+func (fe *FlowExporter) Queued() int { return fe.n }
+
+func (fe *FlowExporter) queue(rec FlowRecord) {
+	if fe.n == len(fe.records) {
+		fe.dropped++
+		fe.stack.debug("FLOW:drop", slog.Uint64("dropped", uint64(fe.dropped)))
+		return
+	}
+	fe.records[fe.n] = rec
+	fe.n++
+	fe.stack.RequestSendUDP(fe.cfg.LocalPort)
+}
+
+func (fe *FlowExporter) send(dst []byte) (int, error) {
+	const payloadOffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+	if fe.stack.flows != fe {
+		return 0, io.EOF
+	} else if fe.n == 0 {
+		return 0, nil
+	}
+	collector := fe.cfg.Collector.Addr().As4()
+	if fe.hw == [6]byte{} {
+		hw, err := fe.stack.arpClient.resolve(collector)
+		if err == errARPResponsePending {
+			return 0, ErrFlagPending
+		} else if err != nil {
+			fe.stack.error("FLOW:drop-unresolved", slog.Int("records", fe.n))
+			fe.dropped += uint32(fe.n)
+			fe.n = 0
+			return 0, nil
+		}
+		fe.hw = hw
+	}
+	limit := min(len(dst), int(fe.stack.mtu))
+	overhead := payloadOffset + sizeIPFIXHeader + sizeIPFIXTemplateSet + sizeIPFIXSetHeader
+	if limit < overhead+2*sizeIPFIXDataRecord {
+		return 0, io.ErrShortBuffer
+	}
+	// Both directions of a flow are sent in the same message.
+	nflows := min(fe.n, (limit-overhead)/(2*sizeIPFIXDataRecord))
+	now := fe.stack.now()
+	payload := fe.appendMessage(dst[payloadOffset:payloadOffset], now, fe.records[:nflows])
+	fe.n = copy(fe.records, fe.records[nflows:fe.n])
+	const ipv4ToS = 0
+	fe.stack.setUDP(&fe.pkt, fe.hw, fe.stack.ip, collector, ipv4ToS, payload, fe.cfg.LocalPort, fe.cfg.Collector.Port())
+	fe.pkt.PutHeaders(dst)
+	fe.stack.debug("FLOW:send", slog.Int("flows", nflows), slog.Uint64("seq", uint64(fe.seq)))
+	if fe.n > 0 {
+		return payloadOffset + len(payload), ErrFlagPending
+	}
+	return payloadOffset + len(payload), nil
+}
+
+// appendMessage appends an IPFIX message holding the template and the data
+// records of flows to dst.
+func (fe *FlowExporter) appendMessage(dst []byte, now time.Time, flows []FlowRecord) []byte {
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint16(dst, ipfixVersion)
+	dst = binary.BigEndian.AppendUint16(dst, 0) // Length, set below.
+	dst = binary.BigEndian.AppendUint32(dst, uint32(now.Unix()))
+	dst = binary.BigEndian.AppendUint32(dst, fe.seq)
+	dst = binary.BigEndian.AppendUint32(dst, fe.cfg.ObservationDomain)
+
+	dst = binary.BigEndian.AppendUint16(dst, ipfixSetTemplate)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(sizeIPFIXTemplateSet))
+	dst = binary.BigEndian.AppendUint16(dst, ipfixTemplateID)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(ipfixTemplateFields)))
+	for _, field := range ipfixTemplateFields {
+		dst = binary.BigEndian.AppendUint16(dst, field[0])
+		dst = binary.BigEndian.AppendUint16(dst, field[1])
+	}
+
+	set := len(dst)
+	dst = binary.BigEndian.AppendUint16(dst, ipfixTemplateID)
+	dst = binary.BigEndian.AppendUint16(dst, 0) // Length, set below.
+	for i := range flows {
+		f := &flows[i]
+		if f.PacketsOut > 0 {
+			dst = appendIPFIXRecord(dst, f, f.Local, f.Remote, f.BytesOut, f.PacketsOut)
+			fe.seq++
+		}
+		if f.PacketsIn > 0 {
+			dst = appendIPFIXRecord(dst, f, f.Remote, f.Local, f.BytesIn, f.PacketsIn)
+			fe.seq++
+		}
+	}
+	binary.BigEndian.PutUint16(dst[set+2:], uint16(len(dst)-set))
+	binary.BigEndian.PutUint16(dst[start+2:], uint16(len(dst)-start))
+	return dst[start:]
+}
+
+func appendIPFIXRecord(dst []byte, f *FlowRecord, src, dstAddr netip.AddrPort, octets, packets uint64) []byte {
+	srcIP, dstIP := src.Addr().As4(), dstAddr.Addr().As4()
+	dst = append(dst, srcIP[:]...)
+	dst = append(dst, dstIP[:]...)
+	dst = binary.BigEndian.AppendUint16(dst, src.Port())
+	dst = binary.BigEndian.AppendUint16(dst, dstAddr.Port())
+	dst = append(dst, f.Proto)
+	dst = binary.BigEndian.AppendUint64(dst, octets)
+	dst = binary.BigEndian.AppendUint64(dst, packets)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(f.Start.UnixMilli()))
+	return binary.BigEndian.AppendUint64(dst, uint64(f.End.UnixMilli()))
+}
+
+func (fe *FlowExporter) recv(pkt *UDPPacket) error {
+	if fe.stack.flows != fe {
+		return io.EOF
+	}
+	return nil // Collectors do not send messages to exporters.
+}
+
+func (fe *FlowExporter) isPendingHandling() bool { return fe.n > 0 }
+
+func (fe *FlowExporter) abort() {
+	if fe.stack.flows == fe {
+		fe.stack.flows = nil
+	}
+	fe.n = 0
+}
@@ -0,0 +1,218 @@
+package stacks
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+const (
+	defaultGatewayProbeInterval = 10 * time.Second
+	defaultGatewayProbeTimeout  = time.Second
+	defaultGatewayMaxFailures   = 3
+)
+
+// GatewayFailover configures dead gateway detection over several default
+// routes, usually the routers of a dual-uplink device. Gateways are probed
+// for liveness with ARP requests and the default gateway is switched to the
+// most preferred live gateway when the current one stops answering, and back
+// once it recovers. See [PortStack.SetGatewayFailover].
+type GatewayFailover struct {
+	// Gateways are the default gateways in order of preference. They must
+	// be within the subnet set with [PortStack.SetGateway]. An empty list
+	// disables dead gateway detection.
+	Gateways []netip.Addr
+	// Interval is the time between probes of each gateway. If zero 10 seconds are used.
+	Interval time.Duration
+	// Timeout is the time waited for a reply to a probe. If zero 1 second is used.
+	Timeout time.Duration
+	// MaxFailures is the amount of consecutive unanswered probes after which a
+	// gateway is considered dead. If zero 3 failures are allowed.
+	MaxFailures uint8
+	// OnFailover is an optional callback called when the default gateway is
+	// switched from one gateway to another.
+	OnFailover func(from, to netip.Addr)
+}
+
+// gatewayState is the liveness of a gateway monitored for failover.
+type gatewayState struct {
+	addr     [4]byte
+	dead     bool
+	awaiting bool
+	failures uint8
+	// next is the time the next probe is due or, while awaiting, the time the probe times out.
+	next time.Time
+}
+
+// gatewayMonitor implements dead gateway detection.
+type gatewayMonitor struct {
+	cfg      GatewayFailover
+	gateways []gatewayState
+}
+
+// SetGatewayFailover configures dead gateway detection. The first gateway
+// becomes the default gateway and probing starts on the next call to
+// HandleEth. An empty gateway list disables detection, leaving the current
+// default gateway in place.
+func (ps *PortStack) SetGatewayFailover(gf GatewayFailover) error {
+	for _, gw := range gf.Gateways {
+		if !gw.Is4() || !ps.subnet.Contains(gw) {
+			return errBadGateway
+		}
+	}
+	if gf.Interval <= 0 {
+		gf.Interval = defaultGatewayProbeInterval
+	}
+	if gf.Timeout <= 0 {
+		gf.Timeout = defaultGatewayProbeTimeout
+	}
+	if gf.MaxFailures == 0 {
+		gf.MaxFailures = defaultGatewayMaxFailures
+	}
+	gm := &ps.gwmon
+	gm.cfg = gf
+	gm.gateways = gm.gateways[:0]
+	now := ps.now()
+	for _, gw := range gf.Gateways {
+		gm.gateways = append(gm.gateways, gatewayState{addr: gw.As4(), next: now})
+	}
+	if len(gf.Gateways) > 0 {
+		ps.setGateway(gf.Gateways[0])
+	}
+	return nil
+}
+
+// GatewayAlive reports whether the gateway gw monitored for failover answers
+// probes. It reports false for gateways not monitored.
+func (ps *PortStack) GatewayAlive(gw netip.Addr) bool {
+	for i := range ps.gwmon.gateways {
+		g := &ps.gwmon.gateways[i]
+		if netip.AddrFrom4(g.addr) == gw {
+			return !g.dead
+		}
+	}
+	return false
+}
+
+// gatewayProbePending reports whether a probe is due or has timed out.
+// Gateways are not probed until the stack has an address.
+func (ps *PortStack) gatewayProbePending() bool {
+	if len(ps.gwmon.gateways) == 0 || ps.ip == [4]byte{} {
+		return false
+	}
+	now := ps.now()
+	for i := range ps.gwmon.gateways {
+		if !now.Before(ps.gwmon.gateways[i].next) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGatewayProbe processes timed out probes and writes a due probe to dst.
+func (ps *PortStack) handleGatewayProbe(dst []byte) int {
+	gm := &ps.gwmon
+	if !ps.gatewayProbePending() {
+		return 0
+	}
+	now := ps.now()
+	for i := range gm.gateways {
+		g := &gm.gateways[i]
+		if !g.awaiting || now.Before(g.next) {
+			continue
+		}
+		g.awaiting = false
+		g.next = g.next.Add(gm.cfg.Interval - gm.cfg.Timeout)
+		if g.failures < gm.cfg.MaxFailures {
+			g.failures++
+		}
+		if !g.dead && g.failures >= gm.cfg.MaxFailures {
+			g.dead = true
+			ps.error("GW:dead", ps.addrAttr("gw", g.addr))
+			ps.selectGateway()
+		}
+	}
+	for i := range gm.gateways {
+		g := &gm.gateways[i]
+		if g.awaiting || now.Before(g.next) {
+			continue
+		}
+		g.awaiting = true
+		g.next = now.Add(gm.cfg.Timeout)
+		// Probes are unicast to the gateway's cached hardware address so
+		// that a replacement router with the same address is also detected.
+		hw, ok := ps.arpClient.cache.lookup(g.addr, now)
+		if !ok {
+			hw = eth.BroadcastHW6()
+		}
+		ehdr := eth.EthernetHeader{
+			Destination:     hw,
+			Source:          ps.mac,
+			SizeOrEtherType: uint16(eth.EtherTypeARP),
+		}
+		ahdr := eth.ARPv4Header{
+			Operation:      1,
+			HardwareType:   1, // Ethernet.
+			ProtoType:      uint16(eth.EtherTypeIPv4),
+			HardwareLength: 6,
+			ProtoLength:    4,
+			HardwareSender: ps.mac,
+			ProtoSender:    ps.ip,
+			ProtoTarget:    g.addr,
+		}
+		ehdr.Put(dst)
+		ahdr.Put(dst[eth.SizeEthernetHeader:])
+		if ps.isLogEnabled(slog.LevelDebug) {
+			ps.debug("GW:probe", ps.addrAttr("gw", g.addr), slog.Bool("broadcast", !ok))
+		}
+		return eth.SizeEthernetHeader + eth.SizeARPv4Header
+	}
+	return 0
+}
+
+// checkGatewayReply marks the gateway sending the ARP reply ahdr alive and
+// reports whether it answers a probe.
+func (ps *PortStack) checkGatewayReply(ahdr *eth.ARPv4Header) bool {
+	gm := &ps.gwmon
+	for i := range gm.gateways {
+		g := &gm.gateways[i]
+		if g.addr != ahdr.ProtoSender || !g.awaiting || ahdr.ProtoTarget != ps.ip {
+			continue
+		}
+		g.awaiting = false
+		g.failures = 0
+		g.next = g.next.Add(gm.cfg.Interval - gm.cfg.Timeout)
+		if g.dead {
+			g.dead = false
+			ps.info("GW:alive", ps.addrAttr("gw", g.addr))
+			ps.selectGateway()
+		}
+		return true
+	}
+	return false
+}
+
+// selectGateway sets the default gateway to the most preferred live gateway.
+// The current gateway is kept if all of them are dead.
+func (ps *PortStack) selectGateway() {
+	for i := range ps.gwmon.gateways {
+		g := &ps.gwmon.gateways[i]
+		if g.dead {
+			continue
+		}
+		gw := netip.AddrFrom4(g.addr)
+		if gw == ps.gateway {
+			return
+		}
+		from := ps.gateway
+		ps.setGateway(gw)
+		ps.stats.GatewayFailovers++
+		ps.info("GW:failover", slog.String("from", from.String()), ps.addrAttr("to", g.addr))
+		if ps.gwmon.cfg.OnFailover != nil {
+			ps.gwmon.cfg.OnFailover(from, gw)
+		}
+		return
+	}
+}
@@ -0,0 +1,102 @@
+package stacks
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+)
+
+var (
+	errHandoffNotOwner = errors.New("handoff: connection does not own its port")
+	errHandoffBusy     = errors.New("handoff: destination socket in use or on another stack")
+	errHandoffBufSize  = errors.New("handoff: destination buffers too small")
+)
+
+// Handoff moves the live connection of sock to the closed socket to, such as
+// when an HTTP connection is upgraded to a WebSocket handled with larger
+// buffers, or a plaintext protocol hands off to TLS after STARTTLS. The port
+// is reassigned in a single step between calls to the stack so no segment is
+// lost or answered with a RST: data received and not yet read, segments
+// received ahead of a gap and data written and not yet sent is moved to to
+// along with the timers of the connection. Calls to sock return
+// [net.ErrClosed] after the handoff.
+//
+// The receive buffer of to must be no smaller than sock's so the window
+// advertised to the remote remains valid, and its receive queue must hold
+// the segments sock queued, see [TCPConnConfig.RxQueueLen]. Connections accepted by a
+// [TCPListener] share the listener's port and cannot be handed off.
+func (sock *TCPConn) Handoff(to *TCPConn) error {
+	state := sock.State()
+	switch {
+	case sock.localPort == 0 || state.IsClosed() || sock.aborting:
+		return net.ErrClosed
+	case to == sock || to.stack != sock.stack || to.localPort != 0 || !to.State().IsClosed():
+		return errHandoffBusy
+	case len(to.rx.buf) < len(sock.rx.buf) || len(to.tx.buf) < sock.tx.Buffered() || len(to.rxq.pkts) < sock.rxq.n:
+		return errHandoffBufSize
+	}
+	port := findPort(sock.stack.portsTCP, sock.localPort)
+	if port == nil || port.handler != sock {
+		return errHandoffNotOwner
+	}
+	to.rx.Reset()
+	to.tx.Reset()
+	moveRing(&to.rx, &sock.rx)
+	moveRing(&to.tx, &sock.tx)
+	moveRxQueue(&to.rxq, &sock.rxq)
+	to.scb = sock.scb
+	to.remote = sock.remote
+	to.remoteMAC = sock.remoteMAC
+	to.localPort = sock.localPort
+	to.localIP = sock.localIP
+	to.lastTx = sock.lastTx
+	to.lastRx = sock.lastRx
+	to.opened = sock.opened
+	to.flow = sock.flow
+	to.pathMTU = sock.pathMTU
+	to.peer = sock.peer
+	to.ts = sock.ts
+	to.closing = sock.closing
+	to.abortErr = nil
+	to.pacer.next = sock.pacer.next
+	to.delack = sock.delack
+	to.ka = sock.ka
+	to.persist = sock.persist
+	to.rcvEdge = sock.rcvEdge
+	to.push = sock.push
+	to.timeWaitEnd = sock.timeWaitEnd
+	to.connect = sock.connect
+	to.rates = sock.rates
+	tcfg := to.tcfg
+	to.retx = sock.retx
+	to.applyTCPConfig(tcfg) // Keep to's retransmission limits.
+	to.connid++
+	port.handler = to
+	sock.info("TCPConn.Handoff", slog.Uint64("lport", uint64(to.localPort)), slog.String("state", state.String()))
+	sock.deleteState()
+	if to.isPendingHandling() {
+		sock.stack.RequestSendTCP(to.localPort)
+	}
+	return nil
+}
+
+// moveRxQueue moves the segments queued in src to dst, which must have room
+// for them. Packet buffers are exchanged so that buffers borrowed from the
+// stack's packet pool are released by their new owner.
+func moveRxQueue(dst, src *tcpRxQueue) {
+	for i := 0; i < src.n; i++ {
+		dst.pkts[i], src.pkts[i] = src.pkts[i], dst.pkts[i]
+	}
+	*dst = tcpRxQueue{pkts: dst.pkts, n: src.n, last: src.last, sackPending: src.sackPending}
+	src.n = 0
+}
+
+// moveRing moves all data buffered in src to dst. dst must have enough free space.
+func moveRing(dst, src *ring) {
+	for src.Buffered() > 0 {
+		_, err := dst.readFrom(src)
+		if err != nil {
+			panic("moveRing: " + err.Error())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package stacks
+
+import "time"
+
+// maxConsecutiveErrs is the amount of consecutive failed HandleEth calls after
+// which the stack is considered wedged.
+const maxConsecutiveErrs = 16
+
+// Health is a snapshot of the stack's liveness and error counters. It is
+// intended to be inspected periodically by the main loop or a watchdog task.
+type Health struct {
+	// SinceRx and SinceTx are the time elapsed since the last received and sent
+	// frame respectively. If no frame has been received/sent they count
+	// from when the stack was created.
+	SinceRx time.Duration
+	SinceTx time.Duration
+	// PendingUDP and PendingTCP are the pending handling counters of the UDP and TCP ports.
+	PendingUDP uint32
+	PendingTCP uint32
+	// BufferedTCP is the amount of bytes held in TCP connection buffers.
+	BufferedTCP int
+	// ProcessedPackets counts packets written out by HandleEth.
+	ProcessedPackets uint32
+	// DroppedPackets counts received packets dropped due to ports requiring handling.
+	DroppedPackets uint32
+	// DroppedLLC counts received IEEE 802.3 frames dropped for not carrying a
+	// RFC 1042 LLC/SNAP encapsulated packet.
+	DroppedLLC uint32
+	// DroppedVLAN counts received frames dropped for not being tagged with the stack's VLAN.
+	DroppedVLAN uint32
+	// RejectedL2 counts received frames rejected by the L2 destination address filter.
+	RejectedL2 uint32
+	// RejectedMD5 counts received TCP segments dropped by TCP MD5 signature verification.
+	RejectedMD5 uint32
+	// RejectedACL counts received packets dropped for coming from a peer not allowed on the destination port.
+	RejectedACL uint32
+	// RejectedIPOptions counts received packets dropped by the stack's [IPOptionsPolicy].
+	RejectedIPOptions uint32
+	// RejectedInspection counts received packets vetoed by the stack's [Inspector].
+	RejectedInspection uint32
+	// Deviations counts received packets found to deviate from the protocol
+	// specifications, whether dropped or tolerated. See [Validation].
+	Deviations uint32
+	// BadChecksumIP, BadChecksumTCP and BadChecksumUDP count received packets
+	// with an invalid IPv4 header, TCP or UDP checksum respectively. Such
+	// packets are dropped or tolerated as selected by the stack's [Validation].
+	// Checksums verified by the NIC are not counted. See [ChecksumOffload].
+	BadChecksumIP  uint32
+	BadChecksumTCP uint32
+	BadChecksumUDP uint32
+	// RecvErrors and HandleErrors count calls to RecvEth and HandleEth that returned an error.
+	RecvErrors   uint32
+	HandleErrors uint32
+	// ConsecutiveErrors counts HandleEth calls that returned an error since the last successful call.
+	ConsecutiveErrors uint32
+	// TxFailures counts frames the NIC driver reported as not sent. See [PortStack.TxDone].
+	TxFailures uint32
+	// DroppedStorm counts received broadcast and multicast frames dropped by [StormControl].
+	DroppedStorm uint32
+	// DroppedDuplicate counts received frames dropped as duplicates by [DuplicateFilter].
+	DroppedDuplicate uint32
+	// AddrConflicts counts ARP packets from other hosts claiming the stack's
+	// address. See [PortStackConfig.AddrConflictDetection].
+	AddrConflicts uint32
+	// DroppedFragments counts received IPv4 fragments of datagrams discarded
+	// for timing out, being evicted or malformed. See [PortStackConfig.IPReassemblyBuffers].
+	DroppedFragments uint32
+}
+
+// Health returns a snapshot of the stack's health.
+func (ps *PortStack) Health() Health {
+	now := ps.now()
+	lastRx, lastTx := ps.lastRx, ps.lastTx
+	if lastRx.IsZero() {
+		lastRx = ps.started
+	}
+	if lastTx.IsZero() {
+		lastTx = ps.started
+	}
+	return Health{
+		SinceRx:            now.Sub(lastRx),
+		SinceTx:            now.Sub(lastTx),
+		PendingUDP:         ps.pendingUDPv4,
+		PendingTCP:         ps.pendingTCPv4,
+		BufferedTCP:        ps.BufferedTCP(),
+		ProcessedPackets:   ps.processedPackets,
+		DroppedPackets:     ps.droppedPackets,
+		DroppedLLC:         ps.droppedLLC,
+		DroppedVLAN:        ps.droppedVLAN,
+		RejectedL2:         ps.rejectedL2,
+		RejectedMD5:        ps.rejectedMD5,
+		RejectedACL:        ps.rejectedACL,
+		RejectedIPOptions:  ps.rejectedIPOpts,
+		RejectedInspection: ps.rejectedInspect,
+		Deviations:         ps.deviations,
+		BadChecksumIP:      ps.badChecksums.ip,
+		BadChecksumTCP:     ps.badChecksums.tcp,
+		BadChecksumUDP:     ps.badChecksums.udp,
+		RecvErrors:         ps.recvErrors,
+		HandleErrors:       ps.handleErrors,
+		ConsecutiveErrors:  ps.consecutiveErrs,
+		TxFailures:         ps.txFailures,
+		DroppedStorm:       ps.storm.dropped,
+		DroppedDuplicate:   ps.dedup.dropped,
+		AddrConflicts:      ps.acd.count,
+		DroppedFragments:   ps.reasm.dropped,
+	}
+}
+
+// Wedged reports whether the stack seems unable to make progress: either
+// HandleEth has failed repeatedly or, when maxRxAge is non-zero, no frame
+// has been received for longer than maxRxAge.
+func (h Health) Wedged(maxRxAge time.Duration) bool {
+	return h.ConsecutiveErrors >= maxConsecutiveErrs || (maxRxAge > 0 && h.SinceRx > maxRxAge)
+}
@@ -0,0 +1,140 @@
+package stacks
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/soypat/seqs/eth/dns"
+)
+
+var errHostNoAddr = errors.New("static host needs at least one address")
+
+// hostEntry is a static name to addresses mapping of the host table.
+type hostEntry struct {
+	name  string
+	addrs []netip.Addr
+}
+
+// hostTable resolves the stack's hostname and statically configured names
+// before DNS is queried, the equivalent of a hosts file.
+type hostTable struct {
+	hostname string
+	entries  []hostEntry
+}
+
+// SetHostname sets the stack's hostname, which names resolve to the stack's
+// own address and is requested by DHCP clients not configured with one.
+// An empty name removes the hostname.
+func (ps *PortStack) SetHostname(name string) error {
+	if name != "" {
+		if _, err := dns.NewName(name); err != nil {
+			return err
+		}
+	}
+	ps.info("SetHostname", slog.String("name", name))
+	ps.hosts.hostname = dnsCacheKey(name)
+	return nil
+}
+
+// Hostname returns the name set with [PortStack.SetHostname].
+func (ps *PortStack) Hostname() string { return ps.hosts.hostname }
+
+// AddHost adds a static mapping of name to addrs consulted by
+// [DNSClient.LookupNetIP] before querying DNS, replacing any previous mapping
+// of name. Useful for air-gapped deployments or overriding endpoints in testing.
+// Names are case insensitive.
+func (ps *PortStack) AddHost(name string, addrs ...netip.Addr) error {
+	if len(addrs) == 0 {
+		return errHostNoAddr
+	} else if _, err := dns.NewName(name); err != nil {
+		return err
+	}
+	name = dnsCacheKey(name)
+	entry := hostEntry{name: name, addrs: append([]netip.Addr(nil), addrs...)}
+	for i := range ps.hosts.entries {
+		if ps.hosts.entries[i].name == name {
+			ps.hosts.entries[i] = entry
+			return nil
+		}
+	}
+	ps.hosts.entries = append(ps.hosts.entries, entry)
+	return nil
+}
+
+// RemoveHost removes the static mapping of name added with [PortStack.AddHost].
+func (ps *PortStack) RemoveHost(name string) {
+	name = dnsCacheKey(name)
+	for i := range ps.hosts.entries {
+		if ps.hosts.entries[i].name == name {
+			ps.hosts.entries = append(ps.hosts.entries[:i], ps.hosts.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// ReadHosts adds the mappings of r in the hosts file format, one address per
+// line followed by the names it maps to:
+//
+//	<address> <name> [aliases...]
+//
+// Text after a '#' is a comment. Addresses of names appearing in several lines
+// are merged, but mappings existing before the call are replaced.
+func (ps *PortStack) ReadHosts(r io.Reader) error {
+	var read []hostEntry
+	scanner := bufio.NewScanner(r)
+	nline := 0
+	for scanner.Scan() {
+		nline++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) < 2 {
+			return errors.New("missing host name on line " + strconv.Itoa(nline))
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return err
+		}
+	NAMES:
+		for _, name := range fields[1:] {
+			if _, err := dns.NewName(name); err != nil {
+				return err
+			}
+			name = dnsCacheKey(name)
+			for i := range read {
+				if read[i].name == name {
+					read[i].addrs = append(read[i].addrs, addr)
+					continue NAMES
+				}
+			}
+			read = append(read, hostEntry{name: name, addrs: []netip.Addr{addr}})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for i := range read {
+		ps.AddHost(read[i].name, read[i].addrs...)
+	}
+	return nil
+}
+
+// lookupHost returns the statically configured addresses of the cache key
+// name, or nil if name is not in the host table.
+func (ps *PortStack) lookupHost(name string) []netip.Addr {
+	if name == ps.hosts.hostname && name != "" && ps.ip != [4]byte{} {
+		return []netip.Addr{netip.AddrFrom4(ps.ip)}
+	}
+	for i := range ps.hosts.entries {
+		if ps.hosts.entries[i].name == name {
+			return ps.hosts.entries[i].addrs
+		}
+	}
+	return nil
+}
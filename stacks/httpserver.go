@@ -0,0 +1,427 @@
+package stacks
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/soypat/seqs/httpx"
+)
+
+const (
+	defaultHTTPTimeout = 5 * time.Second
+	defaultHTTPBufSize = 512
+)
+
+// HTTPServerConfig configures an [HTTPServer].
+type HTTPServerConfig struct {
+	// Port is the local TCP port the server listens on.
+	Port uint16
+	// MaxConnections is the amount of connections that may be established at
+	// once. Requests are served one at a time regardless. If zero 1 is used.
+	MaxConnections uint16
+	// BufSize is the size of the TCP buffers of each connection and of the
+	// response buffer. Responses that fit in it are sent with a Content-Length
+	// header, longer responses are sent with chunked encoding. If zero 512 is used.
+	BufSize uint16
+	// Timeout limits the time spent serving a single request. If zero a timeout of 5 seconds is used.
+	Timeout time.Duration
+	// Secure optionally secures accepted connections, i.e: with a crypto/tls
+	// server handshake. It returns the connection requests are then served
+	// over and the identity the client authenticated with, if any, which is
+	// set on conn so that handlers get it from [HTTPRequest.Peer]. If it
+	// returns an error the connection is closed without a response.
+	Secure func(conn *TCPConn) (net.Conn, PeerIdentity, error)
+}
+
+// HTTPHandler responds to an HTTP request. See [HTTPServer.Handle].
+type HTTPHandler interface {
+	ServeHTTP(w *HTTPResponseWriter, r *HTTPRequest)
+}
+
+// HTTPHandlerFunc adapts a function to an [HTTPHandler].
+type HTTPHandlerFunc func(w *HTTPResponseWriter, r *HTTPRequest)
+
+// ServeHTTP calls f(w, r).
+func (f HTTPHandlerFunc) ServeHTTP(w *HTTPResponseWriter, r *HTTPRequest) { f(w, r) }
+
+// HTTPRequest is a request received by an [HTTPServer]. It is only valid
+// during the call to the handler.
+type HTTPRequest struct {
+	// Header holds the parsed request line and headers.
+	Header httpx.RequestHeader
+	// Body reads the Content-Length bytes of the request body.
+	Body io.Reader
+	body io.LimitedReader
+	peer PeerIdentity
+}
+
+// Peer returns the authenticated identity of the client, zero if the
+// connection was not authenticated. See [TCPConn.SetPeerIdentity].
+func (r *HTTPRequest) Peer() PeerIdentity { return r.peer }
+
+// Method returns the request method, i.e: "GET".
+func (r *HTTPRequest) Method() []byte { return r.Header.Method() }
+
+// Path returns the request URI without the query.
+func (r *HTTPRequest) Path() []byte {
+	uri := r.Header.RequestURI()
+	if i := bytes.IndexByte(uri, '?'); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+// Query returns the query of the request URI without the leading '?'.
+func (r *HTTPRequest) Query() []byte {
+	uri := r.Header.RequestURI()
+	if i := bytes.IndexByte(uri, '?'); i >= 0 {
+		return uri[i+1:]
+	}
+	return nil
+}
+
+// HTTPResponseWriter builds the response to an [HTTPRequest]. The body is
+// buffered so that the status and headers may be set until the buffer first fills up.
+type HTTPResponseWriter struct {
+	conn        net.Conn
+	buf         []byte
+	hdr         []byte
+	line        []byte
+	status      int
+	contentType string
+	sentHeader  bool
+	noBody      bool
+	err         error
+}
+
+// SetStatus sets the status code of the response. By default it is 200.
+func (w *HTTPResponseWriter) SetStatus(code int) { w.status = code }
+
+// SetContentType sets the Content-Type of the response. By default it is "text/plain".
+func (w *HTTPResponseWriter) SetContentType(contentType string) { w.contentType = contentType }
+
+// AddHeader adds a header to the response. Content-Length, Transfer-Encoding
+// and Connection are set by the server.
+func (w *HTTPResponseWriter) AddHeader(key, value string) {
+	w.hdr = append(w.hdr, key...)
+	w.hdr = append(w.hdr, ": "...)
+	w.hdr = append(w.hdr, value...)
+	w.hdr = append(w.hdr, "\r\n"...)
+}
+
+// Write appends b to the response body. Once the body no longer fits in the
+// response buffer the headers are sent and the body is sent in chunks.
+func (w *HTTPResponseWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 && w.err == nil {
+		if len(w.buf) == w.bufSize() {
+			w.flushChunk()
+			continue
+		}
+		c := copy(w.buf[len(w.buf):w.bufSize()], b)
+		w.buf = w.buf[:len(w.buf)+c]
+		b = b[c:]
+		n += c
+	}
+	return n, w.err
+}
+
+// WriteString appends s to the response body. See [HTTPResponseWriter.Write].
+func (w *HTTPResponseWriter) WriteString(s string) (int, error) {
+	n := 0
+	for len(s) > 0 && w.err == nil {
+		if len(w.buf) == w.bufSize() {
+			w.flushChunk()
+			continue
+		}
+		c := copy(w.buf[len(w.buf):w.bufSize()], s)
+		w.buf = w.buf[:len(w.buf)+c]
+		s = s[c:]
+		n += c
+	}
+	return n, w.err
+}
+
+// bufSize returns the size of the body buffer, leaving room for the CRLF ending chunks.
+func (w *HTTPResponseWriter) bufSize() int { return cap(w.buf) - 2 }
+
+func (w *HTTPResponseWriter) reset(conn net.Conn, noBody bool) {
+	*w = HTTPResponseWriter{
+		conn:        conn,
+		buf:         w.buf[:0],
+		hdr:         w.hdr[:0],
+		line:        w.line[:0],
+		status:      200,
+		contentType: "text/plain",
+		noBody:      noBody,
+	}
+}
+
+// writeHeader sends the status line and headers. A negative contentLength
+// selects chunked encoding.
+func (w *HTTPResponseWriter) writeHeader(contentLength int) {
+	b := append(w.line[:0], "HTTP/1.1 "...)
+	b = strconv.AppendInt(b, int64(w.status), 10)
+	b = append(b, ' ')
+	b = append(b, httpStatusText(w.status)...)
+	b = append(b, "\r\nContent-Type: "...)
+	b = append(b, w.contentType...)
+	if contentLength < 0 {
+		b = append(b, "\r\nTransfer-Encoding: chunked"...)
+	} else {
+		b = append(b, "\r\nContent-Length: "...)
+		b = strconv.AppendInt(b, int64(contentLength), 10)
+	}
+	b = append(b, "\r\nConnection: close\r\n"...)
+	b = append(b, w.hdr...)
+	b = append(b, "\r\n"...)
+	w.line = b
+	w.sentHeader = true
+	w.write(b)
+}
+
+// flushChunk sends the buffered body as a chunk, sending the headers first if needed.
+func (w *HTTPResponseWriter) flushChunk() {
+	if !w.sentHeader {
+		w.writeHeader(-1)
+	}
+	if len(w.buf) == 0 || w.noBody {
+		w.buf = w.buf[:0]
+		return
+	}
+	w.line = strconv.AppendUint(w.line[:0], uint64(len(w.buf)), 16)
+	w.line = append(w.line, "\r\n"...)
+	w.write(w.line)
+	w.buf = append(w.buf, "\r\n"...)
+	w.write(w.buf)
+	w.buf = w.buf[:0]
+}
+
+// finish sends the remainder of the response.
+func (w *HTTPResponseWriter) finish() error {
+	if !w.sentHeader {
+		w.writeHeader(len(w.buf))
+		if !w.noBody {
+			w.write(w.buf)
+		}
+		return w.err
+	}
+	w.flushChunk()
+	if !w.noBody {
+		w.write([]byte("0\r\n\r\n"))
+	}
+	return w.err
+}
+
+func (w *HTTPResponseWriter) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.conn.Write(b)
+	}
+}
+
+type httpRoute struct {
+	pattern string
+	handler HTTPHandler
+}
+
+// HTTPServer is a minimal HTTP/1.1 server running over a [PortStack], i.e: to
+// expose the configuration or status page of a device. Requests are routed
+// to handlers by path, see [HTTPServer.Handle]. Request bodies must be sent
+// with a Content-Length. Requests are served one at a time and connections
+// are closed after each response.
+type HTTPServer struct {
+	stack  *PortStack
+	l      *TCPListener
+	cfg    HTTPServerConfig
+	routes []httpRoute
+	rd     *bufio.Reader
+	req    HTTPRequest
+	resp   HTTPResponseWriter
+}
+
+// NewHTTPServer creates an HTTP server on stack and starts listening on cfg.Port.
+// Requests are served by calling [HTTPServer.Serve].
+func NewHTTPServer(stack *PortStack, cfg HTTPServerConfig) (*HTTPServer, error) {
+	if cfg.Port == 0 {
+		return nil, errZeroPort
+	}
+	if cfg.MaxConnections == 0 {
+		cfg.MaxConnections = 1
+	}
+	if cfg.BufSize == 0 {
+		cfg.BufSize = defaultHTTPBufSize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultHTTPTimeout
+	}
+	l, err := NewTCPListener(stack, TCPListenerConfig{
+		MaxConnections: cfg.MaxConnections,
+		ConnTxBufSize:  cfg.BufSize,
+		ConnRxBufSize:  cfg.BufSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = l.StartListening(cfg.Port)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPServer{
+		stack: stack,
+		l:     l,
+		cfg:   cfg,
+		rd:    bufio.NewReaderSize(nil, int(cfg.BufSize)),
+		resp:  HTTPResponseWriter{buf: make([]byte, 0, int(cfg.BufSize)+2)},
+	}, nil
+}
+
+// Handle registers the handler for requests whose path matches pattern.
+// Patterns ending in '/' match all paths they are a prefix of, other patterns
+// match a path exactly. The longest matching pattern is used. Handle must
+// not be called concurrently with [HTTPServer.Serve].
+func (hs *HTTPServer) Handle(pattern string, h HTTPHandler) {
+	for i := range hs.routes {
+		if hs.routes[i].pattern == pattern {
+			hs.routes[i].handler = h
+			return
+		}
+	}
+	hs.routes = append(hs.routes, httpRoute{pattern: pattern, handler: h})
+}
+
+// HandleFunc registers the handler function for requests whose path matches pattern. See [HTTPServer.Handle].
+func (hs *HTTPServer) HandleFunc(pattern string, f func(w *HTTPResponseWriter, r *HTTPRequest)) {
+	hs.Handle(pattern, HTTPHandlerFunc(f))
+}
+
+// Serve accepts and serves requests until the server is closed. Like other
+// blocking calls it requires the stack to be serviced by another goroutine.
+func (hs *HTTPServer) Serve() error {
+	for {
+		conn, err := hs.l.AcceptTCP()
+		if err != nil {
+			return err
+		}
+		err = hs.serveConn(conn)
+		if err != nil {
+			hs.stack.info("HTTP:serve", slog.String("err", err.Error()))
+		}
+		conn.Close()
+	}
+}
+
+// Close stops listening for requests.
+func (hs *HTTPServer) Close() error {
+	return hs.stack.CloseTCP(hs.cfg.Port)
+}
+
+func (hs *HTTPServer) serveConn(tcp *TCPConn) error {
+	tcp.SetDeadline(hs.stack.now().Add(hs.cfg.Timeout))
+	var conn net.Conn = tcp
+	if hs.cfg.Secure != nil {
+		secured, id, err := hs.cfg.Secure(tcp)
+		if err != nil {
+			return err
+		}
+		defer secured.Close()
+		conn = secured
+		if !id.IsZero() {
+			tcp.SetPeerIdentity(id)
+		}
+	}
+	hs.rd.Reset(conn)
+	req := &hs.req
+	w := &hs.resp
+	err := req.Header.Read(hs.rd)
+	if err == io.EOF {
+		return nil
+	}
+	w.reset(conn, string(req.Header.Method()) == "HEAD")
+	if err != nil {
+		w.SetStatus(400)
+		w.finish()
+		return err
+	}
+	req.body = io.LimitedReader{R: hs.rd}
+	req.peer = tcp.PeerIdentity()
+	switch n := req.Header.ContentLength(); {
+	case n == -1:
+		w.SetStatus(411)
+		return w.finish()
+	case n > 0:
+		req.body.N = int64(n)
+	}
+	req.Body = &req.body
+	h := hs.handler(req.Path())
+	if h == nil {
+		w.SetStatus(404)
+		w.WriteString("404 Not Found\n")
+		return w.finish()
+	}
+	h.ServeHTTP(w, req)
+	return w.finish()
+}
+
+// handler returns the handler of the longest pattern matching path.
+func (hs *HTTPServer) handler(path []byte) HTTPHandler {
+	var best *httpRoute
+	for i := range hs.routes {
+		r := &hs.routes[i]
+		if best != nil && len(r.pattern) <= len(best.pattern) {
+			continue
+		}
+		n := len(r.pattern)
+		if string(path) == r.pattern || n > 0 && r.pattern[n-1] == '/' && len(path) >= n && string(path[:n]) == r.pattern {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.handler
+}
+
+func httpStatusText(code int) string {
+	switch code {
+	case 200:
+		return "OK"
+	case 201:
+		return "Created"
+	case 204:
+		return "No Content"
+	case 301:
+		return "Moved Permanently"
+	case 302:
+		return "Found"
+	case 303:
+		return "See Other"
+	case 304:
+		return "Not Modified"
+	case 400:
+		return "Bad Request"
+	case 401:
+		return "Unauthorized"
+	case 403:
+		return "Forbidden"
+	case 404:
+		return "Not Found"
+	case 405:
+		return "Method Not Allowed"
+	case 411:
+		return "Length Required"
+	case 413:
+		return "Payload Too Large"
+	case 500:
+		return "Internal Server Error"
+	case 501:
+		return "Not Implemented"
+	case 503:
+		return "Service Unavailable"
+	}
+	return ""
+}
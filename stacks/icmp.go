@@ -0,0 +1,281 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+const (
+	sizeICMPHeader           = 8
+	sizeICMPTimestamp        = sizeICMPHeader + 12
+	sizeICMPAddrMask         = sizeICMPHeader + 4
+	icmpTimestampNonStandard = 1 << 31
+	icmpCodeHostUnreachable  = 1
+	icmpCodePortUnreachable  = 3
+	// maxICMPEchoData is the largest echo request payload answered or sent by the stack.
+	maxICMPEchoData    = 64
+	icmpMaxReply       = sizeICMPHeader + maxICMPEchoData
+	millisecondsPerDay = 24 * 60 * 60 * 1000
+)
+
+var (
+	errBadICMPChecksum = errors.New("invalid ICMP checksum")
+	errICMPBusy        = errors.New("ICMP message pending to be sent")
+	errNoPing          = errors.New("no ping in progress")
+	errPingPending     = errors.New("ping reply pending")
+)
+
+// ICMPResponder selects which optional ICMP requests a [PortStack] answers.
+// All responders are disabled by default.
+type ICMPResponder uint8
+
+const (
+	// ICMPTimestamp answers timestamp requests (type 13) with timestamp replies (type 14).
+	ICMPTimestamp ICMPResponder = 1 << iota
+	// ICMPAddrMask answers address mask requests (type 17) with address mask
+	// replies (type 18) containing the mask set by [PortStackConfig.ICMPAddrMaskBits].
+	ICMPAddrMask
+	// ICMPEcho answers echo requests (type 8) with echo replies (type 0).
+	// Requests carrying more than 64 bytes of data are not answered.
+	ICMPEcho
+)
+
+// icmpReply holds an outgoing ICMP message generated by the stack in response
+// to an incoming request. Only one reply can be pending at a time; requests
+// received while a reply is pending are ignored.
+type icmpReply struct {
+	eth     eth.EthernetHeader
+	ip      eth.IPv4Header
+	msg     [icmpMaxReply]byte
+	n       uint8
+	pending bool
+}
+
+// recvICMP processes an incoming ICMP message. payload is the IP payload.
+// Messages of types without an enabled responder are silently ignored.
+func (ps *PortStack) recvICMP(ehdr *eth.EthernetHeader, ihdr *eth.IPv4Header, payload []byte) error {
+	if len(payload) < sizeICMPHeader {
+		return errPacketSmol
+	}
+	var crc eth.CRC791
+	crc.Write(payload)
+	if crc.Sum16() != 0 {
+		return errBadICMPChecksum
+	}
+	if ps.inspector != nil && !ps.inspect(ehdr, ihdr, nil, nil, nil, payload) {
+		return nil
+	}
+	switch eth.ICMPType(payload[0]) {
+	case eth.ICMPTypeEchoReply:
+		ps.ping.recv(ps.lastRx, ihdr.Source, payload)
+		return nil
+	case eth.ICMPTypeDestUnreachable:
+		ps.recvICMPUnreachable(payload)
+		return nil
+	case eth.ICMPTypeRedirect:
+		ps.recvICMPRedirect(ihdr.Source, payload) // See icmpredirect.go.
+		return nil
+	}
+	reply := &ps.icmp
+	switch {
+	case reply.pending:
+		return nil // Busy with an unsent reply.
+	case payload[1] != 0:
+		return nil // Request types have no codes.
+	}
+	var msg []byte
+	switch eth.ICMPType(payload[0]) {
+	case eth.ICMPTypeEcho:
+		if ps.icmpResponders&ICMPEcho == 0 || len(payload) > icmpMaxReply {
+			return nil
+		}
+		msg = reply.msg[:len(payload)]
+		copy(msg, payload)
+		msg[0] = byte(eth.ICMPTypeEchoReply)
+
+	case eth.ICMPTypeTimestamp:
+		if ps.icmpResponders&ICMPTimestamp == 0 || len(payload) < sizeICMPTimestamp {
+			return nil
+		}
+		msg = reply.msg[:sizeICMPTimestamp]
+		copy(msg, payload[:sizeICMPTimestamp]) // Copies identifier, sequence number and originate timestamp.
+		msg[0] = byte(eth.ICMPTypeTimestampReply)
+		ts := icmpTimestamp(ps.lastRx)
+		binary.BigEndian.PutUint32(msg[12:], ts)
+		binary.BigEndian.PutUint32(msg[16:], ts)
+
+	case eth.ICMPTypeAddrMaskRequest:
+		if ps.icmpResponders&ICMPAddrMask == 0 || len(payload) < sizeICMPAddrMask {
+			return nil
+		}
+		msg = reply.msg[:sizeICMPAddrMask]
+		copy(msg, payload[:sizeICMPHeader])
+		msg[0] = byte(eth.ICMPTypeAddrMaskReply)
+		binary.BigEndian.PutUint32(msg[8:], ^uint32(0)<<(32-ps.icmpMaskBits))
+
+	default:
+		return nil // Unsupported ICMP message.
+	}
+	src := ihdr.Destination
+	if !ps.isLocalAddr(src) {
+		src = ps.ip // Request sent to broadcast address.
+	}
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("ICMP:recv", slog.String("type", eth.ICMPType(payload[0]).String()))
+	}
+	ps.queueICMP(ehdr.Source, src, ihdr.Source, len(msg))
+	return nil
+}
+
+// icmpErrorHandler is implemented by UDP handlers that are notified of ICMP
+// destination unreachable messages concerning datagrams sent from their port.
+type icmpErrorHandler interface {
+	recvICMPError(code uint8, dst netip.AddrPort)
+}
+
+// recvICMPUnreachable delivers a destination unreachable message to the
+// handler of the UDP port that sent the datagram quoted in msg.
+func (ps *PortStack) recvICMPUnreachable(msg []byte) {
+	quoted := msg[sizeICMPHeader:]
+	if len(quoted) < eth.SizeIPv4Header {
+		return
+	}
+	ihdr, offset := eth.DecodeIPv4Header(quoted)
+	if msg[1] == icmpCodeFragNeeded && ps.isLocalAddr(ihdr.Source) {
+		ps.recvFragNeeded(msg, &ihdr, quoted[min(int(offset), len(quoted)):])
+	}
+	if ihdr.Protocol != 17 || offset < eth.SizeIPv4Header || int(offset)+eth.SizeUDPHeader > len(quoted) ||
+		!ps.isLocalAddr(ihdr.Source) {
+		return // Not a datagram sent by us.
+	}
+	uhdr := eth.DecodeUDPHeader(quoted[offset:])
+	port := findPort(ps.portsUDP, uhdr.SourcePort)
+	if port == nil {
+		return
+	}
+	h, ok := port.ihandler.(icmpErrorHandler)
+	if !ok {
+		return
+	}
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("ICMP:unreachable", slog.Int("code", int(msg[1])), slog.Int("port", int(uhdr.SourcePort)))
+	}
+	h.recvICMPError(msg[1], netip.AddrPortFrom(netip.AddrFrom4(ihdr.Destination), uhdr.DestinationPort))
+}
+
+// queueICMP queues the ICMP message of length n held in ps.icmp.msg to be
+// sent. The checksum of the message is calculated by queueICMP.
+func (ps *PortStack) queueICMP(dstMAC [6]byte, src, dst [4]byte, n int) {
+	reply := &ps.icmp
+	msg := reply.msg[:n]
+	msg[2], msg[3] = 0, 0
+	var crc eth.CRC791
+	crc.Write(msg)
+	binary.BigEndian.PutUint16(msg[2:], crc.Sum16())
+	reply.eth = eth.EthernetHeader{
+		Destination:     dstMAC,
+		Source:          ps.mac,
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	reply.ip = eth.IPv4Header{
+		VersionAndIHL: 4<<4 | 5,
+		TotalLength:   eth.SizeIPv4Header + uint16(n),
+		TTL:           64,
+		Protocol:      1,
+		Source:        src,
+		Destination:   dst,
+	}
+	ps.applyFingerprint(&reply.ip)
+	reply.n = uint8(n)
+	reply.pending = true
+}
+
+// put writes the pending ICMP reply to dst and clears the pending flag.
+func (reply *icmpReply) put(dst []byte) int {
+	reply.eth.Put(dst)
+	reply.ip.Put(dst[eth.SizeEthernetHeader:])
+	n := copy(dst[eth.SizeEthernetHeader+eth.SizeIPv4Header:], reply.msg[:reply.n])
+	reply.pending = false
+	return eth.SizeEthernetHeader + eth.SizeIPv4Header + n
+}
+
+// icmpTimestamp returns t as milliseconds since midnight UT. If the stack
+// clock has not been set the high order bit is set to flag the value as
+// non-standard as specified by RFC 792.
+func icmpTimestamp(t time.Time) uint32 {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	ms := uint32(t.Sub(midnight).Milliseconds()) % millisecondsPerDay
+	if t.Before(modernAge) {
+		ms |= icmpTimestampNonStandard
+	}
+	return ms
+}
+
+// pinger is the state of an ICMP echo request sent with [PortStack.BeginPing].
+type pinger struct {
+	dst      [4]byte
+	id       uint16
+	seq      uint16
+	sent     time.Time
+	rtt      time.Duration
+	awaiting bool
+	done     bool
+}
+
+// BeginPing sends an ICMP echo request to addr, reachable through the
+// hardware address hwaddr. The result is obtained with [PortStack.PingResult].
+// A previous ping in progress is abandoned.
+func (ps *PortStack) BeginPing(addr netip.Addr, hwaddr [6]byte) error {
+	if !addr.Is4() {
+		return errIPVersion
+	} else if ps.icmp.pending {
+		return errICMPBusy
+	}
+	p := &ps.ping
+	p.id = ps.rand16()
+	p.seq++
+	p.dst = addr.As4()
+	p.awaiting = true
+	p.done = false
+	const datalen = 32
+	msg := ps.icmp.msg[:sizeICMPHeader+datalen]
+	msg[0], msg[1] = byte(eth.ICMPTypeEcho), 0
+	binary.BigEndian.PutUint16(msg[4:], p.id)
+	binary.BigEndian.PutUint16(msg[6:], p.seq)
+	for i := range msg[sizeICMPHeader:] {
+		msg[sizeICMPHeader+i] = 'a' + byte(i%23)
+	}
+	p.sent = ps.now()
+	ps.queueICMP(hwaddr, ps.ip, p.dst, len(msg))
+	return nil
+}
+
+// PingResult returns the round trip time of the last ping started with
+// [PortStack.BeginPing]. It returns an error if the reply has not been received.
+func (ps *PortStack) PingResult() (rtt time.Duration, err error) {
+	p := &ps.ping
+	switch {
+	case p.done:
+		return p.rtt, nil
+	case p.awaiting:
+		return 0, errPingPending
+	}
+	return 0, errNoPing
+}
+
+// recv processes an echo reply received at time rx.
+func (p *pinger) recv(rx time.Time, src [4]byte, msg []byte) {
+	if !p.awaiting || src != p.dst || binary.BigEndian.Uint16(msg[4:]) != p.id ||
+		binary.BigEndian.Uint16(msg[6:]) != p.seq {
+		return // Not a reply to our request.
+	}
+	p.awaiting = false
+	p.done = true
+	p.rtt = rx.Sub(p.sent)
+}
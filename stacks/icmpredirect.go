@@ -0,0 +1,57 @@
+package stacks
+
+import (
+	"log/slog"
+	"net/netip"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// icmpMaxRedirectCode is the highest ICMP redirect code: redirects for the
+// network, host and type of service and network or host (RFC 792).
+const icmpMaxRedirectCode = 3
+
+// recvICMPRedirect processes an ICMP redirect sent by src, a router, for
+// datagrams quoted in msg. As required by RFC 1122 section 3.2.2.2 it is only
+// accepted if src is the current first-hop router to the destination and the
+// new router is on the attached subnet. Network redirects are treated as host
+// redirects since the destination's subnet is not known.
+func (ps *PortStack) recvICMPRedirect(src [4]byte, msg []byte) {
+	var quoted eth.IPv4Header
+	if len(msg) >= sizeICMPHeader+eth.SizeIPv4Header {
+		quoted, _ = eth.DecodeIPv4Header(msg[sizeICMPHeader:])
+	}
+	gw := netip.AddrFrom4([4]byte(msg[4:8]))
+	reason := ps.validateRedirect(src, msg, &quoted, gw)
+	if reason != "" {
+		ps.stats.ICMPRedirectsIgnored++
+		if ps.isLogEnabled(slog.LevelDebug) {
+			ps.debug("ICMP:redirect-ignored", ps.addrAttr("src", src), slog.String("reason", reason))
+		}
+		return
+	}
+	info := ps.dests.update(quoted.Destination, ps.now())
+	info.Gateway = gw
+	ps.stats.ICMPRedirects++
+	ps.info("ICMP:redirect", ps.addrAttr("dst", quoted.Destination), ps.addrAttr("gateway", gw.As4()))
+}
+
+// validateRedirect returns why the redirect in msg sent by src for datagrams
+// such as quoted must be ignored or the empty string if it is to be accepted.
+func (ps *PortStack) validateRedirect(src [4]byte, msg []byte, quoted *eth.IPv4Header, gw netip.Addr) string {
+	switch {
+	case !ps.acceptRedirects:
+		return "disabled"
+	case len(ps.dests.entries) == 0:
+		return "no destination cache"
+	case msg[1] > icmpMaxRedirectCode || len(msg) < sizeICMPHeader+eth.SizeIPv4Header:
+		return "malformed"
+	case !ps.isLocalAddr(quoted.Source):
+		return "not our datagram"
+	case ps.nextHop(quoted.Destination) != src || src == quoted.Destination:
+		return "not from first-hop router"
+	case !ps.subnet.Contains(gw) || ps.isLocalAddr(gw.As4()):
+		return "gateway not on subnet"
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net/netip"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// minMTU is the smallest MTU accepted by SetMTU: the 68 octet datagrams every
+// IPv4 host must be able to forward (RFC 791) plus the Ethernet header.
+const minMTU = eth.SizeEthernetHeader + 68
+
+var (
+	errMTURange   = errors.New("MTU out of range: must be at least 82 and at most the stack's MaxMTU")
+	errBadGateway = errors.New("gateway must be an IPv4 address within an IPv4 subnet")
+)
+
+// SetMTU sets the maximum transmission unit of the interface: the size of the
+// largest frame sent or received, Ethernet header included. It may not exceed
+// [PortStackConfig.MaxMTU] since packet buffers are allocated on creation.
+// Connections established after the change use it to calculate their MSS.
+func (ps *PortStack) SetMTU(mtu uint16) error {
+	if mtu < minMTU || mtu > ps.maxMTU {
+		return errMTURange
+	}
+	ps.info("SetMTU", slog.Uint64("mtu", uint64(mtu)))
+	ps.mtu = mtu
+	return nil
+}
+
+// MaxMTU returns the largest MTU the stack can be configured with. See [PortStack.SetMTU].
+func (ps *PortStack) MaxMTU() uint16 { return ps.maxMTU }
+
+// SetHardwareAddr sets the stack's hardware address, i.e: when the interface
+// is switched or its address is randomized. Remotes learn the new address
+// from ARP traffic or, with address conflict detection enabled, from the
+// announcements sent after the next call to [PortStack.SetAddr].
+func (ps *PortStack) SetHardwareAddr(mac [6]byte) {
+	ps.trace("SetHardwareAddr")
+	ps.mac = mac
+}
+
+// SetGateway sets the default gateway through which destinations outside the
+// directly attached subnet are reached: their frames are sent to the gateway's
+// hardware address resolved with ARP. gateway must be within subnet. A zero
+// gateway removes the default route so all destinations are resolved directly.
+// Sockets given a hardware address explicitly are not affected.
+func (ps *PortStack) SetGateway(gateway netip.Addr, subnet netip.Prefix) error {
+	if !gateway.IsValid() {
+		ps.subnet, ps.subnet4 = netip.Prefix{}, ipv4Prefix{}
+		ps.setGateway(netip.Addr{})
+		return nil
+	} else if !gateway.Is4() || !subnet.Addr().Is4() || !subnet.Contains(gateway) {
+		return errBadGateway
+	}
+	ps.subnet = subnet.Masked()
+	ps.subnet4 = makeIPv4Prefix(ps.subnet)
+	ps.setGateway(gateway)
+	return nil
+}
+
+// setGateway sets the default gateway, which must be invalid or within the subnet.
+func (ps *PortStack) setGateway(gateway netip.Addr) {
+	ps.gateway = gateway
+	ps.gateway4 = [4]byte{}
+	if gateway.IsValid() {
+		ps.gateway4 = gateway.As4()
+	}
+}
+
+// Gateway returns the default gateway and subnet set with [PortStack.SetGateway].
+func (ps *PortStack) Gateway() (gateway netip.Addr, subnet netip.Prefix) {
+	return ps.gateway, ps.subnet
+}
+
+// nextHop returns the address whose hardware address frames destined to addr are sent to.
+func (ps *PortStack) nextHop(addr [4]byte) [4]byte {
+	if ps.gateway4 == [4]byte{} || ps.subnet4.contains(addr) {
+		return addr
+	} else if info := ps.dests.lookup(addr); info != nil && info.Gateway.IsValid() {
+		return info.Gateway.As4() // Redirected. See icmpredirect.go.
+	}
+	return ps.gateway4
+}
+
+// ipv4Prefix is an IPv4 prefix in the form compared per packet: network
+// address and mask as integers. Unlike [netip.Prefix] checking whether it
+// contains an address involves no method calls, which are costly on TinyGo.
+// The zero value contains all addresses.
+type ipv4Prefix struct {
+	addr, mask uint32
+}
+
+// makeIPv4Prefix converts p, which must be a valid IPv4 prefix.
+func makeIPv4Prefix(p netip.Prefix) ipv4Prefix {
+	var mask uint32
+	if bits := p.Bits(); bits > 0 {
+		mask = ^uint32(0) << (32 - bits)
+	}
+	a := p.Addr().As4()
+	return ipv4Prefix{addr: binary.BigEndian.Uint32(a[:]) & mask, mask: mask}
+}
+
+func (p ipv4Prefix) contains(addr [4]byte) bool {
+	return binary.BigEndian.Uint32(addr[:])&p.mask == p.addr
+}
@@ -0,0 +1,152 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// IGMP message types. See RFC 2236.
+const (
+	igmpTypeQuery    = 0x11
+	igmpTypeV1Report = 0x12
+	igmpTypeV2Report = 0x16
+	igmpTypeLeave    = 0x17
+	sizeIGMP         = 8
+	// igmpReports is the amount of unsolicited reports sent when joining a group.
+	igmpReports = 2
+	// igmpUnsolicitedInterval bounds the random delay between unsolicited reports.
+	igmpUnsolicitedInterval = 10 * time.Second
+	// igmpV1MaxResponse is the response delay bound of IGMPv1 queries, which carry none.
+	igmpV1MaxResponse = 10 * time.Second
+	// sizeRouterAlert is the size of the IPv4 Router Alert option (RFC 2113)
+	// carried by all IGMPv2 messages.
+	sizeRouterAlert = 4
+)
+
+var errBadIGMPChecksum = errors.New("invalid IGMP checksum")
+
+var (
+	allHostsGroup   = [4]byte{224, 0, 0, 1}
+	allRoutersGroup = [4]byte{224, 0, 0, 2}
+)
+
+// recvIGMP processes an incoming IGMP message. payload is the IP payload.
+// Queries schedule reports of the groups joined after a random delay and
+// reports of other members suppress ours, as the host side of RFC 2236 section 3.
+func (ps *PortStack) recvIGMP(payload []byte) error {
+	if len(payload) < sizeIGMP {
+		return errPacketSmol
+	}
+	var crc eth.CRC791
+	crc.Write(payload)
+	if crc.Sum16() != 0 {
+		return errBadIGMPChecksum
+	}
+	group := [4]byte(payload[4:8])
+	switch payload[0] {
+	case igmpTypeQuery:
+		maxResp := time.Duration(payload[1]) * 100 * time.Millisecond
+		if maxResp == 0 {
+			maxResp = igmpV1MaxResponse
+		}
+		if ps.isLogEnabled(slog.LevelDebug) {
+			ps.debug("IGMP:query", ps.addrAttr("group", group), slog.Duration("maxresp", maxResp))
+		}
+		now := ps.now()
+		for i := range ps.groups {
+			g := &ps.groups[i]
+			if g.refs == 0 || (group != [4]byte{} && group != g.addr) {
+				continue
+			}
+			at := now.Add(time.Duration(ps.rand32()) % maxResp)
+			if g.reports == 0 || at.Before(g.reportAt) {
+				g.reportAt = at
+			}
+			if g.reports == 0 {
+				g.reports = 1
+			}
+		}
+	case igmpTypeV1Report, igmpTypeV2Report:
+		for i := range ps.groups {
+			if ps.groups[i].refs > 0 && ps.groups[i].addr == group {
+				ps.groups[i].reports = 0 // Another member reported the group.
+			}
+		}
+	}
+	return nil
+}
+
+// igmpPending reports whether an IGMP report or leave is scheduled.
+func (ps *PortStack) igmpPending() bool {
+	for i := range ps.groups {
+		if ps.groups[i].leave || ps.groups[i].reports > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// handleIGMP writes the next due IGMP report or leave message to dst and
+// returns its length, or zero if none is due.
+func (ps *PortStack) handleIGMP(dst []byte) int {
+	now := ps.now()
+	for i := range ps.groups {
+		g := &ps.groups[i]
+		var typ uint8
+		group, to := g.addr, g.addr
+		switch {
+		case g.leave:
+			typ, to = igmpTypeLeave, allRoutersGroup
+			*g = multicastGroup{}
+		case g.reports > 0 && !now.Before(g.reportAt):
+			typ = igmpTypeV2Report
+			g.reports--
+			g.reportAt = now.Add(time.Duration(ps.rand32()) % igmpUnsolicitedInterval)
+		default:
+			continue
+		}
+		if ps.isLogEnabled(slog.LevelDebug) {
+			ps.debug("IGMP:send", slog.Int("type", int(typ)), ps.addrAttr("group", to))
+		}
+		return ps.putIGMP(dst, typ, to, group)
+	}
+	return 0
+}
+
+// putIGMP writes an IGMPv2 message of type typ concerning group to dst,
+// sent to the address to with TTL 1 and the Router Alert option.
+func (ps *PortStack) putIGMP(dst []byte, typ uint8, to, group [4]byte) int {
+	const ipOffset = eth.SizeEthernetHeader
+	const msgOffset = ipOffset + eth.SizeIPv4Header + sizeRouterAlert
+	ehdr := eth.EthernetHeader{
+		Destination:     multicastMAC(to),
+		Source:          ps.mac,
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	ehdr.Put(dst)
+	ihdr := eth.IPv4Header{
+		TotalLength: eth.SizeIPv4Header + sizeRouterAlert + sizeIGMP,
+		ID:          ps.rand16(),
+		TTL:         1,
+		Protocol:    2,
+		Source:      ps.ip,
+		Destination: to,
+	}
+	routerAlert := [sizeRouterAlert]byte{ipOptRouterAlert, sizeRouterAlert, 0, 0}
+	ihdr.PutWithOptions(dst[ipOffset:], routerAlert[:])
+	var crc eth.CRC791
+	crc.Write(dst[ipOffset:msgOffset])
+	binary.BigEndian.PutUint16(dst[ipOffset+10:], crc.Sum16())
+
+	msg := dst[msgOffset : msgOffset+sizeIGMP]
+	msg[0], msg[1], msg[2], msg[3] = typ, 0, 0, 0
+	copy(msg[4:], group[:])
+	crc.Reset()
+	crc.Write(msg)
+	binary.BigEndian.PutUint16(msg[2:], crc.Sum16())
+	return msgOffset + sizeIGMP
+}
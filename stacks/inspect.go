@@ -0,0 +1,59 @@
+package stacks
+
+import (
+	"log/slog"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// Inspection is a received packet that passed validation and is about to be
+// delivered to its handler. See [PortStack.SetInspector].
+type Inspection struct {
+	Eth eth.EthernetHeader
+	// IP is the IPv4 header with options stripped. IP.Protocol selects which of
+	// UDP or TCP is set: 17 and 136 for UDP and UDP-Lite, 6 for TCP. Neither is set for ICMP.
+	IP  eth.IPv4Header
+	UDP eth.UDPHeader
+	TCP eth.TCPHeader
+	// Options holds the TCP options.
+	Options []byte
+	// Payload is the data carried by the transport header, or the ICMP message.
+	Payload []byte
+}
+
+// Inspector examines received packets before delivery and reports whether
+// they are delivered. Inspectors must not modify or retain the packet.
+type Inspector func(pkt *Inspection) (deliver bool)
+
+// SetInspector sets the inspector called with every ICMP, UDP and TCP packet
+// after it passes checksum, ACL and port lookup and before it reaches its handler,
+// i.e: to implement lightweight intrusion detection or protocol specific policy.
+// Vetoed packets are dropped silently and counted in [Health]. The inspector
+// is called synchronously from RecvEth so slow inspectors delay packet
+// processing. A nil inspector delivers all packets.
+func (ps *PortStack) SetInspector(inspector Inspector) {
+	ps.inspector = inspector
+}
+
+// inspect reports whether the packet is delivered and counts vetoed packets.
+// uhdr and thdr may be nil. The inspection is held by the stack to avoid allocating.
+func (ps *PortStack) inspect(ehdr *eth.EthernetHeader, ihdr *eth.IPv4Header, uhdr *eth.UDPHeader, thdr *eth.TCPHeader, options, payload []byte) bool {
+	pkt := &ps.auxInspect
+	*pkt = Inspection{Eth: *ehdr, IP: *ihdr, Options: options, Payload: payload}
+	if uhdr != nil {
+		pkt.UDP = *uhdr
+	}
+	if thdr != nil {
+		pkt.TCP = *thdr
+	}
+	deliver := ps.inspector(pkt)
+	*pkt = Inspection{} // Do not retain packet data.
+	if deliver {
+		return true
+	}
+	ps.rejectedInspect++
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("inspect:veto", ps.addrAttr("src", ihdr.Source), slog.Uint64("proto", uint64(ihdr.Protocol)))
+	}
+	return false
+}
@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"io"
 	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/eth"
 )
 
 func TestRing(t *testing.T) {
@@ -109,6 +114,235 @@ func TestRing2(t *testing.T) {
 	}
 }
 
+func TestRingReadFrom(t *testing.T) {
+	const bufSize = 10
+	const data = "0123456789abcdefghij"
+	rng := rand.New(rand.NewSource(0))
+	r := &ring{buf: make([]byte, bufSize)}
+	for i := 0; i < 64; i++ {
+		nfirst := rng.Intn(bufSize)
+		setRingData(t, r, rng.Intn(bufSize-1), []byte(data[:nfirst]))
+		free := r.Free()
+		src := strings.NewReader(data[nfirst:])
+		// Free space may not be contiguous, fill it with successive calls.
+		for r.Free() > 0 {
+			_, err := r.readFrom(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := r.readFrom(src)
+		if err != errRingBufferFull {
+			t.Fatalf("want errRingBufferFull, got %v", err)
+		}
+		var buf [bufSize]byte
+		n, _ := r.Read(buf[:])
+		if n != nfirst+free || string(buf[:n]) != data[:n] {
+			t.Fatalf("%d: got %q, want %q", i, buf[:n], data[:nfirst+free])
+		}
+	}
+}
+
+func TestRingWriteTo(t *testing.T) {
+	const bufSize = 10
+	const data = "0123456789"
+	rng := rand.New(rand.NewSource(0))
+	r := &ring{buf: make([]byte, bufSize)}
+	for i := 0; i < 64; i++ {
+		n := rng.Intn(bufSize-1) + 1
+		setRingData(t, r, rng.Intn(bufSize-1), []byte(data[:n]))
+		var got bytes.Buffer
+		for r.Buffered() > 0 {
+			_, err := r.writeTo(&got, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got.String() != data[:n] {
+			t.Fatalf("%d: got %q, want %q", i, got.String(), data[:n])
+		}
+		_, err := r.writeTo(&got, 3)
+		if err != io.EOF {
+			t.Fatalf("want EOF on empty ring, got %v", err)
+		}
+	}
+}
+
+func TestUDPLite(t *testing.T) {
+	const port = 5004
+	ps := NewPortStack(PortStackConfig{MAC: [6]byte{0x02, 0, 0, 0, 0, 1}, MTU: defaultMTU, MaxOpenPortsUDP: 1})
+	ps.SetAddr(netip.AddrFrom4([4]byte{10, 0, 0, 1}))
+	var h udpRecorder
+	err := ps.OpenUDPLite(port, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := func(proto uint8, coverage uint16, payload string) []byte {
+		udp := eth.UDPHeader{SourcePort: 4000, DestinationPort: port, Length: coverage}
+		ip := eth.IPv4Header{
+			VersionAndIHL: 5,
+			TotalLength:   uint16(eth.SizeIPv4Header + eth.SizeUDPHeader + len(payload)),
+			TTL:           64,
+			Protocol:      proto,
+			Source:        [4]byte{10, 0, 0, 2},
+			Destination:   [4]byte{10, 0, 0, 1},
+		}
+		ip.Checksum = ip.CalculateChecksum()
+		udp.Checksum = udp.CalculateChecksumLiteIPv4(&ip, []byte(payload))
+		buf := make([]byte, eth.SizeEthernetHeader+int(ip.TotalLength))
+		ehdr := eth.EthernetHeader{Destination: ps.mac, SizeOrEtherType: uint16(eth.EtherTypeIPv4)}
+		ehdr.Put(buf)
+		ip.Put(buf[eth.SizeEthernetHeader:])
+		udp.Put(buf[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+		copy(buf[eth.SizeEthernetHeader+eth.SizeIPv4Header+eth.SizeUDPHeader:], payload)
+		return buf
+	}
+
+	// Full coverage.
+	err = ps.RecvEth(frame(136, 0, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	} else if h.got != "hello" {
+		t.Fatalf("got %q, want %q", h.got, "hello")
+	}
+
+	// Header only coverage: payload corruption is not detected.
+	f := frame(136, 8, "hello")
+	f[len(f)-1] = 'X'
+	err = ps.RecvEth(f)
+	if err != nil {
+		t.Fatal(err)
+	} else if h.got != "hellX" {
+		t.Fatalf("got %q, want partially covered payload", h.got)
+	}
+
+	// Corruption within coverage is detected.
+	f = frame(136, 10, "hello")
+	f[len(f)-4] = 'X'
+	if err = ps.RecvEth(f); err != ErrChecksumTCPorUDP {
+		t.Errorf("got err %v, want checksum error", err)
+	}
+	// Invalid coverage.
+	if err = ps.RecvEth(frame(136, 4, "hello")); err != errBadUDPLength {
+		t.Errorf("got err %v, want bad length error", err)
+	}
+	// Plain UDP does not reach UDP-Lite ports.
+	h.got = ""
+	udp := frame(17, eth.SizeUDPHeader+5, "hello")
+	ip, _ := eth.DecodeIPv4Header(udp[eth.SizeEthernetHeader:])
+	uhdr := eth.DecodeUDPHeader(udp[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	uhdr.Checksum = uhdr.CalculateChecksumIPv4(&ip, []byte("hello"))
+	uhdr.Put(udp[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	if err = ps.RecvEth(udp); err != nil || h.got != "" {
+		t.Errorf("UDP packet delivered to UDP-Lite port: err=%v got=%q", err, h.got)
+	}
+}
+
+// udpRecorder is a UDP handler that records the payload of the last received
+// packet and the amount of times it was asked to send.
+type udpRecorder struct {
+	got   string
+	sends int
+}
+
+func (h *udpRecorder) send(dst []byte) (int, error) { h.sends++; return 0, nil }
+func (h *udpRecorder) recv(pkt *UDPPacket) error    { h.got = string(pkt.Payload()); return nil }
+func (h *udpRecorder) isPendingHandling() bool      { return false }
+func (h *udpRecorder) abort()                       {}
+
+func TestRequestSend(t *testing.T) {
+	ps := NewPortStack(PortStackConfig{MAC: [6]byte{0x02, 0, 0, 0, 0, 1}, MTU: defaultMTU, MaxOpenPortsUDP: 1})
+	ps.SetAddr(netip.AddrFrom4([4]byte{10, 0, 0, 1}))
+	var h udpRecorder
+	err := ps.OpenUDP(1234, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [defaultMTU]byte
+	ps.HandleEth(buf[:])
+	if h.sends != 0 {
+		t.Fatal("handler called without request")
+	}
+	err = ps.RequestSendUDP(1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.HandleEth(buf[:])
+	ps.HandleEth(buf[:])
+	if h.sends != 1 {
+		t.Errorf("want handler called once after request, got %d", h.sends)
+	}
+	if ps.IsPendingHandling() {
+		t.Error("stack pending after request was handled")
+	}
+}
+
+func TestFlowExportIPv6(t *testing.T) {
+	ps := NewPortStack(PortStackConfig{MAC: [6]byte{0x02, 0, 0, 0, 0, 1}, MTU: defaultMTU, MaxOpenPortsUDP: 1, MaxOpenPortsTCP: 1, IPv6: true})
+	ps.SetAddr(netip.AddrFrom4([4]byte{10, 0, 0, 1}))
+	fe, err := NewFlowExporter(ps, FlowExporterConfig{Collector: netip.MustParseAddrPort("10.0.0.2:4739"), LocalPort: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fe.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := flowCount{pktsOut: 1, bytesOut: 100}
+	ps.endFlow(&fc, 17, ps.ip, 1000, netip.MustParseAddrPort("[fe80::1]:2000"))
+	if fe.Queued() != 0 {
+		t.Errorf("IPv6 flow queued for export")
+	}
+	fc = flowCount{pktsOut: 1, bytesOut: 100}
+	ps.endFlow(&fc, 17, ps.ip, 1000, netip.MustParseAddrPort("10.0.0.3:2000"))
+	if fe.Queued() != 1 {
+		t.Errorf("IPv4 flow not queued for export")
+	}
+	conn, err := NewTCPConn(ps, TCPConnConfig{TxBufSize: 64, RxBufSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.OpenDialTCP(1024, [6]byte{}, netip.MustParseAddrPort("[fe80::1]:80"), 100)
+	if err != errIPVersion {
+		t.Errorf("dial of IPv6 remote: got %v, want %v", err, errIPVersion)
+	}
+}
+
+func TestLogAttrs(t *testing.T) {
+	ps := NewPortStack(PortStackConfig{MAC: [6]byte{0x02, 0, 0, 0, 0, 1}, MTU: defaultMTU})
+	addr := ps.addrAttr("addr", [4]byte{10, 0, 0, 1})
+	for i := 0; i < 8; i++ {
+		ps.addrAttr("other", [4]byte{byte(i), 1, 2, 3})
+		ps.macAttr("mac", [6]byte{byte(i)})
+	}
+	// Attributes retained by handlers are not overwritten by later logs.
+	if got := addr.Value.Resolve().String(); got != "10.0.0.1" {
+		t.Errorf("addr=%q, want 10.0.0.1", got)
+	}
+	if got := ps.addrPortAttr("ap", [4]byte{10, 0, 0, 1}, 80).Value.Resolve().String(); got != "10.0.0.1:80" {
+		t.Errorf("addrport=%q, want 10.0.0.1:80", got)
+	}
+	if got := ps.macAttr("mac", [6]byte{0xde, 0xad, 0xbe, 0xef, 0, 1}).Value.Resolve().String(); got != "de:ad:be:ef:00:01" {
+		t.Errorf("mac=%q", got)
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	ps := NewPortStack(PortStackConfig{
+		MAC:     [6]byte{0x02, 0, 0, 0, 0, 1},
+		MTU:     defaultMTU,
+		Entropy: bytes.NewReader([]byte{1, 2, 3, 4, 5, 6}),
+	})
+	if got := ps.rand32(); got != 0x04030201 {
+		t.Errorf("got %#x, want value read from entropy source", got)
+	}
+	// Source exhausted, falls back to pseudo random generator.
+	a, b := ps.rand32(), ps.rand32()
+	if a == 0 || a == b {
+		t.Errorf("fallback generator returned %#x, %#x", a, b)
+	}
+}
+
 func TestRing_findcrash(t *testing.T) {
 	const maxsize = 33
 	const ntests = 800000
@@ -255,7 +489,55 @@ func (tcp *TCPConn) SCB() *seqs.ControlBlock { return &tcp.scb }
 
 func (dhcpc *DHCPClient) PortStack() *PortStack { return dhcpc.stack }
 func (dhcps *DHCPServer) PortStack() *PortStack { return dhcps.stack }
+func (dhcps *DHCPServer) NumHosts() int         { return len(dhcps.hosts) }
+func (dhcps *DHCPServer) HostsCap() int         { return cap(dhcps.hosts) }
+
+// AdvanceTime moves the stack's clock forward by d.
+func (ps *PortStack) AdvanceTime(d time.Duration) { ps.timeadd += d }
 
 func (tcp *TCPConn) RingBuffers() (rx, tx *ring) {
 	return &tcp.rx, &tcp.tx
 }
+
+func TestTimeoutErrors(t *testing.T) {
+	for _, err := range []error{errSynTimeout, errRetransmitTimeout, errKeepaliveTimeout} {
+		nerr, ok := err.(net.Error)
+		if !ok || !nerr.Timeout() {
+			t.Errorf("%q is not a timeout net.Error", err)
+		}
+	}
+}
+
+func TestDHCPStateString(t *testing.T) {
+	for s := DHCPStateNone; s <= DHCPStateDeclining; s++ {
+		if str := s.String(); strings.HasPrefix(str, "DHCPState(") {
+			t.Errorf("DHCP state %d has no name", uint8(s))
+		}
+	}
+	if got := (DHCPStateDeclining + 1).String(); got != "DHCPState(10)" {
+		t.Errorf("got %q for out of range state", got)
+	}
+}
+
+func TestSipHash(t *testing.T) {
+	// Test vectors of the SipHash reference implementation: key 00..0f and messages 00..n-1.
+	var key [16]byte
+	var msg [16]byte
+	for i := range key {
+		key[i] = byte(i)
+		msg[i] = byte(i)
+	}
+	for _, test := range []struct {
+		n    int
+		want uint64
+	}{
+		{n: 0, want: 0x726fdb47dd0e0e31},
+		{n: 7, want: 0xab0200f58b01d137},
+		{n: 8, want: 0x93f5f5799a932462},
+		{n: 15, want: 0xa129ca6149be45e5},
+	} {
+		if got := siphash24(&key, msg[:test.n]); got != test.want {
+			t.Errorf("len %d: got %#x, want %#x", test.n, got, test.want)
+		}
+	}
+}
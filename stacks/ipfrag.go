@@ -0,0 +1,302 @@
+package stacks
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// ipFlagMoreFragments is the IPv4 MF flag.
+const ipFlagMoreFragments eth.IPFlags = 0x2000
+
+const (
+	defaultReassemblyTimeout = 15 * time.Second // RFC 791 recommended initial timer.
+	// maxReassembled is the largest IP payload that can be reassembled.
+	maxReassembled = defaultMTU - eth.SizeEthernetHeader - eth.SizeIPv4Header
+	// maxUDPFragmented is the largest UDP payload sent in fragments.
+	maxUDPFragmented = 0xffff - eth.SizeIPv4Header - eth.SizeUDPHeader
+	// maxFragments is the most fragments a datagram is reassembled from.
+	maxFragments = 16
+	// minFragment is the smallest non-final fragment accepted, the data
+	// carried in a datagram of the 68 octet minimum MTU of RFC 791.
+	minFragment = 68 - eth.SizeIPv4Header
+)
+
+var (
+	errIPFragBad      = errors.New("IP fragment has bad length")
+	errIPFragOverlap  = errors.New("IP fragment overlaps")
+	errIPFragTooLarge = errors.New("IP fragmented datagram too large to reassemble")
+	errIPFragTooMany  = errors.New("IP datagram has too many fragments")
+	errIPFragTiny     = errors.New("IP fragment too small")
+)
+
+// ipReassembly reassembles fragmented IPv4 datagrams as described in RFC 791
+// section 3.2 and RFC 815. A limited amount of datagrams can be reassembled
+// at a time, the oldest is discarded when a fragment of a new datagram
+// arrives. Overlapping fragments discard the datagram to avoid the ambiguity
+// exploited by overlapping fragment attacks, as do datagrams split in more
+// than maxFragments or in non-final fragments smaller than minFragment.
+// Only UDP datagrams are reassembled; TCP segments are sized to avoid
+// fragmentation by the MSS.
+type ipReassembly struct {
+	bufs    []reassemblyBuf
+	timeout time.Duration
+	// dropped counts fragments of datagrams discarded. See [Health].
+	dropped uint32
+	// drops counts fragments of datagrams discarded by reason. See [Stats].
+	drops FragmentDrops
+}
+
+// discard frees buf, counting its fragments and the one being received, if
+// any, as dropped for the reason counted by reason.
+func (r *ipReassembly) discard(buf *reassemblyBuf, received int, reason *uint32) {
+	n := uint32(buf.frags) + uint32(received)
+	r.dropped += n
+	*reason += n
+	buf.started = time.Time{}
+}
+
+type reassemblyBuf struct {
+	src, dst [4]byte
+	id       uint16
+	proto    uint8
+	// started is the time the first fragment was received. Zero if the buffer is free.
+	started time.Time
+	// total is the size of the datagram's payload once the last fragment is received.
+	total    int
+	haveLast bool
+	// frags is the amount of fragments received.
+	frags uint8
+	// blocks is a bitmap of the 8 octet blocks received.
+	blocks [(maxReassembled/8 + 1 + 7) / 8]byte
+	data   [maxReassembled]byte
+}
+
+func (b *reassemblyBuf) matches(ihdr *eth.IPv4Header) bool {
+	return !b.started.IsZero() && b.id == ihdr.ID && b.src == ihdr.Source &&
+		b.dst == ihdr.Destination && b.proto == ihdr.Protocol
+}
+
+// received checks and sets the blocks of the octets in [off, end). It returns
+// false if any of them was already received.
+func (b *reassemblyBuf) received(off, end int) bool {
+	for blk := off / 8; blk*8 < end; blk++ {
+		if b.blocks[blk/8]&(1<<(blk%8)) != 0 {
+			return false
+		}
+		b.blocks[blk/8] |= 1 << (blk % 8)
+	}
+	return true
+}
+
+func (b *reassemblyBuf) complete() bool {
+	if !b.haveLast {
+		return false
+	}
+	for blk := 0; blk*8 < b.total; blk++ {
+		if b.blocks[blk/8]&(1<<(blk%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reassemble stores the fragment with header ihdr and payload. Once the
+// datagram is complete its payload is returned and ihdr is modified to
+// describe the whole datagram. The payload is valid until the next call.
+// A nil payload and nil error are returned while fragments are missing.
+func (ps *PortStack) reassemble(ihdr *eth.IPv4Header, payload []byte) ([]byte, error) {
+	r := &ps.reasm
+	if len(r.bufs) == 0 || (eth.IPProto(ihdr.Protocol) != eth.IPProtoUDP && eth.IPProto(ihdr.Protocol) != eth.IPProtoUDPLite) {
+		return nil, errIPFragment
+	}
+	now := ps.now()
+	var buf *reassemblyBuf
+	oldest := 0
+	for i := range r.bufs {
+		b := &r.bufs[i]
+		if !b.started.IsZero() && now.Sub(b.started) >= r.timeout {
+			ps.debug("IP:reasm-timeout", ps.addrAttr("src", b.src), slog.Uint64("id", uint64(b.id)))
+			r.discard(b, 0, &r.drops.Timeout)
+		}
+		if b.matches(ihdr) {
+			buf = b
+			break
+		} else if b.started.Before(r.bufs[oldest].started) {
+			oldest = i
+		}
+	}
+	off := int(ihdr.Flags.FragmentOffset()) * 8
+	end := off + len(payload)
+	more := ihdr.Flags.MoreFragments()
+	// The fragment is validated before a new datagram takes a buffer so
+	// that bogus fragments can't evict datagrams being reassembled.
+	var err error
+	var reason *uint32
+	switch {
+	case end > maxReassembled:
+		err, reason = errIPFragTooLarge, &r.drops.TooLarge
+	case more && len(payload) < minFragment:
+		err, reason = errIPFragTiny, &r.drops.Tiny
+	case buf != nil && buf.frags >= maxFragments:
+		err, reason = errIPFragTooMany, &r.drops.TooMany
+	case more && len(payload)%8 != 0, len(payload) == 0,
+		buf != nil && buf.haveLast && (end > buf.total || !more):
+		err, reason = errIPFragBad, &r.drops.Malformed
+	case buf != nil && !buf.received(off, end):
+		err, reason = errIPFragOverlap, &r.drops.Overlap
+	}
+	if err != nil {
+		if ps.isLogEnabled(slog.LevelInfo) {
+			ps.info("IP:reasm-drop", ps.addrAttr("src", ihdr.Source), slog.Uint64("id", uint64(ihdr.ID)), slog.String("err", err.Error()))
+		}
+		if buf != nil {
+			r.discard(buf, 1, reason)
+		} else {
+			r.dropped++
+			*reason++
+		}
+		return nil, err
+	}
+	if buf == nil {
+		buf = &r.bufs[oldest]
+		if !buf.started.IsZero() {
+			r.discard(buf, 0, &r.drops.Evicted) // Evict oldest datagram.
+		}
+		*buf = reassemblyBuf{
+			src:     ihdr.Source,
+			dst:     ihdr.Destination,
+			id:      ihdr.ID,
+			proto:   ihdr.Protocol,
+			started: now,
+		}
+		buf.received(off, end)
+	}
+	buf.frags++
+	copy(buf.data[off:], payload)
+	if !more {
+		buf.total = end
+		buf.haveLast = true
+		for blk := (end + 7) / 8; blk < len(buf.blocks)*8; blk++ {
+			if buf.blocks[blk/8]&(1<<(blk%8)) != 0 {
+				// Data received beyond the end of the datagram.
+				r.discard(buf, 0, &r.drops.Malformed)
+				return nil, errIPFragBad
+			}
+		}
+	}
+	if !buf.complete() {
+		return nil, nil
+	}
+	buf.started = time.Time{}
+	ihdr.Flags = 0
+	ihdr.TotalLength = eth.SizeIPv4Header + uint16(buf.total)
+	return buf.data[:buf.total], nil
+}
+
+// udpFrag is the state of a datagram exceeding the MTU being sent as IPv4
+// fragments, one per call to send. The datagram data is read from the
+// socket's transmit buffer as fragments are sent.
+type udpFrag struct {
+	remote    netip.AddrPort
+	remoteMAC [6]byte
+	uhdr      eth.UDPHeader
+	id        uint16
+	// sent and size are the amount of IP payload octets, UDP header included, sent and to send.
+	sent, size int
+}
+
+// beginFragments prepares sending the oldest datagram in the transmit buffer,
+// of length plen, as fragments. Its record must already be discarded.
+func (sock *UDPConn) beginFragments(plen int, remoteMAC [6]byte, remote netip.AddrPort) {
+	ps := sock.stack
+	f := &sock.frag
+	*f = udpFrag{
+		remote:    remote,
+		remoteMAC: remoteMAC,
+		id:        ps.rand16(),
+		size:      eth.SizeUDPHeader + plen,
+		uhdr: eth.UDPHeader{
+			SourcePort:      sock.localPort,
+			DestinationPort: remote.Port(),
+			Length:          uint16(eth.SizeUDPHeader + plen),
+		},
+	}
+	sock.pkt.IP.ID = f.id
+	// The checksum covers the whole datagram, still held in the transmit buffer.
+	var crc eth.CRC791
+	var chunk [64]byte
+	dst := remote.Addr().As4()
+	crc.AddPseudoIPv4(ps.ip, dst, 17, f.uhdr.Length)
+	f.uhdr.Put(chunk[:eth.SizeUDPHeader])
+	crc.Write(chunk[:eth.SizeUDPHeader])
+	for off := 0; off < plen; {
+		n := sock.tx.peek(chunk[:min(plen-off, len(chunk))], off)
+		crc.Write(chunk[:n])
+		off += n
+	}
+	f.uhdr.Checksum = crc.Sum16()
+	if f.uhdr.Checksum == 0 {
+		f.uhdr.Checksum = 0xffff // Zero means no checksum in UDP over IPv4.
+	}
+}
+
+// sendFragment writes the next fragment of the datagram being fragmented to dst.
+func (sock *UDPConn) sendFragment(dst []byte) (int, error) {
+	const headers = eth.SizeEthernetHeader + eth.SizeIPv4Header
+	ps := sock.stack
+	f := &sock.frag
+	n := min(f.size-f.sent, (int(ps.mtu)-headers)&^7) // Non-last fragment data must be a multiple of 8.
+	if headers+n > len(dst) {
+		sock.discardTx(f.size - max(f.sent, eth.SizeUDPHeader))
+		*f = udpFrag{}
+		return 0, io.ErrShortBuffer
+	}
+	more := f.sent+n < f.size
+	ihdr := eth.IPv4Header{
+		Source:        ps.ip,
+		Destination:   f.remote.Addr().As4(),
+		VersionAndIHL: 5,
+		TotalLength:   eth.SizeIPv4Header + uint16(n),
+		Protocol:      uint8(eth.IPProtoUDP),
+		TTL:           64,
+		ID:            f.id,
+		Flags:         eth.IPFlags(f.sent / 8),
+	}
+	if more {
+		ihdr.Flags |= ipFlagMoreFragments
+	}
+	ihdr.Checksum = ihdr.CalculateChecksum()
+	ehdr := eth.EthernetHeader{
+		Destination:     f.remoteMAC,
+		Source:          ps.mac,
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	ehdr.Put(dst)
+	ihdr.Put(dst[eth.SizeEthernetHeader:])
+	data := dst[headers : headers+n]
+	if f.sent == 0 {
+		f.uhdr.Put(data)
+		data = data[eth.SizeUDPHeader:]
+	}
+	sock.tx.Read(data)
+	f.sent += n
+	sock.lastRemote = f.remote
+	if sock.connected && f.remote == sock.remote {
+		sock.flow.onsend(eth.SizeIPv4Header + n)
+	}
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("UDP:send-fragment", slog.Uint64("id", uint64(f.id)), slog.Int("off", f.sent-n), slog.Bool("more", more))
+	}
+	if !more {
+		*f = udpFrag{}
+	}
+	if more || sock.ntx > 0 {
+		return headers + n, ErrFlagPending
+	}
+	return headers + n, nil
+}
@@ -0,0 +1,93 @@
+package stacks
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// IPv4 option types. See RFC 791.
+const (
+	ipOptEnd         = 0
+	ipOptNop         = 1
+	ipOptLooseRoute  = 131
+	ipOptStrictRoute = 137
+	ipOptRouterAlert = 148
+)
+
+var (
+	errBadIPOptions  = errors.New("malformed IPv4 options")
+	errBadIPOptsMode = errors.New("invalid IPv4 options policy")
+)
+
+// IPOptionsPolicy selects how received IPv4 packets carrying options are
+// handled. Options are never honored: they are validated and stripped
+// before the packet reaches the port handlers. The stack only emits the
+// Router Alert option required by IGMP.
+type IPOptionsPolicy uint8
+
+const (
+	// IPOptionsIgnore accepts packets with well formed options and ignores the options.
+	IPOptionsIgnore IPOptionsPolicy = iota
+	// IPOptionsRejectSourceRoute drops packets carrying the loose or strict
+	// source route options, which may be used to bypass address based filtering.
+	IPOptionsRejectSourceRoute
+	// IPOptionsRejectAll drops all packets carrying options.
+	IPOptionsRejectAll
+	numIPOptionsPolicies
+)
+
+// SetIPOptionsPolicy sets how received IPv4 packets with options are handled.
+func (ps *PortStack) SetIPOptionsPolicy(policy IPOptionsPolicy) error {
+	if policy >= numIPOptionsPolicies {
+		return errBadIPOptsMode
+	}
+	ps.ipOptsPolicy = policy
+	return nil
+}
+
+// IPOptionsPolicy returns the policy applied to received IPv4 packets with options.
+func (ps *PortStack) IPOptionsPolicy() IPOptionsPolicy { return ps.ipOptsPolicy }
+
+// checkIPOptions validates the options of a packet received from src and
+// reports whether the packet is accepted by the stack's options policy.
+// Malformed options return an error.
+func (ps *PortStack) checkIPOptions(src [4]byte, opts []byte) (bool, error) {
+	if len(opts) == 0 {
+		return true, nil
+	}
+	accept := ps.ipOptsPolicy != IPOptionsRejectAll
+	for len(opts) > 0 {
+		typ := opts[0]
+		if typ == ipOptEnd {
+			break
+		} else if typ == ipOptNop {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return false, errBadIPOptions
+		}
+		if ps.ipOptsPolicy == IPOptionsRejectSourceRoute && (typ == ipOptLooseRoute || typ == ipOptStrictRoute) {
+			accept = false
+		}
+		opts = opts[opts[1]:]
+	}
+	if !accept {
+		ps.rejectedIPOpts++
+		if ps.isLogEnabled(slog.LevelDebug) {
+			ps.debug("IP:reject-opts", ps.addrAttr("src", src))
+		}
+	}
+	return accept, nil
+}
+
+// stripIPOptions removes the options from hdr. The payload offset of a
+// stripped header no longer matches the received packet.
+func stripIPOptions(hdr *eth.IPv4Header) {
+	optlen := 4*uint16(hdr.IHL()) - eth.SizeIPv4Header
+	hdr.VersionAndIHL = hdr.VersionAndIHL&0xf0 | 5
+	hdr.TotalLength -= optlen
+	hdr.Checksum = hdr.CalculateChecksum()
+}
@@ -0,0 +1,353 @@
+package stacks
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// IPv6 support is limited to what a host on an IPv6-only network needs: a
+// link-local address, addresses configured from router advertised prefixes
+// (SLAAC, RFC 4862), neighbor discovery (RFC 4861), echo replies and UDP
+// sockets. Extension headers are not parsed so packets carrying them are
+// dropped, as are fragments. TCP over IPv6 is not supported yet.
+
+const (
+	nextHeaderICMPv6 = 58
+	nextHeaderUDP    = 17
+	// defaultHopLimit is the hop limit of packets originated by the stack, as the IPv4 TTL.
+	defaultHopLimit = 64
+	// sizeIPv6Frame is the offset of the IPv6 payload in a frame.
+	sizeIPv6Frame = eth.SizeEthernetHeader + eth.SizeIPv6Header
+	// sizeUDPv6NoPayload is the offset of the UDP payload in an IPv6 frame.
+	sizeUDPv6NoPayload = sizeIPv6Frame + eth.SizeUDPHeader
+)
+
+var (
+	errBadICMPv6Checksum = errors.New("invalid ICMPv6 checksum")
+	errNoIPv6Router      = errors.New("no IPv6 router to reach off-link destination")
+)
+
+var (
+	allNodes6   = [16]byte{0: 0xff, 1: 0x02, 15: 1}
+	allRouters6 = [16]byte{0: 0xff, 1: 0x02, 15: 2}
+)
+
+// addr6State is the state of an IPv6 address of the stack.
+type addr6State uint8
+
+const (
+	addr6None addr6State = iota
+	// addr6Tentative addresses are not used until duplicate address detection completes.
+	addr6Tentative
+	addr6Preferred
+)
+
+// ipv6Addr is an IPv6 address assigned to the stack.
+type ipv6Addr struct {
+	addr  [16]byte
+	state addr6State
+	// dadSent is when the duplicate address detection probe was sent. Zero until then.
+	dadSent time.Time
+	// expires is the end of the address' valid lifetime. Zero if infinite.
+	expires time.Time
+}
+
+// ipv6State holds the IPv6 configuration of a PortStack.
+type ipv6State struct {
+	enabled bool
+	// linkLocal is derived from the hardware address, global configured from a
+	// prefix advertised by a router.
+	linkLocal ipv6Addr
+	global    ipv6Addr
+	// router is the default router learned from router advertisements, zero if none.
+	router        [16]byte
+	routerExpires time.Time
+	// rsSent is the amount of router solicitations sent, the last at rsAt.
+	rsSent uint8
+	rsAt   time.Time
+	// neighbors caches resolved hardware addresses. See ndp.go.
+	neighbors [maxNeighbors6]neighbor6
+	// solicit is the address being resolved, for which solicitSent neighbor
+	// solicitations were sent, the last at solicitAt.
+	solicit       [16]byte
+	solicitSent   uint8
+	solicitAt     time.Time
+	solicitFailed bool
+	reply         icmp6Reply
+}
+
+// icmp6Reply holds an outgoing ICMPv6 message generated by the stack in
+// response to an incoming one. Only one reply can be pending at a time.
+type icmp6Reply struct {
+	dstMAC   [6]byte
+	src, dst [16]byte
+	hopLimit uint8
+	msg      [icmpMaxReply]byte
+	n        uint8
+	pending  bool
+}
+
+// enableIPv6 assigns the link-local address and subscribes to the multicast
+// groups of neighbor discovery.
+func (ps *PortStack) enableIPv6() error {
+	ip6 := &ps.ip6
+	ip6.enabled = true
+	ip6.linkLocal = ipv6Addr{addr: linkLocalAddr(ps.mac), state: addr6Tentative}
+	err := ps.JoinMulticastMAC(multicastMAC6(allNodes6))
+	if err != nil {
+		return err
+	}
+	// The global address shares the interface identifier and so the solicited-node group.
+	return ps.JoinMulticastMAC(multicastMAC6(solicitedNode(ip6.linkLocal.addr)))
+}
+
+// Addr6 returns the IPv6 address of the stack: the address configured from a
+// router advertised prefix or, if there is none, the link-local address. It
+// returns the zero value while no address is ready for use or if IPv6 is not
+// enabled. See [PortStackConfig.IPv6].
+func (ps *PortStack) Addr6() netip.Addr {
+	g := &ps.ip6.global
+	if g.state == addr6Preferred && (g.expires.IsZero() || ps.now().Before(g.expires)) {
+		return netip.AddrFrom16(g.addr)
+	}
+	return ps.LinkLocalAddr6()
+}
+
+// LinkLocalAddr6 returns the IPv6 link-local address of the stack, derived
+// from its hardware address. It returns the zero value while duplicate
+// address detection is in progress or if IPv6 is not enabled.
+func (ps *PortStack) LinkLocalAddr6() netip.Addr {
+	if ps.ip6.linkLocal.state != addr6Preferred {
+		return netip.Addr{}
+	}
+	return netip.AddrFrom16(ps.ip6.linkLocal.addr)
+}
+
+// Router6 returns the default IPv6 router learned from router advertisements,
+// or the zero value if none is known.
+func (ps *PortStack) Router6() netip.Addr {
+	if ps.ip6.router == [16]byte{} || !ps.now().Before(ps.ip6.routerExpires) {
+		return netip.Addr{}
+	}
+	return netip.AddrFrom16(ps.ip6.router)
+}
+
+// supportsAddr reports whether the stack can exchange packets with addr.
+func (ps *PortStack) supportsAddr(addr netip.Addr) bool {
+	return addr.Is4() || ps.ip6.enabled && addr.Is6() && !addr.Is4In6()
+}
+
+// isLocalAddr6 reports whether addr is an IPv6 address of the stack ready for use.
+func (ps *PortStack) isLocalAddr6(addr [16]byte) bool {
+	ip6 := &ps.ip6
+	return ip6.linkLocal.state == addr6Preferred && addr == ip6.linkLocal.addr ||
+		ip6.global.state == addr6Preferred && addr == ip6.global.addr
+}
+
+// srcAddr6 returns the source address of packets sent to dst, which is
+// link-local for link scoped destinations as per RFC 6724.
+func (ps *PortStack) srcAddr6(dst [16]byte) [16]byte {
+	linkScope := isLinkLocal6(dst) || dst[0] == 0xff && dst[1]&0xf <= 2
+	if !linkScope && ps.ip6.global.state == addr6Preferred {
+		return ps.ip6.global.addr
+	}
+	return ps.ip6.linkLocal.addr
+}
+
+// recvIPv6 processes a received IPv6 frame.
+func (ps *PortStack) recvIPv6(ehdr *eth.EthernetHeader, frame []byte) error {
+	if len(frame) < sizeIPv6Frame {
+		return errPacketSmol
+	}
+	ip6 := eth.DecodeIPv6Header(frame[eth.SizeEthernetHeader:])
+	end := sizeIPv6Frame + int(ip6.PayloadLength)
+	switch {
+	case ip6.Version() != 6:
+		return errIPVersion
+	case end > len(frame):
+		return errBadIPTotalLenOrIHL
+	case !ps.isLocalAddr6(ip6.Destination) && ip6.Destination != allNodes6 &&
+		ip6.Destination != solicitedNode(ps.ip6.linkLocal.addr):
+		return nil // Not for us.
+	}
+	payload := frame[sizeIPv6Frame:end]
+	switch ip6.NextHeader {
+	case nextHeaderICMPv6:
+		return ps.recvICMPv6(ehdr, &ip6, payload)
+	case nextHeaderUDP:
+		return ps.recvUDPv6(ehdr, &ip6, frame, payload)
+	}
+	if !ps.recvRaw(frame, eth.EtherTypeIPv6, ip6.NextHeader) {
+		return errUnknownIPProto
+	}
+	return nil
+}
+
+// recvICMPv6 processes a received ICMPv6 message.
+func (ps *PortStack) recvICMPv6(ehdr *eth.EthernetHeader, ip6 *eth.IPv6Header, msg []byte) error {
+	if len(msg) < 4 {
+		return errPacketSmol
+	} else if eth.ChecksumICMPv6(ip6.Source, ip6.Destination, msg) != uint16(msg[2])<<8|uint16(msg[3]) {
+		ps.stats.DroppedChecksum++
+		return errBadICMPv6Checksum
+	}
+	switch eth.ICMPv6Type(msg[0]) {
+	case eth.ICMPv6TypeNeighborSolicit:
+		return ps.recvNeighborSolicit(ehdr, ip6, msg)
+	case eth.ICMPv6TypeNeighborAdvert:
+		return ps.recvNeighborAdvert(ip6, msg)
+	case eth.ICMPv6TypeRouterAdvert:
+		return ps.recvRouterAdvert(ip6, msg)
+	case eth.ICMPv6TypeEchoRequest:
+		if ps.icmpResponders&ICMPEcho == 0 || len(msg) > icmpMaxReply || ps.ip6.reply.pending ||
+			!ps.isLocalAddr6(ip6.Destination) {
+			return nil
+		}
+		if ps.isLogEnabled(slog.LevelDebug) {
+			ps.debug("ICMPv6:echo", slog.String("src", netip.AddrFrom16(ip6.Source).String()))
+		}
+		reply := &ps.ip6.reply
+		n := copy(reply.msg[:], msg)
+		reply.msg[0] = byte(eth.ICMPv6TypeEchoReply)
+		ps.queueICMPv6(ehdr.Source, ip6.Destination, ip6.Source, defaultHopLimit, n)
+	}
+	return nil
+}
+
+// queueICMPv6 flags the message of length n held in the reply to be sent.
+func (ps *PortStack) queueICMPv6(dstMAC [6]byte, src, dst [16]byte, hopLimit uint8, n int) {
+	reply := &ps.ip6.reply
+	reply.dstMAC = dstMAC
+	reply.src = src
+	reply.dst = dst
+	reply.hopLimit = hopLimit
+	reply.n = uint8(n)
+	reply.pending = true
+}
+
+// putICMPv6 writes the headers of the ICMPv6 message of length n already
+// written to the payload of the frame in b and returns the frame's length.
+func (ps *PortStack) putICMPv6(b []byte, dstMAC [6]byte, src, dst [16]byte, hopLimit uint8, n int) int {
+	msg := b[sizeIPv6Frame : sizeIPv6Frame+n]
+	msg[2], msg[3] = 0, 0
+	crc := eth.ChecksumICMPv6(src, dst, msg)
+	msg[2], msg[3] = byte(crc>>8), byte(crc)
+	ps.putIPv6(b, dstMAC, src, dst, nextHeaderICMPv6, hopLimit, n)
+	return sizeIPv6Frame + n
+}
+
+// putIPv6 writes the Ethernet and IPv6 headers of a packet carrying plen
+// bytes of protocol next to b.
+func (ps *PortStack) putIPv6(b []byte, dstMAC [6]byte, src, dst [16]byte, next, hopLimit uint8, plen int) {
+	ehdr := eth.EthernetHeader{
+		Destination:     dstMAC,
+		Source:          ps.mac,
+		SizeOrEtherType: uint16(eth.EtherTypeIPv6),
+	}
+	ehdr.Put(b)
+	ip6 := eth.IPv6Header{
+		PayloadLength: uint16(plen),
+		NextHeader:    next,
+		HopLimit:      hopLimit,
+		Source:        src,
+		Destination:   dst,
+	}
+	ip6.Put(b[eth.SizeEthernetHeader:])
+}
+
+// recvUDPv6 delivers a received UDP datagram to the socket open on its port.
+// Only [UDPConn] sockets receive datagrams over IPv6; the stack's services
+// such as DHCP and DNS are IPv4 only.
+func (ps *PortStack) recvUDPv6(ehdr *eth.EthernetHeader, ip6 *eth.IPv6Header, frame, payload []byte) error {
+	if len(payload) < eth.SizeUDPHeader {
+		return errTooShortTCPOrUDP
+	}
+	uhdr := eth.DecodeUDPHeader(payload)
+	if uhdr.DestinationPort == 0 || uhdr.SourcePort == 0 {
+		return errZeroPort
+	} else if uhdr.Length < eth.SizeUDPHeader || int(uhdr.Length) > len(payload) {
+		return errBadUDPLength
+	}
+	payload = payload[eth.SizeUDPHeader:uhdr.Length]
+	// The checksum is mandatory over IPv6 (RFC 8200 section 8.1).
+	if ps.checksumOffload&ChecksumOffloadUDP == 0 &&
+		(uhdr.Checksum == 0 || uhdr.CalculateChecksumIPv6(ip6.Source, ip6.Destination, payload) != uhdr.Checksum) {
+		ps.stats.DroppedChecksum++
+		return ErrChecksumTCPorUDP
+	}
+	port := findPort(ps.portsUDP, uhdr.DestinationPort)
+	var sock *UDPConn
+	if port != nil && !port.lite && len(port.allow) == 0 {
+		sock, _ = port.ihandler.(*UDPConn)
+	}
+	if sock == nil {
+		if !ps.recvRaw(frame, eth.EtherTypeIPv6, nextHeaderUDP) {
+			ps.stats.DroppedNoSocket++
+		}
+		return nil
+	}
+	ps.pendingUDPv4++
+	remote := netip.AddrPortFrom(netip.AddrFrom16(ip6.Source), uhdr.SourcePort)
+	return sock.queueRx(remote, ehdr.Source, payload, ps.lastRx, eth.SizeIPv6Header+int(ip6.PayloadLength))
+}
+
+// send6 writes the queued datagram of plen bytes to remote over IPv6 to dst.
+func (sock *UDPConn) send6(dst []byte, plen int, remoteMAC [6]byte, remote netip.AddrPort) (int, error) {
+	ps := sock.stack
+	if sizeUDPv6NoPayload+plen > len(dst) || sizeUDPv6NoPayload+plen > int(ps.mtu) {
+		sock.discardTx(plen) // IPv6 datagrams are not fragmented.
+		return 0, io.ErrShortBuffer
+	}
+	payload := dst[sizeUDPv6NoPayload : sizeUDPv6NoPayload+plen]
+	sock.tx.Read(payload)
+	raddr := remote.Addr().As16()
+	src := ps.srcAddr6(raddr)
+	uhdr := eth.UDPHeader{
+		SourcePort:      sock.localPort,
+		DestinationPort: remote.Port(),
+		Length:          uint16(eth.SizeUDPHeader + plen),
+	}
+	uhdr.Checksum = uhdr.CalculateChecksumIPv6(src, raddr, payload)
+	if uhdr.Checksum == 0 {
+		uhdr.Checksum = 0xffff // Zero means no checksum, which IPv6 forbids.
+	}
+	uhdr.Put(dst[sizeIPv6Frame:])
+	ps.putIPv6(dst, remoteMAC, src, raddr, nextHeaderUDP, defaultHopLimit, int(uhdr.Length))
+	sock.lastRemote = remote
+	sock.rates.tx.add(ps.now(), plen)
+	if sock.connected && remote == sock.remote {
+		sock.flow.onsend(eth.SizeIPv6Header + int(uhdr.Length))
+	}
+	if sock.ntx > 0 {
+		return sizeUDPv6NoPayload + plen, ErrFlagPending
+	}
+	return sizeUDPv6NoPayload + plen, nil
+}
+
+// linkLocalAddr returns the link-local address with the modified EUI-64
+// interface identifier derived from mac (RFC 4291 appendix A).
+func linkLocalAddr(mac [6]byte) [16]byte {
+	return [16]byte{
+		0: 0xfe, 1: 0x80,
+		8: mac[0] ^ 2, 9: mac[1], 10: mac[2], 11: 0xff,
+		12: 0xfe, 13: mac[3], 14: mac[4], 15: mac[5],
+	}
+}
+
+// solicitedNode returns the solicited-node multicast group of addr (RFC 4291 section 2.7.1).
+func solicitedNode(addr [16]byte) [16]byte {
+	return [16]byte{0: 0xff, 1: 0x02, 11: 1, 12: 0xff, 13: addr[13], 14: addr[14], 15: addr[15]}
+}
+
+// multicastMAC6 returns the hardware address IPv6 multicast group addr maps to (RFC 2464 section 7).
+func multicastMAC6(addr [16]byte) [6]byte {
+	return [6]byte{0x33, 0x33, addr[12], addr[13], addr[14], addr[15]}
+}
+
+func isLinkLocal6(addr [16]byte) bool { return addr[0] == 0xfe && addr[1]&0xc0 == 0x80 }
+func isMulticast6(addr [16]byte) bool { return addr[0] == 0xff }
@@ -0,0 +1,113 @@
+package stacks
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// maxMulticastMACs is the amount of multicast hardware addresses a PortStack can subscribe to.
+const maxMulticastMACs = 8
+
+var (
+	errMulticastFull = errors.New("multicast address list full")
+	errNotMulticast  = errors.New("not a multicast hardware address")
+)
+
+// L2Filter selects which received ethernet frames are accepted by a [PortStack]
+// based on their destination hardware address. Frames addressed to the stack's
+// own unicast address are always accepted. Rejected frames are counted in [Health].
+type L2Filter uint8
+
+const (
+	// L2Broadcast accepts frames sent to the broadcast address.
+	L2Broadcast L2Filter = 1 << iota
+	// L2Multicast accepts frames sent to multicast addresses subscribed to with [PortStack.JoinMulticastMAC].
+	L2Multicast
+	// L2AllMulticast accepts frames sent to any multicast address.
+	L2AllMulticast
+	// L2Promiscuous accepts all frames regardless of destination.
+	L2Promiscuous
+
+	// DefaultL2Filter is used when [PortStackConfig.L2Filter] is not set.
+	DefaultL2Filter = L2Broadcast | L2Multicast
+)
+
+// SetL2Filter sets the destination hardware address filtering mode.
+func (ps *PortStack) SetL2Filter(filter L2Filter) { ps.l2filter = filter }
+
+// L2Filter returns the current destination hardware address filtering mode.
+func (ps *PortStack) L2Filter() L2Filter { return ps.l2filter }
+
+// JoinMulticastMAC subscribes the stack to frames addressed to the multicast hardware address mac.
+// Frames are only accepted if the [L2Multicast] filter is set.
+func (ps *PortStack) JoinMulticastMAC(mac [6]byte) error {
+	if mac[0]&1 == 0 {
+		return errNotMulticast
+	}
+	for i := 0; i < ps.nmulticast; i++ {
+		if ps.multicast[i] == mac {
+			return nil // Already subscribed.
+		}
+	}
+	if ps.nmulticast == len(ps.multicast) {
+		return errMulticastFull
+	}
+	ps.multicast[ps.nmulticast] = mac
+	ps.nmulticast++
+	err := ps.programMulticast()
+	if err != nil {
+		ps.nmulticast--
+		ps.multicast[ps.nmulticast] = [6]byte{}
+		ps.programMulticast() // Restore previous hardware filter.
+	}
+	return err
+}
+
+// LeaveMulticastMAC unsubscribes the stack from the multicast hardware address mac.
+func (ps *PortStack) LeaveMulticastMAC(mac [6]byte) {
+	for i := 0; i < ps.nmulticast; i++ {
+		if ps.multicast[i] == mac {
+			ps.nmulticast--
+			ps.multicast[i] = ps.multicast[ps.nmulticast]
+			ps.multicast[ps.nmulticast] = [6]byte{}
+			err := ps.programMulticast()
+			if err != nil {
+				ps.error("L2:program-multicast", slog.String("err", err.Error()))
+			}
+			return
+		}
+	}
+}
+
+// programMulticast passes the subscribed multicast addresses to the
+// [PortStackConfig.MulticastFilter] hook, if set.
+func (ps *PortStack) programMulticast() error {
+	if ps.multicastFilter == nil {
+		return nil
+	}
+	return ps.multicastFilter(ps.multicast[:ps.nmulticast])
+}
+
+// acceptL2 reports whether a frame with destination hardware address dst passes the L2 filter.
+func (ps *PortStack) acceptL2(dst [6]byte) bool {
+	filter := ps.l2filter
+	switch {
+	case dst == ps.mac || filter&L2Promiscuous != 0:
+		return true
+	case dst == eth.BroadcastHW6():
+		return filter&L2Broadcast != 0
+	case dst[0]&1 == 0:
+		return false // Unicast to another host.
+	case filter&L2AllMulticast != 0:
+		return true
+	case filter&L2Multicast != 0:
+		for i := 0; i < ps.nmulticast; i++ {
+			if ps.multicast[i] == dst {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/soypat/seqs/eth/lldp"
+)
+
+// lldpMaxField is the amount of bytes kept of each received LLDP identifier and string.
+const lldpMaxField = 32
+
+var (
+	errBadLLDPTable = errors.New("negative LLDP neighbor table size")
+	errBadLLDPDU    = errors.New("LLDP data unit missing mandatory TLVs")
+)
+
+// LLDPNeighbor is a neighbor discovered from LLDP data units received by a
+// [PortStack], usually the switch port the device is plugged into.
+// See [PortStack.LLDPNeighbors].
+type LLDPNeighbor struct {
+	// MAC is the source hardware address of the data units.
+	MAC [6]byte
+	// ChassisID identifies the neighbor device and PortID the neighbor's port
+	// the data units are sent from. Hardware and network addresses are
+	// formatted in their usual notation, other subtypes as text.
+	ChassisID, PortID string
+	// PortDescription and SystemName are empty if not advertised.
+	PortDescription, SystemName string
+	// TTL is the time remaining until the entry expires if no new data unit is received.
+	TTL time.Duration
+}
+
+// lldpNeighbor is an entry of the neighbor table. IDs hold the subtype in
+// their first byte. Fields longer than lldpMaxField are truncated.
+type lldpNeighbor struct {
+	mac     [6]byte
+	expires time.Time
+	chassis [lldpMaxField]byte
+	port    [lldpMaxField]byte
+	desc    [lldpMaxField]byte
+	name    [lldpMaxField]byte
+	// Lengths of the fields above.
+	nchassis, nport, ndesc, nname uint8
+}
+
+// SetLLDP enables reception of LLDP data units (IEEE 802.1AB) and keeps a
+// table of up to maxNeighbors neighbors, allocated on this call, so
+// installers can confirm remotely which switch port a device is plugged into.
+// Entries expire after the time to live advertised by the neighbor. The
+// stack subscribes to the LLDP multicast address. Calling SetLLDP with
+// maxNeighbors equal to zero disables LLDP and frees the table.
+func (ps *PortStack) SetLLDP(maxNeighbors int) error {
+	if maxNeighbors < 0 {
+		return errBadLLDPTable
+	} else if maxNeighbors == 0 {
+		ps.lldp = nil
+		ps.LeaveMulticastMAC(lldp.MulticastNearestBridge)
+		return nil
+	}
+	err := ps.JoinMulticastMAC(lldp.MulticastNearestBridge)
+	if err != nil {
+		return err
+	}
+	ps.lldp = make([]lldpNeighbor, maxNeighbors)
+	return nil
+}
+
+// LLDPNeighbors returns the neighbors discovered over LLDP whose entries have not expired.
+func (ps *PortStack) LLDPNeighbors() []LLDPNeighbor {
+	return ps.AppendLLDPNeighbors(nil)
+}
+
+// AppendLLDPNeighbors appends the entries returned by [PortStack.LLDPNeighbors] to dst and returns the result.
+func (ps *PortStack) AppendLLDPNeighbors(dst []LLDPNeighbor) []LLDPNeighbor {
+	now := ps.now()
+	for i := range ps.lldp {
+		n := &ps.lldp[i]
+		if !n.expires.After(now) {
+			continue
+		}
+		dst = append(dst, LLDPNeighbor{
+			MAC:             n.mac,
+			ChassisID:       lldpID(n.chassis[:n.nchassis], lldp.ChassisMACAddress, lldp.ChassisNetworkAddress),
+			PortID:          lldpID(n.port[:n.nport], lldp.PortMACAddress, lldp.PortNetworkAddress),
+			PortDescription: string(n.desc[:n.ndesc]),
+			SystemName:      string(n.name[:n.nname]),
+			TTL:             n.expires.Sub(now),
+		})
+	}
+	return dst
+}
+
+// WriteLLDPNeighbors writes the LLDP neighbor table to w as a plain text table.
+func (ps *PortStack) WriteLLDPNeighbors(w io.Writer) error {
+	_, err := w.Write(AppendLLDPTable(nil, ps.LLDPNeighbors()))
+	return err
+}
+
+// AppendLLDPTable appends neighbors to b formatted as a table.
+func AppendLLDPTable(b []byte, neighbors []LLDPNeighbor) []byte {
+	b = append(b, "Chassis ID               Port ID          TTL    System Name      Port Description\n"...)
+	for i := range neighbors {
+		n := &neighbors[i]
+		b = appendPadded(b, n.ChassisID, 24, false)
+		b = append(b, ' ')
+		b = appendPadded(b, n.PortID, 16, false)
+		b = append(b, ' ')
+		b = appendPadded(b, strconv.Itoa(int(n.TTL/time.Second)), 6, false)
+		b = append(b, ' ')
+		b = appendPadded(b, n.SystemName, 16, false)
+		b = append(b, ' ')
+		b = append(b, n.PortDescription...)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// recvLLDP updates the neighbor table with the LLDP data unit in payload sent from src.
+func (ps *PortStack) recvLLDP(src [6]byte, payload []byte) error {
+	if ps.lldp == nil {
+		return nil
+	}
+	var chassis, port, desc, name []byte
+	ttl := -1
+	err := lldp.ForEachTLV(payload, func(typ lldp.TLVType, value []byte) error {
+		switch typ {
+		case lldp.TLVChassisID:
+			chassis = value
+		case lldp.TLVPortID:
+			port = value
+		case lldp.TLVTimeToLive:
+			if len(value) == 2 {
+				ttl = int(binary.BigEndian.Uint16(value))
+			}
+		case lldp.TLVPortDescription:
+			desc = value
+		case lldp.TLVSystemName:
+			name = value
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if len(chassis) < 2 || len(port) < 2 || ttl < 0 {
+		return errBadLLDPDU
+	}
+	now := ps.now()
+	// Neighbors are identified by their chassis and port IDs.
+	var entry, free *lldpNeighbor
+	for i := range ps.lldp {
+		n := &ps.lldp[i]
+		if !n.expires.After(now) {
+			if free == nil {
+				free = n
+			}
+		} else if string(n.chassis[:n.nchassis]) == string(truncLLDP(chassis)) && string(n.port[:n.nport]) == string(truncLLDP(port)) {
+			entry = n
+			break
+		}
+	}
+	if ttl == 0 {
+		// Shutdown data unit: neighbor is going away.
+		if entry != nil {
+			entry.expires = time.Time{}
+		}
+		return nil
+	}
+	if entry == nil {
+		entry = free
+	}
+	if entry == nil {
+		// Table full, replace the entry closest to expiry.
+		entry = &ps.lldp[0]
+		for i := range ps.lldp {
+			if ps.lldp[i].expires.Before(entry.expires) {
+				entry = &ps.lldp[i]
+			}
+		}
+	}
+	entry.mac = src
+	entry.expires = now.Add(time.Duration(ttl) * time.Second)
+	entry.nchassis = uint8(copy(entry.chassis[:], chassis))
+	entry.nport = uint8(copy(entry.port[:], port))
+	entry.ndesc = uint8(copy(entry.desc[:], desc))
+	entry.nname = uint8(copy(entry.name[:], name))
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("LLDP:neighbor", slog.String("port", lldpID(entry.port[:entry.nport], lldp.PortMACAddress, lldp.PortNetworkAddress)), slog.Int("ttl", ttl))
+	}
+	return nil
+}
+
+func truncLLDP(b []byte) []byte {
+	if len(b) > lldpMaxField {
+		return b[:lldpMaxField]
+	}
+	return b
+}
+
+// lldpID formats a chassis or port ID whose first byte is the subtype.
+func lldpID(id []byte, macSubtype, addrSubtype uint8) string {
+	if len(id) < 2 {
+		return ""
+	}
+	subtype, value := id[0], id[1:]
+	switch {
+	case subtype == macSubtype && len(value) == 6:
+		return net.HardwareAddr(value).String()
+	case subtype == addrSubtype && len(value) == 5 && value[0] == 1: // IANA address family 1: IPv4.
+		return netip.AddrFrom4([4]byte(value[1:])).String()
+	}
+	return string(value)
+}
@@ -0,0 +1,51 @@
+package stacks
+
+import (
+	"log/slog"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// Addresses are logged as [slog.LogValuer]s, formatted only once a handler
+// processes the record, so that logs of disabled levels do not pay for
+// formatting and every record owns its strings regardless of the goroutine
+// logging it.
+
+type logAddr [4]byte
+
+func (a logAddr) LogValue() slog.Value {
+	var buf [len("255.255.255.255")]byte
+	return slog.StringValue(string(eth.AppendAddr(buf[:0], a)))
+}
+
+type logAddrPort struct {
+	addr [4]byte
+	port uint16
+}
+
+func (a logAddrPort) LogValue() slog.Value {
+	var buf [len("255.255.255.255:65535")]byte
+	return slog.StringValue(string(eth.AppendAddrPort(buf[:0], a.addr, a.port)))
+}
+
+type logMAC [6]byte
+
+func (mac logMAC) LogValue() slog.Value {
+	var buf [len("ff:ff:ff:ff:ff:ff")]byte
+	return slog.StringValue(string(eth.AppendMAC(buf[:0], mac)))
+}
+
+// addrAttr returns a log attribute for the IPv4 address addr.
+func (ps *PortStack) addrAttr(key string, addr [4]byte) slog.Attr {
+	return slog.Any(key, logAddr(addr))
+}
+
+// addrPortAttr returns a log attribute for the IPv4 address addr and port.
+func (ps *PortStack) addrPortAttr(key string, addr [4]byte, port uint16) slog.Attr {
+	return slog.Any(key, logAddrPort{addr: addr, port: port})
+}
+
+// macAttr returns a log attribute for the hardware address mac.
+func (ps *PortStack) macAttr(key string, mac [6]byte) slog.Attr {
+	return slog.Any(key, logMAC(mac))
+}
@@ -0,0 +1,452 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/eth/dns"
+)
+
+const (
+	// MDNSPort is the UDP port of multicast DNS (RFC 6762).
+	MDNSPort        = 5353
+	maxMDNSServices = 15
+	// mdnsHostTTL and mdnsOtherTTL are the TTLs recommended for records
+	// holding host names and for other records in RFC 6762 section 10.
+	mdnsHostTTL  = 120
+	mdnsOtherTTL = 75 * 60
+	// mdnsLegacyTTL caps the TTL of answers to legacy unicast queries (RFC 6762 section 6.7).
+	mdnsLegacyTTL = 10
+	// mdnsCacheFlush is the class bit marking unique records in responses.
+	mdnsCacheFlush = 1 << 15
+	// mdnsAnnouncements is the amount of unsolicited responses sent on start, one second apart.
+	mdnsAnnouncements = 2
+	// recA is the record bit of the host's address record. Other bits are given by [mdnsRecord].
+	recA = 1 << 0
+)
+
+// Records of a service: the service type enumeration PTR, the instance PTR, SRV and TXT records.
+const (
+	recEnum = iota
+	recPTR
+	recSRV
+	recTXT
+	recsPerService
+)
+
+// mdnsGroup is the IPv4 multicast DNS group 224.0.0.251.
+var mdnsGroup = [4]byte{224, 0, 0, 251}
+
+// mdnsServicesName is the service type enumeration name (RFC 6763 section 9).
+var mdnsServicesName = mustEncodeName("_services._dns-sd._udp.local")
+
+var (
+	errMDNSHostname    = errors.New("mDNS hostname must be a single label")
+	errMDNSServices    = errors.New("too many mDNS services")
+	errMDNSServiceType = errors.New("mDNS service type must be of the form _service._tcp or _service._udp")
+)
+
+// MDNSService is a DNS-SD (RFC 6763) service advertised by an [MDNSResponder].
+type MDNSService struct {
+	// Instance is the user visible name of the service instance, i.e: "Living room printer".
+	Instance string
+	// Type is the service type and protocol, i.e: "_http._tcp".
+	Type string
+	// Port is the port the service listens on.
+	Port uint16
+	// TXT holds the key=value strings of the instance's TXT record.
+	TXT []string
+}
+
+// MDNSResponderConfig configures an [MDNSResponder].
+type MDNSResponderConfig struct {
+	// Hostname is the single label host name answered as <Hostname>.local. If
+	// empty the first label of the stack's hostname is used. See [PortStack.SetHostname].
+	Hostname string
+	// Services are the services advertised.
+	Services []MDNSService
+}
+
+// mdnsService holds the encoded names and data of a [MDNSService].
+type mdnsService struct {
+	typ, instance, txt []byte
+	port               uint16
+}
+
+// MDNSResponder answers multicast DNS (RFC 6762) queries for the stack's
+// address as <hostname>.local and for DNS-SD services, so devices can be
+// discovered without DHCP or DNS infrastructure. A, PTR, SRV and TXT queries
+// are answered. Records are announced on start. Probing for name conflicts and
+// known answer suppression are not implemented. Queries asking for unicast
+// responses are answered via multicast, which RFC 6762 allows.
+type MDNSResponder struct {
+	stack    *PortStack
+	host     []byte
+	services []mdnsService
+	pkt      UDPPacket
+	q        dns.Question
+	namebuf  []byte
+	// Pending response: the records answered and those added as additional records.
+	ans, add uint64
+	// Legacy unicast query state, answered directly to the querier with the query's ID and questions.
+	legacy       bool
+	legacyID     uint16
+	legacyQD     uint16
+	legacyQs     []byte
+	legacyDst    netip.AddrPort
+	legacyHW     [6]byte
+	announce     uint8
+	nextAnnounce time.Time
+	running      bool
+	answered     uint32
+}
+
+// NewMDNSResponder creates a multicast DNS responder for stack. Queries are
+// answered once [MDNSResponder.Start] is called.
+func NewMDNSResponder(stack *PortStack, cfg MDNSResponderConfig) (*MDNSResponder, error) {
+	if cfg.Hostname == "" {
+		cfg.Hostname, _, _ = strings.Cut(stack.Hostname(), ".")
+	}
+	if cfg.Hostname == "" || strings.IndexByte(cfg.Hostname, '.') >= 0 {
+		return nil, errMDNSHostname
+	} else if len(cfg.Services) > maxMDNSServices {
+		return nil, errMDNSServices
+	}
+	host, err := encodeName(cfg.Hostname + ".local")
+	if err != nil {
+		return nil, err
+	}
+	m := &MDNSResponder{stack: stack, host: host}
+	for _, svc := range cfg.Services {
+		_, proto, _ := strings.Cut(svc.Type, ".")
+		if !strings.HasPrefix(svc.Type, "_") || (proto != "_tcp" && proto != "_udp") {
+			return nil, errMDNSServiceType
+		} else if svc.Port == 0 {
+			return nil, errZeroPort
+		}
+		typ, err := encodeName(svc.Type + ".local")
+		if err != nil {
+			return nil, err
+		}
+		var instance dns.Name
+		if !instance.CanAddLabel(svc.Instance) {
+			return nil, errors.New("invalid mDNS instance name " + svc.Instance)
+		}
+		instance.AddLabel(svc.Instance)
+		inst, _ := instance.AppendTo(nil)
+		inst = append(inst[:len(inst)-1], typ...) // Instance names may hold dots.
+		var txt []byte
+		for _, s := range svc.TXT {
+			if len(s) > 255 {
+				return nil, errors.New("mDNS TXT string too long")
+			}
+			txt = append(txt, byte(len(s)))
+			txt = append(txt, s...)
+		}
+		if len(txt) == 0 {
+			txt = []byte{0} // RFC 6763 section 6.1: empty TXT records hold a single empty string.
+		}
+		m.services = append(m.services, mdnsService{typ: typ, instance: inst, txt: txt, port: svc.Port})
+	}
+	return m, nil
+}
+
+// Start joins the multicast DNS group, opens the responder's port and announces the records.
+func (m *MDNSResponder) Start() error {
+	err := m.stack.joinGroup(netip.AddrFrom4(mdnsGroup))
+	if err != nil {
+		return err
+	}
+	err = m.stack.OpenUDP(MDNSPort, m)
+	if err != nil {
+		m.stack.leaveGroup(netip.AddrFrom4(mdnsGroup))
+		return err
+	}
+	m.running = true
+	m.announce = mdnsAnnouncements
+	m.nextAnnounce = time.Time{}
+	m.stack.info("MDNS:start", slog.String("host", m.hostname()))
+	return m.stack.RequestSendUDP(MDNSPort)
+}
+
+// Stop stops answering queries, closes the responder's port and leaves the multicast DNS group.
+func (m *MDNSResponder) Stop() error {
+	if !m.running {
+		return nil
+	}
+	m.abort()
+	return m.stack.CloseUDP(MDNSPort)
+}
+
+// Answered returns the amount of queries answered.
+func (m *MDNSResponder) Answered() uint32 { return m.answered }
+
+func (m *MDNSResponder) hostname() string {
+	name := dns.Name{}
+	name.Decode(m.host, 0)
+	return name.String()
+}
+
+func (m *MDNSResponder) recv(pkt *UDPPacket) error {
+	if !m.running {
+		return io.EOF
+	}
+	payload := pkt.Payload()
+	if len(payload) < dns.SizeHeader {
+		return nil
+	}
+	hdr := dns.DecodeHeader(payload)
+	if hdr.Flags.IsResponse() || hdr.Flags.OpCode() != dns.OpCodeQuery {
+		return nil // Responses of other hosts are not checked for conflicts.
+	}
+	legacy := pkt.UDP.SourcePort != MDNSPort
+	if m.ans != 0 && (legacy || m.legacy) {
+		return ErrDroppedPacket // Only multicast responses are aggregated.
+	}
+	if legacy {
+		m.legacyQs = m.legacyQs[:0]
+		m.legacyQD = 0
+	}
+	var ans, add uint64
+	off := uint16(dns.SizeHeader)
+	for i := uint16(0); i < hdr.QDCount; i++ {
+		var err error
+		off, err = m.q.Decode(payload, off)
+		if err != nil {
+			return err
+		}
+		qans, qadd := m.match(&m.q)
+		if qans != 0 && legacy {
+			m.legacyQs, _ = m.q.Name.AppendTo(m.legacyQs)
+			m.legacyQs = binary.BigEndian.AppendUint16(m.legacyQs, uint16(m.q.Type))
+			m.legacyQs = binary.BigEndian.AppendUint16(m.legacyQs, uint16(m.q.Class)&^mdnsCacheFlush)
+			m.legacyQD++
+		}
+		ans |= qans
+		add |= qadd
+	}
+	if ans == 0 {
+		return nil
+	}
+	m.ans |= ans
+	m.add = (m.add | add) &^ m.ans
+	m.legacy = legacy
+	if legacy {
+		m.legacyID = hdr.TransactionID
+		m.legacyDst = netip.AddrPortFrom(netip.AddrFrom4(pkt.IP.Source), pkt.UDP.SourcePort)
+		m.legacyHW = pkt.Eth.Source
+	}
+	m.stack.debug("MDNS:query", m.stack.addrAttr("src", pkt.IP.Source), slog.Bool("legacy", legacy))
+	return nil
+}
+
+// match returns the records answering q and the additional records recommended for them.
+func (m *MDNSResponder) match(q *dns.Question) (ans, add uint64) {
+	var err error
+	m.namebuf, err = q.Name.AppendTo(m.namebuf[:0])
+	if err != nil {
+		return 0, 0
+	}
+	name := m.namebuf
+	anyType := q.Type == dns.TypeALL
+	if nameEqual(name, m.host) {
+		if (q.Type == dns.TypeA || anyType) && m.stack.ip != [4]byte{} {
+			ans |= recA
+		}
+		return ans, 0
+	}
+	isServices := nameEqual(name, mdnsServicesName)
+	for i := range m.services {
+		svc := &m.services[i]
+		switch {
+		case isServices && (q.Type == dns.TypePTR || anyType):
+			ans |= mdnsRecord(i, recEnum)
+		case nameEqual(name, svc.typ) && (q.Type == dns.TypePTR || anyType):
+			ans |= mdnsRecord(i, recPTR)
+			add |= mdnsRecord(i, recSRV) | mdnsRecord(i, recTXT) | recA
+		case nameEqual(name, svc.instance):
+			if q.Type == dns.TypeSRV || anyType {
+				ans |= mdnsRecord(i, recSRV)
+				add |= recA
+			}
+			if q.Type == dns.TypeTXT || anyType {
+				ans |= mdnsRecord(i, recTXT)
+			}
+		}
+	}
+	return ans, add
+}
+
+// mdnsRecord returns the record bit of service i's record rec.
+func mdnsRecord(i, rec int) uint64 { return 1 << (1 + recsPerService*i + rec) }
+
+func (m *MDNSResponder) send(dst []byte) (int, error) {
+	const payloadoffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+	if !m.running {
+		return 0, io.EOF
+	}
+	ans, add, legacy := m.ans, m.add, m.legacy
+	now := m.stack.now()
+	if ans != 0 {
+		m.ans, m.add, m.legacy = 0, 0, false
+		m.answered++
+	} else if m.announce > 0 && !now.Before(m.nextAnnounce) {
+		m.announce--
+		m.nextAnnounce = now.Add(time.Second)
+		if m.stack.ip != [4]byte{} {
+			ans = recA
+		}
+		for i := range m.services {
+			ans |= mdnsRecord(i, recPTR) | mdnsRecord(i, recSRV) | mdnsRecord(i, recTXT)
+		}
+	}
+	if ans == 0 {
+		return 0, nil
+	}
+	limit := min(len(dst), int(m.stack.mtu))
+	if limit < payloadoffset+dns.SizeHeader {
+		return 0, io.ErrShortBuffer
+	}
+	payload := dst[payloadoffset:limit]
+	hdr := dns.Header{Flags: 1<<15 | 1<<10} // Authoritative response.
+	n := dns.SizeHeader
+	if legacy && len(m.legacyQs) <= len(payload)-n {
+		hdr.TransactionID = m.legacyID
+		hdr.QDCount = m.legacyQD
+		n += copy(payload[n:], m.legacyQs)
+	} else if legacy {
+		hdr.TransactionID = m.legacyID
+	}
+	n, hdr.ANCount = m.putRecords(payload, n, ans, legacy)
+	n, hdr.ARCount = m.putRecords(payload, n, add, legacy)
+	hdr.Put(payload)
+
+	dstAddr, dstHW, dport := mdnsGroup, multicastMAC(mdnsGroup), uint16(MDNSPort)
+	if legacy {
+		dstAddr, dstHW, dport = m.legacyDst.Addr().As4(), m.legacyHW, m.legacyDst.Port()
+	}
+	const ipv4ToS = 0
+	m.stack.setUDP(&m.pkt, dstHW, m.stack.ip, dstAddr, ipv4ToS, payload[:n], MDNSPort, dport)
+	if !legacy {
+		// RFC 6762 section 11: multicast responses are sent with IP TTL 255.
+		m.pkt.IP.TTL = 255
+		m.pkt.IP.Checksum = 0
+		m.pkt.IP.Checksum = m.pkt.IP.CalculateChecksum()
+	}
+	m.pkt.PutHeaders(dst)
+	return payloadoffset + n, nil
+}
+
+// putRecords puts the records selected by the bits of recs in payload at
+// offset n while they fit and returns the offset after them and the amount put.
+func (m *MDNSResponder) putRecords(payload []byte, n int, recs uint64, legacy bool) (_ int, count uint16) {
+	for bit := 0; recs != 0 && bit < 64; bit++ {
+		if recs&(1<<bit) == 0 {
+			continue
+		}
+		recs &^= 1 << bit
+		var name, rdata []byte
+		var srv [6]byte
+		typ, ttl, unique := dns.TypePTR, uint32(mdnsOtherTTL), false
+		if bit == 0 {
+			name, rdata, typ, ttl, unique = m.host, m.stack.ip[:], dns.TypeA, mdnsHostTTL, true
+		} else {
+			svc := &m.services[(bit-1)/recsPerService]
+			switch (bit - 1) % recsPerService {
+			case recEnum:
+				name, rdata = mdnsServicesName, svc.typ
+			case recPTR:
+				name, rdata = svc.typ, svc.instance
+			case recSRV:
+				binary.BigEndian.PutUint16(srv[4:], svc.port) // Zero priority and weight.
+				name, rdata, typ, ttl, unique = svc.instance, srv[:], dns.TypeSRV, mdnsHostTTL, true
+			case recTXT:
+				name, rdata, typ, unique = svc.instance, svc.txt, dns.TypeTXT, true
+			}
+		}
+		extra := 0
+		if typ == dns.TypeSRV {
+			extra = len(m.host)
+		}
+		size := len(name) + 10 + len(rdata) + extra
+		if n+size > len(payload) {
+			m.stack.debug("MDNS:truncated", slog.Int("record", bit))
+			continue
+		}
+		class := uint16(dns.ClassINET)
+		if legacy {
+			ttl = mdnsLegacyTTL
+		} else if unique {
+			class |= mdnsCacheFlush
+		}
+		n += copy(payload[n:], name)
+		binary.BigEndian.PutUint16(payload[n:], uint16(typ))
+		binary.BigEndian.PutUint16(payload[n+2:], class)
+		binary.BigEndian.PutUint32(payload[n+4:], ttl)
+		binary.BigEndian.PutUint16(payload[n+8:], uint16(len(rdata)+extra))
+		n += 10
+		n += copy(payload[n:], rdata)
+		if typ == dns.TypeSRV {
+			n += copy(payload[n:], m.host)
+		}
+		count++
+	}
+	return n, count
+}
+
+func (m *MDNSResponder) isPendingHandling() bool {
+	return m.running && (m.ans != 0 || m.announce > 0)
+}
+
+func (m *MDNSResponder) abort() {
+	if m.running {
+		m.stack.leaveGroup(netip.AddrFrom4(mdnsGroup))
+	}
+	m.running = false
+	m.ans, m.add, m.legacy = 0, 0, false
+	m.announce = 0
+}
+
+// encodeName returns the wire format of the domain name s.
+func encodeName(s string) ([]byte, error) {
+	name, err := dns.NewName(s)
+	if err != nil {
+		return nil, err
+	}
+	return name.AppendTo(nil)
+}
+
+func mustEncodeName(s string) []byte {
+	b, err := encodeName(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// nameEqual reports whether the uncompressed wire format names a and b are
+// equal, ignoring ASCII case as DNS names are compared.
+func nameEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		ca, cb := a[i], b[i]
+		if 'A' <= ca && ca <= 'Z' {
+			ca += 'a' - 'A'
+		}
+		if 'A' <= cb && cb <= 'Z' {
+			cb += 'a' - 'A'
+		}
+		if ca != cb {
+			return false
+		}
+	}
+	return true
+}
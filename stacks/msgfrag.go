@@ -0,0 +1,148 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// SizeMessageChunkHeader is the size of the header preceding the data of each
+// chunk written by [MessageSplitter]: message identifier, chunk index, chunk
+// count and offset of the chunk's data within the message.
+const SizeMessageChunkHeader = 6
+
+const maxMessageChunks = 255
+
+var (
+	errMsgChunkSize   = errors.New("message chunk size must exceed chunk header")
+	errMsgTooLong     = errors.New("message needs more than 255 chunks")
+	errMsgChunkHeader = errors.New("short or malformed message chunk")
+	errMsgTooLarge    = errors.New("reassembled message exceeds buffer")
+)
+
+// MessageSplitter splits messages too large for a single datagram, such as
+// those exceeding the path MTU, into numbered chunks written as separate
+// datagrams. The peer reassembles them with a [MessageReassembler]. Unlike IP
+// fragmentation chunks are ordinary datagrams, so a lost chunk loses the
+// whole message and retransmission is left to the application protocol.
+type MessageSplitter struct {
+	w   io.Writer
+	buf []byte
+	id  uint16
+}
+
+// NewMessageSplitter returns a splitter writing chunks of up to datagramSize
+// bytes, header included, to w. w is usually a connected [UDPConn], each
+// Write call sending a single datagram.
+func NewMessageSplitter(w io.Writer, datagramSize int) (*MessageSplitter, error) {
+	if datagramSize <= SizeMessageChunkHeader || datagramSize > maxUDPFragmented {
+		return nil, errMsgChunkSize
+	}
+	return &MessageSplitter{w: w, buf: make([]byte, datagramSize)}, nil
+}
+
+// Write writes msg as one or more chunks sharing a new message identifier.
+// It returns len(msg) if all chunks were written.
+func (s *MessageSplitter) Write(msg []byte) (int, error) {
+	chunkData := len(s.buf) - SizeMessageChunkHeader
+	count := (len(msg) + chunkData - 1) / chunkData
+	if count == 0 {
+		count = 1 // Empty messages are sent as a single empty chunk.
+	}
+	if count > maxMessageChunks || len(msg) > 0xffff {
+		return 0, errMsgTooLong
+	}
+	s.id++
+	for i := 0; i < count; i++ {
+		off := i * chunkData
+		data := msg[off:min(off+chunkData, len(msg))]
+		binary.BigEndian.PutUint16(s.buf[0:], s.id)
+		s.buf[2] = byte(i)
+		s.buf[3] = byte(count)
+		binary.BigEndian.PutUint16(s.buf[4:], uint16(off))
+		n := copy(s.buf[SizeMessageChunkHeader:], data)
+		_, err := s.w.Write(s.buf[:SizeMessageChunkHeader+n])
+		if err != nil {
+			return off, err
+		}
+	}
+	return len(msg), nil
+}
+
+// MessageReassembler reassembles messages split into chunks by a
+// [MessageSplitter]. Chunks may arrive in any order and duplicates are
+// ignored. One message is reassembled at a time: a chunk of another message
+// discards the partially reassembled one.
+type MessageReassembler struct {
+	buf []byte
+	id  uint16
+	// got flags the chunks received of the message being reassembled.
+	got    [(maxMessageChunks + 63) / 64]uint64
+	ngot   uint8
+	count  uint8
+	length int
+	active bool
+	// complete is set once the message identified by id is reassembled.
+	complete bool
+	// discarded counts messages discarded before being completed.
+	discarded int
+}
+
+// NewMessageReassembler returns a reassembler for messages of up to maxMessageSize bytes.
+func NewMessageReassembler(maxMessageSize int) *MessageReassembler {
+	return &MessageReassembler{buf: make([]byte, maxMessageSize)}
+}
+
+// Reassemble processes a received chunk and returns the message it completes.
+// msg is nil while chunks are missing and is only valid until the next call.
+func (r *MessageReassembler) Reassemble(chunk []byte) (msg []byte, err error) {
+	if len(chunk) < SizeMessageChunkHeader || chunk[3] == 0 || chunk[2] >= chunk[3] {
+		return nil, errMsgChunkHeader
+	}
+	id := binary.BigEndian.Uint16(chunk[0:])
+	index, count := chunk[2], chunk[3]
+	off := int(binary.BigEndian.Uint16(chunk[4:]))
+	data := chunk[SizeMessageChunkHeader:]
+	if off+len(data) > len(r.buf) {
+		r.reset()
+		return nil, errMsgTooLarge
+	}
+	if r.complete && id == r.id {
+		return nil, nil // Duplicate chunk of the last message.
+	} else if !r.active || id != r.id || count != r.count {
+		if r.active {
+			r.discarded++
+		}
+		r.reset()
+		r.active = true
+		r.id = id
+		r.count = count
+	}
+	word, bit := index/64, uint64(1)<<(index%64)
+	if r.got[word]&bit != 0 {
+		return nil, nil // Duplicate chunk.
+	}
+	r.got[word] |= bit
+	r.ngot++
+	copy(r.buf[off:], data)
+	if index == count-1 {
+		r.length = off + len(data)
+	}
+	if r.ngot < r.count {
+		return nil, nil
+	}
+	r.active = false
+	r.complete = true
+	return r.buf[:r.length], nil
+}
+
+// Discarded returns the amount of messages discarded with chunks missing.
+func (r *MessageReassembler) Discarded() int { return r.discarded }
+
+func (r *MessageReassembler) reset() {
+	r.got = [len(r.got)]uint64{}
+	r.ngot = 0
+	r.length = 0
+	r.active = false
+	r.complete = false
+}
@@ -0,0 +1,132 @@
+package stacks
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// maxMulticastGroups is the amount of IPv4 multicast groups a PortStack can be a member of.
+const maxMulticastGroups = 4
+
+var (
+	errGroupsFull   = errors.New("multicast group list full")
+	errNotGroupAddr = errors.New("not an IPv4 multicast address")
+)
+
+// multicastGroup is an IPv4 multicast group the stack receives datagrams sent to.
+type multicastGroup struct {
+	addr [4]byte
+	// refs counts the sockets and services that joined the group.
+	refs uint8
+	// reports is the amount of IGMP membership reports pending, the next sent at reportAt. See igmp.go.
+	reports  uint8
+	reportAt time.Time
+	// leave is set when the group was left and the IGMP leave message is pending.
+	leave bool
+}
+
+// multicastMAC returns the hardware address IPv4 multicast group addr maps
+// to as per RFC 1112: the low 23 bits of the group in 01:00:5e:00:00:00.
+func multicastMAC(addr [4]byte) [6]byte {
+	return [6]byte{0x01, 0x00, 0x5e, addr[1] & 0x7f, addr[2], addr[3]}
+}
+
+func isMulticastAddr(addr [4]byte) bool { return addr[0]&0xf0 == 224 }
+
+// joinGroup makes the stack accept IPv4 datagrams sent to group, subscribing
+// to its hardware address and reporting the membership to multicast routers
+// with IGMP. Joins are counted so that each must be paired with a call to leaveGroup.
+func (ps *PortStack) joinGroup(group netip.Addr) error {
+	if !group.Is4() || !isMulticastAddr(group.As4()) || group.As4() == allHostsGroup {
+		return errNotGroupAddr
+	}
+	addr := group.As4()
+	free := -1
+	for i := range ps.groups {
+		g := &ps.groups[i]
+		if g.leave && g.addr == addr {
+			g.leave = false // Rejoined before the leave message was sent.
+		}
+		switch {
+		case g.refs > 0 && g.addr == addr:
+			g.refs++
+			return nil
+		case g.refs > 0:
+		case free < 0 || ps.groups[free].leave && !g.leave:
+			free = i // Prefer slots without a pending leave message.
+		}
+	}
+	if free < 0 {
+		return errGroupsFull
+	}
+	err := ps.JoinMulticastMAC(multicastMAC(addr))
+	if err == nil {
+		// Queries are sent to the all-hosts group.
+		err = ps.JoinMulticastMAC(multicastMAC(allHostsGroup))
+	}
+	if err != nil {
+		ps.leaveGroupMAC(addr)
+		return err
+	}
+	ps.groups[free] = multicastGroup{addr: addr, refs: 1, reports: igmpReports, reportAt: ps.now()}
+	return nil
+}
+
+// leaveGroup undoes a call to joinGroup. The stack stops accepting datagrams
+// sent to group once all joins are undone.
+func (ps *PortStack) leaveGroup(group netip.Addr) {
+	if !group.Is4() {
+		return
+	}
+	addr := group.As4()
+	for i := range ps.groups {
+		g := &ps.groups[i]
+		if g.refs == 0 || g.addr != addr {
+			continue
+		}
+		g.refs--
+		if g.refs > 0 {
+			return
+		}
+		*g = multicastGroup{addr: addr, leave: true}
+		ps.leaveGroupMAC(addr)
+		return
+	}
+}
+
+// leaveGroupMAC unsubscribes from the hardware address of group unless it is
+// shared with another group joined, and from the all-hosts group once no group is joined.
+func (ps *PortStack) leaveGroupMAC(group [4]byte) {
+	mac := multicastMAC(group)
+	shared, joined := false, false
+	for i := range ps.groups {
+		g := &ps.groups[i]
+		if g.refs > 0 && g.addr != group {
+			joined = true
+			shared = shared || multicastMAC(g.addr) == mac
+		}
+	}
+	if !shared {
+		ps.LeaveMulticastMAC(mac)
+	}
+	if !joined {
+		ps.LeaveMulticastMAC(multicastMAC(allHostsGroup))
+	}
+}
+
+// isGroupMember reports whether the stack joined the multicast group addr.
+// All hosts are members of the all-hosts group 224.0.0.1.
+func (ps *PortStack) isGroupMember(addr [4]byte) bool {
+	if !isMulticastAddr(addr) {
+		return false
+	} else if addr == allHostsGroup {
+		return true
+	}
+	for i := range ps.groups {
+		if ps.groups[i].refs > 0 && ps.groups[i].addr == addr {
+			return true
+		}
+	}
+	return false
+}
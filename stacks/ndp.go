@@ -0,0 +1,374 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// Neighbor discovery (RFC 4861) and stateless address autoconfiguration (RFC 4862).
+
+const (
+	ndpOptSourceLinkAddr = 1
+	ndpOptTargetLinkAddr = 2
+	ndpOptPrefixInfo     = 3
+	// ndpHopLimit is the hop limit of neighbor discovery messages. Messages
+	// received with any other were forwarded by a router and are discarded.
+	ndpHopLimit = 255
+	// sizeNDPNeighbor is the size of neighbor solicitations and advertisements without options.
+	sizeNDPNeighbor      = 24
+	sizeNDPRouterSolicit = 8
+	sizeNDPRouterAdvert  = 16
+	sizeNDPLinkAddrOpt   = 8
+	sizeNDPPrefixOpt     = 32
+	// Neighbor advertisement flags.
+	ndpFlagSolicited = 0x40
+	ndpFlagOverride  = 0x20
+	// Prefix information option flags.
+	ndpFlagOnLink     = 0x80
+	ndpFlagAutonomous = 0x40
+	// Protocol constants of RFC 4861 section 10.
+	maxRtrSolicitations     = 3
+	rtrSolicitationInterval = 4 * time.Second
+	maxMulticastSolicit     = 3
+	retransTimer            = time.Second
+	// maxNeighbors6 is the size of the IPv6 neighbor cache.
+	maxNeighbors6 = 4
+	// neighborTTL6 is the time a resolved hardware address is cached. Reachability
+	// of neighbors is not confirmed, so it matches the default ARP cache TTL.
+	neighborTTL6 = 5 * time.Minute
+)
+
+// neighbor6 is an entry of the IPv6 neighbor cache.
+type neighbor6 struct {
+	addr    [16]byte
+	hw      [6]byte
+	expires time.Time
+}
+
+// recvNeighborSolicit answers neighbor solicitations for the stack's addresses
+// and detects duplicates of tentative addresses.
+func (ps *PortStack) recvNeighborSolicit(ehdr *eth.EthernetHeader, ip6 *eth.IPv6Header, msg []byte) error {
+	if ip6.HopLimit != ndpHopLimit || len(msg) < sizeNDPNeighbor || msg[1] != 0 {
+		return nil
+	}
+	target := [16]byte(msg[8:24])
+	unspecified := ip6.Source == [16]byte{}
+	if a := ps.addr6(target); a != nil && a.state == addr6Tentative {
+		if unspecified {
+			ps.duplicateAddr6(a) // Another host is probing for the same address.
+		}
+		return nil
+	} else if !ps.isLocalAddr6(target) || ps.ip6.reply.pending {
+		return nil
+	}
+	var hw [6]byte
+	if opt := ndpOption(msg[sizeNDPNeighbor:], ndpOptSourceLinkAddr); len(opt) >= sizeNDPLinkAddrOpt && !unspecified {
+		hw = [6]byte(opt[2:8])
+		ps.updateNeighbor(ip6.Source, hw, ps.lastRx, true)
+	}
+	reply := &ps.ip6.reply
+	na := reply.msg[:sizeNDPNeighbor+sizeNDPLinkAddrOpt]
+	na[0], na[1] = byte(eth.ICMPv6TypeNeighborAdvert), 0
+	na[4], na[5], na[6], na[7] = ndpFlagSolicited|ndpFlagOverride, 0, 0, 0
+	copy(na[8:24], target[:])
+	na[24], na[25] = ndpOptTargetLinkAddr, 1
+	copy(na[26:32], ps.mac[:])
+	dst, dstMAC := ip6.Source, ehdr.Source
+	if unspecified {
+		// Reply to duplicate address detection goes to all nodes, unsolicited.
+		na[4] = ndpFlagOverride
+		dst, dstMAC = allNodes6, multicastMAC6(allNodes6)
+	}
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("NDP:advertise", slog.String("target", netip.AddrFrom16(target).String()))
+	}
+	ps.queueICMPv6(dstMAC, target, dst, ndpHopLimit, len(na))
+	return nil
+}
+
+// recvNeighborAdvert caches the hardware address advertised for a neighbor
+// and detects duplicates of tentative addresses.
+func (ps *PortStack) recvNeighborAdvert(ip6 *eth.IPv6Header, msg []byte) error {
+	if ip6.HopLimit != ndpHopLimit || len(msg) < sizeNDPNeighbor || msg[1] != 0 {
+		return nil
+	}
+	target := [16]byte(msg[8:24])
+	if a := ps.addr6(target); a != nil {
+		ps.duplicateAddr6(a)
+		return nil
+	}
+	opt := ndpOption(msg[sizeNDPNeighbor:], ndpOptTargetLinkAddr)
+	if len(opt) < sizeNDPLinkAddrOpt {
+		return nil
+	}
+	ip := &ps.ip6
+	solicited := target == ip.solicit
+	ps.updateNeighbor(target, [6]byte(opt[2:8]), ps.lastRx, solicited)
+	if solicited {
+		ip.solicit = [16]byte{}
+		ip.solicitSent = 0
+	}
+	return nil
+}
+
+// recvRouterAdvert learns the default router and configures a global address
+// from prefixes advertised for autonomous configuration.
+func (ps *PortStack) recvRouterAdvert(ip6 *eth.IPv6Header, msg []byte) error {
+	if ip6.HopLimit != ndpHopLimit || len(msg) < sizeNDPRouterAdvert || msg[1] != 0 || !isLinkLocal6(ip6.Source) {
+		return nil
+	}
+	now := ps.lastRx
+	ip := &ps.ip6
+	opts := msg[sizeNDPRouterAdvert:]
+	if opt := ndpOption(opts, ndpOptSourceLinkAddr); len(opt) >= sizeNDPLinkAddrOpt {
+		ps.updateNeighbor(ip6.Source, [6]byte(opt[2:8]), now, true)
+	}
+	lifetime := time.Duration(binary.BigEndian.Uint16(msg[6:8])) * time.Second
+	if lifetime > 0 {
+		if ip.router != ip6.Source {
+			ps.info("NDP:router", slog.String("addr", netip.AddrFrom16(ip6.Source).String()))
+		}
+		ip.router = ip6.Source
+		ip.routerExpires = now.Add(lifetime)
+	} else if ip.router == ip6.Source {
+		ip.router = [16]byte{} // Router no longer default.
+	}
+	for len(opts) >= 8 && opts[1] != 0 {
+		optLen := int(opts[1]) * 8
+		if optLen > len(opts) {
+			break
+		}
+		if opts[0] == ndpOptPrefixInfo && optLen >= sizeNDPPrefixOpt {
+			ps.recvPrefixInfo(opts[:optLen], now)
+		}
+		opts = opts[optLen:]
+	}
+	return nil
+}
+
+// recvPrefixInfo configures a global address from a prefix information option
+// as per RFC 4862 section 5.5.3. Only a single global address is configured.
+func (ps *PortStack) recvPrefixInfo(opt []byte, now time.Time) {
+	prefixLen, flags := opt[2], opt[3]
+	valid := binary.BigEndian.Uint32(opt[4:8])
+	preferred := binary.BigEndian.Uint32(opt[8:12])
+	prefix := [16]byte(opt[16:32])
+	if flags&ndpFlagAutonomous == 0 || prefixLen != 64 || isLinkLocal6(prefix) || preferred > valid {
+		return
+	}
+	g := &ps.ip6.global
+	addr := prefix
+	copy(addr[8:], ps.ip6.linkLocal.addr[8:]) // Same interface identifier as the link-local address.
+	if g.state != addr6None && g.addr != addr {
+		return // A global address was already configured from another prefix.
+	}
+	const minLifetime = 2 * time.Hour
+	infinite := valid == 0xffffffff
+	lifetime := time.Duration(valid) * time.Second
+	if g.state == addr6None {
+		if valid == 0 {
+			return
+		}
+		ps.info("SLAAC:configure", slog.String("addr", netip.AddrFrom16(addr).String()))
+		*g = ipv6Addr{addr: addr, state: addr6Tentative}
+	} else if !infinite && lifetime <= minLifetime && (g.expires.IsZero() || lifetime <= g.expires.Sub(now)) {
+		// Unauthenticated advertisements may not shorten the valid lifetime below 2 hours.
+		if g.expires.IsZero() || g.expires.Sub(now) > minLifetime {
+			g.expires = now.Add(minLifetime)
+		}
+		return
+	}
+	g.expires = time.Time{}
+	if !infinite {
+		g.expires = now.Add(lifetime)
+	}
+}
+
+// addr6 returns the address of the stack equal to addr, tentative or not, or nil.
+func (ps *PortStack) addr6(addr [16]byte) *ipv6Addr {
+	ip := &ps.ip6
+	switch {
+	case ip.linkLocal.state != addr6None && ip.linkLocal.addr == addr:
+		return &ip.linkLocal
+	case ip.global.state != addr6None && ip.global.addr == addr:
+		return &ip.global
+	}
+	return nil
+}
+
+// duplicateAddr6 handles the detection of a duplicate of an address of the
+// stack. Tentative addresses are not assigned. Addresses in use are kept,
+// which RFC 4862 allows, and the conflict is logged.
+func (ps *PortStack) duplicateAddr6(a *ipv6Addr) {
+	ps.error("NDP:duplicate-address", slog.String("addr", netip.AddrFrom16(a.addr).String()), slog.Bool("tentative", a.state == addr6Tentative))
+	if a.state == addr6Tentative {
+		*a = ipv6Addr{}
+	}
+}
+
+// updateNeighbor sets the hardware address of neighbor addr. If insert is false
+// only an existing entry is updated, so that unsolicited messages do not
+// evict entries in use.
+func (ps *PortStack) updateNeighbor(addr [16]byte, hw [6]byte, now time.Time, insert bool) {
+	oldest := 0
+	for i := range ps.ip6.neighbors {
+		n := &ps.ip6.neighbors[i]
+		if n.addr == addr {
+			n.hw = hw
+			n.expires = now.Add(neighborTTL6)
+			return
+		} else if n.expires.Before(ps.ip6.neighbors[oldest].expires) {
+			oldest = i
+		}
+	}
+	if insert {
+		ps.ip6.neighbors[oldest] = neighbor6{addr: addr, hw: hw, expires: now.Add(neighborTTL6)}
+	}
+}
+
+// lookupNeighbor returns the cached hardware address of neighbor addr.
+func (ps *PortStack) lookupNeighbor(addr [16]byte, now time.Time) ([6]byte, bool) {
+	for i := range ps.ip6.neighbors {
+		n := &ps.ip6.neighbors[i]
+		if n.addr == addr && now.Before(n.expires) {
+			return n.hw, true
+		}
+	}
+	return [6]byte{}, false
+}
+
+// resolve6 returns the hardware address packets to addr are sent to without
+// blocking, as arpClient.resolve does for IPv4. Off-link destinations are
+// reached through the default router.
+func (ps *PortStack) resolve6(addr [16]byte) ([6]byte, error) {
+	ip := &ps.ip6
+	if isMulticast6(addr) {
+		return multicastMAC6(addr), nil
+	}
+	onLink := isLinkLocal6(addr) || ip.global.state != addr6None && [8]byte(addr[:8]) == [8]byte(ip.global.addr[:8])
+	if !onLink {
+		if ip.router == [16]byte{} {
+			return [6]byte{}, errNoIPv6Router
+		}
+		addr = ip.router
+	}
+	now := ps.now()
+	if hw, ok := ps.lookupNeighbor(addr, now); ok {
+		return hw, nil
+	}
+	switch {
+	case ip.solicit == addr && ip.solicitFailed && now.Sub(ip.solicitAt) < retransTimer:
+		return [6]byte{}, errARPTimeout
+	case ip.solicit != [16]byte{} && !ip.solicitFailed:
+		return [6]byte{}, errARPResponsePending // Resolution of addr or another address in progress.
+	}
+	ip.solicit = addr
+	ip.solicitSent = 0
+	ip.solicitFailed = false
+	return [6]byte{}, errARPResponsePending
+}
+
+// ipv6Pending reports whether neighbor discovery messages are pending to be sent.
+func (ps *PortStack) ipv6Pending() bool {
+	ip := &ps.ip6
+	return ip.enabled && (ip.reply.pending || ip.linkLocal.state == addr6Tentative ||
+		ip.global.state == addr6Tentative || ip.solicit != [16]byte{} && !ip.solicitFailed ||
+		ip.linkLocal.state == addr6Preferred && ip.router == [16]byte{} && ip.rsSent < maxRtrSolicitations)
+}
+
+// handleIPv6 writes the next due ICMPv6 message to dst and returns its length,
+// or zero if none is due. It also expires addresses and the default router.
+func (ps *PortStack) handleIPv6(dst []byte) int {
+	ip := &ps.ip6
+	if !ip.enabled {
+		return 0
+	}
+	now := ps.now()
+	if g := &ip.global; g.state != addr6None && !g.expires.IsZero() && !now.Before(g.expires) {
+		ps.info("SLAAC:expire", slog.String("addr", netip.AddrFrom16(g.addr).String()))
+		*g = ipv6Addr{}
+	}
+	if ip.router != [16]byte{} && !now.Before(ip.routerExpires) {
+		ip.router = [16]byte{}
+	}
+	if reply := &ip.reply; reply.pending {
+		reply.pending = false
+		copy(dst[sizeIPv6Frame:], reply.msg[:reply.n])
+		return ps.putICMPv6(dst, reply.dstMAC, reply.src, reply.dst, reply.hopLimit, int(reply.n))
+	}
+	for _, a := range [2]*ipv6Addr{&ip.linkLocal, &ip.global} {
+		if a.state != addr6Tentative {
+			continue
+		} else if a.dadSent.IsZero() {
+			// Duplicate address detection probe (RFC 4862 section 5.4.2).
+			a.dadSent = now
+			return ps.putNeighborSolicit(dst, [16]byte{}, a.addr)
+		} else if now.Sub(a.dadSent) >= retransTimer {
+			a.state = addr6Preferred
+			ps.info("NDP:address-ready", slog.String("addr", netip.AddrFrom16(a.addr).String()))
+		}
+	}
+	if ip.linkLocal.state == addr6Preferred && ip.router == [16]byte{} && ip.rsSent < maxRtrSolicitations &&
+		(ip.rsSent == 0 || now.Sub(ip.rsAt) >= rtrSolicitationInterval) {
+		ip.rsSent++
+		ip.rsAt = now
+		return ps.putRouterSolicit(dst)
+	}
+	if ip.solicit != [16]byte{} && !ip.solicitFailed && (ip.solicitSent == 0 || now.Sub(ip.solicitAt) >= retransTimer) {
+		if ip.solicitSent >= maxMulticastSolicit {
+			ps.error("NDP:unresolved", slog.String("addr", netip.AddrFrom16(ip.solicit).String()))
+			ip.solicitFailed = true
+			return 0
+		} else if ip.linkLocal.state == addr6Preferred {
+			ip.solicitSent++
+			ip.solicitAt = now
+			return ps.putNeighborSolicit(dst, ps.srcAddr6(ip.solicit), ip.solicit)
+		}
+	}
+	return 0
+}
+
+// putNeighborSolicit writes a neighbor solicitation for target from src to dst.
+// A zero src probes for a duplicate of a tentative address.
+func (ps *PortStack) putNeighborSolicit(dst []byte, src, target [16]byte) int {
+	msg := dst[sizeIPv6Frame:]
+	n := sizeNDPNeighbor
+	msg[0], msg[1] = byte(eth.ICMPv6TypeNeighborSolicit), 0
+	msg[4], msg[5], msg[6], msg[7] = 0, 0, 0, 0
+	copy(msg[8:24], target[:])
+	if src != [16]byte{} {
+		msg[24], msg[25] = ndpOptSourceLinkAddr, 1
+		copy(msg[26:32], ps.mac[:])
+		n += sizeNDPLinkAddrOpt
+	}
+	group := solicitedNode(target)
+	return ps.putICMPv6(dst, multicastMAC6(group), src, group, ndpHopLimit, n)
+}
+
+// putRouterSolicit writes a router solicitation to all routers.
+func (ps *PortStack) putRouterSolicit(dst []byte) int {
+	msg := dst[sizeIPv6Frame:]
+	msg[0], msg[1] = byte(eth.ICMPv6TypeRouterSolicit), 0
+	msg[4], msg[5], msg[6], msg[7] = 0, 0, 0, 0
+	msg[8], msg[9] = ndpOptSourceLinkAddr, 1
+	copy(msg[10:16], ps.mac[:])
+	return ps.putICMPv6(dst, multicastMAC6(allRouters6), ps.ip6.linkLocal.addr, allRouters6, ndpHopLimit, sizeNDPRouterSolicit+sizeNDPLinkAddrOpt)
+}
+
+// ndpOption returns the first option of type typ in opts, or nil.
+func ndpOption(opts []byte, typ uint8) []byte {
+	for len(opts) >= 8 && opts[1] != 0 {
+		optLen := int(opts[1]) * 8
+		if optLen > len(opts) {
+			return nil
+		} else if opts[0] == typ {
+			return opts[:optLen]
+		}
+		opts = opts[optLen:]
+	}
+	return nil
+}
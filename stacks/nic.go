@@ -0,0 +1,138 @@
+package stacks
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+const defaultNICInterval = time.Millisecond
+
+var errNICNoWait = errors.New("NIC does not implement NICWaiter for notify mode")
+
+// LinkStatus is the state of the physical link of a [NIC].
+type LinkStatus uint8
+
+const (
+	// LinkDown means no frames can be sent or received.
+	LinkDown LinkStatus = iota
+	// LinkUp means the NIC is connected and able to send and receive frames.
+	LinkUp
+)
+
+// String returns "down" or "up".
+func (ls LinkStatus) String() string {
+	switch ls {
+	case LinkDown:
+		return "down"
+	case LinkUp:
+		return "up"
+	}
+	return "LinkStatus(" + strconv.Itoa(int(ls)) + ")"
+}
+
+// NIC is implemented by Ethernet and Wi-Fi drivers so the stack can be
+// serviced by [PortStack.ServiceNIC] or [PortStack.RunNIC] instead of each
+// integration wiring buffers into RecvEth and HandleEth by hand.
+type NIC interface {
+	// ReadFrame reads the next received frame into dst and returns its
+	// length, or zero if no frame is available. It must not block.
+	ReadFrame(dst []byte) (int, error)
+	// WriteFrame writes the Ethernet frame to the wire. frame must not be retained.
+	WriteFrame(frame []byte) error
+	// HardwareAddr6 returns the hardware address of the NIC.
+	HardwareAddr6() [6]byte
+	// LinkStatus returns the current state of the link.
+	LinkStatus() LinkStatus
+}
+
+// NICWaiter is implemented by NICs that signal received frames, usually from
+// an interrupt handler, so the main loop sleeps between frames instead of
+// polling. See [NICNotify].
+type NICWaiter interface {
+	// Wait blocks until a frame is available to ReadFrame or timeout elapses
+	// and reports whether a frame is available.
+	Wait(timeout time.Duration) (bool, error)
+}
+
+// NICMode is the receive mode of [PortStack.RunNIC].
+type NICMode uint8
+
+const (
+	// NICPoll checks the NIC for frames every [NICLoopConfig.Interval].
+	NICPoll NICMode = iota
+	// NICNotify waits on the NIC for frames, see [NICWaiter]. The wait is
+	// bounded by [NICLoopConfig.Interval] so the stack's timers are serviced.
+	NICNotify
+)
+
+// NICLoopConfig configures [PortStack.RunNIC].
+type NICLoopConfig struct {
+	Mode NICMode
+	// Interval is the time slept between cycles in poll mode and the maximum
+	// time waited for a frame in notify mode. If zero 1 millisecond is used.
+	Interval time.Duration
+	// Budget limits the work done every cycle. See [PortStack.Poll].
+	Budget PollBudget
+}
+
+// nicState tracks the link of the NIC serviced by the stack.
+type nicState struct {
+	linkKnown bool
+	link      LinkStatus
+}
+
+// ServiceNIC runs a single cycle of the stack's receive and transmit loop over
+// nic within budget, see [PortStack.Poll]. buf must be at least MTU long.
+// While the link is down nothing is received nor sent so that frames
+// generated by the stack are not lost; timers expire and are serviced once
+// the link comes back up. Link changes are logged.
+func (ps *PortStack) ServiceNIC(nic NIC, buf []byte, budget PollBudget) (PollStats, error) {
+	link := nic.LinkStatus()
+	if !ps.nic.linkKnown || link != ps.nic.link {
+		ps.info("NIC:link", slog.String("status", link.String()))
+		ps.nic = nicState{linkKnown: true, link: link}
+	}
+	if link != LinkUp {
+		return PollStats{}, nil
+	}
+	return ps.Poll(buf, nic.ReadFrame, nic.WriteFrame, budget)
+}
+
+// RunNIC services nic with [PortStack.ServiceNIC] in the mode set by cfg until
+// done returns true or an error occurs. done is checked before every cycle and may
+// be nil to run forever. If the stack has no hardware address the NIC's is used.
+// NICNotify requires nic to implement [NICWaiter].
+func (ps *PortStack) RunNIC(nic NIC, cfg NICLoopConfig, done func() bool) error {
+	waiter, _ := nic.(NICWaiter)
+	if cfg.Mode == NICNotify && waiter == nil {
+		return errNICNoWait
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultNICInterval
+	}
+	if ps.mac == [6]byte{} {
+		ps.SetHardwareAddr(nic.HardwareAddr6())
+	}
+	buf := make([]byte, max(int(ps.maxMTU), eth.SizeEthernetMin))
+	for done == nil || !done() {
+		stats, err := ps.ServiceNIC(nic, buf, cfg.Budget)
+		if err != nil {
+			return err
+		} else if stats.Exhausted {
+			continue // Work pending, do not sleep.
+		}
+		if cfg.Mode == NICNotify && ps.nic.link == LinkUp {
+			_, err = waiter.Wait(cfg.Interval)
+			if err != nil {
+				return err
+			}
+		} else {
+			time.Sleep(cfg.Interval)
+		}
+	}
+	return nil
+}
@@ -53,7 +53,7 @@ func (nc *NTPClient) BeginDefaultRequest(hwaddr [6]byte, raddr netip.Addr) error
 	if err != nil {
 		return err
 	}
-	err = nc.stack.FlagPendingUDP(nc.lport)
+	err = nc.stack.RequestSendUDP(nc.lport)
 	if err != nil {
 		return err
 	}
@@ -96,7 +96,7 @@ func (nc *NTPClient) send(dst []byte) (n int, err error) {
 	}
 	hdr.SetFlags(ntp.ModeClient, ntp.LeapNoWarning)
 	hdr.Put(payload)
-	setUDP(&nc.pkt, nc.stack.mac, nc.svhw, nc.stack.ip, nc.svip.As4(), ToS, payload, nc.lport, ntp.ServerPort)
+	nc.stack.setUDP(&nc.pkt, nc.svhw, nc.stack.ip, nc.svip.As4(), ToS, payload, nc.lport, ntp.ServerPort)
 	nc.pkt.PutHeaders(dst)
 	return payloadoffset + ntp.SizeHeader, nil
 }
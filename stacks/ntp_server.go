@@ -0,0 +1,166 @@
+package stacks
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/eth/ntp"
+)
+
+var errNTPNoClock = errors.New("NTP server requires a reference clock")
+
+// NTPServerConfig configures an [NTPServer].
+type NTPServerConfig struct {
+	// Port is the local UDP port the server listens on. If zero [ntp.ServerPort] is used.
+	Port uint16
+	// Clock returns the current time of the reference clock, i.e: a GPS
+	// receiver disciplined clock. It must return the zero time while the
+	// reference is not synchronized, in which case requests are not answered. Required.
+	Clock func() time.Time
+	// Stratum is the stratum advertised to clients. If zero [ntp.StratumPrimary] is
+	// used, as corresponds to a server with a directly attached reference clock.
+	Stratum uint8
+	// ReferenceID identifies the reference clock, i.e: "GPS" or "PPS" for primary servers.
+	ReferenceID [4]byte
+	// Precision is the precision of the reference clock in log2 seconds. If zero
+	// the precision of the system clock is used. See [ntp.SystemPrecision].
+	Precision int8
+}
+
+// NTPServer answers NTP and SNTP client requests with the time of a
+// user provided reference clock so that a device can be the time source
+// of its local network segment. See RFC 5905 and RFC 4330.
+//
+// A single request is held between calls to the stack, requests received
+// meanwhile are dropped and retried by clients.
+type NTPServer struct {
+	stack     *PortStack
+	cfg       NTPServerConfig
+	pkt       UDPPacket
+	rxTime    ntp.Timestamp
+	hasPacket bool
+	aborted   bool
+	served    uint32
+}
+
+// NewNTPServer creates an NTP server on stack and opens its UDP port.
+func NewNTPServer(stack *PortStack, cfg NTPServerConfig) (*NTPServer, error) {
+	if cfg.Clock == nil {
+		return nil, errNTPNoClock
+	}
+	if cfg.Port == 0 {
+		cfg.Port = ntp.ServerPort
+	}
+	if cfg.Stratum == 0 {
+		cfg.Stratum = ntp.StratumPrimary
+	}
+	if cfg.Precision == 0 {
+		cfg.Precision = ntp.SystemPrecision()
+	}
+	ns := &NTPServer{
+		stack: stack,
+		cfg:   cfg,
+	}
+	err := stack.OpenUDP(cfg.Port, ns)
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// Served returns the amount of requests answered by the server.
+func (ns *NTPServer) Served() uint32 { return ns.served }
+
+// Close stops answering requests and closes the server's port.
+func (ns *NTPServer) Close() error {
+	return ns.stack.CloseUDP(ns.cfg.Port)
+}
+
+func (ns *NTPServer) recv(pkt *UDPPacket) error {
+	if ns.aborted {
+		return io.EOF
+	}
+	payload := pkt.Payload()
+	if len(payload) < ntp.SizeHeader {
+		return errTooShortNTP
+	}
+	nhdr := ntp.DecodeHeader(payload)
+	if nhdr.Mode() != ntp.ModeClient {
+		return nil // Only client mode requests are answered.
+	} else if ns.hasPacket {
+		return ErrDroppedPacket
+	}
+	// Take the receive timestamp as soon as possible.
+	ref := ns.cfg.Clock()
+	if ref.IsZero() {
+		ns.stack.debug("NTP:unsynchronized")
+		return nil
+	}
+	rx, err := ntp.TimestampFromTime(ref)
+	if err != nil {
+		return err
+	}
+	ns.rxTime = rx
+	ns.pkt.copyFrom(pkt)
+	ns.hasPacket = true
+	return nil
+}
+
+func (ns *NTPServer) send(dst []byte) (int, error) {
+	const payloadoffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+	if ns.aborted {
+		return 0, io.EOF
+	} else if !ns.hasPacket {
+		return 0, nil
+	} else if len(dst) < payloadoffset+ntp.SizeHeader {
+		return 0, io.ErrShortBuffer
+	}
+	ns.hasPacket = false
+	req := ntp.DecodeHeader(ns.pkt.Payload())
+	tx, err := ntp.TimestampFromTime(ns.cfg.Clock())
+	if err != nil {
+		return 0, nil // Reference lost synchronization since the request arrived.
+	}
+	hdr := ntp.Header{
+		Stratum:   ns.cfg.Stratum,
+		Poll:      req.Poll,
+		Precision: ns.cfg.Precision,
+		// The reference clock is read for every request so it is always freshly set.
+		ReferenceID:   ns.cfg.ReferenceID,
+		ReferenceTime: ns.rxTime,
+		OriginTime:    req.TransmitTime,
+		ReceiveTime:   ns.rxTime,
+		TransmitTime:  tx,
+	}
+	if req.TransmitTime.IsZero() {
+		// Some clients place their transmit timestamp in the origin field.
+		hdr.OriginTime = req.OriginTime
+	}
+	hdr.SetFlags(ntp.ModeServer, ntp.LeapNoWarning)
+	payload := dst[payloadoffset : payloadoffset+ntp.SizeHeader]
+	hdr.Put(payload)
+	rx := &ns.pkt
+	ns.stack.setUDP(rx, rx.Eth.Source, ns.stack.ip, rx.IP.Source, rx.IP.ToS, payload, ns.cfg.Port, rx.UDP.SourcePort)
+	rx.PutHeaders(dst)
+	ns.served++
+	if ns.stack.isLogEnabled(slog.LevelDebug) {
+		ns.stack.debug("NTP:serve", ns.stack.addrAttr("client", rx.IP.Destination))
+	}
+	return payloadoffset + ntp.SizeHeader, nil
+}
+
+func (ns *NTPServer) isPendingHandling() bool {
+	return ns.aborted || ns.hasPacket
+}
+
+func (ns *NTPServer) abort() {
+	*ns = NTPServer{
+		stack:   ns.stack,
+		cfg:     ns.cfg,
+		served:  ns.served,
+		aborted: true,
+	}
+}
@@ -0,0 +1,55 @@
+package stacks
+
+import (
+	"errors"
+	"time"
+)
+
+var errBadPacing = errors.New("negative pacing rate or gap")
+
+// tcpPacer schedules transmission of data segments so that a connection does
+// not exceed a configured byte rate and keeps a minimum gap between segments.
+// The zero value does not limit transmission.
+type tcpPacer struct {
+	// rate is the byte rate limit in bytes per second.
+	rate int
+	// gap is the minimum time between data segments.
+	gap time.Duration
+	// next is the earliest time the next data segment may be sent.
+	next time.Time
+}
+
+// SetPacing limits the rate at which data segments are sent over the
+// connection to rate bytes per second, keeping at least gap between
+// consecutive data segments. Control segments such as ACKs are not paced.
+// A zero rate or gap disables the respective limit.
+func (sock *TCPConn) SetPacing(rate int, gap time.Duration) error {
+	if rate < 0 || gap < 0 {
+		return errBadPacing
+	}
+	sock.pacer = tcpPacer{rate: rate, gap: gap, next: sock.pacer.next}
+	return nil
+}
+
+// ready returns true if a data segment may be sent at time now.
+func (p *tcpPacer) ready(now time.Time) bool {
+	return !now.Before(p.next)
+}
+
+// onsend schedules the next data segment after a segment of size bytes was sent at now.
+func (p *tcpPacer) onsend(now time.Time, size int) {
+	if p.rate == 0 && p.gap == 0 {
+		return
+	}
+	var wait time.Duration
+	if p.rate > 0 {
+		wait = time.Duration(size) * time.Second / time.Duration(p.rate)
+	}
+	if wait < p.gap {
+		wait = p.gap
+	}
+	if p.next.Before(now) {
+		p.next = now // Do not accumulate credit while idle.
+	}
+	p.next = p.next.Add(wait)
+}
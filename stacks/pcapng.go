@@ -0,0 +1,185 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+)
+
+const (
+	pcapngBlockSHB       = 0x0a0d0d0a
+	pcapngBlockIDB       = 1
+	pcapngBlockEPB       = 6
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngOptEPBFlags    = 2
+	pcapngFlagInbound    = 1
+	pcapngFlagOutbound   = 2
+	sizePcapngSHB        = 28
+	sizePcapngIDB        = 20
+	// sizePcapngEPB is the size of an enhanced packet block without packet data:
+	// header, the epb_flags and end of options options and the trailing length.
+	sizePcapngEPB = 28 + 8 + 4 + 4
+)
+
+var errPcapngSnaplen = errors.New("pcapng snap length must be positive")
+
+// CaptureHook receives the frames received and sent by a stack. See [PortStack.SetCaptureHook].
+type CaptureHook interface {
+	// CaptureFrame is called with every frame received or sent, outgoing
+	// being set for sent frames, at time t. frame is only valid during the call.
+	CaptureFrame(t time.Time, frame []byte, outgoing bool)
+}
+
+// CaptureFilter selects the frames passed to a [CaptureHook]. Zero valued
+// fields match any frame, all set fields must match.
+type CaptureFilter struct {
+	// EtherType matches frames of the EtherType, i.e: [eth.EtherTypeARP].
+	EtherType eth.EtherType
+	// Protocol matches IPv4 frames carrying the IP protocol number, i.e: 6 for TCP and 17 for UDP.
+	Protocol uint8
+	// Host matches IPv4 frames sent from or to the address.
+	Host netip.Addr
+	// Port matches TCP and UDP frames sent from or to the port.
+	Port uint16
+}
+
+// Match reports whether frame is selected by the filter.
+func (f *CaptureFilter) Match(frame []byte) bool {
+	if len(frame) < eth.SizeEthernetHeader {
+		return false
+	}
+	etype := eth.EtherType(eth.FieldEtherType.Get(frame))
+	if f.EtherType != 0 && etype != f.EtherType {
+		return false
+	} else if f.Protocol == 0 && !f.Host.IsValid() && f.Port == 0 {
+		return true
+	}
+	if etype != eth.EtherTypeIPv4 || len(frame) < eth.SizeEthernetHeader+eth.SizeIPv4Header {
+		return false
+	}
+	ihdr, off := eth.DecodeIPv4Header(frame[eth.SizeEthernetHeader:])
+	if f.Protocol != 0 && ihdr.Protocol != f.Protocol {
+		return false
+	}
+	if f.Host.IsValid() && f.Host != netip.AddrFrom4(ihdr.Source) && f.Host != netip.AddrFrom4(ihdr.Destination) {
+		return false
+	}
+	if f.Port == 0 {
+		return true
+	}
+	ports := frame[eth.SizeEthernetHeader+int(off):]
+	if (ihdr.Protocol != 6 && ihdr.Protocol != 17) || ihdr.Flags.FragmentOffset() != 0 || len(ports) < 4 {
+		return false
+	}
+	// TCP and UDP ports share offsets.
+	return eth.FieldUDPSourcePort.Get(ports) == uint32(f.Port) || eth.FieldUDPDestinationPort.Get(ports) == uint32(f.Port)
+}
+
+// SetCaptureHook sets the hook called with the frames received and sent by
+// the stack matching filter, i.e: a [PcapngWriter] to stream them to a file
+// or serial port for analysis with Wireshark. The hook is called synchronously
+// from RecvEth and HandleEth so slow writers delay packet processing. A nil
+// hook disables it. The hook is independent of the capture set with [PortStack.SetCapture].
+func (ps *PortStack) SetCaptureHook(hook CaptureHook, filter CaptureFilter) {
+	ps.captureHook = hook
+	ps.captureFilter = filter
+}
+
+// captureFrame hands frame received or sent at t to the frame capture and the capture hook.
+func (ps *PortStack) captureFrame(t time.Time, frame []byte, outgoing bool) {
+	if ps.capture != nil {
+		ps.capture.record(t, frame)
+	}
+	if ps.captureHook != nil && ps.captureFilter.Match(frame) {
+		ps.captureHook.CaptureFrame(t, frame, outgoing)
+	}
+}
+
+// PcapngWriter is a [CaptureHook] writing frames in the pcapng file format
+// with microsecond timestamps and the direction of each frame.
+type PcapngWriter struct {
+	w       io.Writer
+	snaplen int
+	err     error
+	frames  uint32
+}
+
+// NewPcapngWriter writes the pcapng section header and the Ethernet interface
+// description to w and returns a writer of the frames captured. Frames are
+// truncated to snaplen bytes.
+func NewPcapngWriter(w io.Writer, snaplen int) (*PcapngWriter, error) {
+	if snaplen <= 0 {
+		return nil, errPcapngSnaplen
+	}
+	var hdr [sizePcapngSHB + sizePcapngIDB]byte
+	le := binary.LittleEndian
+	le.PutUint32(hdr[0:], pcapngBlockSHB)
+	le.PutUint32(hdr[4:], sizePcapngSHB)
+	le.PutUint32(hdr[8:], pcapngByteOrderMagic)
+	le.PutUint16(hdr[12:], 1)                  // Major version.
+	le.PutUint16(hdr[14:], 0)                  // Minor version.
+	le.PutUint64(hdr[16:], 0xffffffffffffffff) // Section length not specified.
+	le.PutUint32(hdr[24:], sizePcapngSHB)
+	idb := hdr[sizePcapngSHB:]
+	le.PutUint32(idb[0:], pcapngBlockIDB)
+	le.PutUint32(idb[4:], sizePcapngIDB)
+	le.PutUint16(idb[8:], pcapLinkTypeEthernet)
+	le.PutUint32(idb[12:], uint32(snaplen))
+	le.PutUint32(idb[16:], sizePcapngIDB)
+	_, err := w.Write(hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	return &PcapngWriter{w: w, snaplen: snaplen}, nil
+}
+
+// CaptureFrame writes frame as an enhanced packet block. Once a write fails
+// frames are discarded and the error is returned by [PcapngWriter.Err].
+func (pw *PcapngWriter) CaptureFrame(t time.Time, frame []byte, outgoing bool) {
+	if pw.err != nil {
+		return
+	}
+	caplen := min(len(frame), pw.snaplen)
+	padded := (caplen + 3) &^ 3
+	total := uint32(sizePcapngEPB + padded)
+	le := binary.LittleEndian
+	var hdr [28]byte
+	ts := uint64(t.UnixMicro())
+	le.PutUint32(hdr[0:], pcapngBlockEPB)
+	le.PutUint32(hdr[4:], total)
+	le.PutUint32(hdr[8:], 0) // Interface ID.
+	le.PutUint32(hdr[12:], uint32(ts>>32))
+	le.PutUint32(hdr[16:], uint32(ts))
+	le.PutUint32(hdr[20:], uint32(caplen))
+	le.PutUint32(hdr[24:], uint32(len(frame)))
+	// Padding to 32 bits followed by the epb_flags option, end of options and the block length.
+	var trailer [3 + 8 + 4 + 4]byte
+	tail := trailer[:padded-caplen+16]
+	opts := tail[padded-caplen:]
+	le.PutUint16(opts[0:], pcapngOptEPBFlags)
+	le.PutUint16(opts[2:], 4)
+	flags := uint32(pcapngFlagInbound)
+	if outgoing {
+		flags = pcapngFlagOutbound
+	}
+	le.PutUint32(opts[4:], flags)
+	le.PutUint32(opts[12:], total) // End of options is left zero.
+	if _, pw.err = pw.w.Write(hdr[:]); pw.err != nil {
+		return
+	} else if _, pw.err = pw.w.Write(frame[:caplen]); pw.err != nil {
+		return
+	} else if _, pw.err = pw.w.Write(tail); pw.err != nil {
+		return
+	}
+	pw.frames++
+}
+
+// Frames returns the amount of frames written.
+func (pw *PcapngWriter) Frames() uint32 { return pw.frames }
+
+// Err returns the error of the first failed write, if any.
+func (pw *PcapngWriter) Err() error { return pw.err }
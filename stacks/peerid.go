@@ -0,0 +1,44 @@
+package stacks
+
+import (
+	"log/slog"
+)
+
+// PeerIdentity is the identity of the remote end of a connection as
+// authenticated by a security layer running over it, such as TLS or DTLS.
+// The stack does not verify identities: the security layer sets the identity
+// of a connection once its handshake succeeds, see [TCPConn.SetPeerIdentity],
+// so that applications may key authorization decisions on it, i.e: an HTTP
+// admin endpoint only served to clients presenting a known certificate.
+type PeerIdentity struct {
+	// Certificates is the verified certificate chain presented by the peer
+	// in DER encoding, leaf certificate first.
+	Certificates [][]byte
+	// PSKIdentity is the identity of the pre-shared key used by the peer.
+	PSKIdentity string
+}
+
+// IsZero reports whether the identity is unset, i.e: the peer was not authenticated.
+func (id PeerIdentity) IsZero() bool {
+	return len(id.Certificates) == 0 && id.PSKIdentity == ""
+}
+
+// SetPeerIdentity sets the authenticated identity of the remote end of the
+// connection and reports it to [PortStackConfig.OnPeerIdentity]. It remains
+// set after the connection is closed until the socket is opened again and is
+// moved along with the connection by [TCPConn.Handoff]. The certificates are
+// not copied and must not be modified while set.
+func (sock *TCPConn) SetPeerIdentity(id PeerIdentity) {
+	sock.peer = id
+	if sock.stack.isLogEnabled(slog.LevelInfo) {
+		sock.info("TCP:peer-identity", slog.Uint64("port", uint64(sock.localPort)),
+			slog.Int("certs", len(id.Certificates)), slog.String("psk", id.PSKIdentity))
+	}
+	if sock.stack.onPeerIdentity != nil {
+		sock.stack.onPeerIdentity(sock, id)
+	}
+}
+
+// PeerIdentity returns the authenticated identity of the remote end of the
+// connection set with [TCPConn.SetPeerIdentity]. It is zero if unset.
+func (sock *TCPConn) PeerIdentity() PeerIdentity { return sock.peer }
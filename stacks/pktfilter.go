@@ -0,0 +1,170 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net/netip"
+
+	"github.com/soypat/seqs/eth"
+)
+
+var errBadFilterPrefix = errors.New("packet filter prefix must be an IPv4 prefix")
+
+// FilterAction is the action taken on packets matched by a [FilterRule].
+type FilterAction uint8
+
+const (
+	// FilterAllow passes matched packets on to the stack's sockets and protocols.
+	FilterAllow FilterAction = iota
+	// FilterDeny drops matched packets.
+	FilterDeny
+)
+
+// PortRange is an inclusive range of TCP or UDP ports. The zero value
+// matches any port. If Last is below First the range is the single port First.
+type PortRange struct {
+	First, Last uint16
+}
+
+// FilterRule matches received IPv4 packets by protocol, addresses and ports.
+// Zero valued fields match any packet.
+type FilterRule struct {
+	Action FilterAction
+	// Proto is the IP protocol number matched, i.e: 6 for TCP and 17 for UDP.
+	Proto uint8
+	// Src and Dst are the prefixes the source and destination addresses must be within.
+	Src, Dst netip.Prefix
+	// SrcPorts and DstPorts are the source and destination port ranges. Rules
+	// with ports set only match TCP, UDP and UDP-Lite packets.
+	SrcPorts, DstPorts PortRange
+}
+
+// PacketFilter is a stateless ingress filter of the IPv4 packets received
+// by a stack, evaluated before they are dispatched to sockets and protocol
+// handlers. Rules are evaluated in order and the first matching rule decides
+// the fate of a packet. Frames of other EtherTypes, such as IPv6, cannot be
+// matched by rules and are subject to the default action, except for ARP
+// which IPv4 depends on. See [PortStack.SetPacketFilter].
+type PacketFilter struct {
+	Rules []FilterRule
+	// DefaultDeny drops packets not matched by any rule. By default they are accepted.
+	DefaultDeny bool
+}
+
+// packetFilter is the compiled form of a [PacketFilter].
+type packetFilter struct {
+	rules       []filterRule
+	defaultDeny bool
+}
+
+type filterRule struct {
+	action     FilterAction
+	proto      uint8
+	src, dst   ipv4Prefix
+	sport      [2]uint16
+	dport      [2]uint16
+	matchPorts bool
+	hits       uint32
+}
+
+// SetPacketFilter sets the ingress packet filter of the stack, replacing the
+// previous one and resetting hit counters. An empty filter accepts all packets.
+// Packets dropped by the filter are counted in [Stats].
+func (ps *PortStack) SetPacketFilter(f PacketFilter) error {
+	rules := make([]filterRule, len(f.Rules))
+	for i, r := range f.Rules {
+		if r.Src.IsValid() && !r.Src.Addr().Is4() || r.Dst.IsValid() && !r.Dst.Addr().Is4() {
+			return errBadFilterPrefix
+		}
+		rules[i] = filterRule{
+			action:     r.Action,
+			proto:      r.Proto,
+			sport:      r.SrcPorts.bounds(),
+			dport:      r.DstPorts.bounds(),
+			matchPorts: r.SrcPorts != PortRange{} || r.DstPorts != PortRange{},
+		}
+		if r.Src.IsValid() {
+			rules[i].src = makeIPv4Prefix(r.Src.Masked())
+		}
+		if r.Dst.IsValid() {
+			rules[i].dst = makeIPv4Prefix(r.Dst.Masked())
+		}
+	}
+	ps.filter = packetFilter{rules: rules, defaultDeny: f.DefaultDeny}
+	return nil
+}
+
+// AppendFilterHits appends the amount of packets matched by each rule of the
+// packet filter to dst, in the order of [PacketFilter.Rules].
+func (ps *PortStack) AppendFilterHits(dst []uint32) []uint32 {
+	for i := range ps.filter.rules {
+		dst = append(dst, ps.filter.rules[i].hits)
+	}
+	return dst
+}
+
+// bounds returns the inclusive bounds of the range, {0, 0xffff} if zero.
+func (pr PortRange) bounds() [2]uint16 {
+	switch {
+	case pr == PortRange{}:
+		return [2]uint16{0, 0xffff}
+	case pr.Last < pr.First:
+		return [2]uint16{pr.First, pr.First}
+	}
+	return [2]uint16{pr.First, pr.Last}
+}
+
+func (f *packetFilter) active() bool { return len(f.rules) > 0 || f.defaultDeny }
+
+// filterAccept reports whether the packet with IP header ihdr and payload
+// passes the packet filter.
+func (ps *PortStack) filterAccept(ihdr *eth.IPv4Header, payload []byte) bool {
+	f := &ps.filter
+	hasPorts := (ihdr.Protocol == 6 || ihdr.Protocol == 17 || ihdr.Protocol == 136) && len(payload) >= 4
+	var sport, dport uint16
+	if hasPorts {
+		sport = binary.BigEndian.Uint16(payload[0:2])
+		dport = binary.BigEndian.Uint16(payload[2:4])
+	}
+	for i := range f.rules {
+		r := &f.rules[i]
+		switch {
+		case r.proto != 0 && r.proto != ihdr.Protocol,
+			!r.src.contains(ihdr.Source) || !r.dst.contains(ihdr.Destination),
+			r.matchPorts && (!hasPorts || sport < r.sport[0] || sport > r.sport[1] || dport < r.dport[0] || dport > r.dport[1]):
+			continue
+		}
+		r.hits++
+		if r.action == FilterDeny {
+			ps.dropFiltered(ihdr, dport, i)
+			return false
+		}
+		return true
+	}
+	if f.defaultDeny {
+		ps.dropFiltered(ihdr, dport, -1)
+		return false
+	}
+	return true
+}
+
+// filterAcceptEtherType reports whether a frame of EtherType etype, other
+// than IPv4 and ARP, passes the packet filter's default action.
+func (ps *PortStack) filterAcceptEtherType(etype eth.EtherType) bool {
+	if !ps.filter.defaultDeny {
+		return true
+	}
+	ps.stats.DroppedFilter++
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("filter:drop", slog.String("etype", etype.String()))
+	}
+	return false
+}
+
+func (ps *PortStack) dropFiltered(ihdr *eth.IPv4Header, dport uint16, rule int) {
+	ps.stats.DroppedFilter++
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("filter:drop", ps.addrAttr("src", ihdr.Source), slog.Int("proto", int(ihdr.Protocol)), slog.Int("dport", int(dport)), slog.Int("rule", rule))
+	}
+}
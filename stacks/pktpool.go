@@ -0,0 +1,75 @@
+package stacks
+
+// packetPool is a fixed set of packet buffers shared by the TCP connections
+// of a stack to hold segments received out of order, so that buffer memory
+// is spent on the connections receiving traffic instead of being allocated
+// to every connection on creation. See [PortStackConfig.PacketPoolBytes].
+type packetPool struct {
+	// free holds the buffers not borrowed. Its capacity is the amount of
+	// buffers in the pool so returning them never allocates.
+	free [][]byte
+	// size is the size of each buffer. Zero if the pool is disabled, in
+	// which case connections allocate their own buffers.
+	size int
+	// misses counts buffers not borrowed for lack of free ones.
+	misses uint32
+}
+
+// makePacketPool returns a pool of as many buffers able to hold received
+// frames of up to mtu bytes as fit in budget bytes.
+func makePacketPool(budget int, mtu uint16) packetPool {
+	size := tcpPacketSize(mtu)
+	n := 0
+	if size > 0 {
+		n = budget / size
+	}
+	if n == 0 {
+		return packetPool{}
+	}
+	buf := make([]byte, n*size)
+	free := make([][]byte, n)
+	for i := range free {
+		free[i] = buf[i*size : (i+1)*size : (i+1)*size]
+	}
+	return packetPool{free: free, size: size}
+}
+
+func (p *packetPool) enabled() bool { return p.size > 0 }
+
+// borrow gives pkt a buffer from the pool and reports whether it has one.
+// Packets of connections not using the pool have their own buffer.
+func (p *packetPool) borrow(pkt *TCPPacket) bool {
+	if !p.enabled() || pkt.data != nil {
+		return true
+	} else if len(p.free) == 0 {
+		p.misses++
+		return false
+	}
+	pkt.data = p.free[len(p.free)-1]
+	p.free = p.free[:len(p.free)-1]
+	return true
+}
+
+// release returns the buffer borrowed by pkt to the pool.
+func (p *packetPool) release(pkt *TCPPacket) {
+	if !p.enabled() || pkt.data == nil {
+		return
+	}
+	p.free = append(p.free, pkt.data[:cap(pkt.data)])
+	pkt.data = nil
+}
+
+// makeRxQueue returns the packets of n receive queue slots. Their buffers
+// are borrowed from the pool as segments are queued if it is enabled.
+func (p *packetPool) makeRxQueue(n int, mtu uint16) []TCPPacket {
+	if p.enabled() {
+		return make([]TCPPacket, n)
+	}
+	return makeTCPPackets(n, mtu)
+}
+
+// PacketPool returns the amount of free buffers and the total amount of
+// buffers of the stack's packet pool. See [PortStackConfig.PacketPoolBytes].
+func (ps *PortStack) PacketPool() (free, total int) {
+	return len(ps.pool.free), cap(ps.pool.free)
+}
@@ -0,0 +1,80 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"log/slog"
+
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/eth"
+)
+
+// applyIPHeader sets the fields of the IP header of the connection's packet
+// covered by the stack's fingerprint and the Don't Fragment flag if path MTU
+// discovery is enabled and the path MTU is above pmtuFloor. See [TCPConfig.PathMTUDiscovery].
+func (sock *TCPConn) applyIPHeader() {
+	ip := &sock.pkt.IP
+	sock.stack.applyFingerprint(ip)
+	atFloor := sock.pathMTU != 0 && sock.pathMTU <= pmtuFloor+eth.SizeEthernetHeader
+	if sock.tcfg.PathMTUDiscovery && !atFloor && ip.Flags&ipFlagDontFragment == 0 {
+		ip.Flags |= ipFlagDontFragment
+		ip.Checksum = ip.CalculateChecksum()
+	}
+}
+
+// recvFragNeededTCP lowers the path MTU of the connection that sent the TCP
+// segment quoted by an ICMP fragmentation needed message. segment holds at
+// least the first 8 octets of the quoted TCP header. It reports whether the
+// segment is in flight on an open connection.
+func (ps *PortStack) recvFragNeededTCP(ihdr *eth.IPv4Header, segment []byte, mtu uint16) bool {
+	lport := binary.BigEndian.Uint16(segment[0:2])
+	rport := binary.BigEndian.Uint16(segment[2:4])
+	seq := seqs.Value(binary.BigEndian.Uint32(segment[4:8]))
+	port := findPort(ps.portsTCP, lport)
+	if port == nil {
+		return false
+	}
+	var sock *TCPConn
+	switch h := port.handler.(type) {
+	case *TCPConn:
+		sock = h
+	case *TCPListener:
+		for i := range h.conns {
+			if r := h.conns[i].remote; r.IsValid() && r.Port() == rport && r.Addr().As4() == ihdr.Destination {
+				sock = &h.conns[i]
+				break
+			}
+		}
+	}
+	if sock == nil || sock.remote.Port() != rport || sock.remote.Addr().As4() != ihdr.Destination {
+		return false
+	}
+	return sock.onFragNeeded(mtu, seq)
+}
+
+// pmtuDue reports whether the segment starting at una, the oldest
+// unacknowledged data, is to be resent after the path MTU was lowered.
+func (r *tcpRetx) pmtuDue(una seqs.Value) bool {
+	return r.pmtu && seqs.LessThanEq(r.pmtuNext, una)
+}
+
+// onFragNeeded lowers the path MTU of the connection to mtu, the size of the
+// largest IP datagram that reaches the remote, after the segment starting at
+// seq was dropped for being too large. The unacknowledged data is resent in
+// smaller segments without waiting for the retransmission timer. It reports
+// whether the segment is in flight.
+func (sock *TCPConn) onFragNeeded(mtu uint16, seq seqs.Value) bool {
+	una, nxt := sock.scb.SendUnacked(), sock.scb.SendNext()
+	if !seqs.LessThanEq(una, seq) || !seqs.LessThan(seq, nxt) {
+		return false // Segment not in flight, message is stale or forged (RFC 5927).
+	}
+	frame := mtu + eth.SizeEthernetHeader
+	if sock.pathMTU != 0 && frame >= sock.pathMTU {
+		return true
+	}
+	sock.pathMTU = frame
+	r := &sock.retx
+	r.pmtu, r.pmtuEnd, r.pmtuNext = r.unacked > 0, nxt, una
+	sock.info("TCP:pmtu", slog.Uint64("port", uint64(sock.localPort)), slog.Uint64("mtu", uint64(mtu)))
+	sock.stack.RequestSendTCP(sock.localPort)
+	return true
+}
@@ -0,0 +1,95 @@
+package stacks
+
+import (
+	"errors"
+	"time"
+)
+
+var errPollNilFunc = errors.New("nil receive or transmit function to Poll")
+
+// PollBudget limits the work done by a single call to [PortStack.Poll] so a
+// chatty or flooding peer cannot monopolize the loop of a single threaded
+// program. Receiving and transmitting are budgeted separately so received
+// traffic cannot starve the stack's timers, retransmissions and ACKs which
+// are serviced while transmitting. Zero valued fields mean no limit.
+type PollBudget struct {
+	// MaxFrames is the maximum amount of frames received and, separately, sent per poll.
+	MaxFrames int
+	// MaxBytes is the maximum amount of bytes received and, separately, sent per poll.
+	// It is checked before each frame, so it may be exceeded by up to one frame.
+	MaxBytes int
+	// MaxTime is the maximum time spent receiving and, separately, transmitting per poll.
+	MaxTime time.Duration
+}
+
+// PollStats is the work done by a call to [PortStack.Poll].
+type PollStats struct {
+	RxFrames, RxBytes int
+	TxFrames, TxBytes int
+	// Exhausted is set when the budget ran out while there was possibly
+	// work remaining, in which case Poll should be called again soon.
+	Exhausted bool
+}
+
+// Poll runs a single cycle of the stack's receive and transmit loop within
+// budget. Frames are read with rx into buf and passed to [PortStack.RecvEth]
+// until rx returns no frame or the receive budget runs out. Frames generated
+// by [PortStack.HandleEth] are then written with tx until there is nothing
+// left to send or the transmit budget runs out. buf must be at least MTU long.
+//
+// Pending sockets are serviced round robin by HandleEth so that a socket with
+// large amounts of data to send does not delay the segments of others.
+// Errors returned by rx, tx or HandleEth end the cycle and are returned.
+// Errors processing received frames are counted in [Health] and ignored.
+// Snapshots are published at the end of the cycle when due, see
+// [PortStackConfig.SnapshotInterval].
+func (ps *PortStack) Poll(buf []byte, rx func(dst []byte) (int, error), tx func(frame []byte) error, budget PollBudget) (stats PollStats, err error) {
+	if rx == nil || tx == nil {
+		return stats, errPollNilFunc
+	}
+	start := ps.now()
+	for {
+		if budget.exhausted(stats.RxFrames, stats.RxBytes, ps.now().Sub(start)) {
+			stats.Exhausted = true
+			break
+		}
+		n, err := rx(buf)
+		if err != nil {
+			return stats, err
+		} else if n == 0 {
+			break
+		}
+		ps.RecvEth(buf[:n])
+		stats.RxFrames++
+		stats.RxBytes += n
+	}
+	start = ps.now()
+	for ps.IsPendingHandling() {
+		if budget.exhausted(stats.TxFrames, stats.TxBytes, ps.now().Sub(start)) {
+			stats.Exhausted = true
+			break
+		}
+		n, err := ps.HandleEth(buf)
+		if err != nil {
+			return stats, err
+		} else if n == 0 {
+			break
+		}
+		err = tx(buf[:n])
+		if err != nil {
+			return stats, err
+		}
+		stats.TxFrames++
+		stats.TxBytes += n
+	}
+	if ps.snapshotDue(ps.now()) {
+		ps.PublishSnapshot()
+	}
+	return stats, nil
+}
+
+func (b *PollBudget) exhausted(frames, bytes int, elapsed time.Duration) bool {
+	return b.MaxFrames > 0 && frames >= b.MaxFrames ||
+		b.MaxBytes > 0 && bytes >= b.MaxBytes ||
+		b.MaxTime > 0 && elapsed >= b.MaxTime
+}
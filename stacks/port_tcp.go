@@ -2,6 +2,7 @@ package stacks
 
 import (
 	"errors"
+	"io"
 	"strconv"
 	"time"
 
@@ -21,19 +22,29 @@ type itcphandler interface {
 	// needsHandling() bool
 	isPendingHandling() bool
 	abort()
+	// bufferedBytes returns the amount of bytes held in the handler's buffers.
+	bufferedBytes() int
+	// pendingInteractive returns true if a connection hinted as interactive has segments pending.
+	pendingInteractive() bool
 }
 
 type tcpPort struct {
 	handler itcphandler
 	port    uint16
-	p       bool
+	// txRequested is set when the user requested a send with [PortStack.RequestSendTCP]
+	// or the handler returned [ErrFlagPending]. It is cleared when the handler is called.
+	txRequested bool
+	// allow restricts the peers the port accepts segments from. See acl.go.
+	allow peerACL
+	// opened is the time the port was opened.
+	opened time.Time
 }
 
 func (port tcpPort) Port() uint16 { return port.port }
 
 // IsPendingHandling returns true if there are packet(s) pending handling.
 func (port *tcpPort) IsPendingHandling() bool {
-	return port.port != 0 && port.handler.isPendingHandling()
+	return port.port != 0 && (port.txRequested || port.handler.isPendingHandling())
 }
 
 // HandleEth writes the socket's response into dst to be sent over an ethernet interface.
@@ -43,10 +54,10 @@ func (port *tcpPort) HandleEth(dst []byte) (n int, err error) {
 		panic("nil tcp handler on port " + strconv.Itoa(int(port.port)))
 	}
 
+	port.txRequested = false
 	n, err = port.handler.send(dst)
-	port.p = false
 	if err == ErrFlagPending {
-		port.p = true
+		port.txRequested = true
 	}
 	return n, err
 }
@@ -60,7 +71,8 @@ func (port *tcpPort) Open(portNum uint16, handler itcphandler) {
 	}
 	port.handler = handler
 	port.port = portNum
-	port.p = false
+	port.txRequested = false
+	port.allow = nil
 }
 
 func (port *tcpPort) Close() {
@@ -71,23 +83,63 @@ func (port *tcpPort) Close() {
 	port.port = 0 // Port 0 flags the port is inactive.
 }
 
-const tcpMTU = defaultMTU - eth.SizeEthernetHeader - eth.SizeIPv4Header - eth.SizeTCPHeader
+// sizeTCPOptsBuf is the size of the data buffer of packets used to build
+// outgoing segments, which only hold the TCP options.
+const sizeTCPOptsBuf = 40
 
 type TCPPacket struct {
 	Rx  time.Time
 	Eth eth.EthernetHeader
 	IP  eth.IPv4Header
 	TCP eth.TCPHeader
-	// data contains TCP+IP options and then the actual data.
-	data [tcpMTU]byte
+	// data contains TCP+IP options and then the actual data. It is sized
+	// after the stack's MTU by [makeTCPPackets].
+	data []byte
+}
+
+// makeTCPPackets returns n packets able to hold received frames of up to mtu
+// bytes. Their data buffers share a single allocation.
+func makeTCPPackets(n int, mtu uint16) []TCPPacket {
+	size := tcpPacketSize(mtu)
+	pkts := make([]TCPPacket, n)
+	buf := make([]byte, n*size)
+	for i := range pkts {
+		pkts[i].data = buf[i*size : (i+1)*size : (i+1)*size]
+	}
+	return pkts
+}
+
+// tcpPacketSize returns the size of the data buffer of packets holding
+// received frames of up to mtu bytes.
+func tcpPacketSize(mtu uint16) int {
+	return max(0, int(mtu)-eth.SizeEthernetHeader-eth.SizeIPv4Header-eth.SizeTCPHeader)
+}
+
+// copyFrom sets pkt to a copy of src which does not alias its data buffer.
+func (pkt *TCPPacket) copyFrom(src *TCPPacket) {
+	data := pkt.data
+	*pkt = *src
+	pkt.data = data[:copy(data, src.data)]
 }
 
 func (pkt *TCPPacket) String() string {
-	payload := pkt.Payload()
-	if len(payload) == 0 {
-		return "TCP Packet: " + pkt.Eth.String() + " " + pkt.IP.String() + " " + pkt.TCP.String()
+	return string(pkt.AppendTo(make([]byte, 0, 192)))
+}
+
+// AppendTo appends the human readable representation of the packet's headers
+// and payload returned by [TCPPacket.String] to dst.
+func (pkt *TCPPacket) AppendTo(dst []byte) []byte {
+	dst = append(dst, "TCP Packet: "...)
+	dst = pkt.Eth.AppendTo(dst)
+	dst = append(dst, ' ')
+	dst = pkt.IP.AppendTo(dst)
+	dst = append(dst, ' ')
+	dst = pkt.TCP.AppendTo(dst)
+	if payload := pkt.Payload(); len(payload) > 0 {
+		dst = append(dst, " payload:"...)
+		dst = strconv.AppendQuote(dst, string(payload))
 	}
-	return "TCP Packet: " + pkt.Eth.String() + " " + pkt.IP.String() + " " + pkt.TCP.String() + " payload:" + strconv.Quote(string(pkt.Payload()))
+	return dst
 }
 
 // PutHeaders puts 54 bytes including the Ethernet, IPv4 and TCP headers into b.
@@ -105,12 +157,26 @@ func (pkt *TCPPacket) PutHeaders(b []byte) {
 	pkt.TCP.Put(b[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
 }
 
+// PutHeadersWithOptions puts the Ethernet, IPv4 and TCP headers into b along
+// with the IPv4 and TCP options held in the packet, as set by
+// [TCPPacket.CalculateHeadersWithOptions] or received. The payload is not
+// written and must follow the options in b.
 func (pkt *TCPPacket) PutHeadersWithOptions(b []byte) error {
+	payloadStart, _, tcpOptStart := pkt.dataPtrs()
+	if payloadStart < 0 {
+		return errBadIPTotalLenOrIHL
+	}
 	const minSize = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeTCPHeader
-	if len(b) < minSize {
-		panic("short tcpPacket buffer")
+	if len(b) < minSize+payloadStart {
+		return io.ErrShortBuffer
 	}
-	panic("PutHeadersWithOptions not implemented")
+	tcpStart := eth.SizeEthernetHeader + eth.SizeIPv4Header + tcpOptStart
+	pkt.Eth.Put(b)
+	pkt.IP.Put(b[eth.SizeEthernetHeader:])
+	copy(b[eth.SizeEthernetHeader+eth.SizeIPv4Header:tcpStart], pkt.data[:tcpOptStart])
+	pkt.TCP.Put(b[tcpStart:])
+	copy(b[tcpStart+eth.SizeTCPHeader:], pkt.data[tcpOptStart:payloadStart])
+	return nil
 }
 
 // Payload returns the TCP payload. If TCP or IPv4 header data is incorrect/bad it returns nil.
@@ -193,6 +259,113 @@ func (pkt *TCPPacket) CalculateHeaders(seg seqs.Segment, payload []byte) {
 	pkt.TCP.Checksum = pkt.TCP.CalculateChecksumIPv4(&pkt.IP, nil, payload)
 }
 
+// CalculateHeadersWithOptions is like [TCPPacket.CalculateHeaders] for a
+// segment carrying the TCP options opts, which are held in the packet to be
+// written by [TCPPacket.PutHeadersWithOptions]. The length of opts must be a
+// multiple of 4 and at most 40 bytes. Packets without a buffer large enough
+// for the segment, such as the zero value, are allocated one.
+func (pkt *TCPPacket) CalculateHeadersWithOptions(seg seqs.Segment, opts, payload []byte) {
+	if len(opts)%4 != 0 || len(opts) > 40 {
+		panic("bad TCP options length")
+	}
+	if len(pkt.data) < len(opts)+len(payload) {
+		pkt.data = make([]byte, len(opts)+len(payload))
+	}
+	pkt.CalculateHeaders(seg, payload)
+	copy(pkt.data[:], opts)
+	pkt.IP.TotalLength += uint16(len(opts))
+	pkt.IP.Checksum = pkt.IP.CalculateChecksum()
+	pkt.TCP.SetOffset(5 + uint8(len(opts)/4))
+	pkt.TCP.Checksum = pkt.TCP.CalculateChecksumIPv4(&pkt.IP, opts, payload)
+}
+
+// tcpReset holds an outgoing RST segment generated by the stack in response
+// to a segment that no connection will accept.
+type tcpReset struct {
+	eth     eth.EthernetHeader
+	ip      eth.IPv4Header
+	tcp     eth.TCPHeader
+	pending bool
+}
+
+// queue prepares a RST in response to the incoming packet following the
+// reset generation rules of RFC 9293 section 3.10.7.1. A RST is never sent in
+// response to a RST. Only one RST can be pending at a time; a newer RST replaces an unsent one.
+// It returns true if a RST was queued.
+func (rst *tcpReset) queue(pkt *TCPPacket) bool {
+	flags := pkt.TCP.Flags()
+	if flags.HasAny(seqs.FlagRST) {
+		return false
+	}
+	seg := pkt.TCP.Segment(len(pkt.Payload()))
+	rst.eth = eth.EthernetHeader{
+		Destination:     pkt.Eth.Source,
+		Source:          pkt.Eth.Destination,
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	rst.ip = eth.IPv4Header{
+		VersionAndIHL: 4<<4 | 5,
+		TotalLength:   eth.SizeIPv4Header + eth.SizeTCPHeader,
+		TTL:           64,
+		Protocol:      6,
+		Source:        pkt.IP.Destination,
+		Destination:   pkt.IP.Source,
+	}
+	rst.ip.Checksum = rst.ip.CalculateChecksum()
+	rst.tcp = eth.TCPHeader{
+		SourcePort:      pkt.TCP.DestinationPort,
+		DestinationPort: pkt.TCP.SourcePort,
+	}
+	if flags.HasAny(seqs.FlagACK) {
+		rst.tcp.Seq = seg.ACK
+		rst.tcp.SetFlags(seqs.FlagRST)
+	} else {
+		rst.tcp.Ack = seqs.Add(seg.SEQ, seg.LEN())
+		rst.tcp.SetFlags(seqs.FlagRST | seqs.FlagACK)
+	}
+	rst.tcp.SetOffset(5)
+	rst.tcp.Checksum = rst.tcp.CalculateChecksumIPv4(&rst.ip, nil, nil)
+	rst.pending = true
+	return true
+}
+
+// queueAbort prepares a RST aborting the synchronized connection of sock.
+// Only one RST can be pending at a time; a newer RST replaces an unsent one.
+func (rst *tcpReset) queueAbort(sock *TCPConn) {
+	rst.eth = eth.EthernetHeader{
+		Destination:     sock.remoteMAC,
+		Source:          sock.stack.mac,
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	rst.ip = eth.IPv4Header{
+		VersionAndIHL: 4<<4 | 5,
+		TotalLength:   eth.SizeIPv4Header + eth.SizeTCPHeader,
+		TTL:           64,
+		Protocol:      6,
+		Source:        sock.localAddr(),
+		Destination:   sock.remote.Addr().As4(),
+	}
+	rst.ip.Checksum = rst.ip.CalculateChecksum()
+	rst.tcp = eth.TCPHeader{
+		SourcePort:      sock.localPort,
+		DestinationPort: sock.remote.Port(),
+		Seq:             sock.scb.SendNext(),
+	}
+	rst.tcp.SetFlags(seqs.FlagRST)
+	rst.tcp.SetOffset(5)
+	rst.tcp.Checksum = rst.tcp.CalculateChecksumIPv4(&rst.ip, nil, nil)
+	rst.pending = true
+}
+
+// put writes the pending RST to dst and clears the pending flag.
+func (rst *tcpReset) put(dst []byte) int {
+	rst.eth.Put(dst)
+	rst.ip.Put(dst[eth.SizeEthernetHeader:])
+	rst.tcp.Put(dst[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	rst.pending = false
+	return sizeTCPNoOptions
+}
+
 // prand16 generates a pseudo random number from a seed.
 func prand16(seed uint16) uint16 {
 	// 16bit Xorshift  https://en.wikipedia.org/wiki/Xorshift
@@ -232,19 +405,23 @@ func ParseTCPPacket(b []byte) (pkt TCPPacket, err error) {
 		return pkt, errors.New("short packet or bad IP.TotalLength")
 	}
 	ipOptions := b[eth.SizeEthernetHeader+eth.SizeIPv4Header : eth.SizeEthernetHeader+offset]
-	ipPayload := b[eth.SizeEthernetHeader+offset:]
+	ipPayload := b[eth.SizeEthernetHeader+offset : eth.SizeEthernetHeader+pkt.IP.TotalLength]
 	if pkt.IP.Protocol != 6 {
 		return pkt, errors.New("not tcp")
 	} else if uint16(offset) > pkt.IP.TotalLength {
 		return pkt, errors.New("bad TCP.Offset (greater than IP.TotalLength)")
+	} else if len(ipPayload) < eth.SizeTCPHeader {
+		return pkt, errors.New("short TCP header")
 	}
 	pkt.TCP, offset = eth.DecodeTCPHeader(ipPayload)
+	if int(offset) > len(ipPayload) || offset < eth.SizeTCPHeader {
+		return pkt, errors.New("bad TCP.Offset")
+	}
 	tcpOptions := ipPayload[eth.SizeTCPHeader:offset]
-	tcpPayload := ipPayload[offset:pkt.IP.TotalLength]
+	tcpPayload := ipPayload[offset:]
+	pkt.data = make([]byte, len(ipOptions)+len(tcpOptions)+len(tcpPayload))
 	n := copy(pkt.data[:], ipOptions)
 	n += copy(pkt.data[n:], tcpOptions)
 	copy(pkt.data[n:], tcpPayload)
-
-	pkt.Rx = forcedTime.Add(1) // Mark packet as containing data.
 	return pkt, nil
 }
@@ -18,14 +18,22 @@ type iudphandler interface {
 type udpPort struct {
 	ihandler iudphandler
 	port     uint16
+	// lite is set for UDP-Lite ports.
+	lite bool
+	// txRequested is set when the user requested a send with [PortStack.RequestSendUDP]
+	// or the handler returned [ErrFlagPending]. It is cleared when the handler is called.
+	txRequested bool
+	// allow restricts the peers the port accepts datagrams from. See acl.go.
+	allow peerACL
+	// opened is the time the port was opened.
+	opened time.Time
 }
 
 func (port udpPort) Port() uint16 { return port.port }
 
 // IsPendingHandling returns true if there are packet(s) pending handling.
 func (port *udpPort) IsPendingHandling() bool {
-	// return port.port != 0 && port.ihandler.isPendingHandling()
-	return port.port != 0 && port.ihandler.isPendingHandling()
+	return port.port != 0 && (port.txRequested || port.ihandler.isPendingHandling())
 }
 
 // HandleEth writes the socket's response into dst to be sent over an ethernet interface.
@@ -34,7 +42,12 @@ func (port *udpPort) HandleEth(dst []byte) (int, error) {
 	if port.ihandler == nil {
 		panic("nil udp handler on port " + strconv.Itoa(int(port.port)))
 	}
-	return port.ihandler.send(dst)
+	port.txRequested = false
+	n, err := port.ihandler.send(dst)
+	if err == ErrFlagPending {
+		port.txRequested = true
+	}
+	return n, err
 }
 
 // Open sets the UDP handler and opens the port.
@@ -46,6 +59,9 @@ func (port *udpPort) Open(portNum uint16, h iudphandler) {
 	}
 	port.ihandler = h
 	port.port = portNum
+	port.lite = false
+	port.txRequested = false
+	port.allow = nil
 }
 
 func (port *udpPort) Close() {
@@ -53,16 +69,30 @@ func (port *udpPort) Close() {
 	port.ihandler = nil
 }
 
-// UDP socket can be forced to respond even if no packet has been received
-// by flagging the packet's Rx time with non-zero value.
-var forcedTime = (time.Time{}).Add(1)
-
 type UDPPacket struct {
-	Rx      time.Time
-	Eth     eth.EthernetHeader
-	IP      eth.IPv4Header
-	UDP     eth.UDPHeader
-	payload [defaultMTU - eth.SizeEthernetHeader - eth.SizeIPv4Header - eth.SizeUDPHeader]byte
+	Rx  time.Time
+	Eth eth.EthernetHeader
+	IP  eth.IPv4Header
+	UDP eth.UDPHeader
+	// payload holds received data. It is nil for packets only used to build
+	// the headers of outgoing datagrams. See [makeUDPPacket].
+	payload []byte
+}
+
+// makeUDPPacket returns a packet able to hold a datagram received in a frame of up to mtu bytes.
+func makeUDPPacket(mtu uint16) UDPPacket {
+	size := max(0, int(mtu)-eth.SizeEthernetHeader-eth.SizeIPv4Header-eth.SizeUDPHeader)
+	return UDPPacket{payload: make([]byte, size)}
+}
+
+// copyFrom sets pkt to a copy of src which does not alias its payload buffer.
+func (pkt *UDPPacket) copyFrom(src *UDPPacket) {
+	payload := pkt.payload
+	*pkt = *src
+	if len(payload) < len(src.payload) {
+		payload = make([]byte, len(src.payload))
+	}
+	pkt.payload = payload[:copy(payload, src.payload)]
 }
 
 func (pkt *UDPPacket) PutHeaders(b []byte) {
@@ -78,11 +108,15 @@ func (pkt *UDPPacket) PutHeaders(b []byte) {
 }
 
 // Payload returns the UDP payload. If UDP or IPv4 header data is incorrect/bad it returns nil.
-// If the response is "forced" then payload will be nil.
+// If the response is "forced" then payload will be nil. Octets of the IP packet
+// past the UDP length are not part of the payload.
 func (pkt *UDPPacket) Payload() []byte {
 	ipLen := int(pkt.IP.TotalLength) - int(pkt.IP.IHL()*4) - eth.SizeUDPHeader // Total length(including header) - header length = payload length
 	uLen := int(pkt.UDP.Length) - eth.SizeUDPHeader
-	if ipLen != uLen || uLen > len(pkt.payload) {
+	if pkt.IP.Protocol == 136 {
+		uLen = ipLen // UDP-Lite: Length field holds checksum coverage.
+	}
+	if uLen > ipLen || uLen < 0 || uLen > len(pkt.payload) {
 		return nil // Mismatching IP and UDP data or bad length.
 	}
 	return pkt.payload[:uLen]
@@ -0,0 +1,154 @@
+package stacks
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+)
+
+const (
+	// maxKnockers is the amount of sources whose knock sequence progress is tracked at once.
+	maxKnockers          = 4
+	defaultKnockTimeout  = 5 * time.Second
+	maxKnockSequenceSize = 8
+)
+
+var errBadKnockConfig = errors.New("port knock config needs a callback and a sequence or SPA port")
+
+// PortKnockConfig configures a port knocking listener. Access is granted to
+// a source address that either sends a TCP SYN or UDP datagram to each of
+// the Sequence ports in order, or sends a single packet authorization (SPA)
+// UDP datagram to SPAPort accepted by SPAVerify.
+// Ports used for knocking should not be open on the stack.
+type PortKnockConfig struct {
+	// Sequence is the ordered list of destination ports to knock. At most 8 ports.
+	Sequence []uint16
+	// Timeout is the maximum time allowed between consecutive knocks.
+	// If zero a timeout of 5 seconds is used.
+	Timeout time.Duration
+	// SPAPort is the UDP port single packet authorization datagrams are sent to.
+	// Zero disables single packet authorization.
+	SPAPort uint16
+	// SPAVerify authenticates the payload of a datagram received on SPAPort,
+	// typically by checking a HMAC over it.
+	SPAVerify func(src netip.Addr, payload []byte) bool
+	// OnAccess is called with the source address of a completed knock
+	// sequence or authorized packet. It may be used to open a firewall rule
+	// or start a service.
+	OnAccess func(src netip.Addr)
+}
+
+// knocker tracks progress of sources through a port knock sequence.
+type knocker struct {
+	cfg      PortKnockConfig
+	sequence [maxKnockSequenceSize]uint16
+	seqlen   uint8
+	sources  [maxKnockers]knockSource
+}
+
+type knockSource struct {
+	addr [4]byte
+	next uint8
+	last time.Time
+}
+
+// SetPortKnock enables the port knocking listener configured by cfg.
+// Calling SetPortKnock with the zero value disables it.
+func (ps *PortStack) SetPortKnock(cfg PortKnockConfig) error {
+	k, err := newKnocker(cfg)
+	if err != nil {
+		return err
+	}
+	ps.knock = k
+	return nil
+}
+
+// newKnocker validates cfg and returns the listener state for it. It returns
+// nil with a nil error for the zero value configuration.
+func newKnocker(cfg PortKnockConfig) (*knocker, error) {
+	if cfg.OnAccess == nil && len(cfg.Sequence) == 0 && cfg.SPAPort == 0 {
+		return nil, nil
+	}
+	switch {
+	case cfg.OnAccess == nil,
+		len(cfg.Sequence) == 0 && cfg.SPAPort == 0,
+		cfg.SPAPort != 0 && cfg.SPAVerify == nil,
+		len(cfg.Sequence) > maxKnockSequenceSize:
+		return nil, errBadKnockConfig
+	}
+	for _, port := range cfg.Sequence {
+		if port == 0 {
+			return nil, errZeroPort
+		}
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultKnockTimeout
+	}
+	k := &knocker{cfg: cfg, seqlen: uint8(len(cfg.Sequence))}
+	copy(k.sequence[:], cfg.Sequence)
+	k.cfg.Sequence = k.sequence[:k.seqlen] // Do not retain caller's slice.
+	return k, nil
+}
+
+// observeKnock processes a TCP SYN or UDP datagram received from src to the
+// destination port dport. payload is only used for UDP datagrams.
+func (ps *PortStack) observeKnock(src [4]byte, dport uint16, udp bool, payload []byte) {
+	k := ps.knock
+	if udp && k.cfg.SPAPort != 0 && dport == k.cfg.SPAPort {
+		addr := netip.AddrFrom4(src)
+		if k.cfg.SPAVerify(addr, payload) {
+			ps.info("KNOCK:spa-access", ps.addrAttr("src", src))
+			k.cfg.OnAccess(addr)
+		} else {
+			ps.info("KNOCK:spa-reject", ps.addrAttr("src", src))
+		}
+		return
+	}
+	if k.seqlen == 0 {
+		return
+	}
+	now := ps.now()
+	var knock, free *knockSource
+	for i := range k.sources {
+		s := &k.sources[i]
+		if s.next != 0 && now.Sub(s.last) > k.cfg.Timeout {
+			s.next = 0 // Sequence timed out.
+		}
+		switch {
+		case s.next != 0 && s.addr == src:
+			knock = s
+		case s.next == 0 && free == nil:
+			free = s
+		}
+	}
+	if knock == nil {
+		if dport != k.sequence[0] {
+			return // Not the start of a sequence.
+		}
+		knock = free
+		if knock == nil {
+			// Replace the source that knocked least recently.
+			knock = &k.sources[0]
+			for i := range k.sources {
+				if k.sources[i].last.Before(knock.last) {
+					knock = &k.sources[i]
+				}
+			}
+		}
+		*knock = knockSource{addr: src}
+	}
+	knock.last = now
+	if dport != k.sequence[knock.next] {
+		knock.next = 0 // Wrong knock, start over.
+		if dport != k.sequence[0] {
+			return
+		}
+	}
+	knock.next++
+	if knock.next == k.seqlen {
+		knock.next = 0
+		addr := netip.AddrFrom4(src)
+		ps.info("KNOCK:access", ps.addrAttr("src", src))
+		k.cfg.OnAccess(addr)
+	}
+}
@@ -0,0 +1,103 @@
+package stacks
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	errPortRangeInvalid = errors.New("invalid port range")
+	errPortRangeOverlap = errors.New("port range overlaps existing reservation")
+)
+
+// PortReservation reserves a range of ports for a subsystem of the stack.
+// See [PortStack.ReservePorts].
+type PortReservation struct {
+	// Owner names the subsystem the range is reserved for, i.e: "DHCP client".
+	// It is reported in the errors of rejected binds and identifies the reservation.
+	Owner string
+	// TCP reserves TCP ports, UDP reserves UDP and UDP-Lite ports which share a number space.
+	TCP, UDP bool
+	// First and Last are the first and last ports of the range, inclusive.
+	First, Last uint16
+}
+
+// DefaultPortReservations returns the reservations of the ports of the stack's
+// built-in services. Pass them to [PortStack.ReservePorts] to keep applications
+// from binding them. A new slice is returned on every call so it may be modified.
+func DefaultPortReservations() []PortReservation {
+	return []PortReservation{
+		{Owner: "DHCP server", UDP: true, First: 67, Last: 67},
+		{Owner: "DHCP client", UDP: true, First: 68, Last: 68},
+		{Owner: "NTP", UDP: true, First: 123, Last: 123},
+		{Owner: "mDNS", UDP: true, First: 5353, Last: 5353},
+	}
+}
+
+// ReservePorts reserves the port ranges of res for the stack's subsystems.
+// Opening a [UDPConn], [TCPConn] or [TCPListener] on a reserved port fails
+// with an error naming the owner of the range instead of competing with the
+// subsystem for the port's packets. The stack's built-in services such as
+// [DHCPClient] or [NTPServer] open reserved ports normally and ephemeral ports
+// are never chosen from a reserved range. Ranges overlapping existing ones are rejected.
+func (ps *PortStack) ReservePorts(res ...PortReservation) error {
+	for i, r := range res {
+		if r.First == 0 || r.Last < r.First || (!r.TCP && !r.UDP) {
+			return errPortRangeInvalid
+		}
+		for _, other := range append(ps.reserved, res[:i]...) {
+			if r.overlaps(other) {
+				return errPortRangeOverlap
+			}
+		}
+	}
+	ps.reserved = append(ps.reserved, res...)
+	return nil
+}
+
+// ReleasePorts removes the reservations of owner. Open ports are not affected.
+func (ps *PortStack) ReleasePorts(owner string) {
+	n := 0
+	for _, r := range ps.reserved {
+		if r.Owner != owner {
+			ps.reserved[n] = r
+			n++
+		}
+	}
+	ps.reserved = ps.reserved[:n]
+}
+
+// AppendPortReservations appends the stack's port reservations to dst and returns the result.
+func (ps *PortStack) AppendPortReservations(dst []PortReservation) []PortReservation {
+	return append(dst, ps.reserved...)
+}
+
+func (r PortReservation) overlaps(other PortReservation) bool {
+	return ((r.TCP && other.TCP) || (r.UDP && other.UDP)) && r.First <= other.Last && other.First <= r.Last
+}
+
+// reservation returns the reservation containing portNum or nil if the port is not reserved.
+func (ps *PortStack) reservation(portNum uint16, tcp bool) *PortReservation {
+	for i := range ps.reserved {
+		r := &ps.reserved[i]
+		if ((tcp && r.TCP) || (!tcp && r.UDP)) && r.First <= portNum && portNum <= r.Last {
+			return r
+		}
+	}
+	return nil
+}
+
+// checkReserved returns an error if handler is an application socket and
+// portNum is reserved for a subsystem.
+func (ps *PortStack) checkReserved(portNum uint16, handler any, tcp bool) error {
+	switch handler.(type) {
+	case *UDPConn, *TCPConn, *TCPListener:
+	default:
+		return nil // Built-in services may open reserved ports.
+	}
+	r := ps.reservation(portNum, tcp)
+	if r == nil {
+		return nil
+	}
+	return errors.New("port " + strconv.Itoa(int(portNum)) + " reserved for " + r.Owner)
+}
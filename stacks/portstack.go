@@ -5,17 +5,19 @@ import (
 	"errors"
 	"io"
 	"log/slog"
+	"math"
 	"net/netip"
-	"strconv"
 	"time"
 
+	"github.com/soypat/seqs"
 	"github.com/soypat/seqs/eth"
 	"github.com/soypat/seqs/internal"
 )
 
 const (
-	defaultMTU = 2048
-	arpOpWait  = 0xffff
+	defaultMTU  = 2048
+	arpOpWait   = 0xffff
+	arpOpFailed = 0xfffe
 )
 
 var modernAge = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
@@ -30,27 +32,252 @@ type PortStackConfig struct {
 	// GlobalHandler ethernethandler
 	Logger *slog.Logger
 	MAC    [6]byte
-	// MTU is the maximum transmission unit of the ethernet interface.
+	// MTU is the maximum transmission unit of the ethernet interface: the size
+	// of the largest frame sent or received, Ethernet header included.
+	// See [PortStack.SetMTU].
 	MTU uint16
+	// MaxMTU is the largest MTU the stack may be configured with at runtime.
+	// Packet buffers of the stack and of sockets created on it are sized
+	// after it, so a single binary can serve interfaces with different MTUs.
+	// If zero MTU is used.
+	MaxMTU uint16
+	// Gateway is the default gateway through which destinations outside
+	// Subnet are reached. See [PortStack.SetGateway].
+	Gateway netip.Addr
+	Subnet  netip.Prefix
+	// MaxBufferedTCP limits the total amount of bytes held in TCP connection buffers
+	// across all open TCP ports. Once reached, connections advertise a zero receive
+	// window and new connection attempts are refused with a RST.
+	// A value of zero means no limit.
+	MaxBufferedTCP int
+	// PacketPoolBytes is the byte budget of a pool of MaxMTU sized packet
+	// buffers shared by the stack's TCP connections to hold segments received
+	// out of order. If set connections borrow buffers from the pool as
+	// segments are queued instead of each allocating [TCPConnConfig.RxQueueLen]
+	// buffers on creation, so idle connections cost almost nothing.
+	// See [PortStack.PacketPool].
+	PacketPoolBytes int
+	// WatchdogFeed is an optional callback, typically used to feed a hardware watchdog.
+	// It is called at the end of every HandleEth call that finds the stack healthy.
+	// See [PortStack.Health] and [Health.Wedged] for the criteria used.
+	WatchdogFeed func()
+	// WatchdogMaxRxAge is the maximum time allowed since the last received frame
+	// before the stack is considered wedged and WatchdogFeed stops being called.
+	// A value of zero disables the check.
+	WatchdogMaxRxAge time.Duration
+	// ProfileStages enables accounting of the time spent in each stage of
+	// frame processing, reported by [Stats.Stages], at the cost of a few
+	// clock reads per frame received or sent.
+	ProfileStages bool
+	// SnapshotInterval is the interval at which [PortStack.Poll] publishes
+	// snapshots of the stack for monitoring from other goroutines. If zero
+	// snapshots are only published by calling [PortStack.PublishSnapshot].
+	SnapshotInterval time.Duration
+	// IPv6 enables IPv6 on the interface. A link-local address derived from MAC
+	// is assigned, routers are solicited and an address is configured from the
+	// prefix they advertise (SLAAC). UDP sockets then also exchange datagrams
+	// with IPv6 remotes. See [PortStack.Addr6].
+	IPv6 bool
+	// VLAN is the 802.1Q VLAN identifier of the interface, between 1 and 4094.
+	// If set frames are sent tagged with it and only received frames tagged
+	// with it are accepted, untagged. Buffers passed to [PortStack.HandleEth]
+	// must then have room for the 4 byte tag beyond the MTU. If zero frames
+	// are sent untagged and tagged frames are dropped.
+	VLAN uint16
+	// L2Filter selects which frames are accepted based on their destination
+	// hardware address. If zero [DefaultL2Filter] is used.
+	L2Filter L2Filter
+	// MulticastFilter is an optional hook called with the subscribed multicast
+	// addresses each time [PortStack.JoinMulticastMAC] or [PortStack.LeaveMulticastMAC]
+	// change them, so the driver may program the NIC's multicast hash filter
+	// instead of receiving all multicast frames. The driver computes the hash
+	// used by its hardware. The macs slice must not be retained. If the hook
+	// returns an error when joining, the join is undone and the error returned.
+	MulticastFilter func(macs [][6]byte) error
+	// ICMPResponders enables replies to optional ICMP request types.
+	// No ICMP requests are answered by default.
+	ICMPResponders ICMPResponder
+	// AcceptICMPRedirects enables updating the first-hop router of
+	// destinations in the destination cache from ICMP redirects (RFC 1122).
+	// Redirects are ignored by default since any host on the link can forge
+	// them to divert traffic. See [DestinationInfo.Gateway].
+	AcceptICMPRedirects bool
+	// ICMPAddrMaskBits is the subnet mask prefix length sent in address mask
+	// replies when [ICMPAddrMask] is enabled. Must be between 0 and 32.
+	ICMPAddrMaskBits uint8
+	// Fingerprint configures behaviors observed by remote OS fingerprinting tools.
+	// The zero value is equivalent to the profile returned by [FingerprintDefault].
+	Fingerprint Fingerprint
+	// IPOptions selects how received IPv4 packets with options are handled.
+	// The zero value accepts packets with valid options. See [IPOptionsPolicy].
+	IPOptions IPOptionsPolicy
+	// Validation selects how received packets deviating from the protocol
+	// specifications are treated. See [Validation].
+	Validation Validation
+	// ChecksumOffload selects the checksums of received packets verified by
+	// the NIC, which the stack does not verify again. See [ChecksumOffload].
+	ChecksumOffload ChecksumOffload
+	// Entropy is the source of randomness for sequence numbers, transaction
+	// IDs and IPv4 identifications. If nil crypto/rand is used. See [PortStack.SetEntropy].
+	Entropy io.Reader
+	// Clock returns the current time. If nil time.Now is used. Simulations
+	// set it to a virtual clock so that timers, i.e: retransmissions, expire
+	// without waiting. Socket deadlines are compared against it, while
+	// blocking calls such as [DialTCP] use the system clock for their timeouts.
+	Clock func() time.Time
+	// ARPCacheSize is the amount of entries of the neighbor cache holding
+	// resolved hardware addresses. If zero a cache of 8 entries is used.
+	ARPCacheSize int
+	// ARPCacheTTL is the time after which cached hardware addresses expire and
+	// must be resolved again. If zero entries expire after 5 minutes.
+	ARPCacheTTL time.Duration
+	// ARPTimeout is the time waited for a reply to an ARP request before it is
+	// sent again. If zero 1 second is used.
+	ARPTimeout time.Duration
+	// ARPRetries is the amount of times an unanswered ARP request is sent
+	// again before the resolution fails. If zero 3 retries are made.
+	ARPRetries uint8
+	// ARPQueueLen is the maximum amount of outgoing UDP datagrams held per
+	// destination while its hardware address is resolved, with room for twice
+	// as many shared by all destinations. They are sent once it resolves or
+	// dropped if the resolution fails, in which case connected sockets report
+	// the host unreachable. If zero datagrams wait in their socket's buffer,
+	// holding back those queued after them.
+	ARPQueueLen int
+	// TCP configures the TCP connections created on the stack. See [TCPConfig].
+	TCP TCPConfig
+	// AddrConflictDetection enables IPv4 address conflict detection (RFC 5227).
+	// Each address set with [PortStack.SetAddr] is probed for with ARP and
+	// announced, after which ARP packets from other hosts claiming it are
+	// reported as conflicts. Nothing but probes is sent until the address is
+	// announced, 4 seconds after it is set. A conflict detected while
+	// probing holds traffic until the conflict is cleared. See [PortStack.AddrConflict].
+	AddrConflictDetection bool
+	// AddrConflictPause pauses transmission of all but ARP traffic while an
+	// address conflict is detected, until [PortStack.ClearAddrConflict] or
+	// [PortStack.SetAddr] are called. If false the address is defended.
+	AddrConflictPause bool
+	// OnAddrConflict is an optional callback called when another host with
+	// hardware address hw is detected using the stack's address addr. An
+	// address leased with DHCP should then be declined, see [DHCPClient.Decline].
+	OnAddrConflict func(addr netip.Addr, hw [6]byte)
+	// OnPeerIdentity is an optional callback called when the security layer
+	// of conn authenticates the remote end of the connection as id, i.e: to
+	// audit or authorize clients. See [TCPConn.SetPeerIdentity].
+	OnPeerIdentity func(conn *TCPConn, id PeerIdentity)
+	// StormControl configures suppression of broadcast and multicast storms.
+	// Disabled by default. See [StormControl].
+	StormControl StormControl
+	// DuplicateFilter configures suppression of duplicate received frames.
+	// Disabled by default. See [DuplicateFilter].
+	DuplicateFilter DuplicateFilter
+	// GatewayFailover configures dead gateway detection over several
+	// default gateways within Subnet. Disabled by default. See [GatewayFailover].
+	GatewayFailover GatewayFailover
+	// IPReassemblyBuffers is the amount of fragmented IPv4 datagrams that may
+	// be reassembled at a time. Only UDP datagrams are reassembled and their
+	// size is limited by the largest MTU. If zero fragments are dropped.
+	IPReassemblyBuffers int
+	// IPReassemblyTimeout is the time after the first fragment of a datagram is
+	// received after which it is discarded if incomplete. If zero 15 seconds is used.
+	IPReassemblyTimeout time.Duration
+	// DestinationCacheSize is the amount of remote hosts whose path MTU,
+	// round trip time and failure state are cached for new connections. If
+	// zero metrics are not cached. See [PortStack.Destination].
+	DestinationCacheSize int
 }
 
 // NewPortStack creates a ready to use TCP/UDP Stack instance.
 func NewPortStack(cfg PortStackConfig) *PortStack {
 	s := &PortStack{}
 	s.arpClient.stack = s
+	cacheSize := cfg.ARPCacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultARPCacheSize
+	}
+	s.arpClient.cache = arpCache{entries: make([]arpEntry, cacheSize), ttl: cfg.ARPCacheTTL}
+	s.arpClient.timeout = cfg.ARPTimeout
+	s.arpClient.retries = cfg.ARPRetries
+	s.acd = addrConflict{enabled: cfg.AddrConflictDetection, pause: cfg.AddrConflictPause, onConflict: cfg.OnAddrConflict}
+	s.onPeerIdentity = cfg.OnPeerIdentity
 	s.mac = cfg.MAC
 	// s.ip = cfg.IP.As4()
 	s.portsUDP = make([]udpPort, cfg.MaxOpenPortsUDP)
 	s.portsTCP = make([]tcpPort, cfg.MaxOpenPortsTCP)
 	s.logger = cfg.Logger
-	if cfg.MTU > defaultMTU {
-		panic("please use a smaller MTU. max=" + strconv.Itoa(defaultMTU))
+	s.maxMTU = cfg.MaxMTU
+	if s.maxMTU == 0 {
+		s.maxMTU = cfg.MTU
+	} else if cfg.MTU > s.maxMTU {
+		panic("MTU exceeds MaxMTU")
 	}
 	s.mtu = cfg.MTU
+	auxMTU := s.maxMTU
+	if cfg.IPReassemblyBuffers > 0 && auxMTU < defaultMTU {
+		auxMTU = defaultMTU // Reassembled datagrams are held in the UDP packet buffer.
+	}
+	s.auxUDP = makeUDPPacket(auxMTU)
+	s.auxTCP = makeTCPPackets(1, s.maxMTU)[0]
+	if cfg.ARPQueueLen > 0 {
+		s.arpq = makeARPQueue(cfg.ARPQueueLen, s.maxMTU)
+	}
+	if err := s.SetGateway(cfg.Gateway, cfg.Subnet); err != nil {
+		panic(err.Error())
+	} else if err = s.SetGatewayFailover(cfg.GatewayFailover); err != nil {
+		panic(err.Error())
+	}
+	s.maxBufferedTCP = cfg.MaxBufferedTCP
+	s.pool = makePacketPool(cfg.PacketPoolBytes, s.maxMTU)
+	s.watchdogFeed = cfg.WatchdogFeed
+	s.watchdogMaxRxAge = cfg.WatchdogMaxRxAge
+	s.l2filter = cfg.L2Filter
+	s.vlan = cfg.VLAN & 0xfff
+	s.prof.enabled = cfg.ProfileStages
+	s.snap.interval = cfg.SnapshotInterval
+	s.multicastFilter = cfg.MulticastFilter
+	s.storm.cfg = cfg.StormControl
+	s.dedup.cfg = cfg.DuplicateFilter
+	s.reasm.bufs = make([]reassemblyBuf, cfg.IPReassemblyBuffers)
+	s.reasm.timeout = cfg.IPReassemblyTimeout
+	if s.reasm.timeout <= 0 {
+		s.reasm.timeout = defaultReassemblyTimeout
+	}
+	s.dests.entries = make([]destEntry, cfg.DestinationCacheSize)
+	s.SetEntropy(cfg.Entropy)
+	if s.l2filter == 0 {
+		s.l2filter = DefaultL2Filter
+	}
+	if cfg.ICMPAddrMaskBits > 32 {
+		panic("ICMPAddrMaskBits must be at most 32")
+	}
+	s.icmpResponders = cfg.ICMPResponders
+	s.icmpMaskBits = cfg.ICMPAddrMaskBits
+	s.acceptRedirects = cfg.AcceptICMPRedirects
+	s.fingerprint = cfg.Fingerprint
+	if cfg.IPOptions >= numIPOptionsPolicies {
+		panic("invalid IPOptions policy")
+	}
+	s.ipOptsPolicy = cfg.IPOptions
+	if cfg.Validation >= numValidations {
+		panic("invalid Validation mode")
+	}
+	s.validation = cfg.Validation
+	s.checksumOffload = cfg.ChecksumOffload
+	if err := cfg.TCP.Validate(); err != nil {
+		panic(err.Error())
+	}
+	s.tcpcfg = cfg.TCP.withDefaults()
+	s.clock = cfg.Clock
 	now := time.Now()
 	if now.Before(modernAge) {
 		// s.timeadd = modernAge.Sub(now)
 	}
+	s.started = s.now()
+	if cfg.IPv6 {
+		if err := s.enableIPv6(); err != nil {
+			panic(err.Error())
+		}
+	}
 	return s
 }
 
@@ -62,10 +289,19 @@ var ErrFlagPending = errors.New("seqs: pending data")
 //   - In the case of TCP this means implementing the TCP state machine.
 //   - In the case of UDP PortStack should be enough to build  most applications.
 //
+// # Multiple stacks
+//
+// All state of a stack, including its clock, entropy source, logger and
+// buffers, is held by the PortStack and its sockets; the package keeps no
+// mutable state of its own. Any number of stacks may run in one process, i.e:
+// a gateway with a stack per interface or a simulation of many hosts, each
+// driven by its own goroutine. A single stack must not be used concurrently.
+//
 // # Notes on PortStack handlers
 //
 //   - While PortStack.HandleEth has yet to find a outgoing packet it will look for
 //     a port that has a pending packet or has been flagged as pending and call its handler.
+//     Ports are flagged explicitly with [PortStack.RequestSendUDP] and [PortStack.RequestSendTCP].
 //
 //   - A call to a handler may or may not have an incoming packet ready to process.
 //     When pkt.HasPacket() returns true then pkt contains an incoming packet to the port.
@@ -97,25 +333,166 @@ type PortStack struct {
 	portsUDP      []udpPort
 	portsTCP      []tcpPort
 
-	pendingUDPv4     uint32
-	pendingTCPv4     uint32
+	pendingUDPv4 uint32
+	pendingTCPv4 uint32
+	// tcpWake is the time the earliest TCP timer not yet flagged pending
+	// expires, zero if none is armed. See [PortStack.wakeTCPAt].
+	tcpWake          time.Time
 	processedPackets uint32
 	// droppedPackets counts amount of packets corresponding to TCP/UDP ports
 	// that have been dropped due to the port requiring handling before admitting more packets.
 	droppedPackets uint32
+	// droppedLLC counts received 802.3 frames without a supported LLC/SNAP header.
+	droppedLLC uint32
+	// vlan is the VLAN identifier frames are tagged with. See vlan.go.
+	vlan        uint16
+	droppedVLAN uint32
+	// rejectedL2 counts received frames rejected by the L2 filter.
+	rejectedL2 uint32
+	// rejectedMD5 counts received TCP segments failing MD5 signature verification.
+	rejectedMD5 uint32
+	// rejectedACL counts received packets from peers not allowed on the destination port.
+	rejectedACL uint32
+	// rejectedIPOpts counts received packets dropped by the IPv4 options policy.
+	rejectedIPOpts uint32
+	ipOptsPolicy   IPOptionsPolicy
+	// inspector examines packets before delivery. See inspect.go.
+	inspector       Inspector
+	auxInspect      Inspection
+	rejectedInspect uint32
+	// auxIP and auxTCPHdr hold the headers of the packet being received so
+	// that they do not escape to the heap when passed to handlers.
+	auxIP     eth.IPv4Header
+	auxTCPHdr eth.TCPHeader
+	// deviations counts received packets deviating from the specifications. See validation.go.
+	deviations uint32
+	validation Validation
+	// Received packets with invalid checksums and checksums verified by the NIC. See validation.go.
+	badChecksums    checksumCounts
+	checksumOffload ChecksumOffload
+	// stats holds the traffic counters. See stats.go.
+	stats Stats
+	// rxRate and txRate meter the frame bytes received and sent. See ratemeter.go.
+	rxRate, txRate rateMeter
+	// raw holds the open raw sockets. See rawconn.go.
+	raw [maxRawConns]*RawConn
+	// ip6 holds the IPv6 configuration. See ipv6.go.
+	ip6 ipv6State
+	// prof accounts the time spent per processing stage. See profile.go.
+	prof stageProfiler
+	// snap holds the snapshots read from other goroutines. See snapshot.go.
+	snap snapshots
+	// pool holds the packet buffers borrowed by TCP receive queues. See pktpool.go.
+	pool packetPool
+	// filter is the ingress packet filter. See pktfilter.go.
+	filter packetFilter
+	// L2 filtering state. See l2filter.go.
+	l2filter   L2Filter
+	nmulticast int
+	multicast  [maxMulticastMACs][6]byte
+	// multicastFilter is the hardware filter programming hook.
+	multicastFilter func(macs [][6]byte) error
+	// groups holds the IPv4 multicast groups joined. See multicast.go.
+	groups [maxMulticastGroups]multicastGroup
+	// tcpcfg is the configuration of TCP connections created on the stack. See tcpconfig.go.
+	tcpcfg TCPConfig
+	// entropy is the randomness source. prandState is the fallback generator state. See entropy.go.
+	entropy    io.Reader
+	prandState uint32
 	// ARP state. See arp.go for detailed information on the ARP state machine.
 	arpClient arpClient
+	// arpq holds frames awaiting resolution of their destination. See arpqueue.go.
+	arpq arpQueue
 	// Auxiliary struct to avoid allocations passed to global handler.
-	auxEth  eth.EthernetHeader
-	mac     [6]byte
-	ip      [4]byte
-	mtu     uint16
+	auxEth eth.EthernetHeader
+	mac    [6]byte
+	ip     [4]byte
+	mtu    uint16
+	// maxMTU is the MTU packet buffers are sized for. See iface.go.
+	maxMTU  uint16
 	auxUDP  UDPPacket
 	auxTCP  TCPPacket
 	auxARP  eth.ARPv4Header
 	timeadd time.Duration
+	clock   func() time.Time
+	// aliases are additional addresses assigned to the stack. aliases4 holds
+	// their addresses in the form compared per packet.
+	aliases  [maxAddrAliases]netip.Prefix
+	aliases4 [maxAddrAliases][4]byte
+	naliases int
+	// rst is a RST segment pending to be sent, generated by the stack itself.
+	rst            tcpReset
+	maxBufferedTCP int
+	// icmp is an ICMP reply pending to be sent. See icmp.go.
+	icmp           icmpReply
+	ping           pinger
+	icmpResponders ICMPResponder
+	icmpMaskBits   uint8
+	// acceptRedirects enables ICMP redirect processing. See icmpredirect.go.
+	acceptRedirects bool
+	// fingerprint and ipid shape outgoing IP headers. See fingerprint.go.
+	fingerprint Fingerprint
+	ipid        uint16
+	// tcpmd5 signs and verifies TCP segments. See tcpmd5.go.
+	tcpmd5 TCPMD5Func
+	// knock is the port knocking listener. See portknock.go.
+	knock *knocker
+	// capture holds recently received and sent frames. See capture.go.
+	capture *packetCapture
+	// captureHook is called with frames matching captureFilter. See pcapng.go.
+	captureHook   CaptureHook
+	captureFilter CaptureFilter
+	// activity holds recent TCP connection activity. See activity.go.
+	activity *activityTrace
+	// lldp is the LLDP neighbor table. See lldp.go.
+	lldp []lldpNeighbor
+	// txOwner is the port that generated the last frame sent. See txdone.go.
+	txOwner    txOwner
+	txFailures uint32
+	// nextUDP and nextTCP are the ports HandleEth services first. See poll.go.
+	nextUDP, nextTCP int
+
+	// Health and watchdog state. See health.go.
+	started          time.Time
+	recvErrors       uint32
+	handleErrors     uint32
+	consecutiveErrs  uint32
+	watchdogFeed     func()
+	watchdogMaxRxAge time.Duration
+	traceFilter      TraceFilter
+	// acd is the address conflict detection state. See addrconflict.go.
+	acd addrConflict
+	// onPeerIdentity is called when a connection's peer is authenticated. See peerid.go.
+	onPeerIdentity func(conn *TCPConn, id PeerIdentity)
+	// storm is the broadcast and multicast storm suppression state. See storm.go.
+	storm stormControl
+	// dedup is the duplicate frame suppression state. See dedup.go.
+	dedup dupFilter
+	// nic is the link state of the NIC serviced by the stack. See nic.go.
+	nic nicState
+	// reasm is the IPv4 reassembly state. See ipfrag.go.
+	reasm ipReassembly
+	// flows is the exporter of finished flows, if started. See flowexport.go.
+	flows *FlowExporter
+	// hosts holds the hostname and static name mappings. See hosts.go.
+	hosts hostTable
+	// dests caches metrics of remote hosts. See destcache.go.
+	dests destCache
+	// reserved holds the port ranges reserved for subsystems. See portreserve.go.
+	reserved []PortReservation
+	// gateway is the default route for destinations outside subnet. See iface.go.
+	gateway netip.Addr
+	subnet  netip.Prefix
+	// gateway4 and subnet4 are gateway and subnet in the form compared per packet.
+	gateway4 [4]byte
+	subnet4  ipv4Prefix
+	// gwmon is the dead gateway detection state. See gwfailover.go.
+	gwmon gatewayMonitor
 }
 
+// maxAddrAliases is the amount of address aliases that can be assigned to a PortStack.
+const maxAddrAliases = 4
+
 // Common errors.
 var (
 	ErrDroppedPacket    = errors.New("dropped packet")
@@ -133,6 +510,7 @@ var (
 	errBadUDPLength     = errors.New("invalid UDP length")
 	errInvalidIHL       = errors.New("invalid IP IHL")
 	errIPVersion        = errors.New("IP version not supported")
+	errIPFragment       = errors.New("IP fragment dropped: reassembly not enabled")
 	errUnknownIPProto   = errors.New("unknown IP protocol")
 
 	errPortNoSpace        = errors.New("port limit reached")
@@ -148,6 +526,65 @@ func (ps *PortStack) SetAddr(addr netip.Addr) {
 	}
 	ps.trace("SetAddr")
 	ps.ip = addr.As4()
+	ps.acd.restart(ps.now())
+}
+
+// AddAddrAlias assigns an additional IPv4 address to the stack. The stack
+// answers ARP requests and accepts traffic for aliases as it does for the
+// primary address set with SetAddr. Connections accepted on an alias use it
+// as their local address. Traffic originated by the stack uses the primary address.
+func (ps *PortStack) AddAddrAlias(prefix netip.Prefix) error {
+	addr := prefix.Addr()
+	if !addr.Is4() {
+		return errors.New("alias must be IPv4")
+	} else if addr.IsUnspecified() || addr.As4() == ps.ip {
+		return errBadAddr
+	}
+	for i := 0; i < ps.naliases; i++ {
+		if ps.aliases[i].Addr() == addr {
+			ps.aliases[i] = prefix
+			return nil
+		}
+	}
+	if ps.naliases == len(ps.aliases) {
+		return errors.New("address alias limit reached")
+	}
+	ps.aliases[ps.naliases] = prefix
+	ps.aliases4[ps.naliases] = addr.As4()
+	ps.naliases++
+	return nil
+}
+
+// RemoveAddrAlias unassigns an address added with AddAddrAlias.
+func (ps *PortStack) RemoveAddrAlias(addr netip.Addr) {
+	for i := 0; i < ps.naliases; i++ {
+		if ps.aliases[i].Addr() == addr {
+			ps.naliases--
+			ps.aliases[i] = ps.aliases[ps.naliases]
+			ps.aliases4[i] = ps.aliases4[ps.naliases]
+			ps.aliases[ps.naliases] = netip.Prefix{}
+			ps.aliases4[ps.naliases] = [4]byte{}
+			return
+		}
+	}
+}
+
+// AppendAddrAliases appends the stack's address aliases to dst and returns the result.
+func (ps *PortStack) AppendAddrAliases(dst []netip.Prefix) []netip.Prefix {
+	return append(dst, ps.aliases[:ps.naliases]...)
+}
+
+// isLocalAddr reports whether addr is the primary address or an alias of the stack.
+func (ps *PortStack) isLocalAddr(addr [4]byte) bool {
+	if addr == ps.ip {
+		return true
+	}
+	for i := 0; i < ps.naliases; i++ {
+		if ps.aliases4[i] == addr {
+			return true
+		}
+	}
+	return false
 }
 
 func (ps *PortStack) MTU() uint16 { return ps.mtu }
@@ -160,18 +597,60 @@ func (ps *PortStack) HardwareAddr6() [6]byte { return ps.mac }
 //
 // If [Stack.HandleEth] is not called often enough prevent packet queue from
 // filling up on a socket RecvEth will start to return [ErrDroppedPacket].
+//
+// IEEE 802.3 frames carrying a RFC 1042 LLC/SNAP encapsulated packet are
+// converted in place to Ethernet II framing, modifying ethernetFrame. Other
+// 802.3 frames are dropped and counted in [Health].
 func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 	// defer ps.trace("RecvEth:end")
-	var ihdr eth.IPv4Header
+	if ps.prof.enabled {
+		ps.prof.begin(stageDecode)
+		defer ps.prof.end()
+	}
+	ihdr := &ps.auxIP
 	payload := ethernetFrame
+	if len(payload) >= eth.SizeEthernetHeader && !ps.acceptL2([6]byte(payload[:6])) {
+		ps.rejectedL2++
+		return nil // Ignore packet, is not for us.
+	}
+	if len(payload) >= eth.SizeEthernetHeader && ps.stormDrop([6]byte(payload[:6])) {
+		return nil // Traffic class suppressed.
+	}
+	if ps.duplicateDrop(payload) {
+		return nil // Duplicate frame.
+	}
+	payload, ok := ps.untagVLAN(payload)
+	if !ok {
+		ps.droppedVLAN++
+		return nil // Not on our VLAN.
+	}
+	ethernetFrame = payload
+	if len(payload) >= eth.SizeEthernetHeader+eth.SizeSNAPHeader {
+		if ehdr := eth.DecodeEthernetHeader(payload); ehdr.IsLength() {
+			_, ok := eth.DecodeSNAPEtherType(payload[eth.SizeEthernetHeader:])
+			if !ok {
+				ps.droppedLLC++
+				return nil
+			}
+			// Move MAC addresses over LLC/SNAP header so that the SNAP EtherType sits in the EtherType field.
+			copy(payload[eth.SizeSNAPHeader:eth.SizeSNAPHeader+12], payload[:12])
+			payload = payload[eth.SizeSNAPHeader:]
+			ethernetFrame = payload
+		}
+	}
 	if len(payload) < eth.SizeEthernetHeader+eth.SizeIPv4Header {
 		return errPacketSmol
 	} else if len(payload) > int(ps.mtu) {
 		println("recv", payload, ps.mtu)
 		return errPacketExceedsMTU
 	}
-	ps.trace("Stack.RecvEth:start", slog.Int("plen", len(payload)))
+	if ps.tracePacket(ethernetFrame, internal.LevelTrace, false) {
+		ps.trace("Stack.RecvEth:start", slog.Int("plen", len(payload)))
+	}
 	ps.lastRx = ps.now()
+	ps.stats.Rx.count(ethernetFrame)
+	ps.rxRate.add(ps.lastRx, len(ethernetFrame))
+	ps.captureFrame(ps.lastRx, ethernetFrame, false)
 	// Ethernet parsing block
 	ps.auxEth = eth.DecodeEthernetHeader(payload)
 	ehdr := &ps.auxEth
@@ -181,10 +660,22 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 			return err
 		}
 	}
+	if ehdr.Source[0]&1 != 0 && ps.deviation("multicast source address", true) {
+		return errNonConformant
+	}
 	etype := ehdr.AssertType()
-	if ehdr.Destination != eth.BroadcastHW6() && ehdr.Destination != ps.mac {
-		return nil // Ignore packet, is not for us.
+	if etype != eth.EtherTypeIPv4 && etype != eth.EtherTypeARP && !ps.filterAcceptEtherType(etype) {
+		return nil
+	}
+	if etype == eth.EtherTypeLLDP {
+		ps.prof.enter(stageHandler)
+		return ps.recvLLDP(ehdr.Source, payload[eth.SizeEthernetHeader:])
+	} else if etype == eth.EtherTypeIPv6 && ps.ip6.enabled {
+		ps.prof.enter(stageHandler)
+		return ps.recvIPv6(ehdr, ethernetFrame)
 	} else if etype != eth.EtherTypeIPv4 && etype != eth.EtherTypeARP {
+		ps.prof.enter(stageDemux)
+		ps.recvRaw(ethernetFrame, etype, 0)
 		return nil // Ignore Non-IPv4 packets.
 	}
 
@@ -193,11 +684,12 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 			return errPacketSmol
 		}
 		ps.auxARP = eth.DecodeARPv4Header(payload[eth.SizeEthernetHeader:])
+		ps.prof.enter(stageHandler)
 		return ps.arpClient.recv(&ps.auxARP)
 	}
 	// IP parsing block.
 	var ipOffset uint8
-	ihdr, ipOffset = eth.DecodeIPv4Header(payload[eth.SizeEthernetHeader:])
+	*ihdr, ipOffset = eth.DecodeIPv4Header(payload[eth.SizeEthernetHeader:])
 	offset := eth.SizeEthernetHeader + ipOffset // Can be at most 14+60=74, so no overflow risk.
 	end := eth.SizeEthernetHeader + ihdr.TotalLength
 	switch {
@@ -206,22 +698,64 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 	case ipOffset < eth.SizeIPv4Header:
 		return errInvalidIHL
 
-	case ps.ip != ihdr.Destination && ps.ip != [4]byte{}:
+	case ps.ip != [4]byte{} && !ps.isLocalAddr(ihdr.Destination) && !ps.isGroupMember(ihdr.Destination):
 		return nil // Not for us.
 	case uint16(offset) > end || int(offset) > len(payload) || int(end) > len(payload):
 		return errBadIPTotalLenOrIHL
 	case end > ps.mtu:
 		return errPacketExceedsMTU
 	}
-	ipOptions := payload[eth.SizeEthernetHeader+eth.SizeIPv4Header : offset] // TODO add IPv4 options.
+	if ps.checksumOffload&ChecksumOffloadIPv4 == 0 && !ps.validIPChecksum(payload[eth.SizeEthernetHeader:offset]) && ps.deviation("IP checksum", true) {
+		ps.stats.DroppedChecksum++
+		return errBadIPChecksum
+	} else if ihdr.TTL == 0 && ps.deviation("zero TTL", true) {
+		return errNonConformant
+	}
+	if ipOptions := payload[eth.SizeEthernetHeader+eth.SizeIPv4Header : offset]; len(ipOptions) > 0 {
+		accept, err := ps.checkIPOptions(ihdr.Source, ipOptions)
+		if err != nil || !accept {
+			return err
+		}
+		stripIPOptions(ihdr) // Handlers see packets without options.
+	}
 	payload = payload[offset:end]
-	isDebug := ps.isLogEnabled(slog.LevelDebug)
-	switch ihdr.Protocol {
+	rawFrame := ethernetFrame // Offered to raw sockets if the stack does not claim the packet.
+	if ihdr.Flags.MoreFragments() || ihdr.Flags.FragmentOffset() != 0 {
+		rawFrame = nil // Reassembled datagrams are not offered.
+		// Handlers would misread the headers of non-first fragments so
+		// fragments are held until the datagram is reassembled. See ipfrag.go.
+		payload, err = ps.reassemble(ihdr, payload)
+		if payload == nil {
+			return err
+		}
+	}
+	if ps.filter.active() {
+		ps.prof.enter(stageDemux)
+		if !ps.filterAccept(ihdr, payload) {
+			return nil
+		}
+	}
+	isDebug := ps.tracePacket(ethernetFrame, slog.LevelDebug, false)
+	switch eth.IPProto(ihdr.Protocol) {
 	default:
-		err = errUnknownIPProto
-	case 17:
-		// UDP (User Datagram Protocol).
-		if len(ps.portsUDP) == 0 {
+		ps.prof.enter(stageDemux)
+		if !ps.recvRaw(rawFrame, etype, ihdr.Protocol) {
+			err = errUnknownIPProto
+		}
+	case eth.IPProtoICMP:
+		// ICMP (Internet Control Message Protocol).
+		ps.prof.enter(stageHandler)
+		err = ps.recvICMP(ehdr, ihdr, payload)
+	case eth.IPProtoIGMP:
+		// IGMP (Internet Group Management Protocol).
+		ps.prof.enter(stageHandler)
+		err = ps.recvIGMP(payload)
+	case eth.IPProtoUDP, eth.IPProtoUDPLite:
+		// UDP (User Datagram Protocol) and UDP-Lite (RFC 3828), which share ports and code path.
+		// UDP-Lite replaces the length field with a checksum coverage field.
+		lite := eth.IPProto(ihdr.Protocol) == eth.IPProtoUDPLite
+		if len(ps.portsUDP) == 0 && ps.knock == nil {
+			ps.recvRaw(rawFrame, etype, ihdr.Protocol)
 			break // No sockets.
 		} else if len(payload) < eth.SizeUDPHeader {
 			err = errTooShortTCPOrUDP
@@ -231,21 +765,40 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 		if uhdr.DestinationPort == 0 || uhdr.SourcePort == 0 {
 			err = errZeroPort
 			break
-		} else if uhdr.Length < 8 {
+		} else if (!lite || uhdr.Length != 0) && (uhdr.Length < 8 || int(uhdr.Length) > len(payload)) {
 			err = errBadUDPLength
 			break
 		}
+		if !lite {
+			payload = payload[:uhdr.Length] // Octets past the UDP length are not part of the datagram.
+		}
 
 		payload = payload[eth.SizeUDPHeader:]
-		gotsum := uhdr.CalculateChecksumIPv4(&ihdr, payload)
-		if gotsum != uhdr.Checksum {
+		if ps.checksumOffload&ChecksumOffloadUDP == 0 && !ps.validUDPChecksum(ihdr, &uhdr, payload, lite) && ps.deviation("UDP checksum", false) {
+			ps.stats.DroppedChecksum++
 			err = ErrChecksumTCPorUDP
 			break
 		}
 
+		ps.prof.enter(stageDemux)
+		if ps.knock != nil && !lite {
+			ps.observeKnock(ihdr.Source, uhdr.DestinationPort, true, payload)
+		}
 		port := findPort(ps.portsUDP, uhdr.DestinationPort)
-		if port == nil {
+		if port == nil || port.lite != lite {
+			if ps.recvRaw(rawFrame, etype, ihdr.Protocol) {
+				break // Claimed by a raw socket.
+			}
+			if ps.tracePacket(ethernetFrame, slog.LevelDebug, true) {
+				ps.debug("udp:noSocket", slog.Int("port", int(uhdr.DestinationPort)), slog.Bool("lite", lite))
+			}
+			ps.stats.DroppedNoSocket++
 			break // No socket listening on this port.
+		} else if !port.allow.allows(ihdr.Source) {
+			ps.rejectACL(ihdr.Source, uhdr.DestinationPort)
+			break
+		} else if ps.inspector != nil && !ps.inspect(ehdr, ihdr, &uhdr, nil, nil, payload) {
+			break
 		}
 
 		pkt := &ps.auxUDP
@@ -262,10 +815,11 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 
 		// Flag packets as needing processing.
 		ps.pendingUDPv4++
+		ps.prof.enter(stageHandler)
 
 		pkt.Rx = ps.lastRx
 		pkt.Eth = *ehdr
-		pkt.IP = ihdr // TODO(soypat): Don't ignore IP options.
+		pkt.IP = *ihdr
 		pkt.UDP = uhdr
 		copy(pkt.payload[:], payload)
 		err = port.ihandler.recv(pkt)
@@ -280,16 +834,19 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 			err = nil // TODO(soypat).
 		}
 
-	case 6:
+	case eth.IPProtoTCP:
 		// TCP (Transport Control Protocol).
-		if len(ps.portsTCP) == 0 {
+		if len(ps.portsTCP) == 0 && ps.knock == nil {
+			ps.recvRaw(rawFrame, etype, ihdr.Protocol)
 			break // No sockets.
 		} else if len(payload) < eth.SizeTCPHeader {
 			err = errTooShortTCPOrUDP
 			break
 		}
 
-		thdr, offset := eth.DecodeTCPHeader(payload)
+		thdr := &ps.auxTCPHdr
+		var offset uint8
+		*thdr, offset = eth.DecodeTCPHeader(payload)
 		if thdr.DestinationPort == 0 || thdr.SourcePort == 0 {
 			err = errZeroPort
 			break
@@ -300,18 +857,41 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 
 		tcpOptions := payload[eth.SizeTCPHeader:offset]
 		payload = payload[offset:]
-		gotsum := thdr.CalculateChecksumIPv4(&ihdr, tcpOptions, payload)
-
-		if gotsum != thdr.Checksum {
+		if ps.checksumOffload&ChecksumOffloadTCP == 0 && !ps.validTCPChecksum(ihdr, thdr, tcpOptions, payload) && ps.deviation("TCP checksum", false) {
+			ps.stats.DroppedChecksum++
 			err = ErrChecksumTCPorUDP
 			break
+		} else if ps.tcpmd5 != nil && !ps.verifyTCPMD5(ihdr, thdr, tcpOptions, payload) {
+			break // RFC 2385: Segments failing verification are silently dropped.
+		}
+		ps.prof.enter(stageDemux)
+		if ps.knock != nil && thdr.Flags() == seqs.FlagSYN {
+			ps.observeKnock(ihdr.Source, thdr.DestinationPort, false, nil)
 		}
 		port := findPort(ps.portsTCP, thdr.DestinationPort)
 		if port == nil {
-			if isDebug {
+			if ps.recvRaw(rawFrame, etype, ihdr.Protocol) {
+				break // Claimed by a raw socket.
+			}
+			if ps.tracePacket(ethernetFrame, slog.LevelDebug, true) {
 				ps.debug("tcp:noSocket", slog.Int("port", int(thdr.DestinationPort)), slog.Int("avail", len(ps.portsTCP)))
 			}
+			ps.stats.DroppedNoSocket++
+			if ps.knock == nil && ps.isLocalAddr(ihdr.Destination) {
+				// RFC 9293 3.10.7.1: Segments to closed ports are answered with a RST.
+				// Ports hidden by port knocking stay silent.
+				pkt := &ps.auxTCP
+				pkt.Eth, pkt.IP, pkt.TCP = *ehdr, *ihdr, *thdr
+				n := copy(pkt.data[:], tcpOptions)
+				copy(pkt.data[n:], payload)
+				ps.refuseTCP(pkt)
+			}
 			break // No socket listening on this port.
+		} else if !port.allow.allows(ihdr.Source) {
+			ps.rejectACL(ihdr.Source, thdr.DestinationPort)
+			break
+		} else if ps.inspector != nil && !ps.inspect(ehdr, ihdr, nil, thdr, tcpOptions, payload) {
+			break
 		}
 
 		pkt := &ps.auxTCP
@@ -324,17 +904,16 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 		if isDebug {
 			ps.debug("TCP:recv",
 				slog.Int("opt", len(tcpOptions)),
-				slog.Int("ipopt", len(ipOptions)),
 				slog.Int("payload", len(payload)),
 			)
 		}
 		ps.pendingTCPv4++
+		ps.prof.enter(stageTCP)
 		pkt.Rx = ps.lastRx
 		pkt.Eth = *ehdr
-		pkt.IP = ihdr
-		pkt.TCP = thdr
-		n := copy(pkt.data[:], ipOptions)
-		n += copy(pkt.data[n:], tcpOptions)
+		pkt.IP = *ihdr
+		pkt.TCP = *thdr
+		n := copy(pkt.data[:], tcpOptions)
 		copy(pkt.data[n:], payload)
 		err = port.handler.recv(pkt)
 		if err == io.EOF {
@@ -349,23 +928,52 @@ func (ps *PortStack) RecvEth(ethernetFrame []byte) (err error) {
 		}
 	}
 	if err != nil {
-		ps.error("Stack.RecvEth", slog.String("err", err.Error()))
+		ps.recvErrors++
+		if ps.tracePacket(ethernetFrame, slog.LevelError, true) {
+			ps.error("Stack.RecvEth", slog.String("err", err.Error()))
+		}
 	}
 	return err
 }
 
 func (ps *PortStack) HandleEth(dst []byte) (n int, err error) {
-	isTrace := ps.isLogEnabled(internal.LevelTrace)
+	if ps.prof.enabled {
+		ps.prof.begin(stageEncode)
+		defer ps.prof.end()
+	}
 	n, err = ps.handleEth(dst)
+	if n > 0 && n < eth.SizeEthernetMin && err == nil {
+		// Pad runt frames. Length fields and checksums of encapsulated
+		// protocols are unaffected since they exclude the padding.
+		for i := n; i < eth.SizeEthernetMin; i++ {
+			dst[i] = 0
+		}
+		n = eth.SizeEthernetMin
+	}
+	if n > 0 && err == nil && ps.vlan != 0 {
+		n, err = ps.tagVLAN(dst, n)
+	}
 	if n > 0 && err == nil {
-		if isTrace {
+		if ps.tracePacket(dst[:n], internal.LevelTrace, false) {
 			ps.trace("Stack:	HandleEth", slog.Int("plen", n))
 		}
 		ps.lastTx = ps.now()
 		ps.processedPackets++
+		ps.stats.Tx.count(dst[:n])
+		ps.txRate.add(ps.lastTx, n)
+		ps.captureFrame(ps.lastTx, dst[:n], true)
 	} else if err != nil && ps.isLogEnabled(slog.LevelError) {
 		ps.error("Stack:HandleEth", slog.String("err", err.Error()))
 	}
+	if err != nil {
+		ps.handleErrors++
+		ps.consecutiveErrs++
+	} else {
+		ps.consecutiveErrs = 0
+	}
+	if ps.watchdogFeed != nil && !ps.Health().Wedged(ps.watchdogMaxRxAge) {
+		ps.watchdogFeed()
+	}
 	return n, err
 }
 
@@ -375,18 +983,56 @@ func (ps *PortStack) HandleEth(dst []byte) (n int, err error) {
 // not processed and that a future call to HandleEth is required to complete.
 //
 // If a handler returns any other error the port is closed.
+// dst must be as long as the MTU and the padded minimum Ethernet frame.
 func (ps *PortStack) handleEth(dst []byte) (n int, err error) {
 	switch {
-	case len(dst) < int(ps.mtu):
+	case len(dst) < int(ps.mtu) || len(dst) < eth.SizeEthernetMin:
 		return 0, io.ErrShortBuffer
 
 	case !ps.IsPendingHandling():
 		return 0, nil // No remaining packets to handle.
 	}
+	ps.txOwner = txOwner{} // Frame not reported with TxDone assumed sent.
+	if ps.addrTentative() {
+		return ps.handleAddrConflict(dst), nil // Only probes are sent from tentative addresses.
+	}
 	n = ps.arpClient.handle(dst)
 	if n != 0 {
 		return n, nil
 	}
+	n = ps.handleAddrConflict(dst)
+	if n == 0 {
+		n = ps.handleGatewayProbe(dst)
+	}
+	if n != 0 || ps.acd.paused() {
+		return n, nil // Only ARP is sent while paused by an address conflict.
+	}
+	n = ps.handleARPQueue(dst)
+	if n != 0 {
+		return n, nil
+	}
+	if ps.rst.pending {
+		if ps.isLogEnabled(slog.LevelDebug) {
+			ps.debug("TCP:send-rst", slog.Int("rport", int(ps.rst.tcp.DestinationPort)))
+		}
+		return ps.rst.put(dst), nil
+	}
+	if ps.icmp.pending {
+		if ps.isLogEnabled(slog.LevelDebug) {
+			ps.debug("ICMP:send", slog.String("type", eth.ICMPType(ps.icmp.msg[0]).String()))
+		}
+		return ps.icmp.put(dst), nil
+	}
+	n = ps.handleIGMP(dst)
+	if n == 0 {
+		n = ps.handleIPv6(dst)
+	}
+	if n == 0 {
+		n = ps.handleRaw(dst)
+	}
+	if n != 0 {
+		return n, nil
+	}
 
 	type Socket interface {
 		Close()
@@ -416,10 +1062,12 @@ func (ps *PortStack) handleEth(dst []byte) (n int, err error) {
 		return n, sock.IsPendingHandling(), err
 	}
 
-	isDebug := ps.isLogEnabled(slog.LevelDebug)
 	socketPending := false
 	if ps.pendingUDPv4 > 0 {
-		for i := range ps.portsUDP {
+		// Ports are serviced round robin starting after the port last sent from. See poll.go.
+		for j := range ps.portsUDP {
+			i := (ps.nextUDP + j) % len(ps.portsUDP)
+			port := ps.portsUDP[i].port
 			n, pending, err := handleSocket(dst, &ps.portsUDP[i])
 			if pending {
 				socketPending = true
@@ -427,7 +1075,9 @@ func (ps *PortStack) handleEth(dst []byte) (n int, err error) {
 			if err != nil {
 				return 0, err
 			} else if n > 0 {
-				if isDebug {
+				ps.txOwner = txOwner{port: port}
+				ps.nextUDP = i + 1
+				if ps.tracePacket(dst[:n], slog.LevelDebug, false) {
 					ps.debug("UDP:send", slog.Int("plen", n))
 				}
 				return n, nil
@@ -439,19 +1089,37 @@ func (ps *PortStack) handleEth(dst []byte) (n int, err error) {
 	}
 
 	socketPending = false
+	if ps.tcpWakeDue() {
+		ps.tcpWake = time.Time{}
+		ps.pendingTCPv4++ // Sockets rearm their timers when serviced.
+	}
 	if ps.pendingTCPv4 > 0 {
-		for i := range ps.portsTCP {
-			n, pending, err := handleSocket(dst, &ps.portsTCP[i])
-			if pending {
-				pending = true
-			}
-			if err != nil {
-				return 0, err
-			} else if n > 0 {
-				if isDebug {
-					ps.debug("TCP:send", slog.Int("plen", n))
+		// First pass services ports with interactive connections pending so
+		// their ACKs are not delayed behind bulk transfers. See priority.go.
+		for pass := 0; pass < 2; pass++ {
+			for j := range ps.portsTCP {
+				i := (ps.nextTCP + j) % len(ps.portsTCP)
+				port := &ps.portsTCP[i]
+				if pass == 0 && (port.port == 0 || !port.handler.pendingInteractive()) {
+					continue
+				}
+				portNum := port.port
+				ps.prof.enter(stageTCP)
+				n, pending, err := handleSocket(dst, port)
+				ps.prof.enter(stageEncode)
+				if pending {
+					socketPending = true
+				}
+				if err != nil {
+					return 0, err
+				} else if n > 0 {
+					ps.txOwner = txOwner{port: portNum, tcp: true}
+					ps.nextTCP = i + 1
+					if ps.tracePacket(dst[:n], slog.LevelDebug, false) {
+						ps.debug("TCP:send", slog.Int("plen", n))
+					}
+					return n, nil
 				}
-				return n, nil
 			}
 		}
 		if !socketPending {
@@ -464,7 +1132,49 @@ func (ps *PortStack) handleEth(dst []byte) (n int, err error) {
 
 // IsPendingHandling checks if a call to HandleEth could possibly result in a packet being generated by the PortStack.
 func (ps *PortStack) IsPendingHandling() bool {
-	return ps.pendingUDPv4 > 0 || ps.pendingTCPv4 > 0 || ps.arpClient.isPending()
+	if ps.addrTentative() {
+		return ps.acdPending()
+	} else if ps.acd.paused() {
+		return ps.arpClient.isPending() || ps.acdPending() || ps.gatewayProbePending()
+	}
+	return ps.acdPending() || ps.gatewayProbePending() || ps.pendingUDPv4 > 0 || ps.pendingTCPv4 > 0 || ps.tcpWakeDue() || ps.arpClient.isPending() || ps.arpq.pending() || ps.rst.pending || ps.icmp.pending || ps.igmpPending() || ps.ipv6Pending() || ps.rawPending()
+}
+
+// wakeTCPAt arms the stack to service its TCP sockets at t, used by timers
+// of sockets with nothing else pending such as keepalive.
+func (ps *PortStack) wakeTCPAt(t time.Time) {
+	if ps.tcpWake.IsZero() || t.Before(ps.tcpWake) {
+		ps.tcpWake = t
+	}
+}
+
+func (ps *PortStack) tcpWakeDue() bool {
+	return !ps.tcpWake.IsZero() && !ps.now().Before(ps.tcpWake)
+}
+
+// BufferedTCP returns the total amount of bytes held in the buffers of all open TCP ports.
+func (ps *PortStack) BufferedTCP() (n int) {
+	for i := range ps.portsTCP {
+		port := &ps.portsTCP[i]
+		if port.port != 0 {
+			n += port.handler.bufferedBytes()
+		}
+	}
+	return n
+}
+
+// tcpMemExhausted returns true if the TCP buffer memory limit set by
+// [PortStackConfig.MaxBufferedTCP] has been reached.
+func (ps *PortStack) tcpMemExhausted() bool {
+	return ps.maxBufferedTCP > 0 && ps.BufferedTCP() >= ps.maxBufferedTCP
+}
+
+// refuseTCP queues a RST in response to pkt, refusing the connection attempt.
+func (ps *PortStack) refuseTCP(pkt *TCPPacket) {
+	ps.info("TCP:refuse", slog.Uint64("lport", uint64(pkt.TCP.DestinationPort)), slog.Uint64("rport", uint64(pkt.TCP.SourcePort)))
+	if ps.rst.queue(pkt) {
+		ps.applyFingerprint(&ps.rst.ip)
+	}
 }
 
 // OpenUDP opens a UDP port and sets the handler.
@@ -473,26 +1183,73 @@ func (ps *PortStack) IsPendingHandling() bool {
 //
 // See [PortStack] for information on handler argument.
 func (ps *PortStack) OpenUDP(portNum uint16, handler iudphandler) error {
+	return ps.openUDP(portNum, handler, false)
+}
+
+// OpenUDPLite opens a UDP-Lite (RFC 3828) port and sets the handler. UDP-Lite
+// ports share the port table and number space with UDP ports. Handlers receive
+// UDP-Lite packets with the UDP Length field set to the checksum coverage.
+//
+// See [PortStack] for information on handler argument.
+func (ps *PortStack) OpenUDPLite(portNum uint16, handler iudphandler) error {
+	return ps.openUDP(portNum, handler, true)
+}
+
+// openEphemeralUDP opens a UDP port chosen at random from the dynamic port
+// range (RFC 6335) and returns its number.
+func (ps *PortStack) openEphemeralUDP(handler iudphandler) (uint16, error) {
+	port, err := ps.ephemeralPort(false)
+	if err != nil {
+		return 0, err
+	}
+	return port, ps.openUDP(port, handler, false)
+}
+
+// ephemeralPort returns a TCP or UDP port chosen at random from the dynamic
+// port range (RFC 6335) that is neither open nor reserved. Randomizing the
+// port makes connections harder to spoof (RFC 6056).
+func (ps *PortStack) ephemeralPort(tcp bool) (uint16, error) {
+	const minEphemeral, maxAttempts = 49152, 16
+	for i := 0; i < maxAttempts; i++ {
+		port := minEphemeral + ps.rand16()%(math.MaxUint16-minEphemeral+1)
+		inUse := findPort(ps.portsUDP, port) != nil
+		if tcp {
+			inUse = findPort(ps.portsTCP, port) != nil
+		}
+		if inUse || ps.reservation(port, tcp) != nil {
+			continue // In use or reserved, try another.
+		}
+		return port, nil
+	}
+	return 0, errPortNoneAvail
+}
+
+func (ps *PortStack) openUDP(portNum uint16, handler iudphandler, lite bool) error {
 	switch {
 	case portNum == 0:
 		return errZeroPort
 	case handler == nil:
 		return errNilHandler
 	}
-
+	if err := ps.checkReserved(portNum, handler, false); err != nil {
+		return err
+	}
 	port, err := findAvailPort(ps.portsUDP, portNum)
 	if err != nil {
 		return err
 	}
 	port.Open(portNum, handler)
+	port.lite = lite
+	port.opened = ps.now()
 	return nil
 }
 
-// FlagPendingUDP flags a given UDP port as having a pending packet.
-// This is useful to force a response even if no packet has been received.
+// RequestSendUDP requests the handler of UDP port portNum be called on a
+// following HandleEth call even if no packet has been received, i.e: to send
+// a query. The request is cleared once the handler is called.
 //
 // See [PortStack] for more information on how packets are processed.
-func (ps *PortStack) FlagPendingUDP(portNum uint16) error {
+func (ps *PortStack) RequestSendUDP(portNum uint16) error {
 	if portNum == 0 {
 		return errZeroPort
 	}
@@ -500,10 +1257,14 @@ func (ps *PortStack) FlagPendingUDP(portNum uint16) error {
 	if port == nil {
 		return errPortNonexistent
 	}
+	port.txRequested = true
 	ps.pendingUDPv4++
 	return nil
 }
 
+// FlagPendingUDP is equivalent to [PortStack.RequestSendUDP] and is kept for compatibility.
+func (ps *PortStack) FlagPendingUDP(portNum uint16) error { return ps.RequestSendUDP(portNum) }
+
 // CloseUDP closes a UDP port. See [PortStack].
 func (ps *PortStack) CloseUDP(portNum uint16) error {
 	if portNum == 0 {
@@ -517,6 +1278,14 @@ func (ps *PortStack) CloseUDP(portNum uint16) error {
 	return nil
 }
 
+// closeUDPOwned closes UDP port portNum if it is held by handler.
+func (ps *PortStack) closeUDPOwned(portNum uint16, handler iudphandler) {
+	port := findPort(ps.portsUDP, portNum)
+	if portNum != 0 && port != nil && port.ihandler == handler {
+		port.Close()
+	}
+}
+
 // OpenTCP opens a TCP port and sets the handler.
 // OpenTCP returns an error if the port is already open
 // or if there is no socket available it returns an error.
@@ -529,19 +1298,35 @@ func (ps *PortStack) OpenTCP(portNum uint16, handler itcphandler) error {
 	case handler == nil:
 		return errNilHandler
 	}
+	if err := ps.checkReserved(portNum, handler, true); err != nil {
+		return err
+	}
 	p, err := findAvailPort(ps.portsTCP, portNum)
 	if err != nil {
 		return err
 	}
 	p.Open(portNum, handler)
+	p.opened = ps.now()
 	return nil
 }
 
-// FlagPendingTCP flags a given TCP port as having a pending packet.
-// This is useful to force a response even if no packet has been received.
+// tcpPortReusable reports whether the open TCP port portNum is held by a
+// connection that is closed or in TIME_WAIT and may be taken over.
+func (ps *PortStack) tcpPortReusable(portNum uint16) bool {
+	port := findPort(ps.portsTCP, portNum)
+	if port == nil {
+		return false
+	}
+	conn, ok := port.handler.(*TCPConn)
+	return ok && conn.State().IsClosed()
+}
+
+// RequestSendTCP requests the handler of TCP port portNum be called on a
+// following HandleEth call even if no packet has been received. The request
+// is cleared once the handler is called.
 //
 // See [PortStack] for more information on how packets are processed.
-func (ps *PortStack) FlagPendingTCP(portNum uint16) error {
+func (ps *PortStack) RequestSendTCP(portNum uint16) error {
 	if portNum == 0 {
 		return errZeroPort
 	}
@@ -549,10 +1334,14 @@ func (ps *PortStack) FlagPendingTCP(portNum uint16) error {
 	if port == nil {
 		return errPortNonexistent
 	}
+	port.txRequested = true
 	ps.pendingTCPv4++
 	return nil
 }
 
+// FlagPendingTCP is equivalent to [PortStack.RequestSendTCP] and is kept for compatibility.
+func (ps *PortStack) FlagPendingTCP(portNum uint16) error { return ps.RequestSendTCP(portNum) }
+
 // CloseTCP closes the TCP port, effectively aborting the connection. See [PortStack].
 func (ps *PortStack) CloseTCP(portNum uint16) error {
 	if portNum == 0 {
@@ -567,6 +1356,9 @@ func (ps *PortStack) CloseTCP(portNum uint16) error {
 }
 
 func (ps *PortStack) now() time.Time {
+	if ps.clock != nil {
+		return ps.clock().Add(ps.timeadd)
+	}
 	now := time.Now()
 	return now.Add(ps.timeadd)
 }
@@ -595,6 +1387,65 @@ func (ps *PortStack) SetLogger(log *slog.Logger) {
 	ps.logger = log
 }
 
+// SetTraceFilter restricts the per-frame logs emitted by RecvEth and HandleEth
+// to frames that match the filter. The zero value TraceFilter disables filtering.
+// Logs not tied to a single frame, such as connection state changes, are not affected.
+func (ps *PortStack) SetTraceFilter(filter TraceFilter) {
+	ps.traceFilter = filter
+}
+
+// TraceFilter selects which frames are logged by the stack. Zero valued
+// fields match any frame, so a frame is logged when it matches all non-zero fields.
+type TraceFilter struct {
+	// Port matches frames with a TCP or UDP source or destination port equal to Port.
+	Port uint16
+	// Protocol matches frames with the given IPv4 protocol number, i.e: 6 for TCP, 17 for UDP.
+	Protocol uint8
+	// Peer matches frames with an IPv4 source or destination address equal to
+	// Peer. An IPv6 Peer matches no frames.
+	Peer netip.Addr
+	// OnlyDropped restricts logging to frames that were dropped or rejected by the stack.
+	OnlyDropped bool
+}
+
+func (f *TraceFilter) match(frame []byte, dropped bool) bool {
+	if f.OnlyDropped && !dropped {
+		return false
+	} else if f.Port == 0 && f.Protocol == 0 && !f.Peer.IsValid() {
+		return true
+	} else if len(frame) < eth.SizeEthernetHeader+eth.SizeIPv4Header ||
+		eth.DecodeEthernetHeader(frame).AssertType() != eth.EtherTypeIPv4 {
+		return false // Only IPv4 frames carry the fields we filter by.
+	}
+	ihdr, offset := eth.DecodeIPv4Header(frame[eth.SizeEthernetHeader:])
+	if f.Protocol != 0 && ihdr.Protocol != f.Protocol {
+		return false
+	}
+	if f.Peer.IsValid() {
+		peer := f.Peer.Unmap()
+		if !peer.Is4() || (ihdr.Source != peer.As4() && ihdr.Destination != peer.As4()) {
+			return false // IPv6 peers never match IPv4 frames.
+		}
+	}
+	if f.Port != 0 {
+		ports := frame[min(len(frame), eth.SizeEthernetHeader+int(offset)):]
+		if (ihdr.Protocol != 6 && ihdr.Protocol != 17) || len(ports) < 4 {
+			return false
+		}
+		src := uint16(ports[0])<<8 | uint16(ports[1])
+		dst := uint16(ports[2])<<8 | uint16(ports[3])
+		if src != f.Port && dst != f.Port {
+			return false
+		}
+	}
+	return true
+}
+
+// tracePacket reports whether a log of level lvl for the frame should be emitted.
+func (ps *PortStack) tracePacket(frame []byte, lvl slog.Level, dropped bool) bool {
+	return ps.isLogEnabled(lvl) && ps.traceFilter.match(frame, dropped)
+}
+
 var _ porter = udpPort{}
 var _ porter = tcpPort{}
 
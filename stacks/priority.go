@@ -0,0 +1,28 @@
+package stacks
+
+// SetInteractive hints the stack the connection carries interactive traffic,
+// such as a control channel or remote shell. When several connections have
+// segments pending the stack sends those of interactive connections first so
+// that their ACKs and window updates are not delayed behind bulk transfers
+// saturating the device. The hint is kept after the connection is closed
+// and applies to following connections over the socket.
+func (sock *TCPConn) SetInteractive(interactive bool) {
+	sock.interactive = interactive
+}
+
+// Interactive reports whether the connection was hinted to carry interactive traffic. See [TCPConn.SetInteractive].
+func (sock *TCPConn) Interactive() bool { return sock.interactive }
+
+func (sock *TCPConn) pendingInteractive() bool {
+	return sock.interactive && sock.isPendingHandling()
+}
+
+func (l *TCPListener) pendingInteractive() bool {
+	for i := range l.conns {
+		conn := &l.conns[i]
+		if conn.LocalPort() != 0 && conn.pendingInteractive() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package stacks
+
+import "time"
+
+// Processing stages accounted by the stage profiler. See [StageTimes].
+const (
+	stageDecode uint8 = iota
+	stageDemux
+	stageTCP
+	stageHandler
+	stageEncode
+	numStages
+)
+
+// StageTimes are the cumulative times a stack spent in each stage of frame
+// processing, so that the stage where CPU goes can be found when a device
+// can't keep up with line rate. See [PortStackConfig.ProfileStages].
+type StageTimes struct {
+	// Decode is the time RecvEth spent filtering frames and decoding and
+	// validating their headers, checksums included.
+	Decode time.Duration
+	// Demux is the time spent finding the socket packets are for, access
+	// control and packet inspection included.
+	Demux time.Duration
+	// TCP is the time spent by TCP connections processing received segments
+	// and generating segments to send.
+	TCP time.Duration
+	// Handler is the time spent processing received packets by UDP sockets
+	// and the stack's protocols such as ARP, ICMP and NDP.
+	Handler time.Duration
+	// Encode is the time HandleEth spent generating frames other than TCP segments.
+	Encode time.Duration
+}
+
+// stageProfiler accumulates the time spent in each processing stage. Time
+// is measured with the system clock since the stack's clock may be virtual.
+type stageProfiler struct {
+	enabled bool
+	// stage is the current stage, entered at start.
+	stage uint8
+	start time.Time
+	times [numStages]time.Duration
+}
+
+// begin starts accounting time to stage.
+func (p *stageProfiler) begin(stage uint8) {
+	p.stage = stage
+	p.start = time.Now()
+}
+
+// enter accounts the time since the last stage was entered to it and starts
+// accounting time to stage. It is a no-op if profiling is disabled.
+func (p *stageProfiler) enter(stage uint8) {
+	if !p.enabled || stage == p.stage {
+		return
+	}
+	now := time.Now()
+	p.times[p.stage] += now.Sub(p.start)
+	p.stage = stage
+	p.start = now
+}
+
+// end accounts the time since the current stage was entered to it.
+func (p *stageProfiler) end() {
+	p.times[p.stage] += time.Since(p.start)
+}
+
+// snapshot returns the accumulated times.
+func (p *stageProfiler) snapshot() StageTimes {
+	return StageTimes{
+		Decode:  p.times[stageDecode],
+		Demux:   p.times[stageDemux],
+		TCP:     p.times[stageTCP],
+		Handler: p.times[stageHandler],
+		Encode:  p.times[stageEncode],
+	}
+}
@@ -0,0 +1,86 @@
+package stacks
+
+import "time"
+
+// rateInterval is the interval bytes are counted over before the count is
+// averaged into the rate of a rateMeter.
+const rateInterval = time.Second
+
+// rateWeightShift sets the weight of each interval's count in the average to 1/4.
+const rateWeightShift = 2
+
+// maxRateIntervals is the amount of idle intervals after which a rate has
+// decayed to zero regardless of its value.
+const maxRateIntervals = 32
+
+// rateMeter estimates a byte rate as an exponentially weighted moving average
+// of the bytes counted every rateInterval. It uses no floating point so it is
+// cheap on microcontrollers. The zero value is ready to use.
+type rateMeter struct {
+	// start is the start of the current interval. Zero until bytes are first counted.
+	start time.Time
+	// count is the amount of bytes counted in the current interval.
+	count uint32
+	// rate is the average in bytes per second.
+	rate uint32
+}
+
+// add counts n bytes transferred at now.
+func (m *rateMeter) add(now time.Time, n int) {
+	m.advance(now)
+	m.count += uint32(n)
+}
+
+// advance averages the counts of the intervals elapsed before now into the rate.
+func (m *rateMeter) advance(now time.Time) {
+	if m.start.IsZero() {
+		m.start = now
+		return
+	}
+	elapsed := now.Sub(m.start)
+	if elapsed >= maxRateIntervals*rateInterval {
+		*m = rateMeter{start: now}
+		return
+	}
+	for ; elapsed >= rateInterval; elapsed -= rateInterval {
+		delta := (int64(m.count) - int64(m.rate)) >> rateWeightShift
+		m.rate = uint32(int64(m.rate) + delta)
+		m.count = 0
+		m.start = m.start.Add(rateInterval)
+	}
+}
+
+// at returns the rate at now without modifying the meter so that it may be
+// read outside the goroutine handling the stack.
+func (m rateMeter) at(now time.Time) uint32 {
+	m.advance(now)
+	return m.rate
+}
+
+// byteRates meters the data received and sent by a socket.
+type byteRates struct {
+	rx, tx rateMeter
+}
+
+// Rates returns the average rates in bytes per second at which the stack
+// received and sent frames during the last seconds. Same as [Stats.RxRate]
+// and [Stats.TxRate].
+func (ps *PortStack) Rates() (rx, tx uint32) {
+	now := ps.now()
+	return ps.rxRate.at(now), ps.txRate.at(now)
+}
+
+// Rates returns the average rates in bytes per second at which the connection
+// received and sent data during the last seconds, retransmissions included.
+// Rates are reset when the connection is closed.
+func (sock *TCPConn) Rates() (rx, tx uint32) {
+	now := sock.stack.now()
+	return sock.rates.rx.at(now), sock.rates.tx.at(now)
+}
+
+// Rates returns the average rates in bytes per second at which the socket
+// received and sent datagram payloads during the last seconds.
+func (sock *UDPConn) Rates() (rx, tx uint32) {
+	now := sock.stack.now()
+	return sock.rates.rx.at(now), sock.rates.tx.at(now)
+}
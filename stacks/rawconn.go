@@ -0,0 +1,252 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/internal"
+)
+
+const (
+	// maxRawConns is the amount of raw sockets that may be open on a stack.
+	maxRawConns = 4
+	// sizeRawRecord is the size of the frame length preceding each frame in the socket buffers.
+	sizeRawRecord = 2
+)
+
+var (
+	errRawConnLimit = errors.New("raw socket limit reached")
+	errRawOpen      = errors.New("raw socket already open")
+	errRawShort     = errors.New("raw frame shorter than Ethernet header")
+	errRawTooLong   = errors.New("raw frame exceeds MTU or socket buffer")
+)
+
+// RawConnConfig configures a [RawConn].
+type RawConnConfig struct {
+	// EtherType selects the frames received by EtherType. If zero frames
+	// of all EtherTypes are received.
+	EtherType eth.EtherType
+	// Protocol selects the IPv4 packets received by IP protocol number.
+	// If zero IPv4 packets of all protocols are received.
+	Protocol uint8
+	// TxBufSize and RxBufSize are the sizes of the socket buffers, which
+	// must hold at least one frame plus 2 bytes. If zero 1024 bytes are used.
+	TxBufSize uint16
+	RxBufSize uint16
+}
+
+// RawConn is a raw socket: an escape hatch for prototyping protocols the stack
+// does not implement, such as PTP or custom L2 telemetry. It receives whole
+// Ethernet frames that are not claimed by the stack:
+//   - frames of EtherTypes other than IPv4, ARP and LLDP,
+//   - IPv4 packets of protocols other than ICMP, IGMP, UDP and TCP,
+//   - UDP datagrams and TCP segments to ports no socket is open on. These are
+//     then not answered with a RST nor counted in [Stats.DroppedNoSocket].
+//
+// IPv4 datagrams reassembled from fragments are not received. Frames written
+// to the socket are sent verbatim, so they must be built by the user,
+// Ethernet header included. Frames not matching the socket's filter or that
+// do not fit its receive buffer are not claimed by it.
+type RawConn struct {
+	stack *PortStack
+	rdead time.Time
+	wdead time.Time
+	tx    ring
+	rx    ring
+	// ntx is the amount of frames in tx.
+	ntx   int
+	etype eth.EtherType
+	proto uint8
+	open  bool
+}
+
+// NewRawConn creates a raw socket on stack. It must be opened to receive frames.
+func NewRawConn(stack *PortStack, cfg RawConnConfig) (*RawConn, error) {
+	if cfg.RxBufSize == 0 {
+		cfg.RxBufSize = defaultUDPConnSize
+	}
+	if cfg.TxBufSize == 0 {
+		cfg.TxBufSize = defaultUDPConnSize
+	}
+	buf := make([]byte, int(cfg.RxBufSize)+int(cfg.TxBufSize))
+	return &RawConn{
+		stack: stack,
+		tx:    ring{buf: buf[:cfg.TxBufSize]},
+		rx:    ring{buf: buf[cfg.TxBufSize:]},
+		etype: cfg.EtherType,
+		proto: cfg.Protocol,
+	}, nil
+}
+
+// Open registers the socket with its stack so that it starts receiving frames.
+func (sock *RawConn) Open() error {
+	if sock.open {
+		return errRawOpen
+	}
+	ps := sock.stack
+	for i := range ps.raw {
+		if ps.raw[i] == nil {
+			sock.tx.Reset()
+			sock.rx.Reset()
+			sock.ntx = 0
+			sock.open = true
+			ps.raw[i] = sock
+			return nil
+		}
+	}
+	return errRawConnLimit
+}
+
+// Close unregisters the socket, discarding frames not yet sent or read.
+func (sock *RawConn) Close() error {
+	if !sock.open {
+		return net.ErrClosed
+	}
+	ps := sock.stack
+	for i := range ps.raw {
+		if ps.raw[i] == sock {
+			ps.raw[i] = nil
+		}
+	}
+	sock.open = false
+	sock.ntx = 0
+	sock.tx.Reset()
+	sock.rx.Reset()
+	return nil
+}
+
+// PortStack returns the PortStack that this socket is attached to.
+func (sock *RawConn) PortStack() *PortStack { return sock.stack }
+
+// Write queues frame to be sent as is by the stack. Write blocks until there
+// is room for the frame in the output buffer or the write deadline is exceeded.
+func (sock *RawConn) Write(frame []byte) (int, error) {
+	if !sock.open {
+		return 0, net.ErrClosed
+	} else if len(frame) < eth.SizeEthernetHeader {
+		return 0, errRawShort
+	} else if len(frame) > int(sock.stack.mtu) || sizeRawRecord+len(frame) > len(sock.tx.buf) {
+		return 0, errRawTooLong
+	}
+	backoff := internal.NewBackoff(internal.BackoffHasPriority)
+	for sock.tx.Free() < sizeRawRecord+len(frame) {
+		if !sock.open {
+			return 0, net.ErrClosed
+		} else if sock.deadlineExceeded(sock.wdead) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		backoff.Miss()
+	}
+	var hdr [sizeRawRecord]byte
+	binary.BigEndian.PutUint16(hdr[:], uint16(len(frame)))
+	sock.tx.Write(hdr[:])
+	sock.tx.Write(frame)
+	sock.ntx++
+	return len(frame), nil
+}
+
+// Read reads a single received frame into b. If b is smaller than the frame
+// the excess data is discarded. Read blocks until a frame is received or the
+// read deadline is exceeded.
+func (sock *RawConn) Read(b []byte) (int, error) {
+	backoff := internal.NewBackoff(internal.BackoffHasPriority)
+	for sock.rx.Buffered() == 0 {
+		if !sock.open {
+			return 0, net.ErrClosed
+		} else if sock.deadlineExceeded(sock.rdead) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		backoff.Miss()
+	}
+	var hdr [sizeRawRecord]byte
+	sock.rx.Read(hdr[:])
+	flen := int(binary.BigEndian.Uint16(hdr[:]))
+	n := min(flen, len(b))
+	sock.rx.Read(b[:n])
+	sock.rx.discard(flen - n)
+	return n, nil
+}
+
+// SetDeadline sets the read and write deadlines of the socket. A zero value for t means no deadline.
+// Deadlines are compared against the stack's clock, see [PortStackConfig.Clock].
+func (sock *RawConn) SetDeadline(t time.Time) error {
+	sock.rdead = t
+	sock.wdead = t
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read calls. A zero value for t means Read will not time out.
+func (sock *RawConn) SetReadDeadline(t time.Time) error {
+	sock.rdead = t
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls. A zero value for t means Write will not time out.
+func (sock *RawConn) SetWriteDeadline(t time.Time) error {
+	sock.wdead = t
+	return nil
+}
+
+func (sock *RawConn) deadlineExceeded(dead time.Time) bool {
+	return deadlineExceeded(sock.stack, dead)
+}
+
+// matches reports whether the socket receives frames of etype carrying, if IPv4, protocol proto.
+func (sock *RawConn) matches(etype eth.EtherType, proto uint8) bool {
+	return (sock.etype == 0 || sock.etype == etype) &&
+		(sock.proto == 0 || etype == eth.EtherTypeIPv4 && sock.proto == proto)
+}
+
+// recvRaw offers a frame not claimed by the stack to the raw sockets. proto
+// is the IP protocol of IPv4 frames. It returns true if a socket claimed it.
+// frame is nil for packets that must not be offered.
+func (ps *PortStack) recvRaw(frame []byte, etype eth.EtherType, proto uint8) bool {
+	if frame == nil {
+		return false
+	}
+	for _, sock := range ps.raw {
+		if sock == nil || !sock.matches(etype, proto) || sock.rx.Free() < sizeRawRecord+len(frame) {
+			continue
+		}
+		var hdr [sizeRawRecord]byte
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(frame)))
+		sock.rx.Write(hdr[:])
+		sock.rx.Write(frame)
+		return true
+	}
+	return false
+}
+
+// rawPending reports whether a raw socket has frames to send.
+func (ps *PortStack) rawPending() bool {
+	for _, sock := range ps.raw {
+		if sock != nil && sock.ntx > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// handleRaw writes the next frame queued on a raw socket to dst.
+func (ps *PortStack) handleRaw(dst []byte) int {
+	for _, sock := range ps.raw {
+		if sock == nil || sock.ntx == 0 {
+			continue
+		}
+		var hdr [sizeRawRecord]byte
+		sock.tx.Read(hdr[:])
+		flen := int(binary.BigEndian.Uint16(hdr[:]))
+		sock.ntx--
+		if flen > len(dst) {
+			sock.tx.discard(flen) // MTU lowered since the frame was written.
+			continue
+		}
+		sock.tx.Read(dst[:flen])
+		return flen
+	}
+	return 0
+}
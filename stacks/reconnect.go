@@ -0,0 +1,187 @@
+package stacks
+
+import (
+	"errors"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs"
+)
+
+const (
+	defaultReconnectDialTimeout = 5 * time.Second
+	defaultReconnectMinBackoff  = 100 * time.Millisecond
+	defaultReconnectMaxBackoff  = 30 * time.Second
+)
+
+var (
+	errBadReconnectConfig = errors.New("reconnect config needs stacks, remote address or host, local port and RemoteMAC")
+	errReconnectFailed    = errors.New("reconnect attempts exhausted")
+	errDialRefused        = errors.New("connection refused")
+)
+
+// ReconnectConfig configures a [Reconnector].
+type ReconnectConfig struct {
+	// Stacks are the interfaces the connection may be established over in
+	// order of preference. The first stack is the primary interface.
+	Stacks []*PortStack
+	// Remote is the address of the server.
+	Remote netip.AddrPort
+	// Host is the name of the server. If set the server's address is looked
+	// up with Resolver before every dial so that a server changing address is
+	// followed, and only the port of Remote is used.
+	Host     string
+	Resolver Resolver
+	// RemoteMAC returns the hardware address the server is reached through
+	// on stack, usually the gateway's hardware address resolved via ARP.
+	RemoteMAC func(stack *PortStack) ([6]byte, error)
+	// LocalPort is the local port used on every stack.
+	LocalPort uint16
+	// TxBufSize and RxBufSize are the buffer sizes of the connection on each stack.
+	TxBufSize, RxBufSize uint16
+	// DialTimeout is the time allowed for the handshake on an interface. If zero 5 seconds are used.
+	DialTimeout time.Duration
+	// MinBackoff and MaxBackoff bound the time waited after every interface
+	// failed to connect. The wait doubles after each failed round and is
+	// randomized by up to a quarter, see [Backoff]. Default to 100ms and 30s.
+	MinBackoff, MaxBackoff time.Duration
+	// MaxAttempts limits the amount of rounds over all interfaces. Zero means no limit.
+	MaxAttempts int
+	// LinkDown reports whether the link of stack is down. If nil a stack is
+	// considered down when its [Health] reports it is wedged.
+	LinkDown func(stack *PortStack) bool
+	// OnConnect is called after the connection is established, before it is
+	// returned to the user. reconnect is set if a connection was established
+	// before, so the hook may resume the application session (i.e: MQTT
+	// CONNECT without clean session, resubscribe). If OnConnect returns an
+	// error the connection is dropped and the next interface is tried.
+	OnConnect func(conn *TCPConn, reconnect bool) error
+}
+
+// Reconnector maintains a long lived client connection that is re-established
+// over a backup interface when the current link fails. It does not migrate
+// connection state: a new connection is opened and the application protocol
+// is expected to resume the session in [ReconnectConfig.OnConnect].
+type Reconnector struct {
+	cfg       ReconnectConfig
+	conns     []*TCPConn
+	current   int
+	connected bool
+	// reconnect is set once a connection has been established.
+	reconnect bool
+}
+
+// NewReconnector creates a reconnect helper. No connection is attempted until [Reconnector.Conn] is called.
+func NewReconnector(cfg ReconnectConfig) (*Reconnector, error) {
+	hasRemote := cfg.Remote.IsValid() || cfg.Host != "" && cfg.Resolver != nil
+	if len(cfg.Stacks) == 0 || !hasRemote || cfg.LocalPort == 0 || cfg.RemoteMAC == nil {
+		return nil, errBadReconnectConfig
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = defaultReconnectDialTimeout
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultReconnectMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = defaultReconnectMaxBackoff
+	}
+	rc := &Reconnector{cfg: cfg}
+	for _, stack := range cfg.Stacks {
+		conn, err := NewTCPConn(stack, TCPConnConfig{TxBufSize: cfg.TxBufSize, RxBufSize: cfg.RxBufSize})
+		if err != nil {
+			return nil, err
+		}
+		rc.conns = append(rc.conns, conn)
+	}
+	return rc, nil
+}
+
+// Conn returns the established connection. If the connection was lost or the
+// link of its interface is down, Conn blocks while the connection is
+// re-established over the first available interface, in order of preference.
+// Like other blocking calls it requires the stacks to be serviced by other goroutines.
+func (rc *Reconnector) Conn() (*TCPConn, error) {
+	if rc.connected {
+		conn := rc.conns[rc.current]
+		if conn.State() == seqs.StateEstablished && !rc.linkDown(conn.PortStack()) {
+			return conn, nil
+		}
+		conn.PortStack().info("RECONNECT:lost", slog.Int("iface", rc.current))
+		rc.Drop()
+	}
+	retx := Backoff{Initial: rc.cfg.MinBackoff, Max: rc.cfg.MaxBackoff, Jitter: retryJitter}
+	for attempt := 0; rc.cfg.MaxAttempts == 0 || attempt < rc.cfg.MaxAttempts; attempt++ {
+		for i, conn := range rc.conns {
+			stack := conn.PortStack()
+			if rc.linkDown(stack) {
+				continue
+			}
+			err := rc.dial(conn)
+			if err == nil && rc.cfg.OnConnect != nil {
+				err = rc.cfg.OnConnect(conn, rc.reconnect)
+			}
+			if err != nil {
+				stack.info("RECONNECT:dial-fail", slog.Int("iface", i), slog.String("err", err.Error()))
+				stack.CloseTCP(rc.cfg.LocalPort)
+				continue
+			}
+			stack.info("RECONNECT:connected", slog.Int("iface", i), slog.Bool("reconnect", rc.reconnect))
+			rc.current = i
+			rc.connected = true
+			rc.reconnect = true
+			return conn, nil
+		}
+		time.Sleep(retx.Next(rc.conns[0].PortStack().rand32()))
+	}
+	return nil, errReconnectFailed
+}
+
+// Interface returns the index in [ReconnectConfig.Stacks] of the interface
+// the connection is established over. It returns -1 if not connected.
+func (rc *Reconnector) Interface() int {
+	if !rc.connected {
+		return -1
+	}
+	return rc.current
+}
+
+// Drop aborts the current connection. The next call to [Reconnector.Conn] reconnects.
+func (rc *Reconnector) Drop() {
+	if !rc.connected {
+		return
+	}
+	rc.connected = false
+	rc.conns[rc.current].Abort()
+}
+
+func (rc *Reconnector) linkDown(stack *PortStack) bool {
+	if rc.cfg.LinkDown != nil {
+		return rc.cfg.LinkDown(stack)
+	}
+	return stack.Health().Wedged(0)
+}
+
+func (rc *Reconnector) dial(conn *TCPConn) error {
+	stack := conn.PortStack()
+	mac, err := rc.cfg.RemoteMAC(stack)
+	if err != nil {
+		return err
+	}
+	remote := rc.cfg.Remote
+	if rc.cfg.Host != "" {
+		addr, err := lookupFirst4(rc.cfg.Resolver, rc.cfg.Host)
+		if err != nil {
+			return err
+		}
+		remote = netip.AddrPortFrom(addr, remote.Port())
+	}
+	stack.CloseTCP(rc.cfg.LocalPort) // Release port of a previous connection, if any.
+	iss := seqs.Value(stack.rand32())
+	err = conn.OpenDialTCP(rc.cfg.LocalPort, mac, remote, iss)
+	if err != nil {
+		return err
+	}
+	return awaitEstablished(conn, rc.cfg.DialTimeout) // See dial.go.
+}
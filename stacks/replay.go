@@ -0,0 +1,277 @@
+package stacks
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const replayMagic = "seqsrpl1"
+
+// Record kinds of a replay log.
+const (
+	replayClock   = 'T' // Clock reading, varint nanoseconds since the previous reading.
+	replayEntropy = 'E' // Entropy read, uvarint length and bytes read.
+	replayRecv    = 'R' // RecvEth call, uvarint length and frame.
+	replayHandle  = 'H' // HandleEth call, uvarint length of the buffer.
+	replayHandled = 'O' // HandleEth result, uvarint length, FNV-1a hash of the frame and error flag.
+)
+
+var (
+	// ErrReplayDiverged is returned by [Replayer.Next] when the replayed stack
+	// requests inputs in a different order than recorded or produces
+	// different output, i.e: it was not configured as the recorded stack.
+	ErrReplayDiverged = errors.New("replay diverged from recording")
+	errReplayMagic    = errors.New("not a replay log")
+	errReplayBuffer   = errors.New("replay buffer smaller than recorded")
+)
+
+// Recorder records all inputs of a stack to a compact log: received frames,
+// clock readings and entropy draws, along with a hash of every frame sent so
+// that a [Replayer] can reproduce the stack's behavior byte-exactly. The log
+// may be attached to bug reports. Frames are recorded whole, payloads included.
+//
+// The stack must be created with the Recorder as its clock and entropy source
+// and frames passed through the Recorder's RecvEth and HandleEth methods:
+//
+//	rec := stacks.NewRecorder(file, nil, nil)
+//	stack := stacks.NewPortStack(stacks.PortStackConfig{Clock: rec.Now, Entropy: rec, ...})
+//	// Main loop calls rec.RecvEth(stack, frame) and rec.HandleEth(stack, buf).
+//
+// Calls into the stack and its sockets made by the application must be
+// repeated in the same order when replaying.
+type Recorder struct {
+	w       io.Writer
+	clock   func() time.Time
+	entropy io.Reader
+	last    int64
+	buf     []byte
+	err     error
+}
+
+// NewRecorder returns a Recorder writing the log to w. clock and entropy are
+// the recorded sources. If nil time.Now and crypto/rand are used.
+func NewRecorder(w io.Writer, clock func() time.Time, entropy io.Reader) *Recorder {
+	if clock == nil {
+		clock = time.Now
+	}
+	if entropy == nil {
+		entropy = rand.Reader
+	}
+	r := &Recorder{w: w, clock: clock, entropy: entropy}
+	r.buf = append(r.buf, replayMagic...)
+	r.flush()
+	return r
+}
+
+// Err returns the first error encountered writing the log.
+func (r *Recorder) Err() error { return r.err }
+
+// Now returns the time of the recorded clock. It is meant to be the stack's
+// [PortStackConfig.Clock].
+func (r *Recorder) Now() time.Time {
+	t := r.clock()
+	ns := t.UnixNano()
+	r.buf = append(r.buf, replayClock)
+	r.buf = binary.AppendVarint(r.buf, ns-r.last)
+	r.last = ns
+	r.flush()
+	return t
+}
+
+// Read reads from the recorded entropy source. It is meant to be the stack's
+// [PortStackConfig.Entropy].
+func (r *Recorder) Read(b []byte) (int, error) {
+	n, err := r.entropy.Read(b)
+	r.buf = append(r.buf, replayEntropy)
+	r.buf = binary.AppendUvarint(r.buf, uint64(n))
+	r.buf = append(r.buf, b[:n]...)
+	r.flush()
+	return n, err
+}
+
+// RecvEth records frame and passes it to ps.RecvEth.
+func (r *Recorder) RecvEth(ps *PortStack, frame []byte) error {
+	r.buf = append(r.buf, replayRecv)
+	r.buf = binary.AppendUvarint(r.buf, uint64(len(frame)))
+	r.buf = append(r.buf, frame...)
+	r.flush()
+	return ps.RecvEth(frame)
+}
+
+// HandleEth calls ps.HandleEth with dst and records a hash of the frame written.
+func (r *Recorder) HandleEth(ps *PortStack, dst []byte) (int, error) {
+	r.buf = append(r.buf, replayHandle)
+	r.buf = binary.AppendUvarint(r.buf, uint64(len(dst)))
+	r.flush()
+	n, err := ps.HandleEth(dst)
+	r.buf = appendHandled(r.buf, dst[:n], err)
+	r.flush()
+	return n, err
+}
+
+func (r *Recorder) flush() {
+	if r.err == nil {
+		_, r.err = r.w.Write(r.buf)
+	}
+	r.buf = r.buf[:0]
+}
+
+func appendHandled(b, frame []byte, err error) []byte {
+	b = append(b, replayHandled)
+	b = binary.AppendUvarint(b, uint64(len(frame)))
+	b = binary.BigEndian.AppendUint32(b, fnv1a(frame))
+	if err != nil {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// Replayer replays a log written by a [Recorder] into a stack configured and
+// driven by the application as the recorded one, with the Replayer as its
+// clock and entropy source:
+//
+//	rp, err := stacks.NewReplayer(file)
+//	stack := stacks.NewPortStack(stacks.PortStackConfig{Clock: rp.Now, Entropy: rp, ...})
+//	for err == nil {
+//		err = rp.Next(stack, buf)
+//	}
+type Replayer struct {
+	r    *bufio.Reader
+	last int64
+	buf  []byte
+	err  error
+}
+
+// NewReplayer returns a Replayer reading the log from r.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	rp := &Replayer{r: bufio.NewReader(r)}
+	var magic [len(replayMagic)]byte
+	_, err := io.ReadFull(rp.r, magic[:])
+	if err != nil {
+		return nil, err
+	} else if string(magic[:]) != replayMagic {
+		return nil, errReplayMagic
+	}
+	return rp, nil
+}
+
+// Now returns the next recorded clock reading. It is meant to be the stack's
+// [PortStackConfig.Clock].
+func (rp *Replayer) Now() time.Time {
+	if rp.expect(replayClock) {
+		delta, err := binary.ReadVarint(rp.r)
+		rp.fail(err)
+		rp.last += delta
+	}
+	return time.Unix(0, rp.last)
+}
+
+// Read returns the next recorded entropy draw. It is meant to be the stack's
+// [PortStackConfig.Entropy].
+func (rp *Replayer) Read(b []byte) (int, error) {
+	if !rp.expect(replayEntropy) {
+		return 0, rp.err
+	}
+	n, err := rp.readLen(len(b))
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.ReadFull(rp.r, b[:n])
+	rp.fail(err)
+	if n < len(b) {
+		return n, io.ErrUnexpectedEOF // Recorded source failed, the stack falls back as it did.
+	}
+	return n, rp.err
+}
+
+// Next replays the next recorded RecvEth or HandleEth call on ps, using buf
+// to receive and send frames. It returns io.EOF at the end of the log and
+// ErrReplayDiverged if ps behaves differently than the recorded stack.
+func (rp *Replayer) Next(ps *PortStack, buf []byte) error {
+	if rp.err != nil {
+		return rp.err
+	}
+	kind, err := rp.r.ReadByte()
+	if err != nil {
+		return err // io.EOF at end of log.
+	}
+	switch kind {
+	case replayRecv:
+		n, err := rp.readLen(len(buf))
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(rp.r, buf[:n])
+		if rp.fail(err) {
+			return rp.err
+		}
+		ps.RecvEth(buf[:n])
+
+	case replayHandle:
+		n, err := rp.readLen(len(buf))
+		if err != nil {
+			return err
+		}
+		n, err = ps.HandleEth(buf[:n])
+		if !rp.expect(replayHandled) {
+			return rp.err
+		}
+		var want [binary.MaxVarintLen64 + 5]byte
+		got := appendHandled(rp.buf[:0], buf[:n], err)[1:]
+		rp.buf = got
+		_, err = io.ReadFull(rp.r, want[:len(got)])
+		if rp.fail(err) {
+			return rp.err
+		} else if string(want[:len(got)]) != string(got) {
+			rp.err = ErrReplayDiverged
+		}
+
+	default:
+		rp.err = ErrReplayDiverged
+	}
+	return rp.err
+}
+
+// expect reads the kind of the next record and reports whether it is kind.
+func (rp *Replayer) expect(kind byte) bool {
+	if rp.err != nil {
+		return false
+	}
+	got, err := rp.r.ReadByte()
+	if rp.fail(err) {
+		return false
+	} else if got != kind {
+		rp.err = ErrReplayDiverged
+		return false
+	}
+	return true
+}
+
+// readLen reads a record length which must be at most max.
+func (rp *Replayer) readLen(max int) (int, error) {
+	n, err := binary.ReadUvarint(rp.r)
+	if rp.fail(err) {
+		return 0, rp.err
+	} else if n > uint64(max) {
+		rp.err = errReplayBuffer
+		return 0, rp.err
+	}
+	return int(n), nil
+}
+
+// fail records err, reporting a truncated log as unexpected EOF, and reports whether err is not nil.
+func (rp *Replayer) fail(err error) bool {
+	if err == nil {
+		return false
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if rp.err == nil {
+		rp.err = err
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package stacks
+
+import (
+	"errors"
+	"log/slog"
+	"net/netip"
+	"time"
+)
+
+var errHostNotFound = errors.New("host not found")
+
+// Resolver looks up the addresses of host names. It is the lookup backend of
+// [DialHost] and [Reconnector] so that static tables, DNS, mDNS or custom
+// discovery may be used interchangeably. LookupNetIP may block and the
+// returned slice may be reused by the next call.
+type Resolver interface {
+	LookupNetIP(host string) ([]netip.Addr, error)
+}
+
+var (
+	_ Resolver = DNSResolver{}
+	_ Resolver = StaticResolver(nil)
+	_ Resolver = ResolverChain(nil)
+	_ Resolver = hostResolver{}
+)
+
+// DNSResolver resolves names by querying the DNS server in Config with
+// Client. See [DNSClient.LookupNetIP].
+type DNSResolver struct {
+	Client *DNSClient
+	Config DNSResolveConfig
+}
+
+// LookupNetIP implements [Resolver].
+func (r DNSResolver) LookupNetIP(host string) ([]netip.Addr, error) {
+	return r.Client.LookupNetIP(host, r.Config)
+}
+
+// StaticResolver resolves names from a fixed table. Names are matched
+// ignoring case and a trailing dot.
+type StaticResolver map[string][]netip.Addr
+
+// LookupNetIP implements [Resolver].
+func (r StaticResolver) LookupNetIP(host string) ([]netip.Addr, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	key := dnsCacheKey(host)
+	for name, addrs := range r {
+		if dnsCacheKey(name) == key {
+			return addrs, nil
+		}
+	}
+	return nil, errHostNotFound
+}
+
+// ResolverChain tries each resolver in order, returning the addresses found
+// by the first that succeeds, i.e: a static table before DNS. If all fail the
+// error of the last is returned.
+type ResolverChain []Resolver
+
+// LookupNetIP implements [Resolver].
+func (rc ResolverChain) LookupNetIP(host string) ([]netip.Addr, error) {
+	err := errHostNotFound
+	for _, r := range rc {
+		var addrs []netip.Addr
+		addrs, err = r.LookupNetIP(host)
+		if err == nil && len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, err
+}
+
+// hostResolver resolves names in the host table of a stack.
+type hostResolver struct{ ps *PortStack }
+
+// HostResolver returns a [Resolver] of the names in the stack's host table
+// and its own hostname, see [PortStack.AddHost] and [PortStack.SetHostname].
+func (ps *PortStack) HostResolver() Resolver { return hostResolver{ps: ps} }
+
+// LookupNetIP implements [Resolver].
+func (r hostResolver) LookupNetIP(host string) ([]netip.Addr, error) {
+	addrs := r.ps.lookupHost(dnsCacheKey(host))
+	if len(addrs) == 0 {
+		return nil, errHostNotFound
+	}
+	return addrs, nil
+}
+
+// DialHost looks up host with r and dials port on each IPv4 address found
+// in turn until a connection is established or timeout elapses. If r is nil
+// the stack's host table is used, see [PortStack.HostResolver]. See [DialTCP].
+func DialHost(stack *PortStack, cfg TCPConnConfig, r Resolver, host string, port uint16, timeout time.Duration) (*TCPConn, error) {
+	if r == nil {
+		r = stack.HostResolver()
+	}
+	deadline := time.Now().Add(timeout)
+	addrs, err := r.LookupNetIP(host)
+	if err != nil {
+		return nil, err
+	}
+	err = errHostNotFound
+	for _, addr := range addrs {
+		remaining := time.Until(deadline)
+		if !addr.Is4() {
+			continue
+		} else if remaining <= 0 {
+			break
+		}
+		var conn *TCPConn
+		conn, err = DialTCP(stack, cfg, netip.AddrPortFrom(addr, port), remaining)
+		if err == nil {
+			return conn, nil
+		}
+		stack.debug("TCP:dial-host-fail", slog.String("host", host), stack.addrAttr("addr", addr.As4()), slog.String("err", err.Error()))
+	}
+	return nil, err
+}
+
+// lookupFirst4 returns the first IPv4 address of host found by r.
+func lookupFirst4(r Resolver, host string) (netip.Addr, error) {
+	addrs, err := r.LookupNetIP(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, addr := range addrs {
+		if addr.Is4() {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, errHostNotFound
+}
@@ -65,6 +65,79 @@ func (r *ring) Read(b []byte) (int, error) {
 	return n, nil
 }
 
+// readFrom reads from rd directly into the contiguous free space of the ring
+// with a single call to rd.Read. It returns errRingBufferFull if there is no free space.
+func (r *ring) readFrom(rd io.Reader) (int, error) {
+	var free []byte
+	switch {
+	case r.Free() == 0:
+		return 0, errRingBufferFull
+	case r.midFree() > 0:
+		free = r.buf[r.end:r.off]
+	case r.end < len(r.buf):
+		free = r.buf[r.end:]
+	default:
+		// End of buffer reached, wrap around to free space at start.
+		r.end = 0
+		free = r.buf[:r.off]
+	}
+	n, err := rd.Read(free)
+	r.end += n
+	return n, err
+}
+
+// writeTo writes up to limit buffered bytes to w directly from the ring with
+// a single call to w.Write and discards the bytes written.
+func (r *ring) writeTo(w io.Writer, limit int) (int, error) {
+	if r.Buffered() == 0 {
+		return 0, io.EOF
+	}
+	var used []byte
+	if r.end > r.off {
+		used = r.buf[r.off:r.end]
+	} else {
+		used = r.buf[r.off:] // Buffered data wraps around, write first part.
+	}
+	if len(used) > limit {
+		used = used[:limit]
+	}
+	n, err := w.Write(used)
+	r.off += n
+	r.onReadEnd()
+	return n, err
+}
+
+// peek copies buffered bytes starting skip bytes after the oldest buffered
+// byte into b without discarding them. It returns the amount of bytes copied.
+func (r *ring) peek(b []byte, skip int) int {
+	buffered := r.Buffered()
+	if skip >= buffered {
+		return 0
+	}
+	n := min(len(b), buffered-skip)
+	start := r.off + skip
+	if start >= len(r.buf) {
+		start -= len(r.buf)
+	}
+	n1 := copy(b[:n], r.buf[start:])
+	copy(b[n1:n], r.buf)
+	return n
+}
+
+// discard discards the n oldest buffered bytes.
+func (r *ring) discard(n int) {
+	if n <= 0 {
+		return
+	} else if n >= r.Buffered() {
+		r.Reset()
+		return
+	}
+	r.off += n
+	if r.off >= len(r.buf) {
+		r.off -= len(r.buf)
+	}
+}
+
 func (r *ring) Buffered() int {
 	return len(r.buf) - r.Free()
 }
@@ -0,0 +1,370 @@
+package stacks
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRTSPTimeout        = 5 * time.Second
+	defaultRTSPBufSize        = 1024
+	defaultRTSPSessionTimeout = 60 * time.Second
+	rtspUserAgent             = "seqs"
+)
+
+var (
+	errRTSPResponse  = errors.New("rtsp: malformed response")
+	errRTSPCSeq      = errors.New("rtsp: response CSeq mismatch")
+	errRTSPBody      = errors.New("rtsp: response body exceeds buffer")
+	errRTSPFrameSize = errors.New("rtsp: interleaved frame exceeds buffer")
+	errRTSPNoSession = errors.New("rtsp: no session, call Setup first")
+)
+
+// RTSPClientConfig configures an [RTSPClient].
+type RTSPClientConfig struct {
+	// URL is the rtsp:// URL of the presentation, i.e: "rtsp://192.168.1.64/stream1".
+	URL string
+	// UserAgent is sent in the User-Agent header of requests. If empty "seqs" is used.
+	UserAgent string
+	// BufSize is the size of the buffer holding response lines and bodies,
+	// such as the SDP description of the presentation. If zero 1024 is used.
+	BufSize uint16
+	// Timeout limits the wait for a response or interleaved frame. If zero a timeout of 5 seconds is used.
+	Timeout time.Duration
+}
+
+// RTSPClient is a minimal RTSP 1.0 client (RFC 2326) pulling media streams,
+// i.e: from an IP camera. Media is interleaved in the RTSP connection as
+// described in RFC 2326 section 10.12 so that a single TCP connection carries
+// both control and media, which suits NAT and firewalled networks and needs
+// no UDP ports. A stream is pulled by calling [RTSPClient.Describe],
+// [RTSPClient.Setup] for each media and [RTSPClient.Play], after which the
+// RTP and RTCP packets are read with [RTSPClient.ReadPacket].
+// Authentication and RTSP over HTTP tunneling are not supported.
+type RTSPClient struct {
+	conn *TCPConn
+	cfg  RTSPClientConfig
+	rd   *bufio.Reader
+	req  []byte
+	body []byte
+	// base is the URL media control URLs are relative to, from the Content-Base of the description.
+	base    string
+	session []byte
+	// sessionTimeout is the time the server keeps the session without requests.
+	sessionTimeout time.Duration
+	lastReq        time.Time
+	cseq           uint32
+	// keepaliveCSeq is the CSeq of a keepalive whose response is pending.
+	keepaliveCSeq uint32
+	channels      uint8
+	status        int
+}
+
+// NewRTSPClient creates an RTSP client on the established connection conn to
+// the server, i.e: dialed with [DialTCP]. The connection is not closed by the client.
+func NewRTSPClient(conn *TCPConn, cfg RTSPClientConfig) (*RTSPClient, error) {
+	if !strings.HasPrefix(cfg.URL, "rtsp://") {
+		return nil, errors.New("rtsp: URL must begin with rtsp://")
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = rtspUserAgent
+	}
+	if cfg.BufSize == 0 {
+		cfg.BufSize = defaultRTSPBufSize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultRTSPTimeout
+	}
+	return &RTSPClient{
+		conn: conn,
+		cfg:  cfg,
+		rd:   bufio.NewReaderSize(conn, int(cfg.BufSize)),
+		body: make([]byte, 0, cfg.BufSize),
+		base: cfg.URL,
+	}, nil
+}
+
+// Describe requests the description of the presentation and returns it,
+// usually in SDP format. Media are set up with the URL of their a=control
+// attribute, see [RTSPClient.Setup]. The description is valid until the next call.
+func (c *RTSPClient) Describe() ([]byte, error) {
+	c.startRequest("DESCRIBE", c.cfg.URL)
+	c.req = append(c.req, "Accept: application/sdp\r\n"...)
+	err := c.do()
+	if err != nil {
+		return nil, err
+	}
+	return c.body, nil
+}
+
+// Setup sets up the transport of the media with the given control URL, as
+// found in the a=control attribute of the description. Relative URLs are
+// resolved against the base URL of the presentation. Setup returns the
+// interleaved channel of the media's RTP packets; RTCP packets are received
+// on the following channel. The session is created by the first call.
+func (c *RTSPClient) Setup(control string) (channel uint8, err error) {
+	channel = c.channels
+	c.startRequest("SETUP", c.mediaURL(control))
+	c.req = append(c.req, "Transport: RTP/AVP/TCP;unicast;interleaved="...)
+	c.req = strconv.AppendUint(c.req, uint64(channel), 10)
+	c.req = append(c.req, '-')
+	c.req = strconv.AppendUint(c.req, uint64(channel+1), 10)
+	c.req = append(c.req, "\r\n"...)
+	err = c.do()
+	if err != nil {
+		return 0, err
+	}
+	c.channels += 2
+	return channel, nil
+}
+
+// Play starts the delivery of the media set up from the beginning of the presentation.
+func (c *RTSPClient) Play() error {
+	if c.session == nil {
+		return errRTSPNoSession
+	}
+	c.startRequest("PLAY", c.base)
+	c.req = append(c.req, "Range: npt=0.000-\r\n"...)
+	return c.do()
+}
+
+// Teardown stops the delivery of the media and ends the session. Interleaved
+// frames received before the response are discarded.
+func (c *RTSPClient) Teardown() error {
+	if c.session == nil {
+		return errRTSPNoSession
+	}
+	c.startRequest("TEARDOWN", c.base)
+	err := c.do()
+	c.session = nil
+	c.channels = 0
+	return err
+}
+
+// Keepalive sends a GET_PARAMETER request so that the server does not
+// expire the session. Its response is consumed by [RTSPClient.ReadPacket].
+// ReadPacket sends keepalives when half the session timeout elapses without
+// requests, so Keepalive need only be called if packets are not being read.
+func (c *RTSPClient) Keepalive() error {
+	if c.session == nil {
+		return errRTSPNoSession
+	}
+	c.startRequest("GET_PARAMETER", c.base)
+	c.req = append(c.req, "\r\n"...)
+	c.keepaliveCSeq = c.cseq
+	c.conn.SetWriteDeadline(c.conn.stack.now().Add(c.cfg.Timeout))
+	_, err := c.conn.Write(c.req)
+	return err
+}
+
+// ReadPacket reads the next interleaved frame into b and returns its channel
+// and size. Frames on the channel returned by [RTSPClient.Setup] hold RTP
+// packets, see package rtp, and on the following channel RTCP packets. A
+// frame that does not fit b is discarded and an error returned, after which
+// reading may continue. Responses to keepalives are consumed.
+func (c *RTSPClient) ReadPacket(b []byte) (channel uint8, n int, err error) {
+	now := c.conn.stack.now()
+	if c.session != nil && c.keepaliveCSeq == 0 && now.Sub(c.lastReq) >= c.sessionTimeout/2 {
+		err = c.Keepalive()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	c.conn.SetReadDeadline(now.Add(c.cfg.Timeout))
+	for {
+		hdr, err := c.rd.Peek(4)
+		if err != nil {
+			return 0, 0, err
+		}
+		if hdr[0] != '$' {
+			err = c.readResponse(c.keepaliveCSeq)
+			if err != nil && err != errRTSPCSeq {
+				return 0, 0, err
+			}
+			c.keepaliveCSeq = 0
+			continue
+		}
+		channel = hdr[1]
+		size := int(hdr[2])<<8 | int(hdr[3])
+		if size > len(b) {
+			_, err = c.rd.Discard(4 + size)
+			if err == nil {
+				err = errRTSPFrameSize
+			}
+			return channel, 0, err
+		}
+		c.rd.Discard(4)
+		n, err = io.ReadFull(c.rd, b[:size])
+		return channel, n, err
+	}
+}
+
+// Session returns the session identifier assigned by the server, nil before [RTSPClient.Setup].
+func (c *RTSPClient) Session() []byte { return c.session }
+
+// mediaURL resolves a media control URL against the base URL of the presentation.
+func (c *RTSPClient) mediaURL(control string) string {
+	base := c.base
+	if base == "" {
+		base = c.cfg.URL
+	}
+	switch {
+	case control == "" || control == "*":
+		return base
+	case strings.HasPrefix(control, "rtsp://"):
+		return control
+	case base[len(base)-1] == '/':
+		return base + control
+	}
+	return base + "/" + control
+}
+
+// validRTSPURL reports whether u is an absolute rtsp:// URL with a host,
+// which excludes characters that would break the request line.
+func validRTSPURL(u []byte) bool {
+	parsed, err := url.Parse(string(u))
+	return err == nil && parsed.Scheme == "rtsp" && parsed.Host != ""
+}
+
+// startRequest begins a request of the given method with the common headers.
+func (c *RTSPClient) startRequest(method, url string) {
+	c.cseq++
+	c.req = append(c.req[:0], method...)
+	c.req = append(c.req, ' ')
+	c.req = append(c.req, url...)
+	c.req = append(c.req, " RTSP/1.0\r\nCSeq: "...)
+	c.req = strconv.AppendUint(c.req, uint64(c.cseq), 10)
+	c.req = append(c.req, "\r\nUser-Agent: "...)
+	c.req = append(c.req, c.cfg.UserAgent...)
+	c.req = append(c.req, "\r\n"...)
+	if c.session != nil {
+		c.req = append(c.req, "Session: "...)
+		c.req = append(c.req, c.session...)
+		c.req = append(c.req, "\r\n"...)
+	}
+	c.lastReq = c.conn.stack.now()
+}
+
+// do sends the request being built and reads its response, which must have a 2xx status.
+func (c *RTSPClient) do() error {
+	c.req = append(c.req, "\r\n"...)
+	deadline := c.conn.stack.now().Add(c.cfg.Timeout)
+	c.conn.SetDeadline(deadline)
+	_, err := c.conn.Write(c.req)
+	if err != nil {
+		return err
+	}
+	for {
+		err = c.readResponse(c.cseq)
+		if err != errRTSPCSeq || c.keepaliveCSeq == 0 {
+			break
+		}
+		c.keepaliveCSeq = 0 // Response to the keepalive, keep reading.
+	}
+	if err != nil {
+		return err
+	} else if c.status < 200 || c.status > 299 {
+		return errors.New("rtsp: response status " + strconv.Itoa(c.status))
+	}
+	return nil
+}
+
+// readResponse reads the response with the given CSeq, discarding interleaved
+// frames received before it. Its body is read into c.body.
+func (c *RTSPClient) readResponse(cseq uint32) error {
+	for {
+		hdr, err := c.rd.Peek(4)
+		if err != nil {
+			return err
+		} else if hdr[0] != '$' {
+			break
+		}
+		_, err = c.rd.Discard(4 + (int(hdr[2])<<8 | int(hdr[3])))
+		if err != nil {
+			return err
+		}
+	}
+	line, err := c.rd.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	// Status line: RTSP/1.0 200 OK
+	if len(line) < len("RTSP/1.0 200") || string(line[:5]) != "RTSP/" {
+		return errRTSPResponse
+	}
+	_, rest, _ := bytes.Cut(line, []byte{' '})
+	code, _, _ := bytes.Cut(rest, []byte{' '})
+	c.status, err = strconv.Atoi(string(bytes.TrimSpace(code)))
+	if err != nil {
+		return errRTSPResponse
+	}
+	contentLength := 0
+	gotCSeq := false
+	for {
+		line, err = c.rd.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+		key, value, ok := bytes.Cut(line, []byte{':'})
+		if !ok {
+			return errRTSPResponse
+		}
+		value = bytes.TrimSpace(value)
+		switch {
+		case bytes.EqualFold(key, []byte("CSeq")):
+			n, err := strconv.ParseUint(string(value), 10, 32)
+			gotCSeq = err == nil && uint32(n) == cseq
+		case bytes.EqualFold(key, []byte("Content-Length")):
+			contentLength, err = strconv.Atoi(string(value))
+			if err != nil || contentLength < 0 {
+				return errRTSPResponse
+			}
+		case bytes.EqualFold(key, []byte("Content-Base")):
+			if validRTSPURL(value) {
+				c.base = string(value)
+			}
+		case bytes.EqualFold(key, []byte("Session")):
+			c.setSession(value)
+		}
+	}
+	if contentLength > cap(c.body) {
+		c.rd.Discard(contentLength)
+		return errRTSPBody
+	}
+	c.body = c.body[:contentLength]
+	_, err = io.ReadFull(c.rd, c.body)
+	if err != nil {
+		return err
+	} else if !gotCSeq {
+		return errRTSPCSeq
+	}
+	if c.conn.stack.isLogEnabled(slog.LevelDebug) {
+		c.conn.stack.debug("RTSP:response", slog.Uint64("cseq", uint64(cseq)), slog.Int("status", c.status), slog.Int("len", contentLength))
+	}
+	return nil
+}
+
+// setSession sets the session from the value of a Session header, i.e:
+// "12345678;timeout=60".
+func (c *RTSPClient) setSession(value []byte) {
+	id, params, _ := bytes.Cut(value, []byte{';'})
+	c.session = append(c.session[:0], id...)
+	c.sessionTimeout = defaultRTSPSessionTimeout
+	if _, t, ok := bytes.Cut(params, []byte("timeout=")); ok {
+		secs, err := strconv.Atoi(string(bytes.TrimSpace(t)))
+		if err == nil && secs > 0 {
+			c.sessionTimeout = time.Duration(secs) * time.Second
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package stacks
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Snapshot is a copy of the monitoring state of a stack. Snapshots are
+// published by the goroutine servicing the stack and may be read from any
+// other goroutine without stopping it. See [PortStack.PublishSnapshot].
+type Snapshot struct {
+	// Taken is the time the snapshot was published.
+	Taken  time.Time
+	Stats  Stats
+	Health Health
+	// Conns are the open ports and connections. See [PortStack.Connections].
+	Conns []ConnEntry
+	// ARP are the entries of the ARP neighbor cache.
+	ARP []ARPEntry
+	// Leases are the active leases of the DHCP servers running on the stack.
+	Leases []DHCPLease
+}
+
+// ARPEntry is an entry of the ARP neighbor cache.
+type ARPEntry struct {
+	Addr netip.Addr
+	HW   [6]byte
+	// Age is the time elapsed since the entry was learned or refreshed.
+	Age time.Duration
+}
+
+// DHCPLease is an address leased by a [DHCPServer].
+type DHCPLease struct {
+	Addr netip.Addr
+	HW   [6]byte
+	// Expiry is the time the lease expires. Zero for infinite leases.
+	Expiry time.Time
+}
+
+// snapshots double buffers published snapshots. The goroutine servicing the
+// stack fills staging and swaps it with published under mu, which readers
+// hold while copying published. Publishing never blocks: it is skipped if a
+// reader holds mu.
+type snapshots struct {
+	mu        sync.Mutex
+	staging   Snapshot
+	published Snapshot
+	// ok is set once a snapshot has been published.
+	ok bool
+	// interval is the interval at which Poll publishes snapshots, next is when the next is due.
+	interval time.Duration
+	next     time.Time
+}
+
+// PublishSnapshot takes a snapshot of the stack for [PortStack.ReadSnapshot].
+// It must be called from the goroutine servicing the stack, i.e: between
+// calls to [PortStack.RecvEth] and [PortStack.HandleEth]. It returns false
+// without blocking if a reader is copying the last snapshot, in which case
+// the snapshot is published by the next call. [PortStack.Poll] calls it at
+// [PortStackConfig.SnapshotInterval].
+func (ps *PortStack) PublishSnapshot() bool {
+	s := &ps.snap.staging
+	now := ps.now()
+	s.Taken = now
+	s.Stats = ps.Stats()
+	s.Health = ps.Health()
+	s.Conns = ps.AppendConnections(s.Conns[:0])
+	s.ARP = ps.arpClient.appendEntries(s.ARP[:0], now)
+	s.Leases = s.Leases[:0]
+	for i := range ps.portsUDP {
+		if sv, ok := ps.portsUDP[i].ihandler.(*DHCPServer); ok && ps.portsUDP[i].port != 0 {
+			s.Leases = sv.appendLeases(s.Leases, now)
+		}
+	}
+	if !ps.snap.mu.TryLock() {
+		return false
+	}
+	ps.snap.staging, ps.snap.published = ps.snap.published, ps.snap.staging
+	ps.snap.ok = true
+	ps.snap.mu.Unlock()
+	return true
+}
+
+// ReadSnapshot copies the last snapshot published with [PortStack.PublishSnapshot]
+// into dst, reusing the backing arrays of its slices. It is safe to call from
+// any goroutine concurrently with the one servicing the stack. It returns
+// false if no snapshot has been published yet.
+func (ps *PortStack) ReadSnapshot(dst *Snapshot) bool {
+	ps.snap.mu.Lock()
+	defer ps.snap.mu.Unlock()
+	if !ps.snap.ok {
+		return false
+	}
+	src := &ps.snap.published
+	conns := append(dst.Conns[:0], src.Conns...)
+	arp := append(dst.ARP[:0], src.ARP...)
+	leases := append(dst.Leases[:0], src.Leases...)
+	*dst = *src
+	dst.Conns, dst.ARP, dst.Leases = conns, arp, leases
+	return true
+}
+
+// snapshotDue reports whether Poll must publish a snapshot at now.
+func (ps *PortStack) snapshotDue(now time.Time) bool {
+	snap := &ps.snap
+	if snap.interval <= 0 || now.Before(snap.next) {
+		return false
+	}
+	snap.next = now.Add(snap.interval)
+	return true
+}
+
+// appendEntries appends the unexpired entries of the ARP cache to dst.
+func (c *arpClient) appendEntries(dst []ARPEntry, now time.Time) []ARPEntry {
+	for i := range c.cache.entries {
+		e := &c.cache.entries[i]
+		if e.updated.IsZero() || now.Sub(e.updated) >= c.cache.lifetime() {
+			continue
+		}
+		dst = append(dst, ARPEntry{Addr: netip.AddrFrom4(e.addr), HW: e.hw, Age: now.Sub(e.updated)})
+	}
+	return dst
+}
+
+// appendLeases appends the server's active leases to dst.
+func (d *DHCPServer) appendLeases(dst []DHCPLease, now time.Time) []DHCPLease {
+	for i := range d.hosts {
+		client := &d.hosts[i]
+		if client.leaseActive(now) {
+			dst = append(dst, DHCPLease{Addr: client.addr, HW: client.mac, Expiry: client.leaseEnd})
+		}
+	}
+	return dst
+}
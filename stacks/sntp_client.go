@@ -0,0 +1,251 @@
+package stacks
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/eth/ntp"
+)
+
+const (
+	defaultSNTPInterval = time.Hour
+	defaultSNTPTimeout  = 5 * time.Second
+)
+
+var errSNTPServer = errors.New("SNTP server address must be IPv4")
+
+// SNTPClientConfig configures an [SNTPClient].
+type SNTPClientConfig struct {
+	// Server is the address of the NTP or SNTP server. Required.
+	Server netip.Addr
+	// ServerHWAddr is the hardware address of the server or the gateway to
+	// reach it. If zero it is resolved with ARP.
+	ServerHWAddr [6]byte
+	// LocalPort is the port requests are sent from. If zero [ntp.ClientPort] is used.
+	LocalPort uint16
+	// Interval is the time between synchronizations. If zero one hour is used.
+	Interval time.Duration
+	// Jitter is the maximum random time added to Interval so that devices
+	// powered on together do not query the server in lockstep. If zero
+	// an eighth of Interval is used. Negative disables jitter.
+	Jitter time.Duration
+	// Timeout is the time waited for a response before retrying. Retries back
+	// off exponentially up to Interval. If zero 5 seconds is used.
+	Timeout time.Duration
+	// OnSync is called on every synchronization with its result, i.e: to set
+	// the system time. May be nil.
+	OnSync func(SNTPResult)
+}
+
+// SNTPResult is the outcome of a synchronization of an [SNTPClient].
+type SNTPResult struct {
+	// Offset is the server's clock minus the stack's clock. Adding it to
+	// the stack's time yields the server's time.
+	Offset time.Duration
+	// Delay is the round trip delay of the exchange, server processing time excluded.
+	Delay time.Duration
+	// Stratum is the stratum of the server.
+	Stratum uint8
+	// Synced is the stack's time when the response was received.
+	Synced time.Time
+}
+
+// Time returns the server's time at the moment of synchronization.
+func (r *SNTPResult) Time() time.Time { return r.Synced.Add(r.Offset) }
+
+// SNTPClient synchronizes with an NTP server periodically as described by
+// RFC 4330 so that targets without a real time clock can learn the time.
+// Unlike [NTPClient] it keeps resynchronizing once started, computing the
+// clock offset and round trip delay of every exchange.
+type SNTPClient struct {
+	stack *PortStack
+	cfg   SNTPClientConfig
+	pkt   UDPPacket
+	hw    [6]byte
+	// xmt is the transmit timestamp of the outstanding request, echoed by servers.
+	xmt ntp.Timestamp
+	// deadline is when the outstanding request times out or the next
+	// synchronization starts if no request is outstanding.
+	deadline time.Time
+	result   SNTPResult
+	retx     Backoff
+	awaiting bool
+	running  bool
+	synced   bool
+}
+
+// NewSNTPClient creates an SNTP client on stack. Synchronization begins when
+// [SNTPClient.Start] is called.
+func NewSNTPClient(stack *PortStack, cfg SNTPClientConfig) (*SNTPClient, error) {
+	if !cfg.Server.Is4() {
+		return nil, errSNTPServer
+	}
+	if cfg.LocalPort == 0 {
+		cfg.LocalPort = ntp.ClientPort
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultSNTPInterval
+	}
+	if cfg.Jitter == 0 {
+		cfg.Jitter = cfg.Interval / 8
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultSNTPTimeout
+	}
+	return &SNTPClient{
+		stack: stack,
+		cfg:   cfg,
+		hw:    cfg.ServerHWAddr,
+		retx:  Backoff{Initial: cfg.Timeout, Max: cfg.Interval, Jitter: retryJitter},
+	}, nil
+}
+
+// Start opens the client's port and sends the first request.
+func (c *SNTPClient) Start() error {
+	err := c.stack.OpenUDP(c.cfg.LocalPort, c)
+	if err != nil {
+		return err
+	}
+	c.running = true
+	c.deadline = time.Time{}
+	c.stack.info("SNTP:start", c.stack.addrAttr("server", c.cfg.Server.As4()))
+	return c.stack.RequestSendUDP(c.cfg.LocalPort)
+}
+
+// Stop stops synchronizing and closes the client's port. The last result is kept.
+func (c *SNTPClient) Stop() error {
+	c.abort()
+	return c.stack.CloseUDP(c.cfg.LocalPort)
+}
+
+// Result returns the result of the last synchronization and false if the
+// client has not synchronized yet.
+func (c *SNTPClient) Result() (SNTPResult, bool) { return c.result, c.synced }
+
+// Now returns the server's time estimated from the stack's clock and the last
+// synchronization. Returns the zero time if the client has not synchronized yet.
+func (c *SNTPClient) Now() time.Time {
+	if !c.synced {
+		return time.Time{}
+	}
+	return c.stack.now().Add(c.result.Offset)
+}
+
+func (c *SNTPClient) send(dst []byte) (int, error) {
+	const payloadoffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+	if !c.running {
+		return 0, io.EOF
+	} else if len(dst) < payloadoffset+ntp.SizeHeader {
+		return 0, io.ErrShortBuffer
+	}
+	now := c.stack.now()
+	if now.Before(c.deadline) {
+		return 0, nil
+	}
+	server := c.cfg.Server.As4()
+	if c.hw == [6]byte{} {
+		hw, err := c.stack.arpClient.resolve(server)
+		if err == errARPResponsePending {
+			return 0, ErrFlagPending
+		} else if err != nil {
+			c.stack.error("SNTP:unresolved", c.stack.addrAttr("server", server))
+			c.retry(now)
+			return 0, nil
+		}
+		c.hw = hw
+	}
+	if c.awaiting {
+		c.stack.debug("SNTP:timeout", slog.Int("retries", c.retx.Attempts()))
+	}
+	xmt, err := ntp.TimestampFromTime(now)
+	if err != nil {
+		return 0, err
+	}
+	hdr := ntp.Header{TransmitTime: xmt}
+	hdr.SetFlags(ntp.ModeClient, ntp.LeapNotSync)
+	payload := dst[payloadoffset : payloadoffset+ntp.SizeHeader]
+	hdr.Put(payload)
+	const ipv4ToS = 0
+	c.stack.setUDP(&c.pkt, c.hw, c.stack.ip, server, ipv4ToS, payload, c.cfg.LocalPort, ntp.ServerPort)
+	c.pkt.PutHeaders(dst)
+	c.xmt = xmt
+	c.awaiting = true
+	c.retry(now)
+	return payloadoffset + ntp.SizeHeader, nil
+}
+
+// retry schedules the next request after a backed off timeout.
+func (c *SNTPClient) retry(now time.Time) {
+	c.deadline = now.Add(c.retx.Next(c.stack.rand32()))
+}
+
+// schedule schedules the next synchronization after the interval and a random jitter.
+func (c *SNTPClient) schedule(now time.Time) {
+	next := c.cfg.Interval
+	if c.cfg.Jitter > 0 {
+		r := uint64(c.stack.rand32())<<32 | uint64(c.stack.rand32())
+		next += time.Duration(r % uint64(c.cfg.Jitter))
+	}
+	c.awaiting = false
+	c.retx.Reset()
+	c.deadline = now.Add(next)
+}
+
+func (c *SNTPClient) recv(pkt *UDPPacket) error {
+	if !c.running {
+		return io.EOF
+	}
+	payload := pkt.Payload()
+	if len(payload) < ntp.SizeHeader {
+		return errTooShortNTP
+	}
+	// Take the destination timestamp as soon as possible.
+	now := c.stack.now()
+	nhdr := ntp.DecodeHeader(payload)
+	switch {
+	case !c.awaiting || pkt.IP.Source != c.cfg.Server.As4():
+		return nil // Unsolicited.
+	case nhdr.Mode() != ntp.ModeServer || nhdr.OriginTime != c.xmt || nhdr.TransmitTime.IsZero():
+		c.stack.debug("SNTP:bogus", slog.Time("origin", nhdr.OriginTime.Time()))
+		return errBogusNTP
+	case nhdr.Stratum == ntp.StratumUnspecified:
+		// Kiss-o'-Death: the server asks us to back off (RFC 4330 section 8).
+		c.stack.info("SNTP:kiss", slog.String("code", string(nhdr.ReferenceID[:])))
+		c.schedule(now)
+		return nil
+	case nhdr.LeapIndicator() == ntp.LeapNotSync:
+		c.stack.debug("SNTP:unsynchronized")
+		return nil // Retried on timeout.
+	}
+	dstTime, err := ntp.TimestampFromTime(now)
+	if err != nil {
+		return err
+	}
+	// Offset and delay as computed per RFC 4330 section 5.
+	t1, t2, t3, t4 := c.xmt, nhdr.ReceiveTime, nhdr.TransmitTime, dstTime
+	c.result = SNTPResult{
+		Offset:  (t2.Sub(t1) + t3.Sub(t4)) / 2,
+		Delay:   t4.Sub(t1) - t3.Sub(t2),
+		Stratum: nhdr.Stratum,
+		Synced:  now,
+	}
+	c.synced = true
+	c.schedule(now)
+	c.stack.info("SNTP:sync", slog.Duration("offset", c.result.Offset), slog.Duration("delay", c.result.Delay))
+	if c.cfg.OnSync != nil {
+		c.cfg.OnSync(c.result)
+	}
+	return nil
+}
+
+func (c *SNTPClient) isPendingHandling() bool { return c.running }
+
+func (c *SNTPClient) abort() {
+	c.running = false
+	c.awaiting = false
+	c.retx.Reset()
+}
@@ -0,0 +1,175 @@
+// Package stackstest provides an in-memory link between two stacks so that
+// exchanges such as TCP handshakes and transfers, retransmissions and DHCP
+// can be integration tested and fuzzed without hardware nor TAP devices.
+//
+// Both stacks of a [Link] run on a virtual clock advanced by the link itself,
+// so timers expire as fast as the simulation runs and results only depend on
+// the link's configuration:
+//
+//	link := stackstest.NewLink(stackstest.LinkConfig{Loss: 0.1, Latency: 2}, cfgA, cfgB)
+//	a, b := link.Stacks()
+//	// Open connections on a and b.
+//	err := link.Run(10000, func() bool { return done })
+package stackstest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/soypat/seqs/stacks"
+)
+
+const (
+	defaultTick         = time.Millisecond
+	defaultReorderDelay = 2
+)
+
+// ErrTickLimit is returned by [Link.Run] when the condition is not met within the tick limit.
+var ErrTickLimit = errors.New("stackstest: tick limit reached")
+
+// epoch is the start of the virtual clock of links.
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// LinkConfig configures the impairments of a [Link]. The zero value is a
+// lossless link delivering frames on the tick they are sent.
+type LinkConfig struct {
+	// Loss is the probability, from 0 to 1, of a frame being lost in transit.
+	Loss float64
+	// Reorder is the probability, from 0 to 1, of a frame being held back
+	// ReorderDelay ticks so that frames sent after it may overtake it.
+	Reorder float64
+	// ReorderDelay is the amount of ticks reordered frames are held back. If zero 2 ticks are used.
+	ReorderDelay int
+	// Latency is the amount of ticks a frame takes to arrive.
+	Latency int
+	// Tick is the time the virtual clock advances on every tick. If zero 1 millisecond is used.
+	Tick time.Duration
+	// Rand is the source of the impairments. If nil a generator seeded with 1 is used.
+	Rand *rand.Rand
+	// OnFrame is an optional callback called with every frame sent by stack
+	// 0 or 1 before impairments are applied. frame must not be retained.
+	OnFrame func(from int, frame []byte)
+}
+
+// LinkStats are the counters of a [Link].
+type LinkStats struct {
+	Ticks int
+	// Frames and Bytes count the frames sent by both stacks, lost ones included.
+	Frames int
+	Bytes  int
+	// Lost and Reordered count the frames affected by impairments.
+	Lost      int
+	Reordered int
+}
+
+// Link is a simulated point-to-point ethernet link between two stacks.
+type Link struct {
+	cfg     LinkConfig
+	stacks  [2]*stacks.PortStack
+	now     time.Time
+	flight  []inflight
+	stats   LinkStats
+	scratch []byte
+}
+
+type inflight struct {
+	to        int
+	deliverAt int
+	data      []byte
+}
+
+// NewLink creates two stacks with configurations a and b attached to each
+// other by a link configured by cfg. The Clock of a and b is overridden with
+// the link's virtual clock.
+func NewLink(cfg LinkConfig, a, b stacks.PortStackConfig) *Link {
+	if cfg.Tick <= 0 {
+		cfg.Tick = defaultTick
+	}
+	if cfg.ReorderDelay <= 0 {
+		cfg.ReorderDelay = defaultReorderDelay
+	}
+	if cfg.Rand == nil {
+		cfg.Rand = rand.New(rand.NewSource(1))
+	}
+	l := &Link{cfg: cfg, now: epoch}
+	for i, scfg := range [2]stacks.PortStackConfig{a, b} {
+		scfg.Clock = l.Now
+		l.stacks[i] = stacks.NewPortStack(scfg)
+	}
+	mtu := l.stacks[0].MTU()
+	if m := l.stacks[1].MTU(); m > mtu {
+		mtu = m
+	}
+	l.scratch = make([]byte, mtu)
+	return l
+}
+
+// Stacks returns the stacks attached to the link.
+func (l *Link) Stacks() (a, b *stacks.PortStack) { return l.stacks[0], l.stacks[1] }
+
+// Now returns the current time of the link's virtual clock.
+func (l *Link) Now() time.Time { return l.now }
+
+// Stats returns the link's counters.
+func (l *Link) Stats() LinkStats { return l.stats }
+
+// Step runs a single tick of the simulation: every stack gets a chance to
+// send a frame, frames due for delivery are received and the clock advances.
+func (l *Link) Step() error {
+	for i, ps := range l.stacks {
+		n, err := ps.HandleEth(l.scratch)
+		if err != nil {
+			return fmt.Errorf("stack %d HandleEth: %w", i, err)
+		} else if n == 0 {
+			continue
+		}
+		frame := l.scratch[:n]
+		l.stats.Frames++
+		l.stats.Bytes += n
+		if l.cfg.OnFrame != nil {
+			l.cfg.OnFrame(i, frame)
+		}
+		if l.cfg.Loss > 0 && l.cfg.Rand.Float64() < l.cfg.Loss {
+			l.stats.Lost++
+			continue
+		}
+		deliverAt := l.stats.Ticks + l.cfg.Latency
+		if l.cfg.Reorder > 0 && l.cfg.Rand.Float64() < l.cfg.Reorder {
+			l.stats.Reordered++
+			deliverAt += l.cfg.ReorderDelay
+		}
+		l.flight = append(l.flight, inflight{to: 1 - i, deliverAt: deliverAt, data: append([]byte(nil), frame...)})
+	}
+	remaining := l.flight[:0]
+	for _, f := range l.flight {
+		if f.deliverAt > l.stats.Ticks {
+			remaining = append(remaining, f)
+			continue
+		}
+		err := l.stacks[f.to].RecvEth(f.data)
+		if err != nil && !errors.Is(err, stacks.ErrDroppedPacket) {
+			return fmt.Errorf("stack %d RecvEth: %w", f.to, err)
+		}
+	}
+	l.flight = remaining
+	l.stats.Ticks++
+	l.now = l.now.Add(l.cfg.Tick)
+	return nil
+}
+
+// Run steps the simulation until done returns true. It returns ErrTickLimit
+// if done is not true after maxTicks steps.
+func (l *Link) Run(maxTicks int, done func() bool) error {
+	for i := 0; !done(); i++ {
+		if i >= maxTicks {
+			return ErrTickLimit
+		}
+		err := l.Step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package stackstest_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/soypat/seqs/eth/dhcp"
+	"github.com/soypat/seqs/stacks"
+	"github.com/soypat/seqs/stacks/stackstest"
+)
+
+const mtu = 1500
+
+func newLink(cfg stackstest.LinkConfig) *stackstest.Link {
+	scfg := func(i byte) stacks.PortStackConfig {
+		return stacks.PortStackConfig{
+			MAC:             [6]byte{0x02, 0, 0, 0, 0, i},
+			MaxOpenPortsUDP: 1,
+			MaxOpenPortsTCP: 1,
+			MTU:             mtu,
+		}
+	}
+	return stackstest.NewLink(cfg, scfg(1), scfg(2))
+}
+
+// transfer sends size bytes from a client on stack a to a server on stack b
+// and checks they are received intact.
+func transfer(t *testing.T, link *stackstest.Link, size, maxTicks int) {
+	t.Helper()
+	const bufSize = 2048
+	cstack, sstack := link.Stacks()
+	cstack.SetAddr(netip.AddrFrom4([4]byte{192, 168, 1, 2}))
+	sstack.SetAddr(netip.AddrFrom4([4]byte{192, 168, 1, 1}))
+	cfg := stacks.TCPConnConfig{TxBufSize: bufSize, RxBufSize: bufSize}
+	client, err := stacks.NewTCPConn(cstack, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := stacks.NewTCPConn(sstack, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.OpenListenTCP(80, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.OpenDialTCP(1025, sstack.HardwareAddr6(), netip.AddrPortFrom(sstack.Addr(), 80), 0x2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	var got []byte
+	var buf [bufSize]byte
+	sent := 0
+	err = link.Run(maxTicks, func() bool {
+		if client.State().IsSynchronized() && sent < size {
+			// Write only what fits so that the simulation never blocks.
+			chunk := client.AvailableOutput()
+			if size-sent < chunk {
+				chunk = size - sent
+			}
+			if chunk > 0 {
+				n, err := client.Write(data[sent : sent+chunk])
+				sent += n
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if server.BufferedInput() > 0 {
+			n, _ := server.Read(buf[:])
+			got = append(got, buf[:n]...)
+		}
+		return len(got) >= size
+	})
+	if err != nil {
+		t.Fatalf("received %d/%d bytes: %v (%+v)", len(got), size, err, link.Stats())
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("received data differs from sent data")
+	}
+}
+
+func TestLinkTCP(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  stackstest.LinkConfig
+	}{
+		{name: "lossless"},
+		{name: "latency", cfg: stackstest.LinkConfig{Latency: 5}},
+		{name: "impaired", cfg: stackstest.LinkConfig{Loss: 0.1, Reorder: 0.1, Latency: 2, Tick: 10 * time.Millisecond}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			link := newLink(tc.cfg)
+			transfer(t, link, 16*1024, 100000)
+			st := link.Stats()
+			if tc.cfg.Loss > 0 && st.Lost == 0 {
+				t.Error("no frames lost on lossy link")
+			}
+		})
+	}
+}
+
+func TestLinkDHCP(t *testing.T) {
+	var frames [2]int
+	link := newLink(stackstest.LinkConfig{
+		Latency: 1,
+		OnFrame: func(from int, frame []byte) { frames[from]++ },
+	})
+	cstack, sstack := link.Stacks()
+	client := stacks.NewDHCPClient(cstack, dhcp.DefaultClientPort)
+	server := stacks.NewDHCPServer(sstack, netip.AddrFrom4([4]byte{192, 168, 1, 1}), dhcp.DefaultServerPort)
+	err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.BeginRequest(stacks.DHCPRequestConfig{Xid: 0x1234})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := link.Now()
+	err = link.Run(1000, func() bool { return client.State() == dhcp.StateBound })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames != [2]int{2, 2} {
+		t.Errorf("sent frames %v, want DISCOVER and REQUEST answered", frames)
+	}
+	if elapsed := link.Now().Sub(start); elapsed != time.Duration(link.Stats().Ticks)*time.Millisecond {
+		t.Errorf("virtual clock advanced %s in %d ticks", elapsed, link.Stats().Ticks)
+	}
+}
+
+// TestLinksConcurrent runs identical links in parallel. Stacks keep no shared
+// state so every link must yield the same result as if run alone.
+func TestLinksConcurrent(t *testing.T) {
+	const numLinks = 8
+	cfg := stackstest.LinkConfig{Loss: 0.05, Reorder: 0.05, Latency: 1}
+	var stats [numLinks]stackstest.LinkStats
+	t.Run("group", func(t *testing.T) {
+		for i := range stats {
+			i := i
+			t.Run(fmt.Sprint("link", i), func(t *testing.T) {
+				t.Parallel()
+				link := newLink(cfg)
+				transfer(t, link, 8*1024, 100000)
+				stats[i] = link.Stats()
+			})
+		}
+	})
+	for i := range stats {
+		if stats[i] != stats[0] {
+			t.Errorf("link %d stats %+v differ from link 0 %+v", i, stats[i], stats[0])
+		}
+	}
+}
+
+func FuzzLinkTCP(f *testing.F) {
+	f.Add(int64(1), uint8(5), uint8(5), uint8(2))
+	f.Fuzz(func(t *testing.T, seed int64, lossPercent, reorderPercent, latency uint8) {
+		link := newLink(stackstest.LinkConfig{
+			Loss:    float64(lossPercent%20) / 100,
+			Reorder: float64(reorderPercent%20) / 100,
+			Latency: int(latency % 8),
+			Tick:    10 * time.Millisecond,
+			Rand:    rand.New(rand.NewSource(seed)),
+		})
+		transfer(t, link, 4096, 200000)
+	})
+}
@@ -0,0 +1,134 @@
+package stacks
+
+import "github.com/soypat/seqs/eth"
+
+// FrameCounts counts frames and their bytes by protocol. Frames carrying
+// other protocols are only counted in Frames and Bytes.
+type FrameCounts struct {
+	Frames uint32
+	Bytes  uint64
+	ARP    uint32
+	ICMP   uint32
+	IGMP   uint32
+	// UDP counts UDP and UDP-Lite datagrams.
+	UDP uint32
+	TCP uint32
+}
+
+// count counts the ethernet frame by the protocol it carries.
+func (fc *FrameCounts) count(frame []byte) {
+	fc.Frames++
+	fc.Bytes += uint64(len(frame))
+	if len(frame) < eth.SizeEthernetHeader {
+		return
+	}
+	etype, ipOffset := eth.EtherType(eth.FieldEtherType.Get(frame)), eth.SizeEthernetHeader
+	if etype == eth.EtherTypeVLAN && len(frame) >= eth.SizeEthernetHeader+eth.SizeVLANTag {
+		// Frames sent on a VLAN are counted by the protocol they carry.
+		var ehdr eth.EthernetHeader
+		ehdr, _, ipOffset = eth.DecodeEthernetHeaderVLAN(frame)
+		etype = ehdr.AssertType()
+	}
+	switch etype {
+	case eth.EtherTypeARP:
+		fc.ARP++
+	case eth.EtherTypeIPv4:
+		protoOffset := ipOffset + 9
+		if len(frame) <= protoOffset {
+			return
+		}
+		switch eth.IPProto(frame[protoOffset]) {
+		case eth.IPProtoICMP:
+			fc.ICMP++
+		case eth.IPProtoIGMP:
+			fc.IGMP++
+		case eth.IPProtoTCP:
+			fc.TCP++
+		case eth.IPProtoUDP, eth.IPProtoUDPLite:
+			fc.UDP++
+		}
+	}
+}
+
+// FragmentDrops counts received IPv4 fragments discarded with the datagram
+// they belong to by the reason it was discarded for. See [PortStackConfig.IPReassemblyBuffers].
+type FragmentDrops struct {
+	// Timeout counts fragments of datagrams not completed within [PortStackConfig.IPReassemblyTimeout].
+	Timeout uint32
+	// Evicted counts fragments of datagrams discarded to reassemble a newer one.
+	Evicted uint32
+	// Overlap counts fragments of datagrams with overlapping fragments, as sent by teardrop attacks.
+	Overlap uint32
+	// TooLarge counts fragments of datagrams too large to reassemble.
+	TooLarge uint32
+	// TooMany counts fragments of datagrams split in more than 16 fragments.
+	TooMany uint32
+	// Tiny counts fragments of datagrams with a non-final fragment carrying less than 48 octets.
+	Tiny uint32
+	// Malformed counts fragments of datagrams with inconsistent fragment lengths.
+	Malformed uint32
+}
+
+// Stats are cumulative traffic counters of a stack for field diagnostics of
+// what the stack is doing. Error counters and liveness are reported by [Health].
+type Stats struct {
+	// Rx counts received frames accepted by the L2 filter. See [L2Filter].
+	Rx FrameCounts
+	// Tx counts frames written out by HandleEth.
+	Tx FrameCounts
+	// RxRate and TxRate are the average rates in bytes per second at which
+	// frames were received and sent over the last seconds, an exponentially
+	// weighted moving average of the bytes counted every second.
+	RxRate, TxRate uint32
+	// DroppedNoSocket counts received UDP and TCP packets for which no port is open.
+	DroppedNoSocket uint32
+	// DroppedFilter counts received packets dropped by the packet filter. See [PortStack.SetPacketFilter].
+	DroppedFilter uint32
+	// DroppedChecksum counts received packets dropped for an invalid checksum.
+	// See [Health.BadChecksumIP] for the packets with invalid checksums whether dropped or not.
+	DroppedChecksum uint32
+	// DroppedQueueFull counts received packets dropped because the destination
+	// port had not been handled yet. Same as [Health.DroppedPackets].
+	DroppedQueueFull uint32
+	// TCPRetransmits counts TCP segments retransmitted on a retransmission timeout.
+	TCPRetransmits uint32
+	// TCPSynRetransmits counts SYN segments retransmitted by connections being dialed.
+	TCPSynRetransmits uint32
+	// TCPConnectTimeouts counts dials aborted after [TCPConfig.SynRetries] unanswered retransmissions.
+	TCPConnectTimeouts uint32
+	// ARPCacheMisses counts hardware address lookups that started an ARP resolution.
+	ARPCacheMisses uint32
+	// ARPQueueDrops counts datagrams dropped from the ARP queue after their
+	// destination failed to resolve. See [PortStackConfig.ARPQueueLen].
+	ARPQueueDrops uint32
+	// ICMPRedirects counts ICMP redirects that updated the destination cache,
+	// ICMPRedirectsIgnored those ignored by policy or for failing validation.
+	// See [PortStackConfig.AcceptICMPRedirects].
+	ICMPRedirects        uint32
+	ICMPRedirectsIgnored uint32
+	// GatewayFailovers counts switches of the default gateway by dead gateway
+	// detection. See [GatewayFailover].
+	GatewayFailovers uint32
+	// DHCPLeasesIssued counts addresses leased or renewed by DHCP servers on the stack.
+	DHCPLeasesIssued uint32
+	// DroppedFragments counts received IPv4 fragments of datagrams discarded
+	// by reason. See [Health.DroppedFragments] for the total.
+	DroppedFragments FragmentDrops
+	// PacketPoolMisses counts segments received out of order not queued for
+	// lack of free buffers in the packet pool. See [PortStackConfig.PacketPoolBytes].
+	PacketPoolMisses uint32
+	// Stages are the times spent per processing stage. Zero unless
+	// [PortStackConfig.ProfileStages] is set.
+	Stages StageTimes
+}
+
+// Stats returns a snapshot of the stack's traffic counters.
+func (ps *PortStack) Stats() Stats {
+	stats := ps.stats
+	stats.DroppedQueueFull = ps.droppedPackets
+	stats.RxRate, stats.TxRate = ps.Rates()
+	stats.Stages = ps.prof.snapshot()
+	stats.PacketPoolMisses = ps.pool.misses
+	stats.DroppedFragments = ps.reasm.drops
+	return stats
+}
@@ -0,0 +1,105 @@
+package stacks
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultStormInterval = time.Second
+	defaultStormHoldoff  = 5 * time.Second
+)
+
+// StormControl configures the suppression of broadcast and multicast storms,
+// which protects the poll loop of devices attached to noisy flat networks.
+// Once more than Limit frames of a traffic class are received within an
+// Interval, all frames of that class are dropped for the Holdoff time.
+// Broadcast and multicast frames are accounted separately. Dropped frames are
+// counted in [Health].
+type StormControl struct {
+	// Limit is the amount of broadcast or multicast frames accepted per
+	// Interval. If zero storm control is disabled.
+	Limit uint16
+	// Interval is the time period frames are counted over. If zero 1 second is used.
+	Interval time.Duration
+	// Holdoff is the time a traffic class is dropped once its limit is
+	// exceeded. If zero 5 seconds is used.
+	Holdoff time.Duration
+	// OnStorm is an optional callback called when suppression of a traffic
+	// class, [L2Broadcast] or [L2Multicast], starts and ends.
+	OnStorm func(class L2Filter, suppressed bool)
+}
+
+// stormControl holds the frame rate state of each traffic class.
+type stormControl struct {
+	cfg     StormControl
+	classes [2]stormClass
+	dropped uint32
+}
+
+type stormClass struct {
+	// start is the start of the current counting interval.
+	start time.Time
+	count uint32
+	// until is the end of suppression. Zero if not suppressed.
+	until time.Time
+}
+
+// SetStormControl sets the broadcast and multicast storm suppression
+// configuration, resetting suppression state.
+func (ps *PortStack) SetStormControl(sc StormControl) {
+	ps.storm = stormControl{cfg: sc, dropped: ps.storm.dropped}
+}
+
+// StormControl returns the broadcast and multicast storm suppression configuration.
+func (ps *PortStack) StormControl() StormControl { return ps.storm.cfg }
+
+// stormDrop accounts for a received frame with destination hardware address
+// dst and reports whether it must be dropped due to a storm of its class.
+func (ps *PortStack) stormDrop(dst [6]byte) bool {
+	sc := &ps.storm
+	if sc.cfg.Limit == 0 || dst[0]&1 == 0 {
+		return false // Disabled or unicast.
+	}
+	class, c := L2Multicast, &sc.classes[1]
+	if dst == [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff} {
+		class, c = L2Broadcast, &sc.classes[0]
+	}
+	now := ps.now()
+	if !c.until.IsZero() {
+		if now.Before(c.until) {
+			sc.dropped++
+			return true
+		}
+		c.until = time.Time{}
+		c.count = 0
+		c.start = now
+		ps.info("L2:storm-end", slog.Int("class", int(class)))
+		if sc.cfg.OnStorm != nil {
+			sc.cfg.OnStorm(class, false)
+		}
+	}
+	interval := sc.cfg.Interval
+	if interval <= 0 {
+		interval = defaultStormInterval
+	}
+	if now.Sub(c.start) >= interval {
+		c.start = now
+		c.count = 0
+	}
+	c.count++
+	if c.count <= uint32(sc.cfg.Limit) {
+		return false
+	}
+	holdoff := sc.cfg.Holdoff
+	if holdoff <= 0 {
+		holdoff = defaultStormHoldoff
+	}
+	c.until = now.Add(holdoff)
+	sc.dropped++
+	ps.error("L2:storm-start", slog.Int("class", int(class)), slog.Int("frames", int(c.count)), slog.Duration("interval", interval))
+	if sc.cfg.OnStorm != nil {
+		sc.cfg.OnStorm(class, true)
+	}
+	return true
+}
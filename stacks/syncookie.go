@@ -0,0 +1,256 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"math/bits"
+	"net/netip"
+	"time"
+
+	"github.com/soypat/seqs"
+	"github.com/soypat/seqs/eth"
+)
+
+const (
+	// synCookieTick is the period of the counter encoded in SYN cookies.
+	synCookieTick = 64 * time.Second
+	// synCookieHashMask selects the bits of a SYN cookie holding its hash.
+	synCookieHashMask = 1<<25 - 1
+)
+
+// synCookieMSS are the maximum segment sizes that can be encoded in a SYN cookie.
+// The largest not above the remote's MSS is used.
+var synCookieMSS = [4]uint16{536, 1220, 1440, 1460}
+
+// tcpSynCookies implements the SYN cookies of RFC 4987 section 3.6 for a
+// listener whose half-open connections are exhausted: the SYN is answered
+// with a SYN-ACK whose initial sequence number encodes the connection and no
+// state is kept until the remote acknowledges it. Connections established
+// this way do not negotiate window scaling, SACK or timestamps.
+//
+// The cookie holds a 5 bit counter that ticks every 64 seconds, a 2 bit index
+// into synCookieMSS and 25 bits of a hash keyed with a secret of the listener.
+type tcpSynCookies struct {
+	enabled bool
+	key     [16]byte
+	// eth, ip, tcp and opts hold the outgoing SYN-ACK carrying a cookie.
+	// Only one can be pending at a time; a newer one replaces an unsent one.
+	eth     eth.EthernetHeader
+	ip      eth.IPv4Header
+	tcp     eth.TCPHeader
+	opts    [4]byte
+	pending bool
+	// syn holds the SYN reconstructed from a valid cookie.
+	syn TCPPacket
+}
+
+// rekey draws a new secret from the stack's entropy source, invalidating
+// cookies sent before.
+func (c *tcpSynCookies) rekey(ps *PortStack) {
+	for i := 0; i < len(c.key); i += 4 {
+		binary.LittleEndian.PutUint32(c.key[i:], ps.rand32())
+	}
+	c.pending = false
+}
+
+// hash returns the keyed hash of the connection of pkt, sent or acknowledged by
+// the remote, with initial sequence number irs, counter t and MSS index idx.
+func (c *tcpSynCookies) hash(pkt *TCPPacket, irs seqs.Value, t uint32, idx uint8) uint32 {
+	var buf [4 + 4 + 2 + 2 + 4 + 4 + 1]byte
+	b := append(buf[:0], pkt.IP.Source[:]...)
+	b = append(b, pkt.IP.Destination[:]...)
+	b = binary.BigEndian.AppendUint16(b, pkt.TCP.SourcePort)
+	b = binary.BigEndian.AppendUint16(b, pkt.TCP.DestinationPort)
+	b = binary.BigEndian.AppendUint32(b, uint32(irs))
+	b = binary.BigEndian.AppendUint32(b, t)
+	b = append(b, idx)
+	return uint32(siphash24(&c.key, b))
+}
+
+// clock returns the cookie counter at now.
+func (c *tcpSynCookies) clock(now time.Time) uint32 {
+	return uint32(now.Unix() / int64(synCookieTick/time.Second))
+}
+
+// encode returns the cookie used as initial sequence number in response to the SYN pkt.
+func (c *tcpSynCookies) encode(pkt *TCPPacket, mss uint16, now time.Time) seqs.Value {
+	var idx uint8
+	for i := range synCookieMSS {
+		if synCookieMSS[i] <= mss {
+			idx = uint8(i)
+		}
+	}
+	t := c.clock(now)
+	return seqs.Value(t<<27 | uint32(idx)<<25 | c.hash(pkt, pkt.TCP.Seq, t, idx)&synCookieHashMask)
+}
+
+// decode validates the cookie acknowledged by the ACK pkt and returns the MSS
+// of the remote encoded in it. Cookies are valid for up to two counter ticks.
+func (c *tcpSynCookies) decode(pkt *TCPPacket, now time.Time) (mss uint16, ok bool) {
+	cookie := uint32(pkt.TCP.Ack) - 1
+	t := c.clock(now)
+	age := (t - cookie>>27) & 31
+	if age > 1 {
+		return 0, false
+	}
+	t -= age
+	idx := uint8(cookie>>25) & 3
+	if cookie&synCookieHashMask != c.hash(pkt, pkt.TCP.Seq-1, t, idx)&synCookieHashMask {
+		return 0, false
+	}
+	return synCookieMSS[idx], true
+}
+
+// queue prepares a SYN-ACK with a cookie in response to the SYN pkt received by l.
+func (c *tcpSynCookies) queue(l *TCPListener, pkt *TCPPacket) {
+	ps := l.stack
+	opts, err := seqs.ParseOptions(pkt.TCPOptions())
+	if err != nil {
+		return
+	}
+	if opts.MSS == 0 {
+		opts.MSS = synCookieMSS[0] // RFC 9293 3.7.1: Default MSS.
+	}
+	c.eth = eth.EthernetHeader{
+		Destination:     pkt.Eth.Source,
+		Source:          pkt.Eth.Destination,
+		SizeOrEtherType: uint16(eth.EtherTypeIPv4),
+	}
+	c.ip = eth.IPv4Header{
+		VersionAndIHL: 4<<4 | 5,
+		TotalLength:   eth.SizeIPv4Header + eth.SizeTCPHeader + uint16(len(c.opts)),
+		TTL:           64,
+		Protocol:      6,
+		Source:        pkt.IP.Destination,
+		Destination:   pkt.IP.Source,
+	}
+	wnd := seqs.Size(min(len(l.conns[0].rx.buf), 0xffff))
+	c.tcp = eth.TCPHeader{
+		SourcePort:      pkt.TCP.DestinationPort,
+		DestinationPort: pkt.TCP.SourcePort,
+		Seq:             c.encode(pkt, opts.MSS, ps.now()),
+		Ack:             seqs.Add(pkt.TCP.Seq, 1),
+		WindowSizeRaw:   uint16(ps.fingerprint.synWindow(seqs.FlagSYN, wnd)),
+	}
+	var local seqs.Options
+	if ps.mtu > sizeTCPNoOptions {
+		local.MSS = ps.mtu - sizeTCPNoOptions
+	}
+	local.Append(c.opts[:0])
+	c.tcp.SetFlags(seqs.FlagSYN | seqs.FlagACK)
+	c.tcp.SetOffset(5 + uint8(len(c.opts)/4))
+	c.tcp.Checksum = c.tcp.CalculateChecksumIPv4(&c.ip, c.opts[:], nil)
+	ps.applyFingerprint(&c.ip)
+	c.pending = true
+	if ps.isLogEnabled(slog.LevelDebug) {
+		l.debug("lst:syncookie", slog.Uint64("lport", uint64(l.port)), slog.Uint64("rport", uint64(pkt.TCP.SourcePort)))
+	}
+}
+
+// put writes the pending SYN-ACK to dst and clears the pending flag.
+func (c *tcpSynCookies) put(dst []byte) int {
+	c.eth.Put(dst)
+	c.ip.Put(dst[eth.SizeEthernetHeader:])
+	c.tcp.Put(dst[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	copy(dst[sizeTCPNoOptions:], c.opts[:])
+	c.pending = false
+	return sizeTCPNoOptions + len(c.opts)
+}
+
+// acceptCookie establishes the connection acknowledged by the ACK pkt if it
+// carries a valid cookie, replaying the handshake the listener did not keep
+// state for. It returns false if the cookie is invalid.
+func (l *TCPListener) acceptCookie(pkt *TCPPacket) (bool, error) {
+	mss, ok := l.cookies.decode(pkt, l.stack.now())
+	if !ok {
+		return false, nil
+	}
+	idx := l.freeConnIndex()
+	if idx < 0 {
+		idx = l.evictHalfOpen()
+	}
+	if idx < 0 || l.pendingAccept() >= int(l.backlog) {
+		l.trace("lst:backlog-full")
+		return true, ErrDroppedPacket
+	}
+	syn := &l.cookies.syn
+	syn.Rx = pkt.Rx
+	syn.Eth = pkt.Eth
+	syn.IP = pkt.IP
+	syn.IP.VersionAndIHL = 4<<4 | 5
+	syn.IP.TotalLength = eth.SizeIPv4Header + eth.SizeTCPHeader + uint16(len(syn.data))
+	syn.TCP = pkt.TCP
+	syn.TCP.Seq = pkt.TCP.Seq - 1
+	syn.TCP.Ack = 0
+	syn.TCP.SetFlags(seqs.FlagSYN)
+	syn.TCP.SetOffset(5 + uint8(len(syn.data)/4))
+	seqs.Options{MSS: mss}.Append(syn.data[:0])
+
+	conn := &l.conns[idx]
+	conn.abort()
+	conn.open(seqs.StateListen, l.port, pkt.TCP.Ack-1, [6]byte{}, netip.AddrPort{})
+	l.used[idx] = false
+	err := conn.recv(syn)
+	if err == ErrFlagPending {
+		err = nil // SYN-ACK pending, sent below.
+	}
+	if seg, ok := conn.scb.PendingSegment(0); err == nil && ok && seg.Flags == seqs.FlagSYN|seqs.FlagACK {
+		err = conn.scb.Send(seg) // SYN-ACK sent with the cookie.
+	}
+	if err == nil {
+		err = conn.recv(pkt)
+	}
+	if err == io.EOF || !conn.State().IsSynchronized() {
+		l.freeConnForReuse(idx)
+		return true, nil
+	}
+	l.info("lst:syncookie-accept", slog.Uint64("lport", uint64(l.port)), slog.Uint64("rport", uint64(pkt.TCP.SourcePort)))
+	return true, err
+}
+
+// siphash24 returns the SipHash-2-4 of b keyed with key. Unlike unkeyed hashes
+// such as FNV prefixed with a secret, it is a MAC: observing outputs does not
+// allow computing the output for other inputs without the key.
+func siphash24(key *[16]byte, b []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	last := uint64(len(b)) << 56
+	for ; len(b) >= 8; b = b[8:] {
+		m := binary.LittleEndian.Uint64(b)
+		v3 ^= m
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0 ^= m
+	}
+	for i, c := range b {
+		last |= uint64(c) << (8 * i)
+	}
+	v3 ^= last
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0 ^= last
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+func sipRound(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+	v0 += v1
+	v1 = bits.RotateLeft64(v1, 13) ^ v0
+	v0 = bits.RotateLeft64(v0, 32)
+	v2 += v3
+	v3 = bits.RotateLeft64(v3, 16) ^ v2
+	v0 += v3
+	v3 = bits.RotateLeft64(v3, 21) ^ v0
+	v2 += v1
+	v1 = bits.RotateLeft64(v1, 17) ^ v2
+	v2 = bits.RotateLeft64(v2, 32)
+	return v0, v1, v2, v3
+}
@@ -0,0 +1,205 @@
+package stacks
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errTCPConfigRTO       = errors.New("TCP config: invalid retransmission timeout bounds")
+	errTCPConfigDelACK    = errors.New("TCP config: delayed ACK time must be between 0 and 500ms")
+	errTCPConfigKeepalive = errors.New("TCP config: negative keepalive time")
+	errTCPConfigTimeout   = errors.New("TCP config: negative SYN interval, close timeout or MSL")
+)
+
+// Defaults of the fields of [TCPConfig].
+const (
+	defaultSocketSize        = 2048
+	defaultMinRTO            = time.Second // RFC 6298 section 2.4.
+	defaultMaxRTO            = 60 * time.Second
+	defaultMaxRetrans        = 8
+	defaultSynInterval       = 3 * time.Second
+	defaultCloseTimeout      = 3 * time.Second
+	defaultKeepaliveInterval = 75 * time.Second
+	defaultKeepaliveProbes   = 9
+	// maxDelayedACK is the limit on delaying acknowledgements of RFC 1122 section 4.2.3.2.
+	maxDelayedACK = 500 * time.Millisecond
+)
+
+// TCPConfig holds the tunables of TCP connections. The stack's configuration
+// set with [PortStackConfig.TCP] or [PortStack.SetTCPConfig] is used by
+// connections when created unless overridden with [TCPConnConfig.TCP] or
+// [TCPConn.SetTCPConfig]. Zero valued fields select the defaults documented
+// on each field.
+type TCPConfig struct {
+	// MinRTO and MaxRTO bound the retransmission timeout calculated from round
+	// trip time measurements. If zero 1 second (RFC 6298) and 60 seconds are used.
+	// A lower minimum recovers faster from loss on low latency local networks.
+	MinRTO time.Duration
+	MaxRTO time.Duration
+	// MaxRetransmits is the amount of consecutive retransmissions of
+	// unacknowledged data after which the connection is aborted. If zero 8 is used.
+	MaxRetransmits uint8
+	// SynInterval is the time between retransmissions of the SYN of a
+	// connection being dialed. If zero 3 seconds is used.
+	SynInterval time.Duration
+	// SynRetries is the amount of unanswered SYN retransmissions after which
+	// a connection being dialed is aborted, bounding the time spent trying to
+	// reach an unreachable server. If zero the SYN is retransmitted until the
+	// connection is closed.
+	SynRetries uint8
+	// SynBackoff doubles the time between SYN retransmissions after each one,
+	// up to MaxRTO. By default the SYN is retransmitted every SynInterval.
+	SynBackoff bool
+	// ConnectTimeout is the time a connection being dialed waits to be
+	// established before it is aborted with an error whose Timeout method
+	// returns true. If zero only SynRetries bounds the time spent dialing.
+	ConnectTimeout time.Duration
+	// CloseTimeout is the time a closing connection waits for the remote
+	// before it is aborted. If zero 3 seconds is used.
+	CloseTimeout time.Duration
+	// MSL is the maximum segment lifetime. Connections closed by us remain in
+	// TIME_WAIT for twice MSL holding their port, acknowledging the FIN of the
+	// remote again should our final ACK be lost (RFC 9293 section 3.6). RFC
+	// 9293 suggests 2 minutes; a few seconds suffice on a local network. If
+	// zero the port is released as soon as the close completes, which saves
+	// memory on constrained targets at the risk of the remote seeing a RST.
+	MSL time.Duration
+	// DelayedACK is the maximum time the acknowledgement of received data is
+	// delayed so that it may be sent along with data or a window update. An
+	// acknowledgement is sent without delay for every second segment received.
+	// Must be at most 500ms. If zero acknowledgements are sent immediately.
+	DelayedACK time.Duration
+	// KeepaliveIdle is the time without receiving segments after which an
+	// established connection sends keepalive probes. If zero keepalives are disabled.
+	KeepaliveIdle time.Duration
+	// KeepaliveInterval is the time between unanswered keepalive probes. If zero 75 seconds is used.
+	KeepaliveInterval time.Duration
+	// KeepaliveProbes is the amount of unanswered keepalive probes after
+	// which the connection is aborted. If zero 9 is used.
+	KeepaliveProbes uint8
+	// KeepaliveGarbage makes keepalive probes carry one octet of already
+	// acknowledged data as permitted by RFC 1122 section 4.2.3.6, since some
+	// middleboxes such as NATs drop probes without data.
+	KeepaliveGarbage bool
+	// TxBufSize and RxBufSize are the sizes of the buffers of connections
+	// created with [NewTCPConn], which bound the data in flight and the
+	// advertised receive window. If zero 2048 bytes are used.
+	// [TCPConnConfig] buffer sizes take precedence.
+	TxBufSize uint16
+	RxBufSize uint16
+	// Nagle enables Nagle's algorithm (RFC 896): data smaller than a full
+	// segment is held while sent data is unacknowledged so that small
+	// writes are coalesced. By default data is sent as soon as it is written.
+	Nagle bool
+	// SACK enables selective acknowledgements (RFC 2018), negotiated with the
+	// SACK-permitted option in SYN segments. Data received ahead of a lost
+	// segment is reported to the remote, which requires [TCPConnConfig.RxQueueLen]
+	// to be set, and after a retransmission timeout only the data the remote
+	// did not report is retransmitted. Not used on connections signed with TCP MD5.
+	SACK bool
+	// Timestamps enables the timestamps option (RFC 7323), negotiated in SYN
+	// segments and then sent in every segment. The echoed timestamps measure
+	// the round trip time with every acknowledgement, retransmissions
+	// included, which keeps the retransmission timeout accurate on links
+	// with jittery delay, and old duplicate segments are rejected (PAWS).
+	// Not used on connections signed with TCP MD5.
+	Timestamps bool
+	// PathMTUDiscovery sets the Don't Fragment flag on segments sent so that
+	// routers unable to forward them answer with ICMP fragmentation needed
+	// messages instead of fragmenting (RFC 1191). Open connections lower their
+	// segment size as the messages arrive regardless of this setting, and
+	// the path MTU learned is cached per destination if the destination cache
+	// is enabled, see [PortStack.Destination].
+	PathMTUDiscovery bool
+}
+
+// Validate checks the configuration is consistent once defaults are applied.
+func (cfg TCPConfig) Validate() error {
+	if cfg.MinRTO < 0 || cfg.MaxRTO < 0 {
+		return errTCPConfigRTO
+	}
+	cfg = cfg.withDefaults()
+	switch {
+	case cfg.MinRTO > cfg.MaxRTO:
+		return errTCPConfigRTO
+	case cfg.DelayedACK < 0 || cfg.DelayedACK > maxDelayedACK:
+		return errTCPConfigDelACK
+	case cfg.KeepaliveIdle < 0 || cfg.KeepaliveInterval < 0:
+		return errTCPConfigKeepalive
+	case cfg.SynInterval < 0 || cfg.CloseTimeout < 0 || cfg.MSL < 0 || cfg.ConnectTimeout < 0:
+		return errTCPConfigTimeout
+	}
+	return nil
+}
+
+// withDefaults returns cfg with zero valued fields set to their defaults.
+func (cfg TCPConfig) withDefaults() TCPConfig {
+	if cfg.MinRTO == 0 {
+		cfg.MinRTO = defaultMinRTO
+	}
+	if cfg.MaxRTO == 0 {
+		cfg.MaxRTO = defaultMaxRTO
+	}
+	if cfg.MaxRetransmits == 0 {
+		cfg.MaxRetransmits = defaultMaxRetrans
+	}
+	if cfg.SynInterval == 0 {
+		cfg.SynInterval = defaultSynInterval
+	}
+	if cfg.CloseTimeout == 0 {
+		cfg.CloseTimeout = defaultCloseTimeout
+	}
+	if cfg.KeepaliveInterval == 0 {
+		cfg.KeepaliveInterval = defaultKeepaliveInterval
+	}
+	if cfg.KeepaliveProbes == 0 {
+		cfg.KeepaliveProbes = defaultKeepaliveProbes
+	}
+	if cfg.TxBufSize == 0 {
+		cfg.TxBufSize = defaultSocketSize
+	}
+	if cfg.RxBufSize == 0 {
+		cfg.RxBufSize = defaultSocketSize
+	}
+	return cfg
+}
+
+// SetTCPConfig validates cfg and sets it as the configuration of TCP
+// connections created afterwards. Existing connections are not modified.
+func (ps *PortStack) SetTCPConfig(cfg TCPConfig) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+	ps.tcpcfg = cfg.withDefaults()
+	return nil
+}
+
+// TCPConfig returns the stack's TCP configuration with defaults applied.
+func (ps *PortStack) TCPConfig() TCPConfig { return ps.tcpcfg }
+
+// SetTCPConfig validates cfg and sets it as the connection's configuration.
+// Buffer sizes are ignored since the buffers are allocated on creation.
+func (sock *TCPConn) SetTCPConfig(cfg TCPConfig) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+	sock.applyTCPConfig(cfg.withDefaults())
+	if sock.localPort != 0 {
+		sock.stack.RequestSendTCP(sock.localPort) // Keepalive and timers may now be due.
+	}
+	return nil
+}
+
+// TCPConfig returns the connection's configuration with defaults applied.
+func (sock *TCPConn) TCPConfig() TCPConfig { return sock.tcfg }
+
+// applyTCPConfig sets a validated configuration with defaults applied.
+func (sock *TCPConn) applyTCPConfig(cfg TCPConfig) {
+	sock.tcfg = cfg
+	sock.retx.minRTO = cfg.MinRTO
+	sock.retx.maxRTO = cfg.MaxRTO
+	sock.retx.maxRetrans = cfg.MaxRetransmits
+}
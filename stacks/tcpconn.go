@@ -19,10 +19,13 @@ var _ net.Conn = &TCPConn{}
 
 var _ itcphandler = (*TCPConn)(nil)
 
-const (
-	defaultSocketSize = 2048
-	sizeTCPNoOptions  = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeTCPHeader
-)
+var _ io.ReaderFrom = (*TCPConn)(nil)
+
+var _ io.WriterTo = (*TCPConn)(nil)
+
+var errConnAborted = errors.New("connection aborted")
+
+const sizeTCPNoOptions = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeTCPHeader
 
 // TCPConn is a userspace implementation of a TCP connection intended for use with PortStack
 // though is purposefully loosely coupled. It implements [net.Conn].
@@ -39,13 +42,57 @@ type TCPConn struct {
 	// remote is the IP+port address of remote.
 	remote    netip.AddrPort
 	localPort uint16
+	// localIP is the address alias a remote connected to. If zero the
+	// stack's primary address is used.
+	localIP   [4]byte
 	remoteMAC [6]byte
 	abortErr  error
 	closing   bool
+	// aborting is set by Abort. The socket is released on the next send.
+	aborting bool
 	// connid is a conenction counter that is incremented each time a new
 	// connection is established via Open calls. This disambiguate's whether
 	// Read and Write calls belong to the current connection.
 	connid uint8
+	// pacer limits the transmit rate of data segments. See pacing.go.
+	pacer tcpPacer
+	// interactive prioritizes the connection's segments. See priority.go.
+	interactive bool
+	// rxq holds segments received out of order. See tcprxqueue.go.
+	rxq tcpRxQueue
+	// retx tracks unacknowledged data and the retransmission timer. See tcpretx.go.
+	retx tcpRetx
+	// ts is the state of the timestamps option. See tcptimestamps.go.
+	ts tcpTimestamps
+	// tcfg is the connection's configuration with defaults applied. See tcpconfig.go.
+	tcfg TCPConfig
+	// delack tracks received data not yet acknowledged. See tcpdelack.go.
+	delack tcpDelayedACK
+	// quickack disables delaying acknowledgements. See [TCPConn.SetQuickAck].
+	quickack bool
+	// ka is the keepalive probing state. See tcpkeepalive.go.
+	ka tcpKeepalive
+	// persist is the zero window probing state. See tcpwindow.go.
+	persist tcpPersist
+	// rcvEdge is the right edge of the last receive window advertised.
+	rcvEdge seqs.Value
+	// pathMTU is the frame size limit to the remote learned from the
+	// destination cache. Zero if the stack's MTU applies. See destcache.go.
+	pathMTU uint16
+	// push is the amount of buffered data to be sent regardless of Nagle's algorithm. See [TCPConn.Flush].
+	push int
+	// peer is the identity of the remote authenticated by a security layer. See peerid.go.
+	peer PeerIdentity
+	// opened is the time the connection was opened or a remote connected to it.
+	opened time.Time
+	// connect tracks the handshake of a dialed connection. See tcpconnect.go.
+	connect tcpConnect
+	// timeWaitEnd is when a connection lingering in TIME_WAIT releases its port. See [TCPConfig.MSL].
+	timeWaitEnd time.Time
+	// flow accounts the connection's packets. See flowexport.go.
+	flow flowCount
+	// rates meters the data received and sent. See ratemeter.go.
+	rates byteRates
 	// Avoid heap allocations by making LocalAddr and RemoteAddr give out pointers to these fields.
 	raddr, laddr net.TCPAddr
 }
@@ -53,27 +100,62 @@ type TCPConn struct {
 type TCPConnConfig struct {
 	TxBufSize uint16
 	RxBufSize uint16
+	// PacingRate limits the rate at which data is sent in bytes per second.
+	// A value of zero means no limit. See [TCPConn.SetPacing].
+	PacingRate int
+	// PacingMinGap is the minimum time between consecutive data segments.
+	// A value of zero means no minimum gap.
+	PacingMinGap time.Duration
+	// Interactive hints the connection carries interactive traffic. See [TCPConn.SetInteractive].
+	Interactive bool
+	// RxQueueLen is the amount of segments received ahead of a missing
+	// segment, such as when a burst is reordered in flight, held until the
+	// gap is filled. Each queued segment takes an MTU sized buffer allocated on
+	// creation, or borrowed from the stack's packet pool if it has one. See
+	// [PortStackConfig.PacketPoolBytes]. If zero out of order segments are
+	// dropped and must be retransmitted by the peer.
+	RxQueueLen uint8
+	// TCP overrides the stack's TCP configuration for the connection if not nil. See [TCPConfig].
+	TCP *TCPConfig
 }
 
 func NewTCPConn(stack *PortStack, cfg TCPConnConfig) (*TCPConn, error) {
+	tcfg := stack.tcpcfg
+	if cfg.TCP != nil {
+		err := cfg.TCP.Validate()
+		if err != nil {
+			return nil, err
+		}
+		tcfg = cfg.TCP.withDefaults()
+	}
 	if cfg.RxBufSize == 0 {
-		cfg.RxBufSize = defaultSocketSize
+		cfg.RxBufSize = tcfg.RxBufSize
 	}
 	if cfg.TxBufSize == 0 {
-		cfg.TxBufSize = defaultSocketSize
+		cfg.TxBufSize = tcfg.TxBufSize
 	}
-	buf := make([]byte, cfg.RxBufSize+cfg.TxBufSize)
-	sock := makeTCPConn(stack, buf[:cfg.TxBufSize], buf[cfg.TxBufSize:cfg.TxBufSize+cfg.RxBufSize])
+	buf := make([]byte, int(cfg.RxBufSize)+int(cfg.TxBufSize))
+	sock := makeTCPConn(stack, buf[:cfg.TxBufSize], buf[cfg.TxBufSize:])
+	sock.applyTCPConfig(tcfg)
+	err := sock.SetPacing(cfg.PacingRate, cfg.PacingMinGap)
+	if err != nil {
+		return nil, err
+	}
+	sock.interactive = cfg.Interactive
+	sock.rxq.pkts = stack.pool.makeRxQueue(int(cfg.RxQueueLen), stack.maxMTU)
 	sock.trace("NewTCPConn:end")
 	return &sock, nil
 }
 
 func makeTCPConn(stack *PortStack, tx, rx []byte) TCPConn {
-	return TCPConn{
+	sock := TCPConn{
 		stack: stack,
 		tx:    ring{buf: tx},
 		rx:    ring{buf: rx},
+		pkt:   TCPPacket{data: make([]byte, sizeTCPOptsBuf)},
 	}
+	sock.applyTCPConfig(stack.tcpcfg)
+	return sock
 }
 
 // PortStack returns the PortStack that this socket is attached to.
@@ -112,6 +194,10 @@ func (sock *TCPConn) FlushOutputBuffer() error {
 }
 
 // Write writes argument data to the socket's output buffer which is queued to be sent.
+// Data larger than the free space in the buffer is queued in parts as the
+// remote acknowledges sent data. If the write deadline expires or the
+// connection is closed before all of b is queued, the amount of octets
+// queued is returned along with the error.
 func (sock *TCPConn) Write(b []byte) (n int, _ error) {
 	err := sock.checkPipeOpen()
 	if err != nil {
@@ -125,7 +211,7 @@ func (sock *TCPConn) Write(b []byte) (n int, _ error) {
 	if len(b) == 0 {
 		return 0, nil
 	}
-	err = sock.stack.FlagPendingTCP(sock.localPort)
+	err = sock.stack.RequestSendTCP(sock.localPort)
 	if err != nil {
 		return 0, err
 	}
@@ -137,7 +223,8 @@ func (sock *TCPConn) Write(b []byte) (n int, _ error) {
 		} else if connid != sock.connid {
 			return n, net.ErrClosed
 		}
-		ngot, _ := sock.tx.Write(b)
+		// Ring writes are all or nothing so write what fits to allow writes larger than the buffer.
+		ngot, _ := sock.tx.Write(b[:min(len(b), sock.tx.Free())])
 		n += ngot
 		b = b[ngot:]
 		if n == plen {
@@ -153,18 +240,61 @@ func (sock *TCPConn) Write(b []byte) (n int, _ error) {
 		if sock.deadlineExceeded(sock.wdead) {
 			return n, os.ErrDeadlineExceeded
 		}
-		err = sock.stack.FlagPendingTCP(sock.localPort)
+		err = sock.stack.RequestSendTCP(sock.localPort)
 		if err != nil {
 			return n, err
 		}
 	}
 }
 
+// ReadFrom reads data from r until EOF or error and queues it to be sent.
+// Data is read directly into the socket's output buffer, avoiding the
+// intermediate buffer and copy of a Read and Write loop, which suits serving
+// large files or firmware images from flash filesystems. It implements
+// [io.ReaderFrom] and is used by [io.Copy]. Like Write, ReadFrom blocks
+// while the output buffer is full and honors the write deadline.
+func (sock *TCPConn) ReadFrom(r io.Reader) (n int64, err error) {
+	err = sock.checkPipeOpen()
+	if err != nil {
+		return 0, err
+	}
+	sock.trace("TCPConn.ReadFrom:start")
+	connid := sock.connid
+	backoff := internal.NewBackoff(internal.BackoffHasPriority)
+	for {
+		if sock.abortErr != nil {
+			return n, sock.abortErr
+		} else if connid != sock.connid {
+			return n, net.ErrClosed
+		} else if sock.deadlineExceeded(sock.wdead) {
+			return n, os.ErrDeadlineExceeded
+		}
+		if sock.tx.Free() == 0 {
+			backoff.Miss()
+			continue
+		}
+		ngot, err := sock.tx.readFrom(r)
+		n += int64(ngot)
+		if ngot > 0 {
+			backoff.Hit()
+			if rerr := sock.stack.RequestSendTCP(sock.localPort); rerr != nil {
+				return n, rerr
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
+
 // Read reads data from the socket's input buffer. If the buffer is empty,
-// Read will block until data is available.
+// Read will block until data is available. Data received before the remote
+// closed the connection can still be read.
 func (sock *TCPConn) Read(b []byte) (int, error) {
 	err := sock.checkPipeOpen()
-	if err != nil {
+	if err != nil && (sock.closing || sock.abortErr != nil || sock.rx.Buffered() == 0) {
 		return 0, err
 	}
 	sock.trace("TCPConn.Read:start")
@@ -182,16 +312,74 @@ func (sock *TCPConn) Read(b []byte) (int, error) {
 		backoff.Miss()
 	}
 	n, err := sock.rx.Read(b)
+	if n > 0 {
+		sock.onread()
+	}
 	return n, err
 }
 
+// WriteTo writes received data to w until the remote closes the connection
+// or an error occurs. Data is written directly from the socket's input buffer
+// in chunks of at most one segment's size. Buffer space, and with it the
+// receive window advertised to the remote, is freed only as w accepts data
+// so a slow writer such as flash or SD storage throttles the remote.
+// It implements [io.WriterTo] and is used by [io.Copy].
+func (sock *TCPConn) WriteTo(w io.Writer) (n int64, err error) {
+	err = sock.checkPipeOpen()
+	if err != nil && (sock.closing || sock.abortErr != nil || sock.rx.Buffered() == 0) {
+		return 0, err
+	}
+	sock.trace("TCPConn.WriteTo:start")
+	connid := sock.connid
+	mss := int(sock.stack.mtu) - sizeTCPNoOptions
+	backoff := internal.NewBackoff(internal.BackoffHasPriority)
+	for {
+		if sock.rx.Buffered() == 0 {
+			if sock.abortErr != nil {
+				return n, sock.abortErr
+			} else if sock.State() != seqs.StateEstablished {
+				return n, nil // Remote closed the connection.
+			} else if connid != sock.connid {
+				return n, net.ErrClosed
+			} else if sock.deadlineExceeded(sock.rdead) {
+				return n, os.ErrDeadlineExceeded
+			}
+			backoff.Miss()
+			continue
+		}
+		ngot, err := sock.rx.writeTo(w, mss)
+		n += int64(ngot)
+		if err != nil {
+			return n, err
+		} else if ngot == 0 {
+			return n, io.ErrShortWrite
+		}
+		sock.onread()
+		backoff.Hit()
+	}
+}
+
 // BufferedInput returns the number of bytes in the socket's input buffer.
 func (sock *TCPConn) BufferedInput() int { return sock.rx.Buffered() }
 
+// BufferedOutput returns the number of bytes in the socket's output buffer yet to be sent.
+// Sent data is held in the buffer until acknowledged by the remote and is not counted.
+func (sock *TCPConn) BufferedOutput() int { return sock.tx.Buffered() - sock.retx.unacked }
+
+// AvailableOutput returns the number of bytes that may be written to the
+// socket's output buffer without blocking.
+func (sock *TCPConn) AvailableOutput() int { return sock.tx.Free() }
+
+func (sock *TCPConn) bufferedBytes() int { return sock.rx.Buffered() + sock.tx.Buffered() }
+
 // LocalAddr implements [net.Conn] interface.
 func (sock *TCPConn) LocalAddr() net.Addr {
+	ip := sock.stack.ip[:]
+	if sock.localIP != [4]byte{} {
+		ip = sock.localIP[:]
+	}
 	sock.laddr = net.TCPAddr{
-		IP:   sock.stack.ip[:],
+		IP:   ip,
 		Port: int(sock.localPort),
 	}
 	return &sock.laddr
@@ -209,6 +397,7 @@ func (sock *TCPConn) RemoteAddr() net.Addr {
 // SetDeadline sets the read and write deadlines associated
 // with the connection. It is equivalent to calling both
 // SetReadDeadline and SetWriteDeadline. Implements [net.Conn].
+// Deadlines are compared against the stack's clock, see [PortStackConfig.Clock].
 func (sock *TCPConn) SetDeadline(t time.Time) error {
 	err := sock.SetReadDeadline(t)
 	if err != nil {
@@ -243,12 +432,25 @@ func (sock *TCPConn) SetWriteDeadline(t time.Time) error {
 }
 
 func (sock *TCPConn) deadlineExceeded(dead time.Time) bool {
-	return !dead.IsZero() && time.Since(dead) > 0
+	return deadlineExceeded(sock.stack, dead)
 }
 
 // OpenDialTCP opens an active TCP connection to the given remote address.
+// If localPort is zero a free port is chosen from the ephemeral range, see
+// [TCPConn.LocalPort]. See [DialTCP] for a call that blocks until the
+// connection is established.
 func (sock *TCPConn) OpenDialTCP(localPort uint16, remoteMAC [6]byte, remote netip.AddrPort, iss seqs.Value) error {
 	sock.trace("TCPConn.OpenDialTCP:start")
+	if !remote.Addr().Is4() {
+		return errIPVersion // TCP is only carried over IPv4.
+	}
+	if localPort == 0 {
+		var err error
+		localPort, err = sock.stack.ephemeralPort(true)
+		if err != nil {
+			return err
+		}
+	}
 	return sock.openstack(seqs.StateSynSent, localPort, iss, remoteMAC, remote)
 }
 
@@ -265,7 +467,7 @@ func (sock *TCPConn) openstack(state seqs.State, localPortNum uint16, iss seqs.V
 		return err
 	}
 	if state == seqs.StateSynSent {
-		err = sock.stack.FlagPendingTCP(localPortNum)
+		err = sock.stack.RequestSendTCP(localPortNum)
 		if err != nil {
 			sock.stack.CloseTCP(localPortNum)
 			return err
@@ -284,11 +486,26 @@ func (sock *TCPConn) open(state seqs.State, localPortNum uint16, iss seqs.Value,
 		return err
 	}
 	sock.scb.SetLogger(sock.stack.logger)
+	sock.setLocalOptions()
 	sock.remoteMAC = remoteMAC
 	sock.remote = remoteAddr
 	sock.localPort = localPortNum
+	sock.localIP = [4]byte{}
+	sock.opened = sock.stack.now()
+	sock.connect = tcpConnect{}
 	sock.rx.Reset()
 	sock.tx.Reset()
+	sock.retx.reset()
+	sock.pathMTU = 0
+	sock.push = 0
+	sock.peer = PeerIdentity{}
+	sock.ts = tcpTimestamps{}
+	if sock.tcfg.Timestamps {
+		sock.ts.offset = sock.stack.rand32()
+	}
+	if remoteAddr.IsValid() {
+		sock.applyDestination()
+	}
 	if state == seqs.StateSynSent {
 		err = sock.scb.Send(sock.synsentSegment())
 	}
@@ -298,8 +515,11 @@ func (sock *TCPConn) open(state seqs.State, localPortNum uint16, iss seqs.Value,
 	return err
 }
 
+// Close closes the connection gracefully: buffered data is sent followed by a
+// FIN and the connection is torn down by the TCP state machine as the remote
+// acknowledges. Use [TCPConn.Abort] to close the connection immediately.
 func (sock *TCPConn) Close() error {
-	toSend := sock.tx.Buffered()
+	toSend := sock.BufferedOutput()
 	if toSend == 0 {
 		err := sock.scb.Close()
 		if err != nil {
@@ -311,12 +531,58 @@ func (sock *TCPConn) Close() error {
 		}
 	}
 	sock.closing = true
-	sock.stack.FlagPendingTCP(sock.localPort)
+	sock.stack.RequestSendTCP(sock.localPort)
+	return nil
+}
+
+// Abort closes the connection immediately discarding buffered data. If the
+// connection is synchronized a RST is sent to the remote as specified by
+// RFC 9293 section 3.10.5. Blocked and future Read and Write calls return an error.
+// The socket is released for reuse on the following HandleEth call.
+func (sock *TCPConn) Abort() error {
+	state := sock.scb.State()
+	if sock.localPort == 0 || state == seqs.StateClosed {
+		return net.ErrClosed
+	}
+	sock.queueAbortRST(state)
+	sock.info("TCPConn.Abort", slog.Uint64("lport", uint64(sock.localPort)), slog.String("state", state.String()))
+	sock.abortErr = errConnAborted
+	sock.aborting = true
+	sock.stack.RequestSendTCP(sock.localPort)
 	return nil
 }
 
+// Reset closes the connection immediately like [TCPConn.Abort] but releases
+// the socket's port without waiting for HandleEth, returning the socket to its
+// initial state so it may be reopened right away. Reset on a closed socket does nothing.
+func (sock *TCPConn) Reset() {
+	if sock.localPort == 0 {
+		return
+	}
+	state := sock.scb.State()
+	sock.queueAbortRST(state)
+	sock.info("TCPConn.Reset", slog.Uint64("lport", uint64(sock.localPort)), slog.String("state", state.String()))
+	port := findPort(sock.stack.portsTCP, sock.localPort)
+	if port != nil && port.handler == sock {
+		port.Close() // Aborts the socket.
+	} else {
+		sock.abort()
+	}
+}
+
+// queueAbortRST queues the RST telling the remote the connection in state is
+// aborted. RFC 9293 3.10.5: Only SYN-RECEIVED, ESTABLISHED, FIN-WAIT and
+// CLOSE-WAIT connections are reset on ABORT.
+func (sock *TCPConn) queueAbortRST(state seqs.State) {
+	switch state {
+	case seqs.StateSynRcvd, seqs.StateEstablished, seqs.StateFinWait1, seqs.StateFinWait2, seqs.StateCloseWait:
+		sock.stack.rst.queueAbort(sock)
+		sock.stack.applyFingerprint(&sock.stack.rst.ip)
+	}
+}
+
 func (sock *TCPConn) isPendingHandling() bool {
-	return sock.scb.HasPending() || sock.mustSendSyn() || sock.tx.Buffered() > 0 || sock.closing
+	return sock.scb.HasPending() || sock.mustSendSyn() || sock.rxq.sackPending || sock.ts.ackPending || sock.BufferedOutput() > 0 || sock.retx.running() || sock.closing || sock.aborting || !sock.timeWaitEnd.IsZero() || (sock.keepaliveEnabled() && sock.keepaliveDue(sock.stack.now()))
 }
 
 // checkPipeOpen checks if user data can be sent over the socket.
@@ -332,9 +598,26 @@ func (sock *TCPConn) checkPipeOpen() error {
 }
 
 func (sock *TCPConn) recv(pkt *TCPPacket) (err error) {
+	err = sock.recvSegment(pkt)
+	if (err == nil || err == ErrFlagPending) && sock.rxq.n > 0 {
+		if derr := sock.drainAhead(); derr != nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+// recvSegment processes a single received segment.
+func (sock *TCPConn) recvSegment(pkt *TCPPacket) (err error) {
 	sock.trace("TCPConn.recv:start")
 	prevState := sock.scb.State()
-	if prevState.IsClosed() {
+	if prevState == seqs.StateTimeWait && !sock.timeWaitEnd.IsZero() {
+		if pkt.TCP.Flags().HasAny(seqs.FlagFIN) {
+			// Retransmitted FIN, our final ACK was lost. It is acknowledged
+			// again by the control block and TIME_WAIT restarts.
+			sock.timeWaitEnd = sock.stack.now().Add(2 * sock.tcfg.MSL)
+		}
+	} else if prevState.IsClosed() {
 		return io.EOF
 	}
 
@@ -342,15 +625,45 @@ func (sock *TCPConn) recv(pkt *TCPPacket) (err error) {
 	if remotePort != 0 && pkt.TCP.SourcePort != remotePort {
 		return nil // This packet came from a different client to the one we are interacting with.
 	}
-	sock.lastRx = pkt.Rx
 	// By this point we know that the packet is valid and contains data, we process it.
 	payload := pkt.Payload()
 	segIncoming := pkt.TCP.Segment(len(payload))
+	if !sock.recvOptions(pkt, &segIncoming) || !sock.recvTimestamps(pkt, segIncoming) {
+		return nil
+	}
+	if prevState == seqs.StateListen && segIncoming.Flags.HasAny(seqs.FlagSYN) && sock.stack.tcpMemExhausted() {
+		if !segIncoming.Flags.HasAny(seqs.FlagACK | seqs.FlagRST | seqs.FlagFIN) {
+			sock.stack.refuseTCP(pkt) // Only new connection attempts are refused, others dropped.
+		}
+		return nil
+	}
+	sock.lastRx = pkt.Rx
+	sock.flow.onrecv(int(pkt.IP.TotalLength))
+	sock.rates.rx.add(pkt.Rx, len(payload))
+	sock.ka.probes = 0
+	sock.persist.unanswered = 0
 	if sock.scb.IncomingIsKeepalive(segIncoming) {
 		sock.trace("TCPConn.recv:keepalive")
+		// Keepalives fall left of the receive window so the control block
+		// drops them as old duplicates and schedules the ACK answering the probe.
+		sock.scb.Recv(segIncoming)
+		sock.traceActivity(ActivityRecv, &pkt.TCP, len(payload), prevState)
+		return sock.stateCheck()
+	}
+	if prevState.IsSynchronized() {
+		// Window advertised on our last send is consumed by data received since.
+		sock.scb.SetRecvWindow(seqs.Size(sock.rx.Free()))
+	}
+	if sock.queueAhead(pkt, segIncoming) {
 		return nil
 	}
+	if segIncoming.Flags.HasAny(seqs.FlagACK) {
+		// Duplicate ACKs carry SACK blocks but are dropped by the control block.
+		sock.recvSACK(pkt.TCPOptions())
+	}
+	prevUNA := sock.scb.SendUnacked()
 	err = sock.scb.Recv(segIncoming)
+	sock.traceActivity(ActivityRecv, &pkt.TCP, len(payload), prevState)
 	if err != nil {
 		if sock.scb.State() == seqs.StateClosed {
 			sock.info("TCP:rx-abort")
@@ -359,8 +672,12 @@ func (sock *TCPConn) recv(pkt *TCPPacket) (err error) {
 		}
 		return nil // Segment not admitted, yield to sender.
 	}
+	sock.onack(prevUNA, pkt.Rx)
 	if prevState != sock.scb.State() {
 		sock.info("TCP:rx-statechange", slog.Uint64("port", uint64(sock.localPort)), slog.String("old", prevState.String()), slog.String("new", sock.scb.State().String()), slog.String("rxflags", segIncoming.Flags.String()))
+		if prevState == seqs.StateSynSent && sock.scb.State() == seqs.StateEstablished {
+			sock.onestablished(pkt.Rx)
+		}
 	}
 	if segIncoming.DATALEN > 0 {
 		if len(payload) != int(segIncoming.DATALEN) {
@@ -370,11 +687,17 @@ func (sock *TCPConn) recv(pkt *TCPPacket) (err error) {
 		if err != nil {
 			return err
 		}
+		sock.delack.onrecv(pkt.Rx)
 	}
 	if segIncoming.Flags.HasAny(seqs.FlagSYN) && !sock.remote.IsValid() {
 		// We have a client that wants to connect to us.
 		sock.remoteMAC = pkt.Eth.Source
 		sock.remote = netip.AddrPortFrom(netip.AddrFrom4(pkt.IP.Source), pkt.TCP.SourcePort)
+		sock.opened = pkt.Rx
+		if pkt.IP.Destination != sock.stack.ip && sock.stack.isLocalAddr(pkt.IP.Destination) {
+			sock.localIP = pkt.IP.Destination
+		}
+		sock.applyDestination()
 	}
 	err = sock.stateCheck()
 	return err
@@ -382,9 +705,24 @@ func (sock *TCPConn) recv(pkt *TCPPacket) (err error) {
 
 func (sock *TCPConn) send(response []byte) (n int, err error) {
 	defer sock.trace("TCPConn.send:start")
+	if sock.aborting {
+		return 0, io.EOF // Release socket; the RST is sent by the stack.
+	}
 	if !sock.remote.IsValid() {
 		return 0, nil // No remote address yet, yield.
 	}
+	if sock.remoteMAC == [6]byte{} {
+		// Segments wait until the remote is resolved. See arpcache.go.
+		hw, err := sock.stack.arpClient.resolve(sock.remote.Addr().As4())
+		if err == errARPResponsePending {
+			return 0, ErrFlagPending
+		} else if err != nil {
+			sock.logerr("TCP:abort-unresolved", slog.Uint64("port", uint64(sock.localPort)), slog.String("err", err.Error()))
+			sock.abortErr = err
+			return 0, io.EOF
+		}
+		sock.remoteMAC = hw
+	}
 	if sock.awaitingSyn() {
 		// Connection is still preestablished, we need to establish
 		if sock.mustSendSyn() {
@@ -395,15 +733,52 @@ func (sock *TCPConn) send(response []byte) (n int, err error) {
 	}
 
 	// Advertise our receive window as the amount of space available in our receive buffer.
-	sock.scb.SetRecvWindow(seqs.Size(sock.rx.Free()))
-
-	available := min(sock.tx.Buffered(), len(response)-sizeTCPNoOptions)
+	// If the stack ran out of buffer memory we advertise a zero window until it is freed.
+	wnd := seqs.Size(sock.rx.Free())
+	if sock.stack.tcpMemExhausted() {
+		wnd = 0
+	}
+	sock.scb.SetRecvWindow(wnd)
+
+	reserve := sock.optionsReserve()
+	now := sock.stack.now()
+	if sock.rxq.sackPending || sock.ts.ackPending {
+		return sock.sendSACK(response), nil
+	} else if sock.retx.expired(now) || sock.retx.pmtuDue(sock.scb.SendUnacked()) {
+		return sock.retransmit(response, reserve)
+	} else if sock.retx.sack.recovering {
+		if n := sock.retransmitHole(response, reserve); n > 0 {
+			return n, ErrFlagPending
+		}
+	}
+	maxPayload := sock.maxPayload(len(response), reserve)
+	available := min(sock.BufferedOutput(), maxPayload)
+	if sock.nagleHold(available, maxPayload) {
+		available = 0 // Coalesce small writes until outstanding data is acknowledged.
+	}
+	paced := available > 0 && !sock.pacer.ready(now)
+	if paced {
+		available = 0 // Only control segments may be sent until pacer allows more data.
+	}
 	seg, ok := sock.scb.PendingSegment(available)
 	if !ok {
+		if paced {
+			return 0, ErrFlagPending
+		} else if sock.keepaliveDue(now) {
+			return sock.sendKeepalive(response, reserve, now)
+		} else if sock.persistDue(now) {
+			return sock.sendProbe(response, reserve, now)
+		} else if sock.windowUpdateDue(wnd) {
+			return sock.sendWindowUpdate(response, reserve), nil
+		}
 		// No pending control segment or data to send. Yield to handleUser.
+		sock.armKeepalive()
 		return 0, sock.stateCheck()
 	}
 
+	if sock.delack.hold(seg, sock.ackDelay(), now) {
+		return 0, ErrFlagPending // Wait for more data or for the delay to expire.
+	}
 	prevState := sock.scb.State()
 	err = sock.scb.Send(seg)
 	if err != nil {
@@ -413,26 +788,43 @@ func (sock *TCPConn) send(response []byte) (n int, err error) {
 	// If we have user data to send we send it, else we send the control segment.
 	var payload []byte
 	if available > 0 {
-		payload = response[sizeTCPNoOptions : sizeTCPNoOptions+seg.DATALEN]
-		n, err = sock.tx.Read(payload)
-		if err != nil && err != io.EOF || n != int(seg.DATALEN) {
+		payload = response[sizeTCPNoOptions+reserve : sizeTCPNoOptions+reserve+int(seg.DATALEN)]
+		n = sock.tx.peek(payload, sock.retx.unacked)
+		if n != int(seg.DATALEN) {
 			panic("bug in handleUser") // This is a bug in ring buffer or a race condition.
 		}
+		sock.retx.unacked += n
+		sock.onpush(n)
 	}
-	sock.setSrcDest(&sock.pkt)
-	sock.pkt.CalculateHeaders(seg, payload)
-	sock.pkt.PutHeaders(response)
+	nframe := sock.putSegment(response, seg, payload, reserve)
 	if prevState != sock.scb.State() {
 		sock.info("TCP:tx-statechange", slog.Uint64("port", uint64(sock.localPort)), slog.String("old", prevState.String()), slog.String("new", sock.scb.State().String()), slog.String("txflags", seg.Flags.String()))
 	}
 	err = sock.stateCheck()
-	sock.onsend(response[:sizeTCPNoOptions+n])
-	return sizeTCPNoOptions + n, err
+	if n > 0 {
+		sock.pacer.onsend(now, sizeTCPNoOptions+n)
+	}
+	if paced && err == nil {
+		err = ErrFlagPending
+	}
+	sock.onsend(response[:nframe], prevState)
+	if seg.LEN() > 0 {
+		sock.retx.onsend(sock.lastTx, seqs.Add(seg.SEQ, seg.LEN()))
+	}
+	return nframe, err
+}
+
+// localAddr returns the source IPv4 address of the connection's segments.
+func (sock *TCPConn) localAddr() [4]byte {
+	if sock.localIP != [4]byte{} {
+		return sock.localIP
+	}
+	return sock.stack.ip
 }
 
 func (sock *TCPConn) setSrcDest(pkt *TCPPacket) {
 	pkt.Eth.Source = sock.stack.HardwareAddr6()
-	pkt.IP.Source = sock.stack.ip
+	pkt.IP.Source = sock.localAddr()
 	pkt.TCP.SourcePort = sock.localPort
 
 	pkt.IP.Destination = sock.remote.Addr().As4()
@@ -442,11 +834,12 @@ func (sock *TCPConn) setSrcDest(pkt *TCPPacket) {
 
 func (sock *TCPConn) handleInitSyn(response []byte) (n int, err error) {
 	// Uninitialized TCB, we start the handshake.
-	sock.setSrcDest(&sock.pkt)
-	sock.pkt.CalculateHeaders(sock.synsentSegment(), nil)
-	sock.pkt.PutHeaders(response)
-	sock.onsend(response[:sizeTCPNoOptions])
-	return sizeTCPNoOptions, nil
+	if err := sock.onsyn(sock.stack.now()); err != nil {
+		return 0, err
+	}
+	n = sock.putSegment(response, sock.synsentSegment(), nil, sock.optionsReserve())
+	sock.onsend(response[:n], sock.scb.State())
+	return n, ErrFlagPending // Keep polling to resend the SYN if unanswered.
 }
 
 func (sock *TCPConn) awaitingSyn() bool {
@@ -454,24 +847,46 @@ func (sock *TCPConn) awaitingSyn() bool {
 }
 
 func (sock *TCPConn) mustSendSyn() bool {
-	// lastTx is zero-valued on init, so this will trigger on t=0 and every 3 seconds.
-	return sock.awaitingSyn() && time.Since(sock.lastTx) > 3*time.Second
+	// lastTx is zero-valued on init, so this will trigger on t=0 and every SYN interval.
+	if !sock.awaitingSyn() {
+		return false
+	}
+	now := sock.stack.now()
+	return now.Sub(sock.lastTx) > sock.synInterval() || sock.connectExpired(now)
 }
 
-func (sock *TCPConn) onsend(b []byte) {
+// onsend is called with the frame of every segment sent by the connection,
+// which was in state prev before the segment was sent.
+func (sock *TCPConn) onsend(b []byte, prev seqs.State) {
 	if len(b) > 0 {
 		sock.lastTx = sock.stack.now()
+		sock.rcvEdge = seqs.Add(sock.scb.RecvNext(), sock.scb.RecvWindow())
+		sock.ts.lastACK = sock.pkt.TCP.Ack
+		sock.flow.onsend(len(b) - eth.SizeEthernetHeader)
+		sock.delack = tcpDelayedACK{} // Every segment sent acknowledges received data.
+		datalen := int(sock.pkt.IP.TotalLength) - sock.pkt.IP.HeaderLength() - int(sock.pkt.TCP.OffsetInBytes())
+		sock.rates.tx.add(sock.lastTx, datalen)
+		sock.traceActivity(ActivitySend, &sock.pkt.TCP, datalen, prev)
 	}
 }
 
 func (sock *TCPConn) deleteState() {
 	sock.trace("TCPConn.deleteState", slog.Uint64("port", uint64(sock.localPort)))
+	sock.releaseAhead()
+	tcfg := sock.tcfg
 	*sock = TCPConn{
-		stack:  sock.stack,
-		rx:     ring{buf: sock.rx.buf},
-		tx:     ring{buf: sock.tx.buf},
-		connid: sock.connid + 1,
+		stack:       sock.stack,
+		pkt:         TCPPacket{data: sock.pkt.data},
+		rx:          ring{buf: sock.rx.buf},
+		tx:          ring{buf: sock.tx.buf},
+		connid:      sock.connid + 1,
+		pacer:       tcpPacer{rate: sock.pacer.rate, gap: sock.pacer.gap},
+		interactive: sock.interactive,
+		quickack:    sock.quickack,
+		connect:     sock.connect,
+		rxq:         tcpRxQueue{pkts: sock.rxq.pkts},
 	}
+	sock.applyTCPConfig(tcfg)
 }
 
 func (sock *TCPConn) synsentSegment() seqs.Segment {
@@ -485,7 +900,7 @@ func (sock *TCPConn) synsentSegment() seqs.Segment {
 
 func (sock *TCPConn) stateCheck() (portStackErr error) {
 	state := sock.State()
-	txEmpty := sock.tx.Buffered() == 0
+	txEmpty := sock.BufferedOutput() == 0
 	// Close checks:
 	if sock.closing {
 		if txEmpty && sock.scb.State() == seqs.StateEstablished { // Get RAW state of SCB.
@@ -494,7 +909,7 @@ func (sock *TCPConn) stateCheck() (portStackErr error) {
 		} else {
 			now := sock.stack.now()
 			elapsed := now.Sub(sock.lastTx)
-			if elapsed > 3*time.Second {
+			if elapsed > sock.tcfg.CloseTimeout {
 				sock.logerr("TCP:idleabort", slog.Duration("elapsed", elapsed))
 				return io.EOF // Abort connection- no response from remote.
 			}
@@ -504,6 +919,8 @@ func (sock *TCPConn) stateCheck() (portStackErr error) {
 	if sock.scb.HasPending() {
 		sock.trace("TCPConn.stateCheck:hasPending")
 		portStackErr = ErrFlagPending // Flag to PortStack that we have pending data to send.
+	} else if state == seqs.StateTimeWait && sock.lingerTimeWait() {
+		portStackErr = ErrFlagPending // Hold the port until TIME_WAIT ends.
 	} else if state.IsClosed() {
 		sock.trace("TCPConn.stateCheck:closed")
 		portStackErr = io.EOF // On EOF portStack will abort the connection.
@@ -511,10 +928,27 @@ func (sock *TCPConn) stateCheck() (portStackErr error) {
 	return portStackErr
 }
 
+// lingerTimeWait reports whether the connection remains in TIME_WAIT, starting
+// the 2*MSL timer on the first call. See [TCPConfig.MSL].
+func (sock *TCPConn) lingerTimeWait() bool {
+	if sock.tcfg.MSL <= 0 {
+		return false
+	}
+	now := sock.stack.now()
+	if sock.timeWaitEnd.IsZero() {
+		sock.timeWaitEnd = now.Add(2 * sock.tcfg.MSL)
+		sock.debug("TCP:time-wait", slog.Uint64("port", uint64(sock.localPort)), slog.Time("until", sock.timeWaitEnd))
+	}
+	return now.Before(sock.timeWaitEnd)
+}
+
 // abort is called by the PortStack when the port is closed. This happens
 // on EOF returned by Handle/RecvEth. See TCPSocket.stateCheck for information on when
 // a connection is aborted.
 func (sock *TCPConn) abort() {
+	sock.saveDestination()
+	sock.flow.start = sock.opened
+	sock.stack.endFlow(&sock.flow, 6, sock.localAddr(), sock.localPort, sock.remote)
 	sock.deleteState()
 }
 
@@ -0,0 +1,79 @@
+package stacks
+
+import (
+	"io"
+	"log/slog"
+	"time"
+)
+
+var errSynTimeout error = timeoutError("connection timed out: SYN unanswered")
+
+// tcpConnect tracks the handshake of a connection being dialed. It outlives
+// the connection's state so that the metrics of a failed dial can be read.
+type tcpConnect struct {
+	// firstSyn is the time the first SYN was sent. Zero until then.
+	firstSyn time.Time
+	// retries is the amount of SYN retransmissions.
+	retries uint8
+	// elapsed is the time from the first SYN to ESTABLISHED.
+	elapsed time.Duration
+	// timedOut is set when the dial was aborted after SynRetries retransmissions.
+	timedOut bool
+}
+
+// synInterval returns the time to wait for an answer to the last SYN sent.
+func (sock *TCPConn) synInterval() time.Duration {
+	interval := sock.tcfg.SynInterval
+	if !sock.tcfg.SynBackoff {
+		return interval
+	}
+	for i := uint8(0); i < sock.connect.retries && interval < sock.tcfg.MaxRTO; i++ {
+		interval *= 2
+	}
+	if interval > sock.tcfg.MaxRTO {
+		interval = sock.tcfg.MaxRTO
+	}
+	return interval
+}
+
+// onsyn is called before a SYN is sent while dialing. It returns io.EOF
+// if the configured amount of SYN retransmissions went unanswered.
+func (sock *TCPConn) onsyn(now time.Time) error {
+	c := &sock.connect
+	if c.firstSyn.IsZero() {
+		c.firstSyn = now
+		return nil
+	}
+	if sock.tcfg.SynRetries != 0 && c.retries >= sock.tcfg.SynRetries || sock.connectExpired(now) {
+		sock.logerr("TCP:syn-timeout", slog.Uint64("port", uint64(sock.localPort)), slog.Int("retries", int(c.retries)))
+		c.timedOut = true
+		sock.abortErr = errSynTimeout
+		sock.stack.stats.TCPConnectTimeouts++
+		return io.EOF
+	}
+	c.retries++
+	sock.stack.stats.TCPSynRetransmits++
+	return nil
+}
+
+// connectExpired reports whether the connection being dialed exceeded
+// [TCPConfig.ConnectTimeout] at now.
+func (sock *TCPConn) connectExpired(now time.Time) bool {
+	c := &sock.connect
+	return sock.tcfg.ConnectTimeout > 0 && !c.firstSyn.IsZero() && now.Sub(c.firstSyn) >= sock.tcfg.ConnectTimeout
+}
+
+// onestablished records the connect time of a dialed connection.
+func (sock *TCPConn) onestablished(now time.Time) {
+	if !sock.connect.firstSyn.IsZero() {
+		sock.connect.elapsed = now.Sub(sock.connect.firstSyn)
+	}
+}
+
+// SynRetries returns the amount of times the SYN of the last connection
+// dialed was retransmitted before it was answered or the dial failed.
+func (sock *TCPConn) SynRetries() int { return int(sock.connect.retries) }
+
+// ConnectTime returns the time from the first SYN of the last connection
+// dialed until it was established. It is zero if it was not established.
+func (sock *TCPConn) ConnectTime() time.Duration { return sock.connect.elapsed }
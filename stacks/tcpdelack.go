@@ -0,0 +1,69 @@
+package stacks
+
+import (
+	"time"
+
+	"github.com/soypat/seqs"
+)
+
+// tcpDelayedACK tracks received data not yet acknowledged so that the
+// acknowledgement may be delayed as described in RFC 1122 section 4.2.3.2.
+type tcpDelayedACK struct {
+	// since is the time the oldest unacknowledged data was received.
+	since time.Time
+	// segs is the amount of data segments received since the last segment sent.
+	segs uint8
+}
+
+// onrecv registers the reception of a data segment at t.
+func (d *tcpDelayedACK) onrecv(t time.Time) {
+	if d.segs == 0 {
+		d.since = t
+	}
+	if d.segs < 255 {
+		d.segs++
+	}
+}
+
+// hold reports whether the pure acknowledgement seg should be delayed at now.
+// Every second data segment is acknowledged without delay.
+func (d *tcpDelayedACK) hold(seg seqs.Segment, delay time.Duration, now time.Time) bool {
+	return delay > 0 && seg.Flags == seqs.FlagACK && seg.DATALEN == 0 &&
+		d.segs == 1 && now.Sub(d.since) < delay
+}
+
+// nagleHold reports whether available bytes of data, less than a full segment
+// of size maxPayload, should be held back as per Nagle's algorithm (RFC 896).
+// Data pushed with [TCPConn.Flush] is never held.
+func (sock *TCPConn) nagleHold(available, maxPayload int) bool {
+	return sock.tcfg.Nagle && sock.push == 0 && sock.retx.unacked > 0 && available > 0 && available < maxPayload && !sock.closing
+}
+
+// SetNoDelay controls whether small writes are sent without waiting for
+// outstanding data to be acknowledged. Setting noDelay to false enables
+// Nagle's algorithm, coalescing small writes into fewer segments at the cost
+// of latency. It overrides [TCPConfig.Nagle] for the socket.
+func (sock *TCPConn) SetNoDelay(noDelay bool) {
+	sock.tcfg.Nagle = !noDelay
+	if sock.localPort != 0 {
+		sock.stack.RequestSendTCP(sock.localPort) // Held data may now be sent.
+	}
+}
+
+// SetQuickAck controls whether received data is acknowledged immediately
+// regardless of [TCPConfig.DelayedACK], for latency sensitive applications.
+// Like [TCPConn.SetInteractive] the setting is kept after the connection is closed.
+func (sock *TCPConn) SetQuickAck(quickAck bool) {
+	sock.quickack = quickAck
+	if sock.localPort != 0 {
+		sock.stack.RequestSendTCP(sock.localPort) // A delayed ACK may now be due.
+	}
+}
+
+// ackDelay returns the time acknowledgements of received data may be delayed.
+func (sock *TCPConn) ackDelay() time.Duration {
+	if sock.quickack {
+		return 0
+	}
+	return sock.tcfg.DelayedACK
+}
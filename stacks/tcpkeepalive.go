@@ -0,0 +1,75 @@
+package stacks
+
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/soypat/seqs"
+)
+
+var errKeepaliveTimeout error = timeoutError("keepalive probes unanswered")
+
+// tcpKeepalive is the state of keepalive probing of an idle connection as
+// described in RFC 1122 section 4.2.3.6.
+type tcpKeepalive struct {
+	// probes is the amount of probes sent since a segment was last received.
+	probes uint8
+	// last is the time the last probe was sent.
+	last time.Time
+}
+
+// keepaliveEnabled reports whether the connection is probed when idle.
+func (sock *TCPConn) keepaliveEnabled() bool {
+	return sock.tcfg.KeepaliveIdle > 0 && sock.scb.State() == seqs.StateEstablished
+}
+
+// keepaliveDue reports whether a keepalive probe should be sent at now.
+func (sock *TCPConn) keepaliveDue(now time.Time) bool {
+	if !sock.keepaliveEnabled() || sock.retx.running() || sock.BufferedOutput() > 0 {
+		return false
+	}
+	if sock.ka.probes == 0 {
+		return now.Sub(sock.lastRx) >= sock.tcfg.KeepaliveIdle
+	}
+	return now.Sub(sock.ka.last) >= sock.tcfg.KeepaliveInterval
+}
+
+// armKeepalive arms the stack to service the connection when its next
+// keepalive probe is due, as it is not pending handling until then.
+func (sock *TCPConn) armKeepalive() {
+	if !sock.keepaliveEnabled() {
+		return
+	}
+	due := sock.lastRx.Add(sock.tcfg.KeepaliveIdle)
+	if sock.ka.probes > 0 {
+		due = sock.ka.last.Add(sock.tcfg.KeepaliveInterval)
+	}
+	sock.stack.wakeTCPAt(due)
+}
+
+// sendKeepalive writes a keepalive probe to response or aborts the connection
+// if the configured amount of probes went unanswered.
+func (sock *TCPConn) sendKeepalive(response []byte, reserve int, now time.Time) (int, error) {
+	if sock.ka.probes >= sock.tcfg.KeepaliveProbes {
+		sock.logerr("TCP:keepalive-abort", slog.Uint64("port", uint64(sock.localPort)), slog.Int("probes", int(sock.ka.probes)))
+		sock.abortErr = errKeepaliveTimeout
+		return 0, io.EOF // Abort connection- remote unreachable.
+	}
+	seg := sock.scb.MakeKeepalive()
+	var payload []byte
+	if sock.tcfg.KeepaliveGarbage {
+		// The probe's sequence number is that of the last acknowledged octet,
+		// which the remote discards as an old duplicate.
+		payload = response[sizeTCPNoOptions+reserve : sizeTCPNoOptions+reserve+1]
+		payload[0] = 0
+		seg.DATALEN = 1
+	}
+	sock.ka.probes++
+	sock.ka.last = now
+	sock.armKeepalive() // Arm the next probe or the abort if unanswered.
+	sock.debug("TCP:keepalive", slog.Uint64("port", uint64(sock.localPort)), slog.Int("probe", int(sock.ka.probes)))
+	nframe := sock.putSegment(response, seg, payload, reserve)
+	sock.onsend(response[:nframe], sock.scb.State())
+	return nframe, nil
+}
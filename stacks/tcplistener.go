@@ -6,6 +6,8 @@ import (
 	"log/slog"
 	"net"
 	"net/netip"
+	"os"
+	"time"
 
 	"github.com/soypat/seqs"
 	"github.com/soypat/seqs/internal"
@@ -17,6 +19,28 @@ type TCPListenerConfig struct {
 	MaxConnections uint16
 	ConnTxBufSize  uint16
 	ConnRxBufSize  uint16
+	// ReuseAddr allows StartListening to take over a port held by a socket
+	// with no active connection, such as a connection of a previous server
+	// incarnation left in TIME_WAIT. Akin to SO_REUSEADDR.
+	ReuseAddr bool
+	// ConnRxQueueLen is the amount of out of order segments held by each connection. See [TCPConnConfig.RxQueueLen].
+	ConnRxQueueLen uint8
+	// Backlog is the maximum amount of connections being established or
+	// established and not yet accepted. Connection attempts beyond it are
+	// dropped so that remotes retry later. If zero MaxConnections is used.
+	Backlog uint16
+	// MaxHalfOpen is the maximum amount of connections in SYN-RECEIVED, which
+	// a flood of SYNs with spoofed source addresses would otherwise exhaust.
+	// When reached the oldest half-open connection is evicted to admit a new
+	// one, or a SYN cookie is sent if SYNCookies is set. If zero half-open
+	// connections are not evicted and attempts beyond Backlog are dropped.
+	MaxHalfOpen uint16
+	// SYNCookies answers connection attempts beyond MaxHalfOpen or the available
+	// connections with a SYN-ACK that encodes the connection in its sequence
+	// number, keeping no state until the remote completes the handshake.
+	// Connections established this way do not use window scaling, SACK nor
+	// timestamps. Not used if TCP MD5 signatures are enabled.
+	SYNCookies bool
 }
 
 type TCPListener struct {
@@ -27,7 +51,19 @@ type TCPListener struct {
 	port   uint16
 	connid uint8
 	open   bool
-	laddr  net.TCPAddr
+	reuse  bool
+	// backlog is the maximum amount of connections pending acceptance.
+	backlog uint16
+	// maxHalfOpen is the maximum amount of connections in SYN-RECEIVED. Zero disables eviction.
+	maxHalfOpen uint16
+	// cookies answers SYNs statelessly once half-open connections are exhausted. See syncookie.go.
+	cookies tcpSynCookies
+	laddr   net.TCPAddr
+	// lastSent is the index of the connection that sent the last segment.
+	// Connections are serviced round robin after it. See txdone.go.
+	lastSent int
+	// dead is the deadline of Accept calls. Zero if none.
+	dead time.Time
 }
 
 func NewTCPListener(stack *PortStack, cfg TCPListenerConfig) (*TCPListener, error) {
@@ -35,19 +71,35 @@ func NewTCPListener(stack *PortStack, cfg TCPListenerConfig) (*TCPListener, erro
 	if cfg.MaxConnections == 0 || (cfg.ConnRxBufSize < minBufSize && cfg.ConnTxBufSize < minBufSize) {
 		return nil, errors.New("bad TCPListenerConfig")
 	}
+	if cfg.Backlog == 0 || cfg.Backlog > cfg.MaxConnections {
+		cfg.Backlog = cfg.MaxConnections
+	}
+	if cfg.MaxHalfOpen > cfg.Backlog {
+		cfg.MaxHalfOpen = cfg.Backlog
+	}
 	l := &TCPListener{
-		stack: stack,
-		conns: make([]TCPConn, cfg.MaxConnections),
-		used:  make([]bool, cfg.MaxConnections),
+		stack:       stack,
+		conns:       make([]TCPConn, cfg.MaxConnections),
+		used:        make([]bool, cfg.MaxConnections),
+		reuse:       cfg.ReuseAddr,
+		backlog:     cfg.Backlog,
+		maxHalfOpen: cfg.MaxHalfOpen,
+	}
+	if cfg.SYNCookies {
+		l.cookies.enabled = true
+		l.cookies.syn.data = make([]byte, 4) // MSS option.
 	}
 	txlen := int(cfg.ConnTxBufSize)
 	rxlen := int(cfg.ConnRxBufSize)
 	buf := make([]byte, int(cfg.MaxConnections)*(txlen+rxlen))
+	qlen := int(cfg.ConnRxQueueLen)
+	queued := stack.pool.makeRxQueue(int(cfg.MaxConnections)*qlen, stack.maxMTU)
 	for i := range l.conns {
 		offset := i * (txlen + rxlen)
 		tx := buf[offset : offset+txlen]
 		rx := buf[offset+txlen : offset+txlen+rxlen]
 		l.conns[i] = makeTCPConn(stack, tx, rx)
+		l.conns[i].rxq.pkts = queued[i*qlen : (i+1)*qlen : (i+1)*qlen]
 	}
 	return l, nil
 }
@@ -55,6 +107,17 @@ func NewTCPListener(stack *PortStack, cfg TCPListenerConfig) (*TCPListener, erro
 // Accept waits for and returns the next connection to the listener.
 // It implements the [net.Listener] interface.
 func (l *TCPListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// AcceptTCP waits for and returns the next established connection to the
+// listener. Connections are served concurrently on the listener's port and
+// each remains owned by the listener: once closed it is reused for new connections.
+func (l *TCPListener) AcceptTCP() (*TCPConn, error) {
 	connid := l.connid
 	backoff := internal.NewBackoff(internal.BackoffCriticalPath)
 	for l.isOpen() && connid == l.connid {
@@ -66,21 +129,42 @@ func (l *TCPListener) Accept() (net.Conn, error) {
 			l.used[i] = true
 			return conn, nil
 		}
+		if deadlineExceeded(l.stack, l.dead) {
+			return nil, os.ErrDeadlineExceeded
+		}
 		backoff.Miss()
 	}
 	return nil, net.ErrClosed
 }
 
+// SetDeadline sets the deadline for future Accept calls and any
+// currently-blocked Accept call. A zero value for t means Accept will not
+// time out. Deadlines are compared against the stack's clock, see [PortStackConfig.Clock].
+func (l *TCPListener) SetDeadline(t time.Time) error {
+	if !l.isOpen() {
+		return net.ErrClosed
+	}
+	l.dead = t
+	return nil
+}
+
 func (l *TCPListener) StartListening(port uint16) error {
 	if l.isOpen() {
 		return errors.New("already listening")
 	}
+	if l.reuse && l.stack.tcpPortReusable(port) {
+		l.info("lst:reuseaddr", slog.Uint64("lport", uint64(port)))
+		l.stack.CloseTCP(port)
+	}
 	err := l.stack.OpenTCP(port, l)
 	if err != nil {
 		return err
 	}
 	l.port = port
 	l.open = true
+	if l.cookies.enabled {
+		l.cookies.rekey(l.stack)
+	}
 	for i := range l.conns {
 		l.freeConnForReuse(i)
 	}
@@ -88,7 +172,7 @@ func (l *TCPListener) StartListening(port uint16) error {
 }
 
 func (l *TCPListener) Close() error {
-	if l.isOpen() {
+	if !l.isOpen() {
 		return errors.New("already closed")
 	}
 	return l.stack.CloseTCP(l.port)
@@ -107,18 +191,26 @@ func (l *TCPListener) send(dst []byte) (n int, err error) {
 	if !l.isOpen() {
 		return 0, io.EOF
 	}
-	for i := range l.conns {
-		conn := &l.conns[i]
-		if conn.LocalPort() == 0 || !conn.isPendingHandling() {
-			continue
-		}
-		n, err = conn.send(dst)
-		if err == io.EOF {
-			l.freeConnForReuse(i)
-			err = nil
-		}
-		if n > 0 {
-			return n, err
+	if l.cookies.pending {
+		return l.cookies.put(dst), nil
+	}
+	// First pass services interactive connections only. See priority.go.
+	for pass := 0; pass < 2; pass++ {
+		for j := range l.conns {
+			i := (l.lastSent + 1 + j) % len(l.conns)
+			conn := &l.conns[i]
+			if conn.LocalPort() == 0 || !conn.isPendingHandling() || (pass == 0 && !conn.interactive) {
+				continue
+			}
+			n, err = conn.send(dst)
+			if err == io.EOF {
+				l.freeConnForReuse(i)
+				err = nil
+			}
+			if n > 0 {
+				l.lastSent = i
+				return n, err
+			}
 		}
 	}
 	l.trace("lst:noconn2snd")
@@ -129,43 +221,146 @@ func (l *TCPListener) recv(pkt *TCPPacket) error {
 	if !l.isOpen() {
 		return io.EOF
 	}
-	var freeconn *TCPConn
-	isSYN := pkt.TCP.Flags() == seqs.FlagSYN
-	var connidx int
-	for connidx = range l.conns {
+	// ECN-setup SYNs (RFC 3168) also set ECE and CWR.
+	flags := pkt.TCP.Flags()
+	isSYN := flags.HasAny(seqs.FlagSYN) && !flags.HasAny(seqs.FlagACK|seqs.FlagRST|seqs.FlagFIN)
+	connidx := l.connIndex(pkt)
+	if connidx >= 0 {
 		conn := &l.conns[connidx]
-		if pkt.TCP.Ack == 0 && isSYN && !l.used[connidx] && conn.State() == seqs.StateListen {
-			// Get first available connection in list for first SYN packet, initiating connection.
-			freeconn = conn
-			break
+		if !isSYN || conn.State() != seqs.StateTimeWait {
+			return l.recvConn(connidx, pkt)
 		}
-		if pkt.TCP.SourcePort != conn.remote.Port() ||
-			pkt.IP.Source != conn.remote.Addr().As4() {
-			continue // Not for this connection.
+		// RFC 1122 4.2.2.13: A new incarnation of the connection may be
+		// accepted from TIME_WAIT if its initial sequence number is greater
+		// than the last sequence number seen. Old duplicate SYNs are ignored.
+		if !seqs.LessThan(conn.scb.RecvNext(), pkt.TCP.Seq) {
+			return nil
 		}
-		err := conn.recv(pkt)
-		if err == io.EOF {
-			l.freeConnForReuse(connidx)
-			err = nil
+	} else if !isSYN {
+		if l.usesCookies() && pkt.TCP.Flags().HasAny(seqs.FlagACK) && !pkt.TCP.Flags().HasAny(seqs.FlagSYN|seqs.FlagRST) {
+			if ok, err := l.acceptCookie(pkt); ok {
+				return err
+			}
+		}
+		// Stray segment of a connection unknown to us, i.e: from before a reboot.
+		// RFC 9293 3.10.7.1: Reply with a RST so the remote discards the connection.
+		l.stack.refuseTCP(pkt)
+		return nil
+	} else if pkt.TCP.Ack == 0 {
+		connidx = l.freeConnIndex()
+		if connidx < 0 || l.halfOpenFull() {
+			if l.usesCookies() {
+				l.cookies.queue(l, pkt)
+				return nil
+			} else if l.maxHalfOpen > 0 {
+				connidx = l.evictHalfOpen()
+			}
 		}
-		return err
 	}
-	if freeconn == nil {
+	if connidx < 0 {
 		l.trace("lst:noconn2recv")
 		return ErrDroppedPacket // No available connection to receive packet.
+	} else if l.pendingAccept() >= int(l.backlog) {
+		l.trace("lst:backlog-full")
+		return ErrDroppedPacket
+	} else if l.stack.tcpMemExhausted() {
+		l.stack.refuseTCP(pkt)
+		return nil
 	}
-	err := freeconn.recv(pkt)
+	if l.conns[connidx].State() != seqs.StateListen {
+		l.freeConnForReuse(connidx) // New incarnation of connection in TIME_WAIT.
+	}
+	return l.recvConn(connidx, pkt)
+}
+
+// recvConn passes pkt to the connection at idx. Connections that end are
+// reopened for new remotes by freeConnForReuse and must not be aborted after,
+// which would leave them closed and the listener one connection short.
+func (l *TCPListener) recvConn(idx int, pkt *TCPPacket) error {
+	err := l.conns[idx].recv(pkt)
 	if err == io.EOF {
-		l.freeConnForReuse(connidx)
-		freeconn.abort()
+		l.freeConnForReuse(idx)
 		err = nil
 	}
 	return err
 }
 
+// connIndex returns the index of the connection pkt belongs to or -1 if there is none.
+// A remote may be connected to more than one of the stack's addresses.
+func (l *TCPListener) connIndex(pkt *TCPPacket) int {
+	for i := range l.conns {
+		remote := l.conns[i].remote
+		if remote.IsValid() && pkt.TCP.SourcePort == remote.Port() && pkt.IP.Source == remote.Addr().As4() &&
+			pkt.IP.Destination == l.conns[i].localAddr() {
+			return i
+		}
+	}
+	return -1
+}
+
+// freeConnIndex returns the index of a connection available to accept a new remote or -1 if there is none.
+func (l *TCPListener) freeConnIndex() int {
+	for i := range l.conns {
+		if !l.used[i] && l.conns[i].State() == seqs.StateListen {
+			return i
+		}
+	}
+	return -1
+}
+
+// pendingAccept returns the amount of connections being established or not yet returned by Accept.
+func (l *TCPListener) pendingAccept() (n int) {
+	for i := range l.conns {
+		state := l.conns[i].State()
+		if !l.used[i] && state != seqs.StateListen && !state.IsClosed() {
+			n++
+		}
+	}
+	return n
+}
+
+// halfOpenFull reports whether the connections in SYN-RECEIVED reached
+// the limit set by [TCPListenerConfig.MaxHalfOpen], or the backlog if unset.
+func (l *TCPListener) halfOpenFull() bool {
+	limit := int(l.maxHalfOpen)
+	if limit == 0 {
+		limit = int(l.backlog)
+	}
+	n := 0
+	for i := range l.conns {
+		if l.conns[i].State() == seqs.StateSynRcvd {
+			n++
+		}
+	}
+	return n >= limit
+}
+
+// evictHalfOpen frees the oldest connection in SYN-RECEIVED to admit a new
+// connection attempt and returns its index or -1 if there is none.
+func (l *TCPListener) evictHalfOpen() int {
+	idx := -1
+	for i := range l.conns {
+		conn := &l.conns[i]
+		if conn.State() == seqs.StateSynRcvd && (idx < 0 || conn.opened.Before(l.conns[idx].opened)) {
+			idx = i
+		}
+	}
+	if idx >= 0 {
+		l.info("lst:evict-halfopen", slog.Uint64("lport", uint64(l.port)), slog.Uint64("rport", uint64(l.conns[idx].remote.Port())))
+		l.freeConnForReuse(idx)
+	}
+	return idx
+}
+
+// usesCookies reports whether SYN cookies are sent once half-open connections are exhausted.
+func (l *TCPListener) usesCookies() bool {
+	return l.cookies.enabled && l.stack.tcpmd5 == nil
+}
+
 func (l *TCPListener) abort() {
 	l.info("lst:abort", slog.Uint64("lport", uint64(l.port)))
 	l.open = false
+	l.cookies.pending = false
 	l.connid++
 	for i := range l.conns {
 		conn := &l.conns[i]
@@ -176,7 +371,7 @@ func (l *TCPListener) abort() {
 }
 
 func (l *TCPListener) freeConnForReuse(idx int) {
-	l.iss = prand32(l.iss)
+	l.iss = seqs.Value(l.stack.rand32())
 	conn := &l.conns[idx]
 	l.info("lst:freeConnForReuse", slog.Uint64("lport", uint64(conn.localPort)), slog.Uint64("rport", uint64(conn.remote.Port())))
 	conn.abort()
@@ -188,6 +383,13 @@ func (l *TCPListener) isPendingHandling() bool {
 	return l.isOpen()
 }
 
+func (l *TCPListener) bufferedBytes() (n int) {
+	for i := range l.conns {
+		n += l.conns[i].bufferedBytes()
+	}
+	return n
+}
+
 func (l *TCPListener) isOpen() bool { return l.open }
 
 func (l *TCPListener) PortStack() *PortStack { return l.stack }
@@ -196,6 +398,10 @@ func (l *TCPListener) trace(msg string, attrs ...slog.Attr) {
 	internal.LogAttrs(l.stack.logger, internal.LevelTrace, msg, attrs...)
 }
 
+func (l *TCPListener) debug(msg string, attrs ...slog.Attr) {
+	internal.LogAttrs(l.stack.logger, slog.LevelDebug, msg, attrs...)
+}
+
 func (l *TCPListener) info(msg string, attrs ...slog.Attr) {
 	internal.LogAttrs(l.stack.logger, slog.LevelInfo, msg, attrs...)
 }
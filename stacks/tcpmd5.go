@@ -0,0 +1,89 @@
+package stacks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+
+	"github.com/soypat/seqs/eth"
+)
+
+// sizeTCPMD5Opts is the size of the MD5 signature option padded to a 32 bit boundary.
+const sizeTCPMD5Opts = eth.SizeTCPOptMD5 + 2
+
+// TCPMD5Func computes the TCP MD5 signature (RFC 2385) of a segment, typically
+// by hashing the output of [AppendTCPMD5Message] followed by the connection key.
+// The peer is identified by the source address and port of received segments
+// and by the destination address and port of sent segments.
+// TCPMD5Func returns false if no key is configured for the peer, in which case
+// the segment is sent unsigned, or if received, is only accepted if unsigned.
+type TCPMD5Func func(digest *[16]byte, ip *eth.IPv4Header, tcp *eth.TCPHeader, payload []byte) (hasKey bool)
+
+// SetTCPMD5 sets the callback used to sign and verify TCP segments with the
+// TCP MD5 signature option. A nil callback disables signing and verification.
+// While the callback is set [TCPConn] reserves space for the option in every
+// segment it sends. RSTs generated by the stack are not signed.
+func (ps *PortStack) SetTCPMD5(fn TCPMD5Func) { ps.tcpmd5 = fn }
+
+// AppendTCPMD5Message appends the message covered by the TCP MD5 signature to
+// dst, excluding the key: the TCP pseudo-header, the TCP header without
+// options with a zeroed checksum, and the payload.
+func AppendTCPMD5Message(dst []byte, ip *eth.IPv4Header, tcp *eth.TCPHeader, payload []byte) []byte {
+	var buf [12 + eth.SizeTCPHeader]byte
+	copy(buf[0:4], ip.Source[:])
+	copy(buf[4:8], ip.Destination[:])
+	buf[9] = ip.Protocol
+	binary.BigEndian.PutUint16(buf[10:12], ip.TotalLength-uint16(ip.IHL())*4) // Segment length.
+	hdr := *tcp
+	hdr.Checksum = 0
+	hdr.Put(buf[12:])
+	dst = append(dst, buf[:]...)
+	return append(dst, payload...)
+}
+
+// verifyTCPMD5 checks the MD5 signature of a received segment. Segments are
+// rejected if they are unsigned and a key is configured for the peer, if they
+// are signed and no key is configured, or if the signature does not match.
+func (ps *PortStack) verifyTCPMD5(ip *eth.IPv4Header, tcp *eth.TCPHeader, tcpOptions, payload []byte) bool {
+	var digest [16]byte
+	sig, signed := eth.FindTCPOption(tcpOptions, eth.TCPOptMD5)
+	hasKey := ps.tcpmd5(&digest, ip, tcp, payload)
+	ok := hasKey == signed && (!hasKey || bytes.Equal(sig, digest[:]))
+	if !ok {
+		ps.rejectedMD5++
+		ps.info("TCP:md5-reject", slog.Uint64("lport", uint64(tcp.DestinationPort)), slog.Bool("signed", signed), slog.Bool("haskey", hasKey))
+	}
+	return ok
+}
+
+// signTCP adds the MD5 signature option to the outgoing segment in pkt if a
+// key is configured for the peer. pkt headers must be calculated for a segment
+// without options. dst is the frame being written and must have space for the
+// option between the TCP header and payload, which starts at
+// sizeTCPNoOptions+sizeTCPMD5Opts. If the segment is not signed the payload is
+// moved to start at sizeTCPNoOptions. signTCP returns the size of the frame.
+func (ps *PortStack) signTCP(pkt *TCPPacket, dst []byte, payloadLen int) int {
+	payload := dst[sizeTCPNoOptions+sizeTCPMD5Opts : sizeTCPNoOptions+sizeTCPMD5Opts+payloadLen]
+	pkt.TCP.SetOffset(5 + sizeTCPMD5Opts/4)
+	pkt.IP.TotalLength += sizeTCPMD5Opts
+	var digest [16]byte
+	if !ps.tcpmd5(&digest, &pkt.IP, &pkt.TCP, payload) {
+		pkt.TCP.SetOffset(5)
+		pkt.IP.TotalLength -= sizeTCPMD5Opts
+		copy(dst[sizeTCPNoOptions:], payload)
+		pkt.PutHeaders(dst)
+		return sizeTCPNoOptions + payloadLen
+	}
+	opts := dst[sizeTCPNoOptions : sizeTCPNoOptions+sizeTCPMD5Opts]
+	opts[0] = eth.TCPOptMD5
+	opts[1] = eth.SizeTCPOptMD5
+	copy(opts[2:], digest[:])
+	opts[eth.SizeTCPOptMD5] = eth.TCPOptNop
+	opts[eth.SizeTCPOptMD5+1] = eth.TCPOptNop
+	pkt.IP.Checksum = pkt.IP.CalculateChecksum()
+	pkt.TCP.Checksum = pkt.TCP.CalculateChecksumIPv4(&pkt.IP, opts, payload)
+	pkt.Eth.Put(dst)
+	pkt.IP.Put(dst[eth.SizeEthernetHeader:])
+	pkt.TCP.Put(dst[eth.SizeEthernetHeader+eth.SizeIPv4Header:])
+	return sizeTCPNoOptions + sizeTCPMD5Opts + payloadLen
+}
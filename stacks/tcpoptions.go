@@ -0,0 +1,111 @@
+package stacks
+
+import (
+	"log/slog"
+
+	"github.com/soypat/seqs"
+)
+
+// sizeSynOptions is the size of the options sent in SYN segments: MSS, window
+// scale, SACK-permitted and timestamps.
+const sizeSynOptions = 12 + seqs.SizeTimestampsOption
+
+// setLocalOptions sets the options sent in the connection's SYN segments. The
+// MSS advertised is the largest segment payload that fits the stack's MTU, or
+// the path MTU to the remote if smaller.
+// Receive buffers fit an unscaled window so the window scale option is sent
+// with a zero shift count, which lets the remote scale the windows it advertises.
+func (sock *TCPConn) setLocalOptions() {
+	opts := seqs.Options{WindowScale: true, SACKPermitted: sock.tcfg.SACK, Timestamps: sock.tcfg.Timestamps}
+	mtu := sock.stack.mtu
+	if sock.pathMTU != 0 && sock.pathMTU < mtu {
+		mtu = sock.pathMTU
+	}
+	if mtu > sizeTCPNoOptions {
+		opts.MSS = mtu - sizeTCPNoOptions
+	}
+	sock.scb.SetLocalOptions(opts)
+}
+
+// RemoteOptions returns the TCP options received in the remote's SYN segment,
+// which determine the maximum segment size and window scaling of the connection.
+func (sock *TCPConn) RemoteOptions() seqs.Options { return sock.scb.RemoteOptions() }
+
+// recvOptions processes the options and scaled window of an incoming segment.
+// It returns false if the options are malformed and the segment must be dropped.
+func (sock *TCPConn) recvOptions(pkt *TCPPacket, seg *seqs.Segment) bool {
+	if err := sock.scb.RecvOptions(*seg, pkt.TCPOptions()); err != nil {
+		sock.debug("TCP:bad-options", slog.Uint64("port", uint64(sock.localPort)))
+		return false
+	}
+	seg.WND = sock.scb.DecodeWindow(pkt.TCP.WindowSizeRaw, seg.Flags)
+	return true
+}
+
+// maxPayload returns the largest amount of data that may be sent in a frame
+// of size frameLen with reserve bytes of options, honoring the remote's MSS
+// and the path MTU. At least one byte may always be sent.
+func (sock *TCPConn) maxPayload(frameLen, reserve int) int {
+	if sock.pathMTU != 0 && frameLen > int(sock.pathMTU) {
+		frameLen = int(sock.pathMTU)
+	}
+	return max(min(frameLen-sizeTCPNoOptions, int(sock.scb.SendMSS()))-reserve, 1)
+}
+
+// putSegment calculates the headers of seg and writes them to response,
+// returning the size of the frame. payload must be placed in response after
+// the headers and reserve bytes of space for options, see [TCPConn.optionsReserve].
+// The window is scaled as negotiated and SYN segments carry the options set
+// with setLocalOptions, unless they are signed. SYN segments carry no data.
+func (sock *TCPConn) putSegment(response []byte, seg seqs.Segment, payload []byte, reserve int) int {
+	seg.WND = sock.stack.fingerprint.synWindow(seg.Flags, seg.WND)
+	seg.WND = seqs.Size(sock.scb.EncodeWindow(seg.WND, seg.Flags))
+	sock.setSrcDest(&sock.pkt)
+	signed := sock.stack.tcpmd5 != nil
+	if seg.Flags.HasAny(seqs.FlagSYN) && !signed && len(payload) == 0 {
+		var buf [sizeSynOptions]byte
+		synOpts := sock.scb.SendOptions(seg)
+		opts := synOpts.Append(buf[:0])
+		if synOpts.Timestamps {
+			opts = seqs.AppendTimestamps(opts, sock.tsOption())
+		}
+		return sock.putSegmentWithOptions(response, seg, opts, nil)
+	}
+	if !signed {
+		var buf [seqs.SizeTimestampsOption + sizeSACKOptions]byte
+		opts := buf[:0]
+		if sock.tsEnabled() {
+			opts = seqs.AppendTimestamps(opts, sock.tsOption())
+		}
+		if len(payload) == 0 && sock.rxq.n > 0 && sock.sackEnabled() {
+			// Acknowledgements report data queued ahead with SACK blocks.
+			var blocks [seqs.MaxSACKBlocks]seqs.SACKBlock
+			n := sock.sackBlocks(&blocks)
+			if len(opts) > 0 {
+				n = min(n, seqs.MaxSACKBlocksTimestamps)
+			}
+			opts = seqs.AppendSACK(opts, blocks[:n])
+		}
+		if len(opts) > 0 {
+			return sock.putSegmentWithOptions(response, seg, opts, payload)
+		}
+	}
+	sock.pkt.CalculateHeaders(seg, payload)
+	sock.applyIPHeader()
+	if reserve > 0 {
+		return sock.stack.signTCP(&sock.pkt, response, len(payload))
+	}
+	sock.pkt.PutHeaders(response)
+	return sizeTCPNoOptions + len(payload)
+}
+
+// putSegmentWithOptions writes the headers of seg with options opts to
+// response. payload must follow the options in response.
+func (sock *TCPConn) putSegmentWithOptions(response []byte, seg seqs.Segment, opts, payload []byte) int {
+	sock.pkt.CalculateHeadersWithOptions(seg, opts, payload)
+	sock.applyIPHeader()
+	if err := sock.pkt.PutHeadersWithOptions(response); err != nil {
+		panic(err) // Options always fit in a frame.
+	}
+	return sizeTCPNoOptions + len(opts) + len(payload)
+}
@@ -0,0 +1,217 @@
+package stacks
+
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/soypat/seqs"
+)
+
+var errRetransmitTimeout error = timeoutError("connection timed out: retransmissions not acknowledged")
+
+// initialRTO is the retransmission timeout before a round trip time is measured as per RFC 6298.
+const initialRTO = time.Second
+
+// tcpRetx tracks sent data that is not yet acknowledged and the retransmission
+// timer of a connection. The retransmission timeout (RTO) is calculated from
+// round trip time samples as specified in RFC 6298. Samples are not taken from
+// retransmitted segments (Karn's algorithm). Sent data remains in the transmit
+// buffer until acknowledged so it can be retransmitted.
+type tcpRetx struct {
+	// unacked is the amount of bytes at the start of the transmit buffer which were sent and not acknowledged.
+	unacked int
+	// timer is the time the retransmission timer was started. Zero if not running.
+	timer  time.Time
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+	// rttSeq is the sequence number whose acknowledgement completes the round
+	// trip time measurement started at rttStart. Only valid if timing is set.
+	rttSeq   seqs.Value
+	rttStart time.Time
+	timing   bool
+	// backoff is the amount of consecutive retransmissions since data was last acknowledged.
+	backoff uint8
+	// sack holds the data beyond SND.UNA reported received by the remote. See tcpsack.go.
+	sack tcpScoreboard
+	// pmtu is set while data sent before the path MTU was lowered, up to
+	// pmtuEnd, is resent in smaller segments. pmtuNext is the end of the
+	// last segment resent. See pmtud.go.
+	pmtu     bool
+	pmtuEnd  seqs.Value
+	pmtuNext seqs.Value
+	// Configuration, preserved when the connection is closed. See tcpconfig.go.
+	maxRetrans uint8
+	minRTO     time.Duration
+	maxRTO     time.Duration
+}
+
+// SetRetransmission sets the minimum retransmission timeout and the amount
+// of consecutive retransmissions without acknowledgement after which the
+// connection is aborted, leaving the rest of the connection's [TCPConfig]
+// unchanged. Zero values select the defaults: the 1 second minimum of
+// RFC 6298 and 8 retransmissions.
+func (sock *TCPConn) SetRetransmission(minRTO time.Duration, maxRetransmits uint8) error {
+	cfg := sock.tcfg
+	cfg.MinRTO = minRTO
+	cfg.MaxRetransmits = maxRetransmits
+	return sock.SetTCPConfig(cfg)
+}
+
+// RTO returns the current retransmission timeout of the connection including backoff.
+func (sock *TCPConn) RTO() time.Duration { return sock.retx.timeout() }
+
+// SRTT returns the smoothed round trip time of the connection. It is zero until
+// the first acknowledgement of data is received.
+func (sock *TCPConn) SRTT() time.Duration { return sock.retx.srtt }
+
+// CongestionWindow returns the amount of unacknowledged data the connection may
+// have in flight as limited by congestion control. See [seqs.ControlBlock.CongestionWindow].
+func (sock *TCPConn) CongestionWindow() seqs.Size { return sock.scb.CongestionWindow() }
+
+func (r *tcpRetx) running() bool { return !r.timer.IsZero() }
+
+func (r *tcpRetx) timeout() time.Duration {
+	rto := r.rto
+	if rto == 0 {
+		rto = initialRTO
+	}
+	for i := uint8(0); i < r.backoff && rto < r.maxRTO; i++ {
+		rto *= 2
+	}
+	if rto > r.maxRTO {
+		rto = r.maxRTO
+	}
+	return rto
+}
+
+func (r *tcpRetx) expired(now time.Time) bool {
+	return r.running() && now.Sub(r.timer) >= r.timeout()
+}
+
+// onsend is called when a segment ending before sequence number end is sent for the first time.
+func (r *tcpRetx) onsend(now time.Time, end seqs.Value) {
+	if !r.running() {
+		r.timer = now
+	}
+	if !r.timing {
+		r.timing = true
+		r.rttSeq = end
+		r.rttStart = now
+	}
+}
+
+// ontxdone moves the start of the retransmission timer and round trip time
+// measurement to when the NIC reported the frame queued at sent actually left.
+func (r *tcpRetx) ontxdone(sent, now time.Time) {
+	if r.timer.Equal(sent) {
+		r.timer = now
+	}
+	if r.timing && r.rttStart.Equal(sent) {
+		r.rttStart = now
+	}
+}
+
+// sample updates the round trip time estimates with a measurement, see RFC 6298 section 2.
+func (r *tcpRetx) sample(rtt time.Duration) {
+	if r.srtt == 0 {
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+	} else {
+		diff := r.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		r.rttvar = (3*r.rttvar + diff) / 4
+		r.srtt = (7*r.srtt + rtt) / 8
+	}
+	r.rto = r.srtt + 4*r.rttvar
+	if r.rto < r.minRTO {
+		r.rto = r.minRTO
+	} else if r.rto > r.maxRTO {
+		r.rto = r.maxRTO
+	}
+}
+
+// reset clears connection state preserving configuration.
+func (r *tcpRetx) reset() {
+	*r = tcpRetx{maxRetrans: r.maxRetrans, minRTO: r.minRTO, maxRTO: r.maxRTO}
+}
+
+// onack processes the acknowledgement of sent sequence space after SND.UNA advanced from prevUNA.
+// Acknowledged data is discarded from the transmit buffer.
+func (sock *TCPConn) onack(prevUNA seqs.Value, now time.Time) {
+	una := sock.scb.SendUnacked()
+	r := &sock.retx
+	if una == prevUNA || !r.running() {
+		return
+	}
+	acked := min(int(seqs.Sizeof(prevUNA, una)), r.unacked)
+	sock.tx.discard(acked)
+	r.unacked -= acked
+	r.sack.trim(una)
+	if rtt, ok := sock.tsRTT(now); ok {
+		r.timing = false // Timestamps measure every round trip. See tcptimestamps.go.
+		r.sample(rtt)
+	} else if r.timing && !seqs.LessThan(una, r.rttSeq) {
+		r.timing = false
+		r.sample(now.Sub(r.rttStart))
+	}
+	r.backoff = 0
+	if r.pmtu && !seqs.LessThan(una, r.pmtuEnd) {
+		r.pmtu = false // All data sent before the path MTU was lowered was resent.
+	}
+	if una == sock.scb.SendNext() {
+		r.timer = time.Time{} // All sent data acknowledged.
+	} else {
+		r.timer = now
+	}
+}
+
+// retransmit resends the oldest unacknowledged segment once the retransmission
+// timer expires and backs off the timer. The connection is aborted after too
+// many consecutive retransmissions.
+func (sock *TCPConn) retransmit(response []byte, reserve int) (int, error) {
+	r := &sock.retx
+	if r.backoff >= r.maxRetrans {
+		sock.logerr("TCP:retx-abort", slog.Uint64("port", uint64(sock.localPort)), slog.Int("retransmits", int(r.backoff)))
+		sock.abortErr = errRetransmitTimeout
+		return 0, io.EOF // Abort connection- remote unreachable.
+	}
+	size := min(r.unacked, sock.maxPayload(len(response), reserve))
+	if r.sack.n > 0 {
+		// Retransmit up to the first block reported received and the
+		// following holes after. See tcpsack.go.
+		_, hole := r.sack.nextHole(sock.scb.SendUnacked())
+		size = min(size, int(hole))
+	}
+	seg, ok := sock.scb.RetransmitSegment(size)
+	if !ok {
+		r.pmtu = false
+		r.timer = time.Time{}
+		return 0, nil
+	}
+	r.sack.rexmit = seqs.Add(seg.SEQ, seg.DATALEN)
+	r.sack.recovering = r.sack.n > 0
+	payload := response[sizeTCPNoOptions+reserve : sizeTCPNoOptions+reserve+int(seg.DATALEN)]
+	n := sock.tx.peek(payload, 0)
+	if n != int(seg.DATALEN) {
+		panic("bug in retransmit") // Unacknowledged data not in transmit buffer.
+	}
+	if r.pmtuDue(sock.scb.SendUnacked()) {
+		r.pmtuNext = seqs.Add(seg.SEQ, seg.DATALEN) // Segment was dropped for its size, not lost to congestion.
+	} else {
+		r.backoff++
+		sock.stack.stats.TCPRetransmits++
+	}
+	r.timing = false // Karn's algorithm: don't sample retransmitted sequence space.
+	if sock.stack.isLogEnabled(slog.LevelDebug) {
+		sock.debug("TCP:retransmit", slog.Uint64("port", uint64(sock.localPort)), slog.Uint64("seq", uint64(seg.SEQ)),
+			slog.Int("len", n), slog.Duration("rto", r.timeout()))
+	}
+	nframe := sock.putSegment(response, seg, payload, reserve)
+	sock.onsend(response[:nframe], sock.scb.State())
+	r.timer = sock.lastTx
+	return nframe, ErrFlagPending
+}
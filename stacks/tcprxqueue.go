@@ -0,0 +1,95 @@
+package stacks
+
+import (
+	"log/slog"
+
+	"github.com/soypat/seqs"
+)
+
+// tcpRxQueue holds segments received ahead of the next expected sequence
+// number, i.e: when a burst of segments is reordered in flight. Without it
+// the control block only admits sequential segments and the following
+// segments of a burst are dropped until the peer retransmits them.
+type tcpRxQueue struct {
+	pkts []TCPPacket
+	n    int
+	// last is the sequence number of the segment queued last and sackPending
+	// is set when an acknowledgement with SACK blocks is due. See tcpsack.go.
+	last        seqs.Value
+	sackPending bool
+	// draining is set while queued segments are processed. Their timestamps
+	// were checked on arrival. See tcptimestamps.go.
+	draining bool
+}
+
+// queueAhead queues pkt holding segment seg if it arrived ahead of the next
+// expected sequence number and reports whether it was queued. Only data that
+// fits the receive buffer once the preceding gap is filled is queued.
+func (sock *TCPConn) queueAhead(pkt *TCPPacket, seg seqs.Segment) bool {
+	q := &sock.rxq
+	nxt := sock.scb.RecvNext()
+	if len(q.pkts) == 0 || sock.scb.State() != seqs.StateEstablished || seg.DATALEN == 0 ||
+		seg.Flags.HasAny(seqs.FlagSYN|seqs.FlagRST) || !seqs.LessThan(nxt, seg.SEQ) ||
+		seqs.Sizeof(nxt, seg.SEQ)+seg.DATALEN > seqs.Size(sock.rx.Free()) {
+		return false
+	}
+	for i := 0; i < q.n; i++ {
+		if q.pkts[i].TCP.Seq == seg.SEQ {
+			q.sackPending = sock.sackEnabled()
+			return true // Retransmission of a segment already queued.
+		}
+	}
+	if q.n == len(q.pkts) || !sock.stack.pool.borrow(&q.pkts[q.n]) {
+		return false
+	}
+	q.pkts[q.n].copyFrom(pkt)
+	q.n++
+	q.last = seg.SEQ
+	q.sackPending = sock.sackEnabled() // Report the gap without delay, RFC 2018 section 4.
+	if sock.stack.isLogEnabled(slog.LevelDebug) {
+		sock.debug("TCP:rx-queue-ahead", slog.Uint64("seq", uint64(seg.SEQ)), slog.Uint64("rcv.nxt", uint64(nxt)))
+	}
+	return true
+}
+
+// drainAhead processes the queued segments in sequence number order as they
+// become the next expected segment. Segments made obsolete are discarded.
+func (sock *TCPConn) drainAhead() (err error) {
+	q := &sock.rxq
+	for i := 0; i < q.n; {
+		pkt := &q.pkts[i]
+		seg := pkt.TCP.Segment(len(pkt.Payload()))
+		nxt := sock.scb.RecvNext()
+		if seqs.LessThan(nxt, seg.SEQ) {
+			i++ // Still ahead.
+			continue
+		}
+		var perr error
+		if seg.SEQ == nxt {
+			q.draining = true
+			perr = sock.recvSegment(pkt)
+			q.draining = false
+		}
+		q.n--
+		q.pkts[i], q.pkts[q.n] = q.pkts[q.n], q.pkts[i] // Swap to keep buffers unaliased.
+		sock.stack.pool.release(&q.pkts[q.n])
+		i = 0 // Next expected sequence number may have advanced.
+		if perr == ErrFlagPending {
+			err = perr
+		} else if perr != nil {
+			sock.releaseAhead()
+			return perr
+		}
+	}
+	return err
+}
+
+// releaseAhead discards the queued segments, returning their buffers to the
+// stack's packet pool if borrowed from it.
+func (sock *TCPConn) releaseAhead() {
+	q := &sock.rxq
+	for i := 0; i < q.n; i++ {
+		sock.stack.pool.release(&q.pkts[i])
+	}
+	q.n = 0
+}
@@ -0,0 +1,223 @@
+package stacks
+
+import (
+	"log/slog"
+
+	"github.com/soypat/seqs"
+)
+
+// sizeSACKOptions is the size of a SACK option with the most blocks, alignment included.
+const sizeSACKOptions = 4 + 8*seqs.MaxSACKBlocks
+
+// tcpScoreboard holds the blocks of sent data beyond SND.UNA the remote
+// reported received with SACK options, sorted by sequence number, so that
+// only the holes between them are retransmitted. See RFC 2018 and RFC 6675.
+type tcpScoreboard struct {
+	blocks [seqs.MaxSACKBlocks]seqs.SACKBlock
+	n      int
+	// rexmit is the next sequence number to retransmit while recovering,
+	// which starts when the retransmission timer expires with holes reported.
+	rexmit     seqs.Value
+	recovering bool
+}
+
+// sackEnabled reports whether SACK options are exchanged on the connection.
+// They are not used on signed connections for lack of option space.
+func (sock *TCPConn) sackEnabled() bool {
+	return sock.scb.SACKPermitted() && sock.stack.tcpmd5 == nil
+}
+
+// sackBlocks writes the blocks of data queued ahead of the next expected
+// sequence number to dst and returns the amount written. The block holding
+// the most recently queued segment is reported first as per RFC 2018 section 4.
+func (sock *TCPConn) sackBlocks(dst *[seqs.MaxSACKBlocks]seqs.SACKBlock) int {
+	q := &sock.rxq
+	prev := sock.scb.RecvNext()
+	n := 0
+	for ; n < len(dst); n++ {
+		// Find the lowest queued segment after the previous block.
+		var block seqs.SACKBlock
+		found := false
+		for i := 0; i < q.n; i++ {
+			seq := q.pkts[i].TCP.Seq
+			if seqs.LessThan(prev, seq) && (!found || seqs.LessThan(seq, block.Left)) {
+				block = seqs.SACKBlock{Left: seq, Right: seqs.Add(seq, seqs.Size(len(q.pkts[i].Payload())))}
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+		// Extend it with contiguous and overlapping segments.
+		for extended := true; extended; {
+			extended = false
+			for i := 0; i < q.n; i++ {
+				pkt := &q.pkts[i]
+				end := seqs.Add(pkt.TCP.Seq, seqs.Size(len(pkt.Payload())))
+				if seqs.LessThanEq(pkt.TCP.Seq, block.Right) && seqs.LessThan(block.Right, end) && !seqs.LessThan(pkt.TCP.Seq, block.Left) {
+					block.Right = end
+					extended = true
+				}
+			}
+		}
+		dst[n] = block
+		if n > 0 && seqs.LessThanEq(block.Left, q.last) && seqs.LessThan(q.last, block.Right) {
+			dst[0], dst[n] = dst[n], dst[0]
+		}
+		prev = block.Right
+	}
+	return n
+}
+
+// recvSACK adds the blocks reported in the options of an incoming segment
+// acknowledging data up to SND.UNA to the scoreboard.
+func (sock *TCPConn) recvSACK(opts []byte) {
+	var blocks [seqs.MaxSACKBlocks]seqs.SACKBlock
+	n, err := seqs.ParseSACK(opts, blocks[:])
+	if err != nil || n == 0 || !sock.sackEnabled() {
+		return
+	}
+	una, nxt := sock.scb.SendUnacked(), sock.scb.SendNext()
+	for _, b := range blocks[:n] {
+		if seqs.LessThan(una, b.Left) && seqs.LessThan(b.Left, b.Right) && seqs.LessThanEq(b.Right, nxt) {
+			sock.retx.sack.add(b)
+		}
+	}
+}
+
+// add merges b into the scoreboard. b is dropped if the scoreboard is full.
+func (sb *tcpScoreboard) add(b seqs.SACKBlock) {
+	i := 0
+	for ; i < sb.n && seqs.LessThan(sb.blocks[i].Left, b.Left); i++ {
+	}
+	if sb.n == len(sb.blocks) {
+		// Only merge into existing blocks.
+		for j := 0; j < sb.n; j++ {
+			if sackOverlap(sb.blocks[j], b) {
+				sb.blocks[j] = sackUnion(sb.blocks[j], b)
+				sb.merge()
+				return
+			}
+		}
+		return
+	}
+	copy(sb.blocks[i+1:sb.n+1], sb.blocks[i:sb.n])
+	sb.blocks[i] = b
+	sb.n++
+	sb.merge()
+}
+
+// merge coalesces overlapping and contiguous blocks.
+func (sb *tcpScoreboard) merge() {
+	for i := 0; i+1 < sb.n; {
+		if sackOverlap(sb.blocks[i], sb.blocks[i+1]) {
+			sb.blocks[i] = sackUnion(sb.blocks[i], sb.blocks[i+1])
+			copy(sb.blocks[i+1:], sb.blocks[i+2:sb.n])
+			sb.n--
+			continue
+		}
+		i++
+	}
+}
+
+// trim discards blocks acknowledged cumulatively by una.
+func (sb *tcpScoreboard) trim(una seqs.Value) {
+	for sb.n > 0 && seqs.LessThanEq(sb.blocks[0].Left, una) {
+		if seqs.LessThan(una, sb.blocks[0].Right) {
+			sb.blocks[0].Left = una
+			break
+		}
+		copy(sb.blocks[:], sb.blocks[1:sb.n])
+		sb.n--
+	}
+	if seqs.LessThan(sb.rexmit, una) {
+		sb.rexmit = una
+	}
+	if sb.n == 0 {
+		sb.recovering = false
+	}
+}
+
+// nextHole returns the next hole to retransmit at or after seq and its
+// size. size is zero if there are no holes left below the highest block reported.
+func (sb *tcpScoreboard) nextHole(seq seqs.Value) (start seqs.Value, size seqs.Size) {
+	for i := 0; i < sb.n; i++ {
+		b := sb.blocks[i]
+		if seqs.LessThan(seq, b.Left) {
+			return seq, seqs.Sizeof(seq, b.Left)
+		} else if seqs.LessThan(seq, b.Right) {
+			seq = b.Right // Within a block, skip it.
+		}
+	}
+	return seq, 0
+}
+
+func sackOverlap(a, b seqs.SACKBlock) bool {
+	return seqs.LessThanEq(a.Left, b.Right) && seqs.LessThanEq(b.Left, a.Right)
+}
+
+func sackUnion(a, b seqs.SACKBlock) seqs.SACKBlock {
+	if seqs.LessThan(b.Left, a.Left) {
+		a.Left = b.Left
+	}
+	if seqs.LessThan(a.Right, b.Right) {
+		a.Right = b.Right
+	}
+	return a
+}
+
+// retransmitHole retransmits the next hole of sent data not reported by the
+// remote after the retransmission timer expired, so that several segments
+// lost in a window are recovered without waiting for a timeout each.
+// It returns zero once no holes remain.
+func (sock *TCPConn) retransmitHole(response []byte, reserve int) int {
+	sb := &sock.retx.sack
+	start, size := sb.nextHole(sb.rexmit)
+	if size == 0 {
+		sb.recovering = false
+		return 0
+	}
+	una := sock.scb.SendUnacked()
+	off := int(seqs.Sizeof(una, start))
+	size = seqs.Size(min(int(size), min(sock.maxPayload(len(response), reserve), sock.retx.unacked-off)))
+	if int(size) <= 0 {
+		sb.recovering = false
+		return 0
+	}
+	seg := seqs.Segment{
+		SEQ:     start,
+		ACK:     sock.scb.RecvNext(),
+		WND:     sock.scb.RecvWindow(),
+		Flags:   seqs.FlagACK,
+		DATALEN: size,
+	}
+	payload := response[sizeTCPNoOptions+reserve : sizeTCPNoOptions+reserve+int(size)]
+	if sock.tx.peek(payload, off) != int(size) {
+		panic("bug in retransmitHole") // Unacknowledged data not in transmit buffer.
+	}
+	sb.rexmit = seqs.Add(start, size)
+	sock.stack.stats.TCPRetransmits++
+	if sock.stack.isLogEnabled(slog.LevelDebug) {
+		sock.debug("TCP:retransmit-hole", slog.Uint64("port", uint64(sock.localPort)), slog.Uint64("seq", uint64(start)), slog.Int("len", int(size)))
+	}
+	nframe := sock.putSegment(response, seg, payload, reserve)
+	sock.onsend(response[:nframe], sock.scb.State())
+	return nframe
+}
+
+// sendSACK sends an acknowledgement carrying SACK blocks in response to a
+// segment queued ahead of the next expected sequence number, or rejected as
+// an old duplicate by PAWS. See tcptimestamps.go.
+func (sock *TCPConn) sendSACK(response []byte) int {
+	sock.rxq.sackPending = false
+	sock.ts.ackPending = false
+	seg := seqs.Segment{
+		SEQ:   sock.scb.SendNext(),
+		ACK:   sock.scb.RecvNext(),
+		WND:   sock.scb.RecvWindow(),
+		Flags: seqs.FlagACK,
+	}
+	nframe := sock.putSegment(response, seg, nil, 0)
+	sock.onsend(response[:nframe], sock.scb.State())
+	return nframe
+}
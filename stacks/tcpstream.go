@@ -0,0 +1,94 @@
+package stacks
+
+import (
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/soypat/seqs/internal"
+)
+
+// Stream layering hints. A TLS record is at most 16KiB of plaintext plus
+// header, MAC and padding. Record layers read and write whole records through
+// their own buffers so TCP buffers need not hold a full record, though TX
+// buffers of at least SizeTLSRecordOverhead plus the record fragment size let
+// a record be queued without blocking. See [TCPConn.BufferSizes].
+const (
+	SizeTLSRecordHeader   = 5
+	SizeTLSRecordOverhead = SizeTLSRecordHeader + 256
+	MaxTLSRecordPlaintext = 16384
+)
+
+// TryWrite writes as much of b as fits in the socket's output buffer without
+// blocking and returns the amount written, which may be less than len(b). A
+// full buffer is not an error: TryWrite returns 0 and a nil error. It is meant
+// for layers that keep their own buffers, such as TLS record layers, and
+// must not block the caller. Use [TCPConn.Write] to write all of b.
+func (sock *TCPConn) TryWrite(b []byte) (int, error) {
+	err := sock.checkPipeOpen()
+	if err != nil {
+		return 0, err
+	} else if sock.deadlineExceeded(sock.wdead) {
+		return 0, os.ErrDeadlineExceeded
+	} else if sock.abortErr != nil {
+		return 0, sock.abortErr
+	}
+	n, _ := sock.tx.Write(b[:min(len(b), sock.tx.Free())])
+	if n > 0 {
+		err = sock.stack.RequestSendTCP(sock.localPort)
+	}
+	return n, err
+}
+
+// Flush sends data in the output buffer without waiting for outstanding data
+// to be acknowledged as Nagle's algorithm otherwise would, i.e: at the end of
+// a TLS record or flight of handshake messages. It blocks until all buffered
+// data has been sent, though not necessarily acknowledged, or the write
+// deadline is exceeded. See [TCPConn.FlushOutputBuffer] to wait for acknowledgement.
+func (sock *TCPConn) Flush() error {
+	err := sock.checkPipeOpen()
+	if err != nil {
+		return err
+	}
+	connid := sock.connid
+	sock.push = sock.BufferedOutput()
+	if sock.push == 0 {
+		return nil
+	}
+	sock.trace("TCPConn.Flush:start", slog.Int("push", sock.push))
+	backoff := internal.NewBackoff(internal.BackoffHasPriority)
+	for {
+		err = sock.stack.RequestSendTCP(sock.localPort)
+		if err != nil {
+			return err
+		} else if sock.abortErr != nil {
+			return sock.abortErr
+		} else if connid != sock.connid {
+			return net.ErrClosed
+		} else if sock.BufferedOutput() == 0 {
+			return nil
+		} else if sock.deadlineExceeded(sock.wdead) {
+			return os.ErrDeadlineExceeded
+		}
+		backoff.Miss()
+	}
+}
+
+// onpush accounts for n bytes of pushed data sent.
+func (sock *TCPConn) onpush(n int) {
+	sock.push = max(sock.push-n, 0)
+}
+
+// SendMSS returns the largest payload of segments sent on the connection,
+// which depends on the maximum segment size advertised by the remote and the
+// path MTU. Layers framing data may size their writes to multiples of it so
+// that writes are sent in full segments.
+func (sock *TCPConn) SendMSS() int {
+	return sock.maxPayload(int(sock.stack.mtu), sock.optionsReserve())
+}
+
+// BufferSizes returns the capacity of the socket's input and output buffers.
+// A write of up to tx bytes to an empty output buffer never blocks.
+func (sock *TCPConn) BufferSizes() (rx, tx int) {
+	return len(sock.rx.buf), len(sock.tx.buf)
+}
@@ -0,0 +1,112 @@
+package stacks
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/soypat/seqs"
+)
+
+// pawsIdle is the time after which TS.Recent is considered invalid and no
+// longer used to reject segments, see RFC 7323 section 5.5.
+const pawsIdle = 24 * 24 * time.Hour
+
+// tcpTimestamps holds the state of the timestamps option (RFC 7323) of a
+// connection. Timestamps are sent in every segment once negotiated and their
+// echo yields a round trip time sample with every acknowledgement, including
+// that of retransmitted data. Segments with a timestamp older than the most
+// recent one received are rejected as old duplicates (PAWS).
+type tcpTimestamps struct {
+	// offset is added to the stack's millisecond clock so that timestamps
+	// of a connection do not disclose the clock of the host.
+	offset uint32
+	// recent is TS.Recent, the timestamp echoed to the remote, received at recentAt.
+	recent   uint32
+	recentAt time.Time
+	// lastACK is Last.ACK.sent, the acknowledgement number of the last segment sent.
+	lastACK seqs.Value
+	// echo is the echoed timestamp of the segment being processed. Only valid if hasEcho is set.
+	echo    uint32
+	hasEcho bool
+	// ackPending is set when a segment rejected by PAWS must be acknowledged.
+	ackPending bool
+}
+
+// tsEnabled reports whether timestamps are exchanged on the connection.
+// They are not used on signed connections for lack of option space.
+func (sock *TCPConn) tsEnabled() bool {
+	return sock.scb.TimestampsEnabled() && sock.stack.tcpmd5 == nil
+}
+
+// optionsReserve returns the space for options reserved before the payload
+// of segments: the TCP MD5 signature or the timestamps option.
+func (sock *TCPConn) optionsReserve() int {
+	if sock.stack.tcpmd5 != nil {
+		return sizeTCPMD5Opts
+	} else if sock.tsEnabled() {
+		return seqs.SizeTimestampsOption
+	}
+	return 0
+}
+
+// tsClock returns the connection's timestamp clock at now, which ticks every millisecond.
+func (sock *TCPConn) tsClock(now time.Time) uint32 {
+	return uint32(now.UnixMilli()) + sock.ts.offset
+}
+
+// tsOption returns the timestamps option of a segment sent now.
+func (sock *TCPConn) tsOption() seqs.TimestampOption {
+	return seqs.TimestampOption{TSval: sock.tsClock(sock.stack.now()), TSecr: sock.ts.recent}
+}
+
+// recvTimestamps processes the timestamps option of an incoming segment. It
+// returns false if the segment is an old duplicate and must be dropped as per
+// the PAWS algorithm of RFC 7323 section 5.3, in which case it is acknowledged
+// unless it is a RST.
+func (sock *TCPConn) recvTimestamps(pkt *TCPPacket, seg seqs.Segment) bool {
+	sock.ts.hasEcho = false
+	if !sock.tsEnabled() || sock.rxq.draining {
+		return true
+	}
+	ts, ok, err := seqs.ParseTimestamps(pkt.TCPOptions())
+	if err != nil || !ok {
+		return true
+	}
+	st := &sock.ts
+	isSyn := seg.Flags.HasAny(seqs.FlagSYN) && !sock.scb.State().IsSynchronized()
+	if !isSyn && !st.recentAt.IsZero() && int32(ts.TSval-st.recent) < 0 && sock.stack.now().Sub(st.recentAt) < pawsIdle {
+		if !seg.Flags.HasAny(seqs.FlagRST) {
+			st.ackPending = true
+		}
+		if sock.stack.isLogEnabled(slog.LevelDebug) {
+			sock.debug("TCP:paws-reject", slog.Uint64("port", uint64(sock.localPort)),
+				slog.Uint64("tsval", uint64(ts.TSval)), slog.Uint64("recent", uint64(st.recent)))
+		}
+		return false
+	}
+	if isSyn || (int32(ts.TSval-st.recent) >= 0 && seqs.LessThanEq(seg.SEQ, st.lastACK)) {
+		st.recent = ts.TSval
+		st.recentAt = sock.stack.now()
+	}
+	if seg.Flags.HasAny(seqs.FlagACK) {
+		st.echo = ts.TSecr
+		st.hasEcho = true
+	}
+	return true
+}
+
+// tsRTT returns the round trip time measured from the timestamp echoed by the
+// segment being processed, received at now. Round trips shorter than a clock
+// tick are sampled as one.
+func (sock *TCPConn) tsRTT(now time.Time) (time.Duration, bool) {
+	if !sock.ts.hasEcho {
+		return 0, false
+	}
+	ticks := int32(sock.tsClock(now) - sock.ts.echo)
+	if ticks < 0 {
+		return 0, false
+	} else if ticks == 0 {
+		ticks = 1
+	}
+	return time.Duration(ticks) * time.Millisecond, true
+}
@@ -0,0 +1,110 @@
+package stacks
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/soypat/seqs"
+)
+
+var errZeroWindowTimeout = errors.New("connection timed out: zero window probes unanswered")
+
+// tcpPersist is the state of the persist timer probing a zero window
+// advertised by the remote as described in RFC 9293 section 3.8.6.1. Probes
+// elicit an acknowledgement carrying the remote's current window so that a
+// lost window update does not deadlock the connection.
+type tcpPersist struct {
+	// since is when the window was found closed or the last probe was sent.
+	// Zero while the window is open.
+	since time.Time
+	// backoff is the amount of probes sent since the window closed.
+	backoff uint8
+	// unanswered is the amount of probes sent since a segment was last received.
+	unanswered uint8
+}
+
+// zeroWindow reports whether data waiting to be sent is held back solely by
+// a zero window advertised by the remote.
+func (sock *TCPConn) zeroWindow() bool {
+	state := sock.scb.State()
+	return (state == seqs.StateEstablished || state == seqs.StateCloseWait) &&
+		sock.scb.SendWindow() == 0 && sock.BufferedOutput() > 0 && !sock.retx.running()
+}
+
+// persistDue reports whether a zero window probe should be sent at now.
+// The persist timer starts when the window is found closed.
+func (sock *TCPConn) persistDue(now time.Time) bool {
+	if !sock.zeroWindow() {
+		sock.persist = tcpPersist{}
+		return false
+	} else if sock.persist.since.IsZero() {
+		sock.persist.since = now
+		return false
+	}
+	// Probes back off like retransmissions, from the RTO up to MaxRTO.
+	r := sock.retx
+	r.backoff = sock.persist.backoff
+	return now.Sub(sock.persist.since) >= r.timeout()
+}
+
+// sendProbe writes a zero window probe to response or aborts the connection
+// if as many probes as retransmissions allowed went unanswered. The probe is
+// a keepalive, which the remote acknowledges without consuming data.
+func (sock *TCPConn) sendProbe(response []byte, reserve int, now time.Time) (int, error) {
+	if sock.persist.unanswered >= sock.tcfg.MaxRetransmits {
+		sock.logerr("TCP:persist-abort", slog.Uint64("port", uint64(sock.localPort)), slog.Int("probes", int(sock.persist.unanswered)))
+		sock.abortErr = errZeroWindowTimeout
+		return 0, io.EOF // Abort connection- remote unreachable.
+	}
+	seg := sock.scb.MakeKeepalive()
+	sock.persist.since = now
+	sock.persist.unanswered++
+	if sock.persist.backoff < sock.tcfg.MaxRetransmits {
+		sock.persist.backoff++
+	}
+	sock.debug("TCP:persist-probe", slog.Uint64("port", uint64(sock.localPort)), slog.Int("probe", int(sock.persist.unanswered)))
+	n := sock.putSegment(response, seg, nil, reserve)
+	sock.onsend(response[:n], sock.scb.State())
+	return n, ErrFlagPending
+}
+
+// windowUpdateDue reports whether a receive window of wnd should be advertised
+// to the remote since it exceeds what is left of the last window advertised by
+// at least the lesser of half the receive buffer and a segment, avoiding the
+// silly window syndrome as per RFC 1122 section 4.2.3.3.
+func (sock *TCPConn) windowUpdateDue(wnd seqs.Size) bool {
+	state := sock.scb.State()
+	if state != seqs.StateEstablished && state != seqs.StateFinWait1 && state != seqs.StateFinWait2 {
+		return false // Remote sends no more data.
+	}
+	var left seqs.Size
+	if nxt := sock.scb.RecvNext(); seqs.LessThan(nxt, sock.rcvEdge) {
+		left = seqs.Sizeof(nxt, sock.rcvEdge)
+	}
+	threshold := seqs.Size(min(len(sock.rx.buf)/2, int(sock.stack.mtu)-sizeTCPNoOptions))
+	return wnd > left && wnd-left >= threshold
+}
+
+// onread is called after the application read data from the receive buffer
+// and flags the connection so a window update is sent if it reopens the window.
+func (sock *TCPConn) onread() {
+	if sock.windowUpdateDue(seqs.Size(sock.rx.Free())) {
+		sock.stack.RequestSendTCP(sock.localPort)
+	}
+}
+
+// sendWindowUpdate sends an acknowledgement advertising the receive window.
+func (sock *TCPConn) sendWindowUpdate(response []byte, reserve int) int {
+	seg := seqs.Segment{
+		SEQ:   sock.scb.SendNext(),
+		ACK:   sock.scb.RecvNext(),
+		WND:   sock.scb.RecvWindow(),
+		Flags: seqs.FlagACK,
+	}
+	sock.debug("TCP:window-update", slog.Uint64("port", uint64(sock.localPort)), slog.Uint64("wnd", uint64(seg.WND)))
+	nframe := sock.putSegment(response, seg, nil, reserve)
+	sock.onsend(response[:nframe], sock.scb.State())
+	return nframe
+}
@@ -0,0 +1,22 @@
+package stacks
+
+import "time"
+
+// timeoutError is the error of operations aborted because a timeout elapsed,
+// i.e: a connection whose SYN or retransmissions went unanswered. It
+// implements [net.Error] so callers may tell timeouts apart from other
+// failures. Deadlines of blocking calls return [os.ErrDeadlineExceeded].
+type timeoutError string
+
+func (e timeoutError) Error() string { return string(e) }
+
+// Timeout implements [net.Error].
+func (e timeoutError) Timeout() bool { return true }
+
+// Temporary implements [net.Error].
+func (e timeoutError) Temporary() bool { return false }
+
+// deadlineExceeded reports whether deadline dead of a socket of stack has passed.
+func deadlineExceeded(stack *PortStack, dead time.Time) bool {
+	return !dead.IsZero() && stack.now().After(dead)
+}
@@ -0,0 +1,83 @@
+package stacks
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+)
+
+// txCompleter is implemented by port handlers notified of the outcome of
+// transmitting the frames they generated. See [PortStack.TxDone].
+type txCompleter interface {
+	txDone(err error)
+}
+
+// txOwner identifies the port that generated the last frame written by HandleEth.
+type txOwner struct {
+	port uint16
+	tcp  bool
+}
+
+// TxDone reports the outcome of transmitting the frame last written by
+// [PortStack.HandleEth]: nil if the frame was sent or the error reported by the
+// NIC otherwise. It is intended for NIC drivers that learn the outcome after
+// the frame is handed off, such as slow SPI attached NICs signaling
+// completion by interrupt. The socket that generated the frame is notified so
+// it can time retransmissions from when the frame actually left.
+//
+// Calling TxDone is optional. Frames not reported before the next call to
+// HandleEth are assumed sent. Failures are counted in [Health].
+func (ps *PortStack) TxDone(err error) {
+	owner := ps.txOwner
+	ps.txOwner = txOwner{}
+	if err != nil {
+		ps.txFailures++
+		if ps.isLogEnabled(slog.LevelDebug) {
+			ps.debug("Stack:tx-failed", slog.Int("port", int(owner.port)), slog.String("err", err.Error()))
+		}
+	}
+	if owner.port == 0 {
+		return // Frame generated by the stack itself or already reported.
+	}
+	var h any
+	if owner.tcp {
+		if port := findPort(ps.portsTCP, owner.port); port != nil {
+			h = port.handler
+		}
+	} else if port := findPort(ps.portsUDP, owner.port); port != nil {
+		h = port.ihandler
+	}
+	if c, ok := h.(txCompleter); ok {
+		c.txDone(err)
+	}
+}
+
+func (sock *TCPConn) txDone(err error) {
+	if err == nil {
+		now := sock.stack.now()
+		sock.retx.ontxdone(sock.lastTx, now)
+		sock.lastTx = now
+	} else if sock.awaitingSyn() {
+		sock.lastTx = time.Time{} // Resend SYN on next call to HandleEth.
+	}
+}
+
+func (l *TCPListener) txDone(err error) {
+	if l.lastSent >= 0 && l.lastSent < len(l.conns) {
+		l.conns[l.lastSent].txDone(err)
+	}
+}
+
+// SetTxDoneHandler sets a function called with the destination of each
+// datagram sent by the socket once the NIC reports the outcome of its
+// transmission, such as to implement reliable delivery schemes over UDP.
+// Only called if the NIC driver uses [PortStack.TxDone]. A nil fn disables notifications.
+func (sock *UDPConn) SetTxDoneHandler(fn func(remote netip.AddrPort, err error)) {
+	sock.onTxDone = fn
+}
+
+func (sock *UDPConn) txDone(err error) {
+	if sock.onTxDone != nil {
+		sock.onTxDone(sock.lastRemote, err)
+	}
+}
@@ -0,0 +1,366 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/internal"
+)
+
+const (
+	defaultARQTimeout    = 500 * time.Millisecond
+	defaultARQRetransmit = 8
+	defaultARQMsgSize    = 512
+	// sizeARQHeader is the size of the header preceding messages: kind, reserved and sequence number.
+	sizeARQHeader = 4
+	arqKindData   = 1
+	arqKindAck    = 2
+)
+
+var (
+	errARQRemote  = errors.New("ARQ remote must be an IPv4 address and non-zero port")
+	errARQTooLong = errors.New("ARQ message larger than MaxMessageSize")
+	errARQTimeout = errors.New("ARQ message not acknowledged by remote")
+)
+
+// ARQConfig configures an [ARQConn].
+type ARQConfig struct {
+	// LocalPort is the port the connection is opened on. Required.
+	LocalPort uint16
+	// Remote is the address and port of the peer, which must also use an
+	// [ARQConn] or implement the same protocol. Required.
+	Remote netip.AddrPort
+	// RemoteHWAddr is the hardware address of the remote or the gateway to
+	// reach it. If zero it is resolved with ARP.
+	RemoteHWAddr [6]byte
+	// Window is the amount of messages sent and not yet acknowledged. A
+	// window of 1 is stop-and-wait, suited to command/response protocols. If
+	// zero 1 is used. Each message of the window takes MaxMessageSize bytes.
+	Window uint8
+	// MaxMessageSize is the largest message written. If zero 512 bytes are used.
+	MaxMessageSize uint16
+	// Timeout is the time waited for an acknowledgement before messages
+	// are retransmitted. If zero 500ms is used.
+	Timeout time.Duration
+	// MaxRetransmits is the amount of consecutive retransmissions without
+	// acknowledgement after which the connection fails. If zero 8 is used.
+	MaxRetransmits uint8
+	// RxBufSize is the size of the buffer holding received messages until
+	// read. Messages that do not fit are not acknowledged so that the remote
+	// retransmits them. If zero 1024 bytes are used.
+	RxBufSize uint16
+}
+
+// ARQConn provides reliable, ordered delivery of messages over UDP with
+// automatic repeat request (ARQ): messages carry a sequence number and are
+// retransmitted until the remote acknowledges them. Acknowledgements are
+// cumulative and messages received out of order are discarded, so that a
+// lost message is retransmitted along with the rest of the window (go-back-N).
+// It is much lighter than a [TCPConn] for simple command/response protocols
+// but offers no connection setup, flow or congestion control: both ends
+// are expected to start with fresh sequence numbers.
+//
+// Each message is sent in a datagram with a 4 byte header: the message kind
+// (1 for data, 2 for acknowledgement), a reserved zero byte and a big endian
+// sequence number. Acknowledgements carry the sequence number of the next
+// message expected.
+type ARQConn struct {
+	stack *PortStack
+	cfg   ARQConfig
+	pkt   UDPPacket
+	hw    [6]byte
+	// txbuf holds the messages of the window, the message with sequence
+	// number seq at slot seq%Window. txlen holds their lengths.
+	txbuf []byte
+	txlen []uint16
+	// una is the oldest unacknowledged message, nxt the next message to send
+	// and end the next message to be written.
+	una, nxt, end uint16
+	// deadline is when unacknowledged messages are retransmitted. Zero if none outstanding.
+	deadline time.Time
+	retries  uint8
+	// rcvnxt is the next message expected from the remote.
+	rcvnxt     uint16
+	ackPending bool
+	rx         ring
+	rdead      time.Time
+	wdead      time.Time
+	err        error
+	running    bool
+}
+
+// NewARQConn creates a reliable message connection on stack. Messages may be
+// exchanged once [ARQConn.Open] is called.
+func NewARQConn(stack *PortStack, cfg ARQConfig) (*ARQConn, error) {
+	if !cfg.Remote.Addr().Is4() || cfg.Remote.Port() == 0 {
+		return nil, errARQRemote
+	} else if cfg.LocalPort == 0 {
+		return nil, errZeroPort
+	}
+	if cfg.Window == 0 {
+		cfg.Window = 1
+	}
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = defaultARQMsgSize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultARQTimeout
+	}
+	if cfg.MaxRetransmits == 0 {
+		cfg.MaxRetransmits = defaultARQRetransmit
+	}
+	if cfg.RxBufSize == 0 {
+		cfg.RxBufSize = defaultUDPConnSize
+	}
+	return &ARQConn{
+		stack: stack,
+		cfg:   cfg,
+		hw:    cfg.RemoteHWAddr,
+		txbuf: make([]byte, int(cfg.Window)*int(cfg.MaxMessageSize)),
+		txlen: make([]uint16, cfg.Window),
+		rx:    ring{buf: make([]byte, cfg.RxBufSize)},
+	}, nil
+}
+
+// Open opens the connection's port. Sequence numbers start from zero.
+func (c *ARQConn) Open() error {
+	c.abort()
+	c.err = nil
+	err := c.stack.OpenUDP(c.cfg.LocalPort, c)
+	if err != nil {
+		return err
+	}
+	c.running = true
+	return nil
+}
+
+// Close closes the connection's port. Messages not yet acknowledged are discarded.
+func (c *ARQConn) Close() error {
+	if !c.running {
+		return net.ErrClosed
+	}
+	c.abort()
+	return c.stack.CloseUDP(c.cfg.LocalPort)
+}
+
+// Write queues b to be sent reliably as a single message. It blocks while
+// the window is full of unacknowledged messages until the write deadline is
+// exceeded. Write fails once a message is not acknowledged after MaxRetransmits.
+func (c *ARQConn) Write(b []byte) (int, error) {
+	if len(b) > int(c.cfg.MaxMessageSize) {
+		return 0, errARQTooLong
+	}
+	backoff := internal.NewBackoff(internal.BackoffHasPriority)
+	for c.end-c.una >= uint16(c.cfg.Window) {
+		if err := c.checkOpen(); err != nil {
+			return 0, err
+		} else if c.deadlineExceeded(c.wdead) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		backoff.Miss()
+	}
+	if err := c.checkOpen(); err != nil {
+		return 0, err
+	}
+	slot := int(c.end % uint16(c.cfg.Window))
+	off := slot * int(c.cfg.MaxMessageSize)
+	c.txlen[slot] = uint16(copy(c.txbuf[off:off+int(c.cfg.MaxMessageSize)], b))
+	c.end++
+	err := c.stack.RequestSendUDP(c.cfg.LocalPort)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read reads a single message into b. If b is smaller than the message the
+// excess data is discarded. Read blocks until a message is received or the
+// read deadline is exceeded.
+func (c *ARQConn) Read(b []byte) (int, error) {
+	backoff := internal.NewBackoff(internal.BackoffHasPriority)
+	for c.rx.Buffered() == 0 {
+		if err := c.checkOpen(); err != nil {
+			return 0, err
+		} else if c.deadlineExceeded(c.rdead) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		backoff.Miss()
+	}
+	var hdr [2]byte
+	c.rx.Read(hdr[:])
+	plen := int(binary.BigEndian.Uint16(hdr[:]))
+	n := min(plen, len(b))
+	c.rx.Read(b[:n])
+	for discard := plen - n; discard > 0; {
+		var buf [64]byte
+		ngot, _ := c.rx.Read(buf[:min(discard, len(buf))])
+		discard -= ngot
+	}
+	return n, nil
+}
+
+// Unacknowledged returns the amount of messages written and not yet acknowledged by the remote.
+func (c *ARQConn) Unacknowledged() int { return int(c.end - c.una) }
+
+// SetDeadline sets the read and write deadlines of the connection. A zero value for t means no deadline.
+func (c *ARQConn) SetDeadline(t time.Time) error {
+	c.rdead = t
+	c.wdead = t
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future Read calls. A zero value for t means Read will not time out.
+func (c *ARQConn) SetReadDeadline(t time.Time) error {
+	c.rdead = t
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls. A zero value for t means Write will not time out.
+func (c *ARQConn) SetWriteDeadline(t time.Time) error {
+	c.wdead = t
+	return nil
+}
+
+func (c *ARQConn) send(dst []byte) (int, error) {
+	const payloadoffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+	if !c.running {
+		return 0, io.EOF
+	}
+	now := c.stack.now()
+	if !c.deadline.IsZero() && !now.Before(c.deadline) {
+		// Go-back-N: resend every unacknowledged message.
+		if c.retries >= c.cfg.MaxRetransmits {
+			c.stack.error("ARQ:timeout", slog.Uint64("port", uint64(c.cfg.LocalPort)), slog.Uint64("seq", uint64(c.una)))
+			c.err = errARQTimeout
+			c.abort()
+			return 0, io.EOF
+		}
+		c.retries++
+		c.nxt = c.una
+		c.deadline = time.Time{}
+		c.stack.debug("ARQ:retransmit", slog.Uint64("seq", uint64(c.una)), slog.Int("retries", int(c.retries)))
+	}
+	sendData := c.nxt != c.end
+	if !c.ackPending && !sendData {
+		return 0, nil
+	}
+	remote := c.cfg.Remote.Addr().As4()
+	if c.hw == [6]byte{} {
+		hw, err := c.stack.arpClient.resolve(remote)
+		if err == errARPResponsePending {
+			return 0, ErrFlagPending
+		} else if err != nil {
+			c.stack.error("ARQ:unresolved", c.stack.addrAttr("remote", remote))
+			c.err = err
+			c.abort()
+			return 0, io.EOF
+		}
+		c.hw = hw
+	}
+	var payload []byte
+	if c.ackPending {
+		// Acknowledgements take precedence so the remote's window keeps moving.
+		payload = dst[payloadoffset : payloadoffset+sizeARQHeader]
+		payload[0], payload[1] = arqKindAck, 0
+		binary.BigEndian.PutUint16(payload[2:], c.rcvnxt)
+		c.ackPending = false
+	} else {
+		slot := int(c.nxt % uint16(c.cfg.Window))
+		off := slot * int(c.cfg.MaxMessageSize)
+		msg := c.txbuf[off : off+int(c.txlen[slot])]
+		if len(dst) < payloadoffset+sizeARQHeader+len(msg) {
+			return 0, io.ErrShortBuffer
+		}
+		payload = dst[payloadoffset : payloadoffset+sizeARQHeader+len(msg)]
+		payload[0], payload[1] = arqKindData, 0
+		binary.BigEndian.PutUint16(payload[2:], c.nxt)
+		copy(payload[sizeARQHeader:], msg)
+		c.nxt++
+		if c.deadline.IsZero() {
+			c.deadline = now.Add(c.cfg.Timeout)
+		}
+	}
+	const ipv4ToS = 0
+	c.stack.setUDP(&c.pkt, c.hw, c.stack.ip, remote, ipv4ToS, payload, c.cfg.LocalPort, c.cfg.Remote.Port())
+	c.pkt.PutHeaders(dst)
+	if c.ackPending || c.nxt != c.end {
+		return payloadoffset + len(payload), ErrFlagPending
+	}
+	return payloadoffset + len(payload), nil
+}
+
+func (c *ARQConn) recv(pkt *UDPPacket) error {
+	if !c.running {
+		return io.EOF
+	}
+	payload := pkt.Payload()
+	remote := netip.AddrPortFrom(netip.AddrFrom4(pkt.IP.Source), pkt.UDP.SourcePort)
+	if remote != c.cfg.Remote || len(payload) < sizeARQHeader {
+		return nil // Not from remote or malformed.
+	}
+	seq := binary.BigEndian.Uint16(payload[2:])
+	switch payload[0] {
+	case arqKindAck:
+		acked := seq - c.una
+		if acked == 0 || acked > c.end-c.una {
+			return nil // Duplicate or bogus acknowledgement.
+		}
+		c.una = seq
+		if int16(c.nxt-c.una) < 0 {
+			c.nxt = c.una // Acknowledged messages being retransmitted.
+		}
+		c.retries = 0
+		c.deadline = time.Time{}
+		if c.una != c.nxt {
+			c.deadline = c.stack.now().Add(c.cfg.Timeout)
+		}
+	case arqKindData:
+		msg := payload[sizeARQHeader:]
+		if seq == c.rcvnxt && c.rx.Free() >= 2+len(msg) {
+			var hdr [2]byte
+			binary.BigEndian.PutUint16(hdr[:], uint16(len(msg)))
+			c.rx.Write(hdr[:])
+			c.rx.Write(msg)
+			c.rcvnxt++
+		}
+		// Duplicates and out of order messages are acknowledged again so
+		// that a lost acknowledgement does not stall the remote.
+		c.ackPending = true
+		return c.stack.RequestSendUDP(c.cfg.LocalPort)
+	}
+	return nil
+}
+
+func (c *ARQConn) isPendingHandling() bool {
+	return c.running && (c.ackPending || c.una != c.end)
+}
+
+func (c *ARQConn) abort() {
+	c.running = false
+	c.una, c.nxt, c.end, c.rcvnxt = 0, 0, 0, 0
+	c.deadline = time.Time{}
+	c.retries = 0
+	c.ackPending = false
+	c.rx.Reset()
+}
+
+// checkOpen returns the error that failed the connection or net.ErrClosed if closed.
+func (c *ARQConn) checkOpen() error {
+	if c.err != nil {
+		return c.err
+	} else if !c.running {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func (c *ARQConn) deadlineExceeded(dead time.Time) bool {
+	return !dead.IsZero() && time.Since(dead) > 0
+}
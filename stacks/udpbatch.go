@@ -0,0 +1,112 @@
+package stacks
+
+import "net/netip"
+
+// UDPMessage is a datagram read or written in batches with [UDPConn.ReadBatch]
+// and [UDPConn.WriteBatch], in the style of the recvmmsg and sendmmsg system calls.
+type UDPMessage struct {
+	// Payload is the buffer the datagram is read into or the datagram to write.
+	Payload []byte
+	// N is the amount of bytes of Payload read or written.
+	N int
+	// Remote is the datagram's sender or destination address. When writing
+	// on a connected socket a zero value selects the connected remote.
+	Remote netip.AddrPort
+	// RemoteMAC is the hardware address of the sender or the next hop to the destination.
+	RemoteMAC [6]byte
+}
+
+// ReadBatch reads multiple datagrams into msgs and returns the amount read.
+// It blocks as [UDPConn.ReadFrom] until a datagram is available and then reads
+// datagrams already received until msgs is filled without blocking again.
+func (sock *UDPConn) ReadBatch(msgs []UDPMessage) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	m := &msgs[0]
+	var err error
+	m.N, m.Remote, m.RemoteMAC, err = sock.ReadFrom(m.Payload)
+	if err != nil {
+		return 0, err
+	}
+	n := 1
+	for ; n < len(msgs) && sock.rx.Buffered() > 0; n++ {
+		m = &msgs[n]
+		m.N, m.Remote, m.RemoteMAC = sock.readRecord(m.Payload)
+	}
+	return n, nil
+}
+
+// WriteBatch queues the datagrams in msgs to be sent and returns the amount
+// queued. The stack is signaled once for the whole batch. Like
+// [UDPConn.WriteTo] it blocks while the output buffer is full and stops at
+// the first datagram that cannot be queued, returning the error.
+func (sock *UDPConn) WriteBatch(msgs []UDPMessage) (n int, err error) {
+	for n < len(msgs) {
+		m := &msgs[n]
+		remote, remoteMAC := m.Remote, m.RemoteMAC
+		switch {
+		case !remote.IsValid() && !sock.connected:
+			err = errUDPNotConnected
+		case !remote.IsValid():
+			remote, remoteMAC = sock.remote, sock.remoteMAC
+		case !sock.stack.supportsAddr(remote.Addr()):
+			err = errIPVersion
+		case remote.Port() == 0:
+			err = errZeroPort
+		}
+		if err == nil && n == 0 && sock.connected {
+			err = sock.takeICMPErr()
+		}
+		if err == nil {
+			err = sock.enqueue(m.Payload, remoteMAC, remote)
+		}
+		if err != nil {
+			break
+		}
+		m.N = len(m.Payload)
+		n++
+	}
+	if n > 0 {
+		if rerr := sock.stack.RequestSendUDP(sock.localPort); rerr != nil {
+			return n, rerr
+		}
+	}
+	return n, err
+}
+
+// RecvEthBatch passes each of frames to [PortStack.RecvEth], such as frames
+// read in a single transfer from a NIC's receive ring. Errors processing a
+// frame do not stop the batch. It returns the amount of frames processed
+// without error and the first error encountered.
+func (ps *PortStack) RecvEthBatch(frames [][]byte) (n int, err error) {
+	for i := range frames {
+		rerr := ps.RecvEth(frames[i])
+		if rerr == nil {
+			n++
+		} else if err == nil {
+			err = rerr
+		}
+	}
+	return n, err
+}
+
+// HandleEthBatch writes up to len(dst) pending frames generated by
+// [PortStack.HandleEth], one into each buffer of dst, so they can be handed to
+// a NIC in a single transfer. Each buffer must be at least MTU long and is
+// resliced to the length of the frame written. It returns the amount of
+// frames written, stopping early when there is nothing left to send.
+// Only the outcome of the last frame can be reported with [PortStack.TxDone].
+func (ps *PortStack) HandleEthBatch(dst [][]byte) (n int, err error) {
+	for n < len(dst) && ps.IsPendingHandling() {
+		nframe, err := ps.HandleEth(dst[n])
+		if err != nil {
+			return n, err
+		} else if nframe == 0 {
+			break
+		}
+		dst[n] = dst[n][:nframe]
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,517 @@
+package stacks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/soypat/seqs/eth"
+	"github.com/soypat/seqs/internal"
+)
+
+var _ iudphandler = (*UDPConn)(nil)
+
+const (
+	defaultUDPConnSize = 1024
+	// sizeUDPRecord is the size of the header preceding each datagram in the
+	// socket buffers: payload length, port, IPv6 or IPv4-mapped address and hardware address.
+	sizeUDPRecord = 2 + 2 + 16 + 6
+)
+
+var (
+	errUDPNotConnected    = errors.New("UDP socket not connected")
+	errUDPTooLong         = errors.New("UDP datagram does not fit socket buffer")
+	errUDPPortUnreachable = errors.New("UDP remote port unreachable")
+	errUDPHostUnreachable = errors.New("UDP remote host unreachable")
+)
+
+// UDPConn is a datagram socket intended for use with PortStack. Datagrams
+// are queued in the socket's buffers until sent by the stack or read by
+// the user. Datagrams that do not fit the receive buffer are dropped.
+//
+// A UDPConn may be associated with a single remote with [UDPConn.Connect].
+// A connected socket only receives datagrams from its remote and is notified
+// by ICMP destination unreachable messages concerning the datagrams it sent.
+// [UDPConn.PacketConn] adapts the socket to the [net.PacketConn] interface.
+type UDPConn struct {
+	stack     *PortStack
+	rdead     time.Time
+	wdead     time.Time
+	pkt       UDPPacket
+	tx        ring
+	rx        ring
+	localPort uint16
+	// ntx is the amount of complete datagrams in tx.
+	ntx       int
+	remote    netip.AddrPort
+	remoteMAC [6]byte
+	connected bool
+	// icmpErr is set when an ICMP error for the connected remote is received.
+	// It is returned by the next Read or Write call.
+	icmpErr error
+	// lastRemote is the destination of the last datagram sent. See txdone.go.
+	lastRemote netip.AddrPort
+	onTxDone   func(remote netip.AddrPort, err error)
+	// frag is the datagram being sent in fragments. See ipfrag.go.
+	frag udpFrag
+	// flow accounts the packets exchanged with the connected remote. See flowexport.go.
+	flow flowCount
+	// rates meters the payload received and sent. See ratemeter.go.
+	rates byteRates
+	// groups are the IPv4 multicast groups joined by the socket, zero if unused.
+	groups [maxMulticastGroups][4]byte
+}
+
+type UDPConnConfig struct {
+	TxBufSize uint16
+	RxBufSize uint16
+}
+
+// NewUDPConn creates a UDP socket. Each buffer must be able to hold at least
+// one datagram plus 26 bytes of addressing information.
+func NewUDPConn(stack *PortStack, cfg UDPConnConfig) (*UDPConn, error) {
+	if cfg.RxBufSize == 0 {
+		cfg.RxBufSize = defaultUDPConnSize
+	}
+	if cfg.TxBufSize == 0 {
+		cfg.TxBufSize = defaultUDPConnSize
+	}
+	buf := make([]byte, int(cfg.RxBufSize)+int(cfg.TxBufSize))
+	return &UDPConn{
+		stack: stack,
+		tx:    ring{buf: buf[:cfg.TxBufSize]},
+		rx:    ring{buf: buf[cfg.TxBufSize:]},
+	}, nil
+}
+
+// PortStack returns the PortStack that this socket is attached to.
+func (sock *UDPConn) PortStack() *PortStack { return sock.stack }
+
+// LocalPort returns the local port the socket is open on. It returns zero if the socket is closed.
+func (sock *UDPConn) LocalPort() uint16 { return sock.localPort }
+
+// RemoteAddr returns the address the socket is connected to. It returns
+// the zero value if the socket is not connected.
+func (sock *UDPConn) RemoteAddr() netip.AddrPort { return sock.remote }
+
+// Open opens the socket on localPort. The socket is not connected to a remote.
+func (sock *UDPConn) Open(localPort uint16) error {
+	sock.reset()
+	err := sock.stack.OpenUDP(localPort, sock)
+	if err != nil {
+		return err
+	}
+	sock.localPort = localPort
+	return nil
+}
+
+// Connect associates the socket with remote, reachable through the hardware
+// address remoteMAC. Afterwards only datagrams from remote are received and
+// [UDPConn.Write] sends to remote. Received datagrams not yet read are
+// discarded. Calling Connect with a zero remote dissolves the association.
+func (sock *UDPConn) Connect(remoteMAC [6]byte, remote netip.AddrPort) error {
+	if sock.localPort == 0 {
+		return net.ErrClosed
+	}
+	sock.endFlow()
+	if remote == (netip.AddrPort{}) {
+		sock.connected = false
+		sock.remote = netip.AddrPort{}
+		sock.icmpErr = nil
+		return nil
+	} else if !sock.stack.supportsAddr(remote.Addr()) {
+		return errIPVersion
+	} else if remote.Port() == 0 {
+		return errZeroPort
+	}
+	sock.rx.Reset()
+	sock.remote = remote
+	sock.remoteMAC = remoteMAC
+	sock.connected = true
+	sock.icmpErr = nil
+	sock.flow.start = sock.stack.now()
+	return nil
+}
+
+// Write queues b to be sent as a single datagram to the connected remote.
+func (sock *UDPConn) Write(b []byte) (int, error) {
+	if !sock.connected {
+		return 0, errUDPNotConnected
+	} else if err := sock.takeICMPErr(); err != nil {
+		return 0, err
+	}
+	return sock.writeTo(b, sock.remoteMAC, sock.remote)
+}
+
+// WriteTo queues b to be sent as a single datagram to remote, reachable
+// through the hardware address remoteMAC. If remoteMAC is zero it is resolved
+// before sending. WriteTo blocks until there is room for the datagram in the
+// output buffer or the write deadline is exceeded. remote may be an IPv6
+// address if IPv6 is enabled on the stack.
+func (sock *UDPConn) WriteTo(b []byte, remoteMAC [6]byte, remote netip.AddrPort) (int, error) {
+	if !sock.stack.supportsAddr(remote.Addr()) {
+		return 0, errIPVersion
+	} else if remote.Port() == 0 {
+		return 0, errZeroPort
+	}
+	return sock.writeTo(b, remoteMAC, remote)
+}
+
+func (sock *UDPConn) writeTo(b []byte, remoteMAC [6]byte, remote netip.AddrPort) (int, error) {
+	err := sock.enqueue(b, remoteMAC, remote)
+	if err != nil {
+		return 0, err
+	}
+	err = sock.stack.RequestSendUDP(sock.localPort)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// enqueue queues b in the output buffer blocking until there is room for it.
+// Datagrams already queued are flagged to be sent before blocking.
+func (sock *UDPConn) enqueue(b []byte, remoteMAC [6]byte, remote netip.AddrPort) error {
+	if sock.localPort == 0 {
+		return net.ErrClosed
+	} else if sizeUDPRecord+len(b) > len(sock.tx.buf) || len(b) > maxUDPFragmented ||
+		remote.Addr().Is6() && sizeUDPv6NoPayload+len(b) > int(sock.stack.mtu) {
+		return errUDPTooLong // IPv6 datagrams are not fragmented.
+	}
+	if sock.tx.Free() < sizeUDPRecord+len(b) && sock.ntx > 0 {
+		err := sock.stack.RequestSendUDP(sock.localPort)
+		if err != nil {
+			return err
+		}
+	}
+	backoff := internal.NewBackoff(internal.BackoffHasPriority)
+	for sock.tx.Free() < sizeUDPRecord+len(b) {
+		if sock.localPort == 0 {
+			return net.ErrClosed
+		} else if sock.deadlineExceeded(sock.wdead) {
+			return os.ErrDeadlineExceeded
+		}
+		backoff.Miss()
+	}
+	hdr := putUDPRecord(len(b), remoteMAC, remote)
+	sock.tx.Write(hdr[:])
+	sock.tx.Write(b)
+	sock.ntx++
+	return nil
+}
+
+// Read reads a single datagram into b. If b is smaller than the datagram the
+// excess data is discarded. Read blocks until a datagram is received, the
+// read deadline is exceeded or, if connected, an ICMP error is received.
+func (sock *UDPConn) Read(b []byte) (int, error) {
+	n, _, _, err := sock.ReadFrom(b)
+	return n, err
+}
+
+// ReadFrom is like [UDPConn.Read] but also returns the address and hardware
+// address of the datagram's sender.
+func (sock *UDPConn) ReadFrom(b []byte) (n int, remote netip.AddrPort, remoteMAC [6]byte, err error) {
+	backoff := internal.NewBackoff(internal.BackoffHasPriority)
+	for sock.rx.Buffered() == 0 {
+		if sock.localPort == 0 {
+			return 0, remote, remoteMAC, net.ErrClosed
+		} else if err = sock.takeICMPErr(); err != nil {
+			return 0, remote, remoteMAC, err
+		} else if sock.deadlineExceeded(sock.rdead) {
+			return 0, remote, remoteMAC, os.ErrDeadlineExceeded
+		}
+		backoff.Miss()
+	}
+	n, remote, remoteMAC = sock.readRecord(b)
+	return n, remote, remoteMAC, nil
+}
+
+// readRecord reads the oldest received datagram into b, discarding excess data.
+func (sock *UDPConn) readRecord(b []byte) (n int, remote netip.AddrPort, remoteMAC [6]byte) {
+	var hdr [sizeUDPRecord]byte
+	sock.rx.Read(hdr[:])
+	plen, remoteMAC, remote := decodeUDPRecord(hdr)
+	n = plen
+	if n > len(b) {
+		n = len(b)
+	}
+	sock.rx.Read(b[:n])
+	sock.discardRx(plen - n)
+	return n, remote, remoteMAC
+}
+
+// SetDeadline sets the read and write deadlines of the socket. A zero value for t means no deadline.
+// Deadlines are compared against the stack's clock, see [PortStackConfig.Clock].
+func (sock *UDPConn) SetDeadline(t time.Time) error {
+	sock.rdead = t
+	sock.wdead = t
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future Read calls. A zero value for t means Read will not time out.
+func (sock *UDPConn) SetReadDeadline(t time.Time) error {
+	sock.rdead = t
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls. A zero value for t means Write will not time out.
+func (sock *UDPConn) SetWriteDeadline(t time.Time) error {
+	sock.wdead = t
+	return nil
+}
+
+// Close closes the socket's port. Datagrams not yet sent are discarded.
+func (sock *UDPConn) Close() error {
+	if sock.localPort == 0 {
+		return net.ErrClosed
+	}
+	err := sock.stack.CloseUDP(sock.localPort)
+	sock.reset()
+	return err
+}
+
+func (sock *UDPConn) send(dst []byte) (int, error) {
+	const payloadOffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+	if sock.frag.size > 0 {
+		return sock.sendFragment(dst)
+	} else if sock.ntx == 0 {
+		return 0, nil
+	}
+	var hdr [sizeUDPRecord]byte
+	sock.tx.peek(hdr[:], 0)
+	plen, remoteMAC, remote := decodeUDPRecord(hdr)
+	if remoteMAC == [6]byte{} {
+		// Datagram waits in queue until the destination is resolved. See arpcache.go and ndp.go.
+		var hw [6]byte
+		var err error
+		if remote.Addr().Is6() {
+			hw, err = sock.stack.resolve6(remote.Addr().As16())
+		} else {
+			hw, err = sock.stack.arpClient.resolve(remote.Addr().As4())
+		}
+		if err == errARPResponsePending {
+			if sock.queueUnresolved(plen, remote) && sock.ntx == 0 {
+				return 0, nil // Sent by the stack once resolved. See arpqueue.go.
+			}
+			return 0, ErrFlagPending
+		} else if err != nil {
+			if sock.stack.isLogEnabled(slog.LevelError) {
+				sock.stack.error("UDP:drop-unresolved", slog.Uint64("port", uint64(sock.localPort)), slog.String("remote", remote.String()), slog.String("err", err.Error()))
+			}
+			sock.tx.discard(sizeUDPRecord)
+			sock.ntx--
+			sock.discardTx(plen)
+			if sock.connected && remote == sock.remote {
+				sock.icmpErr = errUDPHostUnreachable
+			}
+			if sock.ntx > 0 {
+				return 0, ErrFlagPending
+			}
+			return 0, nil
+		}
+		remoteMAC = hw
+	}
+	sock.tx.discard(sizeUDPRecord)
+	sock.ntx--
+	if remote.Addr().Is6() {
+		return sock.send6(dst, plen, remoteMAC, remote)
+	} else if payloadOffset+plen > int(sock.stack.mtu) {
+		// Datagrams exceeding the MTU are sent as IP fragments.
+		sock.rates.tx.add(sock.stack.now(), plen)
+		sock.beginFragments(plen, remoteMAC, remote)
+		return sock.sendFragment(dst)
+	} else if payloadOffset+plen > len(dst) {
+		sock.discardTx(plen)
+		return 0, io.ErrShortBuffer
+	}
+	n := sock.putDatagram(dst, plen, remoteMAC, remote)
+	if sock.ntx > 0 {
+		return n, ErrFlagPending
+	}
+	return n, nil
+}
+
+// putDatagram writes the frame of the datagram of plen bytes at the head of
+// the output buffer to dst, which must fit it, and returns its length.
+func (sock *UDPConn) putDatagram(dst []byte, plen int, remoteMAC [6]byte, remote netip.AddrPort) int {
+	const payloadOffset = eth.SizeEthernetHeader + eth.SizeIPv4Header + eth.SizeUDPHeader
+	payload := dst[payloadOffset : payloadOffset+plen]
+	sock.tx.Read(payload)
+	const ipv4ToS = 0
+	ps := sock.stack
+	ps.setUDP(&sock.pkt, remoteMAC, ps.ip, remote.Addr().As4(), ipv4ToS, payload, sock.localPort, remote.Port())
+	sock.pkt.PutHeaders(dst)
+	sock.lastRemote = remote
+	sock.rates.tx.add(sock.stack.now(), plen)
+	if sock.connected && remote == sock.remote {
+		sock.flow.onsend(eth.SizeIPv4Header + eth.SizeUDPHeader + plen)
+	}
+	return payloadOffset + plen
+}
+
+func (sock *UDPConn) recv(pkt *UDPPacket) error {
+	payload := pkt.Payload()
+	remote := netip.AddrPortFrom(netip.AddrFrom4(pkt.IP.Source), pkt.UDP.SourcePort)
+	if payload == nil {
+		return nil // Bad datagram.
+	}
+	return sock.queueRx(remote, pkt.Eth.Source, payload, pkt.Rx, int(pkt.IP.TotalLength))
+}
+
+// queueRx queues a datagram received from remote through hardware address hw
+// in an IP packet of iplen bytes to be read.
+func (sock *UDPConn) queueRx(remote netip.AddrPort, hw [6]byte, payload []byte, rx time.Time, iplen int) error {
+	if sock.connected && remote != sock.remote {
+		if sock.stack.isLogEnabled(slog.LevelDebug) {
+			sock.stack.debug("UDP:drop", slog.Uint64("port", uint64(sock.localPort)), slog.String("reason", "not from connected remote"))
+		}
+		return nil // Not from the connected remote.
+	} else if sock.rx.Free() < sizeUDPRecord+len(payload) {
+		sock.stack.droppedPackets++
+		if sock.stack.isLogEnabled(slog.LevelInfo) {
+			sock.stack.info("UDP:drop", slog.Uint64("port", uint64(sock.localPort)), slog.String("reason", "receive buffer full"))
+		}
+		return nil
+	}
+	hdr := putUDPRecord(len(payload), hw, remote)
+	sock.rx.Write(hdr[:])
+	sock.rx.Write(payload)
+	sock.rates.rx.add(rx, len(payload))
+	if sock.connected {
+		sock.flow.onrecv(iplen)
+	}
+	return nil
+}
+
+// recvICMPError is called by the stack when an ICMP destination unreachable
+// message in response to a datagram sent from the socket's port to dst is received.
+func (sock *UDPConn) recvICMPError(code uint8, dst netip.AddrPort) {
+	if !sock.connected || dst != sock.remote {
+		return // Unconnected sockets do not receive errors, as in BSD sockets.
+	}
+	sock.icmpErr = errUDPHostUnreachable
+	if code == icmpCodePortUnreachable {
+		sock.icmpErr = errUDPPortUnreachable
+	}
+}
+
+func (sock *UDPConn) isPendingHandling() bool { return sock.ntx > 0 || sock.frag.size > 0 }
+
+// JoinGroup makes the socket receive datagrams sent to the IPv4 multicast
+// group, i.e: 239.255.255.250 for SSDP. The stack subscribes to the group's
+// hardware address and reports the membership with IGMPv2 so that routers and
+// switches doing IGMP snooping forward the group's traffic. Groups joined are
+// left when the socket is closed.
+func (sock *UDPConn) JoinGroup(group netip.Addr) error {
+	if sock.localPort == 0 {
+		return net.ErrClosed
+	}
+	free := -1
+	for i, g := range sock.groups {
+		if g == [4]byte{} && free < 0 {
+			free = i
+		} else if group.Is4() && g == group.As4() {
+			return nil // Already joined.
+		}
+	}
+	if free < 0 {
+		return errGroupsFull
+	}
+	err := sock.stack.joinGroup(group)
+	if err != nil {
+		return err
+	}
+	sock.groups[free] = group.As4()
+	return nil
+}
+
+// LeaveGroup stops the socket from receiving datagrams sent to group. An IGMP
+// leave message is sent if no other socket or service of the stack joined group.
+func (sock *UDPConn) LeaveGroup(group netip.Addr) error {
+	if sock.localPort == 0 {
+		return net.ErrClosed
+	}
+	for i, g := range sock.groups {
+		if g != [4]byte{} && group.Is4() && g == group.As4() {
+			sock.groups[i] = [4]byte{}
+			sock.stack.leaveGroup(group)
+			return nil
+		}
+	}
+	return errNotGroupAddr
+}
+
+func (sock *UDPConn) abort() { sock.reset() }
+
+func (sock *UDPConn) reset() {
+	for i, g := range sock.groups {
+		if g != [4]byte{} {
+			sock.groups[i] = [4]byte{}
+			sock.stack.leaveGroup(netip.AddrFrom4(g))
+		}
+	}
+	sock.endFlow()
+	sock.tx.Reset()
+	sock.rx.Reset()
+	sock.ntx = 0
+	sock.frag = udpFrag{}
+	sock.rates = byteRates{}
+	sock.localPort = 0
+	sock.connected = false
+	sock.remote = netip.AddrPort{}
+	sock.icmpErr = nil
+}
+
+func (sock *UDPConn) takeICMPErr() error {
+	err := sock.icmpErr
+	sock.icmpErr = nil
+	return err
+}
+
+func (sock *UDPConn) deadlineExceeded(dead time.Time) bool {
+	return deadlineExceeded(sock.stack, dead)
+}
+
+func (sock *UDPConn) discardRx(n int) {
+	var buf [64]byte
+	for n > 0 {
+		ngot, _ := sock.rx.Read(buf[:min(n, len(buf))])
+		n -= ngot
+	}
+}
+
+func (sock *UDPConn) discardTx(n int) {
+	var buf [64]byte
+	for n > 0 {
+		ngot, _ := sock.tx.Read(buf[:min(n, len(buf))])
+		n -= ngot
+	}
+}
+
+func putUDPRecord(plen int, hw [6]byte, addr netip.AddrPort) (hdr [sizeUDPRecord]byte) {
+	binary.BigEndian.PutUint16(hdr[0:], uint16(plen))
+	binary.BigEndian.PutUint16(hdr[2:], addr.Port())
+	ip := addr.Addr().As16() // IPv4 addresses are stored mapped.
+	copy(hdr[4:20], ip[:])
+	copy(hdr[20:], hw[:])
+	return hdr
+}
+
+func decodeUDPRecord(hdr [sizeUDPRecord]byte) (plen int, hw [6]byte, addr netip.AddrPort) {
+	plen = int(binary.BigEndian.Uint16(hdr[0:]))
+	addr = netip.AddrPortFrom(netip.AddrFrom16([16]byte(hdr[4:20])).Unmap(), binary.BigEndian.Uint16(hdr[2:]))
+	copy(hw[:], hdr[20:])
+	return plen, hw, addr
+}
+
+// endFlow exports the accounting of the connected remote's flow.
+func (sock *UDPConn) endFlow() {
+	if sock.connected {
+		sock.stack.endFlow(&sock.flow, 17, sock.stack.ip, sock.localPort, sock.remote)
+	}
+}
@@ -0,0 +1,89 @@
+package stacks
+
+import (
+	"net"
+	"net/netip"
+	"time"
+)
+
+var _ net.PacketConn = (*udpPacketConn)(nil)
+
+// resolveTimeout bounds hardware address resolution by [net.PacketConn]
+// writes when no write deadline is set. ARP retries usually fail first.
+const resolveTimeout = 10 * time.Second
+
+// udpPacketConn adapts a UDPConn to [net.PacketConn].
+type udpPacketConn struct {
+	sock *UDPConn
+	// laddr and raddr are returned by LocalAddr and ReadFrom to avoid allocating.
+	laddr net.UDPAddr
+	raddr net.UDPAddr
+}
+
+// PacketConn returns a [net.PacketConn] using the socket, so that protocols
+// such as DNS, SNTP or CoAP written against the standard library run over
+// the stack. Addresses are of type *net.UDPAddr. The address returned by
+// ReadFrom is only valid until the next call. WriteTo resolves the hardware
+// address of IPv4 destinations with ARP, blocking until it is resolved or the
+// write deadline is exceeded. IPv6 destinations are resolved with neighbor
+// discovery after the datagram is queued. Closing the PacketConn closes the socket.
+func (sock *UDPConn) PacketConn() net.PacketConn {
+	return &udpPacketConn{sock: sock}
+}
+
+// ReadFrom implements [net.PacketConn].
+func (pc *udpPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, remote, _, err := pc.sock.ReadFrom(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	pc.raddr = net.UDPAddr{IP: remote.Addr().AsSlice(), Port: int(remote.Port())}
+	return n, &pc.raddr, nil
+}
+
+// WriteTo implements [net.PacketConn].
+func (pc *udpPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok || uaddr == nil {
+		return 0, net.InvalidAddrError("not a UDP address")
+	}
+	ap := uaddr.AddrPort()
+	remote := netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	if !pc.sock.stack.supportsAddr(remote.Addr()) {
+		return 0, errIPVersion
+	}
+	sock := pc.sock
+	hw := sock.remoteMAC
+	if remote.Addr().Is6() {
+		hw = [6]byte{} // Resolved with neighbor discovery once queued.
+	} else if !sock.connected || remote.Addr() != sock.remote.Addr() {
+		timeout := resolveTimeout
+		if !sock.wdead.IsZero() {
+			timeout = time.Until(sock.wdead)
+		}
+		var err error
+		hw, err = sock.stack.ARP().Resolve(remote.Addr(), timeout)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return sock.WriteTo(b, hw, remote)
+}
+
+// Close implements [net.PacketConn].
+func (pc *udpPacketConn) Close() error { return pc.sock.Close() }
+
+// LocalAddr implements [net.PacketConn].
+func (pc *udpPacketConn) LocalAddr() net.Addr {
+	pc.laddr = net.UDPAddr{IP: pc.sock.stack.ip[:], Port: int(pc.sock.localPort)}
+	return &pc.laddr
+}
+
+// SetDeadline implements [net.PacketConn].
+func (pc *udpPacketConn) SetDeadline(t time.Time) error { return pc.sock.SetDeadline(t) }
+
+// SetReadDeadline implements [net.PacketConn].
+func (pc *udpPacketConn) SetReadDeadline(t time.Time) error { return pc.sock.SetReadDeadline(t) }
+
+// SetWriteDeadline implements [net.PacketConn].
+func (pc *udpPacketConn) SetWriteDeadline(t time.Time) error { return pc.sock.SetWriteDeadline(t) }
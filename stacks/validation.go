@@ -0,0 +1,133 @@
+package stacks
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/soypat/seqs/eth"
+)
+
+var (
+	errBadIPChecksum   = errors.New("invalid IPv4 header checksum")
+	errNonConformant   = errors.New("non-conformant packet dropped by strict validation")
+	errBadValidationMd = errors.New("invalid validation mode")
+)
+
+// Validation selects how the stack treats received packets that deviate
+// from the protocol specifications. Deviations are counted in
+// [Health.Deviations] whether the packet is dropped or not.
+type Validation uint8
+
+const (
+	// ValidationDefault drops packets with bad TCP or UDP checksums and
+	// tolerates other deviations.
+	ValidationDefault Validation = iota
+	// ValidationStrict drops every packet found to be non-conformant. Intended
+	// for security sensitive deployments.
+	ValidationStrict
+	// ValidationLoose tolerates common real world quirks, such as bad
+	// checksums sent by buggy devices or DHCP servers omitting the message type.
+	ValidationLoose
+	numValidations
+)
+
+// SetValidation sets how received packets deviating from the protocol specifications are treated.
+func (ps *PortStack) SetValidation(v Validation) error {
+	if v >= numValidations {
+		return errBadValidationMd
+	}
+	ps.validation = v
+	return nil
+}
+
+// Validation returns how received packets deviating from the protocol specifications are treated.
+func (ps *PortStack) Validation() Validation { return ps.validation }
+
+// deviation counts a received packet deviating from the specifications and
+// reports whether it must be dropped. lenient is set for deviations
+// tolerated by [ValidationDefault].
+func (ps *PortStack) deviation(what string, lenient bool) (drop bool) {
+	ps.deviations++
+	switch ps.validation {
+	case ValidationStrict:
+		drop = true
+	case ValidationLoose:
+		drop = false
+	default:
+		drop = !lenient
+	}
+	if ps.isLogEnabled(slog.LevelDebug) {
+		ps.debug("VALIDATE:deviation", slog.String("what", what), slog.Bool("drop", drop))
+	}
+	return drop
+}
+
+// ChecksumOffload is a set of checksums of received packets verified by the
+// NIC in hardware. The stack skips verifying them, saving the CPU time of
+// summing every received byte. NICs verifying checksums are expected to drop
+// frames failing verification, so they are not counted in [Health].
+type ChecksumOffload uint8
+
+const (
+	// ChecksumOffloadIPv4 is set when the NIC verifies IPv4 header checksums.
+	ChecksumOffloadIPv4 ChecksumOffload = 1 << iota
+	// ChecksumOffloadTCP is set when the NIC verifies TCP checksums.
+	ChecksumOffloadTCP
+	// ChecksumOffloadUDP is set when the NIC verifies UDP and UDP-Lite checksums.
+	ChecksumOffloadUDP
+	// ChecksumOffloadAll is set when the NIC verifies all checksums.
+	ChecksumOffloadAll = ChecksumOffloadIPv4 | ChecksumOffloadTCP | ChecksumOffloadUDP
+)
+
+// SetChecksumOffload sets the checksums of received packets verified by the NIC.
+func (ps *PortStack) SetChecksumOffload(offload ChecksumOffload) {
+	ps.checksumOffload = offload & ChecksumOffloadAll
+}
+
+// checksumCounts counts received packets with invalid checksums per protocol.
+type checksumCounts struct {
+	ip, tcp, udp uint32
+}
+
+// validIPChecksum verifies the checksum of the IPv4 header hdr, options included.
+func (ps *PortStack) validIPChecksum(hdr []byte) bool {
+	var crc eth.CRC791
+	crc.Write(hdr)
+	if crc.Sum16() != 0 {
+		ps.badChecksums.ip++
+		return false
+	}
+	return true
+}
+
+// validUDPChecksum verifies the checksum of a UDP or UDP-Lite datagram.
+// A zero UDP checksum means the sender computed none and a computed checksum
+// of zero is sent as 0xffff (RFC 768). UDP-Lite datagrams must carry a
+// checksum (RFC 3828 section 3.1).
+func (ps *PortStack) validUDPChecksum(ihdr *eth.IPv4Header, uhdr *eth.UDPHeader, payload []byte, lite bool) bool {
+	var sum uint16
+	if lite {
+		sum = uhdr.CalculateChecksumLiteIPv4(ihdr, payload)
+	} else if uhdr.Checksum == 0 {
+		return true
+	} else {
+		sum = uhdr.CalculateChecksumIPv4(ihdr, payload)
+		if sum == 0 {
+			sum = 0xffff
+		}
+	}
+	if sum != uhdr.Checksum || lite && uhdr.Checksum == 0 {
+		ps.badChecksums.udp++
+		return false
+	}
+	return true
+}
+
+// validTCPChecksum verifies the checksum of a TCP segment.
+func (ps *PortStack) validTCPChecksum(ihdr *eth.IPv4Header, thdr *eth.TCPHeader, options, payload []byte) bool {
+	if thdr.CalculateChecksumIPv4(ihdr, options, payload) != thdr.Checksum {
+		ps.badChecksums.tcp++
+		return false
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+package stacks
+
+import (
+	"errors"
+
+	"github.com/soypat/seqs/eth"
+)
+
+var errVLANNoRoom = errors.New("no room in buffer for VLAN tag")
+
+// VLAN returns the 802.1Q VLAN identifier the stack is configured with, or
+// zero if frames are sent and received untagged. See [PortStackConfig.VLAN].
+func (ps *PortStack) VLAN() uint16 { return ps.vlan }
+
+// untagVLAN strips the 802.1Q tag of a received frame in place by moving the
+// hardware addresses over it. ok is false if the frame must be dropped since
+// it is not tagged with the stack's VLAN or is tagged while no VLAN is set.
+func (ps *PortStack) untagVLAN(frame []byte) (untagged []byte, ok bool) {
+	tagged := len(frame) >= eth.SizeEthernetHeader+eth.SizeVLANTag && eth.EtherType(eth.FieldEtherType.Get(frame)) == eth.EtherTypeVLAN
+	if !tagged {
+		return frame, ps.vlan == 0
+	}
+	_, tag, _ := eth.DecodeEthernetHeaderVLAN(frame)
+	if ps.vlan == 0 || tag.VID() != ps.vlan {
+		return nil, false
+	}
+	copy(frame[eth.SizeVLANTag:eth.SizeVLANTag+12], frame[:12])
+	return frame[eth.SizeVLANTag:], true
+}
+
+// tagVLAN inserts the 802.1Q tag of the stack's VLAN into the frame of length
+// n written to dst and returns the tagged length.
+func (ps *PortStack) tagVLAN(dst []byte, n int) (int, error) {
+	if n+eth.SizeVLANTag > len(dst) {
+		return 0, errVLANNoRoom
+	}
+	ehdr := eth.DecodeEthernetHeader(dst)
+	copy(dst[eth.SizeEthernetHeader+eth.SizeVLANTag:], dst[eth.SizeEthernetHeader:n])
+	ehdr.PutVLAN(dst, eth.MakeVLANTag(0, ps.vlan))
+	return n + eth.SizeVLANTag, nil
+}
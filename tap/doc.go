@@ -0,0 +1,28 @@
+// Package tap implements a NIC driver over Linux TAP devices so stacks may be
+// run against the host's own network stack and tools, i.e: curl, dhclient or
+// iperf, during development.
+//
+// Frames sent by the stack are received by the host on a virtual interface
+// created on [Open], and frames sent by the host through that interface are
+// read by the stack. The stack should be given a hardware address other than
+// the interface's. A typical setup assigns the interface an address on the
+// stack's subnet:
+//
+//	ip addr add 192.168.10.1/24 dev tap0
+//
+// Interfaces created by [Open] are removed on [Conn.Close]. Creating TAP devices
+// requires the CAP_NET_ADMIN capability, or a persistent device owned by the user.
+//
+// A typical main loop polls the stack with the [Conn.Recv] and [Conn.Send]
+// methods:
+//
+//	for {
+//		_, err := stack.Poll(buf, conn.Recv, conn.Send, stacks.PollBudget{})
+//		if err != nil {
+//			return err
+//		}
+//		conn.Wait(time.Millisecond)
+//	}
+//
+// The package is only supported on Linux.
+package tap
@@ -0,0 +1,191 @@
+package tap
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var errClosed = errors.New("tap: use of closed device")
+
+// Config configures a [Conn].
+type Config struct {
+	// Up brings the interface up on open so that the host sends and receives
+	// frames through it without further configuration.
+	Up bool
+}
+
+// Conn is a TAP device that sends and receives whole Ethernet frames to and
+// from the host. Its methods are not safe for concurrent use.
+type Conn struct {
+	fd    int
+	iface net.Interface
+}
+
+// Open creates, or attaches to if it exists, the TAP interface named ifname.
+// If ifname is empty the kernel picks a name such as tap0, see [Conn.Name].
+// The device is non-blocking: see [Conn.Recv] and [Conn.Wait].
+func Open(ifname string, cfg Config) (*Conn, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/net/tun", Err: err}
+	}
+	conn := &Conn{fd: fd}
+	err = conn.setup(ifname, cfg)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *Conn) setup(ifname string, cfg Config) error {
+	var req ifreq
+	if len(ifname) >= len(req.name) {
+		return errors.New("tap: interface name too long")
+	}
+	copy(req.name[:], ifname)
+	// No packet information header is prepended, frames are read and written as is.
+	req.flags = syscall.IFF_TAP | syscall.IFF_NO_PI
+	err := ioctl(c.fd, syscall.TUNSETIFF, &req)
+	if err != nil {
+		return os.NewSyscallError("ioctl", err)
+	}
+	if cfg.Up {
+		err = setUp(&req)
+		if err != nil {
+			return err
+		}
+	}
+	name := req.name[:]
+	for i, b := range name {
+		if b == 0 {
+			name = name[:i]
+			break
+		}
+	}
+	iface, err := net.InterfaceByName(string(name))
+	if err != nil {
+		return err
+	}
+	c.iface = *iface
+	return nil
+}
+
+// setUp sets the IFF_UP flag of the interface named in req.
+func setUp(req *ifreq) error {
+	// Interface flags are set through any socket.
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+	flags := ifreq{name: req.name}
+	err = ioctl(fd, syscall.SIOCGIFFLAGS, &flags)
+	if err == nil {
+		flags.flags |= syscall.IFF_UP
+		err = ioctl(fd, syscall.SIOCSIFFLAGS, &flags)
+	}
+	if err != nil {
+		return os.NewSyscallError("ioctl", err)
+	}
+	return nil
+}
+
+// Name returns the name of the interface.
+func (c *Conn) Name() string { return c.iface.Name }
+
+// HardwareAddr6 returns the hardware address of the host's side of the
+// interface. It is not the address the stack should use, see the package documentation.
+func (c *Conn) HardwareAddr6() (hw [6]byte) {
+	copy(hw[:], c.iface.HardwareAddr)
+	return hw
+}
+
+// MTU returns the MTU of the interface with the Ethernet header included, as
+// expected by [github.com/soypat/seqs/stacks.PortStackConfig].
+func (c *Conn) MTU() int {
+	const sizeEthernetHeader = 14
+	return c.iface.MTU + sizeEthernetHeader
+}
+
+// Recv reads the next frame sent by the host into dst and returns its length,
+// or zero if no frame is available. Frames longer than dst are truncated.
+func (c *Conn) Recv(dst []byte) (int, error) {
+	if c.fd < 0 {
+		return 0, errClosed
+	}
+	n, err := syscall.Read(c.fd, dst)
+	switch {
+	case err == syscall.EAGAIN || err == syscall.EINTR:
+		return 0, nil
+	case err != nil:
+		return 0, os.NewSyscallError("read", err)
+	}
+	return n, nil
+}
+
+// Send writes the Ethernet frame to the host. Frames sent while the interface
+// is down are reported as an error, which
+// [github.com/soypat/seqs/stacks.PortStack.TxDone] may be notified of.
+func (c *Conn) Send(frame []byte) error {
+	if c.fd < 0 {
+		return errClosed
+	}
+	for {
+		_, err := syscall.Write(c.fd, frame)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return os.NewSyscallError("write", err)
+		}
+		return nil
+	}
+}
+
+// Wait blocks until a frame is available to [Conn.Recv] or timeout elapses
+// and reports whether a frame is available.
+func (c *Conn) Wait(timeout time.Duration) (bool, error) {
+	if c.fd < 0 {
+		return false, errClosed
+	}
+	var set syscall.FdSet
+	bits := 8 * int(unsafe.Sizeof(set.Bits[0]))
+	set.Bits[c.fd/bits] |= 1 << uint(c.fd%bits)
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+	n, err := syscall.Select(c.fd+1, &set, nil, nil, &tv)
+	if err == syscall.EINTR {
+		return false, nil
+	} else if err != nil {
+		return false, os.NewSyscallError("select", err)
+	}
+	return n > 0, nil
+}
+
+// Close closes the device, removing the interface unless it was made persistent.
+func (c *Conn) Close() error {
+	if c.fd < 0 {
+		return errClosed
+	}
+	err := syscall.Close(c.fd)
+	c.fd = -1
+	return err
+}
+
+// ifreq is struct ifreq of linux/if.h with the ifr_flags member of its union.
+type ifreq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [24 - 2]byte
+}
+
+func ioctl(fd int, req uintptr, arg *ifreq) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(arg)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
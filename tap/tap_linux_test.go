@@ -0,0 +1,57 @@
+package tap
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	conn, err := Open("", Config{Up: true})
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+		t.Skip("TAP devices require /dev/net/tun and CAP_NET_ADMIN")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Name() == "" || conn.MTU() <= 14 {
+		t.Fatalf("bad interface %q with MTU %d", conn.Name(), conn.MTU())
+	}
+	// Broadcast with a local experimental EtherType, received and dropped by the host.
+	frame := make([]byte, 60)
+	copy(frame, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1, 0x88, 0xb5})
+	copy(frame[14:], "tap frame")
+	before := rxPackets(t, conn.Name())
+	err = conn.Send(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rxPackets(t, conn.Name()); got != before+1 {
+		t.Errorf("host received %d frames, want %d", got-before, 1)
+	}
+	var buf [2048]byte
+	for {
+		// Drain frames sent by the host, i.e: IPv6 router solicitations.
+		n, err := conn.Recv(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		} else if n == 0 {
+			break
+		}
+	}
+}
+
+func rxPackets(t *testing.T, ifname string) int {
+	t.Helper()
+	b, err := os.ReadFile("/sys/class/net/" + ifname + "/statistics/rx_packets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}